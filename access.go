@@ -0,0 +1,59 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The access(2) mask bit asking for write permission.
+const accessWrite = 0x2 // W_OK
+
+// AccessCheck returns the AccessOp the file system must approve before the
+// supplied op, read from the connection, is carried out, or nil if there is
+// none. There is one only when MountConfig.CheckWriteAccess is set, for opens
+// for writing and for SetInodeAttributesOp, asking for write access to the
+// inode on behalf of the op's caller. Servers should call the file system
+// with it, and fail op with the error if that returns one.
+func (c *Connection) AccessCheck(op interface{}) *fuseops.AccessOp {
+	if !c.cfg.CheckWriteAccess {
+		return nil
+	}
+
+	switch typed := op.(type) {
+	case *fuseops.OpenFileOp:
+		if fusekernel.OpenFlags(typed.Flags).IsReadOnly() {
+			return nil
+		}
+
+		return &fuseops.AccessOp{
+			Metadata: typed.Metadata,
+			Inode:    typed.Inode,
+			Mask:     accessWrite,
+			For:      op,
+		}
+
+	case *fuseops.SetInodeAttributesOp:
+		return &fuseops.AccessOp{
+			Metadata: typed.Metadata,
+			Inode:    typed.Inode,
+			Mask:     accessWrite,
+			For:      op,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync/atomic"
+)
+
+// Every op that ReadOp hands out must be replied to exactly once. The
+// connection keeps count of how each was finished, and reports ops replied to
+// more than once, whose later replies would otherwise answer whatever request
+// the kernel has since given the same ID, or be rejected as unknown. An op
+// whose context is garbage collected without a reply can no longer be
+// replied to by anyone, and would leave the process that made it waiting
+// forever; the connection fails it with EIO. Either is logged to the
+// ErrorLogger, delivered on MountedFileSystem.Errors, and, if strict mode's
+// action is StrictPanic, panics.
+
+// OpAccounting counts how the ops read from a connection were finished.
+// Replied, Interrupted and Discarded account for every op read once it has
+// been replied to; DoubleReplies and Unreplied count bugs in the server.
+type OpAccounting struct {
+	// Ops read from the kernel, whether handed out by ReadOp or answered by the
+	// connection itself.
+	Read uint64
+
+	// Replies written to the kernel, including for ops that need none, such
+	// as forgets.
+	Replied uint64
+
+	// Replies the kernel refused because it had stopped waiting for them, e.g.
+	// for interrupted ops. See Connection.DroppedReplies.
+	Interrupted uint64
+
+	// Replies not written or not accepted because the kernel had hung up, the
+	// op had been failed in degraded mode, or writing failed.
+	Discarded uint64
+
+	// Replies to ops that had already been replied to, which were ignored.
+	DoubleReplies uint64
+
+	// Ops garbage collected without a reply, which the connection failed with
+	// EIO. They are also counted by the replies above.
+	Unreplied uint64
+}
+
+// InFlight returns the number of ops read and not yet replied to.
+func (a OpAccounting) InFlight() uint64 {
+	return a.Read - a.Replied - a.Interrupted - a.Discarded
+}
+
+// How the reply to an op turned out.
+type opOutcome int
+
+const (
+	outcomeReplied opOutcome = iota
+	outcomeInterrupted
+	outcomeDiscarded
+)
+
+// Shared by the copies of an op's opState, to tell whether it has been
+// replied to. Nothing else refers to it, so that it is garbage collected if
+// the op's context is.
+type opRecord struct {
+	fuseID uint64
+
+	// Set to one by the first reply. Accessed atomically.
+	replied uint32
+}
+
+// Start accounting for an op read from the kernel, returning the record to
+// attach to its state, state.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) accountOp(
+	fuseID uint64,
+	state opState) *opRecord {
+	c.mu.Lock()
+	c.accounting.Read++
+	c.mu.Unlock()
+
+	// The finalizer must not refer to the record, or it would never run.
+	r := &opRecord{fuseID: fuseID}
+	runtime.SetFinalizer(r, func(r *opRecord) {
+		state.record = r
+		c.unreplied(state)
+	})
+
+	return r
+}
+
+// Note that the op with the given state is being replied to, returning false
+// if it already has been.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) claimReply(state opState) bool {
+	r := state.record
+	if !atomic.CompareAndSwapUint32(&r.replied, 0, 1) {
+		c.mu.Lock()
+		c.accounting.DoubleReplies++
+		c.mu.Unlock()
+
+		c.accountingViolation(
+			state.op,
+			fmt.Sprintf("Op 0x%08x: %T replied to more than once", r.fuseID, state.op))
+
+		return false
+	}
+
+	runtime.SetFinalizer(r, nil)
+	return true
+}
+
+// Record how the reply to an op turned out.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) finishAccounting(o opOutcome) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch o {
+	case outcomeReplied:
+		c.accounting.Replied++
+
+	case outcomeInterrupted:
+		c.accounting.Interrupted++
+
+	default:
+		c.accounting.Discarded++
+	}
+}
+
+// Fail an op that can no longer be replied to, its record having been found
+// unreachable.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) unreplied(state opState) {
+	c.mu.Lock()
+	c.accounting.Unreplied++
+	c.mu.Unlock()
+
+	c.accountingViolation(
+		state.op,
+		fmt.Sprintf("Op 0x%08x: %T was never replied to", state.record.fuseID, state.op))
+
+	c.Reply(context.WithValue(context.Background(), contextKey, state), EIO)
+}
+
+// Report a violation of the accounting rules described above.
+func (c *Connection) accountingViolation(
+	op interface{},
+	msg string) {
+	if c.errorLogger != nil {
+		c.errorLogger.Print(msg)
+	}
+
+	c.reportError(OpError{
+		Op:  fmt.Sprintf("%T", op),
+		Err: errors.New(msg),
+	})
+
+	if c.cfg.Strict != nil && c.cfg.Strict.Action == StrictPanic {
+		panic(msg)
+	}
+}
+
+// OpAccounting returns the counts so far of how the ops read from the kernel
+// were finished.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) OpAccounting() OpAccounting {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.accounting
+}
+
+// OpAccounting returns the counts so far of how the ops read from the kernel
+// were finished.
+func (mfs *MountedFileSystem) OpAccounting() OpAccounting {
+	return mfs.conn.OpAccounting()
+}
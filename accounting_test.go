@@ -0,0 +1,168 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A server with a bug in how it replies to StatFSOps: with double set, it
+// replies twice; otherwise, not at all. It fails other ops with ENOSYS.
+type buggyServer struct {
+	double bool
+
+	// Receives what each second reply panicked with, if it did.
+	panics chan interface{}
+}
+
+func (s *buggyServer) ServeOps(c *fuse.Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		if _, ok := op.(*fuseops.StatFSOp); !ok {
+			c.Reply(ctx, fuse.ENOSYS)
+			continue
+		}
+
+		if !s.double {
+			continue
+		}
+
+		c.Reply(ctx, nil)
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					s.panics <- r
+				}
+			}()
+
+			c.Reply(ctx, nil)
+		}()
+	}
+}
+
+func TestOpAccounting_DoubleReply(t *testing.T) {
+	for _, panics := range []bool{false, true} {
+		var logged bytes.Buffer
+		cfg := &fuse.MountConfig{ErrorLogger: log.New(&logged, "", 0)}
+		if panics {
+			cfg.Strict = &fuse.StrictConfig{Action: fuse.StrictPanic}
+		}
+
+		s := &buggyServer{double: true, panics: make(chan interface{}, 1)}
+		k, err := fusetesting.NewFakeKernel(s, cfg)
+		if err != nil {
+			t.Fatalf("NewFakeKernel: %v", err)
+		}
+
+		// The kernel gets the first reply. The second would answer an unknown
+		// request, or worse, a later one given the same ID.
+		if _, err := k.Call(fusekernel.OpStatfs, uint64(fuseops.RootInodeID), nil); err != nil {
+			t.Errorf("Statfs: %v", err)
+		}
+
+		if err := k.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+
+		// Each op read was replied to once nonetheless.
+		got := k.MountedFileSystem().OpAccounting()
+		if got.DoubleReplies != 1 || got.Replied != got.Read || got.InFlight() != 0 {
+			t.Errorf("Panics %v: got %+v", panics, got)
+		}
+
+		const msg = "*fuseops.StatFSOp replied to more than once"
+		if !strings.Contains(logged.String(), msg) {
+			t.Errorf("Panics %v: logged %q", panics, logged.String())
+		}
+
+		var r interface{}
+		select {
+		case r = <-s.panics:
+		default:
+		}
+
+		if panics != (r != nil) || (r != nil && !strings.Contains(fmt.Sprint(r), msg)) {
+			t.Errorf("Panics %v: got panic %v", panics, r)
+		}
+	}
+}
+
+func TestOpAccounting_Unreplied(t *testing.T) {
+	k, err := fusetesting.NewFakeKernel(&buggyServer{}, &fuse.MountConfig{})
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := k.Call(fusekernel.OpStatfs, uint64(fuseops.RootInodeID), nil)
+		done <- err
+	}()
+
+	// Once the op's context has been collected, nothing can reply to it, and
+	// the connection fails it.
+	deadline := time.After(10 * time.Second)
+	for err = nil; err == nil; {
+		runtime.GC()
+
+		select {
+		case err = <-done:
+		case <-time.After(10 * time.Millisecond):
+			continue
+
+		case <-deadline:
+			t.Fatal("Timed out waiting for the unreplied op to fail")
+		}
+
+		if err != syscall.EIO {
+			t.Errorf("Statfs: got %v, want EIO", err)
+		}
+
+		break
+	}
+
+	got := k.MountedFileSystem().OpAccounting()
+	if got.Unreplied != 1 || got.Replied != got.Read || got.InFlight() != 0 {
+		t.Errorf("Got %+v", got)
+	}
+
+	select {
+	case e := <-k.MountedFileSystem().Errors():
+		if !strings.Contains(e.Err.Error(), "was never replied to") {
+			t.Errorf("Reported %v", e)
+		}
+
+	default:
+		t.Error("Nothing reported")
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// AtimePolicy says when a file's access time should be updated as it is
+// read, corresponding to the relatime, strictatime and noatime mount options.
+//
+// The Linux kernel never updates access times of FUSE inodes itself, and so
+// never sends a SetInodeAttributesOp because a file was read; those it does
+// send for atime come from explicit calls like utimensat(2). A file system
+// that keeps access times must update them itself when serving reads, and
+// can use the mount's policy (see MountInfo.Atime) to decide when to pay
+// for doing so.
+type AtimePolicy int
+
+const (
+	// Update the access time only if it is no later than the modification or
+	// change time, or is at least a day old. This is the kernel's default.
+	AtimeRelative AtimePolicy = iota
+
+	// Update the access time on every read.
+	AtimeStrict
+
+	// Never update the access time on reads.
+	AtimeNone
+)
+
+func (p AtimePolicy) String() string {
+	switch p {
+	case AtimeRelative:
+		return "relatime"
+
+	case AtimeStrict:
+		return "strictatime"
+
+	case AtimeNone:
+		return "noatime"
+
+	default:
+		return "AtimePolicy(unknown)"
+	}
+}
+
+// ShouldUpdate says whether, under policy p, a read at time now of an inode
+// with the supplied attributes should update its access time. The rules for
+// AtimeRelative are those of the kernel's relatime_need_update.
+func (p AtimePolicy) ShouldUpdate(
+	attrs *fuseops.InodeAttributes,
+	now time.Time) bool {
+	switch p {
+	case AtimeStrict:
+		return true
+
+	case AtimeNone:
+		return false
+	}
+
+	if !attrs.Atime.After(attrs.Mtime) || !attrs.Atime.After(attrs.Ctime) {
+		return true
+	}
+
+	return now.Sub(attrs.Atime) >= 24*time.Hour
+}
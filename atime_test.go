@@ -0,0 +1,296 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const atimeFileInode = fuseops.RootInodeID + 1
+
+// Serves a single file, foo, keeping its access time according to the
+// mount's policy and counting the work that involves.
+type atimeFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	attrs fuseops.InodeAttributes
+
+	// The number of reads that updated the access time.
+	//
+	// GUARDED_BY(mu)
+	atimeUpdates int
+
+	// Every SetInodeAttributesOp received.
+	//
+	// GUARDED_BY(mu)
+	setattrs []fuseops.SetInodeAttributesOp
+}
+
+func newAtimeFS() *atimeFS {
+	t := time.Now().Add(-time.Hour)
+	return &atimeFS{
+		attrs: fuseops.InodeAttributes{
+			Size:  4,
+			Nlink: 1,
+			Mode:  0644,
+			Atime: t,
+			Mtime: t,
+			Ctime: t,
+			Uid:   uint32(os.Getuid()),
+			Gid:   uint32(os.Getgid()),
+		},
+	}
+}
+
+func (fs *atimeFS) attributes(ino fuseops.InodeID) fuseops.InodeAttributes {
+	if ino == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0755 | os.ModeDir,
+			Uid:   uint32(os.Getuid()),
+			Gid:   uint32(os.Getgid()),
+		}
+	}
+
+	return fs.attrs
+}
+
+func (fs *atimeFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Entry.Child = atimeFileInode
+	op.Entry.Attributes = fs.attributes(atimeFileInode)
+	return nil
+}
+
+func (fs *atimeFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *atimeFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.setattrs = append(fs.setattrs, *op)
+	if op.Atime != nil {
+		fs.attrs.Atime = *op.Atime
+	}
+
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *atimeFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	// Make sure every read reaches us.
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fs *atimeFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	info, _ := fuse.MountInfoFromContext(ctx)
+	if now := time.Now(); info.Atime.ShouldUpdate(&fs.attrs, now) {
+		fs.attrs.Atime = now
+		fs.atimeUpdates++
+	}
+
+	if op.Offset < 4 {
+		op.BytesRead = copy(op.Dst, "taco"[op.Offset:])
+	}
+
+	return nil
+}
+
+// Return the options with which the file system at dir is mounted, according
+// to /proc/self/mountinfo.
+func mountOptions(t *testing.T, dir string) string {
+	contents, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 5 && fields[4] == dir {
+			return fields[5]
+		}
+	}
+
+	t.Fatalf("%s not found in mountinfo", dir)
+	return ""
+}
+
+func TestAtimePolicy(t *testing.T) {
+	const reads = 100
+
+	testCases := []struct {
+		policy fuse.AtimePolicy
+
+		// Expected number of atime updates made by the file system.
+		updates int
+	}{
+		{fuse.AtimeNone, 0},
+		{fuse.AtimeRelative, 1},
+		{fuse.AtimeStrict, reads},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "atime_test")
+			if err != nil {
+				t.Fatalf("TempDir: %v", err)
+			}
+
+			defer os.Remove(dir)
+
+			fs := newAtimeFS()
+			mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+				FSName: "atime_test",
+				Atime:  tc.policy,
+			})
+
+			if err != nil {
+				t.Skipf("Mount: %v", err)
+			}
+
+			defer func() {
+				if err := fuse.Unmount(dir); err != nil {
+					t.Errorf("Unmount: %v", err)
+				}
+
+				mfs.Join(context.Background())
+			}()
+
+			// The kernel should know the policy.
+			opts := strings.Split(mountOptions(t, dir), ",")
+			hasOpt := func(name string) bool {
+				for _, o := range opts {
+					if o == name {
+						return true
+					}
+				}
+
+				return false
+			}
+
+			if got, want := hasOpt("noatime"), tc.policy == fuse.AtimeNone; got != want {
+				t.Errorf("noatime in %v: %v, want %v", opts, got, want)
+			}
+
+			if got, want := hasOpt("relatime"), tc.policy == fuse.AtimeRelative; got != want {
+				t.Errorf("relatime in %v: %v, want %v", opts, got, want)
+			}
+
+			// A read-heavy workload.
+			p := path.Join(dir, "foo")
+			fd, err := syscall.Open(p, syscall.O_RDONLY, 0)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+
+			buf := make([]byte, 4)
+			for i := 0; i < reads; i++ {
+				if _, err := syscall.Pread(fd, buf, 0); err != nil {
+					t.Fatalf("Pread: %v", err)
+				}
+
+				var st syscall.Stat_t
+				if err := syscall.Fstat(fd, &st); err != nil {
+					t.Fatalf("Fstat: %v", err)
+				}
+			}
+
+			if err := syscall.Close(fd); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			// Whatever the policy, the kernel leaves access times to the file
+			// system, which updates them as the policy says.
+			fs.mu.Lock()
+			if n := len(fs.setattrs); n != 0 {
+				t.Errorf("%d SetInodeAttributes calls for reads: %v", n, fs.setattrs)
+			}
+
+			if fs.atimeUpdates != tc.updates {
+				t.Errorf("%d atime updates, want %d", fs.atimeUpdates, tc.updates)
+			}
+			fs.mu.Unlock()
+
+			// An explicit atime-only update, as from `touch -a`, arrives as an op
+			// that can be told apart from others cheaply.
+			const (
+				utimeNow  = (1 << 30) - 1
+				utimeOmit = (1 << 30) - 2
+			)
+
+			ts := []syscall.Timespec{{Nsec: utimeNow}, {Nsec: utimeOmit}}
+			if err := syscall.UtimesNano(p, ts); err != nil {
+				t.Fatalf("UtimesNano: %v", err)
+			}
+
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+
+			if n := len(fs.setattrs); n != 1 {
+				t.Fatalf("%d SetInodeAttributes calls for touch -a", n)
+			}
+
+			op := fs.setattrs[0]
+			if op.Atime == nil || !op.AtimeNow {
+				t.Errorf("Atime %v, AtimeNow %v", op.Atime, op.AtimeNow)
+			}
+
+			if op.Size != nil || op.Mode != nil || op.Mtime != nil || op.MtimeNow {
+				t.Errorf("Unexpected attributes in %+v", op)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// The default for MountConfig.AttributeHistoryInodes.
+const defaultAttributeHistoryInodes = 1024
+
+// AttributeRecord is an entry in the history of the attributes sent to the
+// kernel for an inode. See MountConfig.AttributeHistory.
+type AttributeRecord struct {
+	// When the reply carrying the attributes was sent, according to
+	// MountConfig.Clock.
+	Time time.Time
+
+	// The name of the op whose reply carried them, e.g. "GetInodeAttributesOp".
+	Op string
+
+	Attributes fuseops.InodeAttributes
+
+	// When the kernel stops trusting the attributes and asks again. If no later
+	// than Time, the kernel didn't cache them.
+	Expiration time.Time
+}
+
+// The attributes recently sent to the kernel for each of the inodes it was
+// most recently told about, or nil if not configured. Safe for concurrent
+// use.
+type attributeHistory struct {
+	clock     timeutil.Clock
+	perInode  int
+	maxInodes int
+
+	mu sync.Mutex
+
+	// The inodes, most recently updated at the front, each an *inodeHistory,
+	// and the corresponding elements by inode ID.
+	//
+	// GUARDED_BY(mu)
+	lru    list.List
+	inodes map[fuseops.InodeID]*list.Element
+}
+
+type inodeHistory struct {
+	inode fuseops.InodeID
+
+	// A ring of at most perInode records, of which next is the oldest once
+	// full.
+	records []AttributeRecord
+	next    int
+}
+
+// Create the history configured by cfg, or nil if it isn't wanted.
+func newAttributeHistory(
+	cfg *MountConfig,
+	clock timeutil.Clock) *attributeHistory {
+	if cfg.AttributeHistory <= 0 {
+		return nil
+	}
+
+	maxInodes := cfg.AttributeHistoryInodes
+	if maxInodes <= 0 {
+		maxInodes = defaultAttributeHistoryInodes
+	}
+
+	return &attributeHistory{
+		clock:     clock,
+		perInode:  cfg.AttributeHistory,
+		maxInodes: maxInodes,
+		inodes:    make(map[fuseops.InodeID]*list.Element),
+	}
+}
+
+// Record the attributes carried by the successful reply to op, if any. Does
+// nothing if h is nil.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *attributeHistory) recordReply(op interface{}) {
+	if h == nil {
+		return
+	}
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		h.recordEntry("LookUpInodeOp", &o.Entry)
+
+	case *fuseops.GetInodeAttributesOp:
+		h.record(
+			"GetInodeAttributesOp",
+			o.Inode,
+			&o.Attributes,
+			o.AttributesExpiration,
+			o.AttributesValidFor)
+
+	case *fuseops.SetInodeAttributesOp:
+		h.record(
+			"SetInodeAttributesOp",
+			o.Inode,
+			&o.Attributes,
+			o.AttributesExpiration,
+			o.AttributesValidFor)
+
+	case *fuseops.MkDirOp:
+		h.recordEntry("MkDirOp", &o.Entry)
+
+	case *fuseops.MkNodeOp:
+		h.recordEntry("MkNodeOp", &o.Entry)
+
+	case *fuseops.CreateFileOp:
+		h.recordEntry("CreateFileOp", &o.Entry)
+
+	case *fuseops.CreateSymlinkOp:
+		h.recordEntry("CreateSymlinkOp", &o.Entry)
+
+	case *fuseops.CreateLinkOp:
+		h.recordEntry("CreateLinkOp", &o.Entry)
+	}
+}
+
+// LOCKS_EXCLUDED(h.mu)
+func (h *attributeHistory) recordEntry(
+	opName string,
+	e *fuseops.ChildInodeEntry) {
+	// A zero child is a cached negative lookup, with no attributes.
+	if e.Child == 0 {
+		return
+	}
+
+	h.record(opName, e.Child, &e.Attributes, e.AttributesExpiration, e.AttributesValidFor)
+}
+
+// LOCKS_EXCLUDED(h.mu)
+func (h *attributeHistory) record(
+	opName string,
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes,
+	expiration time.Time,
+	validFor time.Duration) {
+	now := h.clock.Now()
+	if expiration.IsZero() {
+		expiration = now.Add(validFor)
+	}
+
+	r := AttributeRecord{
+		Time:       now,
+		Op:         opName,
+		Attributes: *attrs,
+		Expiration: expiration,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var ih *inodeHistory
+	if e, ok := h.inodes[inode]; ok {
+		h.lru.MoveToFront(e)
+		ih = e.Value.(*inodeHistory)
+	} else {
+		// Make room by forgetting the least recently updated inode.
+		if h.lru.Len() == h.maxInodes {
+			oldest := h.lru.Back()
+			h.lru.Remove(oldest)
+			delete(h.inodes, oldest.Value.(*inodeHistory).inode)
+		}
+
+		ih = &inodeHistory{inode: inode}
+		h.inodes[inode] = h.lru.PushFront(ih)
+	}
+
+	if len(ih.records) < h.perInode {
+		ih.records = append(ih.records, r)
+		return
+	}
+
+	ih.records[ih.next] = r
+	ih.next = (ih.next + 1) % h.perInode
+}
+
+// Return the records for the supplied inode, oldest first.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *attributeHistory) get(inode fuseops.InodeID) []AttributeRecord {
+	if h == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e, ok := h.inodes[inode]
+	if !ok {
+		return nil
+	}
+
+	ih := e.Value.(*inodeHistory)
+	records := make([]AttributeRecord, 0, len(ih.records))
+	records = append(records, ih.records[ih.next:]...)
+	records = append(records, ih.records[:ih.next]...)
+
+	return records
+}
+
+// AttributeHistory returns the attributes most recently sent to the kernel
+// for the supplied inode, oldest first, if MountConfig.AttributeHistory is
+// set. It returns nil if it isn't, or if the inode's history has been
+// forgotten or was never recorded.
+//
+// Comparing the history with what the backend holds tells whether stale
+// attributes seen by applications came from the backend, or from the kernel
+// trusting what it was told until the recorded expiration.
+func (mfs *MountedFileSystem) AttributeHistory(inode fuseops.InodeID) []AttributeRecord {
+	return mfs.conn.attrHistory.get(inode)
+}
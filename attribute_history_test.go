@@ -0,0 +1,202 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system in which the name of each child of the root is its inode ID,
+// and each inode's size counts the attributes handed out for it.
+type historyFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu    sync.Mutex
+	sizes map[fuseops.InodeID]uint64 // GUARDED_BY(mu)
+}
+
+func (fs *historyFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.sizes[inode]++
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0444, Size: fs.sizes[inode]}
+}
+
+func (fs *historyFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	n, err := strconv.Atoi(op.Name)
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	op.Entry.Child = fuseops.InodeID(n)
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	op.Entry.AttributesValidFor = time.Minute
+	return nil
+}
+
+func (fs *historyFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	op.AttributesValidFor = time.Second
+	return nil
+}
+
+func newHistoryKernel(
+	t *testing.T,
+	clock timeutil.Clock,
+	perInode int,
+	inodes int) *fusetesting.FakeKernel {
+	fs := &historyFS{sizes: make(map[fuseops.InodeID]uint64)}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			Clock:                  clock,
+			AttributeHistory:       perInode,
+			AttributeHistoryInodes: inodes,
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	return k
+}
+
+func TestAttributeHistory_Ring(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	start := time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local)
+	clock.SetTime(start)
+
+	k := newHistoryKernel(t, &clock, 3, 0)
+	defer k.Close()
+
+	if _, err := k.LookUp(fuseops.RootInodeID, "2"); err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		clock.AdvanceTime(time.Second)
+		if _, err := k.GetAttr(2); err != nil {
+			t.Fatalf("GetAttr: %v", err)
+		}
+	}
+
+	// The lookup and the first getattr have been pushed out.
+	h := k.MountedFileSystem().AttributeHistory(2)
+	if len(h) != 3 {
+		t.Fatalf("Got %d records: %+v", len(h), h)
+	}
+
+	for i, r := range h {
+		want := start.Add(time.Duration(i+2) * time.Second)
+		if r.Op != "GetInodeAttributesOp" ||
+			r.Attributes.Size != uint64(i+3) ||
+			!r.Time.Equal(want) ||
+			!r.Expiration.Equal(want.Add(time.Second)) {
+			t.Errorf("Record %d: %+v", i, r)
+		}
+	}
+
+	// A lookup is recorded along with its expiration.
+	clock.AdvanceTime(time.Second)
+	if _, err := k.LookUp(fuseops.RootInodeID, "2"); err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	h = k.MountedFileSystem().AttributeHistory(2)
+	last := h[len(h)-1]
+	if len(h) != 3 ||
+		last.Op != "LookUpInodeOp" ||
+		last.Attributes.Size != 6 ||
+		!last.Expiration.Equal(clock.Now().Add(time.Minute)) {
+		t.Errorf("Got %+v", h)
+	}
+
+	// Nothing was sent for other inodes.
+	if h := k.MountedFileSystem().AttributeHistory(3); h != nil {
+		t.Errorf("Inode 3: %+v", h)
+	}
+}
+
+func TestAttributeHistory_LeastRecentlyUpdatedForgotten(t *testing.T) {
+	k := newHistoryKernel(t, nil, 2, 2)
+	defer k.Close()
+
+	getAttr := func(inode fuseops.InodeID) {
+		if _, err := k.GetAttr(inode); err != nil {
+			t.Fatalf("GetAttr(%d): %v", inode, err)
+		}
+	}
+
+	remembered := func() (inodes []fuseops.InodeID) {
+		for inode := fuseops.InodeID(2); inode <= 5; inode++ {
+			if k.MountedFileSystem().AttributeHistory(inode) != nil {
+				inodes = append(inodes, inode)
+			}
+		}
+
+		return inodes
+	}
+
+	getAttr(2)
+	getAttr(3)
+	getAttr(2)
+	getAttr(4)
+
+	if got := remembered(); len(got) != 2 || got[0] != 2 || got[1] != 4 {
+		t.Errorf("Remembered %v, want [2 4]", got)
+	}
+
+	// A forgotten inode starts its history afresh.
+	getAttr(3)
+	h := k.MountedFileSystem().AttributeHistory(3)
+	if len(h) != 1 || h[0].Attributes.Size != 2 {
+		t.Errorf("Inode 3: %+v", h)
+	}
+}
+
+func TestAttributeHistory_Disabled(t *testing.T) {
+	k := newHistoryKernel(t, nil, 0, 0)
+	defer k.Close()
+
+	if _, err := k.GetAttr(2); err != nil {
+		t.Fatalf("GetAttr: %v", err)
+	}
+
+	if h := k.MountedFileSystem().AttributeHistory(2); h != nil {
+		t.Errorf("Got %+v", h)
+	}
+
+	// Replies cost nothing extra when there's no history.
+	op := &fuseops.GetInodeAttributesOp{Inode: 2, AttributesValidFor: time.Second}
+	if n := testing.AllocsPerRun(100, func() { fuse.RecordAttributesWithoutHistory(op) }); n != 0 {
+		t.Errorf("%v allocations per reply", n)
+	}
+}
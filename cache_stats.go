@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// CacheStats counts the requests whose rate depends on how well the kernel
+// caches what the file system tells it, and the invalidations that undo that
+// caching.
+//
+// The kernel doesn't report when it answers from its caches, so hits can't be
+// counted directly. Instead, compare the counts over a fixed workload, or
+// against a baseline such as the number of stat(2) calls the application
+// made: with entries cached for longer (ChildInodeEntry.EntryValidFor),
+// fewer LookUps are needed for the same path walks, and with attributes
+// cached for longer (AttributesValidFor), fewer GetAttrs. The fraction of
+// such calls that didn't reach the file system is the kernel's hit rate for
+// that workload. Invalidations force misses, so a high rate of them relative
+// to lookups suggests that longer timeouts wouldn't help.
+//
+// Counts include ops failed by the connection itself, e.g. in degraded mode.
+type CacheStats struct {
+	// LookUpInodeOps, GetInodeAttributesOps and ReadDirOps received from the
+	// kernel.
+	LookUps  uint64
+	GetAttrs uint64
+	ReadDirs uint64
+
+	// Invalidations successfully sent to the kernel, whether directly or from
+	// the notification queue.
+	InodeInvalidations uint64
+	EntryInvalidations uint64
+}
+
+// Count op towards the cache statistics if it is one they cover.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) countCacheOp(op interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch op.(type) {
+	case *fuseops.LookUpInodeOp:
+		c.cacheStats.LookUps++
+
+	case *fuseops.GetInodeAttributesOp:
+		c.cacheStats.GetAttrs++
+
+	case *fuseops.ReadDirOp:
+		c.cacheStats.ReadDirs++
+	}
+}
+
+// CacheStats returns the counts so far of requests and invalidations bearing
+// on the kernel's caching. See CacheStats for how to interpret them.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) CacheStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cacheStats
+}
+
+// CacheStats returns the counts so far of requests and invalidations bearing
+// on the kernel's caching. See CacheStats for how to interpret them.
+func (mfs *MountedFileSystem) CacheStats() CacheStats {
+	return mfs.conn.CacheStats()
+}
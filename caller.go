@@ -0,0 +1,40 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// CallerFromContext returns the credentials of the process whose request
+// became the op associated with ctx, as the kernel gave them: the pid of the
+// calling thread and its fsuid and fsgid, mapped into the user namespace the
+// file system was mounted in. They are available for every op, not only those
+// with a Metadata field.
+//
+// Requests the kernel makes without a caller, such as forgets and releases,
+// carry zeros, and those it makes on its own behalf, such as writeback of the
+// page cache, may carry root's credentials. ctx must be, or be derived from,
+// a context returned by Connection.ReadOp; otherwise ok is false.
+func CallerFromContext(ctx context.Context) (caller fuseops.OpMetadata, ok bool) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return fuseops.OpMetadata{}, false
+	}
+
+	return convertMetadata(state.inMsg), true
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with an empty root that records the caller of each lookup,
+// by name.
+type callerFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	callers map[string]fuseops.OpMetadata // GUARDED_BY(mu)
+}
+
+func (fs *callerFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0755 | os.ModeDir}
+	return nil
+}
+
+func (fs *callerFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	caller, ok := fuse.CallerFromContext(ctx)
+	if !ok {
+		return syscall.EIO
+	}
+
+	fs.mu.Lock()
+	fs.callers[op.Name] = caller
+	fs.mu.Unlock()
+
+	return fuse.ENOENT
+}
+
+func TestCallerFromContext(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("Needs root to run commands as other users")
+	}
+
+	dir, err := ioutil.TempDir("", "caller_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fs := &callerFS{callers: make(map[string]fuseops.OpMetadata)}
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:     "callerfs",
+		AllowOther: true,
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Unmount(); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	testCases := []struct {
+		name string
+		uid  uint32
+		gid  uint32
+	}{
+		{"alice", 1001, 2001},
+		{"bob", 1002, 2002},
+	}
+
+	for _, tc := range testCases {
+		// stat(1) fails, since nothing exists, but only after the lookup.
+		cmd := exec.Command("stat", path.Join(dir, tc.name))
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: tc.uid, Gid: tc.gid},
+		}
+
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+
+		pid := uint32(cmd.Process.Pid)
+		cmd.Wait()
+
+		fs.mu.Lock()
+		caller, ok := fs.callers[tc.name]
+		fs.mu.Unlock()
+
+		if !ok {
+			t.Errorf("%s: no lookup", tc.name)
+			continue
+		}
+
+		want := fuseops.OpMetadata{Pid: pid, Uid: tc.uid, Gid: tc.gid}
+		if caller != want {
+			t.Errorf("%s: got caller %+v, want %+v", tc.name, caller, want)
+		}
+	}
+}
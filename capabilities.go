@@ -0,0 +1,251 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// CapabilitiesXattr is the extended attribute of the root of a mount through
+// which the library serves the file system's Capabilities, encoded as a JSON
+// object. Its fields are those of Capabilities, under the names given by
+// their json tags, plus "version", currently 1, which is bumped only for
+// changes that older readers would misunderstand.
+//
+// The attribute can't be set or removed, and isn't included in the root's
+// list of extended attributes, which is left to the file system.
+const CapabilitiesXattr = "user.fuse.capabilities"
+
+const capabilitiesVersion = 1
+
+// How a file system keeps the kernel's view of it current when it changes
+// other than through the mount, e.g. when its backend is shared with other
+// clients.
+type ConsistencyModel string
+
+const (
+	// All changes are made through the mount, so the kernel's caches are
+	// never stale.
+	ConsistencyExclusive ConsistencyModel = "exclusive"
+
+	// The file system tells the kernel about other changes as it learns of
+	// them, e.g. through MountedFileSystem.InvalidateInode, so they are seen
+	// promptly.
+	ConsistencyNotified ConsistencyModel = "notified"
+
+	// Other changes are seen once the kernel's cached entries and attributes
+	// expire, as set by the expiration times the file system gives.
+	ConsistencyExpiring ConsistencyModel = "expiring"
+)
+
+// Capabilities describes what a file system supports and how it behaves, so
+// that tools layered on a mount needn't work it out by experiment. A
+// fuse.Server declares them by implementing CapabilityReporter; the library
+// then serves them as CapabilitiesXattr, and reports them from
+// MountedFileSystem.Capabilities.
+//
+// fusetesting.CheckCapabilities checks a declaration against how the file
+// system behaves.
+type Capabilities struct {
+	// The ops the file system implements, named as the methods of
+	// fuseutil.FileSystem that handle them, e.g. "CreateLink" if files may
+	// have several hard links. Others are assumed to fail with ENOSYS.
+	Ops []string `json:"ops"`
+
+	// Whether Rename replaces an existing file in one step, so that the new
+	// name refers throughout to either the old file or the renamed one.
+	AtomicRename bool `json:"atomic_rename"`
+
+	// How changes made other than through the mount are seen, or the empty
+	// string if undeclared.
+	Consistency ConsistencyModel `json:"consistency,omitempty"`
+
+	// The size beyond which files can't be grown, which fails with EFBIG, or
+	// zero if the file system has no limit of its own.
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+}
+
+// A Server may implement CapabilityReporter to declare the capabilities of
+// the file system it serves. The server returned by
+// fuseutil.NewFileSystemServer does so by passing on the result of its
+// FileSystem's Capabilities method, if it has one.
+type CapabilityReporter interface {
+	// Return the file system's capabilities, or nil to declare none. Called
+	// once, when the file system is mounted.
+	Capabilities() *Capabilities
+}
+
+// The ops that may be named in Capabilities.Ops.
+var capabilityOps = map[string]bool{
+	"StatFS":             true,
+	"LookUpInode":        true,
+	"GetInodeAttributes": true,
+	"SetInodeAttributes": true,
+	"ForgetInode":        true,
+	"MkDir":              true,
+	"MkNode":             true,
+	"CreateFile":         true,
+	"CreateLink":         true,
+	"CreateSymlink":      true,
+	"Rename":             true,
+	"RmDir":              true,
+	"Unlink":             true,
+	"OpenDir":            true,
+	"ReadDir":            true,
+	"ReleaseDirHandle":   true,
+	"SyncDir":            true,
+	"OpenFile":           true,
+	"ReadFile":           true,
+	"WriteFile":          true,
+	"SyncFile":           true,
+	"FlushFile":          true,
+	"ReleaseFileHandle":  true,
+	"ReadSymlink":        true,
+	"RemoveXattr":        true,
+	"GetXattr":           true,
+	"ListXattr":          true,
+	"SetXattr":           true,
+	"Fallocate":          true,
+	"GetLock":            true,
+	"SetLock":            true,
+	"Poll":               true,
+	"Ioctl":              true,
+	"Lseek":              true,
+	"CopyFileRange":      true,
+	"Access":             true,
+}
+
+// The capabilities declared by a server, and their encoding as
+// CapabilitiesXattr.
+type declaredCapabilities struct {
+	caps    Capabilities
+	encoded []byte
+}
+
+// Ask server for its capabilities, returning nil if it declares none.
+func describeServer(server Server) (*declaredCapabilities, error) {
+	r, ok := server.(CapabilityReporter)
+	if !ok {
+		return nil, nil
+	}
+
+	caps := r.Capabilities()
+	if caps == nil {
+		return nil, nil
+	}
+
+	d := &declaredCapabilities{caps: *caps}
+	d.caps.Ops = append([]string{}, caps.Ops...)
+	sort.Strings(d.caps.Ops)
+
+	for i, op := range d.caps.Ops {
+		if !capabilityOps[op] {
+			return nil, fmt.Errorf("Unknown op %q", op)
+		}
+
+		if i > 0 && d.caps.Ops[i-1] == op {
+			return nil, fmt.Errorf("Op %q listed twice", op)
+		}
+	}
+
+	switch d.caps.Consistency {
+	case "", ConsistencyExclusive, ConsistencyNotified, ConsistencyExpiring:
+	default:
+		return nil, fmt.Errorf("Unknown consistency model %q", d.caps.Consistency)
+	}
+
+	if d.caps.MaxFileSize < 0 {
+		return nil, fmt.Errorf("Negative MaxFileSize: %d", d.caps.MaxFileSize)
+	}
+
+	encoded := struct {
+		Version int `json:"version"`
+		Capabilities
+	}{capabilitiesVersion, d.caps}
+
+	var err error
+	if d.encoded, err = json.Marshal(&encoded); err != nil {
+		return nil, fmt.Errorf("Encoding: %v", err)
+	}
+
+	return d, nil
+}
+
+// If op concerns CapabilitiesXattr, carry it out and return the error with
+// which it should be replied to, without involving the user. ok is false for
+// other ops, and for all ops if the server declared no capabilities.
+func (c *Connection) capabilitiesOp(op interface{}) (err error, ok bool) {
+	if c.capabilities == nil {
+		return nil, false
+	}
+
+	switch o := op.(type) {
+	case *fuseops.GetXattrOp:
+		if o.Inode != fuseops.RootInodeID || o.Name != CapabilitiesXattr {
+			return nil, false
+		}
+
+		value := c.capabilities.encoded
+		o.BytesRead = len(value)
+		switch {
+		case len(o.Dst) == 0:
+			// A request for the size.
+
+		case len(o.Dst) < len(value):
+			return syscall.ERANGE, true
+
+		default:
+			copy(o.Dst, value)
+		}
+
+		return nil, true
+
+	case *fuseops.SetXattrOp:
+		if o.Inode == fuseops.RootInodeID && o.Name == CapabilitiesXattr {
+			return syscall.EPERM, true
+		}
+
+	case *fuseops.RemoveXattrOp:
+		if o.Inode == fuseops.RootInodeID && o.Name == CapabilitiesXattr {
+			return syscall.EPERM, true
+		}
+	}
+
+	return nil, false
+}
+
+// Capabilities returns the capabilities declared by the server, with Ops
+// sorted, or nil if it declared none. See CapabilityReporter.
+func (c *Connection) Capabilities() *Capabilities {
+	if c.capabilities == nil {
+		return nil
+	}
+
+	caps := c.capabilities.caps
+	caps.Ops = append([]string{}, caps.Ops...)
+	return &caps
+}
+
+// Capabilities returns the capabilities declared by the file system's
+// server, with Ops sorted, or nil if it declared none. See
+// CapabilityReporter.
+func (mfs *MountedFileSystem) Capabilities() *Capabilities {
+	return mfs.conn.Capabilities()
+}
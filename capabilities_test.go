@@ -0,0 +1,175 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// A file system that declares the given capabilities, and whose root has every
+// extended attribute, with value "fs".
+type declaringFS struct {
+	fuseutil.NotImplementedFileSystem
+	caps *fuse.Capabilities
+}
+
+func (fs *declaringFS) Capabilities() *fuse.Capabilities {
+	return fs.caps
+}
+
+func (fs *declaringFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	op.BytesRead = copy(op.Dst, "fs")
+	if len(op.Dst) == 0 {
+		op.BytesRead = len("fs")
+	}
+
+	return nil
+}
+
+func (fs *declaringFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return nil
+}
+
+func (fs *declaringFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return nil
+}
+
+func TestCapabilities(t *testing.T) {
+	k, err := fusetesting.NewFakeKernel(
+		memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid())),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	caps := k.MountedFileSystem().Capabilities()
+	if caps == nil {
+		t.Fatal("Capabilities: nil")
+	}
+
+	if !sort.StringsAreSorted(caps.Ops) || len(caps.Ops) == 0 {
+		t.Errorf("Ops %v aren't sorted", caps.Ops)
+	}
+
+	if !caps.AtomicRename || caps.Consistency != fuse.ConsistencyExpiring {
+		t.Errorf("Capabilities: %+v", caps)
+	}
+
+	// The extended attribute agrees.
+	value, err := getXattr(k, fuse.CapabilitiesXattr)
+	if err != nil {
+		t.Fatalf("getXattr: %v", err)
+	}
+
+	var decoded struct {
+		Version int `json:"version"`
+		fuse.Capabilities
+	}
+
+	if err := json.Unmarshal(value, &decoded); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", value, err)
+	}
+
+	if decoded.Version != 1 || !reflect.DeepEqual(&decoded.Capabilities, caps) {
+		t.Errorf("Got %s, want version 1 of %+v", value, caps)
+	}
+
+	// It can't be changed, nor read into too small a buffer.
+	if err := setXattr(k, fuse.CapabilitiesXattr, []byte("{}")); err != syscall.EPERM {
+		t.Errorf("setXattr: got %v, want EPERM", err)
+	}
+
+	var in fusekernel.GetxattrIn
+	in.Size = 1
+
+	body := append([]byte(nil), (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:]...)
+	body = append(body, fuse.CapabilitiesXattr+"\x00"...)
+	if _, err := k.Call(fusekernel.OpGetxattr, uint64(fuseops.RootInodeID), body); err != syscall.ERANGE {
+		t.Errorf("Getxattr into 1 byte: got %v, want ERANGE", err)
+	}
+
+	// The result is a copy.
+	caps.Ops[0] = "changed"
+	if got := k.MountedFileSystem().Capabilities(); got.Ops[0] == "changed" {
+		t.Errorf("Capabilities shares its Ops: %v", got.Ops)
+	}
+}
+
+func TestCapabilities_Undeclared(t *testing.T) {
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&declaringFS{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	if caps := k.MountedFileSystem().Capabilities(); caps != nil {
+		t.Errorf("Capabilities: got %+v, want nil", caps)
+	}
+
+	// The name is the file system's own.
+	if value, err := getXattr(k, fuse.CapabilitiesXattr); err != nil || string(value) != "fs" {
+		t.Errorf("getXattr: got %q, %v; want the file system's", value, err)
+	}
+
+	if err := setXattr(k, fuse.CapabilitiesXattr, []byte("{}")); err != nil {
+		t.Errorf("setXattr: %v", err)
+	}
+}
+
+func TestCapabilities_Invalid(t *testing.T) {
+	testCases := []fuse.Capabilities{
+		{Ops: []string{"ReadFile", "Frobnicate"}},
+		{Ops: []string{"ReadFile", "ReadFile"}},
+		{Consistency: "sometimes"},
+		{MaxFileSize: -1},
+	}
+
+	for _, caps := range testCases {
+		caps := caps
+		fs := &declaringFS{caps: &caps}
+		k, err := fusetesting.NewFakeKernel(fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{})
+		if err == nil {
+			k.Close()
+			t.Errorf("%+v: NewFakeKernel succeeded", caps)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"io"
+
+	"github.com/jacobsa/fuse/fusecapture"
+)
+
+// CaptureConfig configures the recording of the raw messages exchanged with
+// the kernel, analogous to tcpdump(8), in the format of package fusecapture.
+// cmd/fusedump prints such captures. See MountConfig.Capture.
+//
+// Messages are recorded as they are read and written, before the kernel sees
+// any reply, so a slow Writer slows the file system down. Wrap files in a
+// bufio.Writer, and flush it once MountedFileSystem.Join has returned. If
+// writing fails, nothing more is recorded, and an OpError with Op "Capture"
+// is delivered on Errors.
+//
+// Captures include file names and, unless MaxPayload is set, file contents.
+type CaptureConfig struct {
+	// Where to write the capture. Must be non-nil.
+	Writer io.Writer
+
+	// If positive, at most this many bytes of each message after its header
+	// are recorded, as for fusecapture.NewWriter.
+	MaxPayload int
+}
+
+// Record msg, which went in the given direction, if capturing is enabled.
+func (c *Connection) captureMessage(
+	dir fusecapture.Direction,
+	msg []byte) {
+	if c.capture == nil {
+		return
+	}
+
+	if err := c.capture.WriteRecord(c.clock.Now(), dir, msg); err != nil {
+		c.captureFailed.Do(func() {
+			c.reportError(OpError{Op: "Capture", Err: err})
+		})
+	}
+}
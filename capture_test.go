@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusecapture"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestCapture(t *testing.T) {
+	var buf bytes.Buffer
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		&fuse.MountConfig{
+			Capture: &fuse.CaptureConfig{Writer: &buf, MaxPayload: 4},
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	if _, err := k.LookUp(fuseops.RootInodeID, "foobar"); err == nil {
+		t.Fatal("LookUp succeeded")
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := fusecapture.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+
+	type summary struct {
+		dir    fusecapture.Direction
+		unique uint64
+		len    int
+		kept   int
+	}
+
+	var got []summary
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+
+		// Both headers start with the length, and have the request ID at the
+		// same offset.
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&rec.Data[0]))
+		if int(h.Len) != rec.Len {
+			t.Errorf("Header says %d bytes, record %d", h.Len, rec.Len)
+		}
+
+		got = append(got, summary{rec.Direction, h.Unique, rec.Len, len(rec.Data)})
+	}
+
+	inHeaderSize := int(unsafe.Sizeof(fusekernel.InHeader{}))
+	initInSize := int(unsafe.Sizeof(fusekernel.InitIn{}))
+	lookupSize := inHeaderSize + len("foobar\x00")
+
+	want := []summary{
+		{fusecapture.FromKernel, 1, inHeaderSize + initInSize, inHeaderSize + 4},
+		{fusecapture.ToKernel, 1, -1, buffer.OutMessageHeaderSize + 4},
+		{fusecapture.FromKernel, 2, lookupSize, inHeaderSize + 4},
+		{fusecapture.ToKernel, 2, buffer.OutMessageHeaderSize, buffer.OutMessageHeaderSize},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("Records:\n got %+v\nwant %+v", got, want)
+	}
+
+	// The size of the init reply depends on the protocol version.
+	want[1].len = got[1].len
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Record %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// A writer that fails once it has accepted n writes.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n == 0 {
+		return 0, errors.New("taco")
+	}
+
+	w.n--
+	return len(p), nil
+}
+
+func TestCapture_WriteFailure(t *testing.T) {
+	// Accept the file header and the init request and reply.
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		&fuse.MountConfig{
+			Capture: &fuse.CaptureConfig{Writer: &failingWriter{n: 3}},
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	// The file system carries on regardless.
+	for i := 0; i < 2; i++ {
+		if _, err := k.LookUp(fuseops.RootInodeID, "foo"); err != syscall.ENOSYS {
+			t.Errorf("LookUp: got %v, want ENOSYS", err)
+		}
+	}
+
+	// The failure is reported once.
+	mfs := k.MountedFileSystem()
+	select {
+	case e := <-mfs.Errors():
+		if e.Op != "Capture" {
+			t.Errorf("Unexpected error: %#v", e)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("No error delivered")
+	}
+
+	select {
+	case e := <-mfs.Errors():
+		t.Errorf("Unexpected second error: %#v", e)
+
+	default:
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A directory entry on which a child mount rests. See MountGroup.AddChildMount.
+type anchorEntry struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// A mount added to a MountGroup by AddChildMount.
+type childMount struct {
+	mfs *MountedFileSystem
+
+	// The mount within which mfs is mounted.
+	parent *MountedFileSystem
+}
+
+// How often AddChildMount checks whether the anchor directory has appeared.
+const anchorPollInterval = 10 * time.Millisecond
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) addAnchor(a anchorEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.anchors == nil {
+		c.anchors = make(map[anchorEntry]int)
+	}
+
+	c.anchors[a]++
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) removeAnchor(a anchorEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.anchors[a]--
+	if c.anchors[a] == 0 {
+		delete(c.anchors, a)
+	}
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) isAnchor(a anchorEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.anchors[a] > 0
+}
+
+// Wait until dir can be statted and is a directory, or ctx is done.
+func waitForDir(
+	ctx context.Context,
+	dir string) error {
+	for {
+		var st syscall.Stat_t
+		err := syscall.Stat(dir, &st)
+		switch {
+		case err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR:
+			return nil
+
+		case err == nil || err == syscall.ENOTDIR:
+			return fmt.Errorf("%s is not a directory", dir)
+
+		case err != syscall.ENOENT:
+			return fmt.Errorf("Stat: %v", err)
+		}
+
+		select {
+		case <-time.After(anchorPollInterval):
+		case <-ctx.Done():
+			return fmt.Errorf("Waiting for %s: %v", dir, ctx.Err())
+		}
+	}
+}
+
+// Return whether mfs is a mount in the group that hasn't ended.
+//
+// LOCKS_REQUIRED(g.mu)
+func (g *MountGroup) hasLiveMount(mfs *MountedFileSystem) bool {
+	if mountEnded(mfs) {
+		return false
+	}
+
+	for _, m := range g.mounts {
+		if m == mfs {
+			return true
+		}
+	}
+
+	for _, c := range g.children {
+		if c.mfs == mfs {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AddChildMount mounts server on the directory at the relative path rel
+// within parent, a mount in the group (possibly itself a child mount), so
+// that another file system appears inside the parent's tree. The server
+// needn't be the group's; invalidations sent through the group don't go to
+// child mounts, whose inode IDs are their own.
+//
+// The directory must be provided by the parent's file system, which needn't
+// have created it yet: AddChildMount waits for it to become visible, up to
+// the deadline of ctx. A file system that creates it after the kernel has
+// looked the name up must invalidate the kernel's cached negative entry (see
+// Connection.InvalidateEntry). AddChildMount therefore mustn't be called
+// from an op handler, or with locks held that the parent's ops need.
+//
+// Once the child is mounted, paths crossing the anchor directory lead into
+// the child's file system, whose root is reported by stat(2) and statfs(2)
+// there, with the child's device number. Listing the parent directory of the
+// anchor still shows the parent's entry for it, which should therefore be a
+// directory, as the child's root is. The parent's file system must keep
+// answering lookups of the anchor with the same inode: the kernel detaches
+// mounts from directory entries it finds to be stale. For the same reason,
+// while the child is mounted, invalidating the anchor's entry fails rather
+// than reaching the kernel.
+//
+// UnmountAll and Unmount unmount child mounts before the mounts they rest on,
+// which the kernel otherwise refuses to unmount with EBUSY.
+//
+// LOCKS_EXCLUDED(g.mu)
+func (g *MountGroup) AddChildMount(
+	ctx context.Context,
+	parent *MountedFileSystem,
+	rel string,
+	server Server,
+	config *MountConfig) (*MountedFileSystem, error) {
+	if rel == "" ||
+		path.IsAbs(rel) ||
+		path.Clean(rel) != rel ||
+		rel == "." ||
+		rel == ".." ||
+		strings.HasPrefix(rel, "../") {
+		return nil, fmt.Errorf("AddChildMount: invalid relative path %q", rel)
+	}
+
+	g.mu.Lock()
+	ok := !g.closed && g.hasLiveMount(parent)
+	g.mu.Unlock()
+
+	if !ok {
+		return nil, errors.New("AddChildMount: the parent isn't a live mount in the group")
+	}
+
+	dir := path.Join(parent.Dir(), rel)
+	if err := waitForDir(ctx, dir); err != nil {
+		return nil, fmt.Errorf("AddChildMount: %v", err)
+	}
+
+	// Find the entry on which the child will rest, which must belong to the
+	// parent rather than to a mount within it.
+	var root, container syscall.Stat_t
+	if err := syscall.Stat(parent.Dir(), &root); err != nil {
+		return nil, fmt.Errorf("AddChildMount: Stat: %v", err)
+	}
+
+	if err := syscall.Stat(path.Dir(dir), &container); err != nil {
+		return nil, fmt.Errorf("AddChildMount: Stat: %v", err)
+	}
+
+	if container.Dev != root.Dev {
+		return nil, fmt.Errorf(
+			"AddChildMount: %s lies within another mount; add the child to that",
+			dir)
+	}
+
+	anchor := anchorEntry{
+		parent: fuseops.InodeID(container.Ino),
+		name:   path.Base(dir),
+	}
+
+	mfs, err := Mount(dir, server, config)
+	if err != nil {
+		return nil, fmt.Errorf("AddChildMount: %v", err)
+	}
+
+	parent.conn.addAnchor(anchor)
+	go func() {
+		<-mfs.joinStatusAvailable
+		parent.conn.removeAnchor(anchor)
+	}()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// UnmountAll may have been called in the meantime, in which case it didn't
+	// see the child.
+	if g.closed {
+		Unmount(dir)
+		return nil, errors.New("AddChildMount: the group has been shut down")
+	}
+
+	g.children = append(g.children, &childMount{
+		mfs:    mfs,
+		parent: parent,
+	})
+
+	return mfs, nil
+}
+
+// Return the live child mounts resting on mfs, directly or not, ordered so
+// that each comes before the mount it rests on.
+//
+// LOCKS_REQUIRED(g.mu)
+func (g *MountGroup) descendants(mfs *MountedFileSystem) (d []*MountedFileSystem) {
+	for _, c := range g.children {
+		if c.parent == mfs && !mountEnded(c.mfs) {
+			d = append(d, g.descendants(c.mfs)...)
+			d = append(d, c.mfs)
+		}
+	}
+
+	return d
+}
+
+// Unmount unmounts mfs, a mount in the group, after unmounting the child
+// mounts resting on it, deepest first. It stops at the first failure, leaving
+// the rest mounted. Like UnmountAll, it doesn't wait for the connections to
+// end.
+//
+// LOCKS_EXCLUDED(g.mu)
+func (g *MountGroup) Unmount(mfs *MountedFileSystem) error {
+	g.mu.Lock()
+	ms := append(g.descendants(mfs), mfs)
+	g.mu.Unlock()
+
+	for _, m := range ms {
+		if err := Unmount(m.Dir()); err != nil && !mountEnded(m) {
+			return fmt.Errorf("Unmount: %s: %v", m.Dir(), err)
+		}
+	}
+
+	return nil
+}
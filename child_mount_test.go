@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// The block count reported by statFSFS.
+const childBlocks = 12345
+
+// Wraps a file system, reporting a distinctive block count from StatFS.
+type statFSFS struct {
+	fuseutil.FileSystem
+}
+
+func (fs *statFSFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	op.BlockSize = 4096
+	op.Blocks = childBlocks
+	return nil
+}
+
+// Mount a memfs, and within it a child memfs on the directory "sub", which
+// the parent creates only after the child has been asked for. The caller
+// must call cleanup.
+func mountWithChild(t *testing.T) (
+	g *fuse.MountGroup,
+	parent *fuse.MountedFileSystem,
+	child *fuse.MountedFileSystem,
+	cleanup func()) {
+	dir, err := ioutil.TempDir("", "child_mount_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+	g = fuse.NewMountGroup(memfs.NewMemFS(uid, gid))
+
+	config := &fuse.MountConfig{FSName: "child_mount_test"}
+	parent, err = g.AddMount(dir, config)
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("AddMount: %v", err)
+	}
+
+	cleanup = func() {
+		g.UnmountAll()
+		g.JoinAll(context.Background())
+		os.Remove(dir)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		syscall.Mkdir(path.Join(dir, "sub"), 0755)
+	}()
+
+	child, err = g.AddChildMount(
+		ctx,
+		parent,
+		"sub",
+		fuseutil.NewFileSystemServer(&statFSFS{memfs.NewFileSystem(uid, gid)}),
+		config)
+
+	if err != nil {
+		cleanup()
+		t.Fatalf("AddChildMount: %v", err)
+	}
+
+	return g, parent, child, cleanup
+}
+
+func TestChildMount_Boundary(t *testing.T) {
+	g, parent, child, cleanup := mountWithChild(t)
+	defer cleanup()
+
+	dir := parent.Dir()
+	sub := path.Join(dir, "sub")
+	if child.Dir() != sub {
+		t.Errorf("Child mounted at %q", child.Dir())
+	}
+
+	// Files created beneath the anchor belong to the child, and have its
+	// device number.
+	writeFile(t, path.Join(sub, "foo"), syscall.O_CREAT, "taco")
+
+	root, anchor, foo := stat(t, dir), stat(t, sub), stat(t, path.Join(sub, "foo"))
+	if anchor.Dev == root.Dev {
+		t.Errorf("Anchor has the parent's device %d", root.Dev)
+	}
+
+	if foo.Dev != anchor.Dev {
+		t.Errorf("File has device %d; the child's root has %d", foo.Dev, anchor.Dev)
+	}
+
+	if anchor.Ino != uint64(fuseops.RootInodeID) {
+		t.Errorf("Anchor has inode %d, not the child's root", anchor.Ino)
+	}
+
+	// Walking back up leads to the parent.
+	if up := stat(t, path.Join(sub, "..")); up.Dev != root.Dev || up.Ino != root.Ino {
+		t.Errorf("sub/.. is device %d inode %d", up.Dev, up.Ino)
+	}
+
+	// statfs(2) at the anchor reports the child's file system.
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(sub, &st); err != nil {
+		t.Fatalf("Statfs: %v", err)
+	}
+
+	if st.Blocks != childBlocks {
+		t.Errorf("Statfs at the anchor reports %d blocks", st.Blocks)
+	}
+
+	// The parent lists the anchor as a directory, agreeing with the child's
+	// root.
+	if err := fusetesting.CheckDirentTypes(dir, false); err != nil {
+		t.Error(err)
+	}
+
+	// Invalidating the anchor's entry would detach the child.
+	if err := g.InvalidateEntry(fuseops.RootInodeID, "sub"); err == nil {
+		t.Error("InvalidateEntry of the anchor succeeded")
+	}
+}
+
+func TestChildMount_Unmount(t *testing.T) {
+	g, parent, child, cleanup := mountWithChild(t)
+	defer cleanup()
+
+	// The kernel won't unmount the parent from under the child.
+	if err := fuse.Unmount(parent.Dir()); err == nil {
+		t.Fatal("Unmounted the parent with the child still mounted")
+	}
+
+	if err := g.Unmount(parent); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, mfs := range []*fuse.MountedFileSystem{child, parent} {
+		if err := mfs.Join(ctx); err != nil {
+			t.Errorf("Join(%q): %v", mfs.Dir(), err)
+		}
+	}
+}
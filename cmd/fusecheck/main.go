@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// fusecheck walks a file system checking that its directory listings agree
+// with its lookups, printing each discrepancy found (see
+// fusetesting.CheckConsistency). Usage:
+//
+//	fusecheck [-lookup=paths] -sample=name [-root=dir]
+//	fusecheck mount-point
+//
+// With -sample, the named sample file system is served in-process, without
+// mounting anything: one of hellofs, dynamicfs, memfs, or loopbackfs, which
+// mirrors the directory given by -root. The paths given by -lookup, separated
+// by commas, are looked up first, and reported if they are found but not
+// listed. Other file systems can be checked the same way by passing their
+// server to fusetesting.NewFakeKernel and calling CheckConsistency.
+//
+// Given a mount point instead, the file system mounted there is walked
+// through the kernel (see fusetesting.CheckMountConsistency).
+//
+// The exit status is 1 if there were discrepancies.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples/dynamicfs"
+	"github.com/jacobsa/fuse/samples/hellofs"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
+	"github.com/jacobsa/fuse/samples/memfs"
+	"github.com/jacobsa/timeutil"
+)
+
+var fSample = flag.String("sample", "", "Sample file system to check in-process.")
+var fRoot = flag.String("root", "", "Directory for loopbackfs to mirror.")
+var fLookUp = flag.String("lookup", "", "Comma-separated paths to look up first.")
+
+// Create the named sample file system.
+func makeServer(
+	sample string,
+	root string) (fuse.Server, error) {
+	switch sample {
+	case "hellofs":
+		return hellofs.NewHelloFS(timeutil.RealClock())
+
+	case "dynamicfs":
+		return dynamicfs.NewDynamicFS(timeutil.RealClock())
+
+	case "memfs":
+		return memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid())), nil
+
+	case "loopbackfs":
+		if root == "" {
+			return nil, errors.New("loopbackfs needs -root")
+		}
+
+		return loopbackfs.NewLoopbackFS(root, loopbackfs.Config{})
+	}
+
+	return nil, fmt.Errorf("Unknown sample: %q", sample)
+}
+
+// Look up each component of the slash-separated path p in turn, ignoring
+// failures, which CheckConsistency needn't hear about.
+func lookUpPath(
+	k *fusetesting.FakeKernel,
+	p string) {
+	var inode fuseops.InodeID = fuseops.RootInodeID
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+
+		child, err := k.LookUp(inode, name)
+		if err != nil {
+			return
+		}
+
+		inode = child
+	}
+}
+
+// Check the named sample in-process, having first looked up the given paths.
+func checkSample(
+	sample string,
+	root string,
+	lookUps []string) ([]fusetesting.Discrepancy, error) {
+	server, err := makeServer(sample, root)
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := fusetesting.NewFakeKernel(server, &fuse.MountConfig{})
+	if err != nil {
+		return nil, fmt.Errorf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	for _, p := range lookUps {
+		lookUpPath(k, p)
+	}
+
+	return fusetesting.CheckConsistency(k)
+}
+
+// Print the discrepancies found, returning the exit status.
+func report(
+	w io.Writer,
+	found []fusetesting.Discrepancy) int {
+	for _, d := range found {
+		fmt.Fprintln(w, d)
+	}
+
+	if len(found) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+func main() {
+	flag.Parse()
+
+	if (*fSample == "") == (flag.NArg() == 0) || flag.NArg() > 1 {
+		fmt.Fprintf(
+			os.Stderr,
+			"Usage: %s [-lookup=paths] -sample=name [-root=dir]\n"+
+				"       %s mount-point\n",
+			os.Args[0],
+			os.Args[0])
+
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var found []fusetesting.Discrepancy
+	var err error
+
+	if *fSample != "" {
+		var lookUps []string
+		if *fLookUp != "" {
+			lookUps = strings.Split(*fLookUp, ",")
+		}
+
+		found, err = checkSample(*fSample, *fRoot, lookUps)
+	} else {
+		found, err = fusetesting.CheckMountConsistency(flag.Arg(0))
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	os.Exit(report(os.Stdout, found))
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckSample(t *testing.T) {
+	for _, sample := range []string{"hellofs", "dynamicfs", "memfs"} {
+		found, err := checkSample(sample, "", []string{"dir/world", "missing"})
+		if err != nil {
+			t.Fatalf("%s: %v", sample, err)
+		}
+
+		var out bytes.Buffer
+		if status := report(&out, found); status != 0 {
+			t.Errorf("%s: exit status %d, output:\n%s", sample, status, out.Bytes())
+		}
+	}
+}
+
+func TestCheckSample_Loopback(t *testing.T) {
+	root, err := ioutil.TempDir("", "fusecheck_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(path.Join(root, "a", "b"), 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(root, "a", "f"), []byte("taco"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := os.Symlink("f", path.Join(root, "a", "l")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	found, err := checkSample("loopbackfs", root, []string{"a/f"})
+	if err != nil {
+		t.Fatalf("checkSample: %v", err)
+	}
+
+	if len(found) != 0 {
+		t.Errorf("Discrepancies: %v", found)
+	}
+}
+
+func TestCheckSample_Unknown(t *testing.T) {
+	if _, err := checkSample("tacofs", "", nil); err == nil {
+		t.Error("Checking an unknown sample succeeded")
+	}
+
+	if _, err := checkSample("loopbackfs", "", nil); err == nil {
+		t.Error("Checking loopbackfs without a root succeeded")
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// fusedump prints a capture of the messages exchanged with the kernel over a
+// FUSE connection, as recorded when fuse.MountConfig.Capture is set, followed
+// by statistics about the ops it contains. Usage:
+//
+//	fusedump [-q] [-stats=false] capture-file
+//
+// Each message is printed on a line of its own: the time since the first
+// message, "->" for requests from the kernel or "<-" for replies and
+// notifications, the kernel's request ID, and the op. Replies are matched to
+// their requests to show the op's latency and any error.
+//
+// The capture must have been made on a machine with the same byte order.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fusecapture"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+var fQuiet = flag.Bool("q", false, "Don't print each message.")
+var fStats = flag.Bool("stats", true, "Print statistics at the end.")
+
+var opNames = map[uint32]string{
+	fusekernel.OpLookup:        "LOOKUP",
+	fusekernel.OpForget:        "FORGET",
+	fusekernel.OpGetattr:       "GETATTR",
+	fusekernel.OpSetattr:       "SETATTR",
+	fusekernel.OpReadlink:      "READLINK",
+	fusekernel.OpSymlink:       "SYMLINK",
+	fusekernel.OpMknod:         "MKNOD",
+	fusekernel.OpMkdir:         "MKDIR",
+	fusekernel.OpUnlink:        "UNLINK",
+	fusekernel.OpRmdir:         "RMDIR",
+	fusekernel.OpRename:        "RENAME",
+	fusekernel.OpLink:          "LINK",
+	fusekernel.OpOpen:          "OPEN",
+	fusekernel.OpRead:          "READ",
+	fusekernel.OpWrite:         "WRITE",
+	fusekernel.OpStatfs:        "STATFS",
+	fusekernel.OpRelease:       "RELEASE",
+	fusekernel.OpFsync:         "FSYNC",
+	fusekernel.OpSetxattr:      "SETXATTR",
+	fusekernel.OpGetxattr:      "GETXATTR",
+	fusekernel.OpListxattr:     "LISTXATTR",
+	fusekernel.OpRemovexattr:   "REMOVEXATTR",
+	fusekernel.OpFlush:         "FLUSH",
+	fusekernel.OpInit:          "INIT",
+	fusekernel.OpOpendir:       "OPENDIR",
+	fusekernel.OpReaddir:       "READDIR",
+	fusekernel.OpReleasedir:    "RELEASEDIR",
+	fusekernel.OpFsyncdir:      "FSYNCDIR",
+	fusekernel.OpGetlk:         "GETLK",
+	fusekernel.OpSetlk:         "SETLK",
+	fusekernel.OpSetlkw:        "SETLKW",
+	fusekernel.OpAccess:        "ACCESS",
+	fusekernel.OpCreate:        "CREATE",
+	fusekernel.OpInterrupt:     "INTERRUPT",
+	fusekernel.OpBmap:          "BMAP",
+	fusekernel.OpDestroy:       "DESTROY",
+	fusekernel.OpIoctl:         "IOCTL",
+	fusekernel.OpPoll:          "POLL",
+	fusekernel.OpBatchForget:   "BATCH_FORGET",
+	fusekernel.OpFallocate:     "FALLOCATE",
+	fusekernel.OpReaddirplus:   "READDIRPLUS",
+	fusekernel.OpRename2:       "RENAME2",
+	fusekernel.OpLseek:         "LSEEK",
+	fusekernel.OpCopyFileRange: "COPY_FILE_RANGE",
+	fusekernel.OpSetvolname:    "SETVOLNAME",
+	fusekernel.OpGetxtimes:     "GETXTIMES",
+	fusekernel.OpExchange:      "EXCHANGE",
+}
+
+func opName(opcode uint32) string {
+	if name, ok := opNames[opcode]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("OP_%d", opcode)
+}
+
+// Return whether the kernel expects no reply to ops with the given opcode.
+func noReply(opcode uint32) bool {
+	switch opcode {
+	case fusekernel.OpForget, fusekernel.OpBatchForget, fusekernel.OpInterrupt:
+		return true
+	}
+
+	return false
+}
+
+func notificationName(code int32) string {
+	switch code {
+	case fusekernel.NotifyCodePoll:
+		return "POLL"
+	case fusekernel.NotifyCodeInvalInode:
+		return "INVAL_INODE"
+	case fusekernel.NotifyCodeInvalEntry:
+		return "INVAL_ENTRY"
+	}
+
+	return fmt.Sprintf("NOTIFY_%d", code)
+}
+
+// Copy the header at the start of data into h, whose size is n, returning
+// false if data is too short to hold it.
+func readHeader(
+	data []byte,
+	h unsafe.Pointer,
+	n uintptr) bool {
+	if uintptr(len(data)) < n {
+		return false
+	}
+
+	copy((*[1 << 16]byte)(h)[:n], data)
+	return true
+}
+
+// A request that hasn't yet been replied to.
+type pendingRequest struct {
+	opcode uint32
+	time   time.Time
+}
+
+// Statistics for one kind of op.
+type opStats struct {
+	requests int
+	replies  int
+	errors   int
+
+	totalLatency time.Duration
+	maxLatency   time.Duration
+}
+
+// The state built up while dumping a capture.
+type dumper struct {
+	w       io.Writer
+	quiet   bool
+	start   time.Time
+	pending map[uint64]pendingRequest
+	stats   map[string]*opStats
+
+	notifications int
+	unmatched     int
+}
+
+func (d *dumper) statsFor(opcode uint32) *opStats {
+	name := opName(opcode)
+	s := d.stats[name]
+	if s == nil {
+		s = &opStats{}
+		d.stats[name] = s
+	}
+
+	return s
+}
+
+func (d *dumper) printf(format string, v ...interface{}) {
+	if !d.quiet {
+		fmt.Fprintf(d.w, format, v...)
+	}
+}
+
+// Print the supplied record and account for it in the statistics.
+func (d *dumper) record(rec *fusecapture.Record) {
+	if d.start.IsZero() {
+		d.start = rec.Time
+	}
+
+	d.printf("%12.6f ", rec.Time.Sub(d.start).Seconds())
+
+	var kept string
+	if rec.Truncated() {
+		kept = fmt.Sprintf(" [kept %d]", len(rec.Data))
+	}
+
+	switch rec.Direction {
+	case fusecapture.FromKernel:
+		var h fusekernel.InHeader
+		if !readHeader(rec.Data, unsafe.Pointer(&h), unsafe.Sizeof(h)) {
+			d.printf("-> malformed request len=%d%s\n", rec.Len, kept)
+			return
+		}
+
+		d.printf(
+			"-> #%d %s node=%d pid=%d len=%d%s\n",
+			h.Unique,
+			opName(h.Opcode),
+			h.Nodeid,
+			h.Pid,
+			rec.Len,
+			kept)
+
+		d.statsFor(h.Opcode).requests++
+		if !noReply(h.Opcode) {
+			d.pending[h.Unique] = pendingRequest{h.Opcode, rec.Time}
+		}
+
+	case fusecapture.ToKernel:
+		var h fusekernel.OutHeader
+		if !readHeader(rec.Data, unsafe.Pointer(&h), unsafe.Sizeof(h)) {
+			d.printf("<- malformed reply len=%d%s\n", rec.Len, kept)
+			return
+		}
+
+		// Notifications carry their code in place of an error.
+		if h.Unique == 0 {
+			d.notifications++
+			d.printf("<- notify %s len=%d%s\n", notificationName(h.Error), rec.Len, kept)
+			return
+		}
+
+		req, ok := d.pending[h.Unique]
+		if !ok {
+			d.unmatched++
+			d.printf("<- #%d ? len=%d%s\n", h.Unique, rec.Len, kept)
+			return
+		}
+
+		delete(d.pending, h.Unique)
+		latency := rec.Time.Sub(req.time)
+
+		var status string
+		if h.Error != 0 {
+			status = fmt.Sprintf(" error=%v", syscall.Errno(-h.Error))
+		}
+
+		d.printf(
+			"<- #%d %s len=%d%s (%v)%s\n",
+			h.Unique,
+			opName(req.opcode),
+			rec.Len,
+			status,
+			latency,
+			kept)
+
+		s := d.statsFor(req.opcode)
+		s.replies++
+		if h.Error != 0 {
+			s.errors++
+		}
+
+		s.totalLatency += latency
+		if latency > s.maxLatency {
+			s.maxLatency = latency
+		}
+
+	default:
+		d.printf("?? %v len=%d%s\n", rec.Direction, rec.Len, kept)
+	}
+}
+
+// Print the statistics gathered, busiest ops first.
+func (d *dumper) printStats() {
+	var names []string
+	for name := range d.stats {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		a, b := d.stats[names[i]], d.stats[names[j]]
+		if a.requests != b.requests {
+			return a.requests > b.requests
+		}
+
+		return names[i] < names[j]
+	})
+
+	tw := tabwriter.NewWriter(d.w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "op\trequests\treplies\terrors\tmean\tmax\t\n")
+	for _, name := range names {
+		s := d.stats[name]
+
+		mean, max := "-", "-"
+		if s.replies > 0 {
+			mean = fmt.Sprint(s.totalLatency / time.Duration(s.replies))
+			max = fmt.Sprint(s.maxLatency)
+		}
+
+		fmt.Fprintf(
+			tw,
+			"%s\t%d\t%d\t%d\t%s\t%s\t\n",
+			name,
+			s.requests,
+			s.replies,
+			s.errors,
+			mean,
+			max)
+	}
+
+	tw.Flush()
+
+	fmt.Fprintf(d.w, "notifications: %d\n", d.notifications)
+	fmt.Fprintf(d.w, "requests without replies: %d\n", len(d.pending))
+	fmt.Fprintf(d.w, "replies without requests: %d\n", d.unmatched)
+}
+
+// Print the capture read from r to w.
+func dump(
+	w io.Writer,
+	r io.Reader,
+	quiet bool,
+	stats bool) error {
+	cr, err := fusecapture.NewReader(r)
+	if err != nil {
+		return err
+	}
+
+	d := &dumper{
+		w:       w,
+		quiet:   quiet,
+		pending: make(map[uint64]pendingRequest),
+		stats:   make(map[string]*opStats),
+	}
+
+	if n := cr.MaxPayload(); n > 0 {
+		d.printf("# payloads truncated to %d bytes\n", n)
+	}
+
+	for {
+		rec, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		// Print what we have before reporting a capture cut off part way.
+		if err != nil {
+			if stats {
+				d.printStats()
+			}
+
+			return err
+		}
+
+		d.record(rec)
+	}
+
+	if stats {
+		d.printStats()
+	}
+
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] capture-file\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	defer f.Close()
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+
+	if err := dump(w, bufio.NewReader(f), *fQuiet, *fStats); err != nil {
+		w.Flush()
+		log.Fatalf("%s: %v", flag.Arg(0), err)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/hellofs"
+	"github.com/jacobsa/timeutil"
+)
+
+var fUpdate = flag.Bool("update", false, "Regenerate the files in testdata.")
+
+// Record a short session with hellofs, truncating payloads to 64 bytes.
+func recordHello(t *testing.T) []byte {
+	server, err := hellofs.NewHelloFS(timeutil.RealClock())
+	if err != nil {
+		t.Fatalf("NewHelloFS: %v", err)
+	}
+
+	var buf bytes.Buffer
+	k, err := fusetesting.NewFakeKernel(server, &fuse.MountConfig{
+		Capture: &fuse.CaptureConfig{Writer: &buf, MaxPayload: 64},
+	})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	inode, err := k.LookUp(fuseops.RootInodeID, "hello")
+	if err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	if _, err := k.LookUp(fuseops.RootInodeID, "missing"); err == nil {
+		t.Fatal("LookUp of a missing name succeeded")
+	}
+
+	if _, err := k.GetAttr(inode); err != nil {
+		t.Fatalf("GetAttr: %v", err)
+	}
+
+	h, err := k.Open(inode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if _, err := k.Read(inode, h, 0, 4096); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	mfs := k.MountedFileSystem()
+	mfs.QueueInvalidateInode(inode, -1, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := mfs.FlushNotifications(ctx); err != nil {
+		t.Fatalf("FlushNotifications: %v", err)
+	}
+
+	in := fusekernel.ForgetIn{Nlookup: 1}
+	inBytes := (*[unsafe.Sizeof(fusekernel.ForgetIn{})]byte)(unsafe.Pointer(&in))
+	if err := k.Send(fusekernel.OpForget, uint64(inode), inBytes[:]); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return buf.Bytes()
+}
+
+// Read the named file from testdata, or with -update write contents to it
+// first.
+func testdata(
+	t *testing.T,
+	name string,
+	contents func() []byte) []byte {
+	p := path.Join("testdata", name)
+	if *fUpdate {
+		if err := ioutil.WriteFile(p, contents(), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	return b
+}
+
+func TestDump(t *testing.T) {
+	capture := testdata(t, "hello.fusecap", func() []byte { return recordHello(t) })
+
+	var got bytes.Buffer
+	if err := dump(&got, bytes.NewReader(capture), false, true); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+
+	want := testdata(t, "hello.golden", got.Bytes)
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("Output differs from testdata/hello.golden. Got:\n%s", got.Bytes())
+	}
+}
+
+func TestDump_Quiet(t *testing.T) {
+	f, err := os.Open("testdata/hello.fusecap")
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	var got bytes.Buffer
+	if err := dump(&got, f, true, true); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+
+	if bytes.Contains(got.Bytes(), []byte("->")) {
+		t.Errorf("Quiet output contains messages:\n%s", got.Bytes())
+	}
+
+	if !bytes.Contains(got.Bytes(), []byte("requests without replies: 0")) {
+		t.Errorf("Quiet output lacks statistics:\n%s", got.Bytes())
+	}
+}
+
+func TestDump_Truncated(t *testing.T) {
+	capture, err := ioutil.ReadFile("testdata/hello.fusecap")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	// Cut the last record short.
+	var got bytes.Buffer
+	err = dump(&got, bytes.NewReader(capture[:len(capture)-1]), true, true)
+	if err == nil {
+		t.Fatal("dump of a cut-off capture succeeded")
+	}
+
+	if !bytes.Contains(got.Bytes(), []byte("LOOKUP")) {
+		t.Errorf("Statistics not printed before the error:\n%s", got.Bytes())
+	}
+}
+
+func TestDump_NotACapture(t *testing.T) {
+	var got bytes.Buffer
+	if err := dump(&got, bytes.NewReader([]byte("hello, world")), false, true); err == nil {
+		t.Fatal("dump of garbage succeeded")
+	}
+}
@@ -0,0 +1,448 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// Configuration for MountConfig.ConcurrencyLimit, which limits the number of
+// ops the file system works on at once, adjusting the limit as the file
+// system's latency changes. This suits backends whose capacity varies, for
+// which any fixed limit is either too low, wasting throughput, or too high,
+// overloading the backend until ops are so slow that users interrupt them.
+//
+// Reads and writes (ReadFileOp and WriteFileOp) are limited separately from
+// all other ops, so that a backlog of data doesn't hold up metadata or vice
+// versa. Forgets are never limited, and neither are interrupts, which the
+// connection handles itself.
+//
+// Each limit starts at its minimum. While ops are waiting for a slot and
+// finish in their usual time, it rises: quickly at first, doubling with each
+// round of ops, and after the first cut by one for each round. When ops take
+// more than Tolerance times as long as ops of their kind usually do, on
+// average over a round, the limit is divided by Tolerance. An op's usual time
+// is the least it has taken lately.
+//
+// The current limits are reported by MountedFileSystem.ConcurrencyLimits.
+type ConcurrencyLimitConfig struct {
+	// Bounds on the limit for ops other than reads and writes. If zero, the
+	// minimum is one and the maximum is 128.
+	MinMetadataOps int
+	MaxMetadataOps int
+
+	// Bounds on the limit for reads and writes, as above.
+	MinDataOps int
+	MaxDataOps int
+
+	// How many times longer than usual an op may take before the file system
+	// is considered overloaded. If zero, two. It must otherwise be greater
+	// than one.
+	Tolerance float64
+}
+
+const (
+	defaultMinConcurrency       = 1
+	defaultMaxConcurrency       = 128
+	defaultConcurrencyTolerance = 2
+)
+
+// How long an op must take beyond its usual time to count towards overload,
+// however quick it usually is, so that jitter in ops that take microseconds
+// doesn't look like overload.
+const minOverloadDelay = time.Millisecond
+
+// The fewest ops over which slowdowns are averaged, however low the limit.
+const minSlowdownOps = 4
+
+// An op's usual time is the least it has taken during the current window or
+// the one before, so that this can rise again if the file system slows for
+// good.
+const latencyBaselineWindow = 10 * time.Second
+
+// The current state of a limit set by ConcurrencyLimitConfig.
+type ConcurrencyLimitStats struct {
+	// The number of ops that may be passed to the file system at once.
+	Limit int
+
+	// The number of ops passed to the file system and not yet replied to, and
+	// the number waiting for that.
+	InFlight int
+	Waiting  int
+}
+
+// The limits set by ConcurrencyLimitConfig, for ops other than reads and
+// writes, and for reads and writes.
+type ConcurrencyLimits struct {
+	Metadata ConcurrencyLimitStats
+	Data     ConcurrencyLimitStats
+}
+
+// The limiters for each kind of op, if MountConfig.ConcurrencyLimit is set.
+type concurrencyLimits struct {
+	metadata *concurrencyLimiter
+	data     *concurrencyLimiter
+}
+
+func newConcurrencyLimits(
+	cfg *ConcurrencyLimitConfig,
+	clock timeutil.Clock) (*concurrencyLimits, error) {
+	tolerance := cfg.Tolerance
+	if tolerance == 0 {
+		tolerance = defaultConcurrencyTolerance
+	}
+
+	if !(tolerance > 1) {
+		return nil, fmt.Errorf("Tolerance %v is not greater than one", tolerance)
+	}
+
+	if cfg.MaxMetadataOps > 0 && cfg.MaxMetadataOps < cfg.MinMetadataOps {
+		return nil, errors.New("MaxMetadataOps is less than MinMetadataOps")
+	}
+
+	if cfg.MaxDataOps > 0 && cfg.MaxDataOps < cfg.MinDataOps {
+		return nil, errors.New("MaxDataOps is less than MinDataOps")
+	}
+
+	l := &concurrencyLimits{
+		metadata: newConcurrencyLimiter(clock, cfg.MinMetadataOps, cfg.MaxMetadataOps, tolerance),
+		data:     newConcurrencyLimiter(clock, cfg.MinDataOps, cfg.MaxDataOps, tolerance),
+	}
+
+	return l, nil
+}
+
+// Return the limiter that applies to op.
+func (l *concurrencyLimits) forOp(op interface{}) *concurrencyLimiter {
+	switch op.(type) {
+	case *fuseops.ReadFileOp, *fuseops.WriteFileOp:
+		return l.data
+	}
+
+	return l.metadata
+}
+
+// An adaptive limit on the number of ops of one kind in flight.
+type concurrencyLimiter struct {
+	clock     timeutil.Clock
+	min       float64
+	max       float64
+	tolerance float64
+
+	mu sync.Mutex
+
+	// The current limit, of which the whole part is in effect.
+	//
+	// GUARDED_BY(mu)
+	limit float64
+
+	// The number of ops holding a slot, and the ops waiting for one, each of
+	// which is admitted by closing its channel.
+	//
+	// GUARDED_BY(mu)
+	inFlight int
+	waiting  []chan struct{}
+
+	// Whether the limit has yet to be cut, and when it last was.
+	//
+	// GUARDED_BY(mu)
+	slowStart bool
+	lastCut   time.Time
+
+	// A moving average of how many times longer than usual ops have taken
+	// since the last cut.
+	//
+	// GUARDED_BY(mu)
+	slowdown float64
+
+	// The usual latency of each kind of op, by opcode.
+	//
+	// GUARDED_BY(mu)
+	baselines map[uint32]*latencyBaseline
+}
+
+func newConcurrencyLimiter(
+	clock timeutil.Clock,
+	min int,
+	max int,
+	tolerance float64) *concurrencyLimiter {
+	if min <= 0 {
+		min = defaultMinConcurrency
+	}
+
+	if max <= 0 {
+		max = defaultMaxConcurrency
+	}
+
+	// A minimum above the default maximum is bound to be what's wanted.
+	if max < min {
+		max = min
+	}
+
+	return &concurrencyLimiter{
+		clock:     clock,
+		min:       float64(min),
+		max:       float64(max),
+		tolerance: tolerance,
+		limit:     float64(min),
+		slowStart: true,
+		slowdown:  1,
+		baselines: make(map[uint32]*latencyBaseline),
+	}
+}
+
+// The least latency seen for a kind of op in the current window and the one
+// before it.
+type latencyBaseline struct {
+	windowStart time.Time
+	current     time.Duration
+	previous    time.Duration
+}
+
+// Return the usual latency, then take latency into account.
+func (b *latencyBaseline) observe(
+	now time.Time,
+	latency time.Duration) (usual time.Duration) {
+	usual = b.current
+	if b.previous < usual {
+		usual = b.previous
+	}
+
+	if now.Sub(b.windowStart) >= latencyBaselineWindow {
+		b.windowStart = now
+		b.previous = b.current
+		b.current = latency
+	} else if latency < b.current {
+		b.current = latency
+	}
+
+	return
+}
+
+// LOCKS_REQUIRED(l.mu)
+func (l *concurrencyLimiter) slots() int {
+	return int(l.limit)
+}
+
+// Wait for a slot, failing with EINTR if ctx is cancelled first.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	l.mu.Lock()
+	if len(l.waiting) == 0 && l.inFlight < l.slots() {
+		l.inFlight++
+		l.mu.Unlock()
+		return nil
+	}
+
+	admitted := make(chan struct{})
+	l.waiting = append(l.waiting, admitted)
+	l.mu.Unlock()
+
+	select {
+	case <-admitted:
+		return nil
+
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, w := range l.waiting {
+		if w == admitted {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			return syscall.EINTR
+		}
+	}
+
+	// We were admitted in the meantime, so pass the slot on.
+	l.inFlight--
+	l.admitWaiting()
+	return syscall.EINTR
+}
+
+// LOCKS_REQUIRED(l.mu)
+func (l *concurrencyLimiter) admitWaiting() {
+	for len(l.waiting) > 0 && l.inFlight < l.slots() {
+		close(l.waiting[0])
+		l.waiting = l.waiting[1:]
+		l.inFlight++
+	}
+}
+
+// Give up the slot of an op with the given opcode, admitted at the given
+// time, adjusting the limit according to how long it took unless sample is
+// false.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *concurrencyLimiter) release(
+	opcode uint32,
+	admitted time.Time,
+	sample bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	saturated := l.inFlight >= l.slots() || len(l.waiting) > 0
+	l.inFlight--
+
+	if sample {
+		l.adjust(opcode, admitted, saturated)
+	}
+
+	l.admitWaiting()
+}
+
+// LOCKS_REQUIRED(l.mu)
+func (l *concurrencyLimiter) adjust(
+	opcode uint32,
+	admitted time.Time,
+	saturated bool) {
+	now := l.clock.Now()
+	latency := now.Sub(admitted)
+
+	b := l.baselines[opcode]
+	if b == nil {
+		l.baselines[opcode] = &latencyBaseline{
+			windowStart: now,
+			current:     latency,
+			previous:    latency,
+		}
+
+		return
+	}
+
+	usual := b.observe(now, latency)
+
+	// Ops admitted before the last cut reflect the load before it, so await
+	// the ops that were admitted since.
+	if admitted.Before(l.lastCut) {
+		return
+	}
+
+	// Average how much slower than usual ops are over roughly a round of
+	// them, so that one slow op doesn't look like overload.
+	ratio := 1.0
+	if latency-usual > minOverloadDelay {
+		ratio = float64(latency) / float64(usual)
+	}
+
+	l.slowdown += (ratio - l.slowdown) / math.Max(l.limit, minSlowdownOps)
+
+	switch {
+	case l.slowdown > l.tolerance:
+		l.limit = math.Max(l.min, l.limit/l.tolerance)
+		l.lastCut = now
+		l.slowStart = false
+		l.slowdown = 1
+
+	// Only raise the limit when it is holding ops back, lest it grow without
+	// bound while the file system is idle.
+	case saturated:
+		if l.slowStart {
+			l.limit++
+		} else {
+			l.limit += 1 / l.limit
+		}
+
+		l.limit = math.Min(l.max, l.limit)
+	}
+}
+
+// LOCKS_EXCLUDED(l.mu)
+func (l *concurrencyLimiter) stats() ConcurrencyLimitStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return ConcurrencyLimitStats{
+		Limit:    l.slots(),
+		InFlight: l.inFlight,
+		Waiting:  len(l.waiting),
+	}
+}
+
+// WaitForCapacity blocks the op associated with ctx, a context returned by
+// ReadOp, until the limit set by MountConfig.ConcurrencyLimit allows it to be
+// passed to the file system. Servers must call it before carrying out each
+// op, which fuseutil.NewFileSystemServer does, and the op holds its place
+// until it is replied to. It returns immediately if no limit is set, for
+// forgets, and for lock requests that may wait on other processes.
+//
+// If it returns an error, EINTR because the op's context was cancelled, the
+// server should reply to the op with it rather than carrying it out.
+func (c *Connection) WaitForCapacity(ctx context.Context) error {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok || state.inFlight == nil || c.limits == nil {
+		return nil
+	}
+
+	// A waiting lock request takes as long as the lock is held elsewhere,
+	// which says nothing about the file system's capacity, and the unlock that
+	// ends it mustn't be stuck behind it.
+	if op, ok := state.op.(*fuseops.SetLockOp); ok && op.Wait {
+		return nil
+	}
+
+	l := c.limits.forOp(state.op)
+	if err := l.acquire(ctx); err != nil {
+		return err
+	}
+
+	state.inFlight.limiter = l
+	state.inFlight.admitted = c.clock.Now()
+	return nil
+}
+
+// Give up the slot held by the op being replied to, if any. The time it took
+// counts towards the limit unless it was cancelled, e.g. interrupted,
+// which may have cut it short.
+func (c *Connection) releaseCapacity(
+	ctx context.Context,
+	state opState) {
+	f := state.inFlight
+	if f == nil || f.limiter == nil {
+		return
+	}
+
+	f.limiter.release(state.inMsg.Header().Opcode, f.admitted, ctx.Err() == nil)
+	f.limiter = nil
+}
+
+// ConcurrencyLimits returns the current state of the limits set by
+// MountConfig.ConcurrencyLimit, which is zero if it isn't set.
+func (c *Connection) ConcurrencyLimits() ConcurrencyLimits {
+	if c.limits == nil {
+		return ConcurrencyLimits{}
+	}
+
+	return ConcurrencyLimits{
+		Metadata: c.limits.metadata.stats(),
+		Data:     c.limits.data.stats(),
+	}
+}
+
+// ConcurrencyLimits returns the current state of the limits set by
+// MountConfig.ConcurrencyLimit, which is zero if it isn't set.
+func (mfs *MountedFileSystem) ConcurrencyLimits() ConcurrencyLimits {
+	return mfs.conn.ConcurrencyLimits()
+}
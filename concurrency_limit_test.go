@@ -0,0 +1,376 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fuse_test
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system in which getattrs and reads succeed, with nothing to read.
+type quickFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *quickFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return nil
+}
+
+func (fs *quickFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return nil
+}
+
+// Wraps a file system so that getattrs are carried out at most capacity at
+// a time, the rest waiting their turn, like a backend with that many
+// workers.
+type capacityFS struct {
+	fuseutil.FileSystem
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// GUARDED_BY(mu)
+	capacity int
+	busy     int
+}
+
+func newCapacityFS(
+	wrapped fuseutil.FileSystem,
+	capacity int) *capacityFS {
+	fs := &capacityFS{FileSystem: wrapped, capacity: capacity}
+	fs.cond = sync.NewCond(&fs.mu)
+	return fs
+}
+
+func (fs *capacityFS) setCapacity(capacity int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.capacity = capacity
+	fs.cond.Broadcast()
+}
+
+func (fs *capacityFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	for fs.busy >= fs.capacity {
+		fs.cond.Wait()
+	}
+
+	fs.busy++
+	fs.mu.Unlock()
+
+	defer func() {
+		fs.mu.Lock()
+		fs.busy--
+		fs.cond.Broadcast()
+		fs.mu.Unlock()
+	}()
+
+	return fs.FileSystem.GetInodeAttributes(ctx, op)
+}
+
+func TestConcurrencyLimit_TracksCapacity(t *testing.T) {
+	const (
+		latency         = 10 * time.Millisecond
+		metadataWorkers = 80
+		dataWorkers     = 8
+		phase           = 2 * time.Second
+
+		// The fewest samples of the metadata limit, of about 100 per phase,
+		// needed to judge it.
+		minSaturatedSamples = 20
+	)
+
+	fs := newCapacityFS(fusetesting.NewLatencyFileSystem(&quickFS{}, latency), 20)
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			ConcurrencyLimit: &fuse.ConcurrencyLimitConfig{
+				MaxMetadataOps: metadataWorkers,
+				MaxDataOps:     metadataWorkers,
+			},
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+	mfs := k.MountedFileSystem()
+
+	// Keep the file system as busy as the limits allow, with getattrs that
+	// the backend's capacity holds up and reads that it doesn't.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	work := func(f func() error) {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			if err := f(); err != nil {
+				t.Errorf("Op: %v", err)
+				return
+			}
+		}
+	}
+
+	for i := 0; i < metadataWorkers; i++ {
+		wg.Add(1)
+		go work(func() error {
+			_, err := k.GetAttr(fuseops.RootInodeID)
+			return err
+		})
+	}
+
+	for i := 0; i < dataWorkers; i++ {
+		wg.Add(1)
+		go work(func() error {
+			_, err := k.Read(fuseops.RootInodeID+1, 0, 0, 1)
+			return err
+		})
+	}
+
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	// Give the limiter the first half of each phase to settle, then sample
+	// the limits. The metadata limit is left be while the workers can't keep
+	// up with it, as on a starved machine, so it is only sampled while ops
+	// wait for it.
+	sample := func() (metadata float64, saturated int, data float64) {
+		time.Sleep(phase / 2)
+
+		n := 0
+		for start := time.Now(); time.Since(start) < phase/2; n++ {
+			limits := mfs.ConcurrencyLimits()
+			if limits.Metadata.Waiting > 0 {
+				metadata += float64(limits.Metadata.Limit)
+				saturated++
+			}
+
+			data += float64(limits.Data.Limit)
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if saturated > 0 {
+			metadata /= float64(saturated)
+		}
+
+		data /= float64(n)
+		return
+	}
+
+	// Overload sets in once the limit exceeds the capacity by the tolerance,
+	// twofold by default, and cuts it by as much. So the limit should hover
+	// between the capacity and twice it; allow some slack either side, and a
+	// few ops more above, by which timing noise lets a small limit overshoot.
+	// Meanwhile the reads, which the backend doesn't hold up, have a limit of
+	// their own that should mostly stay out of their way, though a loaded
+	// machine may slow them enough for the odd cut.
+	means := make(map[int]float64)
+	for _, capacity := range []int{20, 5, 12} {
+		fs.setCapacity(capacity)
+		metadata, saturated, data := sample()
+
+		if data < 0.75*dataWorkers {
+			t.Errorf("Capacity %d: mean data limit %.1f", capacity, data)
+		}
+
+		if saturated < minSaturatedSamples {
+			t.Logf("Capacity %d: metadata limit saturated in %d samples", capacity, saturated)
+			continue
+		}
+
+		means[capacity] = metadata
+
+		lo, hi := 0.5*float64(capacity), 3*float64(capacity)+5
+		if metadata < lo || metadata > hi {
+			t.Errorf(
+				"Capacity %d: mean metadata limit %.1f, want within [%.1f, %.1f]",
+				capacity,
+				metadata,
+				lo,
+				hi)
+		}
+	}
+
+	if len(means) == 3 && !(means[5] < means[12] && means[12] < means[20]) {
+		t.Errorf("Mean metadata limits by capacity: %v", means)
+	}
+}
+
+// A file system whose getattrs wait to be released, and which reports the
+// forgets it receives.
+type blockingAttrFS struct {
+	quickFS
+	started chan struct{}
+	release chan struct{}
+	forgets chan fuseops.InodeID
+}
+
+func (fs *blockingAttrFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.started <- struct{}{}
+	<-fs.release
+	return nil
+}
+
+func (fs *blockingAttrFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forgets <- op.Inode
+	return nil
+}
+
+func TestConcurrencyLimit_Exempt(t *testing.T) {
+	fs := &blockingAttrFS{
+		started: make(chan struct{}, 1),
+		release: make(chan struct{}),
+		forgets: make(chan fuseops.InodeID, 1),
+	}
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			ConcurrencyLimit: &fuse.ConcurrencyLimitConfig{
+				MinMetadataOps: 1,
+				MaxMetadataOps: 1,
+				MinDataOps:     1,
+				MaxDataOps:     1,
+			},
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+	mfs := k.MountedFileSystem()
+
+	waitFor := func(desc string, f func(fuse.ConcurrencyLimitStats) bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !f(mfs.ConcurrencyLimits().Metadata) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s: %+v", desc, mfs.ConcurrencyLimits())
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// Fill the metadata limit, and have another getattr wait behind it.
+	first := make(chan error, 1)
+	go func() {
+		_, err := k.GetAttr(fuseops.RootInodeID)
+		first <- err
+	}()
+
+	<-fs.started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	second := make(chan error, 1)
+	go func() {
+		var in fusekernel.GetattrIn
+		const inSize = unsafe.Sizeof(fusekernel.GetattrIn{})
+		_, err := k.CallContext(
+			ctx,
+			fusekernel.OpGetattr,
+			uint64(fuseops.RootInodeID),
+			(*[inSize]byte)(unsafe.Pointer(&in))[:])
+
+		second <- err
+	}()
+
+	waitFor("the second getattr to wait", func(s fuse.ConcurrencyLimitStats) bool {
+		return s.Waiting == 1
+	})
+
+	// Forgets get through regardless, as do reads, which are limited
+	// separately.
+	if err := k.Forget(fuseops.RootInodeID+1, 1); err != nil {
+		t.Fatalf("Forget: %v", err)
+	}
+
+	select {
+	case <-fs.forgets:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the forget")
+	}
+
+	if _, err := k.Read(fuseops.RootInodeID+1, 0, 0, 1); err != nil {
+		t.Errorf("Read: %v", err)
+	}
+
+	// So do interrupts, which fail the waiting getattr.
+	cancel()
+	select {
+	case err := <-second:
+		if err != syscall.EINTR {
+			t.Errorf("Interrupted getattr: %v", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the interrupted getattr")
+	}
+
+	if s := mfs.ConcurrencyLimits().Metadata; s.Waiting != 0 || s.InFlight != 1 {
+		t.Errorf("After interrupt: %+v", s)
+	}
+
+	close(fs.release)
+	if err := <-first; err != nil {
+		t.Errorf("GetAttr: %v", err)
+	}
+
+	waitFor("the first getattr's slot", func(s fuse.ConcurrencyLimitStats) bool {
+		return s.InFlight == 0
+	})
+}
+
+func TestConcurrencyLimit_BadConfig(t *testing.T) {
+	_, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&quickFS{}),
+		&fuse.MountConfig{
+			ConcurrencyLimit: &fuse.ConcurrencyLimitConfig{Tolerance: 0.5},
+		})
+
+	if err == nil {
+		t.Errorf("NewFakeKernel succeeded with a tolerance below one")
+	}
+}
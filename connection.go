@@ -22,13 +22,17 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"runtime/debug"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/jacobsa/fuse/fusecapture"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
 	"github.com/jacobsa/fuse/internal/freelist"
 	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
 )
 
 type contextKeyType uint64
@@ -58,8 +62,11 @@ const maxReadahead = 1 << 20
 // receive and reply to requests from the kernel.
 type Connection struct {
 	cfg         MountConfig
+	negotiator  InitNegotiator
+	mountInfo   MountInfo
 	debugLogger *log.Logger
 	errorLogger *log.Logger
+	clock       timeutil.Clock
 
 	// The device through which we're talking to the kernel, and the protocol
 	// version that we're using to talk to it.
@@ -68,43 +75,284 @@ type Connection struct {
 
 	mu sync.Mutex
 
-	// A map from fuse "unique" request ID (*not* the op ID for logging used
-	// above) to a function that cancel's its associated context.
+	// A map from fuse "unique" request ID (see RequestIDFromContext) to the
+	// state of the op, for each op that has been returned by ReadOp and not yet
+	// replied to. Interrupts name the request they interrupt by this ID. Forget
+	// ops, which have no reply, are not included.
 	//
 	// GUARDED_BY(mu)
-	cancelFuncs map[uint64]func()
+	inFlight map[uint64]*inFlightOp
+
+	// The highest request ID read so far, and the IDs above it named by
+	// interrupts, whose requests are yet to be read. See handleInterrupt.
+	//
+	// GUARDED_BY(mu)
+	lastID          uint64
+	earlyInterrupts map[uint64]struct{}
 
 	// Freelists, serviced by freelists.go.
 	inMessages  freelist.Freelist // GUARDED_BY(mu)
 	outMessages freelist.Freelist // GUARDED_BY(mu)
+
+	// The number of replies the kernel refused because it was no longer
+	// waiting for them. See the notes on Reply.
+	//
+	// GUARDED_BY(mu)
+	droppedReplies uint64
+
+	// How the ops read so far were finished. See accounting.go.
+	//
+	// GUARDED_BY(mu)
+	accounting OpAccounting
+
+	// Set when the kernel has hung up, after which ReadOp returns io.EOF and
+	// replies are discarded. See teardown.go.
+	//
+	// GUARDED_BY(mu)
+	hungUp bool
+
+	// The request ID of the kernel's DESTROY request, if it has sent one,
+	// which is answered once the connection has wound down. Otherwise zero.
+	//
+	// GUARDED_BY(mu)
+	destroyID uint64
+
+	// The first error that ended serving unexpectedly, such as a failure to
+	// read from the device or ErrAborted, which Join returns. Otherwise nil.
+	//
+	// GUARDED_BY(mu)
+	serveErr error
+
+	// Set by MountedFileSystem.Detach, after which ReadOp reads nothing more
+	// but the connection is left open for another process to take over. See
+	// resume.go.
+	//
+	// GUARDED_BY(mu)
+	detached bool
+
+	// If non-nil, called before writing each message to the kernel. A non-nil
+	// result is returned in place of writing. For tests.
+	//
+	// GUARDED_BY(mu)
+	writeHook func(msg []byte) error
+
+	// The error with which ops are failed while in degraded mode, or zero if
+	// not in degraded mode. See MountedFileSystem.EnterDegradedMode.
+	//
+	// GUARDED_BY(mu)
+	degradedErr syscall.Errno
+
+	// Whether the kernel agreed to no-open and no-opendir support during init.
+	noOpen    bool
+	noOpendir bool
+
+	// State for strict mode checks, if enabled by cfg.Strict. Otherwise nil.
+	//
+	// GUARDED_BY(mu)
+	strict *strictState
+
+	// The memory held by ops that have been returned by ReadOp and not yet
+	// replied to, a multiple of memoryPerOp. See memory_limit.go.
+	//
+	// GUARDED_BY(mu)
+	inFlightBytes int64
+
+	// Counts of the requests and invalidations bearing on the kernel's
+	// caching. See cache_stats.go.
+	//
+	// GUARDED_BY(mu)
+	cacheStats CacheStats
+
+	// The attributes recently sent to the kernel, if cfg.AttributeHistory is
+	// set. Otherwise nil. See attribute_history.go.
+	attrHistory *attributeHistory
+
+	// Signalled when inFlightBytes decreases or degradedErr is set.
+	memoryReleased *sync.Cond
+
+	// Sent to without blocking when memoryReleased is signalled or the
+	// connection is detached, for ReadOp to select on. Buffered.
+	memoryWake chan struct{}
+
+	// The ops read from the kernel while in-flight ops held too much memory,
+	// in the order read, and the background read started while waiting for
+	// them to be handed out, if any. See memory_limit.go.
+	//
+	// Used only by ReadOp.
+	parked      []parkedOp
+	pendingRead chan readResult
+
+	// Notifications queued by MountedFileSystem.QueueInvalidateInode and
+	// friends. See notify_queue.go.
+	notifications *notificationQueue
+
+	// The limits on ops in flight, if cfg.ConcurrencyLimit is set. Otherwise
+	// nil. See concurrency_limit.go.
+	limits *concurrencyLimits
+
+	// The capabilities declared by the server, if any. Otherwise nil. See
+	// capabilities.go.
+	capabilities *declaredCapabilities
+
+	// Asynchronous failures, delivered to the user by Errors. See op_error.go.
+	errors chan OpError
+
+	// The number of errors dropped from errors because it was full.
+	//
+	// GUARDED_BY(mu)
+	droppedErrors uint64
+
+	// While the file system is frozen by MountedFileSystem.Freeze, a channel
+	// closed when it is thawed. Otherwise nil. See freeze.go.
+	//
+	// GUARDED_BY(mu)
+	thawed chan struct{}
+
+	// The number of freezes so far, the timer that will thaw the current one
+	// automatically, and a channel closed when mutatingInFlight drops to zero
+	// if Freeze is waiting for that.
+	//
+	// GUARDED_BY(mu)
+	freezes     uint64
+	freezeTimer *time.Timer
+	drained     chan struct{}
+
+	// The number of mutating ops passed to the file system and not yet
+	// replied to.
+	//
+	// GUARDED_BY(mu)
+	mutatingInFlight int
+
+	// Set once errors has been closed.
+	//
+	// GUARDED_BY(mu)
+	errorsClosed bool
+
+	// The number of live child mounts resting on each directory entry. See
+	// MountGroup.AddChildMount.
+	//
+	// GUARDED_BY(mu)
+	anchors map[anchorEntry]int
+
+	// Where messages are recorded if cfg.Capture is set, otherwise nil, and
+	// used to report only the first failure to record. See capture.go.
+	capture       *fusecapture.Writer
+	captureFailed sync.Once
+}
+
+// An op that has been read but not yet replied to.
+type inFlightOp struct {
+	op interface{}
+
+	// Cancels the op's context.
+	cancel func()
+
+	// Set when the op has been failed by EnterDegradedMode before the user
+	// replied to it. The user's reply is then discarded.
+	//
+	// GUARDED_BY(Connection.mu)
+	failed bool
+
+	// Set when the kernel has interrupted the op.
+	//
+	// GUARDED_BY(Connection.mu)
+	interrupted bool
+
+	// Set for a mutating op while it is passed to the file system, or while it
+	// waits in WaitForThaw for the file system to be thawed. See freeze.go.
+	//
+	// GUARDED_BY(Connection.mu)
+	mutating bool
+	frozen   bool
+
+	// Once WaitForCapacity has admitted the op, the limiter whose slot it
+	// holds and when it was admitted. Set before WaitForCapacity returns, and
+	// read when the op is replied to. See concurrency_limit.go.
+	limiter  *concurrencyLimiter
+	admitted time.Time
 }
 
 // State that is maintained for each in-flight op. This is stuffed into the
 // context that the user uses to reply to the op.
 type opState struct {
-	inMsg  *buffer.InMessage
-	outMsg *buffer.OutMessage
-	op     interface{}
+	conn     *Connection
+	inMsg    *buffer.InMessage
+	outMsg   *buffer.OutMessage
+	op       interface{}
+	inFlight *inFlightOp // nil for ops without a reply
+	record   *opRecord
+
+	// When ReadOp handed the op out, if debug logging is enabled.
+	start time.Time
 }
 
 // Create a connection wrapping the supplied file descriptor connected to the
-// kernel. You must eventually call c.close().
+// kernel, for the file system mounted at dir (or "" if unknown). You must
+// eventually call c.close().
 //
-// The loggers may be nil.
+// The loggers and negotiator may be nil.
 func newConnection(
 	cfg MountConfig,
+	dir string,
 	debugLogger *log.Logger,
 	errorLogger *log.Logger,
-	dev *os.File) (*Connection, error) {
+	dev *os.File,
+	negotiator InitNegotiator) (*Connection, error) {
 	c := &Connection{
 		cfg:         cfg,
+		negotiator:  negotiator,
+		mountInfo:   newMountInfo(dir, cfg.Atime),
 		debugLogger: debugLogger,
 		errorLogger: errorLogger,
 		dev:         dev,
-		cancelFuncs: make(map[uint64]func()),
+		inFlight:    make(map[uint64]*inFlightOp),
+		errors:      make(chan OpError, opErrorBufferSize),
+		clock:       cfg.Clock,
+	}
+
+	if c.clock == nil {
+		c.clock = timeutil.RealClock()
+	}
+
+	c.memoryReleased = sync.NewCond(&c.mu)
+	c.memoryWake = make(chan struct{}, 1)
+	c.attrHistory = newAttributeHistory(&cfg, c.clock)
+	c.notifications = newNotificationQueue(c, cfg.MinNotificationInterval)
+
+	if cfg.ConcurrencyLimit != nil {
+		limits, err := newConcurrencyLimits(cfg.ConcurrencyLimit, c.clock)
+		if err != nil {
+			c.close()
+			return nil, fmt.Errorf("ConcurrencyLimit: %v", err)
+		}
+
+		c.limits = limits
+	}
+
+	if cfg.Strict != nil {
+		c.strict = newStrictState()
+	}
+
+	if cfg.Capture != nil {
+		w, err := fusecapture.NewWriter(cfg.Capture.Writer, cfg.Capture.MaxPayload)
+		if err != nil {
+			c.close()
+			return nil, fmt.Errorf("Capture: %v", err)
+		}
+
+		c.capture = w
+	}
+
+	// Initialize, unless another process already did.
+	if cfg.Resume != nil {
+		if err := c.resume(*cfg.Resume); err != nil {
+			c.close()
+			return nil, fmt.Errorf("resume: %v", err)
+		}
+
+		return c, nil
 	}
 
-	// Initialize.
 	if err := c.Init(); err != nil {
 		c.close()
 		return nil, fmt.Errorf("Init: %v", err)
@@ -148,41 +396,69 @@ func (c *Connection) Init() error {
 		c.protocol = initOp.Kernel
 	}
 
-	cacheSymlinks := initOp.Flags&fusekernel.InitCacheSymlinks > 0
-	noOpenSupport := initOp.Flags&fusekernel.InitNoOpenSupport > 0
-	noOpendirSupport := initOp.Flags&fusekernel.InitNoOpendirSupport > 0
+	kernelFlags := initOp.Flags
+	noOpenSupport := kernelFlags&fusekernel.InitNoOpenSupport > 0
+	noOpendirSupport := kernelFlags&fusekernel.InitNoOpendirSupport > 0
+
+	// Decide on the optional features, offering the server a say.
+	offered := initFeaturesFromFlags(kernelFlags)
+	n := InitNegotiation{
+		KernelMajor: initOp.Kernel.Major,
+		KernelMinor: initOp.Kernel.Minor,
+		Offered:     offered,
+		Wanted: InitFeatures{
+			// Enable writeback caching if the user hasn't asked us not to.
+			WritebackCache: !c.cfg.DisableWritebackCaching,
+
+			// Ask for READDIRPLUS in place of READDIR if the user opted into it.
+			// We don't set InitReaddirplusAuto, so the kernel uses it for every
+			// read.
+			ReadDirPlus: c.cfg.EnableReadDirPlus,
+
+			// Take over record and flock locks if the user opted into it.
+			POSIXLocks: c.cfg.EnablePOSIXLocks,
+			FlockLocks: c.cfg.EnableFlockLocks,
+
+			// Enable caching symlink targets in the kernel page cache if the user
+			// opted into it (might require fixing the size field of inode
+			// attributes first).
+			SymlinkCaching: c.cfg.EnableSymlinkCaching,
+		},
+	}
+
+	n.Wanted = initFeaturesFromFlags(n.Wanted.flags() & kernelFlags)
+	if c.negotiator != nil {
+		if err := c.negotiator.NegotiateInit(&n); err != nil {
+			c.Reply(ctx, syscall.EPROTO)
+			return fmt.Errorf("NegotiateInit: %v", err)
+		}
+	}
+
+	features := initFeaturesFromFlags(n.Wanted.flags() & kernelFlags)
+	c.mountInfo.Features = features
 
 	// Respond to the init op.
 	initOp.Library = c.protocol
 	initOp.MaxReadahead = maxReadahead
 	initOp.MaxWrite = buffer.MaxWriteSize
 
-	initOp.Flags = 0
+	initOp.Flags = features.flags()
 
 	// Tell the kernel not to use pitifully small 4 KiB writes.
 	initOp.Flags |= fusekernel.InitBigWrites
 
-	// Enable writeback caching if the user hasn't asked us not to.
-	if !c.cfg.DisableWritebackCaching {
-		initOp.Flags |= fusekernel.InitWritebackCache
-	}
-
-	// Enable caching symlink targets in the kernel page cache if the user opted
-	// into it (might require fixing the size field of inode attributes first):
-	if c.cfg.EnableSymlinkCaching && cacheSymlinks {
-		initOp.Flags |= fusekernel.InitCacheSymlinks
-	}
-
 	// Tell the kernel to treat returning -ENOSYS on OpenFile as not needing
 	// OpenFile calls at all (Linux >= 3.16):
 	if c.cfg.EnableNoOpenSupport && noOpenSupport {
 		initOp.Flags |= fusekernel.InitNoOpenSupport
+		c.noOpen = true
 	}
 
 	// Tell the kernel to treat returning -ENOSYS on OpenDir as not needing
 	// OpenDir calls at all (Linux >= 5.1):
 	if c.cfg.EnableNoOpendirSupport && noOpendirSupport {
 		initOp.Flags |= fusekernel.InitNoOpendirSupport
+		c.noOpendir = true
 	}
 
 	c.Reply(ctx, nil)
@@ -224,28 +500,30 @@ func (c *Connection) debugLog(
 }
 
 // LOCKS_EXCLUDED(c.mu)
-func (c *Connection) recordCancelFunc(
+func (c *Connection) recordInFlight(
 	fuseID uint64,
-	f func()) {
+	f *inFlightOp) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if _, ok := c.cancelFuncs[fuseID]; ok {
-		panic(fmt.Sprintf("Already have cancel func for request %v", fuseID))
+	if _, ok := c.inFlight[fuseID]; ok {
+		panic(fmt.Sprintf("Already have state for request %v", fuseID))
 	}
 
-	c.cancelFuncs[fuseID] = f
+	c.inFlight[fuseID] = f
 }
 
 // Set up state for an op that is about to be returned to the user, given its
 // underlying fuse opcode and request ID.
 //
-// Return a context that should be used for the op.
+// Return a context that should be used for the op, and the op's in-flight
+// state (nil if the op has no reply).
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) beginOp(
 	opCode uint32,
-	fuseID uint64) context.Context {
+	fuseID uint64,
+	op interface{}) (context.Context, *inFlightOp) {
 	// Start with the parent context.
 	ctx := c.cfg.OpContext
 
@@ -257,42 +535,101 @@ func (c *Connection) beginOp(
 	// should not record any state keyed on their ID.
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
-	if opCode != fusekernel.OpForget {
-		var cancel func()
-		ctx, cancel = context.WithCancel(ctx)
-		c.recordCancelFunc(fuseID, cancel)
+	var f *inFlightOp
+	if opCode != fusekernel.OpForget && opCode != fusekernel.OpBatchForget {
+		f = &inFlightOp{op: op}
+		ctx, f.cancel = context.WithCancel(ctx)
+		c.recordInFlight(fuseID, f)
+	}
+
+	c.noteRead(fuseID, f)
+	return ctx, f
+}
+
+// Note that the request with the given ID and in-flight state (nil for a
+// forget) has been read, applying any interrupt that came ahead of it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteRead(
+	fuseID uint64,
+	f *inFlightOp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if fuseID > c.lastID {
+		c.lastID = fuseID
+	}
+
+	if len(c.earlyInterrupts) == 0 {
+		return
+	}
+
+	if _, ok := c.earlyInterrupts[fuseID]; ok && f != nil {
+		f.interrupted = true
+		f.cancel()
+	}
+
+	// Interrupts for the IDs up to this one have nothing more to wait for.
+	for id := range c.earlyInterrupts {
+		if id <= fuseID {
+			delete(c.earlyInterrupts, id)
+		}
 	}
+}
+
+// Report whether the kernel interrupted the op with the given in-flight
+// state.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) wasInterrupted(f *inFlightOp) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return ctx
+	return f != nil && f.interrupted
 }
 
 // Clean up all state associated with an op to which the user has responded,
-// given its underlying fuse opcode and request ID. This must be called before
-// a response is sent to the kernel, to avoid a race where the request's ID
-// might be reused by osxfuse.
+// given its underlying fuse opcode, request ID, and in-flight state. This
+// must be called before a response is sent to the kernel, to avoid a race
+// where the request's ID might be reused by osxfuse.
+//
+// Return false if the op has already been failed by EnterDegradedMode, in
+// which case no response should be sent.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) finishOp(
 	opCode uint32,
-	fuseID uint64) {
+	fuseID uint64,
+	f *inFlightOp) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if f != nil {
+		c.finishMutatingOp(f)
+	}
+
 	// Even though the op is finished, context.WithCancel requires us to arrange
 	// for the cancellation function to be invoked. We also must remove it from
 	// our map.
 	//
 	// Special case: we don't do this for Forget requests. See the note in
 	// beginOp above.
-	if opCode != fusekernel.OpForget {
-		cancel, ok := c.cancelFuncs[fuseID]
-		if !ok {
+	if opCode != fusekernel.OpForget && opCode != fusekernel.OpBatchForget {
+		// Failing the op already took care of this, and the ID may since have
+		// been reused.
+		if f.failed {
+			return false
+		}
+
+		if _, ok := c.inFlight[fuseID]; !ok {
 			panic(fmt.Sprintf("Unknown request ID in finishOp: %v", fuseID))
 		}
 
-		cancel()
-		delete(c.cancelFuncs, fuseID)
+		f.cancel()
+		delete(c.inFlight, fuseID)
 	}
+
+	return true
 }
 
 // LOCKS_EXCLUDED(c.mu)
@@ -309,17 +646,30 @@ func (c *Connection) handleInterrupt(fuseID uint64) {
 	// race and EAGAIN appears to be aimed at userspace programs that
 	// concurrently process requests (cf. http://goo.gl/BES2rs).
 	//
-	// So in this method if we can't find the ID to be interrupted, it means that
-	// the request has already been replied to.
+	// So in this method if we can't find the ID to be interrupted, it usually
+	// means that the request has already been replied to. The kernel issues
+	// IDs in increasing order, though, so an ID above any we have read can
+	// only be for a request that has overtaken its interrupt, which we then
+	// cancel as soon as it is read, rather than answering EAGAIN and having
+	// the kernel send the interrupt again.
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
 	// Cf. http://comments.gmane.org/gmane.comp.file-systems.fuse.devel/14675
-	cancel, ok := c.cancelFuncs[fuseID]
+	f, ok := c.inFlight[fuseID]
 	if !ok {
+		if fuseID > c.lastID {
+			if c.earlyInterrupts == nil {
+				c.earlyInterrupts = make(map[uint64]struct{})
+			}
+
+			c.earlyInterrupts[fuseID] = struct{}{}
+		}
+
 		return
 	}
 
-	cancel()
+	f.interrupted = true
+	f.cancel()
 }
 
 // Read the next message from the kernel. The message must later be destroyed
@@ -356,12 +706,27 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 			return nil, err
 		}
 
+		c.captureMessage(fusecapture.FromKernel, m.Bytes())
 		return m, nil
 	}
 }
 
 // Write the supplied message to the kernel.
+//
+// LOCKS_EXCLUDED(c.mu)
 func (c *Connection) writeMessage(msg []byte) error {
+	c.mu.Lock()
+	hook := c.writeHook
+	c.mu.Unlock()
+
+	if hook != nil {
+		if err := hook(msg); err != nil {
+			return err
+		}
+	}
+
+	c.captureMessage(fusecapture.ToKernel, msg)
+
 	// Avoid the retry loop in os.File.Write.
 	n, err := syscall.Write(int(c.dev.Fd()), msg)
 	if err != nil {
@@ -376,8 +741,10 @@ func (c *Connection) writeMessage(msg []byte) error {
 }
 
 // ReadOp consumes the next op from the kernel process, returning the op and a
-// context that should be used for work related to the op. It returns io.EOF if
-// the kernel has closed the connection.
+// context that should be used for work related to the op. The context is
+// cancelled if the kernel interrupts the op, e.g. because the process waiting
+// for it was signalled. It returns io.EOF if the kernel has closed the
+// connection.
 //
 // If err != nil, the user is responsible for later calling c.Reply with the
 // returned context.
@@ -389,36 +756,146 @@ func (c *Connection) writeMessage(msg []byte) error {
 func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 	// Keep going until we find a request we know how to convert.
 	for {
-		// Read the next message from the kernel.
-		inMsg, err := c.readMessage()
-		if err != nil {
-			return nil, nil, err
-		}
+		var inMsg *buffer.InMessage
+		var outMsg *buffer.OutMessage
+
+		// Hand out the oldest parked op, once there is memory for it.
+		if len(c.parked) > 0 && c.memoryAvailable() {
+			p := c.parked[0]
+			c.parked = c.parked[1:]
+			inMsg, outMsg, op = p.inMsg, p.outMsg, p.op
+		} else {
+			// Once detached, leave what the kernel sends next for whoever takes
+			// over the connection.
+			if c.isDetached() && len(c.parked) == 0 && c.pendingRead == nil {
+				return nil, nil, io.EOF
+			}
 
-		// Convert the message to an op.
-		outMsg := c.getOutMessage()
-		op, err = convertInMessage(inMsg, outMsg, c.protocol)
-		if err != nil {
-			c.putOutMessage(outMsg)
-			return nil, nil, fmt.Errorf("convertInMessage: %v", err)
+			// Read the next message from the kernel, or wake to hand out a parked
+			// op.
+			var err error
+			inMsg, err = c.readOrWake()
+			if err == io.EOF {
+				c.dropParked()
+				c.hangUp()
+				c.checkAborted()
+			}
+
+			if err != nil {
+				if err != io.EOF {
+					c.noteServeError(err)
+				}
+
+				return nil, nil, err
+			}
+
+			if inMsg == nil {
+				continue
+			}
+
+			// If the kernel has hung up, its reads usually fail too. But don't
+			// rely on that, and don't hand out ops that can't be replied to.
+			if c.isHungUp() {
+				c.dropParked()
+				c.putInMessage(inMsg)
+				return nil, nil, io.EOF
+			}
+
+			// Convert the message to an op.
+			outMsg = c.getOutMessage()
+			op, err = convertInMessage(inMsg, outMsg, c.protocol)
+			if err != nil {
+				c.rejectMessage(inMsg, outMsg, err)
+				continue
+			}
+
+			// Log the op under the kernel's ID for the request.
+			if c.debugLogger != nil {
+				c.debugLog(inMsg.Header().Unique, 1, "<- %s", describeRequest(op))
+			}
+
+			// Special case: handle interrupt requests inline.
+			if interruptOp, ok := op.(*interruptOp); ok {
+				c.handleInterrupt(interruptOp.FuseID)
+				c.putInMessage(inMsg)
+				c.putOutMessage(outMsg)
+				continue
+			}
+
+			// Likewise the kernel's goodbye, which is answered once the
+			// connection has wound down.
+			if _, ok := op.(*destroyOp); ok {
+				c.handleDestroy(inMsg.Header().Unique)
+				c.dropParked()
+				c.putInMessage(inMsg)
+				c.putOutMessage(outMsg)
+				return nil, nil, io.EOF
+			}
+
+			c.countCacheOp(op)
+
+			// If in-flight ops hold too much memory, park this op until they
+			// release some, behind any parked already. Meanwhile keep reading, so
+			// that interrupts and forgets still get through; the kernel limits
+			// how many other requests it has outstanding. Ops failed in degraded
+			// mode are replied to straight away, so needn't wait.
+			if !passesMemoryLimit(op) && (len(c.parked) > 0 || !c.memoryAvailable()) {
+				c.parked = append(c.parked, parkedOp{inMsg, outMsg, op})
+				continue
+			}
 		}
 
-		// Choose an ID for this operation for the purposes of logging, and log it.
+		// Set up a context that remembers information about this op.
+		ctx, f := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique, op)
+		state := opState{conn: c, inMsg: inMsg, outMsg: outMsg, op: op, inFlight: f}
+		state.record = c.accountOp(inMsg.Header().Unique, state)
 		if c.debugLogger != nil {
-			c.debugLog(inMsg.Header().Unique, 1, "<- %s", describeRequest(op))
+			state.start = c.clock.Now()
 		}
 
-		// Special case: handle interrupt requests inline.
-		if interruptOp, ok := op.(*interruptOp); ok {
-			c.handleInterrupt(interruptOp.FuseID)
+		ctx = context.WithValue(ctx, contextKey, state)
+		c.holdMemory()
+
+		// In degraded mode, fail the op without involving the user unless it
+		// must go through regardless.
+		if errno := c.degradedError(); errno != 0 && !passesDegradedMode(op) {
+			c.Reply(ctx, errno)
 			continue
 		}
 
-		// Set up a context that remembers information about this op.
-		ctx := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
-		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op})
+		// Likewise for names the user has told us it can't handle.
+		if c.nameTooLong(op) {
+			c.Reply(ctx, syscall.ENAMETOOLONG)
+			continue
+		}
+
+		// And for rename flags it doesn't implement.
+		if c.renameFlagsUnsupported(op) {
+			c.Reply(ctx, syscall.EINVAL)
+			continue
+		}
+
+		// And for extended attributes beyond the usual limits.
+		if errno := xattrError(op); errno != 0 {
+			c.Reply(ctx, errno)
+			continue
+		}
+
+		// And for offsets and sizes that are out of range.
+		if errno := rangeError(op); errno != 0 {
+			c.Reply(ctx, errno)
+			continue
+		}
 
-		// Return the op to the user.
+		// The capabilities the server declared are served by us.
+		if err, ok := c.capabilitiesOp(op); ok {
+			c.Reply(ctx, err)
+			continue
+		}
+
+		// Return the op to the user, who waits in WaitForThaw if it mustn't go
+		// ahead yet.
+		c.admitOp(f)
 		return ctx, op, nil
 	}
 }
@@ -437,6 +914,22 @@ func (c *Connection) shouldLogError(
 		return false
 	}
 
+	// Judge wrapped errnos by the errno the kernel is told.
+	if errno, ok := errnoOf(err); ok {
+		err = errno
+	}
+
+	// The application asked for failures in degraded mode, so they're not
+	// news.
+	if errno := c.degradedError(); errno != 0 && err == errno {
+		return false
+	}
+
+	// Nor are names that are too long, whoever rejected them.
+	if err == syscall.ENAMETOOLONG {
+		return false
+	}
+
 	switch op.(type) {
 	case *fuseops.LookUpInodeOp:
 		// It is totally normal for the kernel to ask to look up an inode by name
@@ -450,6 +943,13 @@ func (c *Connection) shouldLogError(
 		if err == syscall.ENODATA || err == syscall.ERANGE {
 			return false
 		}
+
+	case *fuseops.SetXattrOp:
+		// Nor are values beyond the limits in xattrError.
+		if err == syscall.E2BIG || err == syscall.ERANGE {
+			return false
+		}
+
 	case *unknownOp:
 		// Don't bother the user with methods we intentionally don't support.
 		if err == syscall.ENOSYS {
@@ -460,9 +960,167 @@ func (c *Connection) shouldLogError(
 	return true
 }
 
+// OpContext returns the context from which the contexts of ops are derived.
+// See MountConfig.OpContext.
+func (c *Connection) OpContext() context.Context {
+	return c.cfg.OpContext
+}
+
+// MountInfo returns information identifying this connection, the same as
+// MountInfoFromContext returns for the contexts of its ops.
+func (c *Connection) MountInfo() MountInfo {
+	return c.mountInfo
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) isHungUp() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hungUp
+}
+
+// DroppedReplies returns the number of replies that the kernel refused
+// because it was no longer waiting for them. See the notes on Reply.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) DroppedReplies() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.droppedReplies
+}
+
+// Deal with a failure to write the reply to an op, according to the policy
+// described in the notes on Reply.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) handleReplyWriteError(
+	fuseID uint64,
+	op interface{},
+	err error) {
+	switch err {
+	case syscall.ENOENT:
+		c.mu.Lock()
+		c.droppedReplies++
+		c.mu.Unlock()
+
+	case syscall.ENOTCONN, syscall.ENODEV:
+		c.hangUp()
+
+	default:
+		if c.errorLogger != nil {
+			c.errorLogger.Printf("Op 0x%08x: writing reply for %T: %v", fuseID, op, err)
+		}
+
+		c.reportError(OpError{
+			Op:  fmt.Sprintf("%T", op),
+			Err: fmt.Errorf("writing reply: %v", err),
+		})
+
+		// The kernel may yet accept a bare error, for example if it was the
+		// reply's contents it rejected. Otherwise the caller waits forever.
+		c.replyEIO(fuseID)
+	}
+}
+
+// ReportPanic records that the server panicked with r while handling op, the
+// op associated with ctx (a context returned by ReadOp): it logs r and the
+// stack to the ErrorLogger, and delivers an OpError on Errors. It is meant
+// to be called from a deferred function that recovers, before failing the op
+// with EIO as fuseutil.NewFileSystemServer does, or before re-panicking, so
+// that the panic is on record even when the process's stderr goes nowhere, as
+// for the background copy of a mount helper.
+func (c *Connection) ReportPanic(
+	ctx context.Context,
+	op interface{},
+	r interface{}) {
+	fuseID, _ := RequestIDFromContext(ctx)
+	if c.errorLogger != nil {
+		c.errorLogger.Printf("Op 0x%08x: %T panicked: %v\n%s", fuseID, op, r, debug.Stack())
+	}
+
+	c.reportError(OpError{
+		Op:  fmt.Sprintf("%T", op),
+		Err: fmt.Errorf("panic: %v", r),
+	})
+}
+
+// Fail the request with the given ID with EIO, without involving an op.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) replyEIO(fuseID uint64) {
+	outMsg := c.getOutMessage()
+	defer c.putOutMessage(outMsg)
+
+	h := outMsg.OutHeader()
+	h.Unique = fuseID
+	h.Error = -int32(syscall.EIO)
+	h.Len = uint32(outMsg.Len())
+
+	if err := c.writeMessage(outMsg.Bytes()); err != nil && c.errorLogger != nil {
+		c.errorLogger.Printf("Op 0x%08x: writing EIO reply: %v", fuseID, err)
+	}
+}
+
+// Deal with a message from the kernel that convertInMessage couldn't make
+// sense of, with the supplied error: log it, and fail the request with EIO
+// unless the kernel expects no reply. Serving carries on with the next
+// message.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) rejectMessage(
+	inMsg *buffer.InMessage,
+	outMsg *buffer.OutMessage,
+	err error) {
+	h := inMsg.Header()
+	fuseID, opcode := h.Unique, h.Opcode
+
+	c.putInMessage(inMsg)
+	c.putOutMessage(outMsg)
+
+	if c.errorLogger != nil {
+		c.errorLogger.Printf("Op 0x%08x: decoding opcode %d: %v", fuseID, opcode, err)
+	}
+
+	c.reportError(OpError{
+		Op:  fmt.Sprintf("opcode %d", opcode),
+		Err: fmt.Errorf("convertInMessage: %v", err),
+	})
+
+	switch opcode {
+	case fusekernel.OpForget, fusekernel.OpBatchForget, fusekernel.OpInterrupt:
+		return
+	}
+
+	c.replyEIO(fuseID)
+}
+
 // Reply replies to an op previously read using ReadOp, with the supplied error
 // (or nil if successful). The context must be the context returned by ReadOp.
 //
+// The kernel is told the syscall.Errno opErr carries, if any (see the notes
+// on ENOENT and friends), and EIO otherwise. But if the kernel interrupted the
+// op, which cancels its context, an error without one (such as ctx.Err()) is
+// reported to the kernel as EINTR.
+//
+// The op counts as handled however writing the reply turns out, and in no
+// case does the connection stop serving other ops because of one reply:
+//
+//  *  ENOENT means the kernel gave up on the op, for example because it was
+//     interrupted. This is expected, so the reply is silently dropped and
+//     counted in DroppedReplies.
+//
+//  *  ENOTCONN or ENODEV means the kernel has hung up (e.g. the connection was
+//     aborted). Later calls to ReadOp return io.EOF, so that the server
+//     winds down.
+//
+//  *  Any other error is logged to the configured ErrorLogger, and the
+//     kernel is sent a bare EIO reply in its place, so that the caller isn't
+//     left waiting.
+//
+// Once the kernel has hung up, replies are discarded without being written.
+//
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) Reply(ctx context.Context, opErr error) {
 	// Extract the state we stuffed in earlier.
@@ -473,48 +1131,229 @@ func (c *Connection) Reply(ctx context.Context, opErr error) {
 		panic(fmt.Sprintf("Reply called with invalid context: %#v", ctx))
 	}
 
+	// The op's messages may already belong to another op if it has been
+	// replied to before.
+	if !c.claimReply(state) {
+		return
+	}
+
+	c.releaseCapacity(ctx, state)
+
 	op := state.op
 	inMsg := state.inMsg
 	outMsg := state.outMsg
 	fuseID := inMsg.Header().Unique
 
 	// Make sure we destroy the messages when we're done.
+	defer c.releaseMemory()
 	defer c.putInMessage(inMsg)
 	defer c.putOutMessage(outMsg)
 
-	// Clean up state for this op.
-	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
+	// Clean up state for this op. If it has already been failed, the kernel
+	// isn't waiting for this reply.
+	if !c.finishOp(inMsg.Header().Opcode, fuseID, state.inFlight) {
+		if c.debugLogger != nil {
+			c.debugLog(fuseID, 1, "-> Discarded (failed in degraded mode)")
+		}
 
-	// Debug logging
-	if c.debugLogger != nil {
-		if opErr == nil {
-			c.debugLog(fuseID, 1, "-> OK (%s)", describeResponse(op))
-		} else {
-			c.debugLog(fuseID, 1, "-> Error: %q", opErr.Error())
+		c.finishAccounting(outcomeDiscarded)
+		return
+	}
+
+	// Nor is it if it has hung up.
+	if c.isHungUp() {
+		if c.debugLogger != nil {
+			c.debugLog(fuseID, 1, "-> Discarded (kernel hung up)")
+		}
+
+		c.finishAccounting(outcomeDiscarded)
+		return
+	}
+
+	// In strict mode, make sure the response makes sense.
+	if opErr == nil && c.cfg.Strict != nil {
+		if err := c.checkResponse(op); err != nil {
+			opErr = c.strictViolation(fuseID, op, err)
 		}
 	}
 
+	// A response that can't be encoded fails the op, rather than the server.
+	if opErr == nil {
+		opErr = checkResponseSize(op)
+	}
+
 	// Error logging
 	if c.shouldLogError(op, opErr) {
-		c.errorLogger.Printf("%T error: %v", op, opErr)
+		c.errorLogger.Printf("Op 0x%08x: %T error: %v", fuseID, op, opErr)
+	}
+
+	userErr := opErr
+
+	// A write that failed part way through is reported as a short write.
+	if o, ok := op.(*fuseops.WriteFileOp); ok {
+		if opErr != nil && o.BytesWritten > 0 && o.BytesWritten < len(o.Data) {
+			opErr = nil
+		} else {
+			o.BytesWritten = len(o.Data)
+		}
+	}
+
+	// An interrupted op that fails with something other than an errno, such as
+	// ctx.Err(), has most likely failed because of the interruption, and the
+	// kernel is told so.
+	if opErr != nil && c.wasInterrupted(state.inFlight) {
+		if _, ok := errnoOf(opErr); !ok {
+			opErr = syscall.EINTR
+		}
+	}
+
+	// Debug logging, of what the kernel is told and how long the op took.
+	if c.debugLogger != nil {
+		latency := c.clock.Now().Sub(state.start)
+		if opErr == nil {
+			c.debugLog(fuseID, 1, "-> OK (%s) in %v", describeResponse(op), latency)
+		} else {
+			c.debugLog(
+				fuseID,
+				1,
+				"-> Error: %q (errno %d) in %v",
+				userErr.Error(),
+				replyErrno(opErr),
+				latency)
+		}
 	}
 
 	// Send the reply to the kernel, if one is required.
-	noResponse := c.kernelResponse(outMsg, inMsg.Header().Unique, op, opErr)
+	noResponse := c.kernelResponse(outMsg, fuseID, op, opErr)
 
 	if !noResponse {
-		err := c.writeMessage(outMsg.Bytes())
-		if err != nil && c.errorLogger != nil {
-			c.errorLogger.Printf("writeMessage: %v %v", err, outMsg.Bytes())
+		// Record what the kernel is told before it can act on it.
+		if opErr == nil {
+			c.attrHistory.recordReply(op)
+		}
+
+		if err := c.writeMessage(outMsg.Bytes()); err != nil {
+			c.handleReplyWriteError(fuseID, op, err)
+			if err == syscall.ENOENT {
+				c.finishAccounting(outcomeInterrupted)
+			} else {
+				c.finishAccounting(outcomeDiscarded)
+			}
+
+			return
 		}
 	}
+
+	c.finishAccounting(outcomeReplied)
+}
+
+// Return whether op must be passed to the user even in degraded mode. Forgets
+// keep lookup counts right, and releases let the user clean up handles opened
+// before degrading.
+func passesDegradedMode(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp,
+		*fuseops.BatchForgetOp,
+		*fuseops.ReleaseFileHandleOp,
+		*fuseops.ReleaseDirHandleOp:
+		return true
+	}
+
+	return false
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) degradedError() syscall.Errno {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.degradedErr
+}
+
+// Fail new ops with errno until exitDegradedMode is called. If failInFlight is
+// set, also fail the in-flight ops that wouldn't have been let through,
+// cancelling their contexts.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) enterDegradedMode(
+	errno syscall.Errno,
+	failInFlight bool) {
+	if errno == 0 {
+		panic("enterDegradedMode called with zero errno")
+	}
+
+	c.mu.Lock()
+	c.degradedErr = errno
+
+	// ReadOp may be waiting for memory, which ops in degraded mode don't need.
+	c.memoryReleased.Broadcast()
+	c.wakeParked()
+
+	failed := make(map[uint64]*inFlightOp)
+	if failInFlight {
+		for fuseID, f := range c.inFlight {
+			if passesDegradedMode(f.op) {
+				continue
+			}
+
+			f.failed = true
+			f.cancel()
+			delete(c.inFlight, fuseID)
+			failed[fuseID] = f
+		}
+	}
+
+	c.mu.Unlock()
+
+	// The user still owns the ops' messages, so respond using fresh ones.
+	for fuseID, f := range failed {
+		if c.debugLogger != nil {
+			c.debugLog(fuseID, 1, "-> Error: %q (errno %d, degraded mode)", errno.Error(), errno)
+		}
+
+		outMsg := c.getOutMessage()
+		c.kernelResponse(outMsg, fuseID, f.op, errno)
+		if err := c.writeMessage(outMsg.Bytes()); err != nil {
+			c.handleReplyWriteError(fuseID, f.op, err)
+		}
+
+		c.putOutMessage(outMsg)
+	}
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) exitDegradedMode() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.degradedErr = 0
 }
 
 // Close the connection. Must not be called until operations that were read
 // from the connection have been responded to.
 func (c *Connection) close() error {
+	// Stop writing notifications first, since the device must not be written
+	// once closed.
+	c.notifications.close()
+
 	// Posix doesn't say that close can be called concurrently with read or
-	// write, but luckily we exclude the possibility of a race by requiring the
-	// user to respond to all ops first.
-	return c.dev.Close()
+	// write, but luckily we exclude the possibility of a race by waiting for
+	// the user to respond to all ops first.
+	c.finishTeardown()
+	c.closeErrors()
+
+	c.mu.Lock()
+	err := c.serveErr
+	c.mu.Unlock()
+
+	// A detached device belongs to whoever takes over the connection.
+	if c.Detached() {
+		return err
+	}
+
+	if closeErr := c.dev.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
 }
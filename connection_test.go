@@ -0,0 +1,878 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A bytes.Buffer that may be written by a logger while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// Serve minimalFS through a fake kernel, logging errors to the returned
+// buffer, and arrange for the first reply written to fail with the supplied
+// error.
+func serveWithFailingReply(
+	t *testing.T,
+	errno syscall.Errno) (*fusetesting.FakeKernel, *syncBuffer) {
+	errorLog := &syncBuffer{}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&minimalFS{}),
+		&fuse.MountConfig{
+			ErrorLogger: log.New(errorLog, "", 0),
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	var once sync.Once
+	fuse.SetWriteHook(k.MountedFileSystem(), func(msg []byte) (err error) {
+		once.Do(func() { err = errno })
+		return
+	})
+
+	return k, errorLog
+}
+
+// Wait for the supplied condition to become true, failing the test if it
+// takes too long.
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", desc)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Send a statfs request whose reply the fake kernel won't wait for.
+func sendStatFS(t *testing.T, k *fusetesting.FakeKernel) {
+	if err := k.Send(fusekernel.OpStatfs, 1, nil); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestReplyWriteError_ENOENT(t *testing.T) {
+	k, errorLog := serveWithFailingReply(t, syscall.ENOENT)
+	defer k.Close()
+
+	c := fuse.ConnectionOf(k.MountedFileSystem())
+
+	// The reply should be counted as dropped.
+	sendStatFS(t, k)
+	waitFor(t, "dropped reply", func() bool { return c.DroppedReplies() == 1 })
+
+	// The connection should keep serving.
+	if _, err := k.Call(fusekernel.OpStatfs, 1, nil); err != nil {
+		t.Fatalf("StatFS: %v", err)
+	}
+
+	// Nothing should have been logged.
+	if s := errorLog.String(); s != "" {
+		t.Errorf("Unexpected error log output: %q", s)
+	}
+}
+
+func TestReplyWriteError_ENOTCONN(t *testing.T) {
+	k, errorLog := serveWithFailingReply(t, syscall.ENOTCONN)
+	defer k.Close()
+
+	mfs := k.MountedFileSystem()
+
+	sendStatFS(t, k)
+	waitFor(t, "hang up", func() bool { return fuse.HungUp(mfs) })
+
+	// The next request should cause the server to wind down, even though the
+	// fake kernel's end of the connection is still open.
+	sendStatFS(t, k)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	if n := fuse.ConnectionOf(mfs).DroppedReplies(); n != 0 {
+		t.Errorf("DroppedReplies: %d", n)
+	}
+
+	if s := errorLog.String(); s != "" {
+		t.Errorf("Unexpected error log output: %q", s)
+	}
+}
+
+func TestReplyWriteError_Other(t *testing.T) {
+	k, errorLog := serveWithFailingReply(t, syscall.EIO)
+	defer k.Close()
+
+	// The error should be logged.
+	sendStatFS(t, k)
+	waitFor(t, "error log", func() bool { return errorLog.String() != "" })
+
+	if s := errorLog.String(); !strings.Contains(s, syscall.EIO.Error()) {
+		t.Errorf("Unexpected error log output: %q", s)
+	}
+
+	// The connection should keep serving.
+	if _, err := k.Call(fusekernel.OpStatfs, 1, nil); err != nil {
+		t.Fatalf("StatFS: %v", err)
+	}
+
+	if n := fuse.ConnectionOf(k.MountedFileSystem()).DroppedReplies(); n != 0 {
+		t.Errorf("DroppedReplies: %d", n)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Degraded mode
+////////////////////////////////////////////////////////////////////////
+
+// An inode whose attributes can't be fetched until the test allows it.
+const slowInode fuseops.InodeID = fuseops.RootInodeID + 1
+
+// A file system with no contents besides slowInode, which it allows to be
+// opened.
+type degradedFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// Closed by GetInodeAttributes when it starts waiting on slowInode. The
+	// wait ends when unblock is closed or the op's context is cancelled.
+	started chan struct{}
+	unblock chan struct{}
+
+	mu        sync.Mutex
+	getAttrs  int   // GUARDED_BY(mu)
+	releases  int   // GUARDED_BY(mu)
+	cancelled bool  // GUARDED_BY(mu)
+	waitErr   error // GUARDED_BY(mu)
+}
+
+func newDegradedFS() *degradedFS {
+	return &degradedFS{
+		started: make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+}
+
+func (fs *degradedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	fs.getAttrs++
+	fs.mu.Unlock()
+
+	if op.Inode != slowInode {
+		return nil
+	}
+
+	close(fs.started)
+
+	select {
+	case <-fs.unblock:
+		return nil
+
+	case <-ctx.Done():
+		fs.mu.Lock()
+		fs.cancelled = true
+		fs.mu.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+func (fs *degradedFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *degradedFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	fs.releases++
+	fs.mu.Unlock()
+
+	return nil
+}
+
+func (fs *degradedFS) counts() (getAttrs int, releases int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.getAttrs, fs.releases
+}
+
+func TestDegradedMode_NewOps(t *testing.T) {
+	fs := newDegradedFS()
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	mfs := k.MountedFileSystem()
+
+	// Open a handle while healthy.
+	h, err := k.Open(slowInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// In degraded mode, stat should fail without reaching the file system.
+	mfs.EnterDegradedMode(fuse.EHOSTDOWN, false)
+
+	if _, err := k.GetAttr(fuseops.RootInodeID); err != fuse.EHOSTDOWN {
+		t.Errorf("GetAttr: got %v, want EHOSTDOWN", err)
+	}
+
+	if getAttrs, _ := fs.counts(); getAttrs != 0 {
+		t.Errorf("File system saw %d getattrs", getAttrs)
+	}
+
+	// The handle should still be released by the file system.
+	if err := k.Release(slowInode, h); err != nil {
+		t.Errorf("Release: %v", err)
+	}
+
+	if _, releases := fs.counts(); releases != 1 {
+		t.Errorf("File system saw %d releases", releases)
+	}
+
+	// Once out of degraded mode, stat should work again.
+	mfs.ExitDegradedMode()
+
+	if _, err := k.GetAttr(fuseops.RootInodeID); err != nil {
+		t.Errorf("GetAttr: %v", err)
+	}
+
+	if getAttrs, _ := fs.counts(); getAttrs != 1 {
+		t.Errorf("File system saw %d getattrs", getAttrs)
+	}
+}
+
+func TestDegradedMode_InFlightOps(t *testing.T) {
+	fs := newDegradedFS()
+	debugLog := &syncBuffer{}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			DebugLogger: log.New(debugLog, "", 0),
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	mfs := k.MountedFileSystem()
+
+	// Count the replies written from here on.
+	var mu sync.Mutex
+	var writes int
+	fuse.SetWriteHook(mfs, func(msg []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		writes++
+		return nil
+	})
+
+	// Start a stat that the file system won't finish.
+	result := make(chan error, 1)
+	go func() {
+		_, err := k.GetAttr(slowInode)
+		result <- err
+	}()
+
+	<-fs.started
+
+	// Failing in-flight ops should answer it straight away.
+	mfs.EnterDegradedMode(fuse.EIO, true)
+
+	select {
+	case err := <-result:
+		if err != fuse.EIO {
+			t.Errorf("GetAttr: got %v, want EIO", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for GetAttr to fail")
+	}
+
+	// The file system should see its context cancelled, and its reply should be
+	// discarded rather than written.
+	waitFor(t, "discarded reply", func() bool {
+		return strings.Contains(debugLog.String(), "Discarded")
+	})
+
+	fs.mu.Lock()
+	cancelled := fs.cancelled
+	fs.mu.Unlock()
+
+	if !cancelled {
+		t.Errorf("Context wasn't cancelled")
+	}
+
+	mu.Lock()
+	if writes != 1 {
+		t.Errorf("Wrote %d replies, want 1", writes)
+	}
+	mu.Unlock()
+
+	// Afterward the file system should be consulted as usual.
+	mfs.ExitDegradedMode()
+
+	if _, err := k.GetAttr(fuseops.RootInodeID); err != nil {
+		t.Errorf("GetAttr: %v", err)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Request IDs
+////////////////////////////////////////////////////////////////////////
+
+// A file system that records the request ID seen by each StatFS call, failing
+// the call if asked to.
+type requestIDFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu   sync.Mutex
+	ids  []uint64 // GUARDED_BY(mu)
+	fail bool     // GUARDED_BY(mu)
+}
+
+func (fs *requestIDFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	id, ok := fuse.RequestIDFromContext(ctx)
+	if !ok {
+		return fuse.EIO
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ids = append(fs.ids, id)
+	if fs.fail {
+		return syscall.EPERM
+	}
+
+	return nil
+}
+
+func TestRequestID(t *testing.T) {
+	fs := &requestIDFS{}
+	debugLog := &syncBuffer{}
+	errorLog := &syncBuffer{}
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			DebugLogger: log.New(debugLog, "", 0),
+			ErrorLogger: log.New(errorLog, "", 0),
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	// Record the request ID in the header of each reply.
+	var mu sync.Mutex
+	var replied []uint64
+	fuse.SetWriteHook(k.MountedFileSystem(), func(msg []byte) error {
+		var h fusekernel.OutHeader
+		if len(msg) >= int(unsafe.Sizeof(h)) {
+			h = *(*fusekernel.OutHeader)(unsafe.Pointer(&msg[0]))
+		}
+
+		mu.Lock()
+		replied = append(replied, h.Unique)
+		mu.Unlock()
+
+		return nil
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := k.Call(fusekernel.OpStatfs, 1, nil); err != nil {
+			t.Fatalf("StatFS: %v", err)
+		}
+	}
+
+	fs.mu.Lock()
+	fs.fail = true
+	fs.mu.Unlock()
+
+	if _, err := k.Call(fusekernel.OpStatfs, 1, nil); err != syscall.EPERM {
+		t.Fatalf("StatFS: got %v, want EPERM", err)
+	}
+
+	// The handler should have seen the IDs of the requests it replied to.
+	fs.mu.Lock()
+	ids := fs.ids
+	fs.mu.Unlock()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(ids) != 3 || len(replied) != 3 {
+		t.Fatalf("Saw IDs %v, replied to %v", ids, replied)
+	}
+
+	for i := range ids {
+		if ids[i] != replied[i] {
+			t.Errorf("Request %d: handler saw ID %v, reply has %v", i, ids[i], replied[i])
+		}
+	}
+
+	if ids[0] == ids[1] {
+		t.Errorf("Requests share ID %v", ids[0])
+	}
+
+	// The logs should identify ops by the same ID.
+	tag := fmt.Sprintf("Op 0x%08x", ids[2])
+	if s := debugLog.String(); !strings.Contains(s, tag) {
+		t.Errorf("Debug log doesn't contain %q: %q", tag, s)
+	}
+
+	if s := errorLog.String(); !strings.Contains(s, tag) {
+		t.Errorf("Error log doesn't contain %q: %q", tag, s)
+	}
+
+	// Outside an op there's no ID.
+	if _, ok := fuse.RequestIDFromContext(context.Background()); ok {
+		t.Error("Got a request ID for a background context")
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Strict mode
+////////////////////////////////////////////////////////////////////////
+
+// The size reported for every file by sloppyFS, which returns twice as much
+// data when read.
+const sloppySize = 5
+
+// A file system that gives subtly invalid responses:
+//
+//  *  Looking up "zero" gives a zero child inode ID.
+//  *  Looking up "expired" gives attributes that expired long ago.
+//  *  Looking up anything else gives a valid entry.
+//  *  Files contain more data than their attributes say.
+//  *  Opening a file gives handle zero.
+//
+type sloppyFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *sloppyFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = fuseops.RootInodeID + 1
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Size:  sloppySize,
+		Nlink: 1,
+		Mode:  0444,
+	}
+
+	switch op.Name {
+	case "zero":
+		op.Entry.Child = 0
+
+	case "expired":
+		op.Entry.AttributesExpiration = time.Unix(1, 0)
+	}
+
+	return nil
+}
+
+func (fs *sloppyFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *sloppyFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	op.BytesRead = copy(op.Dst, "tacoburrito")
+	if op.BytesRead > 2*sloppySize {
+		op.BytesRead = 2 * sloppySize
+	}
+
+	return nil
+}
+
+func serveStrict(
+	t *testing.T,
+	strict *fuse.StrictConfig) (*fusetesting.FakeKernel, *syncBuffer) {
+	errorLog := &syncBuffer{}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&sloppyFS{}),
+		&fuse.MountConfig{
+			ErrorLogger:         log.New(errorLog, "", 0),
+			EnableNoOpenSupport: true,
+			Strict:              strict,
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	return k, errorLog
+}
+
+func TestStrictMode_Fail(t *testing.T) {
+	k, errorLog := serveStrict(t, &fuse.StrictConfig{Action: fuse.StrictFail})
+	defer k.Close()
+
+	for _, name := range []string{"zero", "expired"} {
+		if _, err := k.LookUp(fuseops.RootInodeID, name); err != syscall.EIO {
+			t.Errorf("LookUp(%q): got %v, want EIO", name, err)
+		}
+	}
+
+	inode, err := k.LookUp(fuseops.RootInodeID, "foo")
+	if err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	if _, err := k.Open(inode); err != syscall.EIO {
+		t.Errorf("Open: got %v, want EIO", err)
+	}
+
+	if _, err := k.Read(inode, 17, 0, 4096); err != syscall.EIO {
+		t.Errorf("Read: got %v, want EIO", err)
+	}
+
+	// Reading within the size is fine.
+	if data, err := k.Read(inode, 17, 0, sloppySize); err != nil || len(data) != sloppySize {
+		t.Errorf("Read within size: %q, %v", data, err)
+	}
+
+	s := errorLog.String()
+	for _, want := range []string{
+		"invalid *fuseops.LookUpInodeOp response: zero child inode ID",
+		"AttributesExpiration",
+		"invalid *fuseops.OpenFileOp response: zero handle ID",
+		"extends past size 5",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Error log doesn't contain %q: %q", want, s)
+		}
+	}
+}
+
+func TestStrictMode_LogWithDisabledCheck(t *testing.T) {
+	k, errorLog := serveStrict(t, &fuse.StrictConfig{
+		Action:  fuse.StrictLog,
+		Disable: fuse.StrictZeroChild | fuse.StrictZeroHandle,
+	})
+
+	defer k.Close()
+
+	// Problems are logged but the responses still go out.
+	if inode, err := k.LookUp(fuseops.RootInodeID, "zero"); err != nil || inode != 0 {
+		t.Errorf("LookUp(zero): %v, %v", inode, err)
+	}
+
+	if _, err := k.LookUp(fuseops.RootInodeID, "expired"); err != nil {
+		t.Errorf("LookUp(expired): %v", err)
+	}
+
+	if _, err := k.Open(fuseops.RootInodeID + 1); err != nil {
+		t.Errorf("Open: %v", err)
+	}
+
+	s := errorLog.String()
+	if strings.Contains(s, "zero child") || strings.Contains(s, "zero handle") {
+		t.Errorf("Disabled check logged: %q", s)
+	}
+
+	if !strings.Contains(s, "AttributesExpiration") {
+		t.Errorf("Error log doesn't mention the expiration: %q", s)
+	}
+}
+
+// A file system whose root lists "file" as a directory, though it is a
+// regular file, "unknown" with an unknown type, and "dir" accurately. The
+// children have inode IDs 2, 3 and 4.
+type mistypedFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+var mistypedChildren = []struct {
+	name   string
+	listed fuseutil.DirentType
+	mode   os.FileMode
+}{
+	{"file", fuseutil.DT_Directory, 0444},
+	{"unknown", fuseutil.DT_Unknown, 0444},
+	{"dir", fuseutil.DT_Directory, 0555 | os.ModeDir},
+}
+
+func (fs *mistypedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	for i, c := range mistypedChildren {
+		if c.name == op.Name {
+			op.Entry.Child = fuseops.RootInodeID + 1 + fuseops.InodeID(i)
+			op.Entry.Attributes = fuseops.InodeAttributes{
+				Nlink: 1,
+				Mode:  c.mode,
+			}
+
+			return nil
+		}
+	}
+
+	return fuse.ENOENT
+}
+
+func (fs *mistypedFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	for i, c := range mistypedChildren[int(op.Offset):] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], fuseutil.Dirent{
+			Offset: op.Offset + fuseops.DirOffset(i) + 1,
+			Inode:  fuseops.RootInodeID + 1 + fuseops.InodeID(int(op.Offset)+i),
+			Name:   c.name,
+			Type:   c.listed,
+		})
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func TestStrictMode_DirentTypes(t *testing.T) {
+	errorLog := &syncBuffer{}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&mistypedFS{}),
+		&fuse.MountConfig{
+			ErrorLogger: log.New(errorLog, "", 0),
+			Strict:      &fuse.StrictConfig{Action: fuse.StrictFail},
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	// Before anything is listed, there is nothing to contradict.
+	if _, err := k.LookUp(fuseops.RootInodeID, "file"); err != nil {
+		t.Errorf("LookUp before ReadDir: %v", err)
+	}
+
+	if _, err := k.ReadDir(fuseops.RootInodeID, 0, 0, 4096); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	// Once listed as a directory, a regular file is flagged. The unknown and
+	// accurate types are fine.
+	if _, err := k.LookUp(fuseops.RootInodeID, "file"); err != syscall.EIO {
+		t.Errorf("LookUp(file): got %v, want EIO", err)
+	}
+
+	for _, name := range []string{"unknown", "dir"} {
+		if _, err := k.LookUp(fuseops.RootInodeID, name); err != nil {
+			t.Errorf("LookUp(%q): %v", name, err)
+		}
+	}
+
+	want := "ReadDir reported inode 2 as DT_DIR, but its mode is -r--r--r--"
+	if s := errorLog.String(); !strings.Contains(s, want) {
+		t.Errorf("Error log doesn't contain %q: %q", want, s)
+	}
+
+	if n := strings.Count(errorLog.String(), "ReadDir reported"); n != 1 {
+		t.Errorf("%d type mismatches logged, want 1", n)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Expirations
+////////////////////////////////////////////////////////////////////////
+
+// A file system that gives expirations according to the name looked up,
+// measuring absolute ones against clock:
+//
+//  *  "absolute" gives expiration times 10s (attributes) and 20s (entry) from
+//     now.
+//  *  "duration" gives the same as durations.
+//  *  "both" gives both, with the durations set to an hour.
+//
+// GetInodeAttributes gives attributes valid for 30s.
+type expiringFS struct {
+	fuseutil.NotImplementedFileSystem
+	clock timeutil.Clock
+}
+
+func (fs *expiringFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	now := fs.clock.Now()
+	op.Entry.Child = fuseops.RootInodeID + 1
+
+	switch op.Name {
+	case "absolute":
+		op.Entry.AttributesExpiration = now.Add(10 * time.Second)
+		op.Entry.EntryExpiration = now.Add(20 * time.Second)
+
+	case "duration":
+		op.Entry.AttributesValidFor = 10 * time.Second
+		op.Entry.EntryValidFor = 20 * time.Second
+
+	case "both":
+		op.Entry.AttributesExpiration = now.Add(10 * time.Second)
+		op.Entry.EntryExpiration = now.Add(20 * time.Second)
+		op.Entry.AttributesValidFor = time.Hour
+		op.Entry.EntryValidFor = time.Hour
+	}
+
+	return nil
+}
+
+func (fs *expiringFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.AttributesValidFor = 30 * time.Second
+	return nil
+}
+
+func TestExpirations(t *testing.T) {
+	// A clock far from the real time, so that expirations measured against the
+	// wrong one are obvious.
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&expiringFS{clock: clock}),
+		&fuse.MountConfig{
+			Clock:  clock,
+			Strict: &fuse.StrictConfig{Action: fuse.StrictFail},
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	for _, name := range []string{"absolute", "duration", "both"} {
+		out, err := k.Call(
+			fusekernel.OpLookup,
+			fuseops.RootInodeID,
+			append([]byte(name), 0))
+
+		if err != nil {
+			t.Fatalf("LookUp(%q): %v", name, err)
+		}
+
+		entry := (*fusekernel.EntryOut)(unsafe.Pointer(&out[0]))
+		if entry.AttrValid != 10 || entry.AttrValidNsec != 0 {
+			t.Errorf(
+				"LookUp(%q): attributes valid for %ds + %dns, want 10s",
+				name,
+				entry.AttrValid,
+				entry.AttrValidNsec)
+		}
+
+		if entry.EntryValid != 20 || entry.EntryValidNsec != 0 {
+			t.Errorf(
+				"LookUp(%q): entry valid for %ds + %dns, want 20s",
+				name,
+				entry.EntryValid,
+				entry.EntryValidNsec)
+		}
+	}
+
+	var in fusekernel.GetattrIn
+	out, err := k.Call(
+		fusekernel.OpGetattr,
+		fuseops.RootInodeID+1,
+		(*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:])
+
+	if err != nil {
+		t.Fatalf("GetAttr: %v", err)
+	}
+
+	attrOut := (*fusekernel.AttrOut)(unsafe.Pointer(&out[0]))
+	if attrOut.AttrValid != 30 || attrOut.AttrValidNsec != 0 {
+		t.Errorf(
+			"GetAttr: attributes valid for %ds + %dns, want 30s",
+			attrOut.AttrValid,
+			attrOut.AttrValidNsec)
+	}
+}
@@ -26,6 +26,7 @@ import (
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/convert"
 	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
@@ -33,6 +34,44 @@ import (
 // Incoming messages
 ////////////////////////////////////////////////////////////////////////
 
+// Return the size of the buffer to read file or directory contents into for a
+// request of the given size, which is limited to what an OutMessage can hold.
+// The kernel doesn't normally ask for more, but a short read is better than
+// dropping the connection if it does.
+func clampReadSize(size uint32) int {
+	if size > buffer.MaxReadSize {
+		return buffer.MaxReadSize
+	}
+
+	return int(size)
+}
+
+// The most output an ioctl reply can carry after its fusekernel.IoctlOut.
+const maxIoctlOutSize = buffer.MaxReadSize - int(unsafe.Sizeof(fusekernel.IoctlOut{}))
+
+// Return an error if the successful response the file system gave to op
+// can't be encoded, rather than letting the encoding panic.
+func checkResponseSize(op interface{}) error {
+	switch o := op.(type) {
+	case *fuseops.IoctlOp:
+		if o.BytesRead < 0 || o.BytesRead > len(o.Dst) {
+			return fmt.Errorf(
+				"BytesRead %d out of range for a %d-byte Dst",
+				o.BytesRead,
+				len(o.Dst))
+		}
+
+		if o.BytesRead > maxIoctlOutSize {
+			return fmt.Errorf(
+				"BytesRead %d exceeds the %d bytes a reply can carry",
+				o.BytesRead,
+				maxIoctlOutSize)
+		}
+	}
+
+	return nil
+}
+
 // Convert a kernel message to an appropriate op. If the op is unknown, a
 // special unexported type will be used.
 //
@@ -67,7 +106,8 @@ func convertInMessage(
 		}
 
 		to := &fuseops.SetInodeAttributesOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			Metadata: convertMetadata(inMsg),
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
 		}
 		o = to
 
@@ -81,14 +121,24 @@ func convertInMessage(
 			to.Mode = &mode
 		}
 
+		if valid&fusekernel.SetattrUid != 0 {
+			to.Uid = &in.Uid
+		}
+
+		if valid&fusekernel.SetattrGid != 0 {
+			to.Gid = &in.Gid
+		}
+
 		if valid&fusekernel.SetattrAtime != 0 {
 			t := time.Unix(int64(in.Atime), int64(in.AtimeNsec))
 			to.Atime = &t
+			to.AtimeNow = valid.AtimeNow()
 		}
 
 		if valid&fusekernel.SetattrMtime != 0 {
 			t := time.Unix(int64(in.Mtime), int64(in.MtimeNsec))
 			to.Mtime = &t
+			to.MtimeNow = valid.MtimeNow()
 		}
 
 		if valid.Handle() {
@@ -108,6 +158,31 @@ func convertInMessage(
 			N:     in.Nlookup,
 		}
 
+	case fusekernel.OpBatchForget:
+		type input fusekernel.BatchForgetIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpBatchForget")
+		}
+
+		const entrySize = unsafe.Sizeof(fusekernel.ForgetOne{})
+		if uintptr(inMsg.Len()) < uintptr(in.Count)*entrySize {
+			return nil, errors.New("Corrupt OpBatchForget")
+		}
+
+		to := &fuseops.BatchForgetOp{
+			Forgets: make([]fuseops.ForgetInodeOp, in.Count),
+		}
+		o = to
+
+		for i := range to.Forgets {
+			entry := (*fusekernel.ForgetOne)(inMsg.Consume(entrySize))
+			to.Forgets[i] = fuseops.ForgetInodeOp{
+				Inode: fuseops.InodeID(entry.Nodeid),
+				N:     entry.Nlookup,
+			}
+		}
+
 	case fusekernel.OpMkdir:
 		in := (*fusekernel.MkdirIn)(inMsg.Consume(fusekernel.MkdirInSize(protocol)))
 		if in == nil {
@@ -151,6 +226,7 @@ func convertInMessage(
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(name),
 			Mode:   convertFileMode(in.Mode),
+			Rdev:   in.Rdev,
 		}
 
 	case fusekernel.OpCreate:
@@ -170,7 +246,8 @@ func convertInMessage(
 			Parent:   fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:     string(name),
 			Mode:     convertFileMode(in.Mode),
-			Metadata: fuseops.OpMetadata{Pid: inMsg.Header().Pid},
+			Flags:    in.Flags,
+			Metadata: convertMetadata(inMsg),
 		}
 
 	case fusekernel.OpSymlink:
@@ -191,11 +268,24 @@ func convertInMessage(
 			Target: string(target),
 		}
 
-	case fusekernel.OpRename:
-		type input fusekernel.RenameIn
-		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
-		if in == nil {
-			return nil, errors.New("Corrupt OpRename")
+	case fusekernel.OpRename, fusekernel.OpRename2:
+		// Rename2 carries the renameat2(2) flags after the new parent.
+		var newDir uint64
+		var flags uint32
+		if inMsg.Header().Opcode == fusekernel.OpRename2 {
+			in := (*fusekernel.Rename2In)(inMsg.Consume(unsafe.Sizeof(fusekernel.Rename2In{})))
+			if in == nil {
+				return nil, errors.New("Corrupt OpRename")
+			}
+
+			newDir, flags = in.Newdir, in.Flags
+		} else {
+			in := (*fusekernel.RenameIn)(inMsg.Consume(unsafe.Sizeof(fusekernel.RenameIn{})))
+			if in == nil {
+				return nil, errors.New("Corrupt OpRename")
+			}
+
+			newDir = in.Newdir
 		}
 
 		names := inMsg.ConsumeBytes(inMsg.Len())
@@ -215,8 +305,9 @@ func convertInMessage(
 		o = &fuseops.RenameOp{
 			OldParent: fuseops.InodeID(inMsg.Header().Nodeid),
 			OldName:   string(oldName),
-			NewParent: fuseops.InodeID(in.Newdir),
+			NewParent: fuseops.InodeID(newDir),
 			NewName:   string(newName),
+			Flags:     fuseops.RenameFlags(flags),
 		}
 
 	case fusekernel.OpUnlink:
@@ -244,9 +335,16 @@ func convertInMessage(
 		}
 
 	case fusekernel.OpOpen:
+		type input fusekernel.OpenIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpOpen")
+		}
+
 		o = &fuseops.OpenFileOp{
 			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
-			Metadata: fuseops.OpMetadata{Pid: inMsg.Header().Pid},
+			Flags:    in.Flags,
+			Metadata: convertMetadata(inMsg),
 		}
 
 	case fusekernel.OpOpendir:
@@ -267,7 +365,7 @@ func convertInMessage(
 		}
 		o = to
 
-		readSize := int(in.Size)
+		readSize := clampReadSize(in.Size)
 		p := outMsg.GrowNoZero(readSize)
 		if p == nil {
 			return nil, fmt.Errorf("Can't grow for %d-byte read", readSize)
@@ -278,7 +376,7 @@ func convertInMessage(
 		sh.Len = readSize
 		sh.Cap = readSize
 
-	case fusekernel.OpReaddir:
+	case fusekernel.OpReaddir, fusekernel.OpReaddirplus:
 		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
 		if in == nil {
 			return nil, errors.New("Corrupt OpReaddir")
@@ -288,10 +386,11 @@ func convertInMessage(
 			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
 			Handle: fuseops.HandleID(in.Fh),
 			Offset: fuseops.DirOffset(in.Offset),
+			Plus:   inMsg.Header().Opcode == fusekernel.OpReaddirplus,
 		}
 		o = to
 
-		readSize := int(in.Size)
+		readSize := clampReadSize(in.Size)
 		p := outMsg.GrowNoZero(readSize)
 		if p == nil {
 			return nil, fmt.Errorf("Can't grow for %d-byte read", readSize)
@@ -309,10 +408,18 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpRelease")
 		}
 
-		o = &fuseops.ReleaseFileHandleOp{
+		to := &fuseops.ReleaseFileHandleOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
 			Handle: fuseops.HandleID(in.Fh),
+			Flags:  fuseops.ReleaseFlags(in.ReleaseFlags),
+		}
+
+		if to.Flags&fuseops.ReleaseFlockUnlock != 0 {
+			to.LockOwner = in.LockOwner
 		}
 
+		o = to
+
 	case fusekernel.OpReleasedir:
 		type input fusekernel.ReleaseIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -350,8 +457,22 @@ func convertInMessage(
 		}
 
 		o = &fuseops.SyncFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:   fuseops.HandleID(in.Fh),
+			DataOnly: in.FsyncFlags&fusekernel.FsyncFdatasync != 0,
+		}
+
+	case fusekernel.OpFsyncdir:
+		type input fusekernel.FsyncIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpFsyncdir")
+		}
+
+		o = &fuseops.SyncDirOp{
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:   fuseops.HandleID(in.Fh),
+			DataOnly: in.FsyncFlags&fusekernel.FsyncFdatasync != 0,
 		}
 
 	case fusekernel.OpFlush:
@@ -362,9 +483,10 @@ func convertInMessage(
 		}
 
 		o = &fuseops.FlushFileOp{
-			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle:   fuseops.HandleID(in.Fh),
-			Metadata: fuseops.OpMetadata{Pid: inMsg.Header().Pid},
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Metadata:  convertMetadata(inMsg),
+			LockOwner: in.LockOwner,
 		}
 
 	case fusekernel.OpReadlink:
@@ -386,6 +508,9 @@ func convertInMessage(
 			FuseID: in.Unique,
 		}
 
+	case fusekernel.OpDestroy:
+		o = &destroyOp{}
+
 	case fusekernel.OpInit:
 		type input fusekernel.InitIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -495,17 +620,15 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpSetxattr")
 		}
 
+		// The payload is "name\x00value", where the value may be empty and is
+		// in.Size bytes long.
 		payload := inMsg.ConsumeBytes(inMsg.Len())
-		// payload should be "name\x00value"
-		if len(payload) < 3 {
-			return nil, errors.New("Corrupt OpSetxattr")
-		}
 		i := bytes.IndexByte(payload, '\x00')
-		if i < 0 {
+		if i < 0 || len(payload)-(i+1) < int(in.Size) {
 			return nil, errors.New("Corrupt OpSetxattr")
 		}
 
-		name, value := payload[:i], payload[i+1:len(payload)]
+		name, value := payload[:i], payload[i+1:i+1+int(in.Size)]
 
 		o = &fuseops.SetXattrOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
@@ -528,6 +651,123 @@ func convertInMessage(
 			Mode:   in.Mode,
 		}
 
+	case fusekernel.OpLseek:
+		type input fusekernel.LseekIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpLseek")
+		}
+
+		o = &fuseops.LseekOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Offset: int64(in.Offset),
+			Whence: fuseops.SeekWhence(in.Whence),
+		}
+
+	case fusekernel.OpCopyFileRange:
+		type input fusekernel.CopyFileRangeIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpCopyFileRange")
+		}
+
+		o = &fuseops.CopyFileRangeOp{
+			SrcInode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			SrcHandle: fuseops.HandleID(in.FhIn),
+			SrcOffset: int64(in.OffIn),
+			DstInode:  fuseops.InodeID(in.NodeidOut),
+			DstHandle: fuseops.HandleID(in.FhOut),
+			DstOffset: int64(in.OffOut),
+			Length:    in.Len,
+		}
+
+	case fusekernel.OpGetlk, fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		in := (*fusekernel.LkIn)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpGetlk or OpSetlk")
+		}
+
+		inode := fuseops.InodeID(inMsg.Header().Nodeid)
+		lock := fuseops.FileLock{
+			Start: in.Lk.Start,
+			End:   in.Lk.End,
+			Type:  in.Lk.Type,
+			Pid:   in.Lk.Pid,
+		}
+
+		if inMsg.Header().Opcode == fusekernel.OpGetlk {
+			o = &fuseops.GetLockOp{
+				Inode:  inode,
+				Handle: fuseops.HandleID(in.Fh),
+				Owner:  in.Owner,
+				Lock:   lock,
+			}
+		} else {
+			o = &fuseops.SetLockOp{
+				Inode:  inode,
+				Handle: fuseops.HandleID(in.Fh),
+				Owner:  in.Owner,
+				Lock:   lock,
+				Wait:   inMsg.Header().Opcode == fusekernel.OpSetlkw,
+				Flock:  in.LkFlags&fusekernel.LkFlock != 0,
+			}
+		}
+
+	case fusekernel.OpIoctl:
+		type input fusekernel.IoctlIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpIoctl")
+		}
+
+		data := inMsg.ConsumeBytes(uintptr(in.InSize))
+		if data == nil {
+			return nil, errors.New("Corrupt OpIoctl")
+		}
+
+		outSize := int(in.OutSize)
+		if outSize > maxIoctlOutSize {
+			outSize = maxIoctlOutSize
+		}
+
+		o = &fuseops.IoctlOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Cmd:    in.Cmd,
+			Arg:    in.Arg,
+			Input:  data,
+			Dst:    make([]byte, outSize),
+		}
+
+	case fusekernel.OpPoll:
+		type input fusekernel.PollIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpPoll")
+		}
+
+		o = &fuseops.PollOp{
+			Inode:      fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:     fuseops.HandleID(in.Fh),
+			PollHandle: fuseops.PollHandle(in.Kh),
+			Notify:     in.Flags&fusekernel.PollScheduleNotify != 0,
+			Events:     in.Events,
+		}
+
+	case fusekernel.OpAccess:
+		type input fusekernel.AccessIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpAccess")
+		}
+
+		o = &fuseops.AccessOp{
+			Metadata: convertMetadata(inMsg),
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Mask:     in.Mask,
+		}
+
 	default:
 		o = &unknownOp{
 			OpCode: inMsg.Header().Opcode,
@@ -558,6 +798,9 @@ func (c *Connection) kernelResponse(
 	case *fuseops.ForgetInodeOp:
 		return true
 
+	case *fuseops.BatchForgetOp:
+		return true
+
 	case *interruptOp:
 		return true
 	}
@@ -568,10 +811,7 @@ func (c *Connection) kernelResponse(
 		handled := false
 
 		if !handled {
-			m.OutHeader().Error = -int32(syscall.EIO)
-			if errno, ok := opErr.(syscall.Errno); ok {
-				m.OutHeader().Error = -int32(errno)
-			}
+			m.OutHeader().Error = -int32(replyErrno(opErr))
 
 			// Special case: for some types, convertInMessage grew the message in order
 			// to obtain a destination buffer. Make sure that we shrink back to just
@@ -601,37 +841,39 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.LookUpInodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.GetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		out.AttrValid, out.AttrValidNsec = c.convertExpiration(
+			o.AttributesExpiration,
+			o.AttributesValidFor)
+		convert.Attributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.SetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
-		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
-		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
+		out.AttrValid, out.AttrValidNsec = c.convertExpiration(
+			o.AttributesExpiration,
+			o.AttributesValidFor)
+		convert.Attributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.MkDirOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.MkNodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.CreateFileOp:
 		eSize := int(fusekernel.EntryOutSize(c.protocol))
 
 		e := (*fusekernel.EntryOut)(m.Grow(eSize))
-		convertChildInodeEntry(&o.Entry, e)
+		c.convertChildInodeEntry(&o.Entry, e)
 
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
@@ -639,12 +881,12 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.CreateLinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		c.convertChildInodeEntry(&o.Entry, out)
 
 	case *fuseops.RenameOp:
 		// Empty response
@@ -659,6 +901,14 @@ func (c *Connection) kernelResponseForOp(
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
 
+		if o.CacheDir {
+			out.OpenFlags |= uint32(fusekernel.OpenCacheDir)
+		}
+
+		if o.KeepCache {
+			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
+		}
+
 	case *fuseops.ReadDirOp:
 		// convertInMessage already set up the destination buffer to be at the end
 		// of the out message. We need only shrink to the right size based on how
@@ -668,6 +918,9 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.ReleaseDirHandleOp:
 		// Empty response
 
+	case *fuseops.SyncDirOp:
+		// Empty response
+
 	case *fuseops.OpenFileOp:
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
@@ -688,7 +941,7 @@ func (c *Connection) kernelResponseForOp(
 
 	case *fuseops.WriteFileOp:
 		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
-		out.Size = uint32(len(o.Data))
+		out.Size = uint32(o.BytesWritten)
 
 	case *fuseops.SyncFileOp:
 		// Empty response
@@ -696,6 +949,9 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.FlushFileOp:
 		// Empty response
 
+	case *fuseops.AccessOp:
+		// Empty response
+
 	case *fuseops.ReleaseFileHandleOp:
 		// Empty response
 
@@ -709,6 +965,7 @@ func (c *Connection) kernelResponseForOp(
 		out.St.Bavail = o.BlocksAvailable
 		out.St.Files = o.Inodes
 		out.St.Ffree = o.InodesFree
+		out.St.Namelen = c.maxNameLength(o)
 
 		// The posix spec for sys/statvfs.h (http://goo.gl/LktgrF) defines the
 		// following fields of statvfs, among others:
@@ -764,6 +1021,36 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.FallocateOp:
 		// Empty response
 
+	case *fuseops.LseekOp:
+		out := (*fusekernel.LseekOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LseekOut{}))))
+		out.Offset = uint64(o.Result)
+
+	case *fuseops.CopyFileRangeOp:
+		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
+		out.Size = uint32(o.BytesCopied)
+
+	case *fuseops.GetLockOp:
+		out := (*fusekernel.LkOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LkOut{}))))
+		out.Lk.Start = o.Conflict.Start
+		out.Lk.End = o.Conflict.End
+		out.Lk.Type = o.Conflict.Type
+		out.Lk.Pid = o.Conflict.Pid
+
+	case *fuseops.SetLockOp:
+		// Empty response
+
+	case *fuseops.IoctlOp:
+		out := (*fusekernel.IoctlOut)(m.Grow(int(unsafe.Sizeof(fusekernel.IoctlOut{}))))
+		out.Result = o.Result
+		m.Append(o.Dst[:o.BytesRead])
+
+	case *fuseops.PollOp:
+		out := (*fusekernel.PollOut)(m.Grow(int(unsafe.Sizeof(fusekernel.PollOut{}))))
+		out.Revents = o.Revents
+
+	case *destroyOp:
+		// Empty response
+
 	case *initOp:
 		out := (*fusekernel.InitOut)(m.Grow(int(unsafe.Sizeof(fusekernel.InitOut{}))))
 
@@ -784,79 +1071,29 @@ func (c *Connection) kernelResponseForOp(
 // General conversions
 ////////////////////////////////////////////////////////////////////////
 
-func convertTime(t time.Time) (secs uint64, nsec uint32) {
-	totalNano := t.UnixNano()
-	secs = uint64(totalNano / 1e9)
-	nsec = uint32(totalNano % 1e9)
-	return secs, nsec
-}
-
-func convertAttributes(
-	inodeID fuseops.InodeID,
-	in *fuseops.InodeAttributes,
-	out *fusekernel.Attr) {
-	out.Ino = uint64(inodeID)
-	out.Size = in.Size
-	out.Atime, out.AtimeNsec = convertTime(in.Atime)
-	out.Mtime, out.MtimeNsec = convertTime(in.Mtime)
-	out.Ctime, out.CtimeNsec = convertTime(in.Ctime)
-	out.SetCrtime(convertTime(in.Crtime))
-	out.Nlink = in.Nlink
-	out.Uid = in.Uid
-	out.Gid = in.Gid
-	// round up to the nearest 512 boundary
-	out.Blocks = (in.Size + 512 - 1) / 512
-
-	// Set the mode.
-	out.Mode = uint32(in.Mode) & 0777
-	switch {
-	default:
-		out.Mode |= syscall.S_IFREG
-	case in.Mode&os.ModeDir != 0:
-		out.Mode |= syscall.S_IFDIR
-	case in.Mode&os.ModeDevice != 0:
-		if in.Mode&os.ModeCharDevice != 0 {
-			out.Mode |= syscall.S_IFCHR
-		} else {
-			out.Mode |= syscall.S_IFBLK
-		}
-	case in.Mode&os.ModeNamedPipe != 0:
-		out.Mode |= syscall.S_IFIFO
-	case in.Mode&os.ModeSymlink != 0:
-		out.Mode |= syscall.S_IFLNK
-	case in.Mode&os.ModeSocket != 0:
-		out.Mode |= syscall.S_IFSOCK
-	}
-	if in.Mode&os.ModeSetuid != 0 {
-		out.Mode |= syscall.S_ISUID
+// Return the metadata describing the caller of the op in inMsg.
+func convertMetadata(inMsg *buffer.InMessage) fuseops.OpMetadata {
+	h := inMsg.Header()
+	return fuseops.OpMetadata{
+		Pid: h.Pid,
+		Uid: h.Uid,
+		Gid: h.Gid,
 	}
 }
 
-// Convert an absolute cache expiration time to a relative time from now for
-// consumption by the fuse kernel module.
-func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
-	// Fuse represents durations as unsigned 64-bit counts of seconds and 32-bit
-	// counts of nanoseconds (cf. http://goo.gl/EJupJV). So negative durations
-	// are right out. There is no need to cap the positive magnitude, because
-	// 2^64 seconds is well longer than the 2^63 ns range of time.Duration.
-	d := t.Sub(time.Now())
-	if d > 0 {
-		secs = uint64(d / time.Second)
-		nsecs = uint32((d % time.Second) / time.Nanosecond)
-	}
-
-	return secs, nsecs
+// Convert a cache expiration, given either as an absolute time or (if that is
+// zero) as a duration, to a relative time from now for consumption by the fuse
+// kernel module.
+func (c *Connection) convertExpiration(
+	t time.Time,
+	d time.Duration) (secs uint64, nsecs uint32) {
+	return convert.Expiration(c.clock.Now(), t, d)
 }
 
-func convertChildInodeEntry(
+func (c *Connection) convertChildInodeEntry(
 	in *fuseops.ChildInodeEntry,
 	out *fusekernel.EntryOut) {
-	out.Nodeid = uint64(in.Child)
-	out.Generation = uint64(in.Generation)
-	out.EntryValid, out.EntryValidNsec = convertExpirationTime(in.EntryExpiration)
-	out.AttrValid, out.AttrValidNsec = convertExpirationTime(in.AttributesExpiration)
-
-	convertAttributes(in.Child, &in.Attributes, &out.Attr)
+	convert.ChildInodeEntry(c.clock.Now(), in, out)
 }
 
 func convertFileMode(unixMode uint32) os.FileMode {
@@ -72,14 +72,30 @@ func describeRequest(op interface{}) (s string) {
 			addComponent("mode %v", *typed.Mode)
 		}
 
+		if typed.Uid != nil {
+			addComponent("uid %d", *typed.Uid)
+		}
+
+		if typed.Gid != nil {
+			addComponent("gid %d", *typed.Gid)
+		}
+
 		if typed.Atime != nil {
 			addComponent("atime %v", *typed.Atime)
 		}
 
+		if typed.AtimeNow {
+			addComponent("atime_now")
+		}
+
 		if typed.Mtime != nil {
 			addComponent("mtime %v", *typed.Mtime)
 		}
 
+		if typed.MtimeNow {
+			addComponent("mtime_now")
+		}
+
 	case *fuseops.ReadFileOp:
 		addComponent("handle %d", typed.Handle)
 		addComponent("offset %d", typed.Offset)
@@ -90,6 +106,22 @@ func describeRequest(op interface{}) (s string) {
 		addComponent("offset %d", typed.Offset)
 		addComponent("%d bytes", len(typed.Data))
 
+	case *fuseops.OpenFileOp:
+		addComponent("flags %#o", typed.Flags)
+
+	case *fuseops.CreateFileOp:
+		addComponent("mode %v", typed.Mode)
+		addComponent("flags %#o", typed.Flags)
+
+	case *fuseops.ReleaseDirHandleOp:
+		addComponent("handle %d", typed.Handle)
+
+	case *fuseops.ReleaseFileHandleOp:
+		addComponent("handle %d", typed.Handle)
+		if typed.Flags != 0 {
+			addComponent("flags %v", typed.Flags)
+		}
+
 	case *fuseops.RemoveXattrOp:
 		addComponent("name %s", typed.Name)
 
@@ -103,6 +135,53 @@ func describeRequest(op interface{}) (s string) {
 		addComponent("offset %d", typed.Offset)
 		addComponent("length %d", typed.Length)
 		addComponent("mode %d", typed.Mode)
+
+	case *fuseops.BatchForgetOp:
+		addComponent("%d forgets", len(typed.Forgets))
+
+	case *fuseops.LseekOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("offset %d", typed.Offset)
+		addComponent("%v", typed.Whence)
+
+	case *fuseops.CopyFileRangeOp:
+		addComponent("inode %d handle %d offset %d", typed.SrcInode, typed.SrcHandle, typed.SrcOffset)
+		addComponent("to inode %d handle %d offset %d", typed.DstInode, typed.DstHandle, typed.DstOffset)
+		addComponent("length %d", typed.Length)
+
+	case *fuseops.GetLockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.Owner)
+		addComponent("type %d", typed.Lock.Type)
+		addComponent("range [%d, %d]", typed.Lock.Start, typed.Lock.End)
+
+	case *fuseops.SetLockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.Owner)
+		addComponent("type %d", typed.Lock.Type)
+		addComponent("range [%d, %d]", typed.Lock.Start, typed.Lock.End)
+		if typed.Wait {
+			addComponent("wait")
+		}
+
+		if typed.Flock {
+			addComponent("flock")
+		}
+
+	case *fuseops.IoctlOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("cmd %#x", typed.Cmd)
+		addComponent("%d bytes in, %d out", len(typed.Input), len(typed.Dst))
+
+	case *fuseops.PollOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("events %#x", typed.Events)
+		if typed.Notify {
+			addComponent("notify %#x", typed.PollHandle)
+		}
+
+	case *fuseops.AccessOp:
+		addComponent("mask %#o", typed.Mask)
 	}
 
 	// Use just the name if there is no extra info.
@@ -130,5 +209,17 @@ func describeResponse(op interface{}) string {
 		}
 	}
 
+	// Include a new handle, so that the ops using it can be matched up.
+	switch typed := op.(type) {
+	case *fuseops.OpenDirOp:
+		addComponent("handle %d", typed.Handle)
+
+	case *fuseops.OpenFileOp:
+		addComponent("handle %d", typed.Handle)
+
+	case *fuseops.CreateFileOp:
+		addComponent("handle %d", typed.Handle)
+	}
+
 	return fmt.Sprintf("%s", strings.Join(components, ", "))
 }
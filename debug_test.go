@@ -0,0 +1,192 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system holding one empty file, whose handles are all numbered 17.
+type handleFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+const handleFSFile = fuseops.RootInodeID + 1
+
+func (fs *handleFS) attrs(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0755 | os.ModeDir}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0644}
+}
+
+func (fs *handleFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attrs(op.Inode)
+	return nil
+}
+
+func (fs *handleFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = handleFSFile
+	op.Entry.Attributes = fs.attrs(handleFSFile)
+	return nil
+}
+
+func (fs *handleFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.Handle = 17
+	return nil
+}
+
+func (fs *handleFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+// A line of debug logging: the op's ID and the message.
+var debugLine = regexp.MustCompile(`^Op (0x[0-9a-f]{8}) +\S+:\d+\] (.*)$`)
+
+// Return the ID of the op whose request was logged as req, and the message
+// logged for its reply, or empty strings if either is missing.
+func findDebugLines(lines []string, req string) (id string, reply string) {
+	for _, line := range lines {
+		m := debugLine.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+
+		switch {
+		case id == "" && m[2] == "<- "+req:
+			id = m[1]
+
+		case id != "" && m[1] == id && strings.HasPrefix(m[2], "-> "):
+			return id, m[2]
+		}
+	}
+
+	return id, ""
+}
+
+func TestDebugLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "debug_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var logged syncBuffer
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(&handleFS{}), &fuse.MountConfig{
+		FSName:      "handlefs",
+		DebugLogger: log.New(&logged, "", 0),
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Unmount(); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	// Look up foo, open it, and close it.
+	fd, err := syscall.Open(path.Join(dir, "foo"), syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	syscall.Close(fd)
+
+	// And fail to look up something else.
+	var st syscall.Stat_t
+	if err := syscall.Stat(path.Join(dir, "bar"), &st); err != syscall.ENOENT {
+		t.Fatalf("Stat: got %v, want ENOENT", err)
+	}
+
+	testCases := []struct {
+		req   string
+		reply *regexp.Regexp
+	}{
+		{
+			`LookUpInode (parent 1, name "foo")`,
+			regexp.MustCompile(`^-> OK \(inode 2\) in \S+$`),
+		},
+		{
+			`OpenFile (inode 2, flags 0100000)`,
+			regexp.MustCompile(`^-> OK \(handle 17\) in \S+$`),
+		},
+		{
+			`ReleaseFileHandle (inode 2, handle 17)`,
+			regexp.MustCompile(`^-> OK \(\) in \S+$`),
+		},
+		{
+			`LookUpInode (parent 1, name "bar")`,
+			regexp.MustCompile(`^-> Error: "no such file or directory" \(errno 2\) in \S+$`),
+		},
+	}
+
+	// The kernel releases the handle in the background once the file is
+	// closed.
+	deadline := time.Now().Add(10 * time.Second)
+	for _, tc := range testCases {
+		var id, reply string
+		for {
+			lines := strings.Split(logged.String(), "\n")
+			if id, reply = findDebugLines(lines, tc.req); reply != "" || time.Now().After(deadline) {
+				break
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if id == "" {
+			t.Errorf("No request logged as %q:\n%s", tc.req, logged.String())
+			continue
+		}
+
+		if !tc.reply.MatchString(reply) {
+			t.Errorf("Op %s: got reply %q, want a match for %q", id, reply, tc.reply)
+		}
+	}
+}
@@ -22,7 +22,8 @@
 //  *  The Server interface, which your daemon must implement.
 //
 //  *  fuseutil.NewFileSystemServer, which offers a convenient way to implement
-//     the Server interface.
+//     the Server interface, and fuseutil.NewSerialFileSystemServer, for
+//     simple file systems that would rather not deal with concurrency.
 //
 //  *  Mount, a function that allows for mounting a Server as a file system.
 //
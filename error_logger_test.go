@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Serve a file system in which every name exists, logging errors to the
+// returned buffer.
+func newLoggedFakeKernel(t *testing.T) (*fusetesting.FakeKernel, *syncBuffer) {
+	logged := &syncBuffer{}
+	fs := &errorFS{errs: make(map[string]error)}
+	k, err := fusetesting.NewFakeKernel(fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		ErrorLogger: log.New(logged, "", 0),
+	})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	return k, logged
+}
+
+func TestErrorLogger_ReplyFailure(t *testing.T) {
+	k, logged := newLoggedFakeKernel(t)
+	defer k.Close()
+
+	// Fail the next write to the kernel.
+	var fail int32 = 1
+	fuse.SetWriteHook(k.MountedFileSystem(), func(msg []byte) error {
+		if atomic.CompareAndSwapInt32(&fail, 1, 0) {
+			return errors.New("taco")
+		}
+
+		return nil
+	})
+
+	// The lookup's reply is lost, but the kernel is still told something.
+	if _, err := k.LookUp(fuseops.RootInodeID, "foo"); err != syscall.EIO {
+		t.Errorf("LookUp: got %v, want EIO", err)
+	}
+
+	const want = "writing reply for *fuseops.LookUpInodeOp: taco"
+	if !strings.Contains(logged.String(), want) {
+		t.Errorf("No %q in the error log:\n%s", want, logged.String())
+	}
+
+	// And the connection carries on.
+	if _, err := k.LookUp(fuseops.RootInodeID, "foo"); err != nil {
+		t.Errorf("LookUp: %v", err)
+	}
+}
+
+func TestErrorLogger_CorruptRequest(t *testing.T) {
+	k, logged := newLoggedFakeKernel(t)
+	defer k.Close()
+
+	// A mknod too short to hold its arguments is failed, not handed to the
+	// file system.
+	if _, err := k.Call(fusekernel.OpMknod, uint64(fuseops.RootInodeID), []byte{1, 2}); err != syscall.EIO {
+		t.Errorf("Mknod: got %v, want EIO", err)
+	}
+
+	const want = "decoding opcode 8: Corrupt OpMknod"
+	if !strings.Contains(logged.String(), want) {
+		t.Errorf("No %q in the error log:\n%s", want, logged.String())
+	}
+
+	// Serving continues.
+	if _, err := k.LookUp(fuseops.RootInodeID, "foo"); err != nil {
+		t.Errorf("LookUp: %v", err)
+	}
+}
+
+// A file system whose ioctls claim to have filled more of Dst than they were
+// given, when asked to.
+type ioctlBytesFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// The length of the last Dst seen.
+	dstLen int64
+}
+
+func (fs *ioctlBytesFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	atomic.StoreInt64(&fs.dstLen, int64(len(op.Dst)))
+
+	op.BytesRead = len(op.Dst)
+	if op.Cmd == 1 {
+		op.BytesRead++
+	}
+
+	return nil
+}
+
+func TestErrorLogger_IoctlBytesRead(t *testing.T) {
+	logged := &syncBuffer{}
+	fs := &ioctlBytesFS{}
+	k, err := fusetesting.NewFakeKernel(fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		ErrorLogger: log.New(logged, "", 0),
+	})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	ioctl := func(cmd uint32, outSize uint32) ([]byte, error) {
+		in := fusekernel.IoctlIn{Cmd: cmd, OutSize: outSize}
+		b := (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:]
+		return k.Call(fusekernel.OpIoctl, uint64(fuseops.RootInodeID), b)
+	}
+
+	// Claiming more than Dst holds fails the op instead of the server.
+	if _, err := ioctl(1, 8); err != syscall.EIO {
+		t.Errorf("Ioctl: got %v, want EIO", err)
+	}
+
+	const want = "*fuseops.IoctlOp error: BytesRead 9 out of range for a 8-byte Dst"
+	if !strings.Contains(logged.String(), want) {
+		t.Errorf("No %q in the error log:\n%s", want, logged.String())
+	}
+
+	// More output than a reply can carry is cut down to what it can.
+	out, err := ioctl(2, 1<<30)
+	if err != nil {
+		t.Fatalf("Ioctl: %v", err)
+	}
+
+	dstLen := int(atomic.LoadInt64(&fs.dstLen))
+	if dstLen >= 1<<30 {
+		t.Errorf("Got a %d-byte Dst", dstLen)
+	}
+
+	if want := int(unsafe.Sizeof(fusekernel.IoctlOut{})) + dstLen; len(out) != want {
+		t.Errorf("Got %d bytes of output, want %d", len(out), want)
+	}
+}
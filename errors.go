@@ -14,17 +14,47 @@
 
 package fuse
 
-import "syscall"
+import (
+	"errors"
+	"syscall"
+)
 
+// Errors corresponding to kernel error numbers, for file systems to return.
+// Connection.Reply passes on to the kernel any syscall.Errno an op fails with,
+// whether it is one of these or not, and whether it is returned as it is or
+// wrapped, e.g. in an *os.PathError or by fmt.Errorf's %w verb. Any other
+// error is reported to the kernel as EIO, and logged to the ErrorLogger.
 const (
-	// Errors corresponding to kernel error numbers. These may be treated
-	// specially by Connection.Reply.
-	EEXIST    = syscall.EEXIST
-	EINVAL    = syscall.EINVAL
-	EIO       = syscall.EIO
-	ENOATTR   = syscall.ENODATA
-	ENOENT    = syscall.ENOENT
-	ENOSYS    = syscall.ENOSYS
-	ENOTDIR   = syscall.ENOTDIR
-	ENOTEMPTY = syscall.ENOTEMPTY
+	EACCES       = syscall.EACCES
+	EEXIST       = syscall.EEXIST
+	EHOSTDOWN    = syscall.EHOSTDOWN
+	EINVAL       = syscall.EINVAL
+	EIO          = syscall.EIO
+	EISDIR       = syscall.EISDIR
+	ENAMETOOLONG = syscall.ENAMETOOLONG
+	ENOATTR      = syscall.ENODATA
+	ENOENT       = syscall.ENOENT
+	ENOSPC       = syscall.ENOSPC
+	ENOSYS       = syscall.ENOSYS
+	ENOTDIR      = syscall.ENOTDIR
+	ENOTEMPTY    = syscall.ENOTEMPTY
+	ENOTSUP      = syscall.ENOTSUP
+	EPERM        = syscall.EPERM
+	EROFS        = syscall.EROFS
 )
+
+// Return the errno carried by err, looking through wrappers as errors.As
+// does, or false if there is none.
+func errnoOf(err error) (errno syscall.Errno, ok bool) {
+	ok = errors.As(err, &errno)
+	return errno, ok
+}
+
+// Return the errno with which the kernel is told an op failed with err.
+func replyErrno(err error) syscall.Errno {
+	if errno, ok := errnoOf(err); ok {
+		return errno
+	}
+
+	return syscall.EIO
+}
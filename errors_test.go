@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system whose lookups fail with the error registered for the name.
+type errorFS struct {
+	fuseutil.NotImplementedFileSystem
+	errs map[string]error
+}
+
+func (fs *errorFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0755 | os.ModeDir}
+	return nil
+}
+
+func (fs *errorFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.errs[op.Name]
+}
+
+func TestErrnos(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want syscall.Errno
+	}{
+		{"enoent", fuse.ENOENT, syscall.ENOENT},
+		{"eacces", fuse.EACCES, syscall.EACCES},
+		{"enotdir", fuse.ENOTDIR, syscall.ENOTDIR},
+		{"other_errno", syscall.ELOOP, syscall.ELOOP},
+		{"wrapped", fmt.Errorf("lookup: %w", fuse.ENOENT), syscall.ENOENT},
+		{"path_error", &os.PathError{Op: "lstat", Path: "/x", Err: syscall.EPERM}, syscall.EPERM},
+		{"wrapped_path_error", fmt.Errorf("backend: %w", &os.PathError{Op: "open", Path: "/x", Err: syscall.EROFS}), syscall.EROFS},
+		{"opaque", errors.New("taco"), syscall.EIO},
+		{"opaque_wrapped", fmt.Errorf("lookup: %w", errors.New("burrito")), syscall.EIO},
+	}
+
+	fs := &errorFS{errs: make(map[string]error)}
+	for _, tc := range testCases {
+		fs.errs[tc.name] = tc.err
+	}
+
+	dir, err := ioutil.TempDir("", "errors_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var logged syncBuffer
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:      "errorfs",
+		ErrorLogger: log.New(&logged, "", 0),
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Unmount(); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	for _, tc := range testCases {
+		var st syscall.Stat_t
+		err := syscall.Lstat(path.Join(dir, tc.name), &st)
+		if err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+
+	// The errors turned into EIO are logged, so that they can be debugged.
+	for _, want := range []string{"taco", "burrito"} {
+		if !strings.Contains(logged.String(), want) {
+			t.Errorf("No %q in the error log:\n%s", want, logged.String())
+		}
+	}
+
+	// Failed lookups of names that don't exist are routine, however they are
+	// wrapped.
+	if strings.Contains(logged.String(), "lookup: no such file") {
+		t.Errorf("Wrapped ENOENT logged:\n%s", logged.String())
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"io"
+)
+
+// Return the connection serving the supplied file system.
+func ConnectionOf(mfs *MountedFileSystem) *Connection {
+	return mfs.conn
+}
+
+// Return whether the connection serving mfs has seen the kernel hang up.
+func HungUp(mfs *MountedFileSystem) bool {
+	return mfs.conn.isHungUp()
+}
+
+// Arrange for the connection serving mfs to call hook before writing each
+// message to the kernel. A non-nil result is returned in place of writing.
+func SetWriteHook(
+	mfs *MountedFileSystem,
+	hook func(msg []byte) error) {
+	c := mfs.conn
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeHook = hook
+}
+
+// The memory accounted to each in-flight op.
+const MemoryPerOp = memoryPerOp
+
+// The number of errors buffered by MountedFileSystem.Errors.
+const OpErrorBufferSize = opErrorBufferSize
+
+// The environment variable set for the background copy of a mount helper.
+const MountHelperReadyEnv = mountHelperReadyEnv
+
+// Parse a mount helper's command line, returning the device and mount point,
+// the options the file system would be given, and the configuration it would
+// be mounted with if it took none of them.
+func ParseMountHelperArgs(argv []string) (
+	device string,
+	dir string,
+	opts map[string]string,
+	cfg *MountConfig,
+	err error) {
+	a, err := parseMountHelperArgs(argv)
+	if err != nil {
+		return "", "", nil, nil, err
+	}
+
+	return a.device, a.dir, a.options, a.mountConfig(a.options), nil
+}
+
+// Run MountHelperMain's logic with the given command line, returning the
+// status it would exit with.
+func RunMountHelper(
+	argv []string,
+	stderr io.Writer,
+	newServer func(device string, opts map[string]string) (Server, error)) int {
+	return mountHelperMain(argv, stderr, newServer)
+}
+
+// Record the attributes carried by the reply to op as a connection without
+// an attribute history does.
+func RecordAttributesWithoutHistory(op interface{}) {
+	var h *attributeHistory
+	h.recordReply(op)
+}
+
+// Return the options string with which cfg would be passed to the mount
+// helper.
+func OptionsString(cfg *MountConfig) string {
+	return cfg.toOptionsString()
+}
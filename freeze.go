@@ -0,0 +1,271 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The default for MountConfig.MaxFreezeDuration.
+const defaultMaxFreezeDuration = 5 * time.Minute
+
+// Return whether op modifies the file system, and must therefore wait while
+// it is frozen.
+func isMutating(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.SetInodeAttributesOp,
+		*fuseops.MkDirOp,
+		*fuseops.MkNodeOp,
+		*fuseops.CreateFileOp,
+		*fuseops.CreateSymlinkOp,
+		*fuseops.CreateLinkOp,
+		*fuseops.RenameOp,
+		*fuseops.RmDirOp,
+		*fuseops.UnlinkOp,
+		*fuseops.WriteFileOp,
+		*fuseops.SetXattrOp,
+		*fuseops.RemoveXattrOp,
+		*fuseops.FallocateOp:
+		return true
+	}
+
+	return false
+}
+
+// Decide whether the mutating op f, just read from the kernel, may go ahead
+// or must wait in WaitForThaw.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) admitOp(f *inFlightOp) {
+	if f == nil || !isMutating(f.op) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.thawed != nil {
+		f.frozen = true
+		return
+	}
+
+	f.mutating = true
+	c.mutatingInFlight++
+}
+
+// Note that f has been replied to, waking Freeze if it was the last mutating
+// op it was waiting for.
+//
+// LOCKS_REQUIRED(c.mu)
+func (c *Connection) finishMutatingOp(f *inFlightOp) {
+	if !f.mutating {
+		return
+	}
+
+	f.mutating = false
+	c.mutatingInFlight--
+
+	if c.mutatingInFlight == 0 && c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+}
+
+// WaitForThaw blocks the op associated with ctx, a context returned by
+// ReadOp, while the file system is frozen (see MountedFileSystem.Freeze), if
+// it is one that modifies the file system. Servers must call it before
+// carrying out each op, which fuseutil.NewFileSystemServer does; it returns
+// immediately for ops that needn't wait.
+//
+// If it returns an error, the server should reply to the op with it rather
+// than carrying it out: EBUSY if the op waited longer than
+// MountConfig.FrozenOpTimeout, or EINTR if the op's context was cancelled
+// first.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) WaitForThaw(ctx context.Context) error {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok || state.inFlight == nil {
+		return nil
+	}
+
+	f := state.inFlight
+
+	var timeout <-chan time.Time
+	if c.cfg.FrozenOpTimeout > 0 {
+		timer := time.NewTimer(c.cfg.FrozenOpTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		c.mu.Lock()
+		if !f.frozen {
+			c.mu.Unlock()
+			return nil
+		}
+
+		// The file system may have been frozen again since we were woken.
+		thawed := c.thawed
+		if thawed == nil {
+			f.frozen = false
+			f.mutating = true
+			c.mutatingInFlight++
+			c.mu.Unlock()
+			return nil
+		}
+
+		c.mu.Unlock()
+
+		select {
+		case <-thawed:
+		case <-timeout:
+			c.mu.Lock()
+			f.frozen = false
+			c.mu.Unlock()
+			return syscall.EBUSY
+
+		case <-ctx.Done():
+			c.mu.Lock()
+			f.frozen = false
+			c.mu.Unlock()
+			return syscall.EINTR
+		}
+	}
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) freeze(ctx context.Context) error {
+	c.mu.Lock()
+	if c.thawed != nil {
+		c.mu.Unlock()
+		return errors.New("Already frozen")
+	}
+
+	c.thawed = make(chan struct{})
+	c.freezes++
+	generation := c.freezes
+
+	maxDuration := c.cfg.MaxFreezeDuration
+	if maxDuration <= 0 {
+		maxDuration = defaultMaxFreezeDuration
+	}
+
+	c.freezeTimer = time.AfterFunc(maxDuration, func() {
+		if c.thaw(generation) {
+			c.reportError(OpError{
+				Op: "Freeze",
+				Err: fmt.Errorf(
+					"Not thawed within %v; thawed automatically",
+					maxDuration),
+			})
+		}
+	})
+
+	// Wait for mutating ops already passed to the file system to finish.
+	var drained chan struct{}
+	if c.mutatingInFlight > 0 {
+		drained = make(chan struct{})
+		c.drained = drained
+	}
+
+	c.mu.Unlock()
+
+	if drained == nil {
+		return nil
+	}
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		c.thaw(generation)
+		return ctx.Err()
+	}
+
+	// The channel is also closed if we were thawed in the meantime.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.thawed == nil || c.freezes != generation {
+		return errors.New("Thawed before in-flight ops finished")
+	}
+
+	return nil
+}
+
+// Thaw the file system if it is still in the freeze with the given
+// generation, or in any freeze if generation is zero. Return false if there
+// was nothing to thaw.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) thaw(generation uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.thawed == nil || (generation != 0 && generation != c.freezes) {
+		return false
+	}
+
+	c.freezeTimer.Stop()
+	c.freezeTimer = nil
+
+	close(c.thawed)
+	c.thawed = nil
+
+	if c.drained != nil {
+		close(c.drained)
+		c.drained = nil
+	}
+
+	return true
+}
+
+// Freeze stops the file system from being modified, for example so that a
+// backup can take a consistent snapshot of it. Mutating ops (writes, creates,
+// renames, removals, and changes to attributes and extended attributes)
+// arriving from now on wait until Thaw is called, up to
+// MountConfig.FrozenOpTimeout if that is set, while other ops carry on as
+// usual. Freeze returns once mutating ops already in progress have finished.
+// If ctx is done first, it thaws the file system again and returns ctx.Err().
+//
+// In case Thaw is never called, the file system is thawed automatically after
+// MountConfig.MaxFreezeDuration, and an OpError with Op "Freeze" is delivered
+// on Errors.
+//
+// The kernel holds locks while waiting for some mutating ops, which then
+// block other ops until the file system is thawed, even those that don't
+// modify it. In particular, a waiting creation, removal or rename holds the
+// lock of each directory involved, so lookups and readdir(2) in those
+// directories wait too, until the mutating op fails after FrozenOpTimeout if
+// not before.
+//
+// It is an error to freeze a file system that is already frozen. Freeze must
+// not be called from within an op handler, which could be among those it
+// waits for.
+func (mfs *MountedFileSystem) Freeze(ctx context.Context) error {
+	return mfs.conn.freeze(ctx)
+}
+
+// Thaw undoes Freeze, releasing the mutating ops that were waiting. It is a
+// no-op if the file system isn't frozen.
+func (mfs *MountedFileSystem) Thaw() {
+	mfs.conn.thaw(0)
+}
@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system in which every unlink and getattr succeeds.
+type unlinkFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *unlinkFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return nil
+}
+
+func (fs *unlinkFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return nil
+}
+
+func TestFreeze_Timeouts(t *testing.T) {
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&unlinkFS{}),
+		&fuse.MountConfig{
+			FrozenOpTimeout:   10 * time.Millisecond,
+			MaxFreezeDuration: 500 * time.Millisecond,
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+	mfs := k.MountedFileSystem()
+
+	unlink := func() error {
+		_, err := k.Call(fusekernel.OpUnlink, fuseops.RootInodeID, []byte("foo\x00"))
+		return err
+	}
+
+	if err := mfs.Freeze(context.Background()); err != nil {
+		t.Fatalf("Freeze: %v", err)
+	}
+
+	if err := mfs.Freeze(context.Background()); err == nil {
+		t.Error("Freezing twice succeeded")
+	}
+
+	// Reads carry on, but mutations wait and eventually give up.
+	if _, err := k.GetAttr(fuseops.RootInodeID); err != nil {
+		t.Errorf("GetAttr while frozen: %v", err)
+	}
+
+	if err := unlink(); err != syscall.EBUSY {
+		t.Errorf("Unlink while frozen: got %v, want EBUSY", err)
+	}
+
+	// The freeze ends by itself, with a complaint.
+	select {
+	case e := <-mfs.Errors():
+		if e.Op != "Freeze" || !strings.Contains(e.Err.Error(), "thawed automatically") {
+			t.Errorf("Unexpected error: %v", e)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("Not thawed automatically")
+	}
+
+	if err := unlink(); err != nil {
+		t.Errorf("Unlink after thawing: %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fusecapture reads and writes captures of the raw messages exchanged
+// with the kernel over a FUSE connection, as recorded when
+// fuse.MountConfig.Capture is set, for offline analysis with cmd/fusedump.
+//
+// A capture is a file header followed by a record for each message. The
+// integers in the file and record headers are little-endian. The messages are
+// as exchanged with the kernel, so in the byte order of the machine that
+// captured them.
+//
+// The file header has the following layout:
+//
+//	magic       [8]byte  "FUSECAP\x00"
+//	version     uint32   Version
+//	max payload uint32   the truncation limit the capture was made with, or 0
+//
+// Each record has the following layout:
+//
+//	length      uint32   the number of bytes that follow in the record
+//	time        int64    nanoseconds since the Unix epoch
+//	direction   uint8    a Direction
+//	            [3]byte  zero
+//	message len uint32   the length of the message before any truncation
+//	message     []byte   the message, possibly truncated
+//
+// Later versions may add fields to either header, which readers for older
+// versions can't interpret; so the version must be bumped for any change.
+package fusecapture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Version is the version of the format written by Writer, and the only one
+// Reader understands.
+const Version = 1
+
+var magic = [8]byte{'F', 'U', 'S', 'E', 'C', 'A', 'P', 0}
+
+const fileHeaderSize = 16
+
+// The size of a record's header, including its length.
+const recordHeaderSize = 4 + 8 + 4 + 4
+
+// The size of the headers with which messages in each direction start, which
+// are kept whatever the truncation limit.
+var (
+	inHeaderSize  = int(unsafe.Sizeof(fusekernel.InHeader{}))
+	outHeaderSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+)
+
+// Direction says which way a captured message went.
+type Direction uint8
+
+const (
+	// A request from the kernel.
+	FromKernel Direction = 1
+
+	// A reply or notification written to the kernel.
+	ToKernel Direction = 2
+)
+
+func (d Direction) String() string {
+	switch d {
+	case FromKernel:
+		return "FromKernel"
+	case ToKernel:
+		return "ToKernel"
+	}
+
+	return fmt.Sprintf("Direction(%d)", uint8(d))
+}
+
+// Record is a single captured message.
+type Record struct {
+	Time      time.Time
+	Direction Direction
+
+	// The length of the message, and as much of it as was kept.
+	Len  int
+	Data []byte
+}
+
+// Truncated returns whether part of the message wasn't kept.
+func (r *Record) Truncated() bool {
+	return len(r.Data) < r.Len
+}
+
+////////////////////////////////////////////////////////////////////////
+// Writing
+////////////////////////////////////////////////////////////////////////
+
+// Writer writes a capture. Its methods may be called concurrently.
+type Writer struct {
+	maxPayload int
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	w   io.Writer
+	buf bytes.Buffer
+
+	// The first error encountered, after which nothing more is written.
+	//
+	// GUARDED_BY(mu)
+	err error
+}
+
+// NewWriter writes a file header to w, returning a Writer for the records
+// that follow it. If maxPayload is positive, no more than that many bytes of
+// each message after its header (fusekernel.InHeader or OutHeader) are kept.
+func NewWriter(
+	w io.Writer,
+	maxPayload int) (*Writer, error) {
+	if maxPayload < 0 {
+		maxPayload = 0
+	}
+
+	var h [fileHeaderSize]byte
+	copy(h[:], magic[:])
+	binary.LittleEndian.PutUint32(h[8:], Version)
+	binary.LittleEndian.PutUint32(h[12:], uint32(maxPayload))
+
+	if _, err := w.Write(h[:]); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		maxPayload: maxPayload,
+		w:          w,
+	}, nil
+}
+
+// WriteRecord records msg, which went in the given direction at time t. Once
+// a write fails, WriteRecord does nothing more and returns that error.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *Writer) WriteRecord(
+	t time.Time,
+	dir Direction,
+	msg []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	data := msg
+	if w.maxPayload > 0 {
+		headerSize := inHeaderSize
+		if dir == ToKernel {
+			headerSize = outHeaderSize
+		}
+
+		if max := headerSize + w.maxPayload; len(data) > max {
+			data = data[:max]
+		}
+	}
+
+	var h [recordHeaderSize]byte
+	binary.LittleEndian.PutUint32(h[0:], uint32(recordHeaderSize-4+len(data)))
+	binary.LittleEndian.PutUint64(h[4:], uint64(t.UnixNano()))
+	h[12] = byte(dir)
+	binary.LittleEndian.PutUint32(h[16:], uint32(len(msg)))
+
+	// Write the record in one go, so that an io.Writer that isn't buffered
+	// doesn't see it in pieces.
+	w.buf.Reset()
+	w.buf.Write(h[:])
+	w.buf.Write(data)
+
+	if _, err := w.w.Write(w.buf.Bytes()); err != nil {
+		w.err = err
+		return err
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Reading
+////////////////////////////////////////////////////////////////////////
+
+// ErrNotCapture is returned by NewReader if its input doesn't start with a
+// capture file header.
+var ErrNotCapture = errors.New("Not a FUSE capture")
+
+// Reader reads a capture written by Writer.
+type Reader struct {
+	r          io.Reader
+	maxPayload int
+}
+
+// NewReader reads the file header from r, returning a Reader for the records
+// that follow it.
+func NewReader(r io.Reader) (*Reader, error) {
+	var h [fileHeaderSize]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotCapture
+		}
+
+		return nil, err
+	}
+
+	if !bytes.Equal(h[:8], magic[:]) {
+		return nil, ErrNotCapture
+	}
+
+	if v := binary.LittleEndian.Uint32(h[8:]); v != Version {
+		return nil, fmt.Errorf("Unsupported capture version %d", v)
+	}
+
+	return &Reader{
+		r:          r,
+		maxPayload: int(binary.LittleEndian.Uint32(h[12:])),
+	}, nil
+}
+
+// MaxPayload returns the truncation limit the capture was made with, as for
+// NewWriter, or zero if messages were kept whole.
+func (r *Reader) MaxPayload() int {
+	return r.maxPayload
+}
+
+// Next returns the next record, or io.EOF if there are no more. A capture cut
+// off part way through a record, as one being written when the process died
+// may be, gives io.ErrUnexpectedEOF.
+func (r *Reader) Next() (*Record, error) {
+	var h [recordHeaderSize]byte
+	if _, err := io.ReadFull(r.r, h[:]); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.LittleEndian.Uint32(h[0:]))
+	if length < recordHeaderSize-4 {
+		return nil, fmt.Errorf("Corrupt record of length %d", length)
+	}
+
+	rec := &Record{
+		Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(h[4:]))),
+		Direction: Direction(h[12]),
+		Len:       int(binary.LittleEndian.Uint32(h[16:])),
+		Data:      make([]byte, length-(recordHeaderSize-4)),
+	}
+
+	if _, err := io.ReadFull(r.r, rec.Data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return nil, err
+	}
+
+	return rec, nil
+}
@@ -25,8 +25,15 @@ import (
 
 // OpMetadata contains metadata about the file system operation.
 type OpMetadata struct {
-	// PID of the process that is invoking the operation.
+	// PID of the process that is invoking the operation. This is best effort:
+	// it is zero for requests the kernel makes without one, such as writeback
+	// of dirty pages, which may also carry root's uid and gid.
 	Pid uint32
+
+	// The effective user and group IDs of that process, as seen by the kernel
+	// (i.e. in the user namespace the file system was mounted in).
+	Uid uint32
+	Gid uint32
 }
 
 // Return statistics about the file system's capacity and available resources.
@@ -98,6 +105,15 @@ type StatFSOp struct {
 	// The total number of inodes in the file system, and how many remain free.
 	Inodes     uint64
 	InodesFree uint64
+
+	// The longest name, in bytes, that a directory entry may have. This is
+	// surfaced as statfs::f_namelen, and hence as pathconf(3)'s NAME_MAX. If
+	// zero, MountConfig.MaxNameLength is reported if set, and otherwise 255.
+	//
+	// This is advisory: the kernel passes on names of up to 1024 bytes
+	// regardless. Set MountConfig.MaxNameLength to have longer names rejected
+	// before they reach the file system.
+	MaxNameLength uint32
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -137,10 +153,11 @@ type GetInodeAttributesOp struct {
 	Inode InodeID
 
 	// Set by the file system: attributes for the inode, and the time at which
-	// they should expire. See notes on ChildInodeEntry.AttributesExpiration for
-	// more.
+	// (or how long until) they should expire. See notes on
+	// ChildInodeEntry.AttributesExpiration and AttributesValidFor for more.
 	Attributes           InodeAttributes
 	AttributesExpiration time.Time
+	AttributesValidFor   time.Duration
 }
 
 // Change attributes for an inode.
@@ -148,23 +165,47 @@ type GetInodeAttributesOp struct {
 // The kernel sends this for obvious cases like chmod(2), and for less obvious
 // cases like ftrunctate(2).
 type SetInodeAttributesOp struct {
+	// Metadata
+	Metadata OpMetadata
+
 	// The inode of interest.
 	Inode InodeID
 
 	// If set, this is ftruncate(2), otherwise it's truncate(2)
 	Handle *HandleID
 
+	// If Handle is non-nil, the value attached to it when it was opened, if
+	// any. See the notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
 	// The attributes to modify, or nil for attributes that don't need a change.
+	// Uid and Gid are set by chown(2), either or both.
 	Size  *uint64
 	Mode  *os.FileMode
+	Uid   *uint32
+	Gid   *uint32
 	Atime *time.Time
 	Mtime *time.Time
 
+	// Set when the caller asked for Atime or Mtime to be the current time (e.g.
+	// touch(1), or utimensat(2) with UTIME_NOW) rather than a particular one.
+	// The field still holds the kernel's idea of the current time, but a file
+	// system may prefer its own clock.
+	//
+	// The kernel never sends this op for access times merely because a file
+	// was read (see fuse.AtimePolicy). A file system that doesn't keep access
+	// times can therefore recognize the only atime updates it will see by Atime
+	// being the only non-nil attribute, and simply reply with the current
+	// attributes.
+	AtimeNow bool
+	MtimeNow bool
+
 	// Set by the file system: the new attributes for the inode, and the time at
-	// which they should expire. See notes on
-	// ChildInodeEntry.AttributesExpiration for more.
+	// which (or how long until) they should expire. See notes on
+	// ChildInodeEntry.AttributesExpiration and AttributesValidFor for more.
 	Attributes           InodeAttributes
 	AttributesExpiration time.Time
+	AttributesValidFor   time.Duration
 }
 
 // Decrement the reference count for an inode ID previously issued by the file
@@ -206,6 +247,9 @@ type SetInodeAttributesOp struct {
 // remaining inodes when the file system unmounts, including the root inode.
 // Rather they should take fuse.Connection.ReadOp returning io.EOF as
 // implicitly decrementing all lookup counts to zero.
+//
+// When it has several forgets queued up, the kernel sends them together as a
+// BatchForgetOp instead.
 type ForgetInodeOp struct {
 	// The inode whose reference count should be decremented.
 	Inode InodeID
@@ -214,6 +258,20 @@ type ForgetInodeOp struct {
 	N uint64
 }
 
+// Decrement the reference counts of several inodes at once. Linux sends this
+// in place of ForgetInodeOp when forgets pile up faster than the file system
+// reads them, e.g. as the kernel drops its caches. Each entry is what would
+// otherwise have been a ForgetInodeOp of its own, and they are to be applied
+// in order; an inode may appear more than once.
+//
+// fuseutil.NewFileSystemServer doesn't pass this op on. It calls ForgetInode
+// for each entry in turn instead, before reading the next op from the kernel,
+// so that file systems see the same calls in the same order whether or not
+// the kernel batched them.
+type BatchForgetOp struct {
+	Forgets []ForgetInodeOp
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Inode creation
 ////////////////////////////////////////////////////////////////////////
@@ -264,6 +322,10 @@ type MkNodeOp struct {
 	Name string
 	Mode os.FileMode
 
+	// For device nodes, the device number to give the child, to be reported
+	// in InodeAttributes.Rdev.
+	Rdev uint32
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -292,6 +354,11 @@ type CreateFileOp struct {
 	Name string
 	Mode os.FileMode
 
+	// The flags passed to open(2), such as O_RDWR and O_APPEND. Unlike for
+	// OpenFileOp, they include O_CREAT, and O_EXCL if given, though the file
+	// system should return EEXIST for an existing name regardless.
+	Flags uint32
+
 	// Set by the file system: information about the inode that was created.
 	//
 	// The lookup count for the inode is implicitly incremented. See notes on
@@ -307,6 +374,10 @@ type CreateFileOp struct {
 	// file handle. The file system must ensure this ID remains valid until a
 	// later call to ReleaseFileHandle.
 	Handle HandleID
+
+	// Set by the file system: an arbitrary value to associate with the new
+	// handle. See the notes on OpenFileOp.HandleData.
+	HandleData interface{}
 }
 
 // Create a symlink inode. If the name already exists, the file system should
@@ -397,6 +468,12 @@ type RenameOp struct {
 	// overwritten within it.
 	NewParent InodeID
 	NewName   string
+
+	// The flags passed to renameat2(2), or zero for rename(2). Only those in
+	// MountConfig.RenameFlags reach the file system (the kernel already
+	// rejects RenameNoReplace and RenameExchange together), so one that
+	// implements none needn't look at this.
+	Flags RenameFlags
 }
 
 // Unlink a directory from its parent. Because directories cannot have a link
@@ -449,15 +526,46 @@ type OpenDirOp struct {
 	// directory handle. The file system must ensure this ID remains valid until
 	// a later call to ReleaseDirHandle.
 	Handle HandleID
+
+	// Set by the file system: an arbitrary value to associate with the new
+	// handle. See the notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// Set by the file system: whether the kernel may cache the entries returned
+	// by ReadDir for this directory and serve later reads of it, through any
+	// handle, without calling the file system. This requires Linux 4.20 or
+	// later, and is ignored elsewhere.
+	//
+	// The kernel drops the cache when the directory's mtime changes, and when
+	// the directory is next opened unless KeepCache is set for that open. File
+	// systems whose directories change out-of-band can drop it explicitly with
+	// MountedFileSystem.InvalidateDirContents.
+	CacheDir bool
+
+	// Set by the file system: when CacheDir is set, don't drop the entries
+	// already cached for this directory as a result of this open. Cf.
+	// OpenFileOp.KeepPageCache.
+	KeepCache bool
 }
 
 // Read entries from a directory previously opened with OpenDir.
+//
+// The kernel may read from any offset previously returned for the handle, and
+// in particular from zero again after rewinddir(3), so a file system must not
+// assume that each read continues where the last one left off. See the notes
+// on Offset below, and fuseutil.DirCursor for a helper that takes care of
+// this. fuseutil.NewFileSystemServer makes ReadDir calls for a given handle
+// one at a time.
 type ReadDirOp struct {
 	// The directory inode that we are reading, and the handle previously
 	// returned by OpenDir when opening that inode.
 	Inode  InodeID
 	Handle HandleID
 
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
 	// The offset within the directory at which to read.
 	//
 	// Warning: this field is not necessarily a count of bytes. Its legal values
@@ -518,16 +626,39 @@ type ReadDirOp struct {
 	// offset, and return array offsets into that cached listing.
 	Offset DirOffset
 
+	// Whether the kernel sent READDIRPLUS, which it does in place of READDIR
+	// when the file system is mounted with MountConfig.EnableReadDirPlus. If so,
+	// each entry written to Dst must take the format of
+	// fuseutil.WriteDirentPlus, which may carry the child's attributes and
+	// entry expiration as for LookUpInodeOp.
+	//
+	// An entry need not carry them: for an entry written without attributes,
+	// the kernel lists the child as usual but caches nothing for it, and sends
+	// LookUpInodeOp if it later needs the child, as it would have after
+	// READDIR. This lets a file system answer from the attributes it has at
+	// hand, e.g. cached, rather than fetching them for every child of a large
+	// directory, and lets it list a child whose attributes it failed to fetch,
+	// leaving the lookup to report the error for just that child.
+	//
+	// Each entry written with attributes counts as a lookup of its child, to
+	// be balanced by ForgetInodeOp. "." and ".." are the exception; the kernel
+	// ignores the attributes of those.
+	Plus bool
+
 	// The destination buffer, whose length gives the size of the read.
 	//
 	// The output data should consist of a sequence of FUSE directory entries in
 	// the format generated by fuse_add_direntry (http://goo.gl/qCcHCV), which is
 	// consumed by parse_dirfile (http://goo.gl/2WUmD2). Use fuseutil.WriteDirent
-	// to generate this data.
+	// to generate this data, or fuseutil.WriteDirentPlus if Plus is set.
 	//
 	// Each entry returned exposes a directory offset to the user that may later
 	// show up in ReadDirRequest.Offset. See notes on that field for more
 	// information.
+	//
+	// The kernel passes the entries on as they are, without adding "." and
+	// "..". Many tools expect to see those, so file systems should return them
+	// first, e.g. using fuseutil.EmitDotEntries.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst.
@@ -556,6 +687,32 @@ type ReleaseDirHandleOp struct {
 	// be used in further calls to the file system (unless it is reissued by the
 	// file system).
 	Handle HandleID
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+}
+
+// Synchronize a directory previously opened with OpenDir to storage, as for
+// fsync(2) or fdatasync(2) on a descriptor for the directory. Applications
+// such as databases do this after creating, renaming or removing an entry, to
+// make the change to the directory durable.
+//
+// As for SyncFileOp, the syscall doesn't return until the op has, and the
+// op's error becomes its errno. Since many applications treat a failure here
+// as fatal, fuseutil.NotImplementedFileSystem succeeds rather than returning
+// ENOSYS.
+type SyncDirOp struct {
+	// The directory and handle being sync'd.
+	Inode  InodeID
+	Handle HandleID
+
+	// Set for fdatasync(2). See the notes on SyncFileOp.DataOnly.
+	DataOnly bool
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -575,6 +732,10 @@ type OpenFileOp struct {
 	// The ID of the inode to be opened.
 	Inode InodeID
 
+	// The flags passed to open(2), such as O_RDWR and O_APPEND. The kernel deals
+	// with O_CREAT, O_EXCL and O_NOCTTY itself, and doesn't pass them on.
+	Flags uint32
+
 	// An opaque ID that will be echoed in follow-up calls for this file using
 	// the same struct file in the kernel. In practice this usually means
 	// follow-up calls using the file descriptor returned by open(2).
@@ -584,6 +745,14 @@ type OpenFileOp struct {
 	// later call to ReleaseFileHandle.
 	Handle HandleID
 
+	// Set by the file system: an arbitrary value to associate with the new
+	// handle. When the file system is served by fuseutil.NewFileSystemServer, a
+	// non-nil value causes the server to choose the handle ID itself,
+	// overwriting Handle, and to supply the value in the HandleData field of
+	// each later op for the handle, up to and including its release. This
+	// saves the file system from maintaining its own table of handles.
+	HandleData interface{}
+
 	// By default, fuse invalidates the kernel's page cache for an inode when a
 	// new file handle is opened for that inode (cf. https://goo.gl/2rZ9uk). The
 	// intent appears to be to allow users to "see" content that has changed
@@ -621,7 +790,12 @@ type ReadFileOp struct {
 	Inode  InodeID
 	Handle HandleID
 
-	// The offset within the file at which to read.
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The offset within the file at which to read. It is never negative, and
+	// Offset+len(Dst) never overflows.
 	Offset int64
 
 	// The destination buffer, whose length gives the size of the read.
@@ -636,6 +810,12 @@ type ReadFileOp struct {
 	// where EOF is by checking the inode size (http://goo.gl/0BkqKD), returned
 	// by a previous call to LookUpInode, GetInodeAttributes, etc.
 	//
+	// A short read is passed to the kernel as is, without padding. For a
+	// regular file read through the page cache, the kernel takes it to mean
+	// EOF: it zero-fills the rest of the page and, unless the attributes have
+	// changed in the meantime, shrinks its idea of the file's size to match. So
+	// return fewer bytes than asked for only at the end of the file.
+	//
 	// If direct IO is enabled, semantics should match those of read(2).
 	BytesRead int
 }
@@ -668,6 +848,10 @@ type WriteFileOp struct {
 	Inode  InodeID
 	Handle HandleID
 
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
 	// The offset at which to write the data below.
 	//
 	// The man page for pwrite(2) implies that aside from changing the file
@@ -688,6 +872,7 @@ type WriteFileOp struct {
 	// *   If the offset is greater than the current size, extend the file
 	//     with null bytes until it is not, then do the above.
 	//
+	// The offset is never negative, and Offset+len(Data) never overflows.
 	Offset int64
 
 	// The data to write.
@@ -696,7 +881,23 @@ type WriteFileOp struct {
 	// be written, except on error (http://goo.gl/KUpwwn). This appears to be
 	// because it uses file mmapping machinery (http://goo.gl/SGxnaN) to write a
 	// page at a time.
+	//
+	// Data refers to the buffer into which the request was read, which is
+	// reused for later requests once the op has been replied to. The file
+	// system must copy whatever it needs to keep, and must not modify it.
 	Data []byte
+
+	// Set by the file system if it wrote only the first BytesWritten bytes of
+	// Data before failing, in which case it should return the error as usual.
+	// The kernel is then told of a short write of that many bytes rather than
+	// of the error, as write(2) reports a failure part way through. Ignored if
+	// the file system returns nil, or if it is zero.
+	//
+	// Bytes beyond those reported may or may not have been written. Since a
+	// short write of data written back from the page cache has no caller to
+	// tell, fuseutil.NewFileSystemServer still reports the error to the next
+	// sync or flush of the handle, as for any failed write.
+	BytesWritten int
 }
 
 // Synchronize the current contents of an open file to storage.
@@ -715,10 +916,28 @@ type WriteFileOp struct {
 //
 // See also: FlushFileOp, which may perform a similar function when closing a
 // file (but which is not used in "real" file systems).
+//
+// The syscall doesn't return until the op has, and the op's error becomes its
+// errno, so this is where a file system that buffers writes should make them
+// durable and report if it can't.
+//
+// fuseutil.NewFileSystemServer doesn't call the file system for this op until
+// every write on the same handle that the kernel sent before it has finished,
+// and fails it if one of them failed. See the notes there.
 type SyncFileOp struct {
 	// The file and handle being sync'd.
 	Inode  InodeID
 	Handle HandleID
+
+	// Set for fdatasync(2), which needs only the file's data and the metadata
+	// needed to read it back, such as its size, to reach storage, and not e.g.
+	// its mtime. File systems that can't tell the difference may treat it as
+	// an fsync(2).
+	DataOnly bool
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
 }
 
 // Flush the current state of an open file to storage upon closing a file
@@ -732,7 +951,12 @@ type SyncFileOp struct {
 //
 // But note that this is also sent in other contexts where a file descriptor is
 // closed, such as dup2(2) (cf. http://goo.gl/NQDvFS). In the case of close(2),
-// a flush error is returned to the user. For dup2(2), it is not.
+// a flush error is returned to the user as close's errno, which lets a file
+// system that buffers writes report e.g. EDQUOT once it finds out. For
+// dup2(2), it is not. Each copy of a descriptor sends its own flush when it is
+// closed, so a handle is flushed again by a child process that inherited it
+// across fork(2), including when exec(2) closes it for being close-on-exec,
+// and by the exit of a process that held it.
 //
 // One potentially significant case where this may not be sent is mmap'd files,
 // where the behavior is complicated:
@@ -769,6 +993,10 @@ type SyncFileOp struct {
 // data. A file system that writes to remote storage however probably wants
 // to at least schedule a real flush, and maybe do it immediately in order to
 // return any errors that occur.
+//
+// As for SyncFileOp, fuseutil.NewFileSystemServer waits for earlier writes on
+// the same handle before calling the file system, and fails the flush if one
+// of them failed.
 type FlushFileOp struct {
 	// Metadata
 	Metadata OpMetadata
@@ -776,6 +1004,17 @@ type FlushFileOp struct {
 	// The file and handle being flushed.
 	Inode  InodeID
 	Handle HandleID
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The owner of any POSIX record locks that the closing process holds on the
+	// file, as for SetLockOp.Owner. A file system that implements those locks
+	// must drop them all here, since closing any descriptor for a file
+	// releases its process's locks on that file, and the kernel doesn't send
+	// unlocks for them.
+	LockOwner uint64
 }
 
 // Release a previously-minted file handle. The kernel calls this when there
@@ -786,11 +1025,226 @@ type FlushFileOp struct {
 // to the file system (unless it is reissued by the file system).
 //
 // Errors from this op are ignored by the kernel (cf. http://goo.gl/RL38Do).
+//
+// Whether to flush here depends on Flags:
+//
+//  *  If ReleaseFlush is set, no FlushFileOp was sent for the final close and
+//     the file system should do whatever it would have done for one.
+//
+//  *  Otherwise a FlushFileOp has already been received for each close(2),
+//     and that is the place to report errors: the release is sent
+//     asynchronously on Linux, possibly after the process that closed the
+//     file has exited, so nobody will see an error returned here. The file
+//     system need only write out data that arrived after the last flush,
+//     such as stores through a shared mapping that outlived the file
+//     descriptor (see the notes on FlushFileOp).
+//
+// The inode may have been unlinked while the handle was open. In that case
+// the release may be the last op referring to it before ForgetInodeOp, and if
+// no links remain a file system that defers writes until release can discard
+// them instead, since nobody can open the file again.
 type ReleaseFileHandleOp struct {
+	// The inode that the handle was opened for.
+	Inode InodeID
+
 	// The handle ID to be released. The kernel guarantees that this ID will not
 	// be used in further calls to the file system (unless it is reissued by the
 	// file system).
 	Handle HandleID
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// Flags describing the release.
+	Flags ReleaseFlags
+
+	// If Flags has ReleaseFlockUnlock set, the owner of the flock(2) locks
+	// taken through the handle (see SetLockOp.Flock), all of which the file
+	// system must drop, since the kernel doesn't send unlocks for them.
+	// Otherwise zero.
+	LockOwner uint64
+}
+
+////////////////////////////////////////////////////////////////////////
+// Record locks
+////////////////////////////////////////////////////////////////////////
+
+// A POSIX record lock on a range of a file, as for fcntl(2)'s struct flock.
+type FileLock struct {
+	// The first and last bytes of the range, inclusive. A lock that runs to
+	// the end of the file, however far it grows, ends at math.MaxInt64.
+	Start uint64
+	End   uint64
+
+	// The kind of lock: syscall.F_RDLCK, syscall.F_WRLCK or syscall.F_UNLCK.
+	Type uint32
+
+	// The ID of the process that holds or wants the lock, as seen by the
+	// kernel. This is only informative, since the lock belongs to its owner.
+	Pid uint32
+}
+
+// Find a lock held on an inode that would keep the supplied one from being
+// taken, as for fcntl(2) with F_GETLK. Only sent if
+// fuse.MountConfig.EnablePOSIXLocks is set; otherwise the kernel keeps record
+// locks itself, which serves for file systems that aren't shared with other
+// machines.
+type GetLockOp struct {
+	// The file and handle through which the lock was asked about.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The owner asking, whose own locks never conflict (see SetLockOp.Owner),
+	// and the lock it would like to take.
+	Owner uint64
+	Lock  FileLock
+
+	// Set by the file system: a lock held by another owner that conflicts with
+	// Lock, or one with Type syscall.F_UNLCK if there is none.
+	Conflict FileLock
+}
+
+// Take, change or release a lock on part of an inode, as for fcntl(2) with
+// F_SETLK or F_SETLKW. Only sent if fuse.MountConfig.EnablePOSIXLocks is
+// set; see GetLockOp.
+//
+// An owner holds at most one lock on each byte. Setting a lock replaces
+// whatever the owner held on the range, splitting its locks around it as
+// needed, which is how locks are upgraded or downgraded; F_UNLCK merely
+// removes them. If another owner holds a conflicting lock (a write lock
+// conflicts with any other, a read lock only with write locks), the request
+// must fail with EAGAIN and change nothing, unless Wait is set, in which case
+// it should wait until it no longer conflicts, or fail with EINTR if the
+// op's context is cancelled first. The kernel never sends unlocks for locks
+// dropped when a file is closed; see FlushFileOp.LockOwner.
+//
+// flock(2) locks arrive here too, with Flock set, if
+// fuse.MountConfig.EnableFlockLocks is. They follow the same rules, with
+// LOCK_SH, LOCK_EX and LOCK_UN as F_RDLCK, F_WRLCK and F_UNLCK on the whole
+// file, except that they belong to an open file rather than a process, and
+// neither conflict with nor replace fcntl(2) locks. They are never asked about
+// with GetLockOp, and are dropped on ReleaseFileHandleOp rather than
+// FlushFileOp.
+//
+// fuseutil.FileLocks implements these rules for file systems that keep their
+// locks in memory.
+type SetLockOp struct {
+	// The file and handle through which the lock is set.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// An opaque ID for the lock's owner: the process's table of open files,
+	// for fcntl(2) locks, so that locks set through any of a process's
+	// descriptors for the file are the same owner's.
+	Owner uint64
+
+	// The lock to set, or the range to unlock for syscall.F_UNLCK.
+	Lock FileLock
+
+	// Whether to wait for conflicting locks to be released, as for F_SETLKW,
+	// rather than fail with EAGAIN.
+	Wait bool
+
+	// Whether this is a flock(2) lock, whose owner is the open file that it
+	// was taken through.
+	Flock bool
+}
+
+////////////////////////////////////////////////////////////////////////
+// Polling
+////////////////////////////////////////////////////////////////////////
+
+// Find which of some I/O events an open file is ready for, as for poll(2),
+// select(2) and epoll(7). This lets a file behave like a device or a pipe,
+// whose readers wait in poll until there is something to read.
+//
+// The op must not block. If Notify is set, somebody will wait if none of the
+// events is ready, and the file system should keep PollHandle and call
+// fuse.Connection.NotifyPollWakeup with it once that may have changed, after
+// which the kernel asks again. Notifying more often than needed is harmless.
+// A handle stays valid until the handle it was asked through is released;
+// notifications after that are ignored.
+//
+// Returning ENOSYS, as fuseutil.NotImplementedFileSystem does, tells the
+// kernel that every file on the mount is always ready for reading and
+// writing, as for a regular file, and it stops sending this op.
+type PollOp struct {
+	// The file and handle being polled.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The kernel's name for the waiters, for NotifyPollWakeup.
+	PollHandle PollHandle
+
+	// Whether anybody will wait for a notification.
+	Notify bool
+
+	// The events of interest, such as unix.POLLIN or unix.POLLOUT. Zero if the
+	// kernel is too old to say (protocol < 7.21), in which case any may be.
+	Events uint32
+
+	// Set by the file system: the events that are ready, which may include
+	// ones not asked for, such as unix.POLLHUP or unix.POLLERR.
+	Revents uint32
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ioctls
+////////////////////////////////////////////////////////////////////////
+
+// Carry out a command on an open file or directory, as for ioctl(2).
+//
+// The kernel only passes on commands whose number encodes the size and
+// direction of their data (see _IOC in <asm-generic/ioctl.h>). It copies the
+// command's input in before sending the op, and copies back to the caller
+// whatever the file system writes to Dst. Commands the file system doesn't
+// know should fail with ENOTTY, as for any file that doesn't support them;
+// fuseutil.NotImplementedFileSystem does so for all of them.
+//
+// lsattr(1) and chattr(1) use FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, which the
+// kernel sends with 4-byte flags, whatever the size encoded in the commands.
+type IoctlOp struct {
+	// The file or directory, and the handle through which the command was
+	// issued.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The command, and its argument as the caller passed it: an integer for
+	// commands without data, or an address in the caller's memory, of no use
+	// here, for those with.
+	Cmd uint32
+	Arg uint64
+
+	// The command's input, if it has any.
+	Input []byte
+
+	// The buffer for the command's output, as long as the output the caller
+	// expects, if any, up to the most a reply can carry.
+	Dst []byte
+
+	// Set by the file system: the number of bytes of Dst filled, and the
+	// non-negative value for ioctl(2) to return. Failures should be returned
+	// as errors instead. A BytesRead outside [0, len(Dst)] fails the op with
+	// EIO.
+	BytesRead int
+	Result    int32
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -825,7 +1279,8 @@ type RemoveXattrOp struct {
 // Get an extended attribute.
 //
 // This is sent in response to getxattr(2). Return ENOATTR if the
-// extended attribute does not exist.
+// extended attribute does not exist. An attribute with an empty value exists,
+// and is read by setting BytesRead to zero and returning nil.
 type GetXattrOp struct {
 	// The inode whose extended attribute we are reading.
 	Inode InodeID
@@ -854,7 +1309,8 @@ type ListXattrOp struct {
 	// value, the ERANGE error should be sent.
 	//
 	// The output data should consist of a sequence of NUL-terminated strings,
-	// one for each xattr.
+	// one for each xattr. The buffer isn't zeroed beforehand, so the NULs must
+	// be written too.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
@@ -867,6 +1323,12 @@ type ListXattrOp struct {
 //
 // This is sent in response to setxattr(2). Return ENOSPC if there is
 // insufficient space remaining to store the extended attribute.
+//
+// Names longer than 255 bytes are failed with ERANGE, and values larger than
+// 64 KiB with E2BIG, without being passed to the file system, so that it sees
+// Linux's limits on every platform. The exception is macOS's resource fork,
+// "com.apple.ResourceFork", which may be of any size. Values may be empty,
+// which is distinct from the attribute not existing.
 type SetXattrOp struct {
 	// The inode whose extended attribute we are setting.
 	Inode InodeID
@@ -884,21 +1346,131 @@ type SetXattrOp struct {
 	Flags uint32
 }
 
+// Allocate or deallocate space within a file, as for fallocate(2). The mode
+// flags are passed on as the caller gave them, so that the file system can
+// preallocate, e.g. for posix_fallocate(3), or punch holes in sparse files.
+// The kernel itself rejects most other flags, and FALLOC_FL_PUNCH_HOLE
+// without FALLOC_FL_KEEP_SIZE.
+//
+// Return EOPNOTSUPP for a mode the file system doesn't implement. Returning
+// ENOSYS instead makes the kernel fail every later fallocate(2) on the mount
+// with EOPNOTSUPP without sending it, which is also what glibc's
+// posix_fallocate(3) needs to fall back to writing zeroes itself.
 type FallocateOp struct {
 	// The inode and handle we are fallocating
 	Inode  InodeID
 	Handle HandleID
 
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
 	// Start of the byte range
 	Offset uint64
 
 	// Length of the byte range
 	Length uint64
 
-	// If Mode is 0x0, allocate disk space within the range specified
-	// If Mode has 0x1, allocate the space but don't increase the file size
-	// If Mode has 0x2, deallocate space within the range specified
-	// If Mode has 0x2, it sbould also have 0x1 (deallocate should not increase
-	// file size)
+	// If Mode is 0x0, allocate disk space within the range specified, growing
+	// the file if the range ends past its size.
+	// If Mode has 0x1 (FALLOC_FL_KEEP_SIZE), allocate the space but don't
+	// increase the file size.
+	// If Mode has 0x2 (FALLOC_FL_PUNCH_HOLE), deallocate space within the range
+	// specified, so that it reads as zeroes. It then also has 0x1, and the file
+	// size is unchanged.
 	Mode uint32
 }
+
+// Find where data or a hole starts in a file, as for lseek(2) with SEEK_DATA
+// or SEEK_HOLE, so that tools copying sparse files needn't read the holes.
+// The kernel moves the file offset to wherever the file system says.
+//
+// Holes read as zeroes, so a file system that doesn't keep track of them may
+// report zeroes as one, or none at all. Offsets at or past the end of the
+// file should fail with ENXIO, as should SeekData in a hole running to the
+// end. Returning ENOSYS, as fuseutil.NotImplementedFileSystem does, tells the
+// kernel to stop sending the op for the mount and treat every file as data
+// from start to end.
+type LseekOp struct {
+	// The file, and the handle through which it is being sought.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value attached to the handle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The offset from which to look, and what to look for. Whence is always
+	// SeekData or SeekHole.
+	Offset int64
+	Whence SeekWhence
+
+	// Set by the file system: the offset found, no less than Offset.
+	Result int64
+}
+
+// Copy data from one open file to another, or to another part of the same
+// file, as for copy_file_range(2). This lets the file system copy without the
+// data passing through the kernel, one read and one write at a time. Sent
+// only for files on the same mount; the kernel writes back any dirty pages in
+// both ranges first, and has already rejected overlapping ranges of the same
+// file.
+//
+// Copying may stop short, e.g. at the end of the source file. Returning
+// ENOSYS, as fuseutil.NotImplementedFileSystem does, tells the kernel to stop
+// sending the op for the mount and copy through reads and writes instead.
+type CopyFileRangeOp struct {
+	// The file to copy from, the handle through which it was opened, and the
+	// offset at which to start reading.
+	SrcInode  InodeID
+	SrcHandle HandleID
+	SrcOffset int64
+
+	// The value attached to SrcHandle when it was opened, if any. See the
+	// notes on OpenFileOp.HandleData.
+	SrcHandleData interface{}
+
+	// The file to copy to, the handle through which it was opened, and the
+	// offset at which to start writing. The file grows if the copy ends past
+	// its size.
+	DstInode  InodeID
+	DstHandle HandleID
+	DstOffset int64
+
+	// The value attached to DstHandle when it was opened, if any.
+	DstHandleData interface{}
+
+	// The number of bytes to copy. The kernel caps this well within the range
+	// of an off_t.
+	Length uint64
+
+	// Set by the file system: the number of bytes copied, no more than Length.
+	BytesCopied uint64
+}
+
+// Check whether the caller may access an inode in the given way, as for
+// access(2), returning EACCES if not.
+//
+// The kernel only sends this for access(2) and friends when the kernel itself
+// doesn't check permissions, which is never the case for file systems mounted
+// by this package (see the notes on InodeAttributes.Mode). Instead it is sent
+// on behalf of other ops when fuse.MountConfig.CheckWriteAccess is set, so
+// that the file system gets a say even where the kernel's checks let the
+// caller through.
+type AccessOp struct {
+	// The credentials of the caller.
+	Metadata OpMetadata
+
+	// The inode of interest.
+	Inode InodeID
+
+	// The access wanted: some combination of R_OK (4), W_OK (2) and X_OK (1),
+	// or zero to test only for the inode's existence.
+	Mask uint32
+
+	// If the check is made on behalf of another op, that op, which is carried
+	// out only if this one succeeds: an *OpenFileOp opening the inode for
+	// writing, or a *SetInodeAttributesOp. The file system must not modify it.
+	// Nil for the kernel's own checks.
+	For interface{}
+}
@@ -61,6 +61,21 @@ func init() {
 type InodeAttributes struct {
 	Size uint64
 
+	// The number of 512-byte blocks allocated to the inode, reported in
+	// st_blocks and counted by du(1). If zero, Size rounded up to a whole
+	// number of blocks is reported instead. It may be less than that for a
+	// sparse file, and it isn't checked against Size.
+	Blocks uint64
+
+	// The preferred size for I/O on the inode, reported in st_blksize. Linux
+	// uses only powers of two, rounding others down. If zero, the kernel picks
+	// a default.
+	BlockSize uint32
+
+	// For device nodes, the device number, reported in st_rdev (cf.
+	// unix.Mkdev).
+	Rdev uint32
+
 	// The number of incoming hard links to this inode.
 	Nlink uint32
 
@@ -85,6 +100,9 @@ type InodeAttributes struct {
 	//     several code paths if FUSE_DEFAULT_PERMISSIONS is unset. In contrast,
 	//     if that flag *is* set, then it calls generic_permission.
 	//
+	// As with any local file system, generic_permission lets root do as it
+	// pleases regardless of the mode. File systems that must not allow that
+	// can check ops themselves too; see fuse.MountConfig.CheckWriteAccess.
 	Mode os.FileMode
 
 	// Time information. See `man 2 stat` for full details.
@@ -132,11 +150,90 @@ type GenerationNumber uint64
 // This corresponds to fuse_file_info::fh.
 type HandleID uint64
 
+// PollHandle is an opaque 64-bit number chosen by the kernel to identify a
+// file whose readiness somebody is waiting for, to be handed back to
+// fuse.Connection.NotifyPollWakeup. See the notes on PollOp.
+//
+// This corresponds to fuse_poll_in::kh.
+type PollHandle uint64
+
 // DirOffset is an offset into an open directory handle. This is opaque to
 // FUSE, and can be used for whatever purpose the file system desires. See
 // notes on ReadDirOp.Offset for details.
 type DirOffset uint64
 
+// ReleaseFlags describe the circumstances in which the kernel is releasing a
+// file handle. See the notes on ReleaseFileHandleOp for how to use them.
+//
+// This corresponds to fuse_release_in::release_flags.
+type ReleaseFlags uint32
+
+const (
+	// The kernel has not sent a FlushFileOp for the final close of the handle
+	// and expects the release to do the flush's job, including making dirty
+	// data durable if that is what FlushFileOp would do. Linux does not set
+	// this, instead sending a FlushFileOp for every close(2).
+	ReleaseFlush ReleaseFlags = 1 << 0
+
+	// Any flock(2) lock held through the handle should be dropped; see
+	// ReleaseFileHandleOp.LockOwner. The kernel only sets this for mounts with
+	// fuse.MountConfig.EnableFlockLocks.
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1
+)
+
+func (fl ReleaseFlags) String() string {
+	return fusekernel.ReleaseFlags(fl).String()
+}
+
+// SeekWhence says what LseekOp looks for, as for the whence argument to
+// lseek(2). The kernel handles the other values itself.
+type SeekWhence uint32
+
+const (
+	// Find the first offset at or after the supplied one that holds data
+	// (lseek's SEEK_DATA).
+	SeekData SeekWhence = 3
+
+	// Find the first offset at or after the supplied one that lies in a hole
+	// (lseek's SEEK_HOLE). The end of the file counts as a hole.
+	SeekHole SeekWhence = 4
+)
+
+func (w SeekWhence) String() string {
+	switch w {
+	case SeekData:
+		return "SeekData"
+
+	case SeekHole:
+		return "SeekHole"
+	}
+
+	return fmt.Sprintf("SeekWhence(%d)", uint32(w))
+}
+
+// RenameFlags are the flags passed to renameat2(2), which change what a
+// rename does. See the notes on RenameOp for how to use them.
+//
+// This corresponds to fuse_rename2_in::flags.
+type RenameFlags uint32
+
+const (
+	// Fail with EEXIST rather than replace the new name if it exists.
+	RenameNoReplace RenameFlags = 1 << 0
+
+	// Swap the two names, both of which must exist, atomically. They may be of
+	// different types, and a non-empty directory may be swapped.
+	RenameExchange RenameFlags = 1 << 1
+
+	// Leave an overlayfs whiteout, a character device numbered 0/0, at the old
+	// name.
+	RenameWhiteout RenameFlags = 1 << 2
+)
+
+func (fl RenameFlags) String() string {
+	return fusekernel.RenameFlags(fl).String()
+}
+
 // ChildInodeEntry contains information about a child inode within its parent
 // directory. It is shared by LookUpInodeOp, MkDirOp, CreateFileOp, etc, and is
 // consumed by the kernel in order to set up a dcache entry.
@@ -196,6 +293,11 @@ type ChildInodeEntry struct {
 	//     http://stackoverflow.com/q/21540315/1505451
 	AttributesExpiration time.Time
 
+	// An alternative to AttributesExpiration giving how long the attributes
+	// may be cached for, measured from when the response is sent to the
+	// kernel. It is honored only if AttributesExpiration is zero.
+	AttributesValidFor time.Duration
+
 	// The time until which the kernel may maintain an entry for this name to
 	// inode mapping in its dentry cache. After this time, it will revalidate the
 	// dentry.
@@ -219,4 +321,9 @@ type ChildInodeEntry struct {
 	// Beware: this value is ignored on OS X, where entry caching is disabled by
 	// default. See notes on MountConfig.EnableVnodeCaching for more.
 	EntryExpiration time.Time
+
+	// An alternative to EntryExpiration giving how long the entry may be
+	// cached for, measured from when the response is sent to the kernel. It is
+	// honored only if EntryExpiration is zero.
+	EntryValidFor time.Duration
 }
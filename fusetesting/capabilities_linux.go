@@ -0,0 +1,370 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+)
+
+// CheckCapabilities checks the capabilities declared by the file system
+// mounted at dirname (see fuse.Capabilities) against how it behaves through
+// the kernel, so that the declaration can be trusted. It creates, links,
+// renames and removes entries in a scratch directory made in the root, or in
+// the root itself if the file system can't make directories, and reports as
+// discrepancies:
+//
+//   - declared ops that fail with ENOSYS or EOPNOTSUPP, or fail otherwise, or
+//     give the wrong result, such as a read not returning what was written;
+//   - ops that work but aren't declared;
+//   - with AtomicRename, renames over an existing file that fail or don't
+//     replace it;
+//   - with MaxFileSize, files that can be grown beyond it.
+//
+// Only ops whose absence reaches applications are checked: the kernel hides
+// ENOSYS from ForgetInode, OpenDir, ReleaseDirHandle, SyncDir, OpenFile,
+// SyncFile, FlushFile, ReleaseFileHandle and Access. Ops that need a file,
+// such as ReadFile, are only checked if one can be created.
+//
+// Some things can't be observed through the mount alone, and so aren't
+// checked: the kernel holds off lookups in a directory while renaming within
+// it, hiding whether the file system replaces a file in one step, and the
+// consistency model concerns changes made elsewhere.
+//
+// The returned error is for failures to read the declaration or to clean up.
+func CheckCapabilities(dirname string) (d []Discrepancy, err error) {
+	caps, err := readCapabilities(dirname)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capabilityChecker{
+		dirname:  dirname,
+		declared: make(map[string]bool),
+		reported: make(map[string]bool),
+	}
+
+	for _, op := range caps.Ops {
+		c.declared[op] = true
+	}
+
+	c.checkRoot()
+
+	// Work in a scratch directory if possible, so as not to disturb the root.
+	c.scratch = fmt.Sprintf("/.capabilities-%d-%d", os.Getpid(), time.Now().UnixNano())
+	madeDir := c.check("MkDir", c.scratch, syscall.Mkdir(c.path(""), 0700))
+	if !madeDir {
+		c.scratch = "/"
+	}
+
+	c.checkFile(caps)
+
+	if madeDir {
+		err := syscall.Rmdir(c.path(""))
+		if !c.check("RmDir", c.scratch, err) && err != nil {
+			return c.found, fmt.Errorf("Removing %s: %v", c.scratch, err)
+		}
+	}
+
+	return c.found, nil
+}
+
+// Read the capabilities declared through fuse.CapabilitiesXattr.
+func readCapabilities(dirname string) (*fuse.Capabilities, error) {
+	n, err := syscall.Getxattr(dirname, fuse.CapabilitiesXattr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Getxattr: %v", err)
+	}
+
+	buf := make([]byte, n)
+	if n, err = syscall.Getxattr(dirname, fuse.CapabilitiesXattr, buf); err != nil {
+		return nil, fmt.Errorf("Getxattr: %v", err)
+	}
+
+	var decoded struct {
+		Version int `json:"version"`
+		fuse.Capabilities
+	}
+
+	if err := json.Unmarshal(buf[:n], &decoded); err != nil {
+		return nil, fmt.Errorf("Decoding %s: %v", fuse.CapabilitiesXattr, err)
+	}
+
+	if decoded.Version != 1 {
+		return nil, fmt.Errorf("Unknown version %d", decoded.Version)
+	}
+
+	return &decoded.Capabilities, nil
+}
+
+type capabilityChecker struct {
+	dirname  string
+	declared map[string]bool
+	found    []Discrepancy
+
+	// The ops for which check has reported a discrepancy, each of which is
+	// reported once.
+	reported map[string]bool
+
+	// The scratch directory, relative to dirname.
+	scratch string
+}
+
+func (c *capabilityChecker) report(
+	p string,
+	format string,
+	v ...interface{}) {
+	c.found = append(c.found, Discrepancy{p, fmt.Sprintf(format, v...)})
+}
+
+// The absolute path of the given name in the scratch directory.
+func (c *capabilityChecker) path(name string) string {
+	return path.Join(c.dirname, c.scratch, name)
+}
+
+// Check the result of a syscall carried out by op on the entry at p,
+// reporting a discrepancy if it worked but op isn't declared, or failed but
+// is. Return whether it worked.
+func (c *capabilityChecker) check(
+	op string,
+	p string,
+	err error) bool {
+	report := func(format string, v ...interface{}) {
+		if !c.reported[op] {
+			c.reported[op] = true
+			c.report(p, format, v...)
+		}
+	}
+
+	switch {
+	case err == nil:
+		if !c.declared[op] {
+			report("%s works, but isn't declared", op)
+		}
+
+		return true
+
+	case err == syscall.ENOSYS || err == syscall.EOPNOTSUPP:
+		if c.declared[op] {
+			report("%s is declared, but fails with %v", op, err)
+		}
+
+	default:
+		if c.declared[op] {
+			report("%s failed: %v", op, err)
+		}
+	}
+
+	return false
+}
+
+// Check the ops that can be observed without changing anything.
+func (c *capabilityChecker) checkRoot() {
+	var st syscall.Stat_t
+	c.check("GetInodeAttributes", "/", syscall.Lstat(c.dirname, &st))
+
+	// Finding nothing is a successful lookup.
+	err := syscall.Lstat(path.Join(c.dirname, ".capabilities-missing"), &st)
+	if err == syscall.ENOENT {
+		err = nil
+	}
+
+	c.check("LookUpInode", "/", err)
+
+	_, err = readRawDir(c.dirname)
+	c.check("ReadDir", "/", err)
+
+	var sfs syscall.Statfs_t
+	c.check("StatFS", "/", syscall.Statfs(c.dirname, &sfs))
+}
+
+// Check the ops that need a file, creating one, and remove it afterward.
+func (c *capabilityChecker) checkFile(caps *fuse.Capabilities) {
+	const name = "file"
+	p := path.Join(c.scratch, name)
+
+	// The kernel makes do with MkNode if it can't create files.
+	fd, err := syscall.Open(c.path(name), syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL, 0600)
+	if c.declared["MkNode"] && err == nil {
+		c.declared["CreateFile"] = true
+	}
+
+	if !c.check("CreateFile", p, err) {
+		return
+	}
+
+	c.checkFileContents(caps, p, fd)
+	syscall.Close(fd)
+
+	c.checkXattrs(p, c.path(name))
+
+	if c.check("CreateLink", p, syscall.Link(c.path(name), c.path("link"))) {
+		c.unlink("link")
+	}
+
+	if c.check("CreateSymlink", p, syscall.Symlink(name, c.path("symlink"))) {
+		buf := make([]byte, len(name)+1)
+		n, err := syscall.Readlink(c.path("symlink"), buf)
+		if c.check("ReadSymlink", p, err) && string(buf[:n]) != name {
+			c.report(p, "Readlink gave %q, want %q", buf[:n], name)
+		}
+
+		c.unlink("symlink")
+	}
+
+	if c.check("MkNode", p, syscall.Mknod(c.path("fifo"), syscall.S_IFIFO|0600, 0)) {
+		c.unlink("fifo")
+	}
+
+	remaining := name
+	if c.check("Rename", p, syscall.Rename(c.path(name), c.path("renamed"))) {
+		remaining = "renamed"
+		if caps.AtomicRename {
+			c.checkRenameOver(remaining)
+		}
+	} else if caps.AtomicRename {
+		c.report(p, "AtomicRename is declared, but renames fail")
+	}
+
+	c.unlink(remaining)
+}
+
+// Check reads, writes, truncation and allocation through the file open as
+// fd.
+func (c *capabilityChecker) checkFileContents(
+	caps *fuse.Capabilities,
+	p string,
+	fd int) {
+	contents := []byte("capabilities")
+	_, err := syscall.Pwrite(fd, contents, 0)
+	wrote := c.check("WriteFile", p, err)
+
+	if wrote {
+		buf := make([]byte, len(contents)+1)
+		n, err := syscall.Pread(fd, buf, 0)
+		if c.check("ReadFile", p, err) && !bytes.Equal(buf[:n], contents) {
+			c.report(p, "Read back %q after writing %q", buf[:n], contents)
+		}
+	}
+
+	truncated := c.check("SetInodeAttributes", p, syscall.Ftruncate(fd, 4))
+	c.check("Fallocate", p, syscall.Fallocate(fd, 0, 0, 8))
+
+	if caps.MaxFileSize == 0 {
+		return
+	}
+
+	if truncated {
+		err := syscall.Ftruncate(fd, caps.MaxFileSize+1)
+		if err != syscall.EFBIG {
+			c.report(p, "Truncating beyond MaxFileSize gave %v, want EFBIG", err)
+		}
+
+		syscall.Ftruncate(fd, 0)
+	}
+
+	if wrote {
+		_, err := syscall.Pwrite(fd, contents[:1], caps.MaxFileSize)
+		if err != syscall.EFBIG {
+			c.report(p, "Writing beyond MaxFileSize gave %v, want EFBIG", err)
+		}
+
+		syscall.Ftruncate(fd, 0)
+	}
+}
+
+// Check the extended attributes of the file at the given path.
+func (c *capabilityChecker) checkXattrs(p string, file string) {
+	const name = "user.capabilities"
+	value := []byte("value")
+
+	set := c.check("SetXattr", p, syscall.Setxattr(file, name, value, 0))
+
+	// Without SetXattr, finding nothing is success.
+	buf := make([]byte, 1<<16)
+	n, err := syscall.Getxattr(file, name, buf)
+	if !set && err == syscall.ENODATA {
+		err = nil
+	}
+
+	if c.check("GetXattr", p, err) && set && !bytes.Equal(buf[:n], value) {
+		c.report(p, "Getxattr gave %q, want %q", buf[:n], value)
+	}
+
+	n, err = syscall.Listxattr(file, buf)
+	if c.check("ListXattr", p, err) && set {
+		if !bytes.Contains(append([]byte{0}, buf[:n]...), []byte("\x00"+name+"\x00")) {
+			c.report(p, "Listxattr gave %q, which doesn't include %q", buf[:n], name)
+		}
+	}
+
+	err = syscall.Removexattr(file, name)
+	if !set && err == syscall.ENODATA {
+		err = nil
+	}
+
+	c.check("RemoveXattr", p, err)
+}
+
+// Check that renaming a new file over the given one replaces it.
+func (c *capabilityChecker) checkRenameOver(name string) {
+	p := path.Join(c.scratch, name)
+
+	fd, err := syscall.Open(c.path("next"), syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, 0600)
+	if err != nil {
+		c.report(p, "AtomicRename: creating a file to rename: %v", err)
+		return
+	}
+
+	syscall.Close(fd)
+
+	var next syscall.Stat_t
+	if err := syscall.Lstat(c.path("next"), &next); err != nil {
+		c.report(p, "AtomicRename: lstat: %v", err)
+		c.unlink("next")
+		return
+	}
+
+	if err := syscall.Rename(c.path("next"), c.path(name)); err != nil {
+		c.report(p, "AtomicRename is declared, but renaming over a file fails: %v", err)
+		c.unlink("next")
+		return
+	}
+
+	var st syscall.Stat_t
+	switch err := syscall.Lstat(c.path(name), &st); {
+	case err != nil:
+		c.report(p, "Lstat after renaming over it: %v", err)
+
+	case st.Ino != next.Ino:
+		c.report(p, "Is inode %d after renaming inode %d over it", st.Ino, next.Ino)
+	}
+
+	if err := syscall.Lstat(c.path("next"), &st); err != syscall.ENOENT {
+		c.report(p, "Renamed name still found, with error %v", err)
+	}
+}
+
+// Remove the given file from the scratch directory.
+func (c *capabilityChecker) unlink(name string) {
+	c.check("Unlink", path.Join(c.scratch, name), syscall.Unlink(c.path(name)))
+}
@@ -0,0 +1,324 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The size of the ReadDir requests CheckConsistency makes. It is small so that
+// even short listings take several requests, exercising the file system's
+// handling of offsets.
+const consistencyReadSize = 4096
+
+// The most entries CheckConsistency reads from a single directory before
+// deciding that its listing never ends.
+const maxConsistencyEntries = 1 << 20
+
+// A Discrepancy is a disagreement between a file system's directory listings
+// and its lookups, found by CheckConsistency or CheckMountConsistency, or
+// between its declared capabilities and its behavior, found by
+// CheckCapabilities.
+type Discrepancy struct {
+	// The path of the entry concerned, relative to the root of the file system.
+	Path string
+
+	// What is wrong, with the inodes, types, ops and errors involved.
+	Problem string
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%s: %s", d.Path, d.Problem)
+}
+
+// CheckConsistency walks the whole of the file system served to k, checking
+// that its directory listings agree with its lookups, as tools like find(1)
+// and rsync(1) rely on. It reports as discrepancies:
+//
+//   - names listed more than once in the same directory;
+//   - names listed that LookUp can't find;
+//   - names listed with a type, other than DT_Unknown, that disagrees with
+//     the mode GetAttr gives for the child;
+//   - names that an earlier call to k.LookUp found, and that LookUp still
+//     finds, but that aren't listed in their directory;
+//   - directories that can't be opened or read.
+//
+// The last check covers names that tests or other callers have looked up,
+// since there's no way to ask a file system for every name it would find; to
+// check particular names, look them up with k before calling this.
+//
+// The returned error is for failures to talk to the file system at all, such
+// as GetAttr failing for the root.
+func CheckConsistency(k *FakeKernel) (d []Discrepancy, err error) {
+	if _, err := k.GetAttr(fuseops.RootInodeID); err != nil {
+		return nil, fmt.Errorf("GetAttr(root): %v", err)
+	}
+
+	c := &consistencyChecker{
+		k:       k,
+		visited: make(map[fuseops.InodeID]string),
+	}
+
+	c.checkDir(fuseops.RootInodeID, "/")
+	return c.found, nil
+}
+
+type consistencyChecker struct {
+	k     *FakeKernel
+	found []Discrepancy
+
+	// The path at which each directory walked was found, so that a directory
+	// reachable by two paths, or by a cycle, is walked once.
+	visited map[fuseops.InodeID]string
+}
+
+func (c *consistencyChecker) report(
+	p string,
+	format string,
+	v ...interface{}) {
+	c.found = append(c.found, Discrepancy{p, fmt.Sprintf(format, v...)})
+}
+
+// Read the whole listing of the given directory.
+func (c *consistencyChecker) list(
+	dir fuseops.InodeID,
+	p string) (entries []fuseutil.Dirent, ok bool) {
+	h, err := c.k.OpenDir(dir)
+	if err != nil {
+		c.report(p, "OpenDir(inode %d): %v", dir, err)
+		return nil, false
+	}
+
+	// Like the kernel, ignore errors releasing the handle.
+	defer c.k.ReleaseDir(dir, h)
+
+	var offset fuseops.DirOffset
+	for {
+		buf, err := c.k.ReadDir(dir, h, offset, consistencyReadSize)
+		if err != nil {
+			c.report(p, "ReadDir(inode %d, offset %d): %v", dir, offset, err)
+			return nil, false
+		}
+
+		if len(buf) == 0 {
+			return entries, true
+		}
+
+		for len(buf) > 0 {
+			e, n := fuseutil.ReadDirent(buf)
+			if n == 0 {
+				c.report(
+					p,
+					"ReadDir(inode %d, offset %d): malformed entry in reply",
+					dir,
+					offset)
+
+				return nil, false
+			}
+
+			entries = append(entries, e)
+			offset = e.Offset
+			buf = buf[n:]
+		}
+
+		if len(entries) > maxConsistencyEntries {
+			c.report(
+				p,
+				"Listing of inode %d doesn't end after %d entries",
+				dir,
+				len(entries))
+
+			return nil, false
+		}
+	}
+}
+
+// Check the directory with the given inode at the given path, and everything
+// beneath it.
+func (c *consistencyChecker) checkDir(
+	dir fuseops.InodeID,
+	p string) {
+	c.visited[dir] = p
+
+	entries, ok := c.list(dir, p)
+	if !ok {
+		return
+	}
+
+	// Check each name listed, noting the subdirectories to walk.
+	listed := make(map[string]int)
+	var subdirs []fuseutil.Dirent
+
+	for _, e := range entries {
+		listed[e.Name]++
+		if e.Name == "." || e.Name == ".." || listed[e.Name] > 1 {
+			continue
+		}
+
+		child := path.Join(p, e.Name)
+		inode, err := c.k.LookUp(dir, e.Name)
+		if err != nil {
+			c.report(
+				child,
+				"Listed in inode %d (as inode %d, offset %d) but LookUp fails: %v",
+				dir,
+				e.Inode,
+				e.Offset,
+				err)
+
+			continue
+		}
+
+		attr, err := c.k.GetAttr(inode)
+		if err != nil {
+			c.report(child, "Found as inode %d but GetAttr fails: %v", inode, err)
+			continue
+		}
+
+		typ := fuseutil.DirentType((attr.Mode & syscall.S_IFMT) >> 12)
+		if e.Type != fuseutil.DT_Unknown && e.Type != typ {
+			c.report(
+				child,
+				"Listed in inode %d with type %d, but inode %d has mode %#o",
+				dir,
+				e.Type,
+				inode,
+				attr.Mode)
+		}
+
+		if typ == fuseutil.DT_Directory {
+			subdirs = append(subdirs, fuseutil.Dirent{Inode: inode, Name: e.Name})
+		}
+	}
+
+	duplicates := make(map[string]bool)
+	for _, e := range entries {
+		if n := listed[e.Name]; n > 1 && !duplicates[e.Name] {
+			duplicates[e.Name] = true
+			c.report(path.Join(p, e.Name), "Listed %d times in inode %d", n, dir)
+		}
+	}
+
+	// Check the names previously found by lookups.
+	var missing []string
+	for name := range c.k.lookedUp(dir) {
+		if _, ok := listed[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+
+	sort.Strings(missing)
+	for _, name := range missing {
+		inode, err := c.k.LookUp(dir, name)
+		if err != nil {
+			// Removed since it was looked up.
+			continue
+		}
+
+		c.report(
+			path.Join(p, name),
+			"Found by LookUp as inode %d but not listed in inode %d (%d names)",
+			inode,
+			dir,
+			len(listed))
+	}
+
+	for _, s := range subdirs {
+		if _, ok := c.visited[s.Inode]; ok {
+			continue
+		}
+
+		c.checkDir(s.Inode, path.Join(p, s.Name))
+	}
+}
+
+// CheckMountConsistency is like CheckConsistency, but for the file system
+// mounted at dirname, which it walks using readdir(2) and lstat(2). Names are
+// looked up through the kernel, which may answer from its caches.
+//
+// There is no way to enumerate the names the kernel has looked up, so unlike
+// CheckConsistency this can't check that every name found by a lookup is
+// listed.
+func CheckMountConsistency(dirname string) (d []Discrepancy, err error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(dirname, &st); err != nil {
+		return nil, fmt.Errorf("Lstat: %v", err)
+	}
+
+	visited := map[uint64]bool{uint64(st.Ino): true}
+	var walk func(p string)
+	walk = func(p string) {
+		entries, err := readRawDir(path.Join(dirname, p))
+		if err != nil {
+			d = append(d, Discrepancy{p, err.Error()})
+			return
+		}
+
+		listed := make(map[string]int)
+		for _, e := range entries {
+			listed[e.name]++
+		}
+
+		for _, e := range entries {
+			n := listed[e.name]
+			if n == 0 || e.name == "." || e.name == ".." {
+				continue
+			}
+
+			// Check each name once.
+			listed[e.name] = 0
+			child := path.Join(p, e.name)
+
+			if n > 1 {
+				d = append(d, Discrepancy{child, fmt.Sprintf("Listed %d times", n)})
+			}
+
+			var st syscall.Stat_t
+			if err := syscall.Lstat(path.Join(dirname, child), &st); err != nil {
+				d = append(d, Discrepancy{
+					child,
+					fmt.Sprintf("Listed as inode %d but lstat fails: %v", e.inode, err),
+				})
+
+				continue
+			}
+
+			typ := uint8((st.Mode & syscall.S_IFMT) >> 12)
+			if e.typ != syscall.DT_UNKNOWN && e.typ != typ {
+				d = append(d, Discrepancy{
+					child,
+					fmt.Sprintf(
+						"Listed with type %d, but lstat gives mode %#o",
+						e.typ,
+						st.Mode),
+				})
+			}
+
+			if typ == syscall.DT_DIR && !visited[uint64(st.Ino)] {
+				visited[uint64(st.Ino)] = true
+				walk(child)
+			}
+		}
+	}
+
+	walk("/")
+	return d, nil
+}
@@ -0,0 +1,278 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/dynamicfs"
+	"github.com/jacobsa/fuse/samples/hellofs"
+	"github.com/jacobsa/fuse/samples/memfs"
+	"github.com/jacobsa/timeutil"
+)
+
+// Serve server to a FakeKernel, look up the given names in the root, and
+// return what CheckConsistency reports.
+func checkConsistency(
+	t *testing.T,
+	server fuse.Server,
+	names ...string) []string {
+	k, err := fusetesting.NewFakeKernel(server, &fuse.MountConfig{})
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	for _, name := range names {
+		k.LookUp(fuseops.RootInodeID, name)
+	}
+
+	found, err := fusetesting.CheckConsistency(k)
+	if err != nil {
+		t.Fatalf("CheckConsistency: %v", err)
+	}
+
+	var problems []string
+	for _, d := range found {
+		problems = append(problems, d.String())
+	}
+
+	return problems
+}
+
+// A populated memfs.
+func newPopulatedMemFS(t *testing.T) fuse.Server {
+	fs := memfs.NewFileSystem(uint32(os.Getuid()), uint32(os.Getgid()))
+	ctx := context.Background()
+
+	mkdir := &fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "dir",
+		Mode:   0700 | os.ModeDir,
+	}
+
+	if err := fs.MkDir(ctx, mkdir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	// Enough files to need several ReadDir requests.
+	for i := 0; i < 200; i++ {
+		op := &fuseops.CreateFileOp{
+			Parent: mkdir.Entry.Child,
+			Name:   fmt.Sprintf("file_with_a_longish_name_%03d", i),
+			Mode:   0600,
+			// memfs insists on a caller.
+			Metadata: fuseops.OpMetadata{Pid: uint32(os.Getpid())},
+		}
+
+		if err := fs.CreateFile(ctx, op); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+	}
+
+	symlink := &fuseops.CreateSymlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "link",
+		Target: "dir",
+	}
+
+	if err := fs.CreateSymlink(ctx, symlink); err != nil {
+		t.Fatalf("CreateSymlink: %v", err)
+	}
+
+	return fuseutil.NewFileSystemServer(fs)
+}
+
+func TestCheckConsistency_Samples(t *testing.T) {
+	hello, err := hellofs.NewHelloFS(timeutil.RealClock())
+	if err != nil {
+		t.Fatalf("NewHelloFS: %v", err)
+	}
+
+	dynamic, err := dynamicfs.NewDynamicFS(timeutil.RealClock())
+	if err != nil {
+		t.Fatalf("NewDynamicFS: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		server fuse.Server
+	}{
+		{"hellofs", hello},
+		{"dynamicfs", dynamic},
+		{"memfs", newPopulatedMemFS(t)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Names that one would find and one wouldn't.
+			problems := checkConsistency(t, tc.server, "hello", "missing")
+			if len(problems) != 0 {
+				t.Errorf("Discrepancies:\n%v", problems)
+			}
+		})
+	}
+}
+
+// A file system whose root listing disagrees with its lookups in every way
+// CheckConsistency looks for.
+type inconsistentFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+const (
+	inconsistentFileInode fuseops.InodeID = fuseops.RootInodeID + 1 + iota
+	inconsistentDirInode
+)
+
+// The children found by lookups in the root, by name.
+var inconsistentChildren = map[string]fuseops.InodeID{
+	"dup":       inconsistentFileInode,
+	"wrongtype": inconsistentDirInode,
+	"unlisted":  inconsistentFileInode,
+}
+
+func inconsistentAttributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == inconsistentFileInode {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0444}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0555 | os.ModeDir}
+}
+
+func (fs *inconsistentFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = inconsistentAttributes(op.Inode)
+	return nil
+}
+
+func (fs *inconsistentFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	child, ok := inconsistentChildren[op.Name]
+	if op.Parent != fuseops.RootInodeID || !ok {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = child
+	op.Entry.Attributes = inconsistentAttributes(child)
+	return nil
+}
+
+func (fs *inconsistentFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *inconsistentFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Inode != fuseops.RootInodeID {
+		return nil
+	}
+
+	entries := []fuseutil.Dirent{
+		{Name: "dup", Inode: inconsistentFileInode, Type: fuseutil.DT_File},
+		{Name: "vanished", Inode: 17, Type: fuseutil.DT_File},
+		{Name: "wrongtype", Inode: inconsistentDirInode, Type: fuseutil.DT_File},
+		{Name: "dup", Inode: inconsistentFileInode, Type: fuseutil.DT_File},
+	}
+
+	for i := int(op.Offset); i < len(entries); i++ {
+		e := entries[i]
+		e.Offset = fuseops.DirOffset(i + 1)
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *inconsistentFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func TestCheckConsistency_Discrepancies(t *testing.T) {
+	server := fuseutil.NewFileSystemServer(&inconsistentFS{})
+	got := checkConsistency(t, server, "unlisted", "missing")
+
+	want := []string{
+		"/vanished: Listed in inode 1 (as inode 17, offset 2) but LookUp fails: no such file or directory",
+		"/wrongtype: Listed in inode 1 with type 8, but inode 3 has mode 040555",
+		"/dup: Listed 2 times in inode 1",
+		"/unlisted: Found by LookUp as inode 2 but not listed in inode 1 (3 names)",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Discrepancies:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestCheckMountConsistency(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consistency_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	mfs, err := fuse.Mount(dir, newPopulatedMemFS(t), &fuse.MountConfig{
+		FSName: "memfs",
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		fuse.Unmount(dir)
+		mfs.Join(context.Background())
+	}()
+
+	// Look something up through the kernel first, so that some answers come
+	// from its cache.
+	if _, err := os.Lstat(path.Join(dir, "dir", "file_with_a_longish_name_007")); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+
+	found, err := fusetesting.CheckMountConsistency(dir)
+	if err != nil {
+		t.Fatalf("CheckMountConsistency: %v", err)
+	}
+
+	if len(found) != 0 {
+		t.Errorf("Discrepancies:\n%v", found)
+	}
+}
@@ -0,0 +1,745 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The largest read that the kernel will send in a single request, and
+// therefore the largest that FakeKernel.Read accepts.
+const MaxReadSize = buffer.MaxReadSize
+
+// FakeKernel plays the kernel's part of a FUSE connection, so that a
+// fuse.Server can be exercised in-process without mounting anything and
+// without privileges. Requests and replies travel over a SOCK_SEQPACKET
+// socket pair, which preserves message boundaries the way /dev/fuse does.
+//
+// Methods may be called concurrently.
+type FakeKernel struct {
+	mfs  *fuse.MountedFileSystem
+	sock *os.File
+
+	// The protocol version the server agreed to during init.
+	protocol fusekernel.Protocol
+
+	// Closed when readLoop returns.
+	readLoopDone chan struct{}
+
+	mu sync.Mutex
+
+	// The request ID to use for the next request.
+	//
+	// GUARDED_BY(mu)
+	nextUnique uint64
+
+	// Channels on which to deliver replies, by request ID.
+	//
+	// GUARDED_BY(mu)
+	waiting map[uint64]chan []byte
+
+	// The error that terminated readLoop, if it has returned.
+	//
+	// GUARDED_BY(mu)
+	readErr error
+
+	// The child found by the latest successful LookUp of each name, like the
+	// kernel's dentry cache. A failed LookUp removes the name.
+	//
+	// GUARDED_BY(mu)
+	lookUps map[lookUpKey]fuseops.InodeID
+}
+
+// A name within a directory.
+type lookUpKey struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// NewFakeKernel starts serving the supplied server, performing the init
+// handshake before returning. The caller must eventually call Close.
+func NewFakeKernel(
+	server fuse.Server,
+	config *fuse.MountConfig) (*FakeKernel, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Socketpair: %v", err)
+	}
+
+	k := &FakeKernel{
+		sock:         os.NewFile(uintptr(fds[0]), "fake-kernel"),
+		readLoopDone: make(chan struct{}),
+		nextUnique:   2,
+		waiting:      make(map[uint64]chan []byte),
+		lookUps:      make(map[lookUpKey]fuseops.InodeID),
+	}
+
+	dev := os.NewFile(uintptr(fds[1]), "fake-dev-fuse")
+
+	// Queue up the init request before starting the server, which reads it
+	// synchronously. Like the kernel, we give it a non-zero request ID, zero
+	// being reserved for notifications.
+	//
+	// Offer the optional features that a recent kernel does. The server
+	// accepts them only if its config asks for them.
+	initIn := fusekernel.InitIn{
+		Major:        fusekernel.ProtoVersionMaxMajor,
+		Minor:        fusekernel.ProtoVersionMaxMinor,
+		MaxReadahead: 1 << 20,
+		Flags: uint32(fusekernel.InitNoOpenSupport |
+			fusekernel.InitNoOpendirSupport |
+			fusekernel.InitCacheSymlinks |
+			fusekernel.InitWritebackCache |
+			fusekernel.InitDoReaddirplus |
+			fusekernel.InitPosixLocks |
+			fusekernel.InitFlockLocks),
+	}
+
+	const initInSize = unsafe.Sizeof(fusekernel.InitIn{})
+	initBytes := (*[initInSize]byte)(unsafe.Pointer(&initIn))[:]
+	if err := k.send(fusekernel.OpInit, 1, 0, initBytes); err != nil {
+		k.sock.Close()
+		dev.Close()
+		return nil, fmt.Errorf("Sending init: %v", err)
+	}
+
+	k.mfs, err = fuse.Serve(dev, server, config)
+	if err != nil {
+		k.sock.Close()
+		dev.Close()
+		return nil, fmt.Errorf("Serve: %v", err)
+	}
+
+	// Read the init reply.
+	reply, err := k.receive(make([]byte, maxReplySize))
+	if err != nil {
+		k.Close()
+		return nil, fmt.Errorf("Receiving init reply: %v", err)
+	}
+
+	payload, err := parseReply(reply)
+	if err != nil {
+		k.Close()
+		return nil, fmt.Errorf("Init: %v", err)
+	}
+
+	const initOutMin = unsafe.Offsetof(fusekernel.InitOut{}.MaxReadahead)
+	if uintptr(len(payload)) < initOutMin {
+		k.Close()
+		return nil, fmt.Errorf("Init reply too short: %d bytes", len(payload))
+	}
+
+	initOut := (*fusekernel.InitOut)(unsafe.Pointer(&payload[0]))
+	k.protocol = fusekernel.Protocol{initOut.Major, initOut.Minor}
+
+	go k.readLoop()
+
+	return k, nil
+}
+
+// MountedFileSystem returns the result of serving the server, e.g. for use
+// with Join.
+func (k *FakeKernel) MountedFileSystem() *fuse.MountedFileSystem {
+	return k.mfs
+}
+
+// Call sends a request with the given opcode, node ID and body to the server
+// and waits for the reply, returning its body. If the server replies with an
+// error, it is returned as a syscall.Errno.
+func (k *FakeKernel) Call(
+	opcode uint32,
+	nodeID uint64,
+	in []byte) ([]byte, error) {
+	return k.CallContext(context.Background(), opcode, nodeID, in)
+}
+
+// CallContext is like Call, but if ctx is done before the reply arrives, it
+// interrupts the request, as the kernel does when the calling process is
+// signalled, and goes on waiting for the reply.
+func (k *FakeKernel) CallContext(
+	ctx context.Context,
+	opcode uint32,
+	nodeID uint64,
+	in []byte) ([]byte, error) {
+	c := make(chan []byte, 1)
+
+	k.mu.Lock()
+	unique := k.nextUnique
+	k.nextUnique++
+	k.waiting[unique] = c
+	k.mu.Unlock()
+
+	if err := k.send(opcode, unique, nodeID, in); err != nil {
+		k.mu.Lock()
+		delete(k.waiting, unique)
+		k.mu.Unlock()
+
+		return nil, err
+	}
+
+	done := ctx.Done()
+	for {
+		select {
+		case reply := <-c:
+			return parseReply(reply)
+
+		case <-done:
+			done = nil
+
+			interrupt := fusekernel.InterruptIn{Unique: unique}
+			const inSize = unsafe.Sizeof(fusekernel.InterruptIn{})
+			err := k.Send(
+				fusekernel.OpInterrupt,
+				0,
+				(*[inSize]byte)(unsafe.Pointer(&interrupt))[:])
+
+			if err != nil {
+				return nil, fmt.Errorf("Sending interrupt: %v", err)
+			}
+
+		case <-k.readLoopDone:
+			k.mu.Lock()
+			defer k.mu.Unlock()
+
+			return nil, fmt.Errorf("Connection closed: %v", k.readErr)
+		}
+	}
+}
+
+// CallInterrupted is like Call, but sends an interrupt for the request ahead
+// of the request itself, as the server may see them if the interrupt
+// overtakes the request.
+func (k *FakeKernel) CallInterrupted(
+	opcode uint32,
+	nodeID uint64,
+	in []byte) ([]byte, error) {
+	c := make(chan []byte, 1)
+
+	k.mu.Lock()
+	interruptUnique := k.nextUnique
+	unique := k.nextUnique + 1
+	k.nextUnique += 2
+	k.waiting[unique] = c
+	k.mu.Unlock()
+
+	interrupt := fusekernel.InterruptIn{Unique: unique}
+	const inSize = unsafe.Sizeof(fusekernel.InterruptIn{})
+	err := k.send(
+		fusekernel.OpInterrupt,
+		interruptUnique,
+		0,
+		(*[inSize]byte)(unsafe.Pointer(&interrupt))[:])
+
+	if err == nil {
+		err = k.send(opcode, unique, nodeID, in)
+	}
+
+	if err != nil {
+		k.mu.Lock()
+		delete(k.waiting, unique)
+		k.mu.Unlock()
+
+		return nil, err
+	}
+
+	select {
+	case reply := <-c:
+		return parseReply(reply)
+
+	case <-k.readLoopDone:
+		k.mu.Lock()
+		defer k.mu.Unlock()
+
+		return nil, fmt.Errorf("Connection closed: %v", k.readErr)
+	}
+}
+
+// Send sends a request for which the kernel expects no reply, such as a
+// forget.
+func (k *FakeKernel) Send(
+	opcode uint32,
+	nodeID uint64,
+	in []byte) error {
+	k.mu.Lock()
+	unique := k.nextUnique
+	k.nextUnique++
+	k.mu.Unlock()
+
+	return k.send(opcode, unique, nodeID, in)
+}
+
+// LookUp looks up the given name within the given directory, returning the
+// child's inode ID.
+func (k *FakeKernel) LookUp(
+	parent fuseops.InodeID,
+	name string) (fuseops.InodeID, error) {
+	key := lookUpKey{parent, name}
+
+	in := append([]byte(name), 0)
+	out, err := k.Call(fusekernel.OpLookup, uint64(parent), in)
+	if err != nil {
+		k.mu.Lock()
+		delete(k.lookUps, key)
+		k.mu.Unlock()
+
+		return 0, err
+	}
+
+	if uintptr(len(out)) < fusekernel.EntryOutSize(k.protocol) {
+		return 0, fmt.Errorf("Lookup reply too short: %d bytes", len(out))
+	}
+
+	entry := (*fusekernel.EntryOut)(unsafe.Pointer(&out[0]))
+	child := fuseops.InodeID(entry.Nodeid)
+
+	k.mu.Lock()
+	k.lookUps[key] = child
+	k.mu.Unlock()
+
+	return child, nil
+}
+
+// Return the names within the given directory whose latest LookUp succeeded,
+// with the children found.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *FakeKernel) lookedUp(
+	parent fuseops.InodeID) map[string]fuseops.InodeID {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	children := make(map[string]fuseops.InodeID)
+	for key, child := range k.lookUps {
+		if key.parent == parent {
+			children[key.name] = child
+		}
+	}
+
+	return children
+}
+
+// Forget tells the server that the kernel has dropped n lookups of the given
+// inode, without waiting for it, as the kernel expects no reply.
+func (k *FakeKernel) Forget(
+	inode fuseops.InodeID,
+	n uint64) error {
+	in := fusekernel.ForgetIn{Nlookup: n}
+
+	const inSize = unsafe.Sizeof(fusekernel.ForgetIn{})
+	return k.Send(
+		fusekernel.OpForget,
+		uint64(inode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:])
+}
+
+// BatchForget sends the supplied forgets in a single message, as the kernel
+// does when it has several queued up, without waiting for the server.
+func (k *FakeKernel) BatchForget(forgets []fuseops.ForgetInodeOp) error {
+	in := fusekernel.BatchForgetIn{Count: uint32(len(forgets))}
+
+	const inSize = unsafe.Sizeof(fusekernel.BatchForgetIn{})
+	buf := append([]byte(nil), (*[inSize]byte)(unsafe.Pointer(&in))[:]...)
+	for _, f := range forgets {
+		entry := fusekernel.ForgetOne{Nodeid: uint64(f.Inode), Nlookup: f.N}
+
+		const entrySize = unsafe.Sizeof(fusekernel.ForgetOne{})
+		buf = append(buf, (*[entrySize]byte)(unsafe.Pointer(&entry))[:]...)
+	}
+
+	return k.Send(fusekernel.OpBatchForget, 0, buf)
+}
+
+// GetAttr fetches the attributes of the given inode.
+func (k *FakeKernel) GetAttr(inode fuseops.InodeID) (fusekernel.Attr, error) {
+	var in fusekernel.GetattrIn
+
+	const inSize = unsafe.Sizeof(fusekernel.GetattrIn{})
+	out, err := k.Call(
+		fusekernel.OpGetattr,
+		uint64(inode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:])
+
+	if err != nil {
+		return fusekernel.Attr{}, err
+	}
+
+	if uintptr(len(out)) < fusekernel.AttrOutSize(k.protocol) {
+		return fusekernel.Attr{}, fmt.Errorf(
+			"Getattr reply too short: %d bytes", len(out))
+	}
+
+	// Copy out only the portion the protocol version says was sent.
+	var attrOut fusekernel.AttrOut
+	copy(
+		(*[unsafe.Sizeof(fusekernel.AttrOut{})]byte)(unsafe.Pointer(&attrOut))[:],
+		out)
+
+	return attrOut.Attr, nil
+}
+
+// Open opens the given file for reading, returning the handle chosen by the
+// server.
+func (k *FakeKernel) Open(inode fuseops.InodeID) (fuseops.HandleID, error) {
+	in := fusekernel.OpenIn{Flags: uint32(os.O_RDONLY)}
+
+	const inSize = unsafe.Sizeof(fusekernel.OpenIn{})
+	out, err := k.Call(
+		fusekernel.OpOpen,
+		uint64(inode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:])
+
+	if err != nil {
+		return 0, err
+	}
+
+	if uintptr(len(out)) < unsafe.Sizeof(fusekernel.OpenOut{}) {
+		return 0, fmt.Errorf("Open reply too short: %d bytes", len(out))
+	}
+
+	openOut := (*fusekernel.OpenOut)(unsafe.Pointer(&out[0]))
+	return fuseops.HandleID(openOut.Fh), nil
+}
+
+// Read reads up to size bytes from the given offset of an open file. size
+// must be no larger than MaxReadSize.
+func (k *FakeKernel) Read(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset int64,
+	size int) ([]byte, error) {
+	if size > MaxReadSize {
+		return nil, fmt.Errorf("Read size %d exceeds the maximum", size)
+	}
+
+	in := fusekernel.ReadIn{
+		Fh:     uint64(handle),
+		Offset: uint64(offset),
+		Size:   uint32(size),
+	}
+
+	inBytes := (*[unsafe.Sizeof(fusekernel.ReadIn{})]byte)(unsafe.Pointer(&in))
+	return k.Call(
+		fusekernel.OpRead,
+		uint64(inode),
+		inBytes[:fusekernel.ReadInSize(k.protocol)])
+}
+
+// OpenDir opens the given directory for reading, returning the handle chosen
+// by the server.
+func (k *FakeKernel) OpenDir(inode fuseops.InodeID) (fuseops.HandleID, error) {
+	in := fusekernel.OpenIn{Flags: uint32(os.O_RDONLY)}
+
+	const inSize = unsafe.Sizeof(fusekernel.OpenIn{})
+	out, err := k.Call(
+		fusekernel.OpOpendir,
+		uint64(inode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:])
+
+	if err != nil {
+		return 0, err
+	}
+
+	if uintptr(len(out)) < unsafe.Sizeof(fusekernel.OpenOut{}) {
+		return 0, fmt.Errorf("Opendir reply too short: %d bytes", len(out))
+	}
+
+	openOut := (*fusekernel.OpenOut)(unsafe.Pointer(&out[0]))
+	return fuseops.HandleID(openOut.Fh), nil
+}
+
+// ReadDir reads up to size bytes of the listing of a directory from the given
+// offset, returning them in the format written by fuseutil.WriteDirent. size
+// must be no larger than MaxReadSize.
+func (k *FakeKernel) ReadDir(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset fuseops.DirOffset,
+	size int) ([]byte, error) {
+	return k.readDir(fusekernel.OpReaddir, inode, handle, offset, size)
+}
+
+// ReadDirPlus is like ReadDir, but sends READDIRPLUS, as the kernel does when
+// the file system is mounted with fuse.MountConfig.EnableReadDirPlus, so that
+// the entries are in the format written by fuseutil.WriteDirentPlus.
+func (k *FakeKernel) ReadDirPlus(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset fuseops.DirOffset,
+	size int) ([]byte, error) {
+	return k.readDir(fusekernel.OpReaddirplus, inode, handle, offset, size)
+}
+
+func (k *FakeKernel) readDir(
+	opcode uint32,
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset fuseops.DirOffset,
+	size int) ([]byte, error) {
+	if size > MaxReadSize {
+		return nil, fmt.Errorf("ReadDir size %d exceeds the maximum", size)
+	}
+
+	in := fusekernel.ReadIn{
+		Fh:     uint64(handle),
+		Offset: uint64(offset),
+		Size:   uint32(size),
+	}
+
+	inBytes := (*[unsafe.Sizeof(fusekernel.ReadIn{})]byte)(unsafe.Pointer(&in))
+	return k.Call(
+		opcode,
+		uint64(inode),
+		inBytes[:fusekernel.ReadInSize(k.protocol)])
+}
+
+// Write writes data at the given offset of an open file, returning the number
+// of bytes the server reports having written, which is less than len(data) for
+// a short write. data must be no larger than the largest write the kernel
+// sends in a single request.
+func (k *FakeKernel) Write(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset int64,
+	data []byte) (int, error) {
+	if len(data) > buffer.MaxWriteSize {
+		return 0, fmt.Errorf("Write size %d exceeds the maximum", len(data))
+	}
+
+	in := fusekernel.WriteIn{
+		Fh:     uint64(handle),
+		Offset: uint64(offset),
+		Size:   uint32(len(data)),
+	}
+
+	inSize := fusekernel.WriteInSize(k.protocol)
+	inBytes := (*[unsafe.Sizeof(fusekernel.WriteIn{})]byte)(unsafe.Pointer(&in))
+
+	body := make([]byte, 0, int(inSize)+len(data))
+	body = append(body, inBytes[:inSize]...)
+	body = append(body, data...)
+
+	out, err := k.Call(fusekernel.OpWrite, uint64(inode), body)
+	if err != nil {
+		return 0, err
+	}
+
+	if uintptr(len(out)) < unsafe.Sizeof(fusekernel.WriteOut{}) {
+		return 0, fmt.Errorf("Write reply too short: %d bytes", len(out))
+	}
+
+	writeOut := (*fusekernel.WriteOut)(unsafe.Pointer(&out[0]))
+	return int(writeOut.Size), nil
+}
+
+// Fsync syncs an open file, as for fsync(2).
+func (k *FakeKernel) Fsync(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID) error {
+	in := fusekernel.FsyncIn{Fh: uint64(handle)}
+
+	const inSize = unsafe.Sizeof(fusekernel.FsyncIn{})
+	_, err := k.Call(
+		fusekernel.OpFsync,
+		uint64(inode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:])
+
+	return err
+}
+
+// Flush flushes an open file, as for close(2).
+func (k *FakeKernel) Flush(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID) error {
+	in := fusekernel.FlushIn{Fh: uint64(handle)}
+
+	const inSize = unsafe.Sizeof(fusekernel.FlushIn{})
+	_, err := k.Call(
+		fusekernel.OpFlush,
+		uint64(inode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:])
+
+	return err
+}
+
+// Release releases a handle returned by Open.
+func (k *FakeKernel) Release(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID) error {
+	in := fusekernel.ReleaseIn{Fh: uint64(handle)}
+
+	const inSize = unsafe.Sizeof(fusekernel.ReleaseIn{})
+	_, err := k.Call(
+		fusekernel.OpRelease,
+		uint64(inode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:])
+
+	return err
+}
+
+// ReleaseDir releases a handle returned by OpenDir.
+func (k *FakeKernel) ReleaseDir(
+	inode fuseops.InodeID,
+	handle fuseops.HandleID) error {
+	in := fusekernel.ReleaseIn{Fh: uint64(handle)}
+
+	const inSize = unsafe.Sizeof(fusekernel.ReleaseIn{})
+	_, err := k.Call(
+		fusekernel.OpReleasedir,
+		uint64(inode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:])
+
+	return err
+}
+
+// Close hangs up the connection, as the kernel does on unmount, and waits for
+// the server to finish. It returns the result of joining the server.
+func (k *FakeKernel) Close() error {
+	// Shutting down our end for writing causes the server to read EOF, while
+	// leaving the descriptor valid for readLoop until the server has closed
+	// its end in turn.
+	if err := syscall.Shutdown(int(k.sock.Fd()), syscall.SHUT_WR); err != nil {
+		return fmt.Errorf("Shutdown: %v", err)
+	}
+
+	err := k.mfs.Join(context.Background())
+
+	// readLoop only exists if we finished init.
+	if k.protocol.Major != 0 {
+		<-k.readLoopDone
+	}
+
+	k.sock.Close()
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Write a single request to the server.
+func (k *FakeKernel) send(
+	opcode uint32,
+	unique uint64,
+	nodeID uint64,
+	in []byte) error {
+	const headerSize = unsafe.Sizeof(fusekernel.InHeader{})
+
+	msg := make([]byte, int(headerSize)+len(in))
+	h := (*fusekernel.InHeader)(unsafe.Pointer(&msg[0]))
+	h.Len = uint32(len(msg))
+	h.Opcode = opcode
+	h.Unique = unique
+	h.Nodeid = nodeID
+	h.Uid = uint32(os.Getuid())
+	h.Gid = uint32(os.Getgid())
+	h.Pid = uint32(os.Getpid())
+
+	copy(msg[headerSize:], in)
+
+	n, err := syscall.Write(int(k.sock.Fd()), msg)
+	if err != nil {
+		return fmt.Errorf("Write: %v", err)
+	}
+
+	if n != len(msg) {
+		return fmt.Errorf("Wrote %d bytes; expected %d", n, len(msg))
+	}
+
+	return nil
+}
+
+// The largest reply the server may send.
+const maxReplySize = buffer.OutMessageHeaderSize + MaxReadSize
+
+// Read a single reply or notification from the server into buf, which must be
+// at least maxReplySize bytes long.
+func (k *FakeKernel) receive(buf []byte) ([]byte, error) {
+	n, err := syscall.Read(int(k.sock.Fd()), buf)
+	if err != nil {
+		return nil, fmt.Errorf("Read: %v", err)
+	}
+
+	if n == 0 {
+		return nil, errors.New("EOF")
+	}
+
+	if n < buffer.OutMessageHeaderSize {
+		return nil, fmt.Errorf("Short reply: %d bytes", n)
+	}
+
+	return buf[:n], nil
+}
+
+// Deliver replies to the callers waiting for them until the server hangs up.
+func (k *FakeKernel) readLoop() {
+	defer close(k.readLoopDone)
+
+	buf := make([]byte, maxReplySize)
+	for {
+		reply, err := k.receive(buf)
+		if err != nil {
+			k.mu.Lock()
+			k.readErr = err
+			k.mu.Unlock()
+
+			return
+		}
+
+		h := (*fusekernel.OutHeader)(unsafe.Pointer(&reply[0]))
+
+		// Notifications have a zero request ID. Nobody is waiting for them.
+		if h.Unique == 0 {
+			continue
+		}
+
+		k.mu.Lock()
+		c, ok := k.waiting[h.Unique]
+		delete(k.waiting, h.Unique)
+		k.mu.Unlock()
+
+		if ok {
+			c <- append([]byte(nil), reply...)
+		}
+	}
+}
+
+// Check the header of a reply, returning its body or the error it carries.
+func parseReply(reply []byte) ([]byte, error) {
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&reply[0]))
+
+	if int(h.Len) != len(reply) {
+		return nil, fmt.Errorf(
+			"Header says %d bytes, but we read %d",
+			h.Len,
+			len(reply))
+	}
+
+	if h.Error != 0 {
+		return nil, syscall.Errno(-h.Error)
+	}
+
+	return reply[buffer.OutMessageHeaderSize:], nil
+}
@@ -0,0 +1,430 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// NewLatencyFileSystem wraps the supplied file system so that each method
+// (other than Destroy) waits for the given latency before calling through, as
+// a stand-in for a slow backend. If the op's context is cancelled while
+// waiting, the method returns the context's error instead.
+func NewLatencyFileSystem(
+	wrapped fuseutil.FileSystem,
+	latency time.Duration) fuseutil.FileSystem {
+	return NewVariableLatencyFileSystem(
+		wrapped,
+		func() time.Duration { return latency })
+}
+
+// NewVariableLatencyFileSystem is like NewLatencyFileSystem, but calls latency
+// for the time to wait before each method, so that a backend with a given
+// distribution of latencies can be simulated. latency may be called
+// concurrently.
+func NewVariableLatencyFileSystem(
+	wrapped fuseutil.FileSystem,
+	latency func() time.Duration) fuseutil.FileSystem {
+	return &latencyFileSystem{
+		wrapped: wrapped,
+		latency: latency,
+	}
+}
+
+type latencyFileSystem struct {
+	wrapped fuseutil.FileSystem
+	latency func() time.Duration
+}
+
+func (fs *latencyFileSystem) wait(ctx context.Context) error {
+	t := time.NewTimer(fs.latency())
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (fs *latencyFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.StatFS(ctx, op)
+}
+
+func (fs *latencyFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.LookUpInode(ctx, op)
+}
+
+func (fs *latencyFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.GetInodeAttributes(ctx, op)
+}
+
+func (fs *latencyFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.SetInodeAttributes(ctx, op)
+}
+
+func (fs *latencyFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.ForgetInode(ctx, op)
+}
+
+func (fs *latencyFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.MkDir(ctx, op)
+}
+
+func (fs *latencyFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.MkNode(ctx, op)
+}
+
+func (fs *latencyFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.CreateFile(ctx, op)
+}
+
+func (fs *latencyFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.CreateLink(ctx, op)
+}
+
+func (fs *latencyFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.CreateSymlink(ctx, op)
+}
+
+func (fs *latencyFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.Rename(ctx, op)
+}
+
+func (fs *latencyFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.RmDir(ctx, op)
+}
+
+func (fs *latencyFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.Unlink(ctx, op)
+}
+
+func (fs *latencyFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.OpenDir(ctx, op)
+}
+
+func (fs *latencyFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.ReadDir(ctx, op)
+}
+
+func (fs *latencyFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.ReleaseDirHandle(ctx, op)
+}
+
+func (fs *latencyFileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.SyncDir(ctx, op)
+}
+
+func (fs *latencyFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.OpenFile(ctx, op)
+}
+
+func (fs *latencyFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.ReadFile(ctx, op)
+}
+
+func (fs *latencyFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.WriteFile(ctx, op)
+}
+
+func (fs *latencyFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.SyncFile(ctx, op)
+}
+
+func (fs *latencyFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.FlushFile(ctx, op)
+}
+
+func (fs *latencyFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.ReleaseFileHandle(ctx, op)
+}
+
+func (fs *latencyFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.ReadSymlink(ctx, op)
+}
+
+func (fs *latencyFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.RemoveXattr(ctx, op)
+}
+
+func (fs *latencyFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.GetXattr(ctx, op)
+}
+
+func (fs *latencyFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.ListXattr(ctx, op)
+}
+
+func (fs *latencyFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.SetXattr(ctx, op)
+}
+
+func (fs *latencyFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.Fallocate(ctx, op)
+}
+
+func (fs *latencyFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.Lseek(ctx, op)
+}
+
+func (fs *latencyFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.CopyFileRange(ctx, op)
+}
+
+func (fs *latencyFileSystem) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.GetLock(ctx, op)
+}
+
+func (fs *latencyFileSystem) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.SetLock(ctx, op)
+}
+
+func (fs *latencyFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.Poll(ctx, op)
+}
+
+func (fs *latencyFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.Ioctl(ctx, op)
+}
+
+func (fs *latencyFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	if err := fs.wait(ctx); err != nil {
+		return err
+	}
+
+	return fs.wrapped.Access(ctx, op)
+}
+
+func (fs *latencyFileSystem) Destroy() {
+	fs.wrapped.Destroy()
+}
@@ -15,10 +15,14 @@
 package fusetesting
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"sort"
+	"syscall"
+	"unsafe"
 )
 
 type sortedEntries []os.FileInfo
@@ -71,3 +75,157 @@ func ReadDirPicky(dirname string) (entries []os.FileInfo, err error) {
 
 	return entries, nil
 }
+
+// A directory entry as returned by getdents(2).
+type rawDirent struct {
+	name  string
+	inode uint64
+	typ   uint8
+}
+
+// Read the raw entries of the directory with the given name using system
+// calls, which unlike os.File.Readdirnames don't hide "." and ".." or the
+// types the file system reported.
+func readRawDir(dirname string) (entries []rawDirent, err error) {
+	fd, err := syscall.Open(dirname, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	entries, err = readRawDirFd(fd)
+	if err != nil {
+		return nil, fmt.Errorf("ReadDirent: %v", err)
+	}
+
+	return entries, nil
+}
+
+// Like readRawDir, but for a directory that is already open, returning errors
+// from getdents(2) as they are.
+func readRawDirFd(fd int) (entries []rawDirent, err error) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n == 0 {
+			return entries, nil
+		}
+
+		for b := buf[:n]; len(b) > 0; {
+			d := (*syscall.Dirent)(unsafe.Pointer(&b[0]))
+			reclen := int(d.Reclen)
+			if reclen == 0 || reclen > len(b) {
+				return nil, errors.New("Malformed directory entry")
+			}
+
+			name := b[unsafe.Offsetof(d.Name):reclen]
+			if i := bytes.IndexByte(name, 0); i >= 0 {
+				name = name[:i]
+			}
+
+			entries = append(entries, rawDirent{
+				name:  string(name),
+				inode: uint64(d.Ino),
+				typ:   d.Type,
+			})
+
+			b = b[reclen:]
+		}
+	}
+}
+
+// CheckDotEntries checks that the listing of the directory with the given name
+// contains "." and "..", which the kernel relies on the file system to supply,
+// once each, referring to the directory itself and to its parent. If root is
+// set, the directory is the root of the file system, which is its own parent.
+func CheckDotEntries(dirname string, root bool) error {
+	entries, err := readRawDir(dirname)
+	if err != nil {
+		return err
+	}
+
+	inodes := make(map[string][]uint64)
+	for _, e := range entries {
+		inodes[e.name] = append(inodes[e.name], e.inode)
+	}
+
+	var self, parent syscall.Stat_t
+	if err := syscall.Stat(dirname, &self); err != nil {
+		return fmt.Errorf("Stat: %v", err)
+	}
+
+	parent = self
+	if !root {
+		if err := syscall.Stat(path.Join(dirname, ".."), &parent); err != nil {
+			return fmt.Errorf("Stat(..): %v", err)
+		}
+	}
+
+	for _, want := range []struct {
+		name  string
+		inode uint64
+	}{
+		{".", uint64(self.Ino)},
+		{"..", uint64(parent.Ino)},
+	} {
+		got := inodes[want.name]
+		if len(got) != 1 {
+			return fmt.Errorf("%q listed %d times", want.name, len(got))
+		}
+
+		if got[0] != want.inode {
+			return fmt.Errorf(
+				"%q has inode %d, want %d",
+				want.name,
+				got[0],
+				want.inode)
+		}
+	}
+
+	return nil
+}
+
+// CheckDirentTypes checks that the type listed for each child of the directory
+// with the given name, other than DT_UNKNOWN, agrees with the mode lstat(2)
+// gives for it. With unknownAllowed unset, DT_UNKNOWN is an error too, for file
+// systems that are expected to know the types of their children.
+func CheckDirentTypes(dirname string, unknownAllowed bool) error {
+	entries, err := readRawDir(dirname)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.name == "." || e.name == ".." {
+			continue
+		}
+
+		if e.typ == syscall.DT_UNKNOWN {
+			if !unknownAllowed {
+				return fmt.Errorf("%q listed with unknown type", e.name)
+			}
+
+			continue
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path.Join(dirname, e.name), &st); err != nil {
+			return fmt.Errorf("Lstat(%q): %v", e.name, err)
+		}
+
+		if want := uint8((st.Mode & syscall.S_IFMT) >> 12); e.typ != want {
+			return fmt.Errorf(
+				"%q listed with type %d, but lstat gives mode %#o",
+				e.name,
+				e.typ,
+				st.Mode)
+		}
+	}
+
+	return nil
+}
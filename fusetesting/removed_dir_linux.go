@@ -0,0 +1,106 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"fmt"
+	"path"
+	"syscall"
+)
+
+// CheckRemovedDirectory checks that the directory with the given name behaves
+// as it would on ext4 once removed while still open, as it may be as a
+// process's working directory. It opens the directory, calls remove to remove
+// it, and then checks that:
+//
+//   - listing it fails with ENOENT or gives only "." and "..";
+//   - its ".." still refers to the directory's former parent;
+//   - looking up names in it fails with ENOENT;
+//   - creating files or directories in it fails with ENOENT.
+//
+// The kernel takes care of all this itself for a directory removed through the
+// same mount, without consulting the file system. To check the file system's
+// own behavior, remove the directory through another mount of the same file
+// system.
+func CheckRemovedDirectory(
+	dirname string,
+	remove func() error) error {
+	fd, err := syscall.Open(dirname, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return fmt.Errorf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	var parent syscall.Stat_t
+	if err := syscall.Stat(path.Join(dirname, ".."), &parent); err != nil {
+		return fmt.Errorf("Stat(..): %v", err)
+	}
+
+	if err := remove(); err != nil {
+		return fmt.Errorf("remove: %v", err)
+	}
+
+	entries, err := readRawDirFd(fd)
+	switch {
+	case err == syscall.ENOENT:
+
+	case err != nil:
+		return fmt.Errorf("ReadDirent: %v", err)
+
+	default:
+		for _, e := range entries {
+			if e.name != "." && e.name != ".." {
+				return fmt.Errorf("Removed directory lists %q", e.name)
+			}
+		}
+	}
+
+	// Resolve names relative to the open directory, as relative paths would be
+	// for a process whose working directory it is. (Not with path.Join, which
+	// would clean away the "..".)
+	self := fmt.Sprintf("/proc/self/fd/%d", fd)
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(self+"/..", &st); err != nil {
+		return fmt.Errorf("Stat(..) after removal: %v", err)
+	}
+
+	if st.Ino != parent.Ino {
+		return fmt.Errorf(
+			"\"..\" has inode %d after removal, want %d",
+			st.Ino,
+			parent.Ino)
+	}
+
+	if err := syscall.Lstat(self+"/foo", &st); err != syscall.ENOENT {
+		return fmt.Errorf("Lstat(foo): got %v, want ENOENT", err)
+	}
+
+	f, err := syscall.Openat(fd, "foo", syscall.O_WRONLY|syscall.O_CREAT, 0644)
+	if err == nil {
+		syscall.Close(f)
+	}
+
+	if err != syscall.ENOENT {
+		return fmt.Errorf("Create: got %v, want ENOENT", err)
+	}
+
+	if err := syscall.Mkdirat(fd, "bar", 0755); err != syscall.ENOENT {
+		return fmt.Errorf("Mkdir: got %v, want ENOENT", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,612 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Points (see fuseutil.Point) reached by every op that a Scheduler admits.
+const (
+	// Reached on admission, before the op is passed to the wrapped file
+	// system. An op held here is not admitted.
+	PointStart = "start"
+
+	// Reached when the wrapped file system returns, before the reply is sent.
+	PointDone = "done"
+)
+
+// An OpFilter selects the ops to which a Scheduler.Hold applies.
+type OpFilter func(op interface{}) bool
+
+// OpsOfType returns a filter that selects ops of the same type as example,
+// e.g. OpsOfType(&fuseops.ForgetInodeOp{}).
+func OpsOfType(example interface{}) OpFilter {
+	t := reflect.TypeOf(example)
+	return func(op interface{}) bool {
+		return reflect.TypeOf(op) == t
+	}
+}
+
+// A Scheduler controls the order in which ops reach a file system, so that
+// tests of concurrent behavior are reproducible. Use Wrap to put a file
+// system under its control.
+//
+// Ops are admitted to the file system one at a time: once an op has been
+// admitted, the next is admitted only when the first reaches a point, meaning
+// it returns (PointDone) or calls fuseutil.Point. When several ops are waiting
+// to be admitted, the next is chosen pseudo-randomly using the seed. So that
+// the choice doesn't depend on the order in which concurrently issued ops
+// happened to arrive, use Expect to wait for all of them first. Ops of the
+// same type are then told apart only by arrival order.
+//
+// Hold forces a particular interleaving, pausing ops at one point until
+// another op reaches another point.
+//
+// fuseutil's server calls ForgetInode inline, so that pausing a forget would
+// stop other ops from being read. Forgets are therefore admitted as soon as
+// they arrive, though holds still apply to them.
+type Scheduler struct {
+	mu sync.Mutex
+
+	// Broadcast whenever an op is admitted or a hold released.
+	cond sync.Cond
+
+	// GUARDED_BY(mu)
+	rand *rand.Rand
+
+	// The number of waiting ops required before admitting any. See Expect.
+	//
+	// GUARDED_BY(mu)
+	expect int
+
+	// Ops that have arrived but not been admitted, in arrival order.
+	//
+	// GUARDED_BY(mu)
+	waiting []*scheduledOp
+
+	// The most recently admitted op, if it hasn't yet reached a point.
+	//
+	// GUARDED_BY(mu)
+	running *scheduledOp
+
+	// The number of ops that have arrived.
+	//
+	// GUARDED_BY(mu)
+	arrivals uint64
+
+	// GUARDED_BY(mu)
+	holds []*hold
+}
+
+type scheduledOp struct {
+	op interface{}
+
+	// The value of Scheduler.arrivals when the op arrived.
+	seq uint64
+
+	admitted bool // GUARDED_BY(Scheduler.mu)
+}
+
+type hold struct {
+	op         OpFilter
+	point      string
+	until      OpFilter
+	untilPoint string
+
+	released bool // GUARDED_BY(Scheduler.mu)
+}
+
+// NewScheduler creates a scheduler whose choices are determined by seed.
+func NewScheduler(seed int64) *Scheduler {
+	s := &Scheduler{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+
+	s.cond.L = &s.mu
+	return s
+}
+
+// Expect defers admitting any more ops until n are waiting.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Scheduler) Expect(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expect = n
+	s.schedule()
+}
+
+// Hold pauses each op selected by op when it reaches point, until an op
+// selected by until reaches untilPoint. Only ops reaching untilPoint after the
+// call count.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Scheduler) Hold(
+	op OpFilter,
+	point string,
+	until OpFilter,
+	untilPoint string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.holds = append(s.holds, &hold{
+		op:         op,
+		point:      point,
+		until:      until,
+		untilPoint: untilPoint,
+	})
+}
+
+// Wrap returns a file system that passes ops to fs under the control of the
+// scheduler.
+func (s *Scheduler) Wrap(fs fuseutil.FileSystem) fuseutil.FileSystem {
+	return &scheduledFileSystem{
+		s:       s,
+		wrapped: fs,
+	}
+}
+
+// Return whether o must wait at the given point.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *Scheduler) held(o *scheduledOp, point string) bool {
+	for _, h := range s.holds {
+		if !h.released && h.point == point && h.op(o.op) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Release any holds waiting for o to reach the given point.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *Scheduler) releaseHolds(o *scheduledOp, point string) {
+	for _, h := range s.holds {
+		if !h.released && h.untilPoint == point && h.until(o.op) {
+			h.released = true
+		}
+	}
+
+	s.cond.Broadcast()
+}
+
+// Record that o has reached the given point after its admission, letting the
+// next op be admitted.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *Scheduler) reached(o *scheduledOp, point string) {
+	if s.running == o {
+		s.running = nil
+	}
+
+	s.releaseHolds(o, point)
+	s.schedule()
+}
+
+// Admit the next op, if it's time.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *Scheduler) schedule() {
+	for s.running == nil && len(s.waiting) > 0 && len(s.waiting) >= s.expect {
+		var eligible []*scheduledOp
+		for _, o := range s.waiting {
+			if !s.held(o, PointStart) {
+				eligible = append(eligible, o)
+			}
+		}
+
+		if len(eligible) == 0 {
+			return
+		}
+
+		sort.Slice(eligible, func(i, j int) bool {
+			ti := reflect.TypeOf(eligible[i].op).String()
+			tj := reflect.TypeOf(eligible[j].op).String()
+			if ti != tj {
+				return ti < tj
+			}
+
+			return eligible[i].seq < eligible[j].seq
+		})
+
+		o := eligible[s.rand.Intn(len(eligible))]
+		for i, w := range s.waiting {
+			if w == o {
+				s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+				break
+			}
+		}
+
+		s.expect = 0
+		o.admitted = true
+		s.running = o
+		s.releaseHolds(o, PointStart)
+	}
+}
+
+// Wait for o to be admitted.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Scheduler) admit(o *scheduledOp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o.seq = s.arrivals
+	s.arrivals++
+
+	if _, ok := o.op.(*fuseops.ForgetInodeOp); ok {
+		for s.held(o, PointStart) {
+			s.cond.Wait()
+		}
+
+		o.admitted = true
+		s.releaseHolds(o, PointStart)
+		return
+	}
+
+	s.waiting = append(s.waiting, o)
+	s.schedule()
+
+	for !o.admitted {
+		s.cond.Wait()
+	}
+}
+
+// Record that o has reached the given point, then wait until it's no longer
+// held there.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Scheduler) point(o *scheduledOp, point string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reached(o, point)
+	for s.held(o, point) {
+		s.cond.Wait()
+	}
+}
+
+// Pass the op to f once admitted, with a context that reports points to the
+// scheduler.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *Scheduler) run(
+	ctx context.Context,
+	op interface{},
+	f func(context.Context) error) error {
+	o := &scheduledOp{op: op}
+	s.admit(o)
+
+	ctx = fuseutil.WithPointHook(ctx, func(name string) {
+		s.point(o, name)
+	})
+
+	err := f(ctx)
+	s.point(o, PointDone)
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// scheduledFileSystem
+////////////////////////////////////////////////////////////////////////
+
+type scheduledFileSystem struct {
+	s       *Scheduler
+	wrapped fuseutil.FileSystem
+}
+
+func (fs *scheduledFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.StatFS(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.LookUpInode(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.GetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.SetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ForgetInode(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.MkDir(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.MkNode(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.CreateFile(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.CreateLink(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.CreateSymlink(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Rename(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.RmDir(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Unlink(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.OpenDir(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReadDir(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReleaseDirHandle(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.SyncDir(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.OpenFile(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReadFile(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.WriteFile(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.SyncFile(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.FlushFile(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReleaseFileHandle(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ReadSymlink(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.RemoveXattr(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.GetXattr(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.ListXattr(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.SetXattr(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Fallocate(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Lseek(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.CopyFileRange(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.GetLock(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.SetLock(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Poll(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Ioctl(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	return fs.s.run(ctx, op, func(ctx context.Context) error {
+		return fs.wrapped.Access(ctx, op)
+	})
+}
+
+func (fs *scheduledFileSystem) Destroy() {
+	fs.wrapped.Destroy()
+}
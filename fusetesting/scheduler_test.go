@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system that records the order in which it receives ops.
+type orderFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu    sync.Mutex
+	order []string // GUARDED_BY(mu)
+}
+
+func (fs *orderFS) record(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.order = append(fs.order, name)
+}
+
+func (fs *orderFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fs.record("StatFS")
+	return nil
+}
+
+func (fs *orderFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.record("LookUpInode")
+	return fuse.ENOENT
+}
+
+func (fs *orderFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.record("GetInodeAttributes")
+	return nil
+}
+
+func (fs *orderFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.record("OpenFile")
+	return nil
+}
+
+// Issue one op of each type orderFS supports concurrently, returning the
+// order in which the file system received them.
+func orderWithSeed(t *testing.T, seed int64) string {
+	s := fusetesting.NewScheduler(seed)
+	fs := &orderFS{}
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(s.Wrap(fs)),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	calls := []func(){
+		func() { k.Call(fusekernel.OpStatfs, 1, nil) },
+		func() { k.LookUp(fuseops.RootInodeID, "foo") },
+		func() { k.GetAttr(fuseops.RootInodeID) },
+		func() { k.Open(fuseops.RootInodeID + 1) },
+	}
+
+	s.Expect(len(calls))
+
+	var wg sync.WaitGroup
+	for _, f := range calls {
+		wg.Add(1)
+		go func(f func()) {
+			defer wg.Done()
+			f()
+		}(f)
+	}
+
+	wg.Wait()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return strings.Join(fs.order, ", ")
+}
+
+func TestScheduler_Deterministic(t *testing.T) {
+	orders := make(map[string]bool)
+	for seed := int64(0); seed < 10; seed++ {
+		order := orderWithSeed(t, seed)
+		orders[order] = true
+
+		// The same seed should always give the same order, however the ops
+		// happened to arrive.
+		for i := 0; i < 5; i++ {
+			if o := orderWithSeed(t, seed); o != order {
+				t.Fatalf("Seed %d: got order %q, then %q", seed, order, o)
+			}
+		}
+	}
+
+	// Different seeds should explore different orders.
+	if len(orders) < 2 {
+		t.Errorf("Only saw orders: %v", orders)
+	}
+}
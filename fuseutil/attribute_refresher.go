@@ -0,0 +1,310 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// RefreshedAttributes is the result of refreshing the attributes for a single
+// inode: the new attributes and the time until which the kernel may cache
+// them.
+type RefreshedAttributes struct {
+	Attributes fuseops.InodeAttributes
+	Expiration time.Time
+}
+
+// A function that fetches fresh attributes for a batch of inodes, typically
+// using a single bulk call to the file system's backend. Inodes missing from
+// the result are left alone and will be offered again on a later refresh.
+type RefreshFunc func(
+	ctx context.Context,
+	inodes []fuseops.InodeID) (map[fuseops.InodeID]RefreshedAttributes, error)
+
+// AttributeRefresherConfig contains the parameters for NewAttributeRefresher.
+type AttributeRefresherConfig struct {
+	// The clock used to decide when attributes are about to expire. If nil,
+	// timeutil.RealClock() is used. It doesn't pace Run, which waits in real
+	// time.
+	Clock timeutil.Clock
+
+	// How long before an inode's attributes expire that they become eligible
+	// for refreshing.
+	Lead time.Duration
+
+	// The maximum number of inodes to pass to a single call to Refresh. Zero
+	// means no limit.
+	BatchSize int
+
+	// The maximum number of calls to Refresh that may be in flight at once.
+	// Zero is treated as one.
+	MaxConcurrency int
+
+	// The function used to fetch fresh attributes. Must be non-nil.
+	Refresh RefreshFunc
+}
+
+// AttributeRefresher proactively refreshes inode attributes shortly before
+// the expiration time the file system handed to the kernel, so that the first
+// stat(2) after the kernel's cache expires need not wait for the backend.
+//
+// Usage: call Record whenever the file system returns attributes to the
+// kernel (LookUpInode, GetInodeAttributes, etc.), consult Attributes when
+// answering GetInodeAttributes, and call Forget when an inode's lookup count
+// drops to zero so that dead inodes aren't refreshed forever. Refreshing
+// happens in RefreshDue, which may be driven by Run or called directly (e.g.
+// by a test using a simulated clock).
+type AttributeRefresher struct {
+	clock          timeutil.Clock
+	lead           time.Duration
+	batchSize      int
+	maxConcurrency int
+	refresh        RefreshFunc
+
+	mu sync.Mutex
+
+	// The inodes we are tracking. Records are never mutated in place for the
+	// attribute fields; a refresh result is applied only if the record it was
+	// started for is still the one in the map.
+	//
+	// GUARDED_BY(mu)
+	entries map[fuseops.InodeID]*refreshRecord
+}
+
+type refreshRecord struct {
+	attrs      fuseops.InodeAttributes
+	expiration time.Time
+
+	// Set while a call to Refresh covering this record is in flight.
+	inFlight bool
+}
+
+// NewAttributeRefresher creates an AttributeRefresher that tracks no inodes.
+func NewAttributeRefresher(cfg AttributeRefresherConfig) *AttributeRefresher {
+	r := &AttributeRefresher{
+		clock:          cfg.Clock,
+		lead:           cfg.Lead,
+		batchSize:      cfg.BatchSize,
+		maxConcurrency: cfg.MaxConcurrency,
+		refresh:        cfg.Refresh,
+		entries:        make(map[fuseops.InodeID]*refreshRecord),
+	}
+
+	if r.clock == nil {
+		r.clock = timeutil.RealClock()
+	}
+
+	if r.maxConcurrency <= 0 {
+		r.maxConcurrency = 1
+	}
+
+	return r
+}
+
+// Record notes the attributes and expiration time most recently returned to
+// the kernel for the given inode.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *AttributeRefresher) Record(
+	inode fuseops.InodeID,
+	attrs fuseops.InodeAttributes,
+	expiration time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.entries[inode] = &refreshRecord{
+		attrs:      attrs,
+		expiration: expiration,
+	}
+}
+
+// Attributes returns the most recent attributes recorded or refreshed for the
+// inode, provided they have not yet expired.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *AttributeRefresher) Attributes(
+	inode fuseops.InodeID) (
+	attrs fuseops.InodeAttributes,
+	expiration time.Time,
+	ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, present := r.entries[inode]
+	if !present || !r.clock.Now().Before(rec.expiration) {
+		return
+	}
+
+	return rec.attrs, rec.expiration, true
+}
+
+// Forget stops tracking the inode. Call this when the kernel has forgotten
+// the inode (i.e. its lookup count has dropped to zero). A refresh already in
+// flight for the inode will have its result discarded.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *AttributeRefresher) Forget(inode fuseops.InodeID) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.entries, inode)
+}
+
+// RefreshDue calls the Refresh function for every tracked inode whose
+// attributes expire within the configured lead time of the clock's current
+// time, soonest expiring first, and waits for the calls to complete. It
+// returns the first error returned by Refresh, if any.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *AttributeRefresher) RefreshDue(ctx context.Context) error {
+	batches := r.claimDue()
+	if len(batches) == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var firstErr error
+
+	sem := make(chan struct{}, r.maxConcurrency)
+	for _, batch := range batches {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(batch []claimedRecord) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := r.refreshBatch(ctx, batch); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}(batch)
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// Run calls RefreshDue every interval of real time, whatever the configured
+// Clock, until the context is cancelled. Errors are passed to the supplied
+// function if it is non-nil. Code that wants to decide when refreshes happen,
+// such as a test with a simulated clock, should call RefreshDue itself.
+func (r *AttributeRefresher) Run(
+	ctx context.Context,
+	interval time.Duration,
+	reportError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-ticker.C:
+			if err := r.RefreshDue(ctx); err != nil && reportError != nil {
+				reportError(err)
+			}
+		}
+	}
+}
+
+type claimedRecord struct {
+	inode fuseops.InodeID
+	rec   *refreshRecord
+}
+
+// Find the records that are due for a refresh, mark them as in flight, and
+// split them into batches.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *AttributeRefresher) claimDue() [][]claimedRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deadline := r.clock.Now().Add(r.lead)
+
+	var due []claimedRecord
+	for inode, rec := range r.entries {
+		if rec.inFlight || rec.expiration.After(deadline) {
+			continue
+		}
+
+		rec.inFlight = true
+		due = append(due, claimedRecord{inode, rec})
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		a, b := due[i].rec.expiration, due[j].rec.expiration
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+
+		return due[i].inode < due[j].inode
+	})
+
+	var batches [][]claimedRecord
+	for len(due) > 0 {
+		n := len(due)
+		if r.batchSize > 0 && n > r.batchSize {
+			n = r.batchSize
+		}
+
+		batches = append(batches, due[:n])
+		due = due[n:]
+	}
+
+	return batches
+}
+
+// LOCKS_EXCLUDED(r.mu)
+func (r *AttributeRefresher) refreshBatch(
+	ctx context.Context,
+	batch []claimedRecord) error {
+	inodes := make([]fuseops.InodeID, len(batch))
+	for i, c := range batch {
+		inodes[i] = c.inode
+	}
+
+	results, err := r.refresh(ctx, inodes)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range batch {
+		c.rec.inFlight = false
+
+		// Discard the result if the inode was forgotten or re-recorded while we
+		// were refreshing it.
+		if r.entries[c.inode] != c.rec {
+			continue
+		}
+
+		if res, ok := results[c.inode]; ok {
+			r.entries[c.inode] = &refreshRecord{
+				attrs:      res.Attributes,
+				expiration: res.Expiration,
+			}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// A RefreshFunc that records the batches it is called with and returns
+// attributes whose size is the inode ID plus 100.
+type fakeRefresher struct {
+	clock *timeutil.SimulatedClock
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	batches [][]fuseops.InodeID
+}
+
+func (f *fakeRefresher) Refresh(
+	ctx context.Context,
+	inodes []fuseops.InodeID) (map[fuseops.InodeID]RefreshedAttributes, error) {
+	f.mu.Lock()
+	f.batches = append(f.batches, inodes)
+	f.mu.Unlock()
+
+	m := make(map[fuseops.InodeID]RefreshedAttributes)
+	for _, inode := range inodes {
+		m[inode] = RefreshedAttributes{
+			Attributes: fuseops.InodeAttributes{Size: uint64(inode) + 100},
+			Expiration: f.clock.Now().Add(f.ttl),
+		}
+	}
+
+	return m, nil
+}
+
+func (f *fakeRefresher) takeBatches() [][]fuseops.InodeID {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	b := f.batches
+	f.batches = nil
+	return b
+}
+
+func TestAttributeRefresher(t *testing.T) {
+	ctx := context.Background()
+
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+	start := clock.Now()
+
+	f := &fakeRefresher{clock: &clock, ttl: time.Minute}
+	r := NewAttributeRefresher(AttributeRefresherConfig{
+		Clock:     &clock,
+		Lead:      5 * time.Second,
+		BatchSize: 2,
+		Refresh:   f.Refresh,
+	})
+
+	r.Record(1, fuseops.InodeAttributes{Size: 1}, start.Add(10*time.Second))
+	r.Record(2, fuseops.InodeAttributes{Size: 2}, start.Add(20*time.Second))
+	r.Record(3, fuseops.InodeAttributes{Size: 3}, start.Add(12*time.Second))
+	r.Record(4, fuseops.InodeAttributes{Size: 4}, start.Add(11*time.Second))
+
+	// Nothing is due yet.
+	clock.AdvanceTime(4 * time.Second)
+	if err := r.RefreshDue(ctx); err != nil {
+		t.Fatalf("RefreshDue: %v", err)
+	}
+
+	if b := f.takeBatches(); len(b) != 0 {
+		t.Fatalf("Unexpected refreshes: %v", b)
+	}
+
+	// Inodes 1, 3 and 4 are within the lead time of expiring. They should be
+	// refreshed soonest first, in batches of two.
+	clock.AdvanceTime(3 * time.Second)
+	if err := r.RefreshDue(ctx); err != nil {
+		t.Fatalf("RefreshDue: %v", err)
+	}
+
+	expected := [][]fuseops.InodeID{{1, 4}, {3}}
+	if b := f.takeBatches(); !reflect.DeepEqual(b, expected) {
+		t.Fatalf("Batches: got %v, want %v", b, expected)
+	}
+
+	attrs, expiration, ok := r.Attributes(4)
+	if !ok {
+		t.Fatalf("No attributes for inode 4")
+	}
+
+	if attrs.Size != 104 {
+		t.Errorf("Size: got %d, want 104", attrs.Size)
+	}
+
+	if want := clock.Now().Add(time.Minute); !expiration.Equal(want) {
+		t.Errorf("Expiration: got %v, want %v", expiration, want)
+	}
+
+	// Inode 2 hasn't been refreshed, and expires once its time is up.
+	if attrs, _, _ := r.Attributes(2); attrs.Size != 2 {
+		t.Errorf("Size: got %d, want 2", attrs.Size)
+	}
+
+	clock.AdvanceTime(13 * time.Second)
+	if _, _, ok := r.Attributes(2); ok {
+		t.Errorf("Inode 2 attributes should have expired")
+	}
+
+	// Forgotten inodes are never refreshed.
+	r.Forget(2)
+	if err := r.RefreshDue(ctx); err != nil {
+		t.Fatalf("RefreshDue: %v", err)
+	}
+
+	if b := f.takeBatches(); len(b) != 0 {
+		t.Fatalf("Unexpected refreshes: %v", b)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system whose root contains "a", "b" and "c", counting their lookups
+// and panicking if any is forgotten more often than it was looked up.
+type forgetCountFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	counts  map[fuseops.InodeID]uint64 // GUARDED_BY(mu)
+	forgets []fuseops.ForgetInodeOp    // GUARDED_BY(mu)
+}
+
+var forgetCountChildren = map[string]fuseops.InodeID{
+	"a": fuseops.RootInodeID + 1,
+	"b": fuseops.RootInodeID + 2,
+	"c": fuseops.RootInodeID + 3,
+}
+
+func (fs *forgetCountFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	child, ok := forgetCountChildren[op.Name]
+	if op.Parent != fuseops.RootInodeID || !ok {
+		return fuse.ENOENT
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.counts[child]++
+	op.Entry.Child = child
+	op.Entry.Attributes.Nlink = 1
+	return nil
+}
+
+func (fs *forgetCountFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.counts[op.Inode] < op.N {
+		panic(fmt.Sprintf(
+			"Forgetting %d lookups of inode %d, which has %d",
+			op.N,
+			op.Inode,
+			fs.counts[op.Inode]))
+	}
+
+	fs.counts[op.Inode] -= op.N
+	fs.forgets = append(fs.forgets, *op)
+	return nil
+}
+
+func TestBatchForget(t *testing.T) {
+	fs := &forgetCountFS{counts: make(map[fuseops.InodeID]uint64)}
+	k, err := fusetesting.NewFakeKernel(fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{})
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	for _, name := range []string{"a", "a", "a", "b", "b", "c"} {
+		if _, err := k.LookUp(fuseops.RootInodeID, name); err != nil {
+			t.Fatalf("LookUp(%q): %v", name, err)
+		}
+	}
+
+	a, b, c := forgetCountChildren["a"], forgetCountChildren["b"], forgetCountChildren["c"]
+	batch := []fuseops.ForgetInodeOp{{Inode: a, N: 2}, {Inode: b, N: 2}, {Inode: a, N: 1}}
+	if err := k.BatchForget(batch); err != nil {
+		t.Fatalf("BatchForget: %v", err)
+	}
+
+	if err := k.Forget(c, 1); err != nil {
+		t.Fatalf("Forget: %v", err)
+	}
+
+	// Forgets have no reply, but are handled before the next op is read, so
+	// they are done once a later lookup is.
+	if _, err := k.LookUp(fuseops.RootInodeID, "missing"); err != fuse.ENOENT {
+		t.Fatalf("LookUp(missing): got %v, want ENOENT", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// The batch was expanded in order, and the single forget followed it.
+	want := append(batch, fuseops.ForgetInodeOp{Inode: c, N: 1})
+	if !reflect.DeepEqual(fs.forgets, want) {
+		t.Errorf("Got forgets %v, want %v", fs.forgets, want)
+	}
+
+	for name, inode := range forgetCountChildren {
+		if n := fs.counts[inode]; n != 0 {
+			t.Errorf("%q has %d lookups left, want 0", name, n)
+		}
+	}
+}
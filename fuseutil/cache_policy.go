@@ -0,0 +1,476 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// CachePolicy decides how long the kernel may cache the attributes and
+// directory entries a file system returns, for file systems that would rather
+// leave that to operators than hardcode it. See CachePolicyFileSystem.
+//
+// op is the op returning the inode, e.g. a *fuseops.LookUpInodeOp, which a
+// policy may use to tell lookups from getattrs or to learn the name the inode
+// was found by. Methods may be called concurrently.
+type CachePolicy interface {
+	// Return how long the kernel may cache the supplied attributes of inode.
+	AttributesTTL(
+		op interface{},
+		inode fuseops.InodeID,
+		attrs *fuseops.InodeAttributes) time.Duration
+
+	// Return how long the kernel may cache the name by which op found inode,
+	// whose attributes are attrs. It is called only for ops that return a
+	// ChildInodeEntry, after AttributesTTL for the same op.
+	EntryTTL(
+		op interface{},
+		inode fuseops.InodeID,
+		attrs *fuseops.InodeAttributes) time.Duration
+}
+
+// CachePolicyFileSystem wraps a FileSystem, filling in the expirations it
+// leaves unset from a CachePolicy that may be swapped at any time, e.g. to
+// lengthen TTLs during an incident or drop them to zero while debugging
+// staleness. An expiration counts as unset if both its absolute time and its
+// duration are zero (e.g. ChildInodeEntry.EntryExpiration and EntryValidFor);
+// those the file system sets are passed on as they are. The expirations
+// written by WriteDirentPlus are not affected.
+//
+// Changing the policy affects only replies made after the change. Whatever
+// the kernel has already cached stays cached for as long as it was told, so
+// shortening TTLs to see changes sooner may need to be paired with
+// invalidations (see fuse.MountedFileSystem.InvalidateInode).
+type CachePolicyFileSystem struct {
+	FileSystem
+
+	// Holds a cachePolicyBox.
+	policy atomic.Value
+}
+
+// atomic.Value requires every value stored to have the same concrete type.
+type cachePolicyBox struct {
+	p CachePolicy
+}
+
+// NewCachePolicyFileSystem wraps fs, initially using policy.
+func NewCachePolicyFileSystem(
+	fs FileSystem,
+	policy CachePolicy) *CachePolicyFileSystem {
+	cfs := &CachePolicyFileSystem{FileSystem: fs}
+	cfs.SetPolicy(policy)
+	return cfs
+}
+
+// SetPolicy replaces the policy consulted for replies from now on. It is safe
+// to call concurrently with ops.
+func (fs *CachePolicyFileSystem) SetPolicy(policy CachePolicy) {
+	fs.policy.Store(cachePolicyBox{policy})
+}
+
+// Policy returns the policy currently in use.
+func (fs *CachePolicyFileSystem) Policy() CachePolicy {
+	return fs.policy.Load().(cachePolicyBox).p
+}
+
+// Fill in the attribute expiration for inode if it is unset.
+func (fs *CachePolicyFileSystem) fillAttributes(
+	op interface{},
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes,
+	expiration *time.Time,
+	validFor *time.Duration) {
+	if expiration.IsZero() && *validFor == 0 {
+		*validFor = fs.Policy().AttributesTTL(op, inode, attrs)
+	}
+}
+
+// Fill in the unset expirations in e, returned by op, with a single policy.
+func (fs *CachePolicyFileSystem) fillEntry(
+	op interface{},
+	e *fuseops.ChildInodeEntry) {
+	p := fs.Policy()
+	if e.AttributesExpiration.IsZero() && e.AttributesValidFor == 0 {
+		e.AttributesValidFor = p.AttributesTTL(op, e.Child, &e.Attributes)
+	}
+
+	if e.EntryExpiration.IsZero() && e.EntryValidFor == 0 {
+		e.EntryValidFor = p.EntryTTL(op, e.Child, &e.Attributes)
+	}
+}
+
+func (fs *CachePolicyFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.FileSystem.LookUpInode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.fillEntry(op, &op.Entry)
+	return nil
+}
+
+func (fs *CachePolicyFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.FileSystem.GetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.fillAttributes(
+		op,
+		op.Inode,
+		&op.Attributes,
+		&op.AttributesExpiration,
+		&op.AttributesValidFor)
+
+	return nil
+}
+
+func (fs *CachePolicyFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.FileSystem.SetInodeAttributes(ctx, op); err != nil {
+		return err
+	}
+
+	fs.fillAttributes(
+		op,
+		op.Inode,
+		&op.Attributes,
+		&op.AttributesExpiration,
+		&op.AttributesValidFor)
+
+	return nil
+}
+
+func (fs *CachePolicyFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := fs.FileSystem.MkDir(ctx, op); err != nil {
+		return err
+	}
+
+	fs.fillEntry(op, &op.Entry)
+	return nil
+}
+
+func (fs *CachePolicyFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := fs.FileSystem.MkNode(ctx, op); err != nil {
+		return err
+	}
+
+	fs.fillEntry(op, &op.Entry)
+	return nil
+}
+
+func (fs *CachePolicyFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.FileSystem.CreateFile(ctx, op); err != nil {
+		return err
+	}
+
+	fs.fillEntry(op, &op.Entry)
+	return nil
+}
+
+func (fs *CachePolicyFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := fs.FileSystem.CreateSymlink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.fillEntry(op, &op.Entry)
+	return nil
+}
+
+func (fs *CachePolicyFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := fs.FileSystem.CreateLink(ctx, op); err != nil {
+		return err
+	}
+
+	fs.fillEntry(op, &op.Entry)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Static policy
+////////////////////////////////////////////////////////////////////////
+
+// StaticCachePolicy is a CachePolicy that gives the same TTLs to everything.
+// The zero value caches nothing.
+type StaticCachePolicy struct {
+	Attributes time.Duration
+	Entries    time.Duration
+}
+
+func (p StaticCachePolicy) AttributesTTL(
+	op interface{},
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes) time.Duration {
+	return p.Attributes
+}
+
+func (p StaticCachePolicy) EntryTTL(
+	op interface{},
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes) time.Duration {
+	return p.Entries
+}
+
+////////////////////////////////////////////////////////////////////////
+// Prefix policy
+////////////////////////////////////////////////////////////////////////
+
+// PrefixCachePolicy is a CachePolicy that delegates to a different policy for
+// each directory subtree, so that e.g. a rarely-changing "archive" directory
+// can be cached for longer than the rest of the file system.
+type PrefixCachePolicy struct {
+	// Return the slash-separated path of the supplied inode relative to the
+	// root of the file system, e.g. "dir/bar", or false if it is not known.
+	// If the inode has several, any will do. Must be non-nil.
+	//
+	// For ops that find an inode by name, such as LookUpInodeOp, the path used
+	// is instead that of the parent joined with the name, so that Path needn't
+	// know of inodes until the file system has returned them.
+	Path func(fuseops.InodeID) (string, bool)
+
+	// The policy for each subtree, keyed by the path of its root (e.g.
+	// "archive" or "data/static"). A prefix matches whole path components
+	// only, and the longest matching prefix wins.
+	Prefixes map[string]CachePolicy
+
+	// The policy for inodes matching no prefix or whose path isn't known.
+	// Must be non-nil.
+	Default CachePolicy
+}
+
+// Return the policy for the inode returned by op.
+func (p *PrefixCachePolicy) policyFor(
+	op interface{},
+	inode fuseops.InodeID) CachePolicy {
+	var parent fuseops.InodeID
+	var name string
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		parent, name = o.Parent, o.Name
+	case *fuseops.MkDirOp:
+		parent, name = o.Parent, o.Name
+	case *fuseops.MkNodeOp:
+		parent, name = o.Parent, o.Name
+	case *fuseops.CreateFileOp:
+		parent, name = o.Parent, o.Name
+	case *fuseops.CreateSymlinkOp:
+		parent, name = o.Parent, o.Name
+	case *fuseops.CreateLinkOp:
+		parent, name = o.Parent, o.Name
+	}
+
+	var rel string
+	var ok bool
+	if name != "" {
+		rel, ok = p.Path(parent)
+		rel = path.Join(rel, name)
+	} else {
+		rel, ok = p.Path(inode)
+	}
+
+	if !ok {
+		return p.Default
+	}
+
+	// Try the path, then each of its ancestors.
+	rel = strings.Trim(path.Clean("/"+rel), "/")
+	for {
+		if policy, ok := p.Prefixes[rel]; ok {
+			return policy
+		}
+
+		if rel == "" {
+			return p.Default
+		}
+
+		if i := strings.LastIndex(rel, "/"); i >= 0 {
+			rel = rel[:i]
+		} else {
+			rel = ""
+		}
+	}
+}
+
+func (p *PrefixCachePolicy) AttributesTTL(
+	op interface{},
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes) time.Duration {
+	return p.policyFor(op, inode).AttributesTTL(op, inode, attrs)
+}
+
+func (p *PrefixCachePolicy) EntryTTL(
+	op interface{},
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes) time.Duration {
+	return p.policyFor(op, inode).EntryTTL(op, inode, attrs)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Adaptive policy
+////////////////////////////////////////////////////////////////////////
+
+// AdaptiveCachePolicyConfig contains the parameters for
+// NewAdaptiveCachePolicy.
+type AdaptiveCachePolicyConfig struct {
+	// The clock used to tell whether the kernel's copy has expired. If nil,
+	// timeutil.RealClock() is used.
+	Clock timeutil.Clock
+
+	// The TTL given to inodes seen for the first time or just changed, and the
+	// longest TTL given to any inode. Min must be positive, and Max no less
+	// than Min.
+	Min time.Duration
+	Max time.Duration
+}
+
+// AdaptiveCachePolicy is a CachePolicy that lengthens the TTLs of inodes that
+// don't change. An inode starts at the minimum TTL; each time its attributes
+// are returned again after the last TTL given for them has run out (i.e. the
+// kernel refreshed them) and they are unchanged, its TTL doubles, up to the
+// maximum. A change drops it back to the minimum. Entries get the same TTL as
+// their inode's attributes.
+//
+// The policy remembers each inode it has seen until Forget is called for it,
+// which a file system should do once the inode's lookup count drops to zero.
+type AdaptiveCachePolicy struct {
+	clock timeutil.Clock
+	min   time.Duration
+	max   time.Duration
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*adaptiveRecord
+}
+
+type adaptiveRecord struct {
+	attrs   fuseops.InodeAttributes
+	ttl     time.Duration
+	expires time.Time
+}
+
+// NewAdaptiveCachePolicy creates an AdaptiveCachePolicy that has seen no
+// inodes.
+func NewAdaptiveCachePolicy(
+	cfg AdaptiveCachePolicyConfig) *AdaptiveCachePolicy {
+	p := &AdaptiveCachePolicy{
+		clock:  cfg.Clock,
+		min:    cfg.Min,
+		max:    cfg.Max,
+		inodes: make(map[fuseops.InodeID]*adaptiveRecord),
+	}
+
+	if p.clock == nil {
+		p.clock = timeutil.RealClock()
+	}
+
+	if p.max < p.min {
+		p.max = p.min
+	}
+
+	return p
+}
+
+// Return whether a and b describe the same version of an inode.
+func sameAttributes(a, b *fuseops.InodeAttributes) bool {
+	return a.Size == b.Size &&
+		a.Nlink == b.Nlink &&
+		a.Mode == b.Mode &&
+		a.Uid == b.Uid &&
+		a.Gid == b.Gid &&
+		a.Mtime.Equal(b.Mtime) &&
+		a.Ctime.Equal(b.Ctime) &&
+		a.Crtime.Equal(b.Crtime)
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *AdaptiveCachePolicy) AttributesTTL(
+	op interface{},
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock.Now()
+	r := p.inodes[inode]
+
+	switch {
+	case r == nil:
+		r = &adaptiveRecord{ttl: p.min}
+		p.inodes[inode] = r
+
+	case !sameAttributes(&r.attrs, attrs):
+		r.ttl = p.min
+
+	case !now.Before(r.expires):
+		r.ttl *= 2
+		if r.ttl > p.max {
+			r.ttl = p.max
+		}
+	}
+
+	r.attrs = *attrs
+	r.expires = now.Add(r.ttl)
+
+	return r.ttl
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *AdaptiveCachePolicy) EntryTTL(
+	op interface{},
+	inode fuseops.InodeID,
+	attrs *fuseops.InodeAttributes) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if r := p.inodes[inode]; r != nil {
+		return r.ttl
+	}
+
+	return p.min
+}
+
+// Forget discards what the policy knows about the supplied inode, whose TTL
+// starts again from the minimum if it is seen again.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *AdaptiveCachePolicy) Forget(inode fuseops.InodeID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.inodes, inode)
+}
@@ -0,0 +1,210 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/cachingfs"
+	"github.com/jacobsa/timeutil"
+)
+
+// Create a caching file system with the supplied lookup entry timeout, which
+// otherwise leaves its expirations unset.
+func newCachingFS(
+	t *testing.T,
+	lookupEntryTimeout time.Duration) cachingfs.CachingFS {
+	fs, err := cachingfs.NewCachingFS(lookupEntryTimeout, 0)
+	if err != nil {
+		t.Fatalf("NewCachingFS: %v", err)
+	}
+
+	return fs
+}
+
+func lookUp(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	parent fuseops.InodeID,
+	name string) fuseops.ChildInodeEntry {
+	op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+	if err := fs.LookUpInode(context.Background(), op); err != nil {
+		t.Fatalf("LookUpInode(%d, %q): %v", parent, name, err)
+	}
+
+	return op.Entry
+}
+
+// Return the TTL the supplied file system gives the attributes of inode.
+func getAttrTTL(
+	t *testing.T,
+	fs fuseutil.FileSystem,
+	inode fuseops.InodeID) time.Duration {
+	op := &fuseops.GetInodeAttributesOp{Inode: inode}
+	if err := fs.GetInodeAttributes(context.Background(), op); err != nil {
+		t.Fatalf("GetInodeAttributes(%d): %v", inode, err)
+	}
+
+	return op.AttributesValidFor
+}
+
+func TestCachePolicy_Static(t *testing.T) {
+	// The wrapped file system sets its own entry TTL, which is left alone.
+	cfs := newCachingFS(t, 17*time.Second)
+	fs := fuseutil.NewCachePolicyFileSystem(cfs, fuseutil.StaticCachePolicy{
+		Attributes: time.Minute,
+		Entries:    time.Hour,
+	})
+
+	e := lookUp(t, fs, fuseops.RootInodeID, "foo")
+	if e.AttributesValidFor != time.Minute || e.EntryValidFor != 17*time.Second {
+		t.Errorf("Lookup TTLs: %v, %v", e.AttributesValidFor, e.EntryValidFor)
+	}
+
+	if d := getAttrTTL(t, fs, cfs.FooID()); d != time.Minute {
+		t.Errorf("GetInodeAttributes TTL: %v", d)
+	}
+
+	// Swapping the policy takes effect for the next reply.
+	fs.SetPolicy(fuseutil.StaticCachePolicy{})
+	if d := getAttrTTL(t, fs, cfs.FooID()); d != 0 {
+		t.Errorf("TTL after swap: %v", d)
+	}
+
+	// Entries are filled in too when the file system leaves them unset.
+	fs = fuseutil.NewCachePolicyFileSystem(
+		newCachingFS(t, 0),
+		fuseutil.StaticCachePolicy{Entries: time.Hour})
+
+	if e := lookUp(t, fs, fuseops.RootInodeID, "foo"); e.EntryValidFor != time.Hour {
+		t.Errorf("Entry TTL: %v", e.EntryValidFor)
+	}
+}
+
+func TestCachePolicy_Prefix(t *testing.T) {
+	cfs := newCachingFS(t, 0)
+	paths := map[fuseops.InodeID]string{
+		fuseops.RootInodeID: "",
+		cfs.FooID():         "foo",
+		cfs.DirID():         "dir",
+		cfs.BarID():         "dir/bar",
+	}
+
+	long := fuseutil.StaticCachePolicy{Attributes: time.Hour, Entries: time.Hour}
+	short := fuseutil.StaticCachePolicy{Attributes: time.Second, Entries: time.Second}
+
+	fs := fuseutil.NewCachePolicyFileSystem(cfs, &fuseutil.PrefixCachePolicy{
+		Path: func(inode fuseops.InodeID) (string, bool) {
+			p, ok := paths[inode]
+			return p, ok
+		},
+		Prefixes: map[string]fuseutil.CachePolicy{
+			"dir": long,
+			"fo":  long,
+		},
+		Default: short,
+	})
+
+	testCases := []struct {
+		inode fuseops.InodeID
+		want  time.Duration
+	}{
+		{fuseops.RootInodeID, time.Second},
+		{cfs.FooID(), time.Second},
+		{cfs.DirID(), time.Hour},
+		{cfs.BarID(), time.Hour},
+		{12345, time.Second},
+	}
+
+	for _, tc := range testCases {
+		if d := getAttrTTL(t, fs, tc.inode); d != tc.want {
+			t.Errorf("Inode %d (%q): got %v, want %v", tc.inode, paths[tc.inode], d, tc.want)
+		}
+	}
+
+	// Lookups go by the parent's path and the name.
+	delete(paths, cfs.BarID())
+	if e := lookUp(t, fs, cfs.DirID(), "bar"); e.EntryValidFor != time.Hour {
+		t.Errorf("Lookup of dir/bar: entry TTL %v", e.EntryValidFor)
+	}
+
+	if e := lookUp(t, fs, fuseops.RootInodeID, "foo"); e.EntryValidFor != time.Second {
+		t.Errorf("Lookup of foo: entry TTL %v", e.EntryValidFor)
+	}
+}
+
+func TestCachePolicy_Adaptive(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	cfs := newCachingFS(t, 0)
+	p := fuseutil.NewAdaptiveCachePolicy(fuseutil.AdaptiveCachePolicyConfig{
+		Clock: &clock,
+		Min:   time.Second,
+		Max:   8 * time.Second,
+	})
+
+	fs := fuseutil.NewCachePolicyFileSystem(cfs, p)
+	foo := cfs.FooID()
+
+	// Each refresh after the TTL runs out doubles it, up to the maximum.
+	// Replies before then, e.g. for another process, don't count.
+	steps := []struct {
+		advance time.Duration
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{500 * time.Millisecond, time.Second},
+		{time.Second, 2 * time.Second},
+		{2 * time.Second, 4 * time.Second},
+		{4 * time.Second, 8 * time.Second},
+		{8 * time.Second, 8 * time.Second},
+	}
+
+	for i, s := range steps {
+		clock.AdvanceTime(s.advance)
+		if d := getAttrTTL(t, fs, foo); d != s.want {
+			t.Fatalf("Step %d: got %v, want %v", i, d, s.want)
+		}
+	}
+
+	// Entries follow their inode.
+	if e := lookUp(t, fs, fuseops.RootInodeID, "foo"); e.EntryValidFor != 8*time.Second {
+		t.Errorf("Entry TTL: %v", e.EntryValidFor)
+	}
+
+	// A change starts again from the minimum.
+	cfs.SetMtime(clock.Now())
+	clock.AdvanceTime(8 * time.Second)
+	if d := getAttrTTL(t, fs, foo); d != time.Second {
+		t.Errorf("TTL after change: %v", d)
+	}
+
+	clock.AdvanceTime(time.Second)
+	if d := getAttrTTL(t, fs, foo); d != 2*time.Second {
+		t.Errorf("TTL after unchanged refresh: %v", d)
+	}
+
+	// So does forgetting.
+	p.Forget(foo)
+	clock.AdvanceTime(2 * time.Second)
+	if d := getAttrTTL(t, fs, foo); d != time.Second {
+		t.Errorf("TTL after Forget: %v", d)
+	}
+}
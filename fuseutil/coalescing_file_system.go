@@ -0,0 +1,265 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// NewCoalescingFileSystem wraps the supplied file system so that concurrent
+// LookUpInode calls for the same parent and name, and concurrent
+// GetInodeAttributes calls for the same inode, are collapsed into a single
+// call to fs whose result is shared with all of the callers. This helps file
+// systems with slow backends when many processes stat the same uncached path
+// at once. All other methods call straight through. Only calls made through
+// the same connection are collapsed, as a file system serving several mounts
+// may answer differently for each (see fuse.MountInfoFromContext).
+//
+// A caller may share the result of a call that was already in progress when
+// it arrived, and so see the inode as it was when that call began, missing
+// changes that completed in between (e.g. a write made through another mount,
+// or directly to the backend). This is the same staleness the kernel's own
+// attribute and entry caches allow for; file systems for which every lookup
+// must reflect all earlier changes shouldn't coalesce.
+//
+// The kernel increments an inode's lookup count once for each successful
+// LookUpInode reply, including shared ones, and will later forget it that many
+// times. If fs tracks lookup counts, it must supply incrementLookupCount,
+// which is called with the caller's context once for each caller that
+// received a shared result, since fs saw only the original call. (For
+// example, pass the Increment method of the file system's LookupCounts.)
+// Otherwise it may be nil.
+//
+// The lookup count is incremented for the callers sharing a result before the
+// original call returns, so a forget that follows the original call's reply
+// can't drop the count to zero while the shared replies are on their way.
+//
+// If the call whose result would be shared fails because its own context was
+// cancelled (e.g. the kernel interrupted it), the other callers try again
+// rather than sharing the error.
+func NewCoalescingFileSystem(
+	fs FileSystem,
+	incrementLookupCount func(context.Context, fuseops.InodeID)) FileSystem {
+	return &coalescingFileSystem{
+		FileSystem:           fs,
+		incrementLookupCount: incrementLookupCount,
+		calls:                make(map[interface{}]*coalescedCall),
+	}
+}
+
+type coalescingFileSystem struct {
+	FileSystem
+
+	incrementLookupCount func(context.Context, fuseops.InodeID)
+
+	mu sync.Mutex
+
+	// The calls to the wrapped file system currently in progress, keyed by
+	// lookupKey or attrKey.
+	//
+	// GUARDED_BY(mu)
+	calls map[interface{}]*coalescedCall
+}
+
+// Points (see Point) reached by a call that shares the result of another.
+const (
+	// Reached just before waiting for the call in progress.
+	PointCoalesceWait = "fuseutil.coalesce.wait"
+
+	// Reached after receiving the shared result, before returning it.
+	PointCoalesceShared = "fuseutil.coalesce.shared"
+)
+
+type lookupKey struct {
+	mount  uint64
+	parent fuseops.InodeID
+	name   string
+}
+
+type attrKey struct {
+	mount uint64
+	inode fuseops.InodeID
+}
+
+// A call to the wrapped file system whose result may be shared.
+type coalescedCall struct {
+	// The context with which the call was made.
+	ctx context.Context
+
+	// The contexts of the callers waiting to share the result. Once finished
+	// is set, the list is no longer modified, and the waiters are committed to
+	// sharing the result.
+	//
+	// GUARDED_BY(coalescingFileSystem.mu)
+	waiters  []context.Context
+	finished bool
+
+	// Closed when the call has finished, after which the fields below are set.
+	done chan struct{}
+
+	result interface{}
+	err    error
+}
+
+// Call f, unless a call with the same key is already in progress, in which
+// case wait for it and return its result instead. shared reports which
+// happened.
+//
+// If f succeeds and share is non-nil, share is called with the result and the
+// context of each caller that will share it, before any of them (including
+// this one) returns.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *coalescingFileSystem) do(
+	ctx context.Context,
+	key interface{},
+	f func() (interface{}, error),
+	share func(context.Context, interface{})) (
+	result interface{}, shared bool, err error) {
+	for {
+		fs.mu.Lock()
+		call, ok := fs.calls[key]
+		if !ok {
+			call = &coalescedCall{
+				ctx:  ctx,
+				done: make(chan struct{}),
+			}
+
+			fs.calls[key] = call
+		} else {
+			call.waiters = append(call.waiters, ctx)
+		}
+		fs.mu.Unlock()
+
+		// Make the call ourselves if nobody else is.
+		if !ok {
+			call.result, call.err = f()
+
+			fs.mu.Lock()
+			delete(fs.calls, key)
+			call.finished = true
+			waiters := call.waiters
+			fs.mu.Unlock()
+
+			if call.err == nil && share != nil {
+				for _, w := range waiters {
+					share(w, call.result)
+				}
+			}
+
+			close(call.done)
+			return call.result, false, call.err
+		}
+
+		// Otherwise wait for the call in progress. If we're cancelled before it
+		// finishes we can leave, but after that the result has been shared with
+		// us and we must take it.
+		Point(ctx, PointCoalesceWait)
+
+		select {
+		case <-call.done:
+
+		case <-ctx.Done():
+			fs.mu.Lock()
+			finished := call.finished
+			if !finished {
+				call.removeWaiter(ctx)
+			}
+			fs.mu.Unlock()
+
+			if !finished {
+				return nil, false, ctx.Err()
+			}
+
+			<-call.done
+		}
+
+		Point(ctx, PointCoalesceShared)
+
+		// Don't share an error that was specific to the other caller.
+		if call.err != nil && call.ctx.Err() != nil {
+			continue
+		}
+
+		return call.result, true, call.err
+	}
+}
+
+// Remove the supplied context from the list of waiters.
+//
+// LOCKS_REQUIRED(coalescingFileSystem.mu)
+func (call *coalescedCall) removeWaiter(ctx context.Context) {
+	for i, w := range call.waiters {
+		if w == ctx {
+			call.waiters = append(call.waiters[:i], call.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+func (fs *coalescingFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	var share func(context.Context, interface{})
+	if fs.incrementLookupCount != nil {
+		share = func(ctx context.Context, result interface{}) {
+			fs.incrementLookupCount(ctx, result.(fuseops.ChildInodeEntry).Child)
+		}
+	}
+
+	key := lookupKey{mountID(ctx), op.Parent, op.Name}
+	result, shared, err := fs.do(
+		ctx,
+		key,
+		func() (interface{}, error) {
+			err := fs.FileSystem.LookUpInode(ctx, op)
+			return op.Entry, err
+		},
+		share)
+
+	if err != nil || !shared {
+		return err
+	}
+
+	op.Entry = result.(fuseops.ChildInodeEntry)
+	return nil
+}
+
+func (fs *coalescingFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	result, shared, err := fs.do(
+		ctx,
+		attrKey{mountID(ctx), op.Inode},
+		func() (interface{}, error) {
+			err := fs.FileSystem.GetInodeAttributes(ctx, op)
+			return *op, err
+		},
+		nil)
+
+	if err != nil || !shared {
+		return err
+	}
+
+	r := result.(fuseops.GetInodeAttributesOp)
+	op.Attributes = r.Attributes
+	op.AttributesExpiration = r.AttributesExpiration
+	op.AttributesValidFor = r.AttributesValidFor
+
+	return nil
+}
@@ -0,0 +1,367 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The latency injected in front of the backend.
+const backendLatency = 200 * time.Millisecond
+
+// A file system with a single file, counting calls and lookups.
+type countingFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	lookUpCalls  int64 // Accessed atomically
+	getAttrCalls int64 // Accessed atomically
+
+	lookups *fuseutil.LookupCounts
+}
+
+func (fs *countingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	atomic.AddInt64(&fs.lookUpCalls, 1)
+
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = fileInode
+	op.Entry.Attributes.Nlink = 1
+	fs.lookups.Increment(ctx, fileInode)
+
+	return nil
+}
+
+func (fs *countingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	atomic.AddInt64(&fs.getAttrCalls, 1)
+
+	op.Attributes.Nlink = 1
+	op.Attributes.Size = uint64(op.Inode)
+
+	return nil
+}
+
+// The point (see fuseutil.Point) reached by forgettingFS.LookUpInode after
+// looking up the file.
+const pointLookedUp = "looked up"
+
+// Like countingFS, but discarding the file once its lookup count drops to
+// zero, as a file system would for an unlinked file, and detecting lookups of
+// it after that.
+type forgettingFS struct {
+	countingFS
+
+	mu          sync.Mutex
+	forgotten   bool // GUARDED_BY(mu)
+	resurrected int  // GUARDED_BY(mu)
+}
+
+func (fs *forgettingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	err := fs.countingFS.LookUpInode(ctx, op)
+	fuseutil.Point(ctx, pointLookedUp)
+	return err
+}
+
+func (fs *forgettingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.lookups.Forget(ctx, op.Inode, op.N) == 0 {
+		fs.forgotten = true
+	}
+
+	return nil
+}
+
+// For NewCoalescingFileSystem.
+func (fs *forgettingFS) increment(
+	ctx context.Context,
+	inode fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.forgotten {
+		fs.resurrected++
+	}
+
+	fs.lookups.Increment(ctx, inode)
+}
+
+// Serve a countingFS with injected latency, coalescing calls.
+func newCoalescingKernel(t *testing.T) (*fusetesting.FakeKernel, *countingFS) {
+	backend := &countingFS{
+		lookups: fuseutil.NewLookupCounts(),
+	}
+
+	fs := fuseutil.NewCoalescingFileSystem(
+		fusetesting.NewLatencyFileSystem(backend, backendLatency),
+		backend.lookups.Increment)
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	return k, backend
+}
+
+// Call f n times concurrently, returning how long it took.
+func concurrently(n int, f func()) time.Duration {
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+
+	wg.Wait()
+	return time.Since(start)
+}
+
+func TestCoalescing_LookUpInode(t *testing.T) {
+	k, backend := newCoalescingKernel(t)
+	defer k.Close()
+
+	const n = 100
+	errs := make(chan error, n)
+
+	elapsed := concurrently(n, func() {
+		inode, err := k.LookUp(fuseops.RootInodeID, "foo")
+		if err == nil && inode != fileInode {
+			t.Errorf("LookUp returned inode %v", inode)
+		}
+
+		errs <- err
+	})
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("LookUp: %v", err)
+		}
+	}
+
+	// The lookups should have taken about as long as one backend call.
+	if elapsed > 2*backendLatency {
+		t.Errorf("%d lookups took %v", n, elapsed)
+	}
+
+	if calls := atomic.LoadInt64(&backend.lookUpCalls); calls >= n {
+		t.Errorf("Backend saw %d calls", calls)
+	}
+
+	// The kernel will forget all n lookups, so all should be counted.
+	if c := backend.lookups.Total(fileInode); c != n {
+		t.Errorf("Lookup count: %d", c)
+	}
+
+	// Failures are shared too.
+	if _, err := k.LookUp(fuseops.RootInodeID, "bar"); err != fuse.ENOENT {
+		t.Errorf("LookUp(bar): %v", err)
+	}
+}
+
+func TestCoalescing_GetInodeAttributes(t *testing.T) {
+	k, backend := newCoalescingKernel(t)
+	defer k.Close()
+
+	const n = 100
+	errs := make(chan error, n)
+
+	elapsed := concurrently(n, func() {
+		attr, err := k.GetAttr(fileInode)
+		if err == nil && attr.Size != uint64(fileInode) {
+			t.Errorf("GetAttr returned size %v", attr.Size)
+		}
+
+		errs <- err
+	})
+
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("GetAttr: %v", err)
+		}
+	}
+
+	if elapsed > 2*backendLatency {
+		t.Errorf("%d calls took %v", n, elapsed)
+	}
+
+	if calls := atomic.LoadInt64(&backend.getAttrCalls); calls >= n {
+		t.Errorf("Backend saw %d calls", calls)
+	}
+
+	// Calls for different inodes aren't coalesced.
+	attr, err := k.GetAttr(fuseops.RootInodeID)
+	if err != nil {
+		t.Fatalf("GetAttr: %v", err)
+	}
+
+	if attr.Size != uint64(fuseops.RootInodeID) {
+		t.Errorf("GetAttr returned size %v", attr.Size)
+	}
+}
+
+func TestCoalescing_SeparateConnections(t *testing.T) {
+	backend := &countingFS{
+		lookups: fuseutil.NewLookupCounts(),
+	}
+
+	server := fuseutil.NewFileSystemServer(fuseutil.NewCoalescingFileSystem(
+		fusetesting.NewLatencyFileSystem(backend, backendLatency),
+		backend.lookups.Increment))
+
+	var kernels []*fusetesting.FakeKernel
+	for i := 0; i < 2; i++ {
+		k, err := fusetesting.NewFakeKernel(server, &fuse.MountConfig{})
+		if err != nil {
+			t.Fatalf("NewFakeKernel: %v", err)
+		}
+
+		defer k.Close()
+		kernels = append(kernels, k)
+	}
+
+	// Calls made at once through different connections each reach the backend.
+	var next int32
+	concurrently(len(kernels), func() {
+		k := kernels[atomic.AddInt32(&next, 1)-1]
+		if _, err := k.GetAttr(fileInode); err != nil {
+			t.Errorf("GetAttr: %v", err)
+		}
+	})
+
+	if calls := atomic.LoadInt64(&backend.getAttrCalls); calls != 2 {
+		t.Errorf("Backend saw %d calls", calls)
+	}
+}
+
+// A forget for the reply to the original lookup must not release the inode
+// while a shared reply for it is still on its way to the kernel.
+func TestCoalescing_ForgetRacingWithSharedLookUp(t *testing.T) {
+	for seed := int64(0); seed < 4; seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			testForgetRacingWithSharedLookUp(t, seed)
+		})
+	}
+}
+
+func testForgetRacingWithSharedLookUp(t *testing.T, seed int64) {
+	s := fusetesting.NewScheduler(seed)
+	backend := &forgettingFS{
+		countingFS: countingFS{
+			lookups: fuseutil.NewLookupCounts(),
+		},
+	}
+
+	fs := s.Wrap(fuseutil.NewCoalescingFileSystem(backend, backend.increment))
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	// Whichever lookup is admitted first reaches the backend and waits there
+	// until the other joins it. The second then waits with the shared result
+	// until the kernel has forgotten the first one's reply.
+	isLookUp := fusetesting.OpsOfType(&fuseops.LookUpInodeOp{})
+	isForget := fusetesting.OpsOfType(&fuseops.ForgetInodeOp{})
+
+	s.Hold(isLookUp, pointLookedUp, isLookUp, fuseutil.PointCoalesceWait)
+	s.Hold(
+		isLookUp, fuseutil.PointCoalesceShared,
+		isForget, fusetesting.PointDone)
+
+	s.Expect(2)
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			inode, err := k.LookUp(fuseops.RootInodeID, "foo")
+			if err == nil && inode != fileInode {
+				err = fmt.Errorf("Returned inode %v", inode)
+			}
+
+			results <- err
+		}()
+	}
+
+	// Forget the first reply.
+	if err := <-results; err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	in := fusekernel.ForgetIn{Nlookup: 1}
+	const inSize = unsafe.Sizeof(fusekernel.ForgetIn{})
+	err = k.Send(
+		fusekernel.OpForget,
+		uint64(fileInode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:])
+
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if err := <-results; err != nil {
+		t.Fatalf("LookUp: %v", err)
+	}
+
+	// The kernel still refers to the inode through the second reply.
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if backend.forgotten || backend.resurrected != 0 {
+		t.Errorf(
+			"Inode forgotten while in use (resurrected %d times)",
+			backend.resurrected)
+	}
+
+	if c := backend.lookups.Total(fileInode); c != 1 {
+		t.Errorf("Lookup count: %d", c)
+	}
+}
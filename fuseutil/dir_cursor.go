@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// DirCursor serves ReadDir calls for a single directory handle from a
+// snapshot of the directory's listing, taken when the handle is first read and
+// again whenever the kernel reads from offset zero (e.g. after rewinddir(3)).
+// Reads from any other offset previously handed out continue from the
+// snapshot, so a listing taken by one pass over the handle is self-consistent
+// even if the directory changes during it.
+//
+// The typical use is to create a cursor in OpenDir, attach it to the handle
+// using OpenDirOp.HandleData, and delegate to it from ReadDir:
+//
+//	func (fs *myFS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+//	  return op.HandleData.(*fuseutil.DirCursor).ReadDir(ctx, op)
+//	}
+type DirCursor struct {
+	list func(context.Context) ([]Dirent, error)
+
+	mu sync.Mutex
+
+	// The most recent listing, or nil if none has been taken. The offset of
+	// each entry is its index plus one.
+	//
+	// GUARDED_BY(mu)
+	entries []Dirent
+}
+
+// NewDirCursor creates a cursor that obtains listings by calling list. The
+// Offset fields of the entries list returns are ignored; the cursor assigns its
+// own.
+func NewDirCursor(
+	list func(ctx context.Context) ([]Dirent, error)) *DirCursor {
+	return &DirCursor{
+		list: list,
+	}
+}
+
+// ReadDir fills in op.Dst and op.BytesRead from the listing, re-listing the
+// directory first if op.Offset is zero. If op.Plus is set the entries carry no
+// attributes, so the kernel looks up each child it needs as it would after a
+// plain READDIR.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *DirCursor) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if op.Offset == 0 || c.entries == nil {
+		entries, err := c.list(ctx)
+		if err != nil {
+			return err
+		}
+
+		for i := range entries {
+			entries[i].Offset = fuseops.DirOffset(i + 1)
+		}
+
+		// Distinguish an empty listing from no listing.
+		if entries == nil {
+			entries = []Dirent{}
+		}
+
+		c.entries = entries
+	}
+
+	if op.Offset > fuseops.DirOffset(len(c.entries)) {
+		return nil
+	}
+
+	for _, e := range c.entries[op.Offset:] {
+		n := writeDirentFor(op, e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A root directory whose listing may be changed by the test, served with
+// fuseutil.DirCursor.
+type cursorFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu    sync.Mutex
+	names []string // GUARDED_BY(mu)
+}
+
+func (fs *cursorFS) setNames(names []string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.names = names
+}
+
+func (fs *cursorFS) list(ctx context.Context) ([]fuseutil.Dirent, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var entries []fuseutil.Dirent
+	for i, name := range fs.names {
+		entries = append(entries, fuseutil.Dirent{
+			Inode: fuseops.RootInodeID + 1 + fuseops.InodeID(i),
+			Name:  name,
+			Type:  fuseutil.DT_File,
+		})
+	}
+
+	return entries, nil
+}
+
+func (fs *cursorFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fuse.ENOENT
+}
+
+func (fs *cursorFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if op.Inode != fuseops.RootInodeID {
+		return fuse.ENOENT
+	}
+
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  os.ModeDir | 0555,
+	}
+
+	return nil
+}
+
+func (fs *cursorFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	op.HandleData = fuseutil.NewDirCursor(fs.list)
+	return nil
+}
+
+func (fs *cursorFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return op.HandleData.(*fuseutil.DirCursor).ReadDir(ctx, op)
+}
+
+func (fs *cursorFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+// An entry as returned by getdents64(2).
+type kernelDirent struct {
+	Name string
+	Ino  uint64
+	Type uint8
+
+	// The offset at which to resume reading after this entry.
+	Off int64
+}
+
+// Call getdents64(2) with a small buffer until it hits the end of the
+// directory or max entries have been read.
+func readEntries(
+	t *testing.T,
+	fd int,
+	max int) (entries []kernelDirent) {
+	buf := make([]byte, 512)
+	for len(entries) < max {
+		n, err := syscall.Getdents(fd, buf)
+		if err != nil {
+			t.Fatalf("Getdents: %v", err)
+		}
+
+		if n == 0 {
+			break
+		}
+
+		// struct linux_dirent64: ino, off, reclen, type, then the name.
+		for b := buf[:n]; len(b) > 0 && len(entries) < max; {
+			ino := binary.LittleEndian.Uint64(b[0:8])
+			off := int64(binary.LittleEndian.Uint64(b[8:16]))
+			reclen := binary.LittleEndian.Uint16(b[16:18])
+
+			name := b[19:reclen]
+			for i, c := range name {
+				if c == 0 {
+					name = name[:i]
+					break
+				}
+			}
+
+			entries = append(entries, kernelDirent{
+				Name: string(name),
+				Ino:  ino,
+				Type: b[18],
+				Off:  off,
+			})
+			b = b[reclen:]
+		}
+	}
+
+	return entries
+}
+
+func entryNames(entries []kernelDirent) (names []string) {
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+
+	return names
+}
+
+func TestDirCursor_Rewind(t *testing.T) {
+	fs := &cursorFS{}
+
+	// Enough long names that a listing takes several kernel requests.
+	var names []string
+	for i := 0; i < 300; i++ {
+		names = append(names, fmt.Sprintf("some_fairly_long_file_name_%04d", i))
+	}
+
+	fs.setNames(names)
+
+	dir, err := ioutil.TempDir("", "dir_cursor_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName: "dir_cursor_test",
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+			return
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	// Use raw system calls rather than the os package, which would register the
+	// directory with the runtime's poller.
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	rewind := func() {
+		if _, err := syscall.Seek(fd, 0, 0); err != nil {
+			t.Fatalf("Seek: %v", err)
+		}
+	}
+
+	// A complete pass, then another after rewinding, should agree
+	// entry-for-entry.
+	first := readEntries(t, fd, len(names)+1)
+	if got := entryNames(first); !reflect.DeepEqual(got, names) {
+		t.Fatalf("First pass: got %d names %v", len(got), got)
+	}
+
+	rewind()
+	second := readEntries(t, fd, len(names)+1)
+	if !reflect.DeepEqual(second, first) {
+		t.Fatalf("Second pass differs: %v vs. %v", second, first)
+	}
+
+	// Rewinding part way through should start again from the beginning.
+	rewind()
+	readEntries(t, fd, 10)
+
+	rewind()
+	if got := entryNames(readEntries(t, fd, len(names)+1)); !reflect.DeepEqual(got, names) {
+		t.Errorf("Pass after partial read: got %d names %v", len(got), got)
+	}
+
+	// Seeking to an offset handed out by an earlier pass should resume after
+	// the corresponding entry.
+	const resumeAfter = 150
+	if _, err := syscall.Seek(fd, first[resumeAfter].Off, 0); err != nil {
+		t.Fatalf("Seek: %v", err)
+	}
+
+	if got := entryNames(readEntries(t, fd, len(names)+1)); !reflect.DeepEqual(got, names[resumeAfter+1:]) {
+		t.Errorf("Pass after seekdir: got %d names %v", len(got), got)
+	}
+
+	// A rewind should pick up changes to the directory.
+	names = append(names, "taco")
+	fs.setNames(names)
+
+	rewind()
+	if got := entryNames(readEntries(t, fd, len(names)+1)); !reflect.DeepEqual(got, names) {
+		t.Errorf("Pass after change: got %d names %v", len(got), got)
+	}
+}
@@ -15,12 +15,24 @@
 package fuseutil
 
 import (
+	"os"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/convert"
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
+// The type of a child as reported in a directory listing, surfaced to users as
+// dirent::d_type by readdir(3).
+//
+// Programs like find(1) trust a known type without looking the child up, so
+// it must agree with the mode the file system later reports for the child
+// (cf. fuse.StrictDirentType). A file system that can't cheaply tell what a
+// child is while listing should report DT_Unknown, which makes such programs
+// stat the child instead.
 type DirentType uint32
 
 const (
@@ -34,6 +46,29 @@ const (
 	DT_FIFO      DirentType = syscall.DT_FIFO
 )
 
+// DirentTypeOf returns the type to report in a directory listing for a child
+// with the supplied mode, as in InodeAttributes.Mode.
+func DirentTypeOf(mode os.FileMode) DirentType {
+	switch {
+	case mode&os.ModeDir != 0:
+		return DT_Directory
+	case mode&os.ModeDevice != 0:
+		if mode&os.ModeCharDevice != 0 {
+			return DT_Char
+		}
+
+		return DT_Block
+	case mode&os.ModeNamedPipe != 0:
+		return DT_FIFO
+	case mode&os.ModeSymlink != 0:
+		return DT_Link
+	case mode&os.ModeSocket != 0:
+		return DT_Socket
+	}
+
+	return DT_File
+}
+
 // A struct representing an entry within a directory file, describing a child.
 // See notes on fuseops.ReadDirOp and on WriteDirent for details.
 type Dirent struct {
@@ -50,8 +85,8 @@ type Dirent struct {
 	Type DirentType
 }
 
-// Write the supplied directory entry intto the given buffer in the format
-// expected in fuseops.ReadFileOp.Data, returning the number of bytes written.
+// Write the supplied directory entry into the given buffer in the format
+// expected in fuseops.ReadDirOp.Dst, returning the number of bytes written.
 // Return zero if the entry would not fit.
 func WriteDirent(buf []byte, d Dirent) (n int) {
 	// We want to write bytes with the layout of fuse_dirent
@@ -103,3 +138,162 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 
 	return n
 }
+
+// WriteDirentPlus is like WriteDirent, but writes the entry in the format
+// expected in fuseops.ReadDirOp.Dst when ReadDirOp.Plus is set. e gives the
+// child's attributes and expirations as for fuseops.LookUpInodeOp.Entry,
+// except that any expiration given as an absolute time is measured from the
+// wall clock rather than MountConfig.Clock. Its Child must match d.Inode.
+//
+// If e is nil the entry carries no attributes, and the kernel looks the child
+// up separately if it needs them; see the notes on ReadDirOp.Plus. e is
+// ignored for "." and "..", whose attributes the kernel doesn't take from
+// listings.
+func WriteDirentPlus(
+	buf []byte,
+	d Dirent,
+	e *fuseops.ChildInodeEntry) (n int) {
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	if entrySize > len(buf) {
+		return 0
+	}
+
+	// Write the dirent first, so we know whether it fits.
+	n = WriteDirent(buf[entrySize:], d)
+	if n == 0 {
+		return 0
+	}
+
+	var out fusekernel.EntryOut
+	if e != nil && d.Name != "." && d.Name != ".." {
+		convert.ChildInodeEntry(time.Now(), e, &out)
+	}
+
+	n += copy(buf, (*[entrySize]byte)(unsafe.Pointer(&out))[:])
+	return n
+}
+
+// Write d to op.Dst in whichever format op calls for, returning the number of
+// bytes written, or zero if it would not fit. The entry carries no attributes
+// if op.Plus is set.
+func writeDirentFor(
+	op *fuseops.ReadDirOp,
+	d Dirent) int {
+	if op.Plus {
+		return WriteDirentPlus(op.Dst[op.BytesRead:], d, nil)
+	}
+
+	return WriteDirent(op.Dst[op.BytesRead:], d)
+}
+
+// ReadDirent parses a single entry in the format written by WriteDirent from
+// the start of buf, as found in a ReadDirOp's reply, returning the number of
+// bytes it occupies. It returns zero if buf doesn't begin with a complete
+// entry.
+func ReadDirent(buf []byte) (d Dirent, n int) {
+	const direntAlignment = 8
+	const direntSize = 8 + 8 + 4 + 4
+
+	if len(buf) < direntSize {
+		return d, 0
+	}
+
+	namelen := int(*(*uint32)(unsafe.Pointer(&buf[16])))
+	n = direntSize + namelen
+	if n%direntAlignment != 0 {
+		n += direntAlignment - n%direntAlignment
+	}
+
+	if n > len(buf) {
+		return d, 0
+	}
+
+	d = Dirent{
+		Inode:  fuseops.InodeID(*(*uint64)(unsafe.Pointer(&buf[0]))),
+		Offset: fuseops.DirOffset(*(*uint64)(unsafe.Pointer(&buf[8]))),
+		Type:   DirentType(*(*uint32)(unsafe.Pointer(&buf[20]))),
+		Name:   string(buf[direntSize : direntSize+namelen]),
+	}
+
+	return d, n
+}
+
+// Like ReadDirent, but for an entry in the format written by WriteDirentPlus,
+// also returning the child's inode ID and generation from the entry's
+// attributes. The ID is zero if it carries none.
+func readDirentPlus(buf []byte) (
+	d Dirent,
+	child fuseops.InodeID,
+	generation fuseops.GenerationNumber,
+	n int) {
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	if len(buf) < entrySize {
+		return d, 0, 0, 0
+	}
+
+	d, n = ReadDirent(buf[entrySize:])
+	if n == 0 {
+		return d, 0, 0, 0
+	}
+
+	out := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+	return d, fuseops.InodeID(out.Nodeid), fuseops.GenerationNumber(out.Generation), entrySize + n
+}
+
+// The number of directory offsets taken by the entries EmitDotEntries
+// writes. A file system using it must add this to the Offset field of each of
+// its own entries.
+const DotEntryCount = 2
+
+// EmitDotEntries writes the "." and ".." entries for the directory self,
+// whose parent is parent, to op.Dst, as the first two entries of the
+// directory. The kernel doesn't make these up, so file systems must supply
+// them for tools that expect to see them. The root directory is its own
+// parent. If op.Plus is set, the entries are in the format of
+// WriteDirentPlus.
+//
+// Only the entries at or after op.Offset are written, so that a kernel that
+// has already consumed them isn't given them again. EmitDotEntries returns the
+// offset, in the file system's own numbering (i.e. before adding
+// DotEntryCount), from which the caller should continue with its own entries,
+// and false if op.Dst filled up first, in which case it should write nothing
+// more. For example:
+//
+//	rest, ok := fuseutil.EmitDotEntries(op, parent, op.Inode)
+//	if !ok {
+//	  return nil
+//	}
+//
+//	for _, e := range entries[rest:] {
+//	  // e.Offset already includes fuseutil.DotEntryCount.
+//	  n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+//	  if n == 0 {
+//	    break
+//	  }
+//
+//	  op.BytesRead += n
+//	}
+func EmitDotEntries(
+	op *fuseops.ReadDirOp,
+	parent fuseops.InodeID,
+	self fuseops.InodeID) (rest fuseops.DirOffset, ok bool) {
+	dots := [DotEntryCount]Dirent{
+		{Offset: 1, Inode: self, Name: ".", Type: DT_Directory},
+		{Offset: 2, Inode: parent, Name: "..", Type: DT_Directory},
+	}
+
+	if op.Offset >= DotEntryCount {
+		return op.Offset - DotEntryCount, true
+	}
+
+	for _, d := range dots[op.Offset:] {
+		n := writeDirentFor(op, d)
+		if n == 0 {
+			return 0, false
+		}
+
+		op.BytesRead += n
+	}
+
+	return 0, true
+}
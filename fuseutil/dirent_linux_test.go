@@ -0,0 +1,145 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A root directory listing fixed entries, written with WriteDirent.
+type fixedDirFS struct {
+	fuseutil.NotImplementedFileSystem
+	entries []fuseutil.Dirent
+}
+
+func (fs *fixedDirFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: os.ModeDir | 0555}
+	return nil
+}
+
+func (fs *fixedDirFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *fixedDirFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	// Resume after the entry whose offset the kernel gives.
+	for _, d := range fs.entries {
+		if d.Offset <= op.Offset {
+			continue
+		}
+
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *fixedDirFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+// Check that getdents64(2) gives back what WriteDirent encoded, over enough
+// entries that the kernel reads them in several batches.
+func TestWriteDirent_Kernel(t *testing.T) {
+	types := []fuseutil.DirentType{
+		fuseutil.DT_File,
+		fuseutil.DT_Directory,
+		fuseutil.DT_Link,
+		fuseutil.DT_FIFO,
+		fuseutil.DT_Socket,
+		fuseutil.DT_Char,
+		fuseutil.DT_Block,
+		fuseutil.DT_Unknown,
+	}
+
+	fs := &fixedDirFS{}
+	var want []kernelDirent
+	for i := 0; i < 200; i++ {
+		d := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(7 * (i + 1)),
+			Inode:  fuseops.InodeID(1000 + i),
+			Name:   strings.Repeat(string(rune('a'+i%26)), 1+i%40),
+			Type:   types[i%len(types)],
+		}
+
+		fs.entries = append(fs.entries, d)
+		want = append(want, kernelDirent{
+			Name: d.Name,
+			Ino:  uint64(d.Inode),
+			Type: uint8(d.Type),
+			Off:  int64(d.Offset),
+		})
+	}
+
+	dir, err := ioutil.TempDir("", "dirent_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName: "direntfs",
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Unmount(); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	got := readEntries(t, fd, len(want)+1)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got entries %+v, want %+v", got, want)
+	}
+}
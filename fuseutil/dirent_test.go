@@ -0,0 +1,148 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Return the names and offsets of the entries in buf.
+func parseDirents(t *testing.T, buf []byte) (entries []Dirent) {
+	for len(buf) > 0 {
+		d, n := ReadDirent(buf)
+		if n == 0 {
+			t.Fatalf("Malformed entry: %v", buf)
+		}
+
+		entries = append(entries, d)
+		buf = buf[n:]
+	}
+
+	return entries
+}
+
+func TestEmitDotEntries(t *testing.T) {
+	const parent, self = 17, 19
+	dot := Dirent{Offset: 1, Inode: self, Name: ".", Type: DT_Directory}
+	dotDot := Dirent{Offset: 2, Inode: parent, Name: "..", Type: DT_Directory}
+
+	testCases := []struct {
+		offset  fuseops.DirOffset
+		size    int
+		want    []Dirent
+		rest    fuseops.DirOffset
+		wantOK  bool
+		comment string
+	}{
+		{0, 4096, []Dirent{dot, dotDot}, 0, true, "whole listing"},
+		{1, 4096, []Dirent{dotDot}, 0, true, "after ."},
+		{2, 4096, nil, 0, true, "after .."},
+		{5, 4096, nil, 3, true, "among the file system's entries"},
+		{0, 32, []Dirent{dot}, 0, false, "room for only ."},
+		{0, 8, nil, 0, false, "no room"},
+	}
+
+	for _, tc := range testCases {
+		op := &fuseops.ReadDirOp{
+			Inode:  self,
+			Offset: tc.offset,
+			Dst:    make([]byte, tc.size),
+		}
+
+		rest, ok := EmitDotEntries(op, parent, self)
+		if rest != tc.rest || ok != tc.wantOK {
+			t.Errorf("%s: got (%d, %v), want (%d, %v)", tc.comment, rest, ok, tc.rest, tc.wantOK)
+		}
+
+		if got := parseDirents(t, op.Dst[:op.BytesRead]); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got entries %+v, want %+v", tc.comment, got, tc.want)
+		}
+	}
+}
+
+func TestDirentTypeOf(t *testing.T) {
+	testCases := []struct {
+		mode os.FileMode
+		want DirentType
+	}{
+		{0644, DT_File},
+		{0755 | os.ModeDir, DT_Directory},
+		{0777 | os.ModeSymlink, DT_Link},
+		{0644 | os.ModeNamedPipe, DT_FIFO},
+		{0644 | os.ModeSocket, DT_Socket},
+		{0644 | os.ModeDevice, DT_Block},
+		{0644 | os.ModeDevice | os.ModeCharDevice, DT_Char},
+		{0644 | os.ModeSetuid, DT_File},
+	}
+
+	for _, tc := range testCases {
+		if got := DirentTypeOf(tc.mode); got != tc.want {
+			t.Errorf("DirentTypeOf(%v): got %d, want %d", tc.mode, got, tc.want)
+		}
+	}
+}
+
+func TestWriteDirent(t *testing.T) {
+	// Names of every length modulo the alignment, and the longest allowed.
+	var entries []Dirent
+	for i := 1; i <= 9; i++ {
+		entries = append(entries, Dirent{
+			Offset: fuseops.DirOffset(10 * i),
+			Inode:  fuseops.InodeID(100 + i),
+			Name:   strings.Repeat("x", i),
+			Type:   DT_File,
+		})
+	}
+
+	entries = append(entries, Dirent{
+		Offset: 1000,
+		Inode:  1000,
+		Name:   strings.Repeat("y", 255),
+		Type:   DT_Directory,
+	})
+
+	buf := make([]byte, 4096)
+	var written int
+	for _, d := range entries {
+		n := WriteDirent(buf[written:], d)
+
+		// A 24-byte header, then the name padded to 8 bytes.
+		if want := 24 + (len(d.Name)+7)/8*8; n != want {
+			t.Errorf("%q: wrote %d bytes, want %d", d.Name, n, want)
+		}
+
+		written += n
+	}
+
+	if got := parseDirents(t, buf[:written]); !reflect.DeepEqual(got, entries) {
+		t.Errorf("Got entries %+v, want %+v", got, entries)
+	}
+
+	// An entry that doesn't fit isn't written at all.
+	d := Dirent{Offset: 1, Inode: 1, Name: "taco", Type: DT_File}
+	full := make([]byte, 31)
+	if n := WriteDirent(full, d); n != 0 {
+		t.Errorf("Wrote %d bytes into %d", n, len(full))
+	}
+
+	if !reflect.DeepEqual(full, make([]byte, len(full))) {
+		t.Errorf("Buffer modified: %v", full)
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// FileLocks keeps the POSIX record locks and flock(2) locks held on a file
+// system's inodes in memory, for file systems mounted with
+// fuse.MountConfig.EnablePOSIXLocks or EnableFlockLocks. It implements the
+// rules described on fuseops.SetLockOp, so a file system can simply forward
+// GetLockOp and SetLockOp to it, and call ReleaseOwner for each FlushFileOp and
+// for each ReleaseFileHandleOp with ReleaseFlockUnlock set.
+//
+// Unlike the kernel, FileLocks doesn't detect deadlocks between owners
+// waiting for each other; they wait until one of them is interrupted.
+//
+// It is safe to call methods concurrently.
+type FileLocks struct {
+	mu sync.Mutex
+
+	// The locks of each kind held on each inode that has any, in no
+	// particular order. No two locks of the same owner in a set overlap.
+	//
+	// GUARDED_BY(mu)
+	sets map[lockSet][]heldLock
+
+	// Closed and replaced whenever a lock is released or weakened, waking any
+	// SetLock calls waiting for it.
+	//
+	// GUARDED_BY(mu)
+	released chan struct{}
+}
+
+// The locks of one kind on an inode. flock(2) and fcntl(2) locks don't
+// interact.
+type lockSet struct {
+	inode fuseops.InodeID
+	flock bool
+}
+
+type heldLock struct {
+	owner uint64
+	fuseops.FileLock
+}
+
+// NewFileLocks creates an empty lock table.
+func NewFileLocks() *FileLocks {
+	return &FileLocks{
+		sets:     make(map[lockSet][]heldLock),
+		released: make(chan struct{}),
+	}
+}
+
+// GetLock answers op, setting op.Conflict.
+func (l *FileLocks) GetLock(op *fuseops.GetLockOp) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if c, ok := l.conflict(lockSet{op.Inode, false}, op.Owner, op.Lock); ok {
+		op.Conflict = c
+		return
+	}
+
+	op.Conflict = fuseops.FileLock{
+		Start: op.Lock.Start,
+		End:   op.Lock.End,
+		Type:  syscall.F_UNLCK,
+	}
+}
+
+// SetLock carries out op, returning EAGAIN if it conflicts with another
+// owner's lock and op.Wait isn't set, or EINTR if ctx is cancelled while it
+// waits.
+func (l *FileLocks) SetLock(ctx context.Context, op *fuseops.SetLockOp) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	set := lockSet{op.Inode, op.Flock}
+	for {
+		if _, ok := l.conflict(set, op.Owner, op.Lock); !ok {
+			break
+		}
+
+		if !op.Wait {
+			return syscall.EAGAIN
+		}
+
+		released := l.released
+		l.mu.Unlock()
+		select {
+		case <-released:
+			l.mu.Lock()
+
+		case <-ctx.Done():
+			l.mu.Lock()
+			return syscall.EINTR
+		}
+	}
+
+	l.set(set, op.Owner, op.Lock)
+	return nil
+}
+
+// ReleaseOwner drops every lock of either kind that owner holds on inode.
+func (l *FileLocks) ReleaseOwner(inode fuseops.InodeID, owner uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	all := fuseops.FileLock{
+		Start: 0,
+		End:   ^uint64(0),
+		Type:  syscall.F_UNLCK,
+	}
+
+	l.set(lockSet{inode, false}, owner, all)
+	l.set(lockSet{inode, true}, owner, all)
+}
+
+// Find a lock held by another owner that keeps lock from being taken.
+//
+// LOCKS_REQUIRED(l.mu)
+func (l *FileLocks) conflict(
+	set lockSet,
+	owner uint64,
+	lock fuseops.FileLock) (fuseops.FileLock, bool) {
+	if lock.Type == syscall.F_UNLCK {
+		return fuseops.FileLock{}, false
+	}
+
+	for _, h := range l.sets[set] {
+		if h.owner == owner || h.End < lock.Start || h.Start > lock.End {
+			continue
+		}
+
+		if lock.Type == syscall.F_WRLCK || h.Type == syscall.F_WRLCK {
+			return h.FileLock, true
+		}
+	}
+
+	return fuseops.FileLock{}, false
+}
+
+// Replace whatever owner holds on lock's range with lock, merging it with the
+// owner's adjacent locks of the same type.
+//
+// LOCKS_REQUIRED(l.mu)
+func (l *FileLocks) set(
+	set lockSet,
+	owner uint64,
+	lock fuseops.FileLock) {
+	var kept []heldLock
+	released := false
+	for _, h := range l.sets[set] {
+		if h.owner != owner || h.End < lock.Start || h.Start > lock.End {
+			kept = append(kept, h)
+			continue
+		}
+
+		// Keep the parts of the old lock either side of the range.
+		if h.Start < lock.Start {
+			before := h
+			before.End = lock.Start - 1
+			kept = append(kept, before)
+		}
+
+		if h.End > lock.End {
+			after := h
+			after.Start = lock.End + 1
+			kept = append(kept, after)
+		}
+
+		if h.Type != lock.Type {
+			released = true
+		}
+	}
+
+	if lock.Type != syscall.F_UNLCK {
+		merged := kept[:0]
+		for _, h := range kept {
+			if h.owner == owner &&
+				h.Type == lock.Type &&
+				(h.End+1 == lock.Start || lock.End+1 == h.Start) {
+				if h.Start < lock.Start {
+					lock.Start = h.Start
+				}
+
+				if h.End > lock.End {
+					lock.End = h.End
+				}
+
+				continue
+			}
+
+			merged = append(merged, h)
+		}
+
+		kept = append(merged, heldLock{owner: owner, FileLock: lock})
+	}
+
+	if len(kept) == 0 {
+		delete(l.sets, set)
+	} else {
+		l.sets[set] = kept
+	}
+
+	if released {
+		close(l.released)
+		l.released = make(chan struct{})
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fuseutil
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+const (
+	lockInode fuseops.InodeID = 17
+	toEOF                     = math.MaxInt64
+)
+
+func setLock(
+	l *FileLocks,
+	owner uint64,
+	typ uint32,
+	start uint64,
+	end uint64) error {
+	return l.SetLock(context.Background(), &fuseops.SetLockOp{
+		Inode: lockInode,
+		Owner: owner,
+		Lock:  fuseops.FileLock{Start: start, End: end, Type: typ, Pid: uint32(owner)},
+	})
+}
+
+func getLock(
+	l *FileLocks,
+	owner uint64,
+	typ uint32,
+	start uint64,
+	end uint64) fuseops.FileLock {
+	op := &fuseops.GetLockOp{
+		Inode: lockInode,
+		Owner: owner,
+		Lock:  fuseops.FileLock{Start: start, End: end, Type: typ},
+	}
+
+	l.GetLock(op)
+	return op.Conflict
+}
+
+// The fcntl(2) locks held on lockInode, sorted by start.
+func heldLocks(l *FileLocks) []heldLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	held := append([]heldLock(nil), l.sets[lockSet{lockInode, false}]...)
+	sort.Slice(held, func(i, j int) bool { return held[i].Start < held[j].Start })
+	return held
+}
+
+func held(owner uint64, typ uint32, start uint64, end uint64) heldLock {
+	return heldLock{
+		owner:    owner,
+		FileLock: fuseops.FileLock{Start: start, End: end, Type: typ, Pid: uint32(owner)},
+	}
+}
+
+func TestFileLocks_Conflicts(t *testing.T) {
+	l := NewFileLocks()
+	if err := setLock(l, 1, syscall.F_RDLCK, 0, 99); err != nil {
+		t.Fatalf("read lock: %v", err)
+	}
+
+	if err := setLock(l, 2, syscall.F_WRLCK, 100, toEOF); err != nil {
+		t.Fatalf("write lock: %v", err)
+	}
+
+	testCases := []struct {
+		name       string
+		owner      uint64
+		typ        uint32
+		start, end uint64
+		want       *heldLock
+	}{
+		{"shared read", 3, syscall.F_RDLCK, 50, 60, nil},
+		{"write over read", 3, syscall.F_WRLCK, 50, 60, &heldLock{1, fuseops.FileLock{0, 99, syscall.F_RDLCK, 1}}},
+		{"read over write", 3, syscall.F_RDLCK, 99, 100, &heldLock{2, fuseops.FileLock{100, toEOF, syscall.F_WRLCK, 2}}},
+		{"own lock", 2, syscall.F_WRLCK, 100, 200, nil},
+		{"read lock holder upgrading", 1, syscall.F_WRLCK, 0, 99, nil},
+	}
+
+	for _, tc := range testCases {
+		c := getLock(l, tc.owner, tc.typ, tc.start, tc.end)
+		err := setLock(l, tc.owner, tc.typ, tc.start, tc.end)
+		if tc.want == nil {
+			want := fuseops.FileLock{Start: tc.start, End: tc.end, Type: syscall.F_UNLCK}
+			if c != want {
+				t.Errorf("%s: GetLock reported %+v", tc.name, c)
+			}
+
+			if err != nil {
+				t.Errorf("%s: SetLock: %v", tc.name, err)
+			}
+
+			// Put things back as they were.
+			if tc.owner == 3 {
+				setLock(l, 3, syscall.F_UNLCK, 0, toEOF)
+			} else if tc.owner == 1 {
+				setLock(l, 1, syscall.F_RDLCK, 0, 99)
+			}
+
+			continue
+		}
+
+		if c != tc.want.FileLock {
+			t.Errorf("%s: GetLock reported %+v, want %+v", tc.name, c, tc.want.FileLock)
+		}
+
+		if err != syscall.EAGAIN {
+			t.Errorf("%s: SetLock returned %v, want EAGAIN", tc.name, err)
+		}
+	}
+
+	want := []heldLock{
+		held(1, syscall.F_RDLCK, 0, 99),
+		held(2, syscall.F_WRLCK, 100, toEOF),
+	}
+
+	if got := heldLocks(l); !reflect.DeepEqual(got, want) {
+		t.Errorf("held %+v, want %+v", got, want)
+	}
+}
+
+func TestFileLocks_SplitAndMerge(t *testing.T) {
+	l := NewFileLocks()
+	steps := []struct {
+		name       string
+		typ        uint32
+		start, end uint64
+		want       []heldLock
+	}{
+		{
+			"read lock",
+			syscall.F_RDLCK, 0, 99,
+			[]heldLock{held(1, syscall.F_RDLCK, 0, 99)},
+		},
+		{
+			"upgrade the middle",
+			syscall.F_WRLCK, 40, 59,
+			[]heldLock{
+				held(1, syscall.F_RDLCK, 0, 39),
+				held(1, syscall.F_WRLCK, 40, 59),
+				held(1, syscall.F_RDLCK, 60, 99),
+			},
+		},
+		{
+			"unlock across a boundary",
+			syscall.F_UNLCK, 50, 69,
+			[]heldLock{
+				held(1, syscall.F_RDLCK, 0, 39),
+				held(1, syscall.F_WRLCK, 40, 49),
+				held(1, syscall.F_RDLCK, 70, 99),
+			},
+		},
+		{
+			"downgrade, merging with both neighbours",
+			syscall.F_RDLCK, 40, 69,
+			[]heldLock{held(1, syscall.F_RDLCK, 0, 99)},
+		},
+		{
+			"extend to EOF",
+			syscall.F_RDLCK, 100, toEOF,
+			[]heldLock{held(1, syscall.F_RDLCK, 0, toEOF)},
+		},
+		{
+			"unlock all",
+			syscall.F_UNLCK, 0, toEOF,
+			nil,
+		},
+	}
+
+	for _, s := range steps {
+		if err := setLock(l, 1, s.typ, s.start, s.end); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+
+		if got := heldLocks(l); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%s: held %+v, want %+v", s.name, got, s.want)
+		}
+	}
+
+	if len(l.sets) != 0 {
+		t.Errorf("sets left behind: %v", l.sets)
+	}
+}
+
+func TestFileLocks_Wait(t *testing.T) {
+	l := NewFileLocks()
+	if err := setLock(l, 1, syscall.F_WRLCK, 0, toEOF); err != nil {
+		t.Fatalf("SetLock: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- l.SetLock(context.Background(), &fuseops.SetLockOp{
+			Inode: lockInode,
+			Owner: 2,
+			Lock:  fuseops.FileLock{Start: 10, End: 19, Type: syscall.F_RDLCK, Pid: 2},
+			Wait:  true,
+		})
+	}()
+
+	// Changes that leave the conflict in place don't let the waiter in.
+	setLock(l, 1, syscall.F_WRLCK, 0, 9)
+	setLock(l, 1, syscall.F_UNLCK, 30, toEOF)
+	select {
+	case err := <-done:
+		t.Fatalf("SetLock returned %v while the range was write locked", err)
+
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Downgrading does.
+	setLock(l, 1, syscall.F_RDLCK, 0, toEOF)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("SetLock: %v", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("SetLock still waiting after the downgrade")
+	}
+
+	want := []heldLock{
+		held(1, syscall.F_RDLCK, 0, toEOF),
+		held(2, syscall.F_RDLCK, 10, 19),
+	}
+
+	if got := heldLocks(l); !reflect.DeepEqual(got, want) {
+		t.Errorf("held %+v, want %+v", got, want)
+	}
+}
+
+func TestFileLocks_WaitCancelled(t *testing.T) {
+	l := NewFileLocks()
+	if err := setLock(l, 1, syscall.F_RDLCK, 0, toEOF); err != nil {
+		t.Fatalf("SetLock: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- l.SetLock(ctx, &fuseops.SetLockOp{
+			Inode: lockInode,
+			Owner: 2,
+			Lock:  fuseops.FileLock{Start: 0, End: 0, Type: syscall.F_WRLCK, Pid: 2},
+			Wait:  true,
+		})
+	}()
+
+	cancel()
+	if err := <-done; err != syscall.EINTR {
+		t.Errorf("SetLock returned %v, want EINTR", err)
+	}
+
+	want := []heldLock{held(1, syscall.F_RDLCK, 0, toEOF)}
+	if got := heldLocks(l); !reflect.DeepEqual(got, want) {
+		t.Errorf("held %+v, want %+v", got, want)
+	}
+}
+
+func TestFileLocks_ReleaseOwner(t *testing.T) {
+	l := NewFileLocks()
+	setLock(l, 1, syscall.F_RDLCK, 0, 9)
+	setLock(l, 1, syscall.F_WRLCK, 20, 29)
+	setLock(l, 2, syscall.F_RDLCK, 0, 9)
+
+	// Another inode's locks are unaffected.
+	other := &fuseops.SetLockOp{
+		Inode: lockInode + 1,
+		Owner: 1,
+		Lock:  fuseops.FileLock{Start: 0, End: toEOF, Type: syscall.F_WRLCK, Pid: 1},
+	}
+
+	if err := l.SetLock(context.Background(), other); err != nil {
+		t.Fatalf("SetLock: %v", err)
+	}
+
+	l.ReleaseOwner(lockInode, 1)
+
+	want := []heldLock{held(2, syscall.F_RDLCK, 0, 9)}
+	if got := heldLocks(l); !reflect.DeepEqual(got, want) {
+		t.Errorf("held %+v, want %+v", got, want)
+	}
+
+	if got := len(l.sets[lockSet{lockInode + 1, false}]); got != 1 {
+		t.Errorf("%d locks left on the other inode, want 1", got)
+	}
+
+	// Releasing an owner with nothing held is harmless.
+	l.ReleaseOwner(lockInode, 1)
+	l.ReleaseOwner(lockInode+2, 1)
+}
+
+func TestFileLocks_Flock(t *testing.T) {
+	l := NewFileLocks()
+	flock := func(owner uint64, typ uint32) error {
+		return l.SetLock(context.Background(), &fuseops.SetLockOp{
+			Inode: lockInode,
+			Owner: owner,
+			Lock:  fuseops.FileLock{Start: 0, End: toEOF, Type: typ, Pid: uint32(owner)},
+			Flock: true,
+		})
+	}
+
+	// flock(2) locks conflict with each other, but not with fcntl(2) locks.
+	if err := setLock(l, 1, syscall.F_WRLCK, 0, toEOF); err != nil {
+		t.Fatalf("fcntl lock: %v", err)
+	}
+
+	if err := flock(2, syscall.F_WRLCK); err != nil {
+		t.Fatalf("flock: %v", err)
+	}
+
+	if err := flock(3, syscall.F_RDLCK); err != syscall.EAGAIN {
+		t.Errorf("Conflicting flock returned %v, want EAGAIN", err)
+	}
+
+	if c := getLock(l, 3, syscall.F_RDLCK, 0, toEOF); c != (fuseops.FileLock{0, toEOF, syscall.F_WRLCK, 1}) {
+		t.Errorf("GetLock reported %+v", c)
+	}
+
+	// Releasing an owner drops its locks of both kinds.
+	if err := flock(1, syscall.F_RDLCK); err != syscall.EAGAIN {
+		t.Errorf("Conflicting flock returned %v, want EAGAIN", err)
+	}
+
+	l.ReleaseOwner(lockInode, 2)
+	if err := flock(1, syscall.F_RDLCK); err != nil {
+		t.Errorf("flock: %v", err)
+	}
+
+	l.ReleaseOwner(lockInode, 1)
+	if len(l.sets) != 0 {
+		t.Errorf("sets left behind: %v", l.sets)
+	}
+}
@@ -16,7 +16,6 @@ package fuseutil
 
 import (
 	"context"
-	"io"
 	"sync"
 
 	"github.com/jacobsa/fuse"
@@ -50,6 +49,7 @@ type FileSystem interface {
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
 	ReadDir(context.Context, *fuseops.ReadDirOp) error
 	ReleaseDirHandle(context.Context, *fuseops.ReleaseDirHandleOp) error
+	SyncDir(context.Context, *fuseops.SyncDirOp) error
 	OpenFile(context.Context, *fuseops.OpenFileOp) error
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
 	WriteFile(context.Context, *fuseops.WriteFileOp) error
@@ -62,13 +62,38 @@ type FileSystem interface {
 	ListXattr(context.Context, *fuseops.ListXattrOp) error
 	SetXattr(context.Context, *fuseops.SetXattrOp) error
 	Fallocate(context.Context, *fuseops.FallocateOp) error
+	Lseek(context.Context, *fuseops.LseekOp) error
+	CopyFileRange(context.Context, *fuseops.CopyFileRangeOp) error
+	GetLock(context.Context, *fuseops.GetLockOp) error
+	SetLock(context.Context, *fuseops.SetLockOp) error
+	Poll(context.Context, *fuseops.PollOp) error
+	Ioctl(context.Context, *fuseops.IoctlOp) error
+	Access(context.Context, *fuseops.AccessOp) error
 
 	// Regard all inodes (including the root inode) as having their lookup counts
 	// decremented to zero, and clean up any resources associated with the file
 	// system. No further calls to the file system will be made.
+	//
+	// This is called exactly once, after the kernel connection has ended
+	// (whether by unmounting or by the connection being aborted) and every
+	// other call has returned, and before MountedFileSystem.Join returns.
+	// If the file system is served on several connections at once, this is
+	// called only when the last of them ends. See MountDestroyer.
 	Destroy()
 }
 
+// A FileSystem served on several connections at once (see
+// NewFileSystemServer) may implement this interface to learn when one of
+// them ends. Each end implicitly decrements to zero the lookup counts of all
+// inodes with respect to that connection, and invalidates its handles.
+//
+// DestroyMount is called once for each connection, after all other calls for
+// ops read from it have returned, and before Destroy in the case of the last
+// connection.
+type MountDestroyer interface {
+	DestroyMount(mount fuse.MountInfo)
+}
+
 // Create a fuse.Server that handles ops by calling the associated FileSystem
 // method.Respond with the resulting error. Unsupported ops are responded to
 // directly with ENOSYS.
@@ -76,62 +101,491 @@ type FileSystem interface {
 // Each call to a FileSystem method (except ForgetInode) is made on
 // its own goroutine, and is free to block. ForgetInode may be called
 // synchronously, and should not depend on calls to other methods
-// being received concurrently.
+// being received concurrently. A fuseops.BatchForgetOp from the kernel
+// becomes a ForgetInode call for each of its entries, in order.
+//
+// A panic in a method is recovered and reported with
+// fuse.Connection.ReportPanic, which logs it with the op and its request ID
+// to the ErrorLogger, and the op fails with EIO. The server carries on
+// serving other ops, though the panic may have left the file system's own
+// state inconsistent.
 //
 // (It is safe to naively process ops concurrently because the kernel
 // guarantees to serialize operations that the user expects to happen in order,
 // cf. http://goo.gl/jnkHPO, fuse-devel thread "Fuse guarantees on concurrent
 // requests").
+//
+// The server keeps track of any values the file system attaches to handles
+// using the HandleData field of OpenFileOp, CreateFileOp and OpenDirOp. See
+// the notes on OpenFileOp.HandleData. In strict mode the handle IDs it chooses
+// also carry a generation, so that ops naming released handles are caught
+// rather than silently reaching a later handle; see fuse.StrictStaleHandle.
+//
+// ReadDir calls for the same directory handle are made one at a time, so a
+// file system that keeps a position per handle (see DirCursor) needn't lock
+// it against concurrent reads.
+//
+// Calls for the same file handle are otherwise concurrent, with one
+// exception: a SyncFile or FlushFile call is not made until every WriteFile
+// call for the same handle that the kernel sent before the sync or flush has
+// returned, including writes held up by a freeze (see
+// fuse.MountedFileSystem.Freeze). If the sync or flush succeeds but one of
+// those writes failed, the server replies with the write's error instead, so
+// that success means every earlier write on the handle succeeded. Each
+// failure is reported by at most one sync or flush, as for fsync(2) on Linux.
+// "Earlier" is the order in which the kernel sent the ops, which needn't be
+// the order in which the file system sees them, and the guarantee holds
+// however the calls are scheduled. It says nothing about writes on other
+// handles for the same inode; note that with writeback caching the kernel
+// may send the writes for a file descriptor on any handle open for writing. A
+// file system that gives every open the same handle ID can't be told which of
+// an inode's file descriptors an op came from, so its syncs and flushes wait
+// for the inode's writes through each of them.
+//
+// Unlike most servers, the result may be mounted at several mount points at
+// once, to expose the same file system in more than one place. Inode IDs are
+// the file system's own and mean the same on every connection, which is what
+// lets fuse.MountGroup send an inode's invalidations to all of them. But each
+// kernel connection has its own handle IDs, lookup counts and directory
+// positions (e.g. those kept in a DirCursor attached to a handle). The server
+// keeps HandleData separately for each connection. A file system that mints
+// handle IDs itself or tracks lookup counts must likewise key them by the
+// connection identified by fuse.MountInfoFromContext; see LookupCounts and
+// MountDestroyer.
+//
+// If the file system implements HandleLeakReleaser, the server also keeps
+// track of which handles are open, so that it can report those never released
+// when a connection ends.
+//
+// If the file system implements fuse.CapabilityReporter, the server passes on
+// the capabilities it declares. Likewise, if it implements
+// fuse.InitNegotiator, the server passes on each connection's init
+// negotiation.
 func NewFileSystemServer(fs FileSystem) fuse.Server {
 	return &fileSystemServer{
 		fs: fs,
 	}
 }
 
+// NewSerialFileSystemServer is like NewFileSystemServer, but calls the
+// FileSystem's methods one at a time, so that a simple file system needn't
+// lock its state. This includes calls for different connections, and those
+// of the optional interfaces (Destroy, MountDestroyer and so on).
+//
+// Ops are still received concurrently, and the server's own work, such as
+// waiting for a freeze or for earlier writes before a sync, happens outside
+// the serialization. But a method that blocks holds up every other op until
+// it returns, so methods must not wait for other ops: e.g. a SetLock with
+// Wait set must fail with EAGAIN rather than wait for the lock to be
+// released, and the file system must not wait for an invalidation whose
+// reply depends on the kernel reaching it with another op.
+func NewSerialFileSystemServer(fs FileSystem) fuse.Server {
+	return &fileSystemServer{
+		fs:     fs,
+		serial: true,
+	}
+}
+
 type fileSystemServer struct {
-	fs          FileSystem
+	fs FileSystem
+
+	// Whether calls to fs are made one at a time, holding fsMu.
+	serial bool
+	fsMu   sync.Mutex
+
+	mu sync.Mutex
+
+	// The number of connections currently being served.
+	//
+	// GUARDED_BY(mu)
+	connections int
+}
+
+// State for one of the connections served by a fileSystemServer.
+type servedConnection struct {
+	c           *fuse.Connection
 	opsInFlight sync.WaitGroup
+
+	// Values attached to handles via the HandleData fields of ops.
+	handles handleTable
+
+	// The contexts handed out by HandleContext.
+	handleContexts handleContexts
+
+	// The handles that have been opened and not released, if the file system
+	// implements HandleLeakReleaser. Otherwise nil.
+	open *openHandles
+
+	// The lookup counts of the inodes on the connection, if the file system
+	// implements ForgetAller. Otherwise nil.
+	live *liveInodes
+
+	// The writes that syncs and flushes must wait for.
+	writes writeBarriers
+
+	mu sync.Mutex
+
+	// A lock for each directory handle with a ReadDir call in progress or
+	// waiting, used to make the calls one at a time.
+	//
+	// GUARDED_BY(mu)
+	dirLocks map[fuseops.HandleID]*dirLock
+}
+
+type dirLock struct {
+	mu sync.Mutex
+
+	// The number of ReadDir calls holding or waiting for mu.
+	//
+	// GUARDED_BY(servedConnection.mu)
+	refs int
+}
+
+// Wait until no other ReadDir call for the given handle is in progress. The
+// caller must later call unlockDir.
+//
+// LOCKS_EXCLUDED(sc.mu)
+func (sc *servedConnection) lockDir(h fuseops.HandleID) {
+	sc.mu.Lock()
+	if sc.dirLocks == nil {
+		sc.dirLocks = make(map[fuseops.HandleID]*dirLock)
+	}
+
+	l := sc.dirLocks[h]
+	if l == nil {
+		l = &dirLock{}
+		sc.dirLocks[h] = l
+	}
+
+	l.refs++
+	sc.mu.Unlock()
+
+	l.mu.Lock()
 }
 
+// LOCKS_EXCLUDED(sc.mu)
+func (sc *servedConnection) unlockDir(h fuseops.HandleID) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	l := sc.dirLocks[h]
+	l.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(sc.dirLocks, h)
+	}
+}
+
+// Wait until no other call to s.fs is in progress, if s.fs is to be called one
+// call at a time. The caller must later call unlockFS.
+//
+// LOCKS_EXCLUDED(s.fsMu)
+func (s *fileSystemServer) lockFS() {
+	if s.serial {
+		s.fsMu.Lock()
+	}
+}
+
+// LOCKS_REQUIRED(s.fsMu)
+func (s *fileSystemServer) unlockFS() {
+	if s.serial {
+		s.fsMu.Unlock()
+	}
+}
+
+// LOCKS_EXCLUDED(s.mu)
 func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
+	s.serveOps(c, nil)
+}
+
+// Capabilities implements fuse.CapabilityReporter, for a file system that
+// implements it too.
+func (s *fileSystemServer) Capabilities() *fuse.Capabilities {
+	if r, ok := s.fs.(fuse.CapabilityReporter); ok {
+		return r.Capabilities()
+	}
+
+	return nil
+}
+
+// NegotiateInit implements fuse.InitNegotiator, for a file system that
+// implements it too.
+func (s *fileSystemServer) NegotiateInit(n *fuse.InitNegotiation) error {
+	if ni, ok := s.fs.(fuse.InitNegotiator); ok {
+		s.lockFS()
+		defer s.unlockFS()
+		return ni.NegotiateInit(n)
+	}
+
+	return nil
+}
+
+// Serve ops read from c. If r is non-nil, the connection's state is restored
+// from and saved by it.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *fileSystemServer) serveOps(
+	c *fuse.Connection,
+	r *ResumableServer) {
+	sc := &servedConnection{c: c}
+	sc.handles.generations = c.StrictCheckEnabled(fuse.StrictStaleHandle)
+	if _, ok := s.fs.(HandleLeakReleaser); ok {
+		sc.open = newOpenHandles()
+	}
+
+	if _, ok := s.fs.(ForgetAller); ok || r != nil {
+		sc.live = newLiveInodes()
+	}
+
+	if r != nil {
+		r.attach(sc)
+	}
+
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+
 	// When we are done, we clean up by waiting for all in-flight ops then
-	// destroying the file system.
+	// destroying the file system, if this was the last connection. A
+	// connection handed to another process lives on there, so it is left be.
 	defer func() {
-		s.opsInFlight.Wait()
-		s.fs.Destroy()
+		sc.opsInFlight.Wait()
+		sc.handleContexts.releaseAll()
+
+		if r != nil && r.detach(sc) {
+			s.mu.Lock()
+			s.connections--
+			s.mu.Unlock()
+			return
+		}
+
+		s.lockFS()
+		if r, ok := s.fs.(HandleLeakReleaser); ok {
+			for _, h := range sc.open.remaining() {
+				r.ReleaseLeakedHandle(c.MountInfo(), h)
+			}
+		}
+
+		if f, ok := s.fs.(ForgetAller); ok {
+			if remaining := sc.live.remaining(); len(remaining) > 0 {
+				f.ForgetAll(c.MountInfo(), remaining)
+			}
+		}
+
+		if d, ok := s.fs.(MountDestroyer); ok {
+			d.DestroyMount(c.MountInfo())
+		}
+		s.unlockFS()
+
+		s.mu.Lock()
+		s.connections--
+		last := s.connections == 0
+		s.mu.Unlock()
+
+		if last {
+			s.lockFS()
+			s.fs.Destroy()
+			s.unlockFS()
+		}
 	}()
 
 	for {
+		// Stop once the kernel hangs up. Any other error is reported by Join.
 		ctx, op, err := c.ReadOp()
-		if err == io.EOF {
+		if err != nil {
 			break
 		}
 
-		if err != nil {
-			panic(err)
-		}
+		// Decide what syncs and flushes must wait for while ops are still in
+		// the order the kernel sent them.
+		t := sc.writes.arrive(op)
 
-		s.opsInFlight.Add(1)
-		if _, ok := op.(*fuseops.ForgetInodeOp); ok {
+		sc.opsInFlight.Add(1)
+		switch op.(type) {
+		case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
 			// Special case: call in this goroutine for
 			// forget inode ops, which may come in a
 			// flurry from the kernel and are generally
 			// cheap for the file system to handle
-			s.handleOp(c, ctx, op)
-		} else {
-			go s.handleOp(c, ctx, op)
+			s.handleOp(sc, ctx, op, t)
+
+		default:
+			go s.handleOp(sc, ctx, op, t)
 		}
 	}
 }
 
+// Return the handle named by op, if it names one.
+func opHandle(op interface{}) (h fuseops.HandleID, ok bool) {
+	switch typed := op.(type) {
+	case *fuseops.SetInodeAttributesOp:
+		if typed.Handle != nil {
+			return *typed.Handle, true
+		}
+
+	case *fuseops.ReadDirOp:
+		return typed.Handle, true
+
+	case *fuseops.ReleaseDirHandleOp:
+		return typed.Handle, true
+
+	case *fuseops.SyncDirOp:
+		return typed.Handle, true
+
+	case *fuseops.ReadFileOp:
+		return typed.Handle, true
+
+	case *fuseops.WriteFileOp:
+		return typed.Handle, true
+
+	case *fuseops.SyncFileOp:
+		return typed.Handle, true
+
+	case *fuseops.FlushFileOp:
+		return typed.Handle, true
+
+	case *fuseops.ReleaseFileHandleOp:
+		return typed.Handle, true
+
+	case *fuseops.FallocateOp:
+		return typed.Handle, true
+
+	case *fuseops.LseekOp:
+		return typed.Handle, true
+
+	case *fuseops.CopyFileRangeOp:
+		return typed.DstHandle, true
+
+	case *fuseops.GetLockOp:
+		return typed.Handle, true
+
+	case *fuseops.SetLockOp:
+		return typed.Handle, true
+
+	case *fuseops.PollOp:
+		return typed.Handle, true
+
+	case *fuseops.IoctlOp:
+		return typed.Handle, true
+	}
+
+	return 0, false
+}
+
 func (s *fileSystemServer) handleOp(
-	c *fuse.Connection,
+	sc *servedConnection,
 	ctx context.Context,
-	op interface{}) {
-	defer s.opsInFlight.Done()
+	op interface{},
+	t barrierTicket) {
+	defer sc.opsInFlight.Done()
+
+	// A panic in the file system's methods fails just their op (see call). One
+	// in the server itself still takes the process down, but is recorded
+	// first.
+	defer func() {
+		if r := recover(); r != nil {
+			sc.c.ReportPanic(ctx, op, r)
+			panic(r)
+		}
+	}()
+
+	// Let the file system find the handle's context. See HandleContext.
+	if key, ok := opHandleKey(op); ok {
+		_, releaseFile := op.(*fuseops.ReleaseFileHandleOp)
+		_, releaseDir := op.(*fuseops.ReleaseDirHandleOp)
+		ctx = context.WithValue(ctx, handleContextKey, &handleRef{
+			contexts: &sc.handleContexts,
+			parent:   sc.c.OpContext(),
+			key:      key,
+			released: releaseFile || releaseDir,
+		})
+	}
+
+	// Whatever the outcome of a write, later syncs and flushes mustn't wait
+	// for it any more once the kernel has been told.
+	reply := func(err error) {
+		sc.writes.finish(t, err)
+		sc.c.Reply(ctx, err)
+	}
+
+	// Hold mutating ops while the file system is frozen.
+	if err := sc.c.WaitForThaw(ctx); err != nil {
+		reply(err)
+		return
+	}
+
+	// In strict mode, catch handles used after they were released.
+	if h, ok := opHandle(op); ok {
+		if stale := sc.handles.check(h); stale != nil {
+			if err := sc.c.ReportStrictViolation(ctx, op, stale); err != nil {
+				reply(err)
+				return
+			}
+		}
+	}
+
+	// Let the file system refuse the op first, if configured to.
+	if check := sc.c.AccessCheck(op); check != nil {
+		err := s.call(sc, ctx, op, func() error { return s.fs.Access(ctx, check) })
+		if err != nil {
+			reply(err)
+			return
+		}
+	}
+
+	// Let syncs and flushes see earlier writes on their handles finish.
+	if err := sc.writes.wait(ctx, t); err != nil {
+		reply(err)
+		return
+	}
+
+	// Hold the op while the file system is working on as many as it can
+	// take. See MountConfig.ConcurrencyLimit.
+	if err := sc.c.WaitForCapacity(ctx); err != nil {
+		reply(err)
+		return
+	}
 
 	// Dispatch to the appropriate method.
-	var err error
+	err := s.call(sc, ctx, op, func() error { return s.dispatch(sc, ctx, op, t) })
+	if err == nil {
+		sc.live.replied(op)
+	}
+
+	reply(err)
+}
+
+// Call f, which calls into the file system for op, holding the file system
+// lock if calls are serialized. A panic in f is reported with
+// fuse.Connection.ReportPanic and becomes EIO, so that other ops carry on.
+//
+// LOCKS_EXCLUDED(s.fsMu)
+func (s *fileSystemServer) call(
+	sc *servedConnection,
+	ctx context.Context,
+	op interface{},
+	f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			sc.c.ReportPanic(ctx, op, r)
+			err = fuse.EIO
+		}
+	}()
+
+	s.lockFS()
+	defer s.unlockFS()
+
+	return f()
+}
+
+// Call the FileSystem method for op, keeping the server's records of handles
+// and inodes in step with the result.
+func (s *fileSystemServer) dispatch(
+	sc *servedConnection,
+	ctx context.Context,
+	op interface{},
+	t barrierTicket) (err error) {
 	switch typed := op.(type) {
 	default:
 		err = fuse.ENOSYS
@@ -146,11 +600,24 @@ func (s *fileSystemServer) handleOp(
 		err = s.fs.GetInodeAttributes(ctx, typed)
 
 	case *fuseops.SetInodeAttributesOp:
+		if typed.Handle != nil {
+			typed.HandleData = sc.handles.get(*typed.Handle)
+		}
 		err = s.fs.SetInodeAttributes(ctx, typed)
 
 	case *fuseops.ForgetInodeOp:
+		sc.live.forgotten(typed.Inode, typed.N)
 		err = s.fs.ForgetInode(ctx, typed)
 
+	case *fuseops.BatchForgetOp:
+		for i := range typed.Forgets {
+			f := &typed.Forgets[i]
+			sc.live.forgotten(f.Inode, f.N)
+			if ferr := s.fs.ForgetInode(ctx, f); err == nil {
+				err = ferr
+			}
+		}
+
 	case *fuseops.MkDirOp:
 		err = s.fs.MkDir(ctx, typed)
 
@@ -159,6 +626,19 @@ func (s *fileSystemServer) handleOp(
 
 	case *fuseops.CreateFileOp:
 		err = s.fs.CreateFile(ctx, typed)
+		if err == nil && typed.HandleData != nil {
+			typed.Handle = sc.handles.add(
+				typed.HandleData,
+				handleOwner{inode: typed.Entry.Child})
+		}
+
+		if err == nil {
+			sc.open.opened(LeakedHandle{
+				Inode:      typed.Entry.Child,
+				Handle:     typed.Handle,
+				HandleData: typed.HandleData,
+			})
+		}
 
 	case *fuseops.CreateLinkOp:
 		err = s.fs.CreateLink(ctx, typed)
@@ -177,30 +657,84 @@ func (s *fileSystemServer) handleOp(
 
 	case *fuseops.OpenDirOp:
 		err = s.fs.OpenDir(ctx, typed)
+		if err == nil && typed.HandleData != nil {
+			typed.Handle = sc.handles.add(
+				typed.HandleData,
+				handleOwner{inode: typed.Inode, dir: true})
+		}
+
+		if err == nil {
+			sc.open.opened(LeakedHandle{
+				Dir:        true,
+				Inode:      typed.Inode,
+				Handle:     typed.Handle,
+				HandleData: typed.HandleData,
+			})
+		}
 
 	case *fuseops.ReadDirOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
+		sc.lockDir(typed.Handle)
+		defer sc.unlockDir(typed.Handle)
 		err = s.fs.ReadDir(ctx, typed)
 
 	case *fuseops.ReleaseDirHandleOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
+		sc.handleContexts.release(handleKey{typed.Handle, true})
 		err = s.fs.ReleaseDirHandle(ctx, typed)
 
+		// The kernel won't use the handle again, whatever the outcome. But if
+		// the file system failed to release it, it has leaked.
+		sc.handles.remove(typed.Handle)
+		if err == nil {
+			sc.open.released(true, typed.Handle)
+		}
+
+	case *fuseops.SyncDirOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
+		err = s.fs.SyncDir(ctx, typed)
+
 	case *fuseops.OpenFileOp:
 		err = s.fs.OpenFile(ctx, typed)
+		if err == nil && typed.HandleData != nil {
+			typed.Handle = sc.handles.add(
+				typed.HandleData,
+				handleOwner{inode: typed.Inode})
+		}
+
+		if err == nil {
+			sc.open.opened(LeakedHandle{
+				Inode:      typed.Inode,
+				Handle:     typed.Handle,
+				HandleData: typed.HandleData,
+			})
+		}
 
 	case *fuseops.ReadFileOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
 		err = s.fs.ReadFile(ctx, typed)
 
 	case *fuseops.WriteFileOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
 		err = s.fs.WriteFile(ctx, typed)
 
 	case *fuseops.SyncFileOp:
-		err = s.fs.SyncFile(ctx, typed)
+		typed.HandleData = sc.handles.get(typed.Handle)
+		err = sc.writes.result(t, s.fs.SyncFile(ctx, typed))
 
 	case *fuseops.FlushFileOp:
-		err = s.fs.FlushFile(ctx, typed)
+		typed.HandleData = sc.handles.get(typed.Handle)
+		err = sc.writes.result(t, s.fs.FlushFile(ctx, typed))
 
 	case *fuseops.ReleaseFileHandleOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
+		sc.handleContexts.release(handleKey{typed.Handle, false})
 		err = s.fs.ReleaseFileHandle(ctx, typed)
+		sc.handles.remove(typed.Handle)
+		sc.writes.released(typed.Inode, typed.Handle)
+		if err == nil {
+			sc.open.released(false, typed.Handle)
+		}
 
 	case *fuseops.ReadSymlinkOp:
 		err = s.fs.ReadSymlink(ctx, typed)
@@ -218,8 +752,36 @@ func (s *fileSystemServer) handleOp(
 		err = s.fs.SetXattr(ctx, typed)
 
 	case *fuseops.FallocateOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
 		err = s.fs.Fallocate(ctx, typed)
-	}
 
-	c.Reply(ctx, err)
+	case *fuseops.LseekOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
+		err = s.fs.Lseek(ctx, typed)
+
+	case *fuseops.CopyFileRangeOp:
+		typed.SrcHandleData = sc.handles.get(typed.SrcHandle)
+		typed.DstHandleData = sc.handles.get(typed.DstHandle)
+		err = s.fs.CopyFileRange(ctx, typed)
+
+	case *fuseops.GetLockOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
+		err = s.fs.GetLock(ctx, typed)
+
+	case *fuseops.SetLockOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
+		err = s.fs.SetLock(ctx, typed)
+
+	case *fuseops.PollOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
+		err = s.fs.Poll(ctx, typed)
+
+	case *fuseops.IoctlOp:
+		typed.HandleData = sc.handles.get(typed.Handle)
+		err = s.fs.Ioctl(ctx, typed)
+
+	case *fuseops.AccessOp:
+		err = s.fs.Access(ctx, typed)
+	}
+	return err
 }
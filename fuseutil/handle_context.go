@@ -0,0 +1,160 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+type handleContextKeyType struct{}
+
+var handleContextKey interface{} = handleContextKeyType{}
+
+// A handle as named by ops. File systems may give files and directories the
+// same handle IDs.
+type handleKey struct {
+	handle fuseops.HandleID
+	dir    bool
+}
+
+// Return the handle named by op, if any.
+func opHandleKey(op interface{}) (handleKey, bool) {
+	switch typed := op.(type) {
+	case *fuseops.ReadDirOp:
+		return handleKey{typed.Handle, true}, true
+
+	case *fuseops.ReleaseDirHandleOp:
+		return handleKey{typed.Handle, true}, true
+
+	case *fuseops.SyncDirOp:
+		return handleKey{typed.Handle, true}, true
+	}
+
+	if h, ok := opHandle(op); ok {
+		return handleKey{h, false}, true
+	}
+
+	return handleKey{}, false
+}
+
+// The contexts handed out by HandleContext for the handles of a connection,
+// created when first asked for.
+type handleContexts struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	contexts map[handleKey]*handleContext
+}
+
+type handleContext struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// What the context of an op naming a handle carries for HandleContext.
+type handleRef struct {
+	contexts *handleContexts
+	parent   context.Context
+	key      handleKey
+
+	// Set if the op releases the handle, whose context is then already done.
+	released bool
+}
+
+// Return the context for the given handle, deriving it from parent if it
+// doesn't yet exist.
+//
+// LOCKS_EXCLUDED(hc.mu)
+func (hc *handleContexts) get(
+	parent context.Context,
+	key handleKey) context.Context {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if c, ok := hc.contexts[key]; ok {
+		return c.ctx
+	}
+
+	if hc.contexts == nil {
+		hc.contexts = make(map[handleKey]*handleContext)
+	}
+
+	c := &handleContext{}
+	c.ctx, c.cancel = context.WithCancel(parent)
+	hc.contexts[key] = c
+
+	return c.ctx
+}
+
+// Cancel the context for the given handle, if one was handed out.
+//
+// LOCKS_EXCLUDED(hc.mu)
+func (hc *handleContexts) release(key handleKey) {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if c, ok := hc.contexts[key]; ok {
+		c.cancel()
+		delete(hc.contexts, key)
+	}
+}
+
+// Cancel the contexts of all handles, once the connection has ended.
+//
+// LOCKS_EXCLUDED(hc.mu)
+func (hc *handleContexts) releaseAll() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	for key, c := range hc.contexts {
+		c.cancel()
+		delete(hc.contexts, key)
+	}
+}
+
+// HandleContext returns a context for work done on behalf of the file or
+// directory handle named by the op whose context is ctx, for use by servers
+// made by NewFileSystemServer.
+//
+// An op's own context is cancelled when the op is interrupted, and once it
+// has been replied to. The handle's context lives on until the handle is
+// released, and is cancelled just before ReleaseFileHandle or
+// ReleaseDirHandle is called for it (or when the connection ends, for
+// handles never released). So it suits backend work that outlives the op
+// but is pointless once the file is closed, such as prefetching the next
+// part of a file, or a hedged read (see Hedger) whose result is cached for
+// later reads. Work that serves only the op itself should use the op's
+// context.
+//
+// The handle's context derives from the connection's MountConfig.OpContext,
+// not from ctx. If the op names no handle, for example because it is an
+// OpenFileOp, which creates a handle, HandleContext returns ctx.
+func HandleContext(ctx context.Context) context.Context {
+	ref, ok := ctx.Value(handleContextKey).(*handleRef)
+	if !ok {
+		return ctx
+	}
+
+	if ref.released {
+		done, cancel := context.WithCancel(ref.parent)
+		cancel()
+		return done
+	}
+
+	return ref.contexts.get(ref.parent, ref.key)
+}
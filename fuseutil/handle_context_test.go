@@ -0,0 +1,212 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system whose reads start a prefetch that runs until the handle's
+// context is cancelled, as a slow backend read would.
+type prefetchFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// For each handle, a channel closed when its prefetch gives up. The
+	// prefetch is started by the first read.
+	//
+	// GUARDED_BY(mu)
+	stopped map[fuseops.HandleID]chan struct{}
+
+	// The last handle handed out.
+	//
+	// GUARDED_BY(mu)
+	lastHandle fuseops.HandleID
+
+	// Whether the handle's context was still live after ReadFile returned,
+	// and whether it was done by the time ReleaseFileHandle was called.
+	//
+	// GUARDED_BY(mu)
+	outlivedOp    bool
+	doneAtRelease bool
+}
+
+func (fs *prefetchFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lastHandle++
+	op.Handle = fs.lastHandle
+	return nil
+}
+
+func (fs *prefetchFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	hctx := fuseutil.HandleContext(ctx)
+	if hctx == ctx {
+		return fuse.EIO
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if _, ok := fs.stopped[op.Handle]; ok {
+		return nil
+	}
+
+	stopped := make(chan struct{})
+	fs.stopped[op.Handle] = stopped
+
+	go func() {
+		// Outlive the op.
+		time.Sleep(10 * time.Millisecond)
+
+		fs.mu.Lock()
+		fs.outlivedOp = hctx.Err() == nil
+		fs.mu.Unlock()
+
+		<-hctx.Done()
+		close(stopped)
+	}()
+
+	return nil
+}
+
+func (fs *prefetchFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.doneAtRelease = fuseutil.HandleContext(ctx).Err() != nil
+	return nil
+}
+
+func (fs *prefetchFS) awaitStopped(
+	t *testing.T,
+	h fuseops.HandleID) {
+	fs.mu.Lock()
+	stopped := fs.stopped[h]
+	fs.mu.Unlock()
+
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Prefetch for handle %d still running", h)
+	}
+}
+
+func newPrefetchKernel(t *testing.T) (*fusetesting.FakeKernel, *prefetchFS) {
+	fs := &prefetchFS{stopped: make(map[fuseops.HandleID]chan struct{})}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	return k, fs
+}
+
+func TestHandleContext_CancelledOnRelease(t *testing.T) {
+	k, fs := newPrefetchKernel(t)
+	defer k.Close()
+
+	h1, err := k.Open(2)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	h2, err := k.Open(2)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for _, h := range []fuseops.HandleID{h1, h2} {
+		if _, err := k.Read(2, h, 0, 4096); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+
+	// Closing one file stops its prefetch promptly, but not the other's.
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	if err := k.Release(2, h1); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	fs.awaitStopped(t, h1)
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Prefetch stopped %v after release", d)
+	}
+
+	fs.mu.Lock()
+	if !fs.outlivedOp || !fs.doneAtRelease {
+		t.Errorf("Outlived op: %v, done at release: %v", fs.outlivedOp, fs.doneAtRelease)
+	}
+	stopped := fs.stopped[h2]
+	fs.mu.Unlock()
+
+	select {
+	case <-stopped:
+		t.Errorf("Prefetch for the other handle stopped")
+	default:
+	}
+
+	// A later read of the other handle finds the same context.
+	if _, err := k.Read(2, h2, 4096, 4096); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+}
+
+func TestHandleContext_CancelledWhenConnectionEnds(t *testing.T) {
+	k, fs := newPrefetchKernel(t)
+
+	h, err := k.Open(2)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if _, err := k.Read(2, h, 0, 4096); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	// The kernel hangs up without releasing the handle.
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	fs.awaitStopped(t, h)
+}
+
+func TestHandleContext_NoHandle(t *testing.T) {
+	ctx := context.Background()
+	if got := fuseutil.HandleContext(ctx); got != ctx {
+		t.Errorf("Got %v, want the op's context", got)
+	}
+}
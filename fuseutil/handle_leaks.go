@@ -0,0 +1,142 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A FileSystem may implement this interface to clean up after handles that
+// were opened on a connection but never released: those the kernel didn't
+// release before the connection ended, as happens when it is aborted, and
+// those for which ReleaseFileHandle or ReleaseDirHandle returned an error.
+// Without it, any backend resources held for such handles leak silently.
+//
+// When a connection ends, ReleaseLeakedHandle is called once for each such
+// handle, after all other calls for ops read from the connection have
+// returned and before DestroyMount. It is not called at all if every handle
+// was released successfully.
+type HandleLeakReleaser interface {
+	ReleaseLeakedHandle(mount fuse.MountInfo, h LeakedHandle)
+}
+
+// LeakedHandle describes a handle that was never released. See
+// HandleLeakReleaser.
+type LeakedHandle struct {
+	// Whether the handle was opened by OpenDir, rather than by OpenFile or
+	// CreateFile.
+	Dir bool
+
+	// The inode that was opened, and the ID of the handle.
+	Inode  fuseops.InodeID
+	Handle fuseops.HandleID
+
+	// The value attached to the handle via HandleData, if any.
+	HandleData interface{}
+}
+
+type openHandleKey struct {
+	dir bool
+	h   fuseops.HandleID
+}
+
+// The handles open on a connection, for finding those that leak. A nil
+// *openHandles tracks nothing.
+type openHandles struct {
+	mu sync.Mutex
+
+	// The open handles with each key. There may be more than one when the file
+	// system chooses handle IDs itself and reuses them.
+	//
+	// INVARIANT: For each v, len(v) > 0
+	//
+	// GUARDED_BY(mu)
+	handles map[openHandleKey][]LeakedHandle
+}
+
+func newOpenHandles() *openHandles {
+	return &openHandles{
+		handles: make(map[openHandleKey][]LeakedHandle),
+	}
+}
+
+// Record that the supplied handle was opened.
+//
+// LOCKS_EXCLUDED(o.mu)
+func (o *openHandles) opened(h LeakedHandle) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	k := openHandleKey{h.Dir, h.Handle}
+	o.handles[k] = append(o.handles[k], h)
+}
+
+// Record that a handle with the given ID was successfully released.
+//
+// LOCKS_EXCLUDED(o.mu)
+func (o *openHandles) released(
+	dir bool,
+	h fuseops.HandleID) {
+	if o == nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	k := openHandleKey{dir, h}
+	v := o.handles[k]
+	switch len(v) {
+	case 0:
+	case 1:
+		delete(o.handles, k)
+	default:
+		o.handles[k] = v[:len(v)-1]
+	}
+}
+
+// Return the handles that remain open, ordered by handle ID.
+//
+// LOCKS_EXCLUDED(o.mu)
+func (o *openHandles) remaining() (leaked []LeakedHandle) {
+	if o == nil {
+		return nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, v := range o.handles {
+		leaked = append(leaked, v...)
+	}
+
+	sort.SliceStable(leaked, func(i, j int) bool {
+		if leaked[i].Dir != leaked[j].Dir {
+			return !leaked[i].Dir
+		}
+
+		return leaked[i].Handle < leaked[j].Handle
+	})
+
+	return leaked
+}
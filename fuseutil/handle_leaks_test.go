@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system whose file handles are each backed by a descriptor for a file
+// in a local directory, cleaning up leaked handles.
+type leakFS struct {
+	fuseutil.NotImplementedFileSystem
+	backing string
+
+	mu          sync.Mutex
+	open        map[*os.File]bool       // GUARDED_BY(mu)
+	failRelease bool                    // GUARDED_BY(mu)
+	leaked      []fuseutil.LeakedHandle // GUARDED_BY(mu)
+	destroyed   bool                    // GUARDED_BY(mu)
+}
+
+func (fs *leakFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	f, err := os.Open(path.Join(fs.backing, "contents"))
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	fs.open[f] = true
+	fs.mu.Unlock()
+
+	op.HandleData = f
+	return nil
+}
+
+func (fs *leakFS) closeFile(f *os.File) {
+	fs.mu.Lock()
+	delete(fs.open, f)
+	fs.mu.Unlock()
+
+	f.Close()
+}
+
+func (fs *leakFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	fail := fs.failRelease
+	fs.mu.Unlock()
+
+	if fail {
+		return fuse.EIO
+	}
+
+	fs.closeFile(op.HandleData.(*os.File))
+	return nil
+}
+
+func (fs *leakFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	op.HandleData = "dir"
+	return nil
+}
+
+func (fs *leakFS) ReleaseLeakedHandle(
+	mount fuse.MountInfo,
+	h fuseutil.LeakedHandle) {
+	fs.mu.Lock()
+	fs.leaked = append(fs.leaked, h)
+	destroyed := fs.destroyed
+	fs.mu.Unlock()
+
+	if destroyed {
+		panic("ReleaseLeakedHandle called after Destroy")
+	}
+
+	if f, ok := h.HandleData.(*os.File); ok {
+		fs.closeFile(f)
+	}
+}
+
+func (fs *leakFS) Destroy() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.destroyed = true
+}
+
+func openDir(
+	t *testing.T,
+	k *fusetesting.FakeKernel,
+	inode fuseops.InodeID) {
+	in := fusekernel.OpenIn{Flags: uint32(os.O_RDONLY)}
+
+	const inSize = unsafe.Sizeof(fusekernel.OpenIn{})
+	if _, err := k.Call(
+		fusekernel.OpOpendir,
+		uint64(inode),
+		(*[inSize]byte)(unsafe.Pointer(&in))[:]); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+}
+
+func TestHandleLeaks(t *testing.T) {
+	backing, err := ioutil.TempDir("", "handle_leaks_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(backing)
+
+	err = ioutil.WriteFile(path.Join(backing, "contents"), fileContents, 0600)
+	if err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	fs := &leakFS{
+		backing: backing,
+		open:    make(map[*os.File]bool),
+	}
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	// Open three handles, releasing one normally and failing to release
+	// another, and leave a directory open.
+	var handles []fuseops.HandleID
+	for i := 0; i < 3; i++ {
+		h, err := k.Open(fileInode)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+
+		handles = append(handles, h)
+	}
+
+	if err := k.Release(fileInode, handles[0]); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	fs.mu.Lock()
+	fs.failRelease = true
+	fs.mu.Unlock()
+
+	if err := k.Release(fileInode, handles[1]); err != fuse.EIO {
+		t.Fatalf("Release: got %v, want EIO", err)
+	}
+
+	openDir(t, k, fuseops.RootInodeID)
+
+	// Abort the connection with the rest still open.
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Every backend descriptor should have been closed.
+	if len(fs.open) != 0 {
+		t.Errorf("%d backend files still open", len(fs.open))
+	}
+
+	// The leaked handles should have been reported, files first.
+	if len(fs.leaked) != 3 {
+		t.Fatalf("Leaked handles: %v", fs.leaked)
+	}
+
+	for i, want := range []fuseops.HandleID{handles[1], handles[2]} {
+		h := fs.leaked[i]
+		if h.Dir || h.Inode != fileInode || h.Handle != want {
+			t.Errorf("Leaked handle %d: %+v, want file handle %v", i, h, want)
+		}
+	}
+
+	if h := fs.leaked[2]; !h.Dir || h.Inode != fuseops.RootInodeID || h.HandleData != "dir" {
+		t.Errorf("Leaked handle 2: %+v, want root directory", h)
+	}
+
+	if !fs.destroyed {
+		t.Error("Destroy not called")
+	}
+}
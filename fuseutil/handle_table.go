@@ -0,0 +1,312 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Handle IDs minted by handleTable have this bit set, so that they can't be
+// confused with IDs chosen by a file system that manages some of its handles
+// itself.
+const tableHandleBit fuseops.HandleID = 1 << 63
+
+// When a handleTable tags IDs with generations, the generation occupies the
+// 16 bits below tableHandleBit, and the index the rest.
+const (
+	generationShift                  = 47
+	generationMask  fuseops.HandleID = 0xffff << generationShift
+	indexMask       fuseops.HandleID = 1<<generationShift - 1
+)
+
+// The inode a handle was opened for, to name it in diagnostics.
+type handleOwner struct {
+	inode fuseops.InodeID
+	dir   bool
+}
+
+func (o handleOwner) String() string {
+	if o.dir {
+		return fmt.Sprintf("directory inode %d", o.inode)
+	}
+
+	return fmt.Sprintf("file inode %d", o.inode)
+}
+
+// An entry in a handleTable.
+type handleEntry struct {
+	// The attached value, or nil if the entry is unused.
+	data interface{}
+
+	// Who the current or, if unused, the last ID handed out for the entry was
+	// issued for, and who the one before it was.
+	owner     handleOwner
+	prevOwner handleOwner
+
+	// Used only when the table tags IDs with generations: the generation of
+	// the current or last ID. Zero means none.
+	generation uint16
+}
+
+// A table of the values file systems attach to handles via the HandleData
+// fields of OpenFileOp, CreateFileOp and OpenDirOp. Handle IDs are indices
+// into a slice, so lookups are cheap.
+//
+// Reused entries get the same IDs as before, so a handle used after it was
+// released silently refers to whichever handle the entry was reissued to. If
+// generations is set, each ID also carries a generation that changes when
+// the entry is reused, so that stale IDs refer to nothing and check can
+// describe them.
+type handleTable struct {
+	// Set before the table is first used.
+	generations bool
+
+	mu sync.RWMutex
+
+	// The entries, indexed by handle ID without tableHandleBit or the
+	// generation.
+	//
+	// INVARIANT: For each i in free, entries[i].data == nil
+	//
+	// GUARDED_BY(mu)
+	entries []handleEntry
+
+	// Indices of unused entries, available for reuse.
+	//
+	// GUARDED_BY(mu)
+	free []int
+}
+
+// Store the supplied non-nil value, attached to a handle for the given owner,
+// and return a handle ID that refers to it.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *handleTable) add(
+	data interface{},
+	owner handleOwner) fuseops.HandleID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var i int
+	if n := len(t.free); n > 0 {
+		i = t.free[n-1]
+		t.free = t.free[:n-1]
+	} else {
+		i = len(t.entries)
+		t.entries = append(t.entries, handleEntry{})
+	}
+
+	e := &t.entries[i]
+	e.data = data
+	if t.generations {
+		e.generation++
+		if e.generation == 0 {
+			e.generation = 1
+		}
+	}
+
+	e.prevOwner = e.owner
+	e.owner = owner
+
+	return t.id(i)
+}
+
+// Return the handle ID that refers to the current use of the entry with the
+// given index.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *handleTable) id(i int) fuseops.HandleID {
+	if !t.generations {
+		return tableHandleBit | fuseops.HandleID(i)
+	}
+
+	return tableHandleBit |
+		fuseops.HandleID(t.entries[i].generation)<<generationShift |
+		fuseops.HandleID(i)
+}
+
+// Return the index into entries for the given handle ID, which must have
+// tableHandleBit set.
+func (t *handleTable) index(h fuseops.HandleID) uint64 {
+	if t.generations {
+		return uint64(h & indexMask)
+	}
+
+	return uint64(h &^ tableHandleBit)
+}
+
+// Return the entry for the given handle ID, or nil if it wasn't minted by add
+// or, as far as the table can tell, has since been removed.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *handleTable) lookUp(h fuseops.HandleID) *handleEntry {
+	if h&tableHandleBit == 0 {
+		return nil
+	}
+
+	i := t.index(h)
+	if i >= uint64(len(t.entries)) {
+		return nil
+	}
+
+	e := &t.entries[i]
+	if e.data == nil || t.generations && e.generation != handleGeneration(h) {
+		return nil
+	}
+
+	return e
+}
+
+func handleGeneration(h fuseops.HandleID) uint16 {
+	return uint16((h & generationMask) >> generationShift)
+}
+
+// Return the value for the given handle ID, or nil if it wasn't minted by add
+// or has since been removed.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *handleTable) get(h fuseops.HandleID) interface{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if e := t.lookUp(h); e != nil {
+		return e.data
+	}
+
+	return nil
+}
+
+// Forget the value for the given handle ID, if any.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *handleTable) remove(h fuseops.HandleID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.lookUp(h)
+	if e == nil {
+		return
+	}
+
+	e.data = nil
+	t.free = append(t.free, int(t.index(h)))
+}
+
+// If the table tags IDs with generations and the given one was minted by add
+// but has since been removed, return an error describing who it was issued
+// for and who, if anyone, its entry now belongs to. Otherwise return nil.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *handleTable) check(h fuseops.HandleID) error {
+	if !t.generations || h&tableHandleBit == 0 {
+		return nil
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	i := t.index(h)
+	gen := handleGeneration(h)
+	if i >= uint64(len(t.entries)) {
+		return fmt.Errorf("handle %#x (generation %d) was never issued", uint64(h), gen)
+	}
+
+	e := &t.entries[i]
+	if e.data != nil && e.generation == gen {
+		return nil
+	}
+
+	// Name the stale handle's owner if we still know it.
+	stale := "an owner since forgotten"
+	switch {
+	case gen == e.generation:
+		stale = e.owner.String()
+
+	case gen == e.generation-1 && e.data != nil:
+		stale = e.prevOwner.String()
+	}
+
+	if e.data == nil {
+		return fmt.Errorf(
+			"handle %#x, issued for %v (generation %d), has been released",
+			uint64(h),
+			stale,
+			gen)
+	}
+
+	return fmt.Errorf(
+		"handle %#x, issued for %v (generation %d), has been released and "+
+			"reissued for %v (generation %d)",
+		uint64(h),
+		stale,
+		gen,
+		e.owner,
+		e.generation)
+}
+
+// A handle in use, as returned by handleTable.snapshot.
+type tableHandle struct {
+	id    fuseops.HandleID
+	owner handleOwner
+	data  interface{}
+}
+
+// Return the handles in use, ordered by index.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *handleTable) snapshot() (handles []tableHandle) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for i := range t.entries {
+		if e := &t.entries[i]; e.data != nil {
+			handles = append(handles, tableHandle{t.id(i), e.owner, e.data})
+		}
+	}
+
+	return handles
+}
+
+// Make the table, which must be empty, refer to the supplied handles, which
+// must have been returned by snapshot for a table with the same setting of
+// generations.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *handleTable) restore(handles []tableHandle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, h := range handles {
+		i := int(t.index(h.id))
+		for len(t.entries) <= i {
+			t.entries = append(t.entries, handleEntry{})
+		}
+
+		t.entries[i] = handleEntry{
+			data:       h.data,
+			owner:      h.owner,
+			generation: handleGeneration(h.id),
+		}
+	}
+
+	for i := range t.entries {
+		if t.entries[i].data == nil {
+			t.free = append(t.free, i)
+		}
+	}
+}
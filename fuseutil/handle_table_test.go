@@ -0,0 +1,339 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const fileInode fuseops.InodeID = fuseops.RootInodeID + 1
+
+// The contents of every file handle.
+var fileContents = []byte("taco burrito enchilada")
+
+// State for a single open file handle.
+type openFile struct {
+	contents []byte
+}
+
+// Serve reads from a single file, keeping per-handle state in HandleData.
+type handleDataFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu       sync.Mutex
+	opened   []*openFile // GUARDED_BY(mu)
+	released []*openFile // GUARDED_BY(mu)
+}
+
+func (fs *handleDataFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	f := &openFile{contents: fileContents}
+
+	fs.mu.Lock()
+	fs.opened = append(fs.opened, f)
+	fs.mu.Unlock()
+
+	op.HandleData = f
+	return nil
+}
+
+func (fs *handleDataFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	f, ok := op.HandleData.(*openFile)
+	if !ok {
+		return fuse.EIO
+	}
+
+	if op.Offset < int64(len(f.contents)) {
+		op.BytesRead = copy(op.Dst, f.contents[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *handleDataFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	f, ok := op.HandleData.(*openFile)
+	if !ok {
+		return fuse.EIO
+	}
+
+	fs.mu.Lock()
+	fs.released = append(fs.released, f)
+	fs.mu.Unlock()
+
+	return nil
+}
+
+// Like handleDataFS, but keeping its own table of handles, as file systems
+// did before HandleData existed.
+type handleMapFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu         sync.Mutex
+	nextHandle fuseops.HandleID               // GUARDED_BY(mu)
+	handles    map[fuseops.HandleID]*openFile // GUARDED_BY(mu)
+}
+
+func (fs *handleMapFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Handle = fs.nextHandle
+	fs.nextHandle++
+	fs.handles[op.Handle] = &openFile{contents: fileContents}
+
+	return nil
+}
+
+func (fs *handleMapFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	f, ok := fs.handles[op.Handle]
+	fs.mu.Unlock()
+
+	if !ok {
+		return fuse.EIO
+	}
+
+	if op.Offset < int64(len(f.contents)) {
+		op.BytesRead = copy(op.Dst, f.contents[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *handleMapFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	delete(fs.handles, op.Handle)
+	return nil
+}
+
+func TestHandleData(t *testing.T) {
+	fs := &handleDataFS{}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	// Open two handles. They should be distinct.
+	h0, err := k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	h1, err := k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if h0 == h1 {
+		t.Fatalf("Both handles are %v", h0)
+	}
+
+	// Reads through both should find their state.
+	for _, h := range []fuseops.HandleID{h0, h1} {
+		data, err := k.Read(fileInode, h, 5, 7)
+		if err != nil {
+			t.Fatalf("Read(%v): %v", h, err)
+		}
+
+		if got, want := string(data), "burrito"; got != want {
+			t.Errorf("Read(%v): got %q, want %q", h, got, want)
+		}
+	}
+
+	// Release should receive the state attached at open time.
+	if err := k.Release(fileInode, h1); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	fs.mu.Lock()
+	if len(fs.released) != 1 || fs.released[0] != fs.opened[1] {
+		t.Errorf("Unexpected released handles: %v", fs.released)
+	}
+	fs.mu.Unlock()
+
+	// Once released, the handle no longer refers to anything.
+	if _, err := k.Read(fileInode, h1, 0, 1); err != fuse.EIO {
+		t.Errorf("Read after release: got %v, want EIO", err)
+	}
+
+	// The other handle is unaffected, and a new one may reuse the released
+	// slot without confusion.
+	h2, err := k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for _, h := range []fuseops.HandleID{h0, h2} {
+		if _, err := k.Read(fileInode, h, 0, 1); err != nil {
+			t.Errorf("Read(%v): %v", h, err)
+		}
+	}
+}
+
+func TestStaleHandles(t *testing.T) {
+	// Without strict mode, a released handle's ID is reissued as it was.
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&handleDataFS{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	h0, _ := k.Open(fileInode)
+	k.Release(fileInode, h0)
+	if h1, _ := k.Open(fileInode + 1); h1 != h0 {
+		t.Errorf("Reissued handle %#x, want %#x", h1, h0)
+	}
+
+	k.Close()
+
+	// In strict mode, uses of the released handle are caught.
+	var logged bytes.Buffer
+	k, err = fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&handleDataFS{}),
+		&fuse.MountConfig{
+			Strict:      &fuse.StrictConfig{Action: fuse.StrictFail},
+			ErrorLogger: log.New(&logged, "", 0),
+		})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	h0, err = k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if err := k.Release(fileInode, h0); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	h1, err := k.Open(fileInode + 1)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if h1 == h0 {
+		t.Fatalf("Reissued handle %#x", h1)
+	}
+
+	// A stale read and a second release both fail, naming both owners.
+	if _, err := k.Read(fileInode, h0, 0, 1); err != fuse.EIO {
+		t.Errorf("Read of stale handle: got %v, want EIO", err)
+	}
+
+	if err := k.Release(fileInode, h0); err != fuse.EIO {
+		t.Errorf("Second release: got %v, want EIO", err)
+	}
+
+	want := "issued for file inode 2 (generation 1), has been released and " +
+		"reissued for file inode 3 (generation 2)"
+
+	if n := strings.Count(logged.String(), want); n != 2 {
+		t.Errorf("Logged %q, want two lines containing %q", logged.String(), want)
+	}
+
+	// The second release didn't disturb the handle now using the slot.
+	if _, err := k.Read(fileInode+1, h1, 0, 1); err != nil {
+		t.Errorf("Read of reissued handle: %v", err)
+	}
+
+	// Once that is released too, the slot is unused.
+	if err := k.Release(fileInode+1, h1); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	logged.Reset()
+	if _, err := k.Read(fileInode+1, h1, 0, 1); err != fuse.EIO {
+		t.Errorf("Read of released handle: got %v, want EIO", err)
+	}
+
+	want = "issued for file inode 3 (generation 2), has been released"
+	if !strings.Contains(logged.String(), want) {
+		t.Errorf("Logged %q, want it to contain %q", logged.String(), want)
+	}
+}
+
+// Compare small reads served using HandleData with those served using a
+// file-system-side handle map.
+func benchmarkSmallReads(b *testing.B, fs fuseutil.FileSystem) {
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		b.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		h, err := k.Open(fileInode)
+		if err != nil {
+			b.Fatalf("Open: %v", err)
+		}
+
+		for pb.Next() {
+			if _, err := k.Read(fileInode, h, 0, 16); err != nil {
+				b.Fatalf("Read: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkSmallReads_HandleData(b *testing.B) {
+	benchmarkSmallReads(b, &handleDataFS{})
+}
+
+func BenchmarkSmallReads_HandleMap(b *testing.B) {
+	benchmarkSmallReads(b, &handleMapFS{
+		handles: make(map[fuseops.HandleID]*openFile),
+	})
+}
@@ -0,0 +1,242 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HedgeConfig configures a Hedger.
+type HedgeConfig struct {
+	// A call is hedged once it has taken longer than this fraction of recent
+	// calls, e.g. 0.95 to hedge the slowest 5%. Must be in (0, 1].
+	Percentile float64
+
+	// The number of recent calls whose latencies are remembered. Zero means
+	// 100.
+	Window int
+
+	// Bounds on the delay before hedging. Until Window calls have completed,
+	// calls are hedged after MaxDelay, or not at all if it is zero; otherwise
+	// zero means no bound.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+// HedgeStats counts the work done by a Hedger.
+type HedgeStats struct {
+	// Calls to Do.
+	Calls uint64
+
+	// Second attempts started, and those that finished first.
+	Hedges    uint64
+	HedgeWins uint64
+
+	// Attempts cancelled because the other finished first, or because the
+	// caller's context was cancelled. Their work is wasted.
+	Cancelled uint64
+}
+
+// A Hedger runs backend calls for op handlers, starting a second attempt at
+// any call that is taking unusually long and taking the result of whichever
+// finishes first. This trims the tail latency of backends that are mostly
+// fast but occasionally stall, e.g. on a slow replica, at the cost of some
+// duplicated work. Only calls that are safe to repeat should be hedged.
+//
+// Each attempt is given a child of the context passed to Do. For the op's
+// context, both attempts are cancelled when the kernel interrupts the op; for
+// work that outlives the op, such as a prefetch, pass HandleContext(ctx)
+// instead so that they are cancelled once the file is closed. The attempt
+// that doesn't finish first is cancelled too.
+//
+// A Hedger is safe for concurrent use.
+type Hedger struct {
+	cfg HedgeConfig
+
+	mu sync.Mutex
+
+	// The latencies of the most recent calls, used as a ring once full, and
+	// the index at which to record the next.
+	//
+	// GUARDED_BY(mu)
+	latencies []time.Duration
+	next      int
+
+	// GUARDED_BY(mu)
+	stats HedgeStats
+}
+
+// NewHedger creates a Hedger with the supplied configuration.
+func NewHedger(cfg HedgeConfig) *Hedger {
+	if cfg.Window == 0 {
+		cfg.Window = 100
+	}
+
+	return &Hedger{
+		cfg: cfg,
+	}
+}
+
+// The result of one attempt.
+type hedgeResult struct {
+	value interface{}
+	err   error
+	hedge bool
+	took  time.Duration
+}
+
+// Do calls f, and calls it again concurrently if the first call hasn't
+// returned once it has taken longer than the configured percentile of recent
+// calls. It returns the result of whichever call returns first, cancelling
+// the context of the other. f must leave its results in its return values
+// rather than in the op, since the loser may still be running when Do
+// returns.
+//
+// If ctx is cancelled before either call returns, Do returns ctx.Err()
+// without waiting for them.
+func (h *Hedger) Do(
+	ctx context.Context,
+	f func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	// Room for both results, so that the loser doesn't block.
+	results := make(chan hedgeResult, 2)
+
+	attempt := func(hedge bool) context.CancelFunc {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			start := time.Now()
+			v, err := f(attemptCtx)
+			results <- hedgeResult{v, err, hedge, time.Since(start)}
+		}()
+
+		return cancel
+	}
+
+	delay := h.delay()
+
+	cancels := []context.CancelFunc{attempt(false)}
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+
+	var hedgeTimer <-chan time.Time
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		hedgeTimer = t.C
+	}
+
+	for {
+		select {
+		case r := <-results:
+			h.finish(r, len(cancels)-1)
+			return r.value, r.err
+
+		case <-hedgeTimer:
+			hedgeTimer = nil
+			h.countHedge()
+			cancels = append(cancels, attempt(true))
+
+		case <-ctx.Done():
+			h.finish(hedgeResult{}, len(cancels))
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Return the delay after which to hedge the next call, or zero if it
+// shouldn't be hedged.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *Hedger) delay() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stats.Calls++
+
+	if len(h.latencies) < h.cfg.Window {
+		return h.cfg.MaxDelay
+	}
+
+	sorted := make([]time.Duration, len(h.latencies))
+	copy(sorted, h.latencies)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	d := sorted[int(h.cfg.Percentile*float64(len(sorted)-1))]
+	if d < h.cfg.MinDelay {
+		d = h.cfg.MinDelay
+	}
+
+	if h.cfg.MaxDelay != 0 && d > h.cfg.MaxDelay {
+		d = h.cfg.MaxDelay
+	}
+
+	if d <= 0 {
+		d = 1
+	}
+
+	return d
+}
+
+// LOCKS_EXCLUDED(h.mu)
+func (h *Hedger) countHedge() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stats.Hedges++
+}
+
+// Record the outcome of a call that returned r, with the given number of
+// attempts cancelled. A zero r means that the caller gave up.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *Hedger) finish(
+	r hedgeResult,
+	cancelled int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stats.Cancelled += uint64(cancelled)
+	if r.hedge {
+		h.stats.HedgeWins++
+	}
+
+	// Only a real attempt's latency says anything about the backend.
+	if r.took == 0 {
+		return
+	}
+
+	if len(h.latencies) < h.cfg.Window {
+		h.latencies = append(h.latencies, r.took)
+		return
+	}
+
+	h.latencies[h.next] = r.took
+	h.next = (h.next + 1) % h.cfg.Window
+}
+
+// Stats returns the counts of calls and hedges so far.
+//
+// LOCKS_EXCLUDED(h.mu)
+func (h *Hedger) Stats() HedgeStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.stats
+}
@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A backend that knows the attributes of every inode.
+type attrFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *attrFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes.Nlink = 1
+	return nil
+}
+
+// Return a backend that usually answers within a millisecond, but
+// occasionally takes fifty.
+func newBimodalBackend() fuseutil.FileSystem {
+	var mu sync.Mutex
+	r := rand.New(rand.NewSource(1))
+
+	return fusetesting.NewVariableLatencyFileSystem(
+		&attrFS{},
+		func() time.Duration {
+			mu.Lock()
+			defer mu.Unlock()
+
+			if r.Float64() < 0.03 {
+				return 50 * time.Millisecond
+			}
+
+			return time.Millisecond
+		})
+}
+
+// Call f n times, returning the 99th percentile of the time taken.
+func p99(
+	t *testing.T,
+	n int,
+	f func() error) time.Duration {
+	var latencies []time.Duration
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		if err := f(); err != nil {
+			t.Fatalf("Call %d: %v", i, err)
+		}
+
+		latencies = append(latencies, time.Since(start))
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[n*99/100]
+}
+
+func TestHedger_TailLatency(t *testing.T) {
+	ctx := context.Background()
+	backend := newBimodalBackend()
+
+	getAttr := func(ctx context.Context) (interface{}, error) {
+		op := &fuseops.GetInodeAttributesOp{Inode: 2}
+		err := backend.GetInodeAttributes(ctx, op)
+		return op.Attributes, err
+	}
+
+	const n = 300
+	unhedged := p99(t, n, func() error {
+		_, err := getAttr(ctx)
+		return err
+	})
+
+	h := fuseutil.NewHedger(fuseutil.HedgeConfig{
+		Percentile: 0.9,
+		Window:     50,
+		MaxDelay:   10 * time.Millisecond,
+	})
+
+	hedged := p99(t, n, func() error {
+		v, err := h.Do(ctx, getAttr)
+		if err == nil && v.(fuseops.InodeAttributes).Nlink != 1 {
+			t.Errorf("Attributes: %+v", v)
+		}
+
+		return err
+	})
+
+	if hedged > unhedged/2 {
+		t.Errorf("p99 with hedging: %v, without: %v", hedged, unhedged)
+	}
+
+	stats := h.Stats()
+	if stats.Calls != n || stats.Hedges == 0 || stats.HedgeWins == 0 {
+		t.Errorf("Stats: %+v", stats)
+	}
+
+	// Every hedge leaves one attempt to be cancelled.
+	if stats.Cancelled != stats.Hedges {
+		t.Errorf("Stats: %+v", stats)
+	}
+}
+
+func TestHedger_ContextCancelled(t *testing.T) {
+	h := fuseutil.NewHedger(fuseutil.HedgeConfig{
+		Percentile: 0.9,
+		MaxDelay:   time.Millisecond,
+	})
+
+	// Two attempts that wait to be cancelled, as a kernel interrupt would.
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	started := make(chan struct{}, 2)
+	errs := make(chan error, 2)
+	f := func(ctx context.Context) (interface{}, error) {
+		defer wg.Done()
+		started <- struct{}{}
+		<-ctx.Done()
+		errs <- ctx.Err()
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		<-started
+		cancel()
+	}()
+
+	if _, err := h.Do(ctx, f); err != context.Canceled {
+		t.Errorf("Do: %v", err)
+	}
+
+	wg.Wait()
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != context.Canceled {
+			t.Errorf("Attempt: %v", err)
+		}
+	}
+
+	if stats := h.Stats(); stats.Hedges != 1 || stats.Cancelled != 2 {
+		t.Errorf("Stats: %+v", stats)
+	}
+}
+
+func TestHedger_FastCallsNotHedged(t *testing.T) {
+	h := fuseutil.NewHedger(fuseutil.HedgeConfig{
+		Percentile: 0.5,
+		Window:     10,
+		MinDelay:   time.Second,
+	})
+
+	for i := 0; i < 100; i++ {
+		v, err := h.Do(
+			context.Background(),
+			func(ctx context.Context) (interface{}, error) { return i, nil })
+
+		if v != i || err != nil {
+			t.Fatalf("Do: (%v, %v), want %d", v, err, i)
+		}
+	}
+
+	if stats := h.Stats(); stats.Calls != 100 || stats.Hedges != 0 {
+		t.Errorf("Stats: %+v", stats)
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A FileSystem may implement this interface to release the inodes the kernel
+// still refers to when a connection ends. The kernel sends ForgetInode only
+// for inodes it evicts from its cache while mounted; on unmount it simply
+// drops the connection, so a file system that frees an inode's resources only
+// once its lookup count drops to zero would otherwise leak those of every
+// inode still cached.
+//
+// If the file system implements it, the server keeps the lookup count of each
+// inode on each connection, as the kernel does. When a connection ends,
+// ForgetAll is called once with every inode whose count on it is still
+// positive, after all other calls for ops read from the connection have
+// returned, and after ReleaseLeakedHandle but before DestroyMount. It should
+// act as though it had received a ForgetInode for each with the given count.
+// The root inode's implicit initial count isn't included, but lookups that
+// find the root are.
+//
+// A file system that tracks lookup counts with LookupCounts gets the same
+// effect by calling ForgetMount from DestroyMount, and needn't implement this.
+type ForgetAller interface {
+	ForgetAll(mount fuse.MountInfo, remaining []RemainingInode)
+}
+
+// RemainingInode describes an inode that the kernel still referred to when a
+// connection ended. See ForgetAller.
+type RemainingInode struct {
+	Inode fuseops.InodeID
+
+	// The inode's lookup count on the connection.
+	N uint64
+}
+
+// The lookup counts of the inodes on a connection, for finding those never
+// forgotten. A nil *liveInodes tracks nothing.
+type liveInodes struct {
+	mu sync.Mutex
+
+	// INVARIANT: For each v, v.n > 0
+	//
+	// GUARDED_BY(mu)
+	counts map[fuseops.InodeID]liveInode
+}
+
+// An inode's lookup count, and the generation it was last looked up with.
+type liveInode struct {
+	n          uint64
+	generation fuseops.GenerationNumber
+}
+
+func newLiveInodes() *liveInodes {
+	return &liveInodes{
+		counts: make(map[fuseops.InodeID]liveInode),
+	}
+}
+
+// Record the lookups implied by the reply to op, which succeeded. This must be
+// called before the kernel sees the reply, so that it can't forget the inodes
+// first.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *liveInodes) replied(op interface{}) {
+	if l == nil {
+		return
+	}
+
+	var children []fuseops.ChildInodeEntry
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		children = append(children, typed.Entry)
+
+	case *fuseops.MkDirOp:
+		children = append(children, typed.Entry)
+
+	case *fuseops.MkNodeOp:
+		children = append(children, typed.Entry)
+
+	case *fuseops.CreateFileOp:
+		children = append(children, typed.Entry)
+
+	case *fuseops.CreateSymlinkOp:
+		children = append(children, typed.Entry)
+
+	case *fuseops.CreateLinkOp:
+		children = append(children, typed.Entry)
+
+	case *fuseops.ReadDirOp:
+		if !typed.Plus {
+			return
+		}
+
+		for b := typed.Dst[:typed.BytesRead]; len(b) > 0; {
+			d, child, generation, n := readDirentPlus(b)
+			if n == 0 {
+				break
+			}
+
+			if d.Name != "." && d.Name != ".." {
+				children = append(children, fuseops.ChildInodeEntry{
+					Child:      child,
+					Generation: generation,
+				})
+			}
+
+			b = b[n:]
+		}
+
+	default:
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, c := range children {
+		// A zero ID is a negative entry, which the kernel doesn't count.
+		if c.Child != 0 {
+			l.counts[c.Child] = liveInode{l.counts[c.Child].n + 1, c.Generation}
+		}
+	}
+}
+
+// Record that the kernel forgot n lookups of the given inode.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *liveInodes) forgotten(
+	inode fuseops.InodeID,
+	n uint64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := l.counts[inode]
+	if c.n <= n {
+		delete(l.counts, inode)
+		return
+	}
+
+	c.n -= n
+	l.counts[inode] = c
+}
+
+// Return the inodes with positive counts, ordered by ID.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *liveInodes) remaining() (r []RemainingInode) {
+	for _, s := range l.snapshot() {
+		r = append(r, RemainingInode{s.Inode, s.N})
+	}
+
+	return r
+}
+
+// Like remaining, but with the inodes' generations.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *liveInodes) snapshot() (s []SavedInode) {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for inode, c := range l.counts {
+		s = append(s, SavedInode{inode, c.generation, c.n})
+	}
+
+	sort.Slice(s, func(i, j int) bool { return s[i].Inode < s[j].Inode })
+	return s
+}
+
+// Take on the supplied counts, returned by snapshot, in place of any recorded
+// so far.
+//
+// LOCKS_EXCLUDED(l.mu)
+func (l *liveInodes) restore(s []SavedInode) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.counts = make(map[fuseops.InodeID]liveInode)
+	for _, i := range s {
+		if i.N > 0 {
+			l.counts[i.Inode] = liveInode{i.N, i.Generation}
+		}
+	}
+}
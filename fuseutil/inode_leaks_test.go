@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system whose root contains "a" and "b", recording the inodes it is
+// told to forget when the connection ends.
+type forgetAllFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu        sync.Mutex
+	remaining []fuseutil.RemainingInode // GUARDED_BY(mu)
+	calls     int                       // GUARDED_BY(mu)
+}
+
+var forgetAllChildren = map[string]fuseops.InodeID{
+	"a": fuseops.RootInodeID + 1,
+	"b": fuseops.RootInodeID + 2,
+}
+
+func (fs *forgetAllFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	switch op.Name {
+	case "negative":
+		// A negative entry, which the kernel doesn't count.
+		op.Entry.EntryValidFor = time.Minute
+		return nil
+
+	case "a", "b":
+		op.Entry.Child = forgetAllChildren[op.Name]
+		op.Entry.Attributes.Nlink = 1
+		return nil
+	}
+
+	return fuse.ENOENT
+}
+
+func (fs *forgetAllFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *forgetAllFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *forgetAllFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+// Lists "a" with attributes, counting as a lookup, and "b" without.
+func (fs *forgetAllFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Offset != 0 {
+		return nil
+	}
+
+	fuseutil.EmitDotEntries(op, fuseops.RootInodeID, fuseops.RootInodeID)
+
+	a := &fuseops.ChildInodeEntry{Child: forgetAllChildren["a"]}
+	a.Attributes.Nlink = 1
+
+	op.BytesRead += fuseutil.WriteDirentPlus(
+		op.Dst[op.BytesRead:],
+		fuseutil.Dirent{Offset: 3, Inode: a.Child, Name: "a", Type: fuseutil.DT_File},
+		a)
+
+	op.BytesRead += fuseutil.WriteDirentPlus(
+		op.Dst[op.BytesRead:],
+		fuseutil.Dirent{Offset: 4, Inode: forgetAllChildren["b"], Name: "b", Type: fuseutil.DT_File},
+		nil)
+
+	return nil
+}
+
+func (fs *forgetAllFS) ForgetAll(
+	mount fuse.MountInfo,
+	remaining []fuseutil.RemainingInode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.calls++
+	fs.remaining = remaining
+}
+
+func TestForgetAll(t *testing.T) {
+	fs := &forgetAllFS{}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{EnableReadDirPlus: true})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	for _, name := range []string{"a", "a", "a", "b", "negative", "missing"} {
+		k.LookUp(fuseops.RootInodeID, name)
+	}
+
+	// Forget one lookup of each.
+	for _, name := range []string{"a", "b"} {
+		if err := k.Forget(forgetAllChildren[name], 1); err != nil {
+			t.Fatalf("Forget: %v", err)
+		}
+	}
+
+	h, err := k.OpenDir(fuseops.RootInodeID)
+	if err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	if _, err := k.ReadDirPlus(fuseops.RootInodeID, h, 0, 4096); err != nil {
+		t.Fatalf("ReadDirPlus: %v", err)
+	}
+
+	if err := k.ReleaseDir(fuseops.RootInodeID, h); err != nil {
+		t.Fatalf("ReleaseDir: %v", err)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// "a" was looked up three times, forgotten once and listed with its
+	// attributes once. "b" was forgotten as often as it was looked up.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	want := []fuseutil.RemainingInode{{Inode: forgetAllChildren["a"], N: 3}}
+	if fs.calls != 1 || !reflect.DeepEqual(fs.remaining, want) {
+		t.Errorf("ForgetAll called %d times, last with %v; want once with %v", fs.calls, fs.remaining, want)
+	}
+}
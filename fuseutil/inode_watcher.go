@@ -0,0 +1,613 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Invalidator is the part of fuse.MountedFileSystem that InodeWatcher uses to
+// tell the kernel about changes.
+type Invalidator interface {
+	QueueInvalidateInode(inode fuseops.InodeID, off int64, size int64)
+	QueueInvalidateEntry(parent fuseops.InodeID, name string)
+}
+
+// The defaults for InodeWatcherConfig.
+const (
+	defaultMaxWatches   = 4096
+	defaultPollInterval = time.Second
+)
+
+// InodeWatcherConfig contains the parameters for NewInodeWatcher.
+type InodeWatcherConfig struct {
+	// The maximum number of inodes watched using the kernel's change
+	// notifications (inotify on Linux) at once. When more are live, the least
+	// recently used are polled instead. Zero means a default of 4096, and a
+	// negative value means that every inode is polled.
+	MaxWatches int
+
+	// How often polled inodes are checked for changes. Zero means a default of
+	// one second.
+	PollInterval time.Duration
+}
+
+// InodeWatcher detects changes made to the files backing a file system's
+// inodes behind its back, and invalidates the kernel's caches of them, so that
+// loopback-style file systems can hand out long attribute and entry
+// expirations and still reflect out-of-band changes promptly.
+//
+// The file system tells the watcher about each inode it hands to the kernel
+// with Watch, about use of it with Touch, and about its being forgotten with
+// Unwatch. Run then sends the invalidations:
+//
+//   - A change to a file's contents invalidates its attributes and cached data,
+//     and a change to only its metadata (mode, ownership, link count) its
+//     attributes.
+//
+//   - A backing file that is removed, renamed or replaced by another gets its
+//     entry invalidated, so that the next access looks the name up again.
+//
+//   - When a directory's children change, the entries for the names involved
+//     are invalidated along with the directory's cached listing.
+//
+// On Linux, up to InodeWatcherConfig.MaxWatches inodes are watched with
+// inotify, with the rest demoted to polling in least recently used order;
+// elsewhere every inode is polled. Polling compares lstat(2) results, so it
+// notices a directory's children changing but not which, and invalidates only
+// the directory itself.
+type InodeWatcher struct {
+	maxWatches   int
+	pollInterval time.Duration
+
+	// The source of kernel notifications, or nil if there is none.
+	notifier changeNotifier
+
+	mu sync.Mutex
+
+	// The inodes being watched or polled.
+	//
+	// GUARDED_BY(mu)
+	entries map[fuseops.InodeID]*watchEntry
+
+	// The entries watched using the notifier, by watch, and as a list with the
+	// most recently used first. A single watch may cover several entries, for
+	// inodes that are hard links to the same backing file.
+	//
+	// GUARDED_BY(mu)
+	byWatch map[int]map[fuseops.InodeID]*watchEntry
+	watched *list.List
+
+	// Invalidations discovered outside of Run, waiting for it to send them.
+	//
+	// GUARDED_BY(mu)
+	pending []invalidation
+
+	// Receives a value when pending becomes non-empty.
+	wake chan struct{}
+}
+
+// The state of an inode known to an InodeWatcher.
+type watchEntry struct {
+	inode fuseops.InodeID
+
+	// The inode's entry in its parent, which is zero for the root.
+	parent fuseops.InodeID
+	name   string
+
+	// The path of the backing file.
+	path string
+
+	// The notifier's watch for the backing file, and the entry's element in
+	// the watched list, or -1 and nil if it is polled.
+	wd   int
+	elem *list.Element
+
+	// For polled entries, the result of the last lstat(2).
+	last fileSnapshot
+}
+
+// What can be told about a backing file cheaply, for detecting changes to it.
+type fileSnapshot struct {
+	missing bool
+	ino     uint64
+	mode    os.FileMode
+	nlink   uint64
+	size    int64
+	mtime   time.Time
+	ctime   time.Time
+}
+
+// Take a snapshot of the file at p, not following symbolic links.
+func takeSnapshot(p string) (s fileSnapshot) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		s.missing = true
+		return s
+	}
+
+	st := fi.Sys().(*syscall.Stat_t)
+	s.ino = uint64(st.Ino)
+	s.mode = fi.Mode()
+	s.nlink = uint64(st.Nlink)
+	s.size = fi.Size()
+	s.mtime = fi.ModTime()
+	s.ctime = changeTime(st)
+
+	return s
+}
+
+// The kinds of change a notifier may report, as a bit mask.
+type changeKind uint32
+
+const (
+	// The contents of the file or directory changed.
+	changeData changeKind = 1 << iota
+
+	// The file's metadata changed.
+	changeAttrs
+
+	// The named child of the directory was created, removed or renamed.
+	changeChild
+
+	// The file itself was removed or renamed.
+	changeSelf
+
+	// The watch was dropped by the kernel, e.g. because the file is gone.
+	changeDropped
+
+	// Notifications were lost, so anything may have changed.
+	changeOverflow
+)
+
+// A change reported by a notifier.
+type changeEvent struct {
+	wd   int
+	kind changeKind
+
+	// For changeChild, the child's name.
+	name string
+}
+
+// A source of kernel notifications about changes to files, implemented for
+// each platform that has one. Its methods may be called concurrently.
+type changeNotifier interface {
+	// Start watching the file at p, returning an identifier for the watch.
+	// Watching the same file twice returns the same identifier.
+	add(p string, dir bool) (wd int, err error)
+
+	// Stop watching.
+	remove(wd int) error
+
+	// Wait for and return the next batch of changes. Fails once close has
+	// been called.
+	read() ([]changeEvent, error)
+
+	close() error
+}
+
+// NewInodeWatcher creates a watcher with the supplied configuration. The
+// caller must eventually call Close.
+func NewInodeWatcher(cfg InodeWatcherConfig) (*InodeWatcher, error) {
+	w := &InodeWatcher{
+		maxWatches:   cfg.MaxWatches,
+		pollInterval: cfg.PollInterval,
+		entries:      make(map[fuseops.InodeID]*watchEntry),
+		byWatch:      make(map[int]map[fuseops.InodeID]*watchEntry),
+		watched:      list.New(),
+		wake:         make(chan struct{}, 1),
+	}
+
+	if w.maxWatches == 0 {
+		w.maxWatches = defaultMaxWatches
+	}
+
+	if w.pollInterval <= 0 {
+		w.pollInterval = defaultPollInterval
+	}
+
+	if w.maxWatches > 0 {
+		n, err := newChangeNotifier()
+		if err != nil {
+			return nil, fmt.Errorf("newChangeNotifier: %v", err)
+		}
+
+		w.notifier = n
+	}
+
+	if w.notifier == nil {
+		w.maxWatches = 0
+	}
+
+	return w, nil
+}
+
+// Watch starts watching the file at p, which backs the inode with the given
+// ID and is the named child of the given parent inode (zero for the root), or
+// updates what is known about it if it is already watched, e.g. because it
+// was found under a new name. Either way the inode becomes the most recently
+// used.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *InodeWatcher) Watch(
+	inode fuseops.InodeID,
+	parent fuseops.InodeID,
+	name string,
+	p string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.entries[inode]
+	if !ok {
+		e = &watchEntry{inode: inode, wd: -1}
+		w.entries[inode] = e
+	}
+
+	// If the file has been found under a new name, the old one may well be
+	// gone, and polling can't tell once the new path has been recorded.
+	moved := ok && e.path != p
+	if moved {
+		w.pending = append(w.pending, invalidateEntry(e)...)
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+
+	e.parent = parent
+	e.name = name
+	e.path = p
+
+	switch {
+	case e.elem == nil:
+		e.last = takeSnapshot(p)
+		w.promoteLocked(e)
+
+	case moved:
+		// The kernel's watch follows the file it was set on, which may not be
+		// the one now at the path.
+		w.demoteLocked(e)
+		w.promoteLocked(e)
+
+	default:
+		w.watched.MoveToFront(e.elem)
+	}
+}
+
+// Touch marks the inode as the most recently used, if it is being watched,
+// watching it with the kernel's notifications again if it had been demoted to
+// polling.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *InodeWatcher) Touch(inode fuseops.InodeID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.entries[inode]
+	if !ok {
+		return
+	}
+
+	if e.elem != nil {
+		w.watched.MoveToFront(e.elem)
+		return
+	}
+
+	w.promoteLocked(e)
+}
+
+// Unwatch stops watching the inode, typically because the kernel has
+// forgotten it.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *InodeWatcher) Unwatch(inode fuseops.InodeID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	e, ok := w.entries[inode]
+	if !ok {
+		return
+	}
+
+	w.demoteLocked(e)
+	delete(w.entries, inode)
+}
+
+// Counts returns the number of inodes being watched using the kernel's
+// notifications, and the number being polled.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *InodeWatcher) Counts() (watched int, polled int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	watched = w.watched.Len()
+	polled = len(w.entries) - watched
+	return watched, polled
+}
+
+// Try to watch the polled entry e using the notifier, first demoting the
+// least recently used watched entry if that is needed to stay within the
+// limit. Leave e polled if the notifier refuses it.
+//
+// LOCKS_REQUIRED(w.mu)
+func (w *InodeWatcher) promoteLocked(e *watchEntry) {
+	if w.maxWatches == 0 {
+		return
+	}
+
+	if w.watched.Len() >= w.maxWatches {
+		w.demoteLocked(w.watched.Back().Value.(*watchEntry))
+	}
+
+	wd, err := w.notifier.add(e.path, e.last.mode.IsDir())
+	if err != nil {
+		return
+	}
+
+	e.wd = wd
+	e.elem = w.watched.PushFront(e)
+
+	if w.byWatch[wd] == nil {
+		w.byWatch[wd] = make(map[fuseops.InodeID]*watchEntry)
+	}
+
+	w.byWatch[wd][e.inode] = e
+}
+
+// Stop watching e using the notifier, if it is, and poll it instead.
+//
+// LOCKS_REQUIRED(w.mu)
+func (w *InodeWatcher) demoteLocked(e *watchEntry) {
+	if e.elem == nil {
+		return
+	}
+
+	w.watched.Remove(e.elem)
+	e.elem = nil
+
+	delete(w.byWatch[e.wd], e.inode)
+	if len(w.byWatch[e.wd]) == 0 {
+		delete(w.byWatch, e.wd)
+		w.notifier.remove(e.wd)
+	}
+
+	e.wd = -1
+
+	// Changes from now on will be noticed by comparing with this.
+	e.last = takeSnapshot(e.path)
+}
+
+// Run sends invalidations to inv for the changes the watcher detects, until
+// ctx is done or reading the kernel's notifications fails.
+func (w *InodeWatcher) Run(
+	ctx context.Context,
+	inv Invalidator) error {
+	done := make(chan struct{})
+	defer close(done)
+
+	batches := make(chan []changeEvent)
+	readErr := make(chan error, 1)
+	if w.notifier != nil {
+		go func() {
+			for {
+				events, err := w.notifier.read()
+				if err != nil {
+					readErr <- err
+					return
+				}
+
+				select {
+				case batches <- events:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+
+		case err := <-readErr:
+			return fmt.Errorf("read: %v", err)
+
+		case events := <-batches:
+			w.handleEvents(events, inv)
+
+		case <-w.wake:
+			w.mu.Lock()
+			invs := w.pending
+			w.pending = nil
+			w.mu.Unlock()
+
+			send(inv, invs)
+
+		case <-ticker.C:
+			w.poll(inv)
+		}
+	}
+}
+
+// Close stops watching everything and releases the watcher's resources. Run
+// must have returned or be about to, because its context is done.
+func (w *InodeWatcher) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.entries = make(map[fuseops.InodeID]*watchEntry)
+	w.byWatch = make(map[int]map[fuseops.InodeID]*watchEntry)
+	w.watched.Init()
+	w.pending = nil
+
+	if w.notifier == nil {
+		return nil
+	}
+
+	return w.notifier.close()
+}
+
+// An invalidation to be sent, collected while holding the lock and sent
+// after releasing it.
+type invalidation struct {
+	inode fuseops.InodeID
+
+	// For an inode, the range to invalidate; see QueueInvalidateInode.
+	off int64
+
+	// If non-empty, invalidate this entry of inode instead.
+	name string
+}
+
+// Invalidate the inode's attributes and all of its cached data.
+func invalidateAll(inode fuseops.InodeID) invalidation {
+	return invalidation{inode: inode}
+}
+
+// Invalidate only the inode's attributes.
+func invalidateAttrs(inode fuseops.InodeID) invalidation {
+	return invalidation{inode: inode, off: -1}
+}
+
+// Invalidate the entry for e in its parent, if it has one.
+func invalidateEntry(e *watchEntry) []invalidation {
+	if e.parent == 0 {
+		return nil
+	}
+
+	return []invalidation{{inode: e.parent, name: e.name}}
+}
+
+func send(
+	inv Invalidator,
+	invs []invalidation) {
+	for _, i := range invs {
+		if i.name != "" {
+			inv.QueueInvalidateEntry(i.inode, i.name)
+			continue
+		}
+
+		inv.QueueInvalidateInode(i.inode, i.off, 0)
+	}
+}
+
+// Turn the notifier's events into invalidations.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *InodeWatcher) handleEvents(
+	events []changeEvent,
+	inv Invalidator) {
+	w.mu.Lock()
+
+	var invs []invalidation
+	for _, ev := range events {
+		if ev.kind&changeOverflow != 0 {
+			for _, e := range w.entries {
+				invs = append(invs, invalidateAll(e.inode))
+				invs = append(invs, invalidateEntry(e)...)
+			}
+
+			continue
+		}
+
+		// Copy the entries, which dropped watches remove from the map.
+		var entries []*watchEntry
+		for _, e := range w.byWatch[ev.wd] {
+			entries = append(entries, e)
+		}
+
+		for _, e := range entries {
+			switch {
+			case ev.kind&changeChild != 0:
+				invs = append(
+					invs,
+					invalidation{inode: e.inode, name: ev.name},
+					invalidateAll(e.inode))
+
+			case ev.kind&changeData != 0:
+				invs = append(invs, invalidateAll(e.inode))
+
+			case ev.kind&changeAttrs != 0:
+				invs = append(invs, invalidateAttrs(e.inode))
+			}
+
+			if ev.kind&changeSelf != 0 {
+				invs = append(invs, invalidateAttrs(e.inode))
+				invs = append(invs, invalidateEntry(e)...)
+			}
+
+			// The kernel has stopped watching, so poll the path from now on.
+			if ev.kind&changeDropped != 0 {
+				w.watched.Remove(e.elem)
+				e.elem = nil
+				e.wd = -1
+				e.last = takeSnapshot(e.path)
+			}
+		}
+
+		if ev.kind&changeDropped != 0 {
+			delete(w.byWatch, ev.wd)
+		}
+	}
+
+	w.mu.Unlock()
+	send(inv, invs)
+}
+
+// Check each polled entry for changes since the last poll.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *InodeWatcher) poll(inv Invalidator) {
+	w.mu.Lock()
+
+	var invs []invalidation
+	for _, e := range w.entries {
+		if e.elem != nil {
+			continue
+		}
+
+		s := takeSnapshot(e.path)
+		last := e.last
+		e.last = s
+
+		switch {
+		case s.missing != last.missing || s.ino != last.ino:
+			invs = append(invs, invalidateAll(e.inode))
+			invs = append(invs, invalidateEntry(e)...)
+
+		case s.size != last.size || !s.mtime.Equal(last.mtime):
+			invs = append(invs, invalidateAll(e.inode))
+
+		case s.mode != last.mode || s.nlink != last.nlink || !s.ctime.Equal(last.ctime):
+			invs = append(invs, invalidateAttrs(e.inode))
+		}
+	}
+
+	w.mu.Unlock()
+	send(inv, invs)
+}
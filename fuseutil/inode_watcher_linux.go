@@ -0,0 +1,150 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func changeTime(st *syscall.Stat_t) time.Time {
+	return time.Unix(st.Ctim.Unix())
+}
+
+// The inotify events watched for on files, and additionally on directories.
+const (
+	inotifyFileMask = syscall.IN_MODIFY |
+		syscall.IN_ATTRIB |
+		syscall.IN_CLOSE_WRITE |
+		syscall.IN_DELETE_SELF |
+		syscall.IN_MOVE_SELF |
+		syscall.IN_DONT_FOLLOW
+
+	inotifyDirMask = syscall.IN_CREATE |
+		syscall.IN_DELETE |
+		syscall.IN_MOVED_FROM |
+		syscall.IN_MOVED_TO |
+		syscall.IN_EXCL_UNLINK
+)
+
+// A changeNotifier using inotify(7).
+type inotifyNotifier struct {
+	fd int
+
+	// The inotify instance, opened non-blocking so that reads wait in the
+	// runtime's poller and are woken by close.
+	f *os.File
+
+	// Large enough for any single event.
+	buf []byte
+}
+
+func newChangeNotifier() (changeNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	n := &inotifyNotifier{
+		fd:  fd,
+		f:   os.NewFile(uintptr(fd), "(inotify)"),
+		buf: make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)),
+	}
+
+	return n, nil
+}
+
+func (n *inotifyNotifier) add(p string, dir bool) (int, error) {
+	var mask uint32 = inotifyFileMask
+	if dir {
+		mask |= inotifyDirMask
+	}
+
+	wd, err := syscall.InotifyAddWatch(n.fd, p, mask)
+	if err != nil {
+		return 0, os.NewSyscallError("inotify_add_watch", err)
+	}
+
+	return wd, nil
+}
+
+func (n *inotifyNotifier) remove(wd int) error {
+	_, err := syscall.InotifyRmWatch(n.fd, uint32(wd))
+	if err != nil {
+		return os.NewSyscallError("inotify_rm_watch", err)
+	}
+
+	return nil
+}
+
+func (n *inotifyNotifier) read() ([]changeEvent, error) {
+	size, err := n.f.Read(n.buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []changeEvent
+	for off := 0; off+syscall.SizeofInotifyEvent <= size; {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&n.buf[off]))
+		off += syscall.SizeofInotifyEvent
+
+		// The name is padded with NULs.
+		name := n.buf[off : off+int(raw.Len)]
+		off += int(raw.Len)
+		for i, c := range name {
+			if c == 0 {
+				name = name[:i]
+				break
+			}
+		}
+
+		ev := changeEvent{wd: int(raw.Wd)}
+		if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			ev.kind |= changeOverflow
+		}
+
+		switch {
+		case raw.Mask&inotifyDirMask != 0 && len(name) > 0:
+			ev.kind |= changeChild
+			ev.name = string(name)
+
+		case raw.Mask&(syscall.IN_MODIFY|syscall.IN_CLOSE_WRITE) != 0:
+			ev.kind |= changeData
+
+		case raw.Mask&syscall.IN_ATTRIB != 0:
+			ev.kind |= changeAttrs
+		}
+
+		if raw.Mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+			ev.kind |= changeSelf
+		}
+
+		if raw.Mask&syscall.IN_IGNORED != 0 {
+			ev.kind |= changeDropped
+		}
+
+		if ev.kind != 0 {
+			events = append(events, ev)
+		}
+	}
+
+	return events, nil
+}
+
+func (n *inotifyNotifier) close() error {
+	return n.f.Close()
+}
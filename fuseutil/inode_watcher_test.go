@@ -0,0 +1,243 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An Invalidator that records what it is asked to invalidate.
+type recordingInvalidator struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (r *recordingInvalidator) record(s string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.seen == nil {
+		r.seen = make(map[string]bool)
+	}
+
+	r.seen[s] = true
+}
+
+func (r *recordingInvalidator) QueueInvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	size int64) {
+	r.record(fmt.Sprintf("inode %d [%d, +%d)", inode, off, size))
+}
+
+func (r *recordingInvalidator) QueueInvalidateEntry(
+	parent fuseops.InodeID,
+	name string) {
+	r.record(fmt.Sprintf("entry %d %q", parent, name))
+}
+
+// Wait for the invalidation described by want to be recorded, then forget
+// everything recorded so far.
+func (r *recordingInvalidator) await(
+	t *testing.T,
+	want string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		r.mu.Lock()
+		seen := r.seen[want]
+		if seen {
+			r.seen = nil
+		}
+
+		r.mu.Unlock()
+
+		if seen {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("Never saw %s", want)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Create a watcher with the supplied config, running against the returned
+// invalidator until the test finishes.
+func startWatcher(
+	t *testing.T,
+	cfg InodeWatcherConfig) (*InodeWatcher, *recordingInvalidator) {
+	w, err := NewInodeWatcher(cfg)
+	if err != nil {
+		t.Fatalf("NewInodeWatcher: %v", err)
+	}
+
+	inv := &recordingInvalidator{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- w.Run(ctx, inv) }()
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+
+		w.Close()
+	})
+
+	return w, inv
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "inode_watcher_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func writeFile(
+	t *testing.T,
+	p string,
+	contents string) {
+	if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+func TestInodeWatcher_Changes(t *testing.T) {
+	for _, maxWatches := range []int{0, -1} {
+		t.Run(fmt.Sprintf("MaxWatches=%d", maxWatches), func(t *testing.T) {
+			w, inv := startWatcher(t, InodeWatcherConfig{
+				MaxWatches:   maxWatches,
+				PollInterval: 10 * time.Millisecond,
+			})
+
+			dir := tempDir(t)
+			foo := path.Join(dir, "foo")
+			writeFile(t, foo, "taco")
+
+			w.Watch(fuseops.RootInodeID, 0, "", dir)
+			w.Watch(2, fuseops.RootInodeID, "foo", foo)
+
+			// Contents.
+			writeFile(t, foo, "burrito")
+			inv.await(t, "inode 2 [0, +0)")
+
+			// Metadata.
+			if err := os.Chmod(foo, 0600); err != nil {
+				t.Fatalf("Chmod: %v", err)
+			}
+
+			inv.await(t, "inode 2 [-1, +0)")
+
+			// Replacement by another file, which polling notices only through the
+			// change of inode number.
+			bar := path.Join(dir, "bar")
+			writeFile(t, bar, "enchilada")
+			if err := os.Rename(bar, foo); err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+
+			inv.await(t, `entry 1 "foo"`)
+
+			// Polling sees a change to the directory, but not which child it was.
+			if err := os.Remove(foo); err != nil {
+				t.Fatalf("Remove: %v", err)
+			}
+
+			if w.notifier == nil || maxWatches < 0 {
+				inv.await(t, "inode 1 [0, +0)")
+				return
+			}
+
+			inv.await(t, `entry 1 "foo"`)
+		})
+	}
+}
+
+func TestInodeWatcher_LeastRecentlyUsedArePolled(t *testing.T) {
+	w, inv := startWatcher(t, InodeWatcherConfig{
+		MaxWatches:   2,
+		PollInterval: 10 * time.Millisecond,
+	})
+
+	checkCounts := func(wantWatched int, wantPolled int) {
+		t.Helper()
+		if w.notifier == nil {
+			wantPolled += wantWatched
+			wantWatched = 0
+		}
+
+		if watched, polled := w.Counts(); watched != wantWatched || polled != wantPolled {
+			t.Errorf("Counts: got (%d, %d), want (%d, %d)", watched, polled, wantWatched, wantPolled)
+		}
+	}
+
+	isWatched := func(inode fuseops.InodeID) bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return w.entries[inode].elem != nil
+	}
+
+	dir := tempDir(t)
+	for i := 0; i < 3; i++ {
+		p := path.Join(dir, fmt.Sprint(i))
+		writeFile(t, p, "taco")
+		w.Watch(fuseops.InodeID(i+2), fuseops.RootInodeID, fmt.Sprint(i), p)
+	}
+
+	// The first file is the least recently used.
+	checkCounts(2, 1)
+	if isWatched(2) {
+		t.Errorf("Inode 2 is still watched")
+	}
+
+	// Using it swaps it with the second.
+	w.Touch(2)
+	checkCounts(2, 1)
+	if isWatched(3) {
+		t.Errorf("Inode 3 is still watched")
+	}
+
+	// Changes to every file are noticed, whether watched or polled.
+	for i := 0; i < 3; i++ {
+		writeFile(t, path.Join(dir, fmt.Sprint(i)), "burrito")
+		inv.await(t, fmt.Sprintf("inode %d [0, +0)", i+2))
+	}
+
+	// A forgotten inode is no longer watched, which makes room for the polled
+	// one.
+	w.Unwatch(2)
+	checkCounts(1, 1)
+
+	w.Touch(3)
+	checkCounts(2, 0)
+}
@@ -0,0 +1,605 @@
+//go:build go1.16
+// +build go1.16
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// IOFS is a read-only io/fs view of a FileSystem, for reading its contents
+// in-process without going through the kernel, e.g. for backups, integrity
+// scans or serving over HTTP. It implements io/fs.FS, ReadDirFS and StatFS,
+// and the files it opens implement io.Seeker and io.ReaderAt.
+//
+// IOFS calls the file system's methods directly, the way the kernel would for
+// the same accesses: each path is resolved one component at a time with
+// LookUpInode, files and directories are opened with OpenFile and OpenDir and
+// read with ReadFile and ReadDir, and every lookup and handle is eventually
+// balanced by a ForgetInode or release. The ops carry no connection
+// information (see fuse.MountInfoFromContext), so LookupCounts treats them as
+// coming from a connection of their own, and the file system may be mounted
+// at the same time.
+//
+// Symbolic links are not followed. They appear as such in listings and in
+// Stat, but opening one fails.
+type IOFS struct {
+	ctx context.Context
+	fs  FileSystem
+}
+
+var _ iofs.ReadDirFS = &IOFS{}
+var _ iofs.StatFS = &IOFS{}
+
+// NewIOFS creates an io/fs view of the supplied file system. ctx is used for
+// all ops sent to it.
+func NewIOFS(
+	ctx context.Context,
+	fs FileSystem) *IOFS {
+	return &IOFS{
+		ctx: ctx,
+		fs:  fs,
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Inodes
+////////////////////////////////////////////////////////////////////////
+
+// An inode found by IOFS, holding one lookup count unless it is the root.
+type ioInode struct {
+	id    fuseops.InodeID
+	name  string
+	attrs fuseops.InodeAttributes
+}
+
+// Drop the lookup count held by in.
+func (f *IOFS) forget(in *ioInode) {
+	if in.id == fuseops.RootInodeID {
+		return
+	}
+
+	f.fs.ForgetInode(f.ctx, &fuseops.ForgetInodeOp{Inode: in.id, N: 1})
+}
+
+// Look up the named child of parent, which must be a directory.
+func (f *IOFS) lookUp(
+	parent fuseops.InodeID,
+	name string) (*ioInode, error) {
+	op := &fuseops.LookUpInodeOp{
+		Parent: parent,
+		Name:   name,
+	}
+
+	if err := f.fs.LookUpInode(f.ctx, op); err != nil {
+		return nil, err
+	}
+
+	return &ioInode{id: op.Entry.Child, name: name, attrs: op.Entry.Attributes}, nil
+}
+
+// Resolve the supplied path, which must be valid according to
+// io/fs.ValidPath. The caller must later forget the result.
+func (f *IOFS) resolve(op string, name string) (*ioInode, error) {
+	if !iofs.ValidPath(name) {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: iofs.ErrInvalid}
+	}
+
+	getAttrs := &fuseops.GetInodeAttributesOp{Inode: fuseops.RootInodeID}
+	if err := f.fs.GetInodeAttributes(f.ctx, getAttrs); err != nil {
+		return nil, &iofs.PathError{Op: op, Path: name, Err: err}
+	}
+
+	in := &ioInode{id: fuseops.RootInodeID, name: ".", attrs: getAttrs.Attributes}
+	if name == "." {
+		return in, nil
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		if !in.attrs.Mode.IsDir() {
+			f.forget(in)
+			return nil, &iofs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+
+		child, err := f.lookUp(in.id, component)
+		f.forget(in)
+
+		if err != nil {
+			return nil, &iofs.PathError{Op: op, Path: name, Err: err}
+		}
+
+		in = child
+	}
+
+	return in, nil
+}
+
+// Stat implements io/fs.StatFS.
+func (f *IOFS) Stat(name string) (iofs.FileInfo, error) {
+	in, err := f.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	f.forget(in)
+	return newIOFileInfo(in.name, &in.attrs), nil
+}
+
+// Open implements io/fs.FS.
+func (f *IOFS) Open(name string) (iofs.File, error) {
+	in, err := f.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case in.attrs.Mode.IsDir():
+		op := &fuseops.OpenDirOp{Inode: in.id}
+		if err := f.fs.OpenDir(f.ctx, op); err != nil {
+			f.forget(in)
+			return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return &ioDir{
+			f:          f,
+			path:       name,
+			in:         in,
+			handle:     op.Handle,
+			handleData: op.HandleData,
+		}, nil
+
+	case in.attrs.Mode.IsRegular():
+		op := &fuseops.OpenFileOp{
+			Metadata: fuseops.OpMetadata{Pid: uint32(os.Getpid())},
+			Inode:    in.id,
+		}
+
+		if err := f.fs.OpenFile(f.ctx, op); err != nil {
+			f.forget(in)
+			return nil, &iofs.PathError{Op: "open", Path: name, Err: err}
+		}
+
+		return &ioFile{
+			f:          f,
+			path:       name,
+			in:         in,
+			handle:     op.Handle,
+			handleData: op.HandleData,
+		}, nil
+
+	default:
+		f.forget(in)
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrInvalid}
+	}
+}
+
+// ReadDir implements io/fs.ReadDirFS.
+func (f *IOFS) ReadDir(name string) ([]iofs.DirEntry, error) {
+	file, err := f.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	d, ok := file.(*ioDir)
+	if !ok {
+		return nil, &iofs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	entries, err := d.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Files
+////////////////////////////////////////////////////////////////////////
+
+// An open regular file.
+type ioFile struct {
+	f          *IOFS
+	path       string
+	in         *ioInode
+	handle     fuseops.HandleID
+	handleData interface{}
+
+	mu     sync.Mutex
+	offset int64 // GUARDED_BY(mu)
+	closed bool  // GUARDED_BY(mu)
+}
+
+func (file *ioFile) Stat() (iofs.FileInfo, error) {
+	return newIOFileInfo(file.in.name, &file.in.attrs), nil
+}
+
+// LOCKS_EXCLUDED(file.mu)
+func (file *ioFile) Read(p []byte) (int, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	n, err := file.readAt("read", p, file.offset)
+	file.offset += int64(n)
+
+	return n, err
+}
+
+// LOCKS_EXCLUDED(file.mu)
+func (file *ioFile) ReadAt(p []byte, off int64) (int, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	// Unlike Read, ReadAt must fill p unless it hits the end of the file.
+	var n int
+	for n < len(p) {
+		m, err := file.readAt("read", p[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Read once from the file system into p, returning io.EOF for a read that
+// returns nothing.
+//
+// LOCKS_REQUIRED(file.mu)
+func (file *ioFile) readAt(
+	opName string,
+	p []byte,
+	off int64) (int, error) {
+	if file.closed {
+		return 0, &iofs.PathError{Op: opName, Path: file.path, Err: iofs.ErrClosed}
+	}
+
+	if off < 0 {
+		return 0, &iofs.PathError{Op: opName, Path: file.path, Err: iofs.ErrInvalid}
+	}
+
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	op := &fuseops.ReadFileOp{
+		Inode:      file.in.id,
+		Handle:     file.handle,
+		HandleData: file.handleData,
+		Offset:     off,
+		Dst:        p,
+	}
+
+	// Some file systems return io.EOF along with a short read; the kernel
+	// would fail the read.
+	if err := file.f.fs.ReadFile(file.f.ctx, op); err != nil && err != io.EOF {
+		return op.BytesRead, &iofs.PathError{Op: opName, Path: file.path, Err: err}
+	}
+
+	if op.BytesRead == 0 {
+		return 0, io.EOF
+	}
+
+	return op.BytesRead, nil
+}
+
+// LOCKS_EXCLUDED(file.mu)
+func (file *ioFile) Seek(offset int64, whence int) (int64, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	if file.closed {
+		return 0, &iofs.PathError{Op: "seek", Path: file.path, Err: iofs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += file.offset
+
+	case io.SeekEnd:
+		offset += int64(file.in.attrs.Size)
+	}
+
+	if offset < 0 {
+		return 0, &iofs.PathError{Op: "seek", Path: file.path, Err: iofs.ErrInvalid}
+	}
+
+	file.offset = offset
+	return offset, nil
+}
+
+// LOCKS_EXCLUDED(file.mu)
+func (file *ioFile) Close() error {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+
+	if file.closed {
+		return &iofs.PathError{Op: "close", Path: file.path, Err: iofs.ErrClosed}
+	}
+
+	file.closed = true
+
+	// Like the kernel, ignore the result: many file systems don't implement
+	// release at all.
+	file.f.fs.ReleaseFileHandle(file.f.ctx, &fuseops.ReleaseFileHandleOp{
+		Handle:     file.handle,
+		HandleData: file.handleData,
+	})
+
+	file.f.forget(file.in)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directories
+////////////////////////////////////////////////////////////////////////
+
+// The size of the buffer for each ReadDir call, which is what the kernel uses.
+const ioDirBufSize = 4096
+
+// An open directory.
+type ioDir struct {
+	f          *IOFS
+	path       string
+	in         *ioInode
+	handle     fuseops.HandleID
+	handleData interface{}
+
+	mu sync.Mutex
+
+	// The offset from which to continue reading, and entries already read
+	// from the file system but not yet returned.
+	//
+	// GUARDED_BY(mu)
+	offset  fuseops.DirOffset
+	pending []Dirent
+
+	// Set once the file system has returned the end of the directory.
+	//
+	// GUARDED_BY(mu)
+	eof bool
+
+	// GUARDED_BY(mu)
+	closed bool
+}
+
+func (d *ioDir) Stat() (iofs.FileInfo, error) {
+	return newIOFileInfo(d.in.name, &d.in.attrs), nil
+}
+
+func (d *ioDir) Read(p []byte) (int, error) {
+	return 0, &iofs.PathError{Op: "read", Path: d.path, Err: syscall.EISDIR}
+}
+
+// Fill d.pending from the file system, setting d.eof at the end.
+//
+// LOCKS_REQUIRED(d.mu)
+func (d *ioDir) fill() error {
+	op := &fuseops.ReadDirOp{
+		Inode:      d.in.id,
+		Handle:     d.handle,
+		HandleData: d.handleData,
+		Offset:     d.offset,
+		Dst:        make([]byte, ioDirBufSize),
+	}
+
+	if err := d.f.fs.ReadDir(d.f.ctx, op); err != nil {
+		return &iofs.PathError{Op: "readdir", Path: d.path, Err: err}
+	}
+
+	if op.BytesRead == 0 {
+		d.eof = true
+		return nil
+	}
+
+	for b := op.Dst[:op.BytesRead]; len(b) > 0; {
+		e, n := ReadDirent(b)
+		if n == 0 {
+			return &iofs.PathError{
+				Op:   "readdir",
+				Path: d.path,
+				Err:  errors.New("malformed directory entry"),
+			}
+		}
+
+		b = b[n:]
+		d.offset = e.Offset
+
+		if e.Name != "." && e.Name != ".." {
+			d.pending = append(d.pending, e)
+		}
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *ioDir) ReadDir(n int) (entries []iofs.DirEntry, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil, &iofs.PathError{Op: "readdir", Path: d.path, Err: iofs.ErrClosed}
+	}
+
+	for n <= 0 || len(entries) < n {
+		if len(d.pending) == 0 {
+			if d.eof {
+				break
+			}
+
+			if err = d.fill(); err != nil {
+				return entries, err
+			}
+
+			continue
+		}
+
+		e := d.pending[0]
+		d.pending = d.pending[1:]
+
+		entry, err := d.newEntry(e)
+		if err != nil {
+			return entries, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if n > 0 && len(entries) == 0 {
+		return nil, io.EOF
+	}
+
+	return entries, nil
+}
+
+// Make a directory entry for e, looking it up if the file system didn't say
+// what type of file it is.
+func (d *ioDir) newEntry(e Dirent) (iofs.DirEntry, error) {
+	entry := &ioDirEntry{d: d, name: e.Name}
+	switch e.Type {
+	case DT_Directory:
+		entry.mode = iofs.ModeDir
+	case DT_Link:
+		entry.mode = iofs.ModeSymlink
+	case DT_File:
+	case DT_FIFO:
+		entry.mode = iofs.ModeNamedPipe
+	case DT_Socket:
+		entry.mode = iofs.ModeSocket
+	case DT_Char:
+		entry.mode = iofs.ModeDevice | iofs.ModeCharDevice
+	case DT_Block:
+		entry.mode = iofs.ModeDevice
+
+	default:
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		entry.mode = info.Mode().Type()
+	}
+
+	return entry, nil
+}
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *ioDir) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return &iofs.PathError{Op: "close", Path: d.path, Err: iofs.ErrClosed}
+	}
+
+	d.closed = true
+
+	// As for files, ignore the result.
+	d.f.fs.ReleaseDirHandle(d.f.ctx, &fuseops.ReleaseDirHandleOp{
+		Handle:     d.handle,
+		HandleData: d.handleData,
+	})
+
+	d.f.forget(d.in)
+	return nil
+}
+
+// An entry returned by ioDir.ReadDir.
+type ioDirEntry struct {
+	d    *ioDir
+	name string
+	mode iofs.FileMode
+}
+
+func (e *ioDirEntry) Name() string {
+	return e.name
+}
+
+func (e *ioDirEntry) IsDir() bool {
+	return e.mode.IsDir()
+}
+
+func (e *ioDirEntry) Type() iofs.FileMode {
+	return e.mode
+}
+
+// Info looks up the entry afresh, so that the directory need not still be
+// open.
+func (e *ioDirEntry) Info() (iofs.FileInfo, error) {
+	in, err := e.d.f.lookUp(e.d.in.id, e.name)
+	if err != nil {
+		return nil, &iofs.PathError{Op: "stat", Path: path.Join(e.d.path, e.name), Err: err}
+	}
+
+	e.d.f.forget(in)
+	return newIOFileInfo(in.name, &in.attrs), nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// File info
+////////////////////////////////////////////////////////////////////////
+
+type ioFileInfo struct {
+	name  string
+	attrs fuseops.InodeAttributes
+}
+
+func newIOFileInfo(
+	name string,
+	attrs *fuseops.InodeAttributes) *ioFileInfo {
+	return &ioFileInfo{name: name, attrs: *attrs}
+}
+
+func (fi *ioFileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *ioFileInfo) Size() int64 {
+	return int64(fi.attrs.Size)
+}
+
+func (fi *ioFileInfo) Mode() iofs.FileMode {
+	return fi.attrs.Mode
+}
+
+func (fi *ioFileInfo) ModTime() time.Time {
+	return fi.attrs.Mtime
+}
+
+func (fi *ioFileInfo) IsDir() bool {
+	return fi.attrs.Mode.IsDir()
+}
+
+func (fi *ioFileInfo) Sys() interface{} {
+	return &fi.attrs
+}
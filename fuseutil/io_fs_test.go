@@ -0,0 +1,236 @@
+//go:build go1.16
+// +build go1.16
+
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Wraps a file system, keeping track of outstanding lookups and handles.
+type balanceFS struct {
+	fuseutil.FileSystem
+
+	mu      sync.Mutex
+	lookups map[fuseops.InodeID]int // GUARDED_BY(mu)
+	handles int                     // GUARDED_BY(mu)
+}
+
+func (fs *balanceFS) add(inode fuseops.InodeID, lookups int, handles int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.lookups[inode] += lookups
+	if fs.lookups[inode] == 0 {
+		delete(fs.lookups, inode)
+	}
+
+	fs.handles += handles
+}
+
+func (fs *balanceFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	if err == nil {
+		fs.add(op.Entry.Child, 1, 0)
+	}
+
+	return err
+}
+
+func (fs *balanceFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.add(op.Inode, -int(op.N), 0)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+func (fs *balanceFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	err := fs.FileSystem.OpenFile(ctx, op)
+	if err == nil {
+		fs.add(0, 0, 1)
+	}
+
+	return err
+}
+
+func (fs *balanceFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.add(0, 0, -1)
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
+
+func (fs *balanceFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	err := fs.FileSystem.OpenDir(ctx, op)
+	if err == nil {
+		fs.add(0, 0, 1)
+	}
+
+	return err
+}
+
+func (fs *balanceFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.add(0, 0, -1)
+	return fs.FileSystem.ReleaseDirHandle(ctx, op)
+}
+
+// Build a tree in memfs by calling it directly, returning the files created.
+func populate(
+	t *testing.T,
+	fs fuseutil.FileSystem) map[string][]byte {
+	ctx := context.Background()
+	files := map[string][]byte{
+		"hello.txt":      []byte("Hello, world!"),
+		"a/taco":         []byte("burrito"),
+		"a/b/empty":      nil,
+		"a/b/c/big.data": bytes.Repeat([]byte("enchilada"), 100000),
+	}
+
+	dirs := map[string]fuseops.InodeID{"": fuseops.RootInodeID}
+	var mkdir func(p string) fuseops.InodeID
+	mkdir = func(p string) fuseops.InodeID {
+		if id, ok := dirs[p]; ok {
+			return id
+		}
+
+		parent, name := "", p
+		if i := strings.LastIndex(p, "/"); i >= 0 {
+			parent, name = p[:i], p[i+1:]
+		}
+
+		op := &fuseops.MkDirOp{Parent: mkdir(parent), Name: name, Mode: os.ModeDir | 0755}
+		if err := fs.MkDir(ctx, op); err != nil {
+			t.Fatalf("MkDir(%q): %v", p, err)
+		}
+
+		dirs[p] = op.Entry.Child
+		return op.Entry.Child
+	}
+
+	for p, contents := range files {
+		parent, name := "", p
+		if i := strings.LastIndex(p, "/"); i >= 0 {
+			parent, name = p[:i], p[i+1:]
+		}
+
+		create := &fuseops.CreateFileOp{
+			Metadata: fuseops.OpMetadata{Pid: uint32(os.Getpid())},
+			Parent:   mkdir(parent),
+			Name:     name,
+			Mode:     0644,
+		}
+
+		if err := fs.CreateFile(ctx, create); err != nil {
+			t.Fatalf("CreateFile(%q): %v", p, err)
+		}
+
+		write := &fuseops.WriteFileOp{
+			Inode:  create.Entry.Child,
+			Handle: create.Handle,
+			Data:   contents,
+		}
+
+		if err := fs.WriteFile(ctx, write); err != nil {
+			t.Fatalf("WriteFile(%q): %v", p, err)
+		}
+
+		fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{Handle: create.Handle})
+
+		fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: create.Entry.Child, N: 1})
+	}
+
+	for p, id := range dirs {
+		if p != "" {
+			fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: id, N: 1})
+		}
+	}
+
+	return files
+}
+
+func TestIOFS(t *testing.T) {
+	fs := &balanceFS{
+		FileSystem: memfs.NewFileSystem(uint32(os.Getuid()), uint32(os.Getgid())),
+		lookups:    make(map[fuseops.InodeID]int),
+	}
+
+	files := populate(t, fs.FileSystem)
+	fsys := fuseutil.NewIOFS(context.Background(), fs)
+
+	var names []string
+	for p := range files {
+		names = append(names, p)
+	}
+
+	if err := fstest.TestFS(fsys, names...); err != nil {
+		t.Fatalf("TestFS: %v", err)
+	}
+
+	// Contents should come through intact.
+	for p, want := range files {
+		f, err := fsys.Open(p)
+		if err != nil {
+			t.Fatalf("Open(%q): %v", p, err)
+		}
+
+		got, err := ioutil.ReadAll(f)
+		f.Close()
+
+		if err != nil {
+			t.Fatalf("ReadAll(%q): %v", p, err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Errorf("%q: got %d bytes, want %d", p, len(got), len(want))
+		}
+	}
+
+	if _, err := fsys.Open("a/nope"); !os.IsNotExist(err) {
+		t.Errorf("Open(a/nope): got %v, want not exist", err)
+	}
+
+	if _, err := fsys.Open("hello.txt/x"); err == nil {
+		t.Error("Open(hello.txt/x) succeeded")
+	}
+
+	// Every lookup and handle should have been balanced.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.lookups) != 0 || fs.handles != 0 {
+		t.Errorf("Unbalanced lookups %v, handles %d", fs.lookups, fs.handles)
+	}
+}
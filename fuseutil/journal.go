@@ -0,0 +1,665 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fuseutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A metadata op recorded in a Journal: one that a file system has
+// acknowledged to the kernel but not yet committed to its backend.
+type JournalRecord struct {
+	// Assigned by Journal.Append, increasing from each record to the next.
+	Seq uint64
+
+	// What the op was. The journal doesn't interpret this; its values are up
+	// to the file system.
+	Kind uint32
+
+	// The inodes the op affects, e.g. for a rename the child and both parents.
+	// Syncing any of them with Journal.SyncInode makes the record durable.
+	Inodes []fuseops.InodeID
+
+	// The op's arguments, encoded however the file system likes, e.g. a name
+	// and a mode.
+	Args [][]byte
+}
+
+// Configuration for OpenJournal.
+type JournalConfig struct {
+	// The journal's file, which is created if it doesn't exist.
+	Path string
+
+	// How often appended records are made durable, if nothing syncs them
+	// sooner. One fsync covers every record appended before it, so a longer
+	// interval means fewer fsyncs, but more acknowledged ops lost to a power
+	// failure. Zero means 10ms.
+	SyncInterval time.Duration
+
+	// Called by OpenJournal with the records left uncommitted by an earlier
+	// run, in the order they were appended, to apply them to the backend.
+	//
+	// A crash may come after the backend commits a batch but before the
+	// journal learns of it, so Apply must cope with records whose ops the
+	// backend already holds, e.g. by applying ops idempotently.
+	Apply func(context.Context, []JournalRecord) error
+}
+
+const defaultJournalSyncInterval = 10 * time.Millisecond
+
+// A Journal is a write-ahead log for file systems that batch metadata
+// mutations (e.g. a rename, a setattr and a setxattr) into one commit to
+// their backend, so that ops acknowledged to the kernel survive a crash
+// before the commit. A file system appends a record for each such op before
+// replying to it, calls Commit once the backend holds the op, and passes the
+// records left over from a crash to JournalConfig.Apply when it next starts.
+//
+// Appended records reach the file straight away, so they survive the file
+// system process being killed, and are fsync'd together every
+// JournalConfig.SyncInterval, so that they survive a power failure too. Use
+// SyncInode or NewJournalingFileSystem to make an inode's records durable
+// sooner, as for fsync(2).
+//
+// Once the journal fails to write or fsync its file it can't tell what
+// reached storage, so every later call fails.
+type Journal struct {
+	f *os.File
+
+	// Closed to stop syncLoop, which then closes syncLoopDone.
+	closing      chan struct{}
+	syncLoopDone chan struct{}
+
+	// Sent to, without blocking, to have syncLoop sync straight away.
+	kick chan struct{}
+
+	mu sync.Mutex
+
+	// The sequence numbers of the next record to be appended, of the last
+	// record written and fsync'd, and of the last record the backend has
+	// committed.
+	//
+	// GUARDED_BY(mu)
+	next      uint64
+	synced    uint64
+	committed uint64
+
+	// For each inode with records not yet fsync'd, the last of them.
+	//
+	// GUARDED_BY(mu)
+	unsynced map[fuseops.InodeID]uint64
+
+	// The size of the file.
+	//
+	// GUARDED_BY(mu)
+	size int64
+
+	// Closed and replaced whenever synced or err changes.
+	//
+	// GUARDED_BY(mu)
+	syncedChanged chan struct{}
+
+	// The error that broke the journal, if any.
+	//
+	// GUARDED_BY(mu)
+	err error
+}
+
+// The journal's file starts with a header, followed by a sequence of frames:
+//
+//	header: magic (8 bytes), version (uint32), first sequence number (uint64)
+//	frame:  payload length (uint32), CRC-32C of payload (uint32), payload
+//
+// integers are little-endian. A payload is a frame type byte followed by
+// uvarints: for a record, its sequence number, kind, inode count, inodes and
+// argument count, with each argument as a length and its bytes; for a commit,
+// the sequence number through which the backend has committed.
+//
+// A crash while appending may leave a partial or garbled frame at the end of
+// the file. Reading stops at the first frame that doesn't check out, and
+// OpenJournal discards it and anything after it.
+const (
+	journalMagic      = "fusejrnl"
+	journalVersion    = 1
+	journalHeaderSize = 8 + 4 + 8
+	journalFrameSize  = 4 + 4
+)
+
+const (
+	journalFrameRecord = 1
+	journalFrameCommit = 2
+)
+
+// Once every record is committed and the file has grown to this size, it is
+// truncated.
+const journalCompactSize = 1 << 20
+
+var journalCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// OpenJournal opens the journal at cfg.Path, applies the records it holds
+// that were never committed, and starts syncing it in the background. It
+// fails if Apply does, leaving the records in place for next time.
+func OpenJournal(
+	ctx context.Context,
+	cfg JournalConfig) (*Journal, error) {
+	f, err := os.OpenFile(cfg.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := openJournalFile(ctx, f, cfg.Apply)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	interval := cfg.SyncInterval
+	if interval == 0 {
+		interval = defaultJournalSyncInterval
+	}
+
+	go j.syncLoop(interval)
+	return j, nil
+}
+
+func openJournalFile(
+	ctx context.Context,
+	f *os.File,
+	apply func(context.Context, []JournalRecord) error) (*Journal, error) {
+	contents, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("Reading journal: %v", err)
+	}
+
+	// A file too short for a header is new, or was being reset after every
+	// record was committed.
+	next := uint64(1)
+	var pending []JournalRecord
+	if len(contents) >= journalHeaderSize {
+		next, pending, err = readJournal(contents)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(pending) > 0 {
+		if apply == nil {
+			return nil, errors.New("Journal holds uncommitted records, but no Apply function was given")
+		}
+
+		if err := apply(ctx, pending); err != nil {
+			return nil, err
+		}
+	}
+
+	j := &Journal{
+		f:             f,
+		closing:       make(chan struct{}),
+		syncLoopDone:  make(chan struct{}),
+		kick:          make(chan struct{}, 1),
+		next:          next,
+		synced:        next - 1,
+		committed:     next - 1,
+		unsynced:      make(map[fuseops.InodeID]uint64),
+		syncedChanged: make(chan struct{}),
+	}
+
+	// Everything has now been applied, so start afresh.
+	if err := j.reset(); err != nil {
+		return nil, err
+	}
+
+	if err := f.Sync(); err != nil {
+		return nil, fmt.Errorf("Sync: %v", err)
+	}
+
+	return j, nil
+}
+
+// Parse the journal's contents, returning the sequence number for the next
+// record and the records not committed.
+func readJournal(contents []byte) (
+	next uint64, pending []JournalRecord, err error) {
+	if string(contents[:8]) != journalMagic {
+		err = errors.New("Not a journal")
+		return
+	}
+
+	if v := binary.LittleEndian.Uint32(contents[8:]); v != journalVersion {
+		err = fmt.Errorf("Journal has version %d; want %d", v, journalVersion)
+		return
+	}
+
+	next = binary.LittleEndian.Uint64(contents[12:])
+
+	var records []JournalRecord
+	var committed uint64
+	rest := contents[journalHeaderSize:]
+	for len(rest) >= journalFrameSize {
+		n := binary.LittleEndian.Uint32(rest)
+		sum := binary.LittleEndian.Uint32(rest[4:])
+		if uint64(n) > uint64(len(rest)-journalFrameSize) {
+			break
+		}
+
+		payload := rest[journalFrameSize : journalFrameSize+int(n)]
+		if crc32.Checksum(payload, journalCRCTable) != sum {
+			break
+		}
+
+		frameType, r, ok := decodeJournalFrame(payload)
+		if !ok {
+			break
+		}
+
+		switch frameType {
+		case journalFrameRecord:
+			records = append(records, r)
+			if r.Seq >= next {
+				next = r.Seq + 1
+			}
+
+		case journalFrameCommit:
+			if r.Seq > committed {
+				committed = r.Seq
+			}
+		}
+
+		rest = rest[journalFrameSize+int(n):]
+	}
+
+	for _, r := range records {
+		if r.Seq > committed {
+			pending = append(pending, r)
+		}
+	}
+
+	return
+}
+
+func decodeJournalFrame(payload []byte) (
+	frameType byte, r JournalRecord, ok bool) {
+	if len(payload) == 0 {
+		return
+	}
+
+	frameType = payload[0]
+	rest := payload[1:]
+
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(rest)
+		if n <= 0 {
+			ok = false
+			return 0
+		}
+
+		rest = rest[n:]
+		return v
+	}
+
+	ok = true
+	r.Seq = uvarint()
+	switch frameType {
+	case journalFrameCommit:
+
+	case journalFrameRecord:
+		r.Kind = uint32(uvarint())
+
+		for i, n := uint64(0), uvarint(); ok && i < n; i++ {
+			r.Inodes = append(r.Inodes, fuseops.InodeID(uvarint()))
+		}
+
+		for i, n := uint64(0), uvarint(); ok && i < n; i++ {
+			size := uvarint()
+			if size > uint64(len(rest)) {
+				ok = false
+				break
+			}
+
+			arg := make([]byte, size)
+			copy(arg, rest)
+			r.Args = append(r.Args, arg)
+			rest = rest[size:]
+		}
+
+	default:
+		ok = false
+	}
+
+	if len(rest) != 0 {
+		ok = false
+	}
+
+	return
+}
+
+func encodeJournalFrame(frameType byte, r *JournalRecord) []byte {
+	var payload bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	uvarint := func(v uint64) {
+		payload.Write(tmp[:binary.PutUvarint(tmp[:], v)])
+	}
+
+	payload.WriteByte(frameType)
+	uvarint(r.Seq)
+	if frameType == journalFrameRecord {
+		uvarint(uint64(r.Kind))
+
+		uvarint(uint64(len(r.Inodes)))
+		for _, inode := range r.Inodes {
+			uvarint(uint64(inode))
+		}
+
+		uvarint(uint64(len(r.Args)))
+		for _, arg := range r.Args {
+			uvarint(uint64(len(arg)))
+			payload.Write(arg)
+		}
+	}
+
+	frame := make([]byte, journalFrameSize, journalFrameSize+payload.Len())
+	binary.LittleEndian.PutUint32(frame, uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(frame[4:], crc32.Checksum(payload.Bytes(), journalCRCTable))
+	return append(frame, payload.Bytes()...)
+}
+
+// Empty the file, leaving a header that continues from j.next. Every record
+// must have been committed.
+//
+// LOCKS_REQUIRED(j.mu)
+func (j *Journal) reset() error {
+	if err := j.f.Truncate(0); err != nil {
+		return fmt.Errorf("Truncate: %v", err)
+	}
+
+	header := make([]byte, journalHeaderSize)
+	copy(header, journalMagic)
+	binary.LittleEndian.PutUint32(header[8:], journalVersion)
+	binary.LittleEndian.PutUint64(header[12:], j.next)
+
+	j.size = 0
+	return j.write(header)
+}
+
+// LOCKS_REQUIRED(j.mu)
+func (j *Journal) write(b []byte) error {
+	n, err := j.f.Write(b)
+	j.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("Write: %v", err)
+	}
+
+	return nil
+}
+
+// Record that the journal is broken.
+//
+// LOCKS_REQUIRED(j.mu)
+func (j *Journal) fail(err error) error {
+	if j.err == nil {
+		j.err = err
+		close(j.syncedChanged)
+		j.syncedChanged = make(chan struct{})
+	}
+
+	return j.err
+}
+
+// Append writes r to the journal, setting r.Seq, and returns its sequence
+// number. It doesn't wait for the record to be durable.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *Journal) Append(r *JournalRecord) (uint64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return 0, j.err
+	}
+
+	r.Seq = j.next
+	if err := j.write(encodeJournalFrame(journalFrameRecord, r)); err != nil {
+		return 0, j.fail(err)
+	}
+
+	j.next++
+	for _, inode := range r.Inodes {
+		j.unsynced[inode] = r.Seq
+	}
+
+	return r.Seq, nil
+}
+
+// Commit records that the backend now holds the ops of every record through
+// seq, so that they needn't be applied after a crash. It doesn't wait for
+// this to be durable; the worst a crash can do is have them applied again.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *Journal) Commit(seq uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return j.err
+	}
+
+	if seq >= j.next {
+		return fmt.Errorf("Commit(%d): the last record is %d", seq, j.next-1)
+	}
+
+	if seq <= j.committed {
+		return nil
+	}
+
+	j.committed = seq
+	if j.committed == j.next-1 && j.size >= journalCompactSize {
+		if err := j.reset(); err != nil {
+			return j.fail(err)
+		}
+
+		return nil
+	}
+
+	if err := j.write(encodeJournalFrame(journalFrameCommit, &JournalRecord{Seq: seq})); err != nil {
+		return j.fail(err)
+	}
+
+	return nil
+}
+
+// SyncInode waits until every record affecting the inode has been made
+// durable, fsyncing the journal now if necessary.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *Journal) SyncInode(
+	ctx context.Context,
+	inode fuseops.InodeID) error {
+	j.mu.Lock()
+	seq := j.unsynced[inode]
+	j.mu.Unlock()
+
+	return j.syncThrough(ctx, seq)
+}
+
+// Sync waits until every record appended so far has been made durable,
+// fsyncing the journal now if necessary.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *Journal) Sync(ctx context.Context) error {
+	j.mu.Lock()
+	seq := j.next - 1
+	j.mu.Unlock()
+
+	return j.syncThrough(ctx, seq)
+}
+
+// LOCKS_EXCLUDED(j.mu)
+func (j *Journal) syncThrough(
+	ctx context.Context,
+	seq uint64) error {
+	for {
+		j.mu.Lock()
+		synced, err, changed := j.synced, j.err, j.syncedChanged
+		j.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		if synced >= seq {
+			return nil
+		}
+
+		select {
+		case j.kick <- struct{}{}:
+		default:
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Sync the journal every interval, or when kicked, until closed.
+func (j *Journal) syncLoop(interval time.Duration) {
+	defer close(j.syncLoopDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-j.closing:
+			return
+
+		case <-ticker.C:
+		case <-j.kick:
+		}
+
+		j.syncOnce()
+	}
+}
+
+// LOCKS_EXCLUDED(j.mu)
+func (j *Journal) syncOnce() {
+	j.mu.Lock()
+	target := j.next - 1
+	done := j.synced >= target || j.err != nil
+	j.mu.Unlock()
+
+	if done {
+		return
+	}
+
+	err := j.f.Sync()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err != nil {
+		j.fail(fmt.Errorf("Sync: %v", err))
+		return
+	}
+
+	j.synced = target
+	for inode, seq := range j.unsynced {
+		if seq <= target {
+			delete(j.unsynced, inode)
+		}
+	}
+
+	close(j.syncedChanged)
+	j.syncedChanged = make(chan struct{})
+}
+
+// Close syncs the journal and closes its file. Records not yet committed
+// stay in it, to be applied when it is next opened.
+func (j *Journal) Close() error {
+	close(j.closing)
+	<-j.syncLoopDone
+
+	j.syncOnce()
+
+	j.mu.Lock()
+	err := j.err
+	j.fail(errors.New("Journal closed"))
+	j.mu.Unlock()
+
+	if closeErr := j.f.Close(); err == nil && closeErr != nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// NewJournalingFileSystem wraps the supplied file system so that SyncFile,
+// FlushFile and SyncDir first make the inode's records in j durable (see
+// Journal.SyncInode), failing if that fails. All other methods call straight
+// through.
+func NewJournalingFileSystem(
+	fs FileSystem,
+	j *Journal) FileSystem {
+	return &journalingFileSystem{
+		FileSystem: fs,
+		j:          j,
+	}
+}
+
+type journalingFileSystem struct {
+	FileSystem
+	j *Journal
+}
+
+func (fs *journalingFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if err := fs.j.SyncInode(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+func (fs *journalingFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if err := fs.j.SyncInode(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+func (fs *journalingFileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	if err := fs.j.SyncInode(ctx, op.Inode); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncDir(ctx, op)
+}
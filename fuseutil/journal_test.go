@@ -0,0 +1,463 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fuseutil_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Open the journal in dir, returning the records it applied.
+func openTestJournal(
+	t *testing.T,
+	dir string,
+	interval time.Duration) (*fuseutil.Journal, []fuseutil.JournalRecord) {
+	var applied []fuseutil.JournalRecord
+	j, err := fuseutil.OpenJournal(
+		context.Background(),
+		fuseutil.JournalConfig{
+			Path:         path.Join(dir, "journal"),
+			SyncInterval: interval,
+			Apply: func(ctx context.Context, records []fuseutil.JournalRecord) error {
+				applied = records
+				return nil
+			},
+		})
+
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+
+	return j, applied
+}
+
+func appendRecords(
+	t *testing.T,
+	j *fuseutil.Journal,
+	records []fuseutil.JournalRecord) {
+	for i := range records {
+		if _, err := j.Append(&records[i]); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+}
+
+func TestJournal_Replay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	j, applied := openTestJournal(t, dir, 0)
+	if applied != nil {
+		t.Errorf("New journal applied %v", applied)
+	}
+
+	records := []fuseutil.JournalRecord{
+		{Kind: 1, Inodes: []fuseops.InodeID{2, 3, 4}, Args: [][]byte{[]byte("a"), []byte("b")}},
+		{Kind: 2, Inodes: []fuseops.InodeID{5}, Args: [][]byte{{}, []byte("taco")}},
+		{Kind: 3},
+	}
+
+	appendRecords(t, j, records)
+	for i, r := range records {
+		if r.Seq != uint64(i+1) {
+			t.Errorf("Record %d has Seq %d", i, r.Seq)
+		}
+	}
+
+	if err := j.Commit(1); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A failed Apply leaves the records for next time.
+	_, err = fuseutil.OpenJournal(
+		context.Background(),
+		fuseutil.JournalConfig{
+			Path: path.Join(dir, "journal"),
+			Apply: func(ctx context.Context, records []fuseutil.JournalRecord) error {
+				return errors.New("backend unavailable")
+			},
+		})
+
+	if err == nil || err.Error() != "backend unavailable" {
+		t.Fatalf("OpenJournal with failing Apply: %v", err)
+	}
+
+	// The records not committed are applied, once.
+	j, applied = openTestJournal(t, dir, 0)
+	if !reflect.DeepEqual(applied, records[1:]) {
+		t.Errorf("Applied %+v, want %+v", applied, records[1:])
+	}
+
+	r := fuseutil.JournalRecord{Kind: 4}
+	appendRecords(t, j, []fuseutil.JournalRecord{r})
+	if err := j.Commit(4); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if err := j.Commit(5); err == nil {
+		t.Errorf("Commit of a record not yet appended succeeded")
+	}
+
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	j, applied = openTestJournal(t, dir, 0)
+	if applied != nil {
+		t.Errorf("Applied %+v again", applied)
+	}
+
+	j.Close()
+}
+
+func TestJournal_TornTail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	j, _ := openTestJournal(t, dir, 0)
+	records := []fuseutil.JournalRecord{
+		{Kind: 1, Args: [][]byte{[]byte("burrito")}},
+		{Kind: 2, Args: [][]byte{[]byte("enchilada")}},
+	}
+
+	appendRecords(t, j, records)
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Lop off the end of the last record, as a crash part way through writing
+	// it might.
+	p := path.Join(dir, "journal")
+	fi, err := os.Stat(p)
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if err := os.Truncate(p, fi.Size()-3); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	j, applied := openTestJournal(t, dir, 0)
+	if !reflect.DeepEqual(applied, records[:1]) {
+		t.Errorf("Applied %+v, want %+v", applied, records[:1])
+	}
+
+	// What follows isn't lost behind the torn record.
+	records = []fuseutil.JournalRecord{{Kind: 3}}
+	appendRecords(t, j, records)
+	if err := j.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	j, applied = openTestJournal(t, dir, 0)
+	if !reflect.DeepEqual(applied, records) {
+		t.Errorf("Applied %+v, want %+v", applied, records)
+	}
+
+	j.Close()
+}
+
+func TestJournal_Version(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	header := []byte("fusejrnl\x02\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00")
+	if err := ioutil.WriteFile(path.Join(dir, "journal"), header, 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	_, err = fuseutil.OpenJournal(
+		context.Background(),
+		fuseutil.JournalConfig{Path: path.Join(dir, "journal")})
+
+	if err == nil || !strings.Contains(err.Error(), "version 2") {
+		t.Errorf("OpenJournal: %v", err)
+	}
+}
+
+// A file system that records the flushes and syncs it sees.
+type journaledFS struct {
+	fuseutil.NotImplementedFileSystem
+	calls []string
+}
+
+func (fs *journaledFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.calls = append(fs.calls, fmt.Sprintf("sync %d", op.Inode))
+	return nil
+}
+
+func (fs *journaledFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.calls = append(fs.calls, fmt.Sprintf("flush %d", op.Inode))
+	return nil
+}
+
+func TestJournal_SyncInode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Long enough that only forcing a sync gets anything synced.
+	j, _ := openTestJournal(t, dir, time.Hour)
+	defer j.Close()
+
+	wrapped := &journaledFS{}
+	fs := fuseutil.NewJournalingFileSystem(wrapped, j)
+
+	appendRecords(t, j, []fuseutil.JournalRecord{{Inodes: []fuseops.InodeID{7}}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := fs.SyncFile(ctx, &fuseops.SyncFileOp{Inode: 7}); err != nil {
+		t.Fatalf("SyncFile: %v", err)
+	}
+
+	appendRecords(t, j, []fuseutil.JournalRecord{{Inodes: []fuseops.InodeID{8, 9}}})
+	if err := fs.FlushFile(ctx, &fuseops.FlushFileOp{Inode: 9}); err != nil {
+		t.Fatalf("FlushFile: %v", err)
+	}
+
+	if err := j.SyncInode(ctx, 10); err != nil {
+		t.Fatalf("SyncInode: %v", err)
+	}
+
+	want := []string{"sync 7", "flush 9"}
+	if !reflect.DeepEqual(wrapped.calls, want) {
+		t.Errorf("Calls: %q, want %q", wrapped.calls, want)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Crashes
+////////////////////////////////////////////////////////////////////////
+
+const journalCrashDirEnv = "FUSEUTIL_JOURNAL_CRASH_DIR"
+
+// The records of the crash test set key i%10 of a backend to i. The backend
+// keeps each key in a file.
+func setRecord(i int) fuseutil.JournalRecord {
+	return fuseutil.JournalRecord{
+		Kind:   1,
+		Inodes: []fuseops.InodeID{fuseops.InodeID(i%10 + 2)},
+		Args:   [][]byte{[]byte(fmt.Sprintf("k%d", i%10)), []byte(strconv.Itoa(i))},
+	}
+}
+
+func applyRecords(
+	backend string,
+	records []fuseutil.JournalRecord) error {
+	for _, r := range records {
+		err := ioutil.WriteFile(path.Join(backend, string(r.Args[0])), r.Args[1], 0600)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run by TestJournal_Crash in a child process, to append, acknowledge and
+// commit records until killed. It reports each acknowledgment on stdout.
+func TestJournal_CrashHelper(t *testing.T) {
+	dir := os.Getenv(journalCrashDirEnv)
+	if dir == "" {
+		t.Skip("Run by TestJournal_Crash")
+	}
+
+	ctx := context.Background()
+	backend := path.Join(dir, "backend")
+	j, err := fuseutil.OpenJournal(ctx, fuseutil.JournalConfig{
+		Path: path.Join(dir, "journal"),
+	})
+
+	if err != nil {
+		t.Fatalf("OpenJournal: %v", err)
+	}
+
+	var batch []fuseutil.JournalRecord
+	for i := 0; ; i++ {
+		r := setRecord(i)
+		if _, err := j.Append(&r); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+
+		batch = append(batch, r)
+
+		// Acknowledge every fifth record, as a file system replying to an op
+		// would, once the records so far are durable.
+		if i%5 == 4 {
+			if err := j.Sync(ctx); err != nil {
+				t.Fatalf("Sync: %v", err)
+			}
+
+			fmt.Printf("acked %d\n", i)
+		}
+
+		// Commit every fifteenth to the backend.
+		if i%15 == 14 {
+			if err := applyRecords(backend, batch); err != nil {
+				t.Fatalf("applyRecords: %v", err)
+			}
+
+			if err := j.Commit(r.Seq); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+
+			batch = nil
+		}
+	}
+}
+
+func TestJournal_Crash(t *testing.T) {
+	replayed := 0
+	for trial := 0; trial < 10; trial++ {
+		dir, err := ioutil.TempDir("", "journal_test")
+		if err != nil {
+			t.Fatalf("TempDir: %v", err)
+		}
+
+		defer os.RemoveAll(dir)
+
+		backend := path.Join(dir, "backend")
+		if err := os.Mkdir(backend, 0700); err != nil {
+			t.Fatalf("Mkdir: %v", err)
+		}
+
+		// Kill the child with SIGKILL at a random point after it has
+		// acknowledged some records.
+		cmd := exec.Command(os.Args[0], "-test.run=^TestJournal_CrashHelper$")
+		cmd.Env = append(os.Environ(), journalCrashDirEnv+"="+dir)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatalf("StdoutPipe: %v", err)
+		}
+
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+
+		lastAcked := -1
+		target := 1 + rand.Intn(20)
+		scanner := bufio.NewScanner(stdout)
+		for n := 0; n < target && scanner.Scan(); {
+			if i, err := strconv.Atoi(strings.TrimPrefix(scanner.Text(), "acked ")); err == nil {
+				lastAcked = i
+				n++
+			}
+		}
+
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		if lastAcked < 0 {
+			t.Fatalf("Trial %d: the child acknowledged nothing", trial)
+		}
+
+		// Replay what the child left.
+		j, err := fuseutil.OpenJournal(
+			context.Background(),
+			fuseutil.JournalConfig{
+				Path: path.Join(dir, "journal"),
+				Apply: func(ctx context.Context, records []fuseutil.JournalRecord) error {
+					replayed++
+					return applyRecords(backend, records)
+				},
+			})
+
+		if err != nil {
+			t.Fatalf("Trial %d: OpenJournal: %v", trial, err)
+		}
+
+		j.Close()
+
+		// The backend must reflect every record through some point at or after
+		// the last one acknowledged, and nothing after that point.
+		values := make(map[int]int)
+		last := -1
+		for k := 0; k < 10; k++ {
+			contents, err := ioutil.ReadFile(path.Join(backend, fmt.Sprintf("k%d", k)))
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("ReadFile: %v", err)
+			}
+
+			v, err := strconv.Atoi(string(contents))
+			if err != nil {
+				t.Fatalf("Trial %d: key %d holds %q", trial, k, contents)
+			}
+
+			values[k] = v
+			if v > last {
+				last = v
+			}
+		}
+
+		if last < lastAcked {
+			t.Errorf("Trial %d: backend holds records through %d; %d was acknowledged", trial, last, lastAcked)
+		}
+
+		for k := 0; k < 10; k++ {
+			want, ok := last-(last-k+10)%10, last >= k
+			if got, present := values[k]; present != ok || got != want && ok {
+				t.Errorf("Trial %d: key %d holds %d (%v), want %d (%v)", trial, k, got, present, want, ok)
+			}
+		}
+	}
+
+	// The kills came between acknowledgment and commit at least some times.
+	if replayed == 0 {
+		t.Errorf("No trial left records to replay")
+	}
+}
@@ -0,0 +1,431 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The number of shards over which LookupCounts spreads inodes, by ID modulo
+// the number. Each has its own lock, so that ops for different inodes rarely
+// contend.
+const lookupShards = 64
+
+// The length at which a shard's slab starts. See lookupShard.grow.
+const minLookupSlab = 512
+
+// The count of a single inode. The zero value is a free slot.
+type lookupCount struct {
+	// The count, if mount isn't sharedCount.
+	n uint32
+
+	// The index of the connection to which the count belongs, plus one (see
+	// LookupCounts.mountIndex), or sharedCount if the inode's counts are
+	// instead in lookupShard.shared.
+	mount uint32
+}
+
+// The value of lookupCount.mount for an inode that more than one connection
+// refers to, or whose count doesn't fit in lookupCount.n.
+const sharedCount = ^uint32(0)
+
+type sharedCounts struct {
+	// The sum of byMount.
+	total uint64
+
+	// Counts by lookupCount.mount.
+	//
+	// INVARIANT: No count is zero.
+	byMount map[uint32]uint64
+}
+
+// The counts of the inodes whose IDs are congruent to index modulo
+// lookupShards.
+//
+// Most file systems choose small, dense inode IDs, as memfs does, or could.
+// The counts of those are kept in a slab indexed by slot, the ID divided by
+// lookupShards, so that they cost 8 bytes each. So that a file system choosing
+// sparse IDs, such as hashes, doesn't make the slab huge and mostly empty,
+// it grows only while at least half full, and inodes whose slots lie beyond
+// it are kept in a hash table instead.
+type lookupShard struct {
+	index uint64
+
+	mu sync.Mutex
+
+	// INVARIANT: len(slab) is zero or no less than minLookupSlab.
+	// INVARIANT: slabLive is the number of non-free entries in slab.
+	//
+	// GUARDED_BY(mu)
+	slab     []lookupCount
+	slabLive int
+
+	// The inodes with slots not less than len(slab).
+	//
+	// GUARDED_BY(mu)
+	table lookupTable
+
+	// The counts of inodes marked sharedCount.
+	//
+	// GUARDED_BY(mu)
+	shared map[fuseops.InodeID]*sharedCounts
+}
+
+// Return the ID of the inode at the given slot of the shard.
+func (s *lookupShard) inode(slot uint64) fuseops.InodeID {
+	return fuseops.InodeID(slot*lookupShards + s.index)
+}
+
+// Return the count of the given inode, or nil if it has none. If create is
+// set, return a free slot for it instead, which the caller must fill in. The
+// result is invalidated by any other change to the shard.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *lookupShard) find(
+	inode fuseops.InodeID,
+	create bool) *lookupCount {
+	slot := uint64(inode) / lookupShards
+	if slot >= uint64(len(s.slab)) && create {
+		s.grow(slot)
+	}
+
+	if slot < uint64(len(s.slab)) {
+		c := &s.slab[slot]
+		if c.mount == 0 {
+			if !create {
+				return nil
+			}
+
+			s.slabLive++
+		}
+
+		return c
+	}
+
+	return s.table.find(inode, create)
+}
+
+// Remove the given inode's count.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *lookupShard) remove(inode fuseops.InodeID) {
+	slot := uint64(inode) / lookupShards
+	if slot < uint64(len(s.slab)) {
+		s.slab[slot] = lookupCount{}
+		s.slabLive--
+		return
+	}
+
+	s.table.remove(inode)
+}
+
+// Extend the slab to cover the given slot, if that keeps it dense enough,
+// moving the counts it comes to cover out of the table. Growing the slab by a
+// quarter only when it is half full keeps at least two fifths of it in use,
+// and all but a fifth when IDs are dense.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *lookupShard) grow(slot uint64) {
+	n := uint64(len(s.slab))
+	newLen := n + n/4
+
+	switch {
+	case n == 0:
+		newLen = minLookupSlab
+
+	case uint64(s.slabLive) < n/2:
+		return
+	}
+
+	if slot >= newLen {
+		return
+	}
+
+	slab := make([]lookupCount, newLen)
+	copy(slab, s.slab)
+	s.slab = slab
+
+	var moved []fuseops.InodeID
+	s.table.each(func(inode fuseops.InodeID, c lookupCount) {
+		if slot := uint64(inode) / lookupShards; slot < newLen {
+			s.slab[slot] = c
+			s.slabLive++
+			moved = append(moved, inode)
+		}
+	})
+
+	for _, inode := range moved {
+		s.table.remove(inode)
+	}
+}
+
+// Add n to the count of the given inode for the given connection (see
+// lookupCount.mount).
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *lookupShard) add(
+	inode fuseops.InodeID,
+	mount uint32,
+	n uint64) {
+	c := s.find(inode, true)
+	switch {
+	case c.mount == 0 && n <= uint64(^uint32(0)):
+		*c = lookupCount{n: uint32(n), mount: mount}
+		return
+
+	case c.mount == mount && uint64(c.n)+n <= uint64(^uint32(0)):
+		c.n += uint32(n)
+		return
+
+	case c.mount != sharedCount:
+		sc := &sharedCounts{byMount: make(map[uint32]uint64)}
+		if c.mount != 0 {
+			sc.byMount[c.mount] = uint64(c.n)
+			sc.total = uint64(c.n)
+		}
+
+		*c = lookupCount{mount: sharedCount}
+		if s.shared == nil {
+			s.shared = make(map[fuseops.InodeID]*sharedCounts)
+		}
+
+		s.shared[inode] = sc
+	}
+
+	sc := s.shared[inode]
+	sc.byMount[mount] += n
+	sc.total += n
+}
+
+// Subtract up to n from the count of the given inode for the given
+// connection, returning its remaining total over all connections.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *lookupShard) subtract(
+	inode fuseops.InodeID,
+	mount uint32,
+	n uint64) uint64 {
+	c := s.find(inode, false)
+	switch {
+	case c == nil:
+		return 0
+
+	case c.mount == sharedCount:
+		return s.subtractShared(inode, mount, n)
+
+	case c.mount != mount:
+		return uint64(c.n)
+
+	case n >= uint64(c.n):
+		s.remove(inode)
+		return 0
+	}
+
+	c.n -= uint32(n)
+	return uint64(c.n)
+}
+
+// LOCKS_REQUIRED(s.mu)
+func (s *lookupShard) subtractShared(
+	inode fuseops.InodeID,
+	mount uint32,
+	n uint64) uint64 {
+	sc := s.shared[inode]
+	if c := sc.byMount[mount]; n >= c {
+		n = c
+		delete(sc.byMount, mount)
+	} else {
+		sc.byMount[mount] = c - n
+	}
+
+	sc.total -= n
+	if sc.total == 0 {
+		delete(s.shared, inode)
+		s.remove(inode)
+	}
+
+	return sc.total
+}
+
+// Return the total count of the given inode.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *lookupShard) total(inode fuseops.InodeID) uint64 {
+	c := s.find(inode, false)
+	switch {
+	case c == nil:
+		return 0
+
+	case c.mount == sharedCount:
+		return s.shared[inode].total
+	}
+
+	return uint64(c.n)
+}
+
+// Drop all counts for the given connection, returning the inodes whose total
+// counts thereby dropped to zero.
+//
+// LOCKS_REQUIRED(s.mu)
+func (s *lookupShard) forgetMount(mount uint32) (released []fuseops.InodeID) {
+	for slot := range s.slab {
+		if s.slab[slot].mount == mount {
+			s.slab[slot] = lookupCount{}
+			s.slabLive--
+			released = append(released, s.inode(uint64(slot)))
+		}
+	}
+
+	var inTable []fuseops.InodeID
+	s.table.each(func(inode fuseops.InodeID, c lookupCount) {
+		if c.mount == mount {
+			inTable = append(inTable, inode)
+		}
+	})
+
+	for _, inode := range inTable {
+		s.table.remove(inode)
+	}
+
+	released = append(released, inTable...)
+
+	for inode, sc := range s.shared {
+		if c, ok := sc.byMount[mount]; ok {
+			if s.subtractShared(inode, mount, c) == 0 {
+				released = append(released, inode)
+			}
+		}
+	}
+
+	return released
+}
+
+////////////////////////////////////////////////////////////////////////
+// lookupTable
+////////////////////////////////////////////////////////////////////////
+
+// The smallest number of entries in a non-empty lookupTable.
+const minLookupTable = 16
+
+// An open-addressing hash table of lookup counts, using linear probing. Entries
+// cost 16 bytes, and the table is kept between a quarter and three quarters
+// full once past its minimum size. The zero value is empty.
+type lookupTable struct {
+	// Free entries have inode zero, which the kernel never uses.
+	//
+	// INVARIANT: len(entries) is zero or a power of two.
+	// INVARIANT: live is the number of non-free entries.
+	entries []lookupTableEntry
+	live    int
+}
+
+type lookupTableEntry struct {
+	inode fuseops.InodeID
+	c     lookupCount
+}
+
+// Return the index of the entry at which to start looking for inode.
+func (t *lookupTable) home(inode fuseops.InodeID) int {
+	// Fibonacci hashing, so that IDs with patterns in their low bits still
+	// spread out.
+	h := uint64(inode) * 0x9e3779b97f4a7c15
+	return int(h >> 32 & uint64(len(t.entries)-1))
+}
+
+// As for lookupShard.find.
+func (t *lookupTable) find(
+	inode fuseops.InodeID,
+	create bool) *lookupCount {
+	if create && (t.live+1)*4 > len(t.entries)*3 {
+		t.resize(2 * len(t.entries))
+	}
+
+	if len(t.entries) == 0 {
+		return nil
+	}
+
+	mask := len(t.entries) - 1
+	for i := t.home(inode); ; i = (i + 1) & mask {
+		e := &t.entries[i]
+		switch e.inode {
+		case inode:
+			return &e.c
+
+		case 0:
+			if !create {
+				return nil
+			}
+
+			e.inode = inode
+			t.live++
+			return &e.c
+		}
+	}
+}
+
+// Remove the entry for the given inode, which must exist.
+func (t *lookupTable) remove(inode fuseops.InodeID) {
+	mask := len(t.entries) - 1
+	i := t.home(inode)
+	for t.entries[i].inode != inode {
+		i = (i + 1) & mask
+	}
+
+	// Shift back later entries that would otherwise become unreachable,
+	// rather than leaving a tombstone.
+	for j := (i + 1) & mask; t.entries[j].inode != 0; j = (j + 1) & mask {
+		// The entry at j may move to i if its home doesn't lie cyclically in
+		// (i, j].
+		if h := t.home(t.entries[j].inode); (j-h)&mask >= (j-i)&mask {
+			t.entries[i] = t.entries[j]
+			i = j
+		}
+	}
+
+	t.entries[i] = lookupTableEntry{}
+	t.live--
+
+	if n := len(t.entries); n > minLookupTable && t.live*4 < n {
+		t.resize(n / 2)
+	}
+}
+
+// Call f for each entry.
+func (t *lookupTable) each(f func(fuseops.InodeID, lookupCount)) {
+	for _, e := range t.entries {
+		if e.inode != 0 {
+			f(e.inode, e.c)
+		}
+	}
+}
+
+// Rehash into a table of the given size, or the minimum if smaller.
+func (t *lookupTable) resize(n int) {
+	if n < minLookupTable {
+		n = minLookupTable
+	}
+
+	old := t.entries
+	t.entries = make([]lookupTableEntry, n)
+	t.live = 0
+
+	for _, e := range old {
+		if e.inode != 0 {
+			*t.find(e.inode, true) = e.c
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"unicode/utf8"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/text/unicode/norm"
+)
+
+// NameTranslator converts names between the form in which a backend stores
+// them and the form in which they are presented to the kernel, e.g. between
+// encodings or Unicode normalization forms. See NewTranslatingPathBackend.
+type NameTranslator interface {
+	// Return the name to present for one the backend stores, or an error if
+	// it can't be presented.
+	Present(stored string) (string, error)
+
+	// Return the name to store for one that is presented, or an error if it
+	// can't be stored.
+	Store(presented string) (string, error)
+}
+
+// NormalizingTranslator is a NameTranslator for backends that store names in
+// a different Unicode normalization form from the one presented, such as the
+// NFD that HFS+ and files created by the macOS Finder use, where other
+// software looks names up in NFC:
+//
+//	fuseutil.NormalizingTranslator{Stored: norm.NFD, Presented: norm.NFC}
+//
+// Names that aren't valid UTF-8 can be neither presented nor stored.
+type NormalizingTranslator struct {
+	Stored    norm.Form
+	Presented norm.Form
+}
+
+var errInvalidUTF8 = errors.New("Invalid UTF-8")
+
+func (t NormalizingTranslator) Present(stored string) (string, error) {
+	if !utf8.ValidString(stored) {
+		return "", errInvalidUTF8
+	}
+
+	return t.Presented.String(stored), nil
+}
+
+func (t NormalizingTranslator) Store(presented string) (string, error) {
+	if !utf8.ValidString(presented) {
+		return "", errInvalidUTF8
+	}
+
+	return t.Stored.String(presented), nil
+}
+
+// Latin1Translator is a NameTranslator for backends that store names in
+// ISO 8859-1, presenting them in UTF-8. Every stored name can be presented,
+// but only presented names made up of the first 256 code points can be
+// stored.
+type Latin1Translator struct{}
+
+func (Latin1Translator) Present(stored string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(stored); i++ {
+		b.WriteRune(rune(stored[i]))
+	}
+
+	return b.String(), nil
+}
+
+func (Latin1Translator) Store(presented string) (string, error) {
+	var b strings.Builder
+	for _, r := range presented {
+		if r > 0xff {
+			return "", errors.New("Not representable in ISO 8859-1")
+		}
+
+		b.WriteByte(byte(r))
+	}
+
+	return b.String(), nil
+}
+
+// NamePolicy says what NewTranslatingPathBackend does with stored names that
+// don't survive a round trip through the translator, i.e. that can't be
+// presented, or whose presented form would be stored under a different name.
+type NamePolicy int
+
+const (
+	// Present the name with each byte at or above 0x80 replaced by the code
+	// point U+F700 plus the byte, from Unicode's private use area, so that
+	// the file can still be reached. Presented names containing such code
+	// points are taken to be escaped in this way, and stored names that
+	// contain them are escaped too.
+	NamePolicyEscape NamePolicy = iota
+
+	// Leave the name out of directory listings, making the file unreachable.
+	NamePolicyHide
+
+	// Fail listings of directories containing the name with EIO.
+	NamePolicyError
+)
+
+// The code points to which NamePolicyEscape maps the bytes 0x80 to 0xff.
+const (
+	escapeBase = 0xf700
+	escapeMin  = escapeBase + 0x80
+	escapeMax  = escapeBase + 0xff
+)
+
+// Return whether s contains any of the code points used for escaping.
+func containsEscapes(s string) bool {
+	for _, r := range s {
+		if r >= escapeMin && r <= escapeMax {
+			return true
+		}
+	}
+
+	return false
+}
+
+func escapeName(stored string) string {
+	var b strings.Builder
+	for i := 0; i < len(stored); i++ {
+		if c := stored[i]; c >= 0x80 {
+			b.WriteRune(escapeBase + rune(c))
+		} else {
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// Undo escapeName, failing if presented isn't the result of escaping
+// something.
+func unescapeName(presented string) (string, bool) {
+	var b strings.Builder
+	for _, r := range presented {
+		switch {
+		case r < 0x80:
+			b.WriteByte(byte(r))
+
+		case r >= escapeMin && r <= escapeMax:
+			b.WriteByte(byte(r - escapeBase))
+
+		default:
+			return "", false
+		}
+	}
+
+	return b.String(), true
+}
+
+// A PathBackend that translates the names of another.
+type translatingPathBackend struct {
+	wrapped    PathBackend
+	translator NameTranslator
+	policy     NamePolicy
+}
+
+// NewTranslatingPathBackend wraps a PathBackend whose names are stored in a
+// different form from the one that should be presented to the kernel,
+// translating every path component passed to it and every name it lists.
+//
+// Translation is strict: a stored name is presented as is only if storing the
+// result gives the same name back, and a presented name is accepted only if
+// it is the presented form of what it would be stored as. So each file has
+// exactly one name when served by PathFS, and a name that isn't in presented
+// form, such as an NFD name looked up under NormalizingTranslator with NFC
+// presented, is not found, and can't be created (EILSEQ). Stored names that
+// don't survive the round trip are dealt with according to policy.
+func NewTranslatingPathBackend(
+	wrapped PathBackend,
+	translator NameTranslator,
+	policy NamePolicy) PathBackend {
+	return &translatingPathBackend{
+		wrapped:    wrapped,
+		translator: translator,
+		policy:     policy,
+	}
+}
+
+// Return the presented form of the stored name, and false if it doesn't
+// survive a round trip through the translator.
+func (b *translatingPathBackend) present(stored string) (string, bool) {
+	presented, err := b.translator.Present(stored)
+	if err != nil {
+		return "", false
+	}
+
+	if again, err := b.translator.Store(presented); err != nil || again != stored {
+		return "", false
+	}
+
+	// Names that look escaped must be escaped themselves to be told apart.
+	if b.policy == NamePolicyEscape && containsEscapes(presented) {
+		return "", false
+	}
+
+	return presented, true
+}
+
+// Return the stored form of the presented name, or false if there can be no
+// such stored name.
+func (b *translatingPathBackend) store(presented string) (string, bool) {
+	if b.policy == NamePolicyEscape && containsEscapes(presented) {
+		stored, ok := unescapeName(presented)
+		if !ok {
+			return "", false
+		}
+
+		// Only names that can't be presented otherwise are escaped.
+		if _, ok := b.present(stored); ok {
+			return "", false
+		}
+
+		return stored, true
+	}
+
+	stored, err := b.translator.Store(presented)
+	if err != nil {
+		return "", false
+	}
+
+	if again, ok := b.present(stored); !ok || again != presented {
+		return "", false
+	}
+
+	return stored, true
+}
+
+// Translate each component of the presented path p, failing with the
+// supplied error if the last can't be stored, and ENOENT if another can't.
+func (b *translatingPathBackend) storePath(
+	p string,
+	errno syscall.Errno) (string, error) {
+	if p == "." {
+		return p, nil
+	}
+
+	components := strings.Split(p, "/")
+	for i, c := range components {
+		stored, ok := b.store(c)
+		if !ok && i < len(components)-1 {
+			return "", syscall.ENOENT
+		}
+
+		if !ok {
+			return "", errno
+		}
+
+		components[i] = stored
+	}
+
+	return strings.Join(components, "/"), nil
+}
+
+func (b *translatingPathBackend) GetAttributes(
+	ctx context.Context,
+	p string) (fuseops.InodeAttributes, error) {
+	stored, err := b.storePath(p, syscall.ENOENT)
+	if err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	return b.wrapped.GetAttributes(ctx, stored)
+}
+
+func (b *translatingPathBackend) ReadDir(
+	ctx context.Context,
+	p string) ([]Dirent, error) {
+	stored, err := b.storePath(p, syscall.ENOENT)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := b.wrapped.ReadDir(ctx, stored)
+	if err != nil {
+		return nil, err
+	}
+
+	translated := entries[:0]
+	for _, e := range entries {
+		presented, ok := b.present(e.Name)
+		if !ok {
+			switch b.policy {
+			case NamePolicyEscape:
+				presented = escapeName(e.Name)
+
+			case NamePolicyHide:
+				continue
+
+			default:
+				return nil, syscall.EIO
+			}
+		}
+
+		e.Name = presented
+		translated = append(translated, e)
+	}
+
+	return translated, nil
+}
+
+func (b *translatingPathBackend) ReadFile(
+	ctx context.Context,
+	p string,
+	off int64,
+	dst []byte) (int, error) {
+	stored, err := b.storePath(p, syscall.ENOENT)
+	if err != nil {
+		return 0, err
+	}
+
+	return b.wrapped.ReadFile(ctx, stored, off, dst)
+}
+
+func (b *translatingPathBackend) WriteFile(
+	ctx context.Context,
+	p string,
+	off int64,
+	data []byte) error {
+	stored, err := b.storePath(p, syscall.ENOENT)
+	if err != nil {
+		return err
+	}
+
+	return b.wrapped.WriteFile(ctx, stored, off, data)
+}
+
+func (b *translatingPathBackend) CreateFile(
+	ctx context.Context,
+	p string,
+	mode os.FileMode) (fuseops.InodeAttributes, error) {
+	stored, err := b.storePath(p, syscall.EILSEQ)
+	if err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	return b.wrapped.CreateFile(ctx, stored, mode)
+}
+
+func (b *translatingPathBackend) MkDir(
+	ctx context.Context,
+	p string,
+	mode os.FileMode) (fuseops.InodeAttributes, error) {
+	stored, err := b.storePath(p, syscall.EILSEQ)
+	if err != nil {
+		return fuseops.InodeAttributes{}, err
+	}
+
+	return b.wrapped.MkDir(ctx, stored, mode)
+}
+
+func (b *translatingPathBackend) Unlink(
+	ctx context.Context,
+	p string) error {
+	stored, err := b.storePath(p, syscall.ENOENT)
+	if err != nil {
+		return err
+	}
+
+	return b.wrapped.Unlink(ctx, stored)
+}
+
+func (b *translatingPathBackend) RmDir(
+	ctx context.Context,
+	p string) error {
+	stored, err := b.storePath(p, syscall.ENOENT)
+	if err != nil {
+		return err
+	}
+
+	return b.wrapped.RmDir(ctx, stored)
+}
+
+func (b *translatingPathBackend) Rename(
+	ctx context.Context,
+	oldPath string,
+	newPath string) error {
+	storedOld, err := b.storePath(oldPath, syscall.ENOENT)
+	if err != nil {
+		return err
+	}
+
+	storedNew, err := b.storePath(newPath, syscall.EILSEQ)
+	if err != nil {
+		return err
+	}
+
+	return b.wrapped.Rename(ctx, storedOld, storedNew)
+}
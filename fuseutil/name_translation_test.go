@@ -0,0 +1,232 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Names used below, in both Unicode normalization forms.
+var (
+	cafeNFC  = norm.NFC.String("café")
+	cafeNFD  = norm.NFD.String("café")
+	naiveNFC = norm.NFC.String("naïve")
+	naiveNFD = norm.NFD.String("naïve")
+	uberNFC  = norm.NFC.String("über")
+)
+
+// Create files with the supplied names in the root of a new memBackend.
+func backendWithFiles(
+	t *testing.T,
+	names ...string) *memBackend {
+	b := newMemBackend()
+	for _, name := range names {
+		if _, err := b.CreateFile(context.Background(), name, 0644); err != nil {
+			t.Fatalf("CreateFile(%q): %v", name, err)
+		}
+	}
+
+	return b
+}
+
+// Return the names listed in the root of the backend.
+func rootNames(
+	t *testing.T,
+	b fuseutil.PathBackend) []string {
+	entries, err := b.ReadDir(context.Background(), ".")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+
+	return names
+}
+
+// Return the names stored in the memBackend, other than the root's.
+func storedNames(b *memBackend) map[string]bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	names := make(map[string]bool)
+	for p := range b.entries {
+		if p != "." {
+			names[p] = true
+		}
+	}
+
+	return names
+}
+
+func TestNameTranslation_Normalization(t *testing.T) {
+	ctx := context.Background()
+
+	// The Finder stores names in NFD, while most software looks them up in
+	// NFC.
+	stored := backendWithFiles(t, cafeNFD)
+	pfs := fuseutil.NewPathFS(fuseutil.NewTranslatingPathBackend(
+		stored,
+		fuseutil.NormalizingTranslator{Stored: norm.NFD, Presented: norm.NFC},
+		fuseutil.NamePolicyError))
+
+	lookUp := func(name string) error {
+		return pfs.LookUpInode(ctx, &fuseops.LookUpInodeOp{
+			Parent: fuseops.RootInodeID,
+			Name:   name,
+		})
+	}
+
+	if err := lookUp(cafeNFC); err != nil {
+		t.Errorf("LookUpInode(NFC): %v", err)
+	}
+
+	// Each file has exactly one name.
+	if err := lookUp(cafeNFD); err != syscall.ENOENT {
+		t.Errorf("LookUpInode(NFD): got %v, want ENOENT", err)
+	}
+
+	// New names are stored in NFD, and names not in NFC are refused.
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: naiveNFC}
+	if err := pfs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile(NFC): %v", err)
+	}
+
+	create = &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: naiveNFD + "2"}
+	if err := pfs.CreateFile(ctx, create); err != syscall.EILSEQ {
+		t.Errorf("CreateFile(NFD): got %v, want EILSEQ", err)
+	}
+
+	rename := &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   cafeNFC,
+		NewParent: fuseops.RootInodeID,
+		NewName:   uberNFC,
+	}
+
+	if err := pfs.Rename(ctx, rename); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	want := map[string]bool{naiveNFD: true, norm.NFD.String(uberNFC): true}
+	if got := storedNames(stored); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stored names: got %v, want %v", got, want)
+	}
+}
+
+func TestNameTranslation_Policies(t *testing.T) {
+	translator := fuseutil.NormalizingTranslator{Stored: norm.NFD, Presented: norm.NFC}
+
+	// Another client stored a name in NFC, which has no presented form that
+	// would be stored under the same name, and one that isn't UTF-8 at all.
+	const latin1 = "caf\xe9"
+	stored := backendWithFiles(t, naiveNFD, uberNFC, latin1)
+
+	// Escaped names can be found under the name listed.
+	b := fuseutil.NewTranslatingPathBackend(stored, translator, fuseutil.NamePolicyEscape)
+	names := rootNames(t, b)
+	want := []string{
+		"caf\uf7e9",
+		naiveNFC,
+		"\uf7c3\uf7bcber",
+	}
+
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("Escaped names: got %q, want %q", names, want)
+	}
+
+	for _, name := range names {
+		if _, err := b.GetAttributes(context.Background(), name); err != nil {
+			t.Errorf("GetAttributes(%q): %v", name, err)
+		}
+	}
+
+	// Names that look escaped but aren't the escaped form of an untranslatable
+	// name are not found, even if the name they decode to exists.
+	escapedNaive := "nai\uf7cc\uf788ve"
+	if _, err := stored.GetAttributes(context.Background(), "nai\xcc\x88ve"); err != nil {
+		t.Fatalf("GetAttributes(stored): %v", err)
+	}
+
+	for _, name := range []string{escapedNaive, "\uf7e9é"} {
+		if _, err := b.GetAttributes(context.Background(), name); err != syscall.ENOENT {
+			t.Errorf("GetAttributes(%q): got %v, want ENOENT", name, err)
+		}
+	}
+
+	// Hidden names are left out.
+	b = fuseutil.NewTranslatingPathBackend(stored, translator, fuseutil.NamePolicyHide)
+	if got := rootNames(t, b); !reflect.DeepEqual(got, []string{naiveNFC}) {
+		t.Errorf("Hidden names: got %q", got)
+	}
+
+	// Otherwise listing fails.
+	b = fuseutil.NewTranslatingPathBackend(stored, translator, fuseutil.NamePolicyError)
+	if _, err := b.ReadDir(context.Background(), "."); err != syscall.EIO {
+		t.Errorf("ReadDir: got %v, want EIO", err)
+	}
+}
+
+func TestNameTranslation_Latin1(t *testing.T) {
+	ctx := context.Background()
+	stored := backendWithFiles(t, "caf\xe9")
+	if _, err := stored.MkDir(ctx, "r\xe9sum\xe9s", 0755); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	b := fuseutil.NewTranslatingPathBackend(
+		stored,
+		fuseutil.Latin1Translator{},
+		fuseutil.NamePolicyError)
+
+	want := []string{cafeNFC, norm.NFC.String("résumés")}
+	if got := rootNames(t, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("Names: got %q, want %q", got, want)
+	}
+
+	// Every component of a path is translated.
+	p := norm.NFC.String("résumés/été")
+	if _, err := b.CreateFile(ctx, p, 0644); err != nil {
+		t.Fatalf("CreateFile(%q): %v", p, err)
+	}
+
+	if _, err := stored.GetAttributes(ctx, "r\xe9sum\xe9s/\xe9t\xe9"); err != nil {
+		t.Errorf("GetAttributes(stored): %v", err)
+	}
+
+	// Names outside ISO 8859-1 can't be created, nor found within a directory
+	// whose name is outside it.
+	if _, err := b.CreateFile(ctx, "日本", 0644); err != syscall.EILSEQ {
+		t.Errorf("CreateFile(日本): got %v, want EILSEQ", err)
+	}
+
+	if _, err := b.CreateFile(ctx, "日本/foo", 0644); err != syscall.ENOENT {
+		t.Errorf("CreateFile(日本/foo): got %v, want ENOENT", err)
+	}
+
+	// The stored form isn't a presented name.
+	if _, err := b.GetAttributes(ctx, "caf\xe9"); err != syscall.ENOENT {
+		t.Errorf("GetAttributes(stored form): got %v, want ENOENT", err)
+	}
+}
@@ -16,24 +16,44 @@ package fuseutil
 
 import (
 	"context"
+	"syscall"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 )
 
-// A FileSystem that responds to all ops with fuse.ENOSYS. Embed this in your
-// struct to inherit default implementations for the methods you don't care
-// about, ensuring your struct will continue to implement FileSystem even as
-// new methods are added.
+// A FileSystem that responds to all ops with fuse.ENOSYS, except SyncDir,
+// which succeeds, StatFS, which reports a file system with space to spare,
+// and Ioctl, which fails with ENOTTY. Embed this in your struct to inherit default
+// implementations for the methods you don't care about, ensuring your struct
+// will continue to implement FileSystem even as new methods are added.
 type NotImplementedFileSystem struct {
 }
 
 var _ FileSystem = &NotImplementedFileSystem{}
 
+// The capacity reported by NotImplementedFileSystem.StatFS: 4 PiB in 4 KiB
+// blocks, and four billion inodes, all free.
+const (
+	notImplementedBlockSize = 1 << 12
+	notImplementedBlocks    = 1 << 40
+	notImplementedInodes    = 1 << 32
+)
+
+// StatFS reports a file system that is nowhere near full, since applications
+// often refuse to write to one whose statfs(2) fails, and df(1) hides those
+// that report no blocks at all.
 func (fs *NotImplementedFileSystem) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) error {
-	return fuse.ENOSYS
+	op.BlockSize = notImplementedBlockSize
+	op.IoSize = notImplementedBlockSize
+	op.Blocks = notImplementedBlocks
+	op.BlocksFree = notImplementedBlocks
+	op.BlocksAvailable = notImplementedBlocks
+	op.Inodes = notImplementedInodes
+	op.InodesFree = notImplementedInodes
+	return nil
 }
 
 func (fs *NotImplementedFileSystem) LookUpInode(
@@ -126,6 +146,14 @@ func (fs *NotImplementedFileSystem) ReleaseDirHandle(
 	return fuse.ENOSYS
 }
 
+// SyncDir succeeds, since applications often treat a failed fsync(2) of a
+// directory as fatal.
+func (fs *NotImplementedFileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	return nil
+}
+
 func (fs *NotImplementedFileSystem) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) error {
@@ -198,5 +226,49 @@ func (fs *NotImplementedFileSystem) Fallocate(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	return fuse.ENOSYS
+}
+
+// Ioctl fails with ENOTTY, which tools take to mean the file doesn't support
+// the command, rather than ENOSYS, which they would report.
+func (fs *NotImplementedFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	return syscall.ENOTTY
+}
+
+func (fs *NotImplementedFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) Destroy() {
 }
@@ -0,0 +1,64 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Call every FileSystem method of NotImplementedFileSystem, so that methods
+// added to the interface are covered without being listed here.
+func TestNotImplementedFileSystem(t *testing.T) {
+	// The methods that don't fail with ENOSYS.
+	exceptions := map[string]error{
+		"StatFS":  nil,
+		"SyncDir": nil,
+		"Ioctl":   syscall.ENOTTY,
+	}
+
+	fsType := reflect.TypeOf((*fuseutil.FileSystem)(nil)).Elem()
+	fs := reflect.ValueOf(&fuseutil.NotImplementedFileSystem{})
+	ctx := reflect.ValueOf(context.Background())
+
+	for i := 0; i < fsType.NumMethod(); i++ {
+		m := fsType.Method(i)
+		if m.Type.NumIn() != 2 {
+			// Destroy.
+			continue
+		}
+
+		op := reflect.New(m.Type.In(1).Elem())
+		out := fs.MethodByName(m.Name).Call([]reflect.Value{ctx, op})
+
+		var got error
+		if err, ok := out[0].Interface().(error); ok {
+			got = err
+		}
+
+		want, ok := exceptions[m.Name]
+		if !ok {
+			want = syscall.ENOSYS
+		}
+
+		if got != want {
+			t.Errorf("%s: got %v, want %v", m.Name, got, want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A bytes.Buffer that may be written by the server while the test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer // GUARDED_BY(mu)
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// A file system in which every name but "panic" exists, and looking that one
+// up panics.
+type panicFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *panicFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Name == "panic" {
+		panic("taco")
+	}
+
+	op.Entry.Child = fuseops.RootInodeID + 1
+	op.Entry.Attributes.Nlink = 1
+	return nil
+}
+
+func TestFileSystemServer_Panic(t *testing.T) {
+	servers := map[string]func(fuseutil.FileSystem) fuse.Server{
+		"concurrent": fuseutil.NewFileSystemServer,
+		"serial":     fuseutil.NewSerialFileSystemServer,
+	}
+
+	for name, server := range servers {
+		t.Run(name, func(t *testing.T) {
+			logged := &lockedBuffer{}
+			k, err := fusetesting.NewFakeKernel(server(&panicFS{}), &fuse.MountConfig{
+				ErrorLogger: log.New(logged, "", 0),
+			})
+
+			if err != nil {
+				t.Fatalf("NewFakeKernel: %v", err)
+			}
+
+			defer k.Close()
+
+			// The panicking op fails, and the panic is logged with the op.
+			if _, err := k.LookUp(fuseops.RootInodeID, "panic"); err != syscall.EIO {
+				t.Errorf("LookUp(panic): got %v, want EIO", err)
+			}
+
+			const want = "*fuseops.LookUpInodeOp panicked: taco"
+			if !strings.Contains(logged.String(), want) {
+				t.Errorf("No %q in the error log:\n%s", want, logged.String())
+			}
+
+			// The server carries on, with no lock left held.
+			if _, err := k.LookUp(fuseops.RootInodeID, "foo"); err != nil {
+				t.Errorf("LookUp(foo): %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,753 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// PathBackend is implemented by storage that names files by path rather than
+// by inode, such as an object store or a remote file system, in order to be
+// served by PathFS. Paths are slash-separated and relative to the root, which
+// is ".", as for io/fs.
+//
+// Each file has exactly one path: PathFS doesn't support hard links. Methods
+// may be called concurrently, including those reading a path that a Rename in
+// progress is about to change. PathFS discards the results of such calls (see
+// PathFS).
+//
+// Backends that store names in a different encoding or normalization from the
+// one that should be presented can be wrapped with NewTranslatingPathBackend.
+type PathBackend interface {
+	// Return the attributes of the file or directory at p, or ENOENT if there
+	// is none.
+	GetAttributes(
+		ctx context.Context,
+		p string) (fuseops.InodeAttributes, error)
+
+	// List the directory at p. See PathFS.OpenDir for the use of the entries'
+	// Inode fields; their Offset fields are ignored.
+	ReadDir(
+		ctx context.Context,
+		p string) ([]Dirent, error)
+
+	// Read from the file at p at the given offset into dst, returning the
+	// number of bytes read. Reaching the end of the file is not an error.
+	ReadFile(
+		ctx context.Context,
+		p string,
+		off int64,
+		dst []byte) (int, error)
+
+	// Write data to the file at p at the given offset.
+	WriteFile(
+		ctx context.Context,
+		p string,
+		off int64,
+		data []byte) error
+
+	// Create an empty file or a directory at p, failing with EEXIST if
+	// something is already there, and return its attributes.
+	CreateFile(
+		ctx context.Context,
+		p string,
+		mode os.FileMode) (fuseops.InodeAttributes, error)
+
+	MkDir(
+		ctx context.Context,
+		p string,
+		mode os.FileMode) (fuseops.InodeAttributes, error)
+
+	// Remove the file or empty directory at p.
+	Unlink(ctx context.Context, p string) error
+	RmDir(ctx context.Context, p string) error
+
+	// Move the file or directory at oldPath to newPath, replacing whatever is
+	// there, as for rename(2).
+	Rename(
+		ctx context.Context,
+		oldPath string,
+		newPath string) error
+}
+
+// Points (see Point) reached by PathFS ops that only read from the backend,
+// such as lookups, at which they may race with renames.
+const (
+	// Reached after resolving the path of the inode involved, before calling
+	// the backend with it.
+	PointPathResolved = "fuseutil.path.resolved"
+
+	// Reached when the backend returns, before checking that the path is still
+	// current.
+	PointPathCalled = "fuseutil.path.called"
+)
+
+// The number of times a PathFS op that reads from the backend races with a
+// change to the namespace before waiting for changes to finish instead.
+const maxOptimisticPathAttempts = 3
+
+// PathFS is a FileSystem serving a PathBackend, assigning inode IDs to the
+// paths the kernel looks up and keeping track of the (parent, name) of each,
+// so that ops on an inode reach the backend with its current path, even after
+// the inode or one of its ancestors has been renamed. Inode IDs are never
+// reused.
+//
+// Renames, unlinks and rmdirs change the namespace, and are serialized by a
+// single lock over the whole file system. Ops that write to the backend
+// (creates, mkdirs and writes) hold the same lock shared, so that a
+// concurrent rename can't move the path they are writing to out from under
+// them. Ops that only read from the backend (lookups, getattrs, reads and
+// directory listings) don't wait for renames at all. Instead, once the
+// backend has returned, they check whether the namespace changed in a way
+// that affects the path they used: a rename or removal of the inode or one of
+// its ancestors, or, for lookups, of an entry in the parent directory. If so,
+// the result is discarded and the op tried again with the new path. So a
+// lookup in flight for a path that has been renamed away never records the
+// old name, nor finds whatever has since been created there, and a path walk
+// that races with the rename of a directory it passes through ends up
+// entirely on one side of the rename. An op that keeps racing with renames
+// waits for them after a few attempts.
+//
+// An inode that has been unlinked, or replaced by a rename, no longer has a
+// path, and ops on it fail with ESTALE, even if it's still open: the backend
+// has no other name for it. Lookups and creations within a directory that has
+// been removed fail with ENOENT, as they do for ext4.
+//
+// PathFS keeps lookup counts per connection using LookupCounts, and forgets
+// an inode once its count has dropped to zero and the kernel no longer refers
+// to any of its children.
+type PathFS struct {
+	NotImplementedFileSystem
+
+	backend PathBackend
+	lookups *LookupCounts
+
+	// Held exclusively while changing the namespace, and shared while writing
+	// to the backend. See above.
+	namespaceMu sync.RWMutex
+
+	mu sync.Mutex
+
+	// The inodes the kernel may refer to, including the root.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*pathInode
+
+	// GUARDED_BY(mu)
+	nextID fuseops.InodeID
+
+	// Incremented by each change to the namespace.
+	//
+	// GUARDED_BY(mu)
+	seq uint64
+}
+
+var _ FileSystem = &PathFS{}
+var _ MountDestroyer = &PathFS{}
+
+// An inode known to PathFS.
+type pathInode struct {
+	// The directory containing the inode and its name there. parent is zero for
+	// the root, and for inodes that have been unlinked or replaced.
+	parent fuseops.InodeID
+	name   string
+
+	// The children whose inodes are known, by name.
+	children map[string]fuseops.InodeID
+
+	// The values of PathFS.seq when the inode was last moved or detached, and,
+	// for a directory, when one of its entries was last removed or replaced.
+	moved   uint64
+	changed uint64
+}
+
+// NewPathFS creates a file system serving the supplied backend.
+func NewPathFS(backend PathBackend) *PathFS {
+	return &PathFS{
+		backend: backend,
+		lookups: NewLookupCounts(),
+		inodes: map[fuseops.InodeID]*pathInode{
+			fuseops.RootInodeID: {children: make(map[string]fuseops.InodeID)},
+		},
+		nextID: fuseops.RootInodeID + 1,
+	}
+}
+
+// InodeCount returns the number of inodes PathFS is keeping track of, other
+// than the root, for diagnostics.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *PathFS) InodeCount() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return len(fs.inodes) - 1
+}
+
+////////////////////////////////////////////////////////////////////////
+// Paths
+////////////////////////////////////////////////////////////////////////
+
+// Return the current path of the given inode, or of its child with the given
+// name if name is non-empty.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *PathFS) pathLocked(
+	inode fuseops.InodeID,
+	name string) (string, error) {
+	var components []string
+	if name != "" {
+		components = append(components, name)
+	}
+
+	for id := inode; id != fuseops.RootInodeID; {
+		in := fs.inodes[id]
+		if in == nil || in.parent == 0 {
+			// A directory that has been removed has no children, and nothing may
+			// be created in it.
+			if id == inode && name != "" {
+				return "", syscall.ENOENT
+			}
+
+			return "", syscall.ESTALE
+		}
+
+		components = append(components, in.name)
+		id = in.parent
+	}
+
+	if len(components) == 0 {
+		return ".", nil
+	}
+
+	for i, j := 0, len(components)-1; i < j; i, j = i+1, j-1 {
+		components[i], components[j] = components[j], components[i]
+	}
+
+	return strings.Join(components, "/"), nil
+}
+
+// Return whether the path returned by pathLocked for the same arguments may
+// have changed since fs.seq was seq.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *PathFS) staleLocked(
+	inode fuseops.InodeID,
+	name string,
+	seq uint64) bool {
+	if name != "" {
+		if in := fs.inodes[inode]; in == nil || in.changed > seq {
+			return true
+		}
+	}
+
+	for id := inode; ; {
+		in := fs.inodes[id]
+		if in == nil || in.moved > seq {
+			return true
+		}
+
+		if id == fuseops.RootInodeID {
+			return false
+		}
+
+		if in.parent == 0 {
+			return true
+		}
+
+		id = in.parent
+	}
+}
+
+// Call f with the path of the given inode, or of its child with the given
+// name if name is non-empty, for an op that only reads from the backend. If
+// the path went stale before f returned, call it again with the new one.
+// Otherwise, if f succeeded and commit is non-nil, call commit while the path
+// is known to be current.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *PathFS) read(
+	ctx context.Context,
+	inode fuseops.InodeID,
+	name string,
+	f func(p string) error,
+	commit func()) error {
+	for attempt := 1; ; attempt++ {
+		// Stop renames getting in the way if they keep doing so. The path can't
+		// then go stale.
+		optimistic := attempt <= maxOptimisticPathAttempts
+		if !optimistic {
+			fs.namespaceMu.RLock()
+		}
+
+		fs.mu.Lock()
+		p, err := fs.pathLocked(inode, name)
+		seq := fs.seq
+		fs.mu.Unlock()
+
+		if err != nil {
+			if !optimistic {
+				fs.namespaceMu.RUnlock()
+			}
+
+			return err
+		}
+
+		if optimistic {
+			Point(ctx, PointPathResolved)
+		}
+
+		err = f(p)
+
+		if optimistic {
+			Point(ctx, PointPathCalled)
+		}
+
+		fs.mu.Lock()
+		stale := fs.staleLocked(inode, name, seq)
+		if !stale && err == nil && commit != nil {
+			commit()
+		}
+
+		fs.mu.Unlock()
+
+		if !optimistic {
+			fs.namespaceMu.RUnlock()
+		}
+
+		if !stale {
+			return err
+		}
+	}
+}
+
+// Return the inode for the named child of parent, creating it if necessary,
+// and record a lookup of it.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *PathFS) lookUpLocked(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string) fuseops.InodeID {
+	p := fs.inodes[parent]
+	id, ok := p.children[name]
+	if !ok {
+		id = fs.nextID
+		fs.nextID++
+
+		fs.inodes[id] = &pathInode{
+			parent:   parent,
+			name:     name,
+			children: make(map[string]fuseops.InodeID),
+		}
+
+		p.children[name] = id
+	}
+
+	fs.lookups.Increment(ctx, id)
+	return id
+}
+
+// Note that the named child of parent has been removed or replaced, detaching
+// its inode if known. The caller must then call dropLocked for parent.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *PathFS) removedLocked(
+	parent fuseops.InodeID,
+	name string) {
+	p := fs.inodes[parent]
+	p.changed = fs.seq
+
+	id, ok := p.children[name]
+	if !ok {
+		return
+	}
+
+	delete(p.children, name)
+
+	in := fs.inodes[id]
+	in.parent = 0
+	in.moved = fs.seq
+
+	fs.dropLocked(id)
+}
+
+// Forget the given inode if the kernel no longer refers to it or to any of
+// its children, and likewise its parent in turn.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *PathFS) dropLocked(id fuseops.InodeID) {
+	for id != fuseops.RootInodeID {
+		in := fs.inodes[id]
+		if in == nil || len(in.children) > 0 || fs.lookups.Total(id) > 0 {
+			return
+		}
+
+		delete(fs.inodes, id)
+		if in.parent == 0 {
+			return
+		}
+
+		delete(fs.inodes[in.parent].children, in.name)
+		id = in.parent
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Inodes
+////////////////////////////////////////////////////////////////////////
+
+func (fs *PathFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	var attrs fuseops.InodeAttributes
+	return fs.read(
+		ctx,
+		op.Parent,
+		op.Name,
+		func(p string) (err error) {
+			attrs, err = fs.backend.GetAttributes(ctx, p)
+			return err
+		},
+		func() {
+			op.Entry.Child = fs.lookUpLocked(ctx, op.Parent, op.Name)
+			op.Entry.Attributes = attrs
+		})
+}
+
+func (fs *PathFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.read(
+		ctx,
+		op.Inode,
+		"",
+		func(p string) (err error) {
+			op.Attributes, err = fs.backend.GetAttributes(ctx, p)
+			return err
+		},
+		nil)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *PathFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.lookups.Forget(ctx, op.Inode, op.N) == 0 {
+		fs.dropLocked(op.Inode)
+	}
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *PathFS) DestroyMount(mount fuse.MountInfo) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, id := range fs.lookups.ForgetMount(mount) {
+		fs.dropLocked(id)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Namespace
+////////////////////////////////////////////////////////////////////////
+
+// Create the named child of parent by calling create with its path.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *PathFS) create(
+	ctx context.Context,
+	parent fuseops.InodeID,
+	name string,
+	entry *fuseops.ChildInodeEntry,
+	create func(p string) (fuseops.InodeAttributes, error)) error {
+	fs.namespaceMu.RLock()
+	defer fs.namespaceMu.RUnlock()
+
+	fs.mu.Lock()
+	p, err := fs.pathLocked(parent, name)
+	fs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	attrs, err := create(p)
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	entry.Child = fs.lookUpLocked(ctx, parent, name)
+	entry.Attributes = attrs
+
+	return nil
+}
+
+func (fs *PathFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return fs.create(ctx, op.Parent, op.Name, &op.Entry, func(p string) (fuseops.InodeAttributes, error) {
+		return fs.backend.MkDir(ctx, p, op.Mode)
+	})
+}
+
+func (fs *PathFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return fs.create(ctx, op.Parent, op.Name, &op.Entry, func(p string) (fuseops.InodeAttributes, error) {
+		return fs.backend.CreateFile(ctx, p, op.Mode)
+	})
+}
+
+// Remove the named child of parent by calling remove with its path.
+//
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *PathFS) remove(
+	parent fuseops.InodeID,
+	name string,
+	remove func(p string) error) error {
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	fs.mu.Lock()
+	p, err := fs.pathLocked(parent, name)
+	fs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if err := remove(p); err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.seq++
+	fs.removedLocked(parent, name)
+	fs.dropLocked(parent)
+
+	return nil
+}
+
+func (fs *PathFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.remove(op.Parent, op.Name, func(p string) error {
+		return fs.backend.Unlink(ctx, p)
+	})
+}
+
+func (fs *PathFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.remove(op.Parent, op.Name, func(p string) error {
+		return fs.backend.RmDir(ctx, p)
+	})
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *PathFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	// PathBackend.Rename has no way to honour renameat2(2) flags.
+	if op.Flags != 0 {
+		return syscall.EINVAL
+	}
+
+	fs.namespaceMu.Lock()
+	defer fs.namespaceMu.Unlock()
+
+	fs.mu.Lock()
+	oldPath, err := fs.pathLocked(op.OldParent, op.OldName)
+	if err == nil {
+		var newPath string
+		newPath, err = fs.pathLocked(op.NewParent, op.NewName)
+		fs.mu.Unlock()
+
+		if err == nil {
+			err = fs.backend.Rename(ctx, oldPath, newPath)
+		}
+	} else {
+		fs.mu.Unlock()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.seq++
+
+	oldParent := fs.inodes[op.OldParent]
+	oldParent.changed = fs.seq
+
+	id, ok := oldParent.children[op.OldName]
+	if ok {
+		delete(oldParent.children, op.OldName)
+	}
+
+	// Whatever was at the new path has been replaced.
+	fs.removedLocked(op.NewParent, op.NewName)
+
+	if ok {
+		in := fs.inodes[id]
+		in.parent = op.NewParent
+		in.name = op.NewName
+		in.moved = fs.seq
+
+		fs.inodes[op.NewParent].children[op.NewName] = id
+	}
+
+	fs.dropLocked(op.OldParent)
+	fs.dropLocked(op.NewParent)
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directories
+////////////////////////////////////////////////////////////////////////
+
+// OpenDir attaches a DirCursor to the handle, listing the directory at its
+// current path. The Inode field of each entry is set to the child's inode ID
+// if the kernel knows of the child, and otherwise left as the backend set it.
+// Since some programs skip entries whose inode number is zero, a backend with
+// no numbering of its own should instead use something like a hash of the
+// name.
+func (fs *PathFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	inode := op.Inode
+	op.HandleData = NewDirCursor(func(ctx context.Context) ([]Dirent, error) {
+		var entries []Dirent
+		err := fs.read(
+			ctx,
+			inode,
+			"",
+			func(p string) (err error) {
+				entries, err = fs.backend.ReadDir(ctx, p)
+				return err
+			},
+			func() {
+				children := fs.inodes[inode].children
+				for i := range entries {
+					if id, ok := children[entries[i].Name]; ok {
+						entries[i].Inode = id
+					}
+				}
+			})
+
+		return entries, err
+	})
+
+	return nil
+}
+
+func (fs *PathFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return op.HandleData.(*DirCursor).ReadDir(ctx, op)
+}
+
+func (fs *PathFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Files
+////////////////////////////////////////////////////////////////////////
+
+// OpenFile checks that the inode still has a path. Reads and writes on the
+// handle use the inode's path at the time.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *PathFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, err := fs.pathLocked(op.Inode, "")
+	return err
+}
+
+func (fs *PathFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	return fs.read(
+		ctx,
+		op.Inode,
+		"",
+		func(p string) (err error) {
+			op.BytesRead, err = fs.backend.ReadFile(ctx, p, op.Offset, op.Dst)
+			if err == io.EOF {
+				err = nil
+			}
+
+			return err
+		},
+		nil)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+// LOCKS_EXCLUDED(fs.namespaceMu)
+func (fs *PathFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.namespaceMu.RLock()
+	defer fs.namespaceMu.RUnlock()
+
+	fs.mu.Lock()
+	p, err := fs.pathLocked(op.Inode, "")
+	fs.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return fs.backend.WriteFile(ctx, p, op.Offset, op.Data)
+}
+
+func (fs *PathFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
@@ -0,0 +1,614 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file or directory in a memBackend. Its tag identifies it across renames,
+// and is reported as its modification time.
+type memEntry struct {
+	dir  bool
+	tag  int64
+	data []byte
+}
+
+// A PathBackend keeping everything in memory.
+type memBackend struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	entries map[string]*memEntry
+	nextTag int64
+
+	// If set, Rename leaves a copy of what it moved at the old path, with new
+	// tags, as if another client had recreated it at once.
+	//
+	// GUARDED_BY(mu)
+	recreate bool
+}
+
+func newMemBackend() *memBackend {
+	b := &memBackend{
+		entries: make(map[string]*memEntry),
+	}
+
+	b.entries["."] = &memEntry{dir: true}
+	return b
+}
+
+// LOCKS_REQUIRED(b.mu)
+func (b *memBackend) addLocked(p string, dir bool) (fuseops.InodeAttributes, error) {
+	if _, ok := b.entries[p]; ok {
+		return fuseops.InodeAttributes{}, syscall.EEXIST
+	}
+
+	if parent, ok := b.entries[path.Dir(p)]; !ok || !parent.dir {
+		return fuseops.InodeAttributes{}, syscall.ENOENT
+	}
+
+	b.nextTag++
+	e := &memEntry{dir: dir, tag: b.nextTag}
+	b.entries[p] = e
+
+	return e.attributes(), nil
+}
+
+func (e *memEntry) attributes() fuseops.InodeAttributes {
+	attrs := fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0644,
+		Size:  uint64(len(e.data)),
+		Mtime: time.Unix(0, e.tag),
+	}
+
+	if e.dir {
+		attrs.Mode = 0755 | os.ModeDir
+	}
+
+	return attrs
+}
+
+// Return whether p is q or lies within it.
+func within(p string, q string) bool {
+	return p == q || strings.HasPrefix(p, q+"/")
+}
+
+func (b *memBackend) GetAttributes(
+	ctx context.Context,
+	p string) (fuseops.InodeAttributes, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[p]
+	if !ok {
+		return fuseops.InodeAttributes{}, syscall.ENOENT
+	}
+
+	return e.attributes(), nil
+}
+
+func (b *memBackend) ReadDir(
+	ctx context.Context,
+	p string) ([]fuseutil.Dirent, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []fuseutil.Dirent
+	for q, e := range b.entries {
+		if q == "." || path.Dir(q) != p {
+			continue
+		}
+
+		d := fuseutil.Dirent{Name: path.Base(q), Type: fuseutil.DT_File}
+		if e.dir {
+			d.Type = fuseutil.DT_Directory
+		}
+
+		entries = append(entries, d)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (b *memBackend) ReadFile(
+	ctx context.Context,
+	p string,
+	off int64,
+	dst []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[p]
+	if !ok {
+		return 0, syscall.ENOENT
+	}
+
+	if off >= int64(len(e.data)) {
+		return 0, nil
+	}
+
+	return copy(dst, e.data[off:]), nil
+}
+
+func (b *memBackend) WriteFile(
+	ctx context.Context,
+	p string,
+	off int64,
+	data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[p]
+	if !ok {
+		return syscall.ENOENT
+	}
+
+	if end := off + int64(len(data)); end > int64(len(e.data)) {
+		e.data = append(e.data, make([]byte, end-int64(len(e.data)))...)
+	}
+
+	copy(e.data[off:], data)
+	return nil
+}
+
+func (b *memBackend) CreateFile(
+	ctx context.Context,
+	p string,
+	mode os.FileMode) (fuseops.InodeAttributes, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.addLocked(p, false)
+}
+
+func (b *memBackend) MkDir(
+	ctx context.Context,
+	p string,
+	mode os.FileMode) (fuseops.InodeAttributes, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.addLocked(p, true)
+}
+
+func (b *memBackend) Unlink(ctx context.Context, p string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e, ok := b.entries[p]; !ok || e.dir {
+		return syscall.ENOENT
+	}
+
+	delete(b.entries, p)
+	return nil
+}
+
+func (b *memBackend) RmDir(ctx context.Context, p string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if e, ok := b.entries[p]; !ok || !e.dir {
+		return syscall.ENOENT
+	}
+
+	for q := range b.entries {
+		if q != p && within(q, p) {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	delete(b.entries, p)
+	return nil
+}
+
+func (b *memBackend) Rename(
+	ctx context.Context,
+	oldPath string,
+	newPath string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.entries[oldPath]; !ok {
+		return syscall.ENOENT
+	}
+
+	if within(newPath, oldPath) {
+		return syscall.EINVAL
+	}
+
+	for q := range b.entries {
+		if within(q, newPath) {
+			delete(b.entries, q)
+		}
+	}
+
+	var moved []string
+	for q := range b.entries {
+		if within(q, oldPath) {
+			moved = append(moved, q)
+		}
+	}
+
+	// Recreate parents before their children.
+	sort.Strings(moved)
+	for _, q := range moved {
+		e := b.entries[q]
+		delete(b.entries, q)
+		b.entries[newPath+strings.TrimPrefix(q, oldPath)] = e
+
+		if b.recreate {
+			b.nextTag++
+			b.entries[q] = &memEntry{dir: e.dir, tag: b.nextTag}
+		}
+	}
+
+	return nil
+}
+
+// The names along the path walked by the tests below.
+var walkNames = []string{"a", "b", "c", "d", "file"}
+
+// Create a backend holding a/b/c/d/file, returning the largest tag used.
+func newWalkBackend(t *testing.T) (*memBackend, int64) {
+	b := newMemBackend()
+
+	var p string
+	for i, name := range walkNames {
+		p = path.Join(p, name)
+		if _, err := b.addLocked(p, i < len(walkNames)-1); err != nil {
+			t.Fatalf("add(%q): %v", p, err)
+		}
+	}
+
+	return b, b.nextTag
+}
+
+// Walk the path a/b/c/d/file from the root, returning the inodes and tags of
+// the entries found.
+func walk(
+	fs fuseutil.FileSystem) (inodes []fuseops.InodeID, tags []int64, err error) {
+	parent := fuseops.InodeID(fuseops.RootInodeID)
+	for _, name := range walkNames {
+		op := &fuseops.LookUpInodeOp{Parent: parent, Name: name}
+		if err := fs.LookUpInode(context.Background(), op); err != nil {
+			return nil, nil, fmt.Errorf("LookUpInode(%q): %v", name, err)
+		}
+
+		parent = op.Entry.Child
+		inodes = append(inodes, op.Entry.Child)
+		tags = append(tags, op.Entry.Attributes.Mtime.UnixNano())
+	}
+
+	return inodes, tags, nil
+}
+
+// Rename a to z while walking the path a/b/c/d/file, with the Rename
+// recreating a/b/c/d/file as it goes, and check that the walk found either
+// the original entries or the recreated ones, but not some of each, and that
+// no inodes are left over once they have been forgotten.
+//
+// The order of events is decided by s.
+func testRenameDuringWalk(
+	t *testing.T,
+	s *fusetesting.Scheduler) (recreated bool) {
+	b, lastOriginal := newWalkBackend(t)
+	b.recreate = true
+
+	pfs := fuseutil.NewPathFS(b)
+	fs := s.Wrap(pfs)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		op := &fuseops.RenameOp{
+			OldParent: fuseops.RootInodeID,
+			OldName:   "a",
+			NewParent: fuseops.RootInodeID,
+			NewName:   "z",
+		}
+
+		if err := fs.Rename(context.Background(), op); err != nil {
+			t.Errorf("Rename: %v", err)
+		}
+	}()
+
+	inodes, tags, err := walk(fs)
+	wg.Wait()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recreated = tags[0] > lastOriginal
+	for i, tag := range tags {
+		if (tag > lastOriginal) != recreated {
+			t.Errorf("Mixture of entries: tags %v, originals up to %d", tags, lastOriginal)
+			break
+		}
+
+		if i > 0 && tags[i-1] >= tag {
+			t.Errorf("Entries out of order: tags %v", tags)
+			break
+		}
+	}
+
+	// The file's path is still good.
+	getAttrs := &fuseops.GetInodeAttributesOp{Inode: inodes[len(inodes)-1]}
+	if err := fs.GetInodeAttributes(context.Background(), getAttrs); err != nil {
+		t.Errorf("GetInodeAttributes: %v", err)
+	} else if tag := getAttrs.Attributes.Mtime.UnixNano(); tag != tags[len(tags)-1] {
+		t.Errorf("GetInodeAttributes found tag %d, want %d", tag, tags[len(tags)-1])
+	}
+
+	if n := pfs.InodeCount(); n != len(walkNames) {
+		t.Errorf("%d inodes after the walk, want %d", n, len(walkNames))
+	}
+
+	for _, inode := range inodes {
+		op := &fuseops.ForgetInodeOp{Inode: inode, N: 1}
+		if err := fs.ForgetInode(context.Background(), op); err != nil {
+			t.Fatalf("ForgetInode: %v", err)
+		}
+	}
+
+	if n := pfs.InodeCount(); n != 0 {
+		t.Errorf("%d inodes left over", n)
+	}
+
+	return recreated
+}
+
+// Rename a directory while a walk through it is held at each step in turn.
+func TestPathFS_RenameDuringWalk(t *testing.T) {
+	isRename := fusetesting.OpsOfType(&fuseops.RenameOp{})
+
+	for i, name := range walkNames {
+		for _, point := range []string{fuseutil.PointPathResolved, fuseutil.PointPathCalled} {
+			t.Run(fmt.Sprintf("%s at %s", name, point), func(t *testing.T) {
+				isHeld := func(op interface{}) bool {
+					l, ok := op.(*fuseops.LookUpInodeOp)
+					return ok && l.Name == name
+				}
+
+				// Let the rename in once the lookup has reached the point, and hold
+				// the lookup there until the rename is done.
+				s := fusetesting.NewScheduler(0)
+				s.Hold(isRename, fusetesting.PointStart, isHeld, point)
+				s.Hold(isHeld, point, isRename, fusetesting.PointDone)
+
+				recreated := testRenameDuringWalk(t, s)
+
+				// Only a lookup in the root can see the recreated entries. The rest
+				// follow the directory they started in.
+				if want := i == 0; recreated != want {
+					t.Errorf("Recreated entries found: %v, want %v", recreated, want)
+				}
+			})
+		}
+	}
+}
+
+// Rename a directory while walking through it, in whichever order the
+// scheduler picks.
+func TestPathFS_RenameDuringWalk_Random(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		t.Run(fmt.Sprintf("seed %d", seed), func(t *testing.T) {
+			s := fusetesting.NewScheduler(seed)
+			s.Expect(2)
+			testRenameDuringWalk(t, s)
+		})
+	}
+}
+
+// A lookup that has found an entry the backend is then told to remove must
+// not record it.
+func TestPathFS_LookupDoesNotResurrect(t *testing.T) {
+	removals := map[string]func(fuseutil.FileSystem) error{
+		"unlink": func(fs fuseutil.FileSystem) error {
+			return fs.Unlink(context.Background(), &fuseops.UnlinkOp{
+				Parent: fuseops.RootInodeID,
+				Name:   "x",
+			})
+		},
+
+		"rename": func(fs fuseutil.FileSystem) error {
+			return fs.Rename(context.Background(), &fuseops.RenameOp{
+				OldParent: fuseops.RootInodeID,
+				OldName:   "x",
+				NewParent: fuseops.RootInodeID,
+				NewName:   "y",
+			})
+		},
+	}
+
+	for desc, remove := range removals {
+		t.Run(desc, func(t *testing.T) {
+			b := newMemBackend()
+			if _, err := b.addLocked("x", false); err != nil {
+				t.Fatalf("add: %v", err)
+			}
+
+			pfs := fuseutil.NewPathFS(b)
+			s := fusetesting.NewScheduler(0)
+			fs := s.Wrap(pfs)
+
+			// Remove x between the backend finding it and the lookup finishing.
+			isLookUp := fusetesting.OpsOfType(&fuseops.LookUpInodeOp{})
+			isRemoval := func(op interface{}) bool { return !isLookUp(op) }
+			s.Hold(isRemoval, fusetesting.PointStart, isLookUp, fuseutil.PointPathCalled)
+			s.Hold(isLookUp, fuseutil.PointPathCalled, isRemoval, fusetesting.PointDone)
+
+			removed := make(chan error, 1)
+			go func() { removed <- remove(fs) }()
+
+			op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "x"}
+			err := fs.LookUpInode(context.Background(), op)
+			if err := <-removed; err != nil {
+				t.Fatalf("Removal: %v", err)
+			}
+
+			if err != syscall.ENOENT {
+				t.Errorf("LookUpInode: got %v (inode %v), want ENOENT", err, op.Entry.Child)
+			}
+
+			if n := pfs.InodeCount(); n != 0 {
+				t.Errorf("%d inodes left over", n)
+			}
+		})
+	}
+}
+
+// Reads and writes on an open file follow it when it is renamed, and fail
+// once it has been unlinked.
+func TestPathFS_OpenFileFollowsRename(t *testing.T) {
+	ctx := context.Background()
+	pfs := fuseutil.NewPathFS(newMemBackend())
+	mkDir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir"}
+	if err := pfs.MkDir(ctx, mkDir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	create := &fuseops.CreateFileOp{Parent: fuseops.RootInodeID, Name: "foo"}
+	if err := pfs.CreateFile(ctx, create); err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+
+	file := create.Entry.Child
+	write := &fuseops.WriteFileOp{Inode: file, Data: []byte("taco")}
+	if err := pfs.WriteFile(ctx, write); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	rename := &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "foo",
+		NewParent: mkDir.Entry.Child,
+		NewName:   "bar",
+	}
+
+	if err := pfs.Rename(ctx, rename); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	read := &fuseops.ReadFileOp{Inode: file, Dst: make([]byte, 10)}
+	if err := pfs.ReadFile(ctx, read); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got := string(read.Dst[:read.BytesRead]); got != "taco" {
+		t.Errorf("ReadFile: got %q, want %q", got, "taco")
+	}
+
+	// The renamed file is listed by the inode ID the kernel knows it by.
+	openDir := &fuseops.OpenDirOp{Inode: mkDir.Entry.Child}
+	if err := pfs.OpenDir(ctx, openDir); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	readDir := &fuseops.ReadDirOp{
+		Inode:      mkDir.Entry.Child,
+		HandleData: openDir.HandleData,
+		Dst:        make([]byte, 4096),
+	}
+
+	if err := pfs.ReadDir(ctx, readDir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	want := make([]byte, 4096)
+	want = want[:fuseutil.WriteDirent(want, fuseutil.Dirent{
+		Offset: 1,
+		Inode:  file,
+		Name:   "bar",
+		Type:   fuseutil.DT_File,
+	})]
+
+	if got := readDir.Dst[:readDir.BytesRead]; !bytes.Equal(got, want) {
+		t.Errorf("ReadDir: got %v, want %v", got, want)
+	}
+
+	unlink := &fuseops.UnlinkOp{Parent: mkDir.Entry.Child, Name: "bar"}
+	if err := pfs.Unlink(ctx, unlink); err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	read.BytesRead = 0
+	if err := pfs.ReadFile(ctx, read); err != syscall.ESTALE {
+		t.Errorf("ReadFile after unlink: got %v, want ESTALE", err)
+	}
+
+	// The unlinked file is forgotten along with the kernel's last reference to
+	// it, and the directory likewise.
+	for _, inode := range []fuseops.InodeID{file, mkDir.Entry.Child} {
+		if err := pfs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: inode, N: 1}); err != nil {
+			t.Fatalf("ForgetInode: %v", err)
+		}
+	}
+
+	if n := pfs.InodeCount(); n != 0 {
+		t.Errorf("%d inodes left over", n)
+	}
+}
+
+// A directory that has been removed has no children, and none can be created
+// in it.
+func TestPathFS_RemovedDirectory(t *testing.T) {
+	ctx := context.Background()
+	pfs := fuseutil.NewPathFS(newMemBackend())
+
+	mkDir := &fuseops.MkDirOp{Parent: fuseops.RootInodeID, Name: "dir"}
+	if err := pfs.MkDir(ctx, mkDir); err != nil {
+		t.Fatalf("MkDir: %v", err)
+	}
+
+	dir := mkDir.Entry.Child
+	if err := pfs.RmDir(ctx, &fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: "dir"}); err != nil {
+		t.Fatalf("RmDir: %v", err)
+	}
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: dir, Name: "foo"}
+	if err := pfs.LookUpInode(ctx, lookUp); err != syscall.ENOENT {
+		t.Errorf("LookUpInode: got %v, want ENOENT", err)
+	}
+
+	create := &fuseops.CreateFileOp{Parent: dir, Name: "foo"}
+	if err := pfs.CreateFile(ctx, create); err != syscall.ENOENT {
+		t.Errorf("CreateFile: got %v, want ENOENT", err)
+	}
+
+	getAttrs := &fuseops.GetInodeAttributesOp{Inode: dir}
+	if err := pfs.GetInodeAttributes(ctx, getAttrs); err != syscall.ESTALE {
+		t.Errorf("GetInodeAttributes: got %v, want ESTALE", err)
+	}
+}
@@ -0,0 +1,1235 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The inode IDs that a PerUserFileSystem gives the kernel carry the index of
+// the uid's file system in the bits from userIndexShift up, and the file
+// system's own ID in the rest. The root is shared.
+const (
+	userIndexShift                 = 48
+	userLocalMask  fuseops.InodeID = 1<<userIndexShift - 1
+	maxUserIndex   fuseops.InodeID = 1<<(64-userIndexShift) - 1
+)
+
+// PerUserConfig configures a PerUserFileSystem.
+type PerUserConfig struct {
+	// Creates the file system seen by callers with the given uid. Required. If
+	// it fails, so does the op that needed the file system, and the next op
+	// from the uid tries again.
+	NewFileSystem func(uid uint32) (FileSystem, error)
+
+	// How long a uid's file system is kept once the kernel holds no
+	// references to it: no inodes looked up and not forgotten, no handles
+	// open, and no ops in progress. It is then destroyed, and created afresh
+	// if the uid comes back. If zero, it is destroyed straight away.
+	IdleTimeout time.Duration
+}
+
+// PerUserFileSystem shows each caller uid its own file system through one
+// mount point, e.g. a multi-tenant cache applying each user's credentials to
+// the backend. Mount it with MountConfig.AllowOther so that other users can
+// reach it at all. A uid's file system is created the first time one of its
+// ops arrives, by PerUserConfig.NewFileSystem, and destroyed once idle.
+//
+// The kernel has a single namespace of inode IDs for the mount, so the
+// wrapper partitions it: each uid's file system gets 2^48 IDs of its own,
+// and must keep its inode IDs below that. Only the root is shared. Ops on the
+// root go to the caller's file system, and ops on other inodes to the file
+// system that returned them. The kernel caches the root's attributes and the
+// names in it regardless of who looked them up, so the wrapper stops it
+// caching either, whatever the file systems ask for; the kernel then looks
+// up each name in the root again for every caller, and on finding a
+// different inode for a name than it had cached, drops the old one. Names
+// below the root are cached as usual, since they are reached only through
+// inodes that belong to one uid.
+//
+// The wrapper attaches its own values to handles, so it must be served by
+// NewFileSystemServer or something else that keeps HandleData. The file
+// systems' own handle IDs and HandleData are passed back to them. AccessOp.For
+// names the original op, with the kernel's inode IDs.
+//
+// Security caveats:
+//
+//   - The uid is the fsuid of the calling thread, as the kernel reports it
+//     (see fuse.CallerFromContext). A setuid program sees the view of the uid
+//     it runs as, not that of the user who ran it. Nothing is keyed on pids,
+//     which are reused, and may be recycled by another user's process between
+//     ops.
+//
+//   - Ops on handles go to the file system that opened them, whoever makes
+//     them, as for any file descriptor: a process that receives a descriptor
+//     from another user, e.g. over a unix socket, reads that user's file
+//     through it. Ops naming another uid's inodes without a handle (e.g. via
+//     /proc/<pid>/cwd or openat(2) on a received directory) fail with EACCES.
+//
+//   - Root (uid 0) is exempt from that check, both because root can read
+//     other users' descriptors anyway and because the kernel makes some
+//     requests on its own behalf with root's credentials, e.g. when writing
+//     back dirty pages. Forgets and releases carry no credentials, and are
+//     routed by ID.
+//
+//   - This isolates views, not permissions: the kernel still checks access
+//     against the attributes each file system reports, and only with the
+//     default_permissions option at all.
+type PerUserFileSystem struct {
+	cfg PerUserConfig
+
+	mu sync.Mutex
+
+	// The live file systems, by uid and by index.
+	//
+	// INVARIANT: For each k, v in byUID, byIndex[v.index] == v
+	// INVARIANT: For each k, v in byIndex, byUID[v.uid] == v
+	//
+	// GUARDED_BY(mu)
+	byUID   map[uint32]*userFS
+	byIndex map[fuseops.InodeID]*userFS
+
+	// The largest index assigned, and indices free for reuse.
+	//
+	// GUARDED_BY(mu)
+	lastIndex   fuseops.InodeID
+	freeIndices []fuseops.InodeID
+}
+
+var _ FileSystem = &PerUserFileSystem{}
+
+// The file system for one uid.
+type userFS struct {
+	uid   uint32
+	index fuseops.InodeID
+
+	// Closed once fs or err has been set, by NewFileSystem.
+	ready chan struct{}
+	fs    FileSystem
+	err   error
+
+	// The kernel's lookups of the file system's inodes, plus its open handles
+	// and ops in progress.
+	//
+	// GUARDED_BY(PerUserFileSystem.mu)
+	refs uint64
+
+	// Set once the file system has been removed from the maps.
+	//
+	// GUARDED_BY(PerUserFileSystem.mu)
+	gone bool
+
+	// Running while the file system is idle, to destroy it.
+	//
+	// GUARDED_BY(PerUserFileSystem.mu)
+	idle *time.Timer
+}
+
+// The value PerUserFileSystem attaches to handles.
+type userHandle struct {
+	u      *userFS
+	handle fuseops.HandleID
+	data   interface{}
+}
+
+// NewPerUserFileSystem creates a file system that shows each caller uid the
+// file system that cfg.NewFileSystem creates for it.
+func NewPerUserFileSystem(cfg PerUserConfig) *PerUserFileSystem {
+	return &PerUserFileSystem{
+		cfg:     cfg,
+		byUID:   make(map[uint32]*userFS),
+		byIndex: make(map[fuseops.InodeID]*userFS),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Add n references to u, keeping it from being destroyed.
+//
+// LOCKS_REQUIRED(p.mu)
+func (p *PerUserFileSystem) hold(
+	u *userFS,
+	n uint64) {
+	u.refs += n
+	if u.idle != nil {
+		u.idle.Stop()
+		u.idle = nil
+	}
+}
+
+// Drop n references to u, destroying it once idle if none remain.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *PerUserFileSystem) release(
+	u *userFS,
+	n uint64) {
+	p.mu.Lock()
+	if n > u.refs {
+		n = u.refs
+	}
+
+	u.refs -= n
+	if u.refs > 0 || u.gone {
+		p.mu.Unlock()
+		return
+	}
+
+	if p.cfg.IdleTimeout > 0 {
+		u.idle = time.AfterFunc(p.cfg.IdleTimeout, func() { p.evictIfIdle(u) })
+		p.mu.Unlock()
+		return
+	}
+
+	p.remove(u)
+	p.mu.Unlock()
+
+	u.fs.Destroy()
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *PerUserFileSystem) evictIfIdle(u *userFS) {
+	p.mu.Lock()
+	if u.refs > 0 || u.gone {
+		p.mu.Unlock()
+		return
+	}
+
+	p.remove(u)
+	p.mu.Unlock()
+
+	u.fs.Destroy()
+}
+
+// Forget u, making its index available for reuse. The kernel holds no
+// references to its inodes, so their IDs can't be confused with those of the
+// next file system to get the index.
+//
+// LOCKS_REQUIRED(p.mu)
+func (p *PerUserFileSystem) remove(u *userFS) {
+	u.gone = true
+	delete(p.byUID, u.uid)
+	delete(p.byIndex, u.index)
+	p.freeIndices = append(p.freeIndices, u.index)
+}
+
+// Return the file system for the given uid, creating it if necessary, with a
+// reference held for the caller.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *PerUserFileSystem) forUID(uid uint32) (*userFS, error) {
+	p.mu.Lock()
+	u := p.byUID[uid]
+	create := u == nil
+	if create {
+		var index fuseops.InodeID
+		switch n := len(p.freeIndices); {
+		case n > 0:
+			index = p.freeIndices[n-1]
+			p.freeIndices = p.freeIndices[:n-1]
+
+		case p.lastIndex < maxUserIndex:
+			p.lastIndex++
+			index = p.lastIndex
+
+		default:
+			p.mu.Unlock()
+			return nil, fmt.Errorf("More than %d users", maxUserIndex)
+		}
+
+		u = &userFS{uid: uid, index: index, ready: make(chan struct{})}
+		p.byUID[uid] = u
+		p.byIndex[index] = u
+	}
+
+	p.hold(u, 1)
+	p.mu.Unlock()
+
+	if create {
+		u.fs, u.err = p.cfg.NewFileSystem(uid)
+		if u.err != nil {
+			p.mu.Lock()
+			p.remove(u)
+			p.mu.Unlock()
+		}
+
+		close(u.ready)
+	}
+
+	<-u.ready
+	if u.err != nil {
+		return nil, u.err
+	}
+
+	return u, nil
+}
+
+// Return the file system owning the inode with the given ID, and its own ID
+// for it, with a reference held for the caller. The root belongs to the
+// caller's file system.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *PerUserFileSystem) forInode(
+	ctx context.Context,
+	inode fuseops.InodeID) (*userFS, fuseops.InodeID, error) {
+	caller, _ := fuse.CallerFromContext(ctx)
+	if inode == fuseops.RootInodeID {
+		u, err := p.forUID(caller.Uid)
+		return u, inode, err
+	}
+
+	p.mu.Lock()
+	u := p.byIndex[inode>>userIndexShift]
+	switch {
+	case u == nil:
+		p.mu.Unlock()
+		return nil, 0, syscall.ESTALE
+
+	case caller.Uid != 0 && caller.Uid != u.uid:
+		p.mu.Unlock()
+		return nil, 0, syscall.EACCES
+	}
+
+	p.hold(u, 1)
+	p.mu.Unlock()
+
+	<-u.ready
+	if u.err != nil {
+		return nil, 0, syscall.ESTALE
+	}
+
+	return u, inode & userLocalMask, nil
+}
+
+// Return the file system's own ID for the inode with the given ID.
+func localID(inode fuseops.InodeID) fuseops.InodeID {
+	if inode == fuseops.RootInodeID {
+		return inode
+	}
+
+	return inode & userLocalMask
+}
+
+// Return the kernel's ID for u's inode with the given ID.
+func (u *userFS) kernelID(local fuseops.InodeID) (fuseops.InodeID, error) {
+	switch {
+	case local == 0 || local == fuseops.RootInodeID:
+		return local, nil
+
+	case local > userLocalMask:
+		return 0, fmt.Errorf("Inode ID %#x is too large to share the namespace", local)
+	}
+
+	return u.index<<userIndexShift | local, nil
+}
+
+// Translate the entry u returned in parent for the kernel, counting the
+// lookup it implies.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *PerUserFileSystem) entry(
+	u *userFS,
+	parent fuseops.InodeID,
+	e *fuseops.ChildInodeEntry) error {
+	child, err := u.kernelID(e.Child)
+	if err != nil {
+		return err
+	}
+
+	e.Child = child
+	if parent == fuseops.RootInodeID {
+		e.EntryExpiration = time.Time{}
+		e.EntryValidFor = 0
+	}
+
+	if child == fuseops.RootInodeID {
+		e.AttributesExpiration = time.Time{}
+		e.AttributesValidFor = 0
+	}
+
+	if child != 0 && child != fuseops.RootInodeID {
+		p.mu.Lock()
+		p.hold(u, 1)
+		p.mu.Unlock()
+	}
+
+	return nil
+}
+
+// Attach the value for a handle u opened to the op that opened it.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *PerUserFileSystem) opened(
+	u *userFS,
+	h *fuseops.HandleID,
+	data *interface{}) {
+	p.mu.Lock()
+	p.hold(u, 1)
+	p.mu.Unlock()
+
+	*data = &userHandle{u, *h, *data}
+	*h = 0
+}
+
+// Return the value attached to a handle by opened.
+func openedHandle(data interface{}) (*userHandle, error) {
+	h, ok := data.(*userHandle)
+	if !ok {
+		return nil, syscall.EBADF
+	}
+
+	return h, nil
+}
+
+// Translate the listing u wrote to buf for the kernel, counting the lookups
+// implied by a listing in the format of WriteDirentPlus. The root's entries
+// aren't to be cached.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *PerUserFileSystem) listed(
+	u *userFS,
+	dir fuseops.InodeID,
+	buf []byte,
+	plus bool) {
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+
+	var lookups uint64
+	for len(buf) > 0 {
+		var out *fusekernel.EntryOut
+		dirent := buf
+		if plus {
+			if len(buf) < entrySize {
+				break
+			}
+
+			out = (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+			dirent = buf[entrySize:]
+		}
+
+		d, n := ReadDirent(dirent)
+		if n == 0 {
+			break
+		}
+
+		if id, err := u.kernelID(d.Inode); err == nil {
+			*(*uint64)(unsafe.Pointer(&dirent[0])) = uint64(id)
+		}
+
+		if out != nil && out.Nodeid != 0 {
+			// An ID the kernel can't be given is left out.
+			id, _ := u.kernelID(fuseops.InodeID(out.Nodeid))
+			out.Nodeid = uint64(id)
+			out.Attr.Ino = uint64(id)
+
+			if dir == fuseops.RootInodeID {
+				out.EntryValid, out.EntryValidNsec = 0, 0
+			}
+
+			if id == fuseops.RootInodeID {
+				out.AttrValid, out.AttrValidNsec = 0, 0
+			}
+
+			// The kernel doesn't count the dot entries.
+			if id != 0 && id != fuseops.RootInodeID && d.Name != "." && d.Name != ".." {
+				lookups++
+			}
+		}
+
+		if plus {
+			n += entrySize
+		}
+
+		buf = buf[n:]
+	}
+
+	if lookups > 0 {
+		p.mu.Lock()
+		p.hold(u, lookups)
+		p.mu.Unlock()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (p *PerUserFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	caller, _ := fuse.CallerFromContext(ctx)
+	u, err := p.forUID(caller.Uid)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+	return u.fs.StatFS(ctx, op)
+}
+
+func (p *PerUserFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	u, parent, err := p.forInode(ctx, op.Parent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelParent := op.Parent
+	op.Parent = parent
+	err = u.fs.LookUpInode(ctx, op)
+	op.Parent = kernelParent
+
+	if err != nil {
+		return err
+	}
+
+	return p.entry(u, op.Parent, &op.Entry)
+}
+
+func (p *PerUserFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	u, inode, err := p.forInode(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelInode := op.Inode
+	op.Inode = inode
+	err = u.fs.GetInodeAttributes(ctx, op)
+	op.Inode = kernelInode
+
+	if op.Inode == fuseops.RootInodeID {
+		op.AttributesExpiration = time.Time{}
+		op.AttributesValidFor = 0
+	}
+
+	return err
+}
+
+func (p *PerUserFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	kernelInode, kernelHandle, kernelData := op.Inode, op.Handle, op.HandleData
+
+	var u *userFS
+	if op.Handle != nil {
+		h, err := openedHandle(op.HandleData)
+		if err != nil {
+			return err
+		}
+
+		u = h.u
+		op.Inode = localID(op.Inode)
+		op.Handle = &h.handle
+		op.HandleData = h.data
+	} else {
+		var err error
+		u, op.Inode, err = p.forInode(ctx, op.Inode)
+		if err != nil {
+			op.Inode = kernelInode
+			return err
+		}
+
+		defer p.release(u, 1)
+	}
+
+	err := u.fs.SetInodeAttributes(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, kernelData
+
+	if op.Inode == fuseops.RootInodeID {
+		op.AttributesExpiration = time.Time{}
+		op.AttributesValidFor = 0
+	}
+
+	return err
+}
+
+func (p *PerUserFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	// The root is never really forgotten, and belongs to no one file system.
+	if op.Inode == fuseops.RootInodeID {
+		return nil
+	}
+
+	p.mu.Lock()
+	u := p.byIndex[op.Inode>>userIndexShift]
+	p.mu.Unlock()
+
+	if u == nil {
+		return nil
+	}
+
+	<-u.ready
+	if u.err != nil {
+		return nil
+	}
+
+	kernelInode := op.Inode
+	op.Inode = localID(op.Inode)
+	err := u.fs.ForgetInode(ctx, op)
+	op.Inode = kernelInode
+
+	p.release(u, op.N)
+	return err
+}
+
+func (p *PerUserFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	u, parent, err := p.forInode(ctx, op.Parent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelParent := op.Parent
+	op.Parent = parent
+	err = u.fs.MkDir(ctx, op)
+	op.Parent = kernelParent
+
+	if err != nil {
+		return err
+	}
+
+	return p.entry(u, op.Parent, &op.Entry)
+}
+
+func (p *PerUserFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	u, parent, err := p.forInode(ctx, op.Parent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelParent := op.Parent
+	op.Parent = parent
+	err = u.fs.MkNode(ctx, op)
+	op.Parent = kernelParent
+
+	if err != nil {
+		return err
+	}
+
+	return p.entry(u, op.Parent, &op.Entry)
+}
+
+func (p *PerUserFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	u, parent, err := p.forInode(ctx, op.Parent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelParent := op.Parent
+	op.Parent = parent
+	err = u.fs.CreateFile(ctx, op)
+	op.Parent = kernelParent
+
+	if err != nil {
+		return err
+	}
+
+	if err := p.entry(u, op.Parent, &op.Entry); err != nil {
+		return err
+	}
+
+	p.opened(u, &op.Handle, &op.HandleData)
+	return nil
+}
+
+func (p *PerUserFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	u, parent, err := p.forInode(ctx, op.Parent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	// Links can't cross from one uid's file system to another's.
+	if op.Target == fuseops.RootInodeID || op.Target>>userIndexShift != u.index {
+		return syscall.EXDEV
+	}
+
+	kernelParent, kernelTarget := op.Parent, op.Target
+	op.Parent, op.Target = parent, localID(op.Target)
+	err = u.fs.CreateLink(ctx, op)
+	op.Parent, op.Target = kernelParent, kernelTarget
+
+	if err != nil {
+		return err
+	}
+
+	return p.entry(u, op.Parent, &op.Entry)
+}
+
+func (p *PerUserFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	u, parent, err := p.forInode(ctx, op.Parent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelParent := op.Parent
+	op.Parent = parent
+	err = u.fs.CreateSymlink(ctx, op)
+	op.Parent = kernelParent
+
+	if err != nil {
+		return err
+	}
+
+	return p.entry(u, op.Parent, &op.Entry)
+}
+
+func (p *PerUserFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	u, oldParent, err := p.forInode(ctx, op.OldParent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	newU, newParent, err := p.forInode(ctx, op.NewParent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(newU, 1)
+
+	if newU != u {
+		return syscall.EXDEV
+	}
+
+	kernelOld, kernelNew := op.OldParent, op.NewParent
+	op.OldParent, op.NewParent = oldParent, newParent
+	err = u.fs.Rename(ctx, op)
+	op.OldParent, op.NewParent = kernelOld, kernelNew
+
+	return err
+}
+
+func (p *PerUserFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	u, parent, err := p.forInode(ctx, op.Parent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelParent := op.Parent
+	op.Parent = parent
+	err = u.fs.RmDir(ctx, op)
+	op.Parent = kernelParent
+
+	return err
+}
+
+func (p *PerUserFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	u, parent, err := p.forInode(ctx, op.Parent)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelParent := op.Parent
+	op.Parent = parent
+	err = u.fs.Unlink(ctx, op)
+	op.Parent = kernelParent
+
+	return err
+}
+
+func (p *PerUserFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	u, inode, err := p.forInode(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelInode := op.Inode
+	op.Inode = inode
+	err = u.fs.OpenDir(ctx, op)
+	op.Inode = kernelInode
+
+	if err != nil {
+		return err
+	}
+
+	// The root's listing differs from one caller to the next.
+	if op.Inode == fuseops.RootInodeID {
+		op.CacheDir = false
+		op.KeepCache = false
+	}
+
+	p.opened(u, &op.Handle, &op.HandleData)
+	return nil
+}
+
+func (p *PerUserFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.ReadDir(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	if err != nil {
+		return err
+	}
+
+	p.listed(h.u, op.Inode, op.Dst[:op.BytesRead], op.Plus)
+	return nil
+}
+
+func (p *PerUserFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	// The kernel won't use the handle again, whatever the outcome.
+	defer p.release(h.u, 1)
+
+	kernelHandle := op.Handle
+	op.Handle, op.HandleData = h.handle, h.data
+	err = h.u.fs.ReleaseDirHandle(ctx, op)
+	op.Handle, op.HandleData = kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.SyncDir(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	u, inode, err := p.forInode(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelInode := op.Inode
+	op.Inode = inode
+	err = u.fs.OpenFile(ctx, op)
+	op.Inode = kernelInode
+
+	if err != nil {
+		return err
+	}
+
+	p.opened(u, &op.Handle, &op.HandleData)
+	return nil
+}
+
+func (p *PerUserFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.ReadFile(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.WriteFile(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.SyncFile(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.FlushFile(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	// The kernel won't use the handle again, whatever the outcome.
+	defer p.release(h.u, 1)
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.ReleaseFileHandle(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	u, inode, err := p.forInode(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelInode := op.Inode
+	op.Inode = inode
+	err = u.fs.ReadSymlink(ctx, op)
+	op.Inode = kernelInode
+
+	return err
+}
+
+func (p *PerUserFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	u, inode, err := p.forInode(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelInode := op.Inode
+	op.Inode = inode
+	err = u.fs.RemoveXattr(ctx, op)
+	op.Inode = kernelInode
+
+	return err
+}
+
+func (p *PerUserFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	u, inode, err := p.forInode(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelInode := op.Inode
+	op.Inode = inode
+	err = u.fs.GetXattr(ctx, op)
+	op.Inode = kernelInode
+
+	return err
+}
+
+func (p *PerUserFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	u, inode, err := p.forInode(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelInode := op.Inode
+	op.Inode = inode
+	err = u.fs.ListXattr(ctx, op)
+	op.Inode = kernelInode
+
+	return err
+}
+
+func (p *PerUserFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	u, inode, err := p.forInode(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelInode := op.Inode
+	op.Inode = inode
+	err = u.fs.SetXattr(ctx, op)
+	op.Inode = kernelInode
+
+	return err
+}
+
+func (p *PerUserFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.Fallocate(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.Lseek(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	src, err := openedHandle(op.SrcHandleData)
+	if err != nil {
+		return err
+	}
+
+	dst, err := openedHandle(op.DstHandleData)
+	if err != nil {
+		return err
+	}
+
+	// Copies can't cross from one uid's file system to another's; the kernel
+	// falls back to reading and writing.
+	if src.u != dst.u {
+		return syscall.EXDEV
+	}
+
+	kernelSrc, kernelSrcHandle := op.SrcInode, op.SrcHandle
+	kernelDst, kernelDstHandle := op.DstInode, op.DstHandle
+	op.SrcInode, op.SrcHandle, op.SrcHandleData = localID(op.SrcInode), src.handle, src.data
+	op.DstInode, op.DstHandle, op.DstHandleData = localID(op.DstInode), dst.handle, dst.data
+	err = src.u.fs.CopyFileRange(ctx, op)
+	op.SrcInode, op.SrcHandle, op.SrcHandleData = kernelSrc, kernelSrcHandle, src
+	op.DstInode, op.DstHandle, op.DstHandleData = kernelDst, kernelDstHandle, dst
+
+	return err
+}
+
+func (p *PerUserFileSystem) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.GetLock(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.SetLock(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.Poll(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	h, err := openedHandle(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	kernelInode, kernelHandle := op.Inode, op.Handle
+	op.Inode, op.Handle, op.HandleData = localID(op.Inode), h.handle, h.data
+	err = h.u.fs.Ioctl(ctx, op)
+	op.Inode, op.Handle, op.HandleData = kernelInode, kernelHandle, h
+
+	return err
+}
+
+func (p *PerUserFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	u, inode, err := p.forInode(ctx, op.Inode)
+	if err != nil {
+		return err
+	}
+
+	defer p.release(u, 1)
+
+	kernelInode := op.Inode
+	op.Inode = inode
+	err = u.fs.Access(ctx, op)
+	op.Inode = kernelInode
+
+	return err
+}
+
+// Destroy destroys every uid's file system.
+func (p *PerUserFileSystem) Destroy() {
+	p.mu.Lock()
+	var live []*userFS
+	for _, u := range p.byUID {
+		if u.idle != nil {
+			u.idle.Stop()
+			u.idle = nil
+		}
+
+		live = append(live, u)
+		p.remove(u)
+	}
+	p.mu.Unlock()
+
+	for _, u := range live {
+		<-u.ready
+		if u.err == nil {
+			u.fs.Destroy()
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system holding one file, named for the uid it was created for.
+type uidFS struct {
+	fuseutil.NotImplementedFileSystem
+	uid       uint32
+	destroyed func(uid uint32)
+}
+
+const uidFileInode = fuseops.RootInodeID + 1
+
+func (fs *uidFS) name() string     { return fmt.Sprintf("uid-%d", fs.uid) }
+func (fs *uidFS) contents() string { return fmt.Sprintf("hello %d\n", fs.uid) }
+
+func (fs *uidFS) attrs(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0755 | os.ModeDir}
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0444,
+		Size:  uint64(len(fs.contents())),
+		Uid:   fs.uid,
+	}
+}
+
+func (fs *uidFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != fs.name() {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = uidFileInode
+	op.Entry.Attributes = fs.attrs(uidFileInode)
+	return nil
+}
+
+func (fs *uidFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attrs(op.Inode)
+	return nil
+}
+
+func (fs *uidFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *uidFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *uidFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Offset > 0 {
+		return nil
+	}
+
+	op.BytesRead = fuseutil.WriteDirent(op.Dst, fuseutil.Dirent{
+		Offset: 1,
+		Inode:  uidFileInode,
+		Name:   fs.name(),
+		Type:   fuseutil.DT_File,
+	})
+
+	return nil
+}
+
+func (fs *uidFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *uidFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *uidFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if op.Offset < int64(len(fs.contents())) {
+		op.BytesRead = copy(op.Dst, fs.contents()[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *uidFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func (fs *uidFS) Destroy() {
+	fs.destroyed(fs.uid)
+}
+
+// Run a command as the given uid, returning its output.
+func runAs(
+	uid uint32,
+	name string,
+	args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uid, Gid: uid},
+	}
+
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+func TestPerUserFileSystem(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Running commands as other users requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "per_user_file_system_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// The other users must be able to reach the mount point.
+	if err := os.Chmod(dir, 0755); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	var mu sync.Mutex
+	created := make(map[uint32]int)
+	destroyed := make(map[uint32]int)
+
+	fs := fuseutil.NewPerUserFileSystem(fuseutil.PerUserConfig{
+		NewFileSystem: func(uid uint32) (fuseutil.FileSystem, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			created[uid]++
+			return &uidFS{
+				uid: uid,
+				destroyed: func(uid uint32) {
+					mu.Lock()
+					defer mu.Unlock()
+					destroyed[uid]++
+				},
+			}, nil
+		},
+	})
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:     "peruserfs",
+		AllowOther: true,
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	// Each user sees only their own file, through the same directory, and
+	// the two files are distinct inodes though both file systems call them
+	// by the same ID.
+	inodes := make(map[string]bool)
+	for _, uid := range []uint32{1000, 1001} {
+		mine := fmt.Sprintf("uid-%d", uid)
+
+		out, err := runAs(uid, "ls", dir)
+		if err != nil || out != mine+"\n" {
+			t.Errorf("ls as %d: got (%q, %v), want %q", uid, out, err, mine+"\n")
+		}
+
+		out, err = runAs(uid, "cat", path.Join(dir, mine))
+		if want := fmt.Sprintf("hello %d\n", uid); err != nil || out != want {
+			t.Errorf("cat as %d: got (%q, %v), want %q", uid, out, err, want)
+		}
+
+		out, err = runAs(uid, "stat", "-c", "%i", path.Join(dir, mine))
+		if err != nil {
+			t.Fatalf("stat as %d: %v, %s", uid, err, out)
+		}
+
+		inodes[strings.TrimSpace(out)] = true
+	}
+
+	if len(inodes) != 2 {
+		t.Errorf("Got inodes %v, want two", inodes)
+	}
+
+	// Neither can see the other's file.
+	if out, err := runAs(1001, "cat", path.Join(dir, "uid-1000")); err == nil {
+		t.Errorf("cat of the other user's file succeeded: %q", out)
+	}
+
+	// Once the kernel forgets their inodes, the file systems are destroyed.
+	// With no idle timeout, that may happen between one command and the
+	// next, and the next creates a new one.
+	if err := ioutil.WriteFile("/proc/sys/vm/drop_caches", []byte("2"), 0); err != nil {
+		t.Logf("Not checking eviction: %v", err)
+		return
+	}
+
+	// The kernel sends the forgets without waiting for them.
+	live := func() (uids []uint32) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for uid, n := range created {
+			if destroyed[uid] != n {
+				uids = append(uids, uid)
+			}
+		}
+
+		return uids
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for len(live()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if uids := live(); len(uids) > 0 {
+		t.Errorf("File systems for %v not destroyed", uids)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import "context"
+
+type pointHookKeyType struct{}
+
+var pointHookKey interface{} = pointHookKeyType{}
+
+// Point marks a named point in the handling of an op, at which a test
+// scheduler (see fusetesting.Scheduler) may pause it in order to force an
+// interleaving with other ops. It does nothing unless ctx was set up with
+// WithPointHook, so file systems may leave calls in place in production.
+func Point(ctx context.Context, name string) {
+	if hook, ok := ctx.Value(pointHookKey).(func(string)); ok {
+		hook(name)
+	}
+}
+
+// WithPointHook returns a child of ctx for which Point calls hook with the
+// name of the point.
+func WithPointHook(
+	ctx context.Context,
+	hook func(name string)) context.Context {
+	return context.WithValue(ctx, pointHookKey, hook)
+}
@@ -0,0 +1,475 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The version of the format written by ResumableServer.
+const serverStateVersion = 1
+
+// SavedInode describes an inode that the kernel referred to when a
+// ResumableServer saved its state.
+type SavedInode struct {
+	Inode fuseops.InodeID
+
+	// The generation of the entry with which the inode was last returned to
+	// the kernel.
+	Generation fuseops.GenerationNumber
+
+	// The inode's lookup count.
+	N uint64
+}
+
+// SavedHandle describes a handle that was open when a ResumableServer saved
+// its state, to which the file system had attached a value via HandleData.
+type SavedHandle struct {
+	// Whether the handle was opened by OpenDir, rather than by OpenFile or
+	// CreateFile.
+	Dir bool
+
+	// The inode that was opened, and the ID of the handle.
+	Inode  fuseops.InodeID
+	Handle fuseops.HandleID
+
+	// The attached value, as encoded by ResumeConfig.Codec.
+	HandleData []byte
+}
+
+// ServerState is the state of a connection saved by a ResumableServer.
+type ServerState struct {
+	// What the connection agreed with the kernel at init. Pass it as
+	// fuse.MountConfig.Resume when resuming.
+	Connection fuse.ConnectionState
+
+	// The inodes the kernel refers to, ordered by ID.
+	Inodes []SavedInode
+
+	// The handles with values attached, ordered by index.
+	Handles []SavedHandle
+
+	// Whether the handle IDs carry generations, as they do in strict mode. A
+	// resumed server reads them the same way, whatever the configuration of
+	// the new connection.
+	HandleGenerations bool
+}
+
+// The contents of a file written by ResumableServer.
+type savedServerState struct {
+	Version int
+	State   ServerState
+}
+
+// HandleDataCodec converts the values a file system attaches to handles (see
+// OpenFileOp.HandleData) to and from bytes, so that a ResumableServer can save
+// them.
+type HandleDataCodec interface {
+	EncodeHandleData(data interface{}) ([]byte, error)
+	DecodeHandleData(b []byte) (interface{}, error)
+}
+
+// A FileSystem served by a ResumableServer may implement this interface to
+// learn which inodes the kernel still refers to when the server resumes a
+// connection. RestoreInodes is called once, before any op read from the
+// connection is served, with the inodes in ResumeConfig.Resume. A file system
+// that tracks lookup counts itself should take these on; the server's own
+// counts (see ForgetAller) are restored regardless.
+type InodeRestorer interface {
+	RestoreInodes(mount fuse.MountInfo, inodes []SavedInode)
+}
+
+// ResumeConfig configures a ResumableServer.
+type ResumeConfig struct {
+	// The file to which the state is saved. Required.
+	Path string
+
+	// If positive, also save the state this often while serving, so that
+	// something can be recovered after a crash.
+	CheckpointInterval time.Duration
+
+	// Converts the values attached to handles. If nil, handles with values
+	// attached aren't saved, and can't be resumed.
+	Codec HandleDataCodec
+
+	// If non-nil, the state to resume from, as loaded by LoadServerState from
+	// a file written by the process that detached the connection.
+	Resume *ServerState
+
+	// If non-nil, where failures to save or restore state are logged.
+	ErrorLogger *log.Logger
+}
+
+// ResumableServer serves a FileSystem as the server made by
+// NewFileSystemServer does, and saves the tables that server keeps for a
+// connection to a file, so that another process can take over the connection
+// without the inode and handle IDs that the kernel has cached becoming
+// meaningless. See fuse.MountedFileSystem.Detach for the handover itself.
+//
+// The tables are the lookup count of each inode the kernel refers to, with
+// the generation it was last returned with, and the values the file system
+// attached to handles, encoded by ResumeConfig.Codec. The inodes and the
+// handles' values are the file system's own, and it must be able to make
+// sense of them in the new process, e.g. because it keeps inode IDs in a
+// persistent backend.
+//
+// When the connection is detached, ServeOps saves its state once the ops in
+// flight have been replied to, and returns without releasing handles or
+// forgetting inodes: DestroyMount, Destroy and the like are called by the
+// process that the connection ends in. The new process creates a
+// ResumableServer with ResumeConfig.Resume set to the saved state and serves
+// it with fuse.Serve. When the connection ends otherwise, the file is
+// removed.
+//
+// After a hard crash, a process holding a copy of the device (e.g. a
+// supervisor, or systemd's file descriptor store) may resume from the last
+// checkpoint. That recovers the handles that were open and the lookup counts
+// as they were at the time. It does not recover:
+//
+//   - Ops that the crashed process had read but not replied to. The kernel is
+//     waiting for replies that will never come, and the processes that made
+//     them hang until the connection is aborted.
+//
+//   - Handles opened since the checkpoint. Ops naming them are given no
+//     HandleData, and in strict mode are reported as naming released
+//     handles.
+//
+//   - Changes to lookup counts since the checkpoint, so that those restored
+//     may be too high, keeping inodes alive, or too low, in which case
+//     forgets for more lookups than recorded are ignored.
+//
+//   - Anything the file system itself hadn't persisted.
+//
+// Connection state (see fuse.ConnectionState) doesn't change after init, so
+// any checkpoint has it right.
+//
+// A ResumableServer must be served on at most one connection at a time.
+type ResumableServer struct {
+	server *fileSystemServer
+	cfg    ResumeConfig
+
+	// Held while writing the file.
+	saveMu sync.Mutex
+
+	mu sync.Mutex
+
+	// The connection being served, if any.
+	//
+	// GUARDED_BY(mu)
+	sc *servedConnection
+
+	// The state saved when the connection was detached, if it has been.
+	//
+	// GUARDED_BY(mu)
+	final *ServerState
+
+	// Closed to stop checkpointing the connection being served, if
+	// checkpointing.
+	//
+	// GUARDED_BY(mu)
+	stop chan struct{}
+}
+
+// NewResumableServer creates a server for the supplied file system that
+// saves and, if cfg.Resume is set, restores its state as configured.
+func NewResumableServer(
+	fs FileSystem,
+	cfg ResumeConfig) *ResumableServer {
+	return &ResumableServer{
+		server: &fileSystemServer{fs: fs},
+		cfg:    cfg,
+	}
+}
+
+// ServeOps implements fuse.Server.
+func (s *ResumableServer) ServeOps(c *fuse.Connection) {
+	s.server.serveOps(c, s)
+}
+
+// Capabilities implements fuse.CapabilityReporter, as for
+// NewFileSystemServer.
+func (s *ResumableServer) Capabilities() *fuse.Capabilities {
+	return s.server.Capabilities()
+}
+
+// NegotiateInit implements fuse.InitNegotiator, as for NewFileSystemServer.
+func (s *ResumableServer) NegotiateInit(n *fuse.InitNegotiation) error {
+	return s.server.NegotiateInit(n)
+}
+
+// Checkpoint saves the state of the connection being served or, once it has
+// been detached, the state with which it was detached. ServeOps calls it
+// itself when the connection is detached, and every
+// ResumeConfig.CheckpointInterval; calling it again after a failure retries.
+//
+// State is saved for each handle that can be, even if encoding another's
+// value fails; the error is then returned after saving.
+//
+// LOCKS_EXCLUDED(s.saveMu, s.mu)
+func (s *ResumableServer) Checkpoint() error {
+	// Hold saveMu throughout, so that an older state can't replace a newer
+	// one.
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	sc, st := s.sc, s.final
+	s.mu.Unlock()
+
+	var encodeErr error
+	switch {
+	case st != nil:
+	case sc != nil:
+		st, encodeErr = s.snapshot(sc)
+
+	default:
+		return errors.New("No connection has been served")
+	}
+
+	if err := s.save(st); err != nil {
+		return err
+	}
+
+	return encodeErr
+}
+
+// LoadServerState reads the state saved by a ResumableServer to the file with
+// the given path.
+func LoadServerState(path string) (*ServerState, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved savedServerState
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, fmt.Errorf("Unmarshal: %v", err)
+	}
+
+	if saved.Version != serverStateVersion {
+		return nil, fmt.Errorf("Unknown version %d", saved.Version)
+	}
+
+	return &saved.State, nil
+}
+
+// Return the current state of the supplied connection, encoding the values
+// attached to handles.
+func (s *ResumableServer) snapshot(sc *servedConnection) (*ServerState, error) {
+	st := &ServerState{
+		Connection:        sc.c.State(),
+		Inodes:            sc.live.snapshot(),
+		HandleGenerations: sc.handles.generations,
+	}
+
+	var firstErr error
+	for _, h := range sc.handles.snapshot() {
+		if s.cfg.Codec == nil {
+			break
+		}
+
+		b, err := s.cfg.Codec.EncodeHandleData(h.data)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("EncodeHandleData(%#x): %v", uint64(h.id), err)
+			}
+
+			continue
+		}
+
+		st.Handles = append(st.Handles, SavedHandle{
+			Dir:        h.owner.dir,
+			Inode:      h.owner.inode,
+			Handle:     h.id,
+			HandleData: b,
+		})
+	}
+
+	return st, firstErr
+}
+
+// Write the supplied state to the file, replacing what was there only once
+// it has all been written.
+//
+// LOCKS_REQUIRED(s.saveMu)
+func (s *ResumableServer) save(st *ServerState) error {
+	b, err := json.Marshal(savedServerState{serverStateVersion, *st})
+	if err != nil {
+		return fmt.Errorf("Marshal: %v", err)
+	}
+
+	tmp := s.cfg.Path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, s.cfg.Path)
+}
+
+func (s *ResumableServer) logf(
+	format string,
+	v ...interface{}) {
+	if s.cfg.ErrorLogger != nil {
+		s.cfg.ErrorLogger.Printf(format, v...)
+	}
+}
+
+// Start serving the supplied connection, restoring the state it is to resume
+// from, if any.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *ResumableServer) attach(sc *servedConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sc != nil {
+		panic("ResumableServer served on more than one connection at a time")
+	}
+
+	s.sc = sc
+	s.final = nil
+
+	// Resume only the first connection served.
+	if st := s.cfg.Resume; st != nil {
+		s.cfg.Resume = nil
+		s.restore(sc, st)
+	}
+
+	if s.cfg.CheckpointInterval > 0 {
+		s.stop = make(chan struct{})
+		go s.checkpointUntil(s.stop)
+	}
+}
+
+// Give the supplied connection the state it is to resume from.
+func (s *ResumableServer) restore(
+	sc *servedConnection,
+	st *ServerState) {
+	sc.handles.generations = st.HandleGenerations
+
+	var handles []tableHandle
+	for _, h := range st.Handles {
+		if s.cfg.Codec == nil {
+			s.logf("Resuming handle %#x: no codec", uint64(h.Handle))
+			continue
+		}
+
+		data, err := s.cfg.Codec.DecodeHandleData(h.HandleData)
+		if err != nil {
+			s.logf("Resuming handle %#x: DecodeHandleData: %v", uint64(h.Handle), err)
+			continue
+		}
+
+		handles = append(handles, tableHandle{
+			id:    h.Handle,
+			owner: handleOwner{inode: h.Inode, dir: h.Dir},
+			data:  data,
+		})
+
+		sc.open.opened(LeakedHandle{
+			Dir:        h.Dir,
+			Inode:      h.Inode,
+			Handle:     h.Handle,
+			HandleData: data,
+		})
+	}
+
+	sc.handles.restore(handles)
+	sc.live.restore(st.Inodes)
+
+	if r, ok := s.server.fs.(InodeRestorer); ok {
+		r.RestoreInodes(sc.c.MountInfo(), st.Inodes)
+	}
+}
+
+// Checkpoint periodically until stop is closed.
+func (s *ResumableServer) checkpointUntil(stop chan struct{}) {
+	ticker := time.NewTicker(s.cfg.CheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+
+		case <-ticker.C:
+			if err := s.Checkpoint(); err != nil {
+				s.logf("Checkpoint: %v", err)
+			}
+		}
+	}
+}
+
+// Finish serving the supplied connection, once no ops are in flight. If it
+// was detached, save its final state and return true. Otherwise remove the
+// file, which is now of no use.
+//
+// LOCKS_EXCLUDED(s.saveMu, s.mu)
+func (s *ResumableServer) detach(sc *servedConnection) bool {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	s.mu.Lock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+
+	s.sc = nil
+	if !sc.c.Detached() {
+		s.mu.Unlock()
+		os.Remove(s.cfg.Path)
+		return false
+	}
+
+	st, err := s.snapshot(sc)
+	s.final = st
+	s.mu.Unlock()
+
+	if err != nil {
+		s.logf("Saving state: %v", err)
+	}
+
+	if err := s.save(st); err != nil {
+		s.logf("Saving state: %v", err)
+	}
+
+	return true
+}
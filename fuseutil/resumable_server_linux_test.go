@@ -0,0 +1,274 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The contents of the file served by resumeFS, standing in for a persistent
+// backend that outlives the process serving it.
+const resumeContents = "taco burrito enchilada"
+
+// The value resumeFS attaches to each handle.
+type resumeHandle struct {
+	Inode  fuseops.InodeID
+	Serial int
+}
+
+// A file system with a single file, "foo", whose handles carry a resumeHandle
+// without which it can't read.
+type resumeFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu        sync.Mutex
+	opens     int                   // GUARDED_BY(mu)
+	released  []resumeHandle        // GUARDED_BY(mu)
+	restored  []fuseutil.SavedInode // GUARDED_BY(mu)
+	destroyed bool                  // GUARDED_BY(mu)
+}
+
+func (fs *resumeFS) attributes(inode fuseops.InodeID) fuseops.InodeAttributes {
+	if inode == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0755 | os.ModeDir}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0444, Size: uint64(len(resumeContents))}
+}
+
+func (fs *resumeFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = fileInode
+	op.Entry.Generation = 7
+	op.Entry.Attributes = fs.attributes(fileInode)
+	return nil
+}
+
+func (fs *resumeFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *resumeFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.opens++
+	op.HandleData = resumeHandle{op.Inode, fs.opens}
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fs *resumeFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	h, ok := op.HandleData.(resumeHandle)
+	if !ok || h.Inode != op.Inode {
+		return fuse.EIO
+	}
+
+	if op.Offset < int64(len(resumeContents)) {
+		op.BytesRead = copy(op.Dst, resumeContents[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *resumeFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	h, _ := op.HandleData.(resumeHandle)
+	fs.released = append(fs.released, h)
+	return nil
+}
+
+func (fs *resumeFS) RestoreInodes(
+	mount fuse.MountInfo,
+	inodes []fuseutil.SavedInode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.restored = inodes
+}
+
+func (fs *resumeFS) Destroy() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.destroyed = true
+}
+
+func (fs *resumeFS) EncodeHandleData(data interface{}) ([]byte, error) {
+	return json.Marshal(data)
+}
+
+func (fs *resumeFS) DecodeHandleData(b []byte) (interface{}, error) {
+	var h resumeHandle
+	err := json.Unmarshal(b, &h)
+	return h, err
+}
+
+// Read len(want) bytes at offset from f, which should give want.
+func checkRead(
+	t *testing.T,
+	f *os.File,
+	offset int64,
+	want string) {
+	buf := make([]byte, len(want))
+	if n, err := f.ReadAt(buf, offset); err != nil || string(buf[:n]) != want {
+		t.Errorf("ReadAt(%d): got (%q, %v), want %q", offset, buf[:n], err, want)
+	}
+}
+
+func TestResumableServer_Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resumable_server_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	mnt := path.Join(dir, "mnt")
+	statePath := path.Join(dir, "state")
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	// Serve the old process's file system, and open the file on it.
+	oldFS := &resumeFS{}
+	oldServer := fuseutil.NewResumableServer(oldFS, fuseutil.ResumeConfig{
+		Path:  statePath,
+		Codec: oldFS,
+	})
+
+	oldMFS, err := fuse.Mount(mnt, oldServer, &fuse.MountConfig{FSName: "resumefs"})
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	f, err := os.Open(path.Join(mnt, "foo"))
+	if err != nil {
+		fuse.Unmount(mnt)
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+	checkRead(t, f, 0, "taco")
+
+	// Hand the connection over. The old file system is left as it was.
+	ctx := context.Background()
+	dev, err := oldMFS.Detach(ctx)
+	if err != nil {
+		fuse.Unmount(mnt)
+		t.Fatalf("Detach: %v", err)
+	}
+
+	oldFS.mu.Lock()
+	if oldFS.destroyed || len(oldFS.released) != 0 {
+		t.Errorf("Detaching released %v, destroyed: %v", oldFS.released, oldFS.destroyed)
+	}
+	oldFS.mu.Unlock()
+
+	st, err := fuseutil.LoadServerState(statePath)
+	if err != nil {
+		dev.Close()
+		t.Fatalf("LoadServerState: %v", err)
+	}
+
+	wantInodes := []fuseutil.SavedInode{{Inode: fileInode, Generation: 7, N: 1}}
+	if !reflect.DeepEqual(st.Inodes, wantInodes) || len(st.Handles) != 1 {
+		t.Errorf("Saved %+v, want handle for inode %d and inodes %+v", st, fileInode, wantInodes)
+	}
+
+	// Carry on in a new file system, which has only the saved state to go on.
+	newFS := &resumeFS{}
+	newServer := fuseutil.NewResumableServer(newFS, fuseutil.ResumeConfig{
+		Path:   statePath,
+		Codec:  newFS,
+		Resume: st,
+	})
+
+	newMFS, err := fuse.Serve(dev, newServer, &fuse.MountConfig{Resume: &st.Connection})
+	if err != nil {
+		dev.Close()
+		t.Fatalf("Serve: %v", err)
+	}
+
+	// The file opened before the restart reads on through its handle, and the
+	// kernel's cached inode still means something.
+	checkRead(t, f, 5, "burrito")
+	if _, err := os.Stat(path.Join(mnt, "foo")); err != nil {
+		t.Errorf("Stat: %v", err)
+	}
+
+	newFS.mu.Lock()
+	if !reflect.DeepEqual(newFS.restored, wantInodes) {
+		t.Errorf("Restored %+v, want %+v", newFS.restored, wantInodes)
+	}
+	newFS.mu.Unlock()
+
+	// Its release reaches the new file system, with the value attached by the
+	// old one.
+	if err := f.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	if err := fuse.Unmount(mnt); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := newMFS.Join(ctx); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+
+	newFS.mu.Lock()
+	defer newFS.mu.Unlock()
+
+	if want := []resumeHandle{{fileInode, 1}}; !reflect.DeepEqual(newFS.released, want) {
+		t.Errorf("Released %v, want %v", newFS.released, want)
+	}
+
+	if !newFS.destroyed {
+		t.Errorf("The new file system wasn't destroyed")
+	}
+
+	// The state is of no use once unmounted.
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Errorf("Stat(%q): got %v, want not found", statePath, err)
+	}
+}
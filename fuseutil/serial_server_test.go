@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system recording how many of its lookups were ever in progress at
+// once. Each takes a while, so that concurrent lookups overlap.
+type overlapFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	current int // GUARDED_BY(mu)
+	max     int // GUARDED_BY(mu)
+}
+
+func (fs *overlapFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	fs.current++
+	if fs.current > fs.max {
+		fs.max = fs.current
+	}
+	fs.mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	fs.mu.Lock()
+	fs.current--
+	fs.mu.Unlock()
+
+	return fuse.ENOENT
+}
+
+// Look up the same missing name n times at once, returning the largest
+// number of lookups the file system saw in progress together.
+func maxOverlap(t *testing.T, server func(fuseutil.FileSystem) fuse.Server, n int) int {
+	fs := &overlapFS{}
+	k, err := fusetesting.NewFakeKernel(server(fs), &fuse.MountConfig{})
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := k.LookUp(fuseops.RootInodeID, "missing"); err != fuse.ENOENT {
+				t.Errorf("LookUp: got %v, want ENOENT", err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.max
+}
+
+func TestSerialFileSystemServer(t *testing.T) {
+	if got := maxOverlap(t, fuseutil.NewSerialFileSystemServer, 8); got != 1 {
+		t.Errorf("Serial server: %d lookups at once, want 1", got)
+	}
+
+	// Without serialization, the same lookups overlap.
+	if got := maxOverlap(t, fuseutil.NewFileSystemServer, 8); got < 2 {
+		t.Errorf("Concurrent server: %d lookups at once, want more than 1", got)
+	}
+}
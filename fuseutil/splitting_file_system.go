@@ -0,0 +1,205 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// SplitConfig configures NewSplittingFileSystem.
+type SplitConfig struct {
+	// The largest read and write to pass to the wrapped file system. Zero means
+	// no limit.
+	MaxReadSize  int
+	MaxWriteSize int
+
+	// The most calls to the wrapped file system to have in progress at once on
+	// behalf of a single read or write. Zero means one, so that the pieces are
+	// read or written in order, each once the last has finished.
+	Parallelism int
+}
+
+// NewSplittingFileSystem wraps the supplied file system so that reads and
+// writes larger than cfg allows, such as the large ones the kernel sends for
+// sequential I/O, are split into consecutive pieces small enough for a backend
+// with a smaller transfer limit. All other methods call straight
+// through. Each piece is passed to fs as a copy of the op with its Offset and
+// buffer adjusted.
+//
+// A read fails if any piece needed fails, since the kernel takes a short read
+// for the end of the file. A piece that is short without failing is taken to
+// be the end of the file, and the data read for pieces after it is discarded.
+//
+// A write that fails part way through is reported as a short write of the
+// pieces before the first that failed, including as much of that piece as fs
+// reports having written in its BytesWritten (see fuseops.WriteFileOp), or as
+// the error if that is nothing. With Parallelism above one, pieces after the
+// one that failed may have been written too; pieces not yet started when the
+// failure is seen are abandoned.
+func NewSplittingFileSystem(
+	fs FileSystem,
+	cfg SplitConfig) FileSystem {
+	if cfg.Parallelism <= 0 {
+		cfg.Parallelism = 1
+	}
+
+	return &splittingFileSystem{
+		FileSystem: fs,
+		cfg:        cfg,
+	}
+}
+
+type splittingFileSystem struct {
+	FileSystem
+	cfg SplitConfig
+}
+
+// The outcome of a call for one piece of an op.
+type pieceResult struct {
+	n   int
+	err error
+}
+
+// Call f for each of the consecutive pieces of at most size bytes that make up
+// [0, total), at most parallelism at a time, starting them in order. f
+// returns the number of bytes of its piece it completed. Pieces after one that
+// failed or was short are no longer started.
+//
+// Return the number of bytes completed before the first piece that failed or
+// was short, including what that piece completed, and the error it failed
+// with.
+func splitCall(
+	total int,
+	size int,
+	parallelism int,
+	f func(off int, n int) (int, error)) (int, error) {
+	if size <= 0 || total <= size {
+		return f(0, total)
+	}
+
+	pieces := (total + size - 1) / size
+	results := make([]pieceResult, pieces)
+
+	var mu sync.Mutex
+	stopAt := pieces // GUARDED_BY(mu)
+
+	slots := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+
+	for i := 0; i < pieces; i++ {
+		slots <- struct{}{}
+
+		mu.Lock()
+		stop := i > stopAt
+		mu.Unlock()
+
+		if stop {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			off := i * size
+			n := size
+			if off+n > total {
+				n = total - off
+			}
+
+			done, err := f(off, n)
+			results[i] = pieceResult{done, err}
+
+			if err != nil || done < n {
+				mu.Lock()
+				if i < stopAt {
+					stopAt = i
+				}
+				mu.Unlock()
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	var completed int
+	for i, r := range results {
+		completed += r.n
+		if r.err != nil || i == stopAt {
+			return completed, r.err
+		}
+	}
+
+	return completed, nil
+}
+
+func (fs *splittingFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	n, err := splitCall(
+		len(op.Dst),
+		fs.cfg.MaxReadSize,
+		fs.cfg.Parallelism,
+		func(off int, n int) (int, error) {
+			piece := *op
+			piece.Offset = op.Offset + int64(off)
+			piece.Dst = op.Dst[off : off+n]
+			piece.BytesRead = 0
+
+			err := fs.FileSystem.ReadFile(ctx, &piece)
+			return piece.BytesRead, err
+		})
+
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead = n
+	return nil
+}
+
+func (fs *splittingFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	n, err := splitCall(
+		len(op.Data),
+		fs.cfg.MaxWriteSize,
+		fs.cfg.Parallelism,
+		func(off int, n int) (int, error) {
+			piece := *op
+			piece.Offset = op.Offset + int64(off)
+			piece.Data = op.Data[off : off+n]
+			piece.BytesWritten = 0
+
+			if err := fs.FileSystem.WriteFile(ctx, &piece); err != nil {
+				written := piece.BytesWritten
+				if written < 0 || written > n {
+					written = 0
+				}
+
+				return written, err
+			}
+
+			return n, nil
+		})
+
+	op.BytesWritten = n
+	return err
+}
@@ -0,0 +1,306 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The transfer limit of limitedFS.
+const backendLimit = 4096
+
+// A file system with a single file, held in memory, that refuses reads and
+// writes larger than backendLimit and can be made to fail the one at a given
+// offset.
+type limitedFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	contents []byte
+
+	// The offset of the read or write to fail, or -1, and for writes how many
+	// bytes to write first.
+	//
+	// GUARDED_BY(mu)
+	failOffset int64
+	failAfter  int
+
+	// The number of calls received, and whether any was too large.
+	//
+	// GUARDED_BY(mu)
+	calls    int
+	tooLarge bool
+}
+
+func (fs *limitedFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *limitedFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.calls++
+	if len(op.Dst) > backendLimit {
+		fs.tooLarge = true
+		return fuse.EINVAL
+	}
+
+	if op.Offset == fs.failOffset {
+		return fuse.EIO
+	}
+
+	if op.Offset < int64(len(fs.contents)) {
+		op.BytesRead = copy(op.Dst, fs.contents[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *limitedFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.calls++
+	if len(op.Data) > backendLimit {
+		fs.tooLarge = true
+		return fuse.EINVAL
+	}
+
+	data := op.Data
+	if op.Offset == fs.failOffset {
+		data = data[:fs.failAfter]
+	}
+
+	if end := int(op.Offset) + len(data); end > len(fs.contents) {
+		fs.contents = append(fs.contents, make([]byte, end-len(fs.contents))...)
+	}
+
+	copy(fs.contents[op.Offset:], data)
+
+	if op.Offset == fs.failOffset {
+		op.BytesWritten = fs.failAfter
+		return fuse.EIO
+	}
+
+	return nil
+}
+
+// Return random data of the given size.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+func TestSplittingFileSystem_Write(t *testing.T) {
+	const pieces = 16
+	const size = pieces*backendLimit - 100
+	want := randomBytes(size)
+
+	for _, parallelism := range []int{1, 4} {
+		for failAt := -1; failAt < pieces; failAt++ {
+			for _, failAfter := range []int{0, 10} {
+				name := fmt.Sprintf(
+					"parallelism %d, failing piece %d after %d bytes",
+					parallelism,
+					failAt,
+					failAfter)
+
+				backend := &limitedFS{failOffset: -1}
+				if failAt >= 0 {
+					backend.failOffset = int64(failAt * backendLimit)
+					backend.failAfter = failAfter
+				}
+
+				fs := fuseutil.NewSplittingFileSystem(backend, fuseutil.SplitConfig{
+					MaxWriteSize: backendLimit,
+					Parallelism:  parallelism,
+				})
+
+				op := &fuseops.WriteFileOp{Data: want}
+				err := fs.WriteFile(context.Background(), op)
+
+				wantWritten := size
+				if failAt >= 0 {
+					wantWritten = failAt*backendLimit + failAfter
+				}
+
+				switch {
+				case failAt >= 0 && err != fuse.EIO:
+					t.Errorf("%s: WriteFile returned %v, want EIO", name, err)
+
+				case failAt < 0 && err != nil:
+					t.Errorf("%s: WriteFile: %v", name, err)
+
+				case op.BytesWritten != wantWritten:
+					t.Errorf("%s: BytesWritten %d, want %d", name, op.BytesWritten, wantWritten)
+				}
+
+				// Done one at a time, the pieces after the failure aren't started.
+				backend.mu.Lock()
+				if parallelism == 1 && failAt >= 0 && backend.calls != failAt+1 {
+					t.Errorf("%s: %d calls, want %d", name, backend.calls, failAt+1)
+				}
+
+				// As a caller told of a short write would, write the rest again.
+				backend.failOffset = -1
+				backend.mu.Unlock()
+
+				rest := &fuseops.WriteFileOp{
+					Offset: int64(op.BytesWritten),
+					Data:   want[op.BytesWritten:],
+				}
+
+				if err := fs.WriteFile(context.Background(), rest); err != nil {
+					t.Errorf("%s: WriteFile of the rest: %v", name, err)
+				}
+
+				backend.mu.Lock()
+				if backend.tooLarge {
+					t.Errorf("%s: backend given too large a write", name)
+				}
+
+				if !bytes.Equal(backend.contents, want) {
+					t.Errorf("%s: contents differ", name)
+				}
+				backend.mu.Unlock()
+			}
+		}
+	}
+}
+
+func TestSplittingFileSystem_Read(t *testing.T) {
+	const pieces = 16
+	contents := randomBytes(pieces*backendLimit - 100)
+
+	for _, parallelism := range []int{1, 4} {
+		// Fail each piece in turn, which fails the read, or none.
+		for failAt := -1; failAt < pieces; failAt++ {
+			name := fmt.Sprintf("parallelism %d, failing piece %d", parallelism, failAt)
+			backend := &limitedFS{contents: contents, failOffset: -1}
+			if failAt >= 0 {
+				backend.failOffset = int64(failAt * backendLimit)
+			}
+
+			fs := fuseutil.NewSplittingFileSystem(backend, fuseutil.SplitConfig{
+				MaxReadSize: backendLimit,
+				Parallelism: parallelism,
+			})
+
+			op := &fuseops.ReadFileOp{Dst: make([]byte, len(contents))}
+			err := fs.ReadFile(context.Background(), op)
+
+			switch {
+			case failAt >= 0 && err != fuse.EIO:
+				t.Errorf("%s: ReadFile returned %v, want EIO", name, err)
+
+			case failAt < 0 && err != nil:
+				t.Errorf("%s: ReadFile: %v", name, err)
+
+			case failAt < 0 && !bytes.Equal(op.Dst[:op.BytesRead], contents):
+				t.Errorf("%s: read %d bytes, not the contents", name, op.BytesRead)
+			}
+		}
+
+		// A read past the end of the file is short, even though the pieces past
+		// the end are read too.
+		backend := &limitedFS{contents: contents, failOffset: -1}
+		fs := fuseutil.NewSplittingFileSystem(backend, fuseutil.SplitConfig{
+			MaxReadSize: backendLimit,
+			Parallelism: parallelism,
+		})
+
+		const offset = 5000
+		op := &fuseops.ReadFileOp{
+			Offset: offset,
+			Dst:    make([]byte, 2*len(contents)),
+		}
+
+		if err := fs.ReadFile(context.Background(), op); err != nil {
+			t.Errorf("Parallelism %d: ReadFile past the end: %v", parallelism, err)
+		} else if !bytes.Equal(op.Dst[:op.BytesRead], contents[offset:]) {
+			t.Errorf(
+				"Parallelism %d: read %d bytes past the end, want %d",
+				parallelism,
+				op.BytesRead,
+				len(contents)-offset)
+		}
+
+		backend.mu.Lock()
+		if backend.tooLarge {
+			t.Errorf("Parallelism %d: backend given too large a read", parallelism)
+		}
+		backend.mu.Unlock()
+	}
+}
+
+func TestSplittingFileSystem_ShortWriteReply(t *testing.T) {
+	backend := &limitedFS{failOffset: 2 * backendLimit, failAfter: 10}
+	fs := fuseutil.NewSplittingFileSystem(backend, fuseutil.SplitConfig{
+		MaxWriteSize: backendLimit,
+	})
+
+	k, err := fusetesting.NewFakeKernel(fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{})
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	h, err := k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// The kernel is told of a short write, not of the failure.
+	data := randomBytes(4 * backendLimit)
+	n, err := k.Write(fileInode, h, 0, data)
+	if err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if want := 2*backendLimit + 10; n != want {
+		t.Errorf("Wrote %d bytes, want %d", n, want)
+	}
+
+	// A write that fails before writing anything still fails.
+	backend.mu.Lock()
+	backend.failOffset = 0
+	backend.failAfter = 0
+	backend.mu.Unlock()
+
+	if _, err := k.Write(fileInode, h, 0, data); err != fuse.EIO {
+		t.Errorf("Write: got %v, want EIO", err)
+	}
+}
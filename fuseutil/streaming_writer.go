@@ -0,0 +1,660 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+)
+
+// ErrStreamAbandoned is returned by the reader passed to
+// StreamingWriterConfig.Upload, after the bytes streamed to it, when the
+// upload is to be abandoned. Upload should discard what it has uploaded and
+// return.
+var ErrStreamAbandoned = errors.New("Streaming upload abandoned")
+
+// Returned by a streamPipe's writes once its reader has gone.
+var errUploadEnded = errors.New("Upload ended")
+
+// StreamFallbackPolicy decides what becomes of a streaming upload when a
+// StreamingWriter stops streaming.
+type StreamFallbackPolicy interface {
+	// Return true to finish the upload with the streamed bytes, i.e. for the
+	// reader passed to Upload to return io.EOF after them, or false to abandon
+	// it, for the reader to return ErrStreamAbandoned. Not called if Upload has
+	// already returned.
+	Commit(streamed int64) bool
+
+	// Return the first n bytes of the file, those streamed, from which the
+	// writer buffers the rest. uploadErr is what Upload returned. After a
+	// commit they might be read back from the backend, say; after an abandoned
+	// or failed upload they must come from elsewhere, e.g. a copy Upload made
+	// as it read them. An error fails the op that caused the fallback, and the
+	// next op tries again.
+	Prefix(
+		ctx context.Context,
+		n int64,
+		uploadErr error) ([]byte, error)
+}
+
+// StreamingWriterConfig configures a StreamingWriter.
+type StreamingWriterConfig struct {
+	// Upload the file's contents, reading them from r until it returns io.EOF,
+	// which marks the end of the file, and return the outcome. Required.
+	// Called in a goroutine of its own on the first write, or on a flush if
+	// there has been none, so that empty files are uploaded too.
+	Upload func(r io.Reader) error
+
+	// Upload the file's contents once the writer has fallen back to
+	// buffering. Required. Called by each flush that follows a change.
+	Flush func(
+		ctx context.Context,
+		contents []byte) error
+
+	// Decides what becomes of the streaming upload on fallback. Required.
+	Policy StreamFallbackPolicy
+
+	// The number of written bytes that may wait for Upload to read them,
+	// beyond which writes block. If zero, 1 MiB.
+	BufferSize int
+
+	// How far past the end of the streamed bytes a write may start and still
+	// be streamed, and how many bytes such writes may hold between them. If
+	// zero, 1 MiB.
+	ReorderWindow int
+}
+
+// StreamingWriter lets a file system upload a file as it is written, for
+// backends that can't patch an object in place but take a long time to
+// upload it whole, such as object stores. Create one for each handle that
+// writes a new file, e.g. one opened by CreateFileOp, or by OpenFileOp with
+// O_TRUNC, and direct WriteFile, truncation (SetInodeAttributes with a size),
+// FlushFile and ReleaseFileHandle to it.
+//
+// While the file is written sequentially from the start, the writes are
+// streamed to StreamingWriterConfig.Upload. The kernel may have several
+// writes for a handle in flight, so they can arrive a little out of order:
+// writes within ReorderWindow of the streamed bytes are held until the gap
+// before them fills. A flush ends the stream and waits for Upload.
+//
+// Once a write isn't part of that sequence, overwriting or skipping past the
+// streamed bytes, the file is truncated to anything but its length, or Upload
+// returns early, the writer falls back to buffering the whole file and
+// calling Flush with it. The streaming upload is committed or abandoned as
+// Policy decides, which also supplies the streamed bytes, since the writer
+// doesn't keep them.
+//
+// The writer can only see the writes the kernel sends. With the writeback
+// cache (see MountConfig.DisableWritebackCaching), the kernel may read back
+// pages it is partly writing, which the writer can't serve while streaming,
+// so such file systems should open streamed files with direct I/O.
+type StreamingWriter struct {
+	cfg StreamingWriterConfig
+
+	// Holds a value while an op is using the writer. A channel, so waiting
+	// for it can be interrupted. The fields below are accessed only by its
+	// holder.
+	turn chan struct{}
+
+	// The stream to Upload, once it has started. ended is set once it has been
+	// closed, be it by a flush or on fallback.
+	pipe       *streamPipe
+	uploadDone chan struct{}
+	uploadErr  error
+	ended      bool
+
+	// The number of bytes streamed, and writes held until those before them
+	// arrive, by offset. They don't overlap.
+	next        int64
+	parked      map[int64][]byte
+	parkedBytes int
+
+	// Set once the writer has fallen back to buffering, after which contents
+	// holds the file's contents. dirty is set if they have changed since the
+	// last successful flush.
+	buffered bool
+	contents []byte
+	dirty    bool
+
+	mu sync.Mutex
+
+	// The size of the file, and whether the writer is still streaming, for
+	// readers other than the holder of turn.
+	//
+	// GUARDED_BY(mu)
+	size      int64
+	streaming bool
+}
+
+// NewStreamingWriter creates a writer for an empty file.
+func NewStreamingWriter(cfg StreamingWriterConfig) *StreamingWriter {
+	if cfg.BufferSize == 0 {
+		cfg.BufferSize = 1 << 20
+	}
+
+	if cfg.ReorderWindow == 0 {
+		cfg.ReorderWindow = 1 << 20
+	}
+
+	return &StreamingWriter{
+		cfg:       cfg,
+		turn:      make(chan struct{}, 1),
+		parked:    make(map[int64][]byte),
+		streaming: true,
+	}
+}
+
+// Streaming reports whether the writer is still streaming, i.e. hasn't
+// fallen back to buffering.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *StreamingWriter) Streaming() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.streaming
+}
+
+// Size returns the size of the file as written.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *StreamingWriter) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Write writes data at the given offset, as for WriteFileOp. data isn't kept
+// after it returns. While streaming, it blocks while the buffer for Upload is
+// full, returning EINTR if ctx is cancelled first.
+func (w *StreamingWriter) Write(
+	ctx context.Context,
+	offset int64,
+	data []byte) error {
+	if err := w.acquire(ctx); err != nil {
+		return err
+	}
+
+	defer w.release()
+
+	if !w.buffered {
+		streamed, err := w.stream(ctx, offset, data)
+		if streamed || err != nil {
+			return err
+		}
+
+		if err := w.fallBack(ctx); err != nil {
+			return err
+		}
+	}
+
+	w.bufferWrite(offset, data)
+	return nil
+}
+
+// Truncate sets the size of the file, as for SetInodeAttributesOp.
+func (w *StreamingWriter) Truncate(
+	ctx context.Context,
+	size int64) error {
+	if err := w.acquire(ctx); err != nil {
+		return err
+	}
+
+	defer w.release()
+
+	if !w.buffered {
+		if size == w.next && len(w.parked) == 0 {
+			return nil
+		}
+
+		if err := w.fallBack(ctx); err != nil {
+			return err
+		}
+	}
+
+	if size < int64(len(w.contents)) {
+		w.contents = w.contents[:size]
+	} else {
+		w.contents = append(w.contents, make([]byte, size-int64(len(w.contents)))...)
+	}
+
+	w.dirty = true
+	w.updateSize()
+	return nil
+}
+
+// Flush uploads what has been written, as for FlushFileOp. While streaming,
+// it ends the stream and returns Upload's result, with which later flushes
+// return until there are more writes. A write after that falls back to
+// buffering.
+func (w *StreamingWriter) Flush(ctx context.Context) error {
+	if err := w.acquire(ctx); err != nil {
+		return err
+	}
+
+	defer w.release()
+
+	if !w.buffered {
+		// A gap the held writes were waiting for won't be filled now.
+		if len(w.parked) == 0 {
+			w.start()
+			w.end(io.EOF)
+			if err := w.awaitUpload(ctx); err != nil {
+				return err
+			}
+
+			return w.uploadErr
+		}
+
+		if err := w.fallBack(ctx); err != nil {
+			return err
+		}
+	}
+
+	if !w.dirty {
+		return nil
+	}
+
+	if err := w.cfg.Flush(ctx, w.contents); err != nil {
+		return err
+	}
+
+	w.dirty = false
+	return nil
+}
+
+// Close abandons a streaming upload that hasn't been flushed, as for
+// ReleaseFileHandleOp. It doesn't wait for Upload to return.
+func (w *StreamingWriter) Close() {
+	w.acquire(context.Background())
+	defer w.release()
+
+	if w.pipe != nil {
+		w.end(ErrStreamAbandoned)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (w *StreamingWriter) acquire(ctx context.Context) error {
+	select {
+	case w.turn <- struct{}{}:
+		return nil
+
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+func (w *StreamingWriter) release() {
+	<-w.turn
+}
+
+// Record the size of the file for Size, and whether the writer is still
+// streaming for Streaming.
+//
+// LOCKS_EXCLUDED(w.mu)
+func (w *StreamingWriter) updateSize() {
+	size := w.next
+	for offset, data := range w.parked {
+		if end := offset + int64(len(data)); end > size {
+			size = end
+		}
+	}
+
+	if w.buffered {
+		size = int64(len(w.contents))
+	}
+
+	w.mu.Lock()
+	w.size = size
+	w.streaming = !w.buffered
+	w.mu.Unlock()
+}
+
+// Start the upload, if it hasn't started.
+func (w *StreamingWriter) start() {
+	if w.pipe != nil {
+		return
+	}
+
+	p := &streamPipe{
+		size:    w.cfg.BufferSize,
+		changed: make(chan struct{}),
+	}
+
+	done := make(chan struct{})
+	w.pipe = p
+	w.uploadDone = done
+
+	go func() {
+		err := w.cfg.Upload(p)
+		if !p.closeRead() && err == nil {
+			err = errors.New("Upload returned before the end of the file")
+		}
+
+		w.uploadErr = err
+		close(done)
+	}()
+}
+
+// End the stream, if it hasn't ended, with the error its reader is to return
+// once it has read what was written.
+func (w *StreamingWriter) end(err error) {
+	if !w.ended {
+		w.pipe.closeWrite(err)
+		w.ended = true
+	}
+}
+
+// Wait for Upload to return, returning EINTR if ctx is cancelled first.
+func (w *StreamingWriter) awaitUpload(ctx context.Context) error {
+	select {
+	case <-w.uploadDone:
+		return nil
+
+	case <-ctx.Done():
+		return syscall.EINTR
+	}
+}
+
+// Stream the write if it continues the sequence, returning false otherwise.
+func (w *StreamingWriter) stream(
+	ctx context.Context,
+	offset int64,
+	data []byte) (streamed bool, err error) {
+	if w.ended {
+		return false, nil
+	}
+
+	defer w.updateSize()
+
+	end := offset + int64(len(data))
+	switch {
+	case offset == w.next:
+		n, err := w.send(ctx, data)
+		if err == errUploadEnded {
+			return false, nil
+		}
+
+		if err != nil {
+			// Hold the rest, so that a gap doesn't open up. The kernel may
+			// well repeat the whole write, which will then fall back.
+			if n < len(data) {
+				w.park(w.next, data[n:])
+			}
+
+			return false, err
+		}
+
+		return true, w.drain(ctx)
+
+	case offset < w.next:
+		return false, nil
+
+	case end > w.next+int64(w.cfg.ReorderWindow):
+		return false, nil
+
+	case w.parkedBytes+len(data) > w.cfg.ReorderWindow:
+		return false, nil
+	}
+
+	for o, d := range w.parked {
+		if offset < o+int64(len(d)) && o < end {
+			return false, nil
+		}
+	}
+
+	w.park(offset, data)
+	return true, nil
+}
+
+// Hold a copy of the data, which is to be written at the given offset once
+// the bytes before it have been.
+func (w *StreamingWriter) park(
+	offset int64,
+	data []byte) {
+	w.parked[offset] = append([]byte(nil), data...)
+	w.parkedBytes += len(data)
+}
+
+// Send the data to the upload, starting it if necessary.
+func (w *StreamingWriter) send(
+	ctx context.Context,
+	data []byte) (n int, err error) {
+	w.start()
+	n, err = w.pipe.write(ctx, data)
+	w.next += int64(n)
+	return n, err
+}
+
+// Send the held writes that are now in sequence.
+func (w *StreamingWriter) drain(ctx context.Context) error {
+	for {
+		data, ok := w.parked[w.next]
+		if !ok {
+			return nil
+		}
+
+		delete(w.parked, w.next)
+		w.parkedBytes -= len(data)
+
+		n, err := w.send(ctx, data)
+		if err == errUploadEnded {
+			// Fall back at the next op; the data is still held.
+			w.park(w.next, data[n:])
+			w.ended = true
+			return nil
+		}
+
+		if err != nil {
+			w.park(w.next, data[n:])
+			return err
+		}
+	}
+}
+
+// Stop streaming, and buffer the file's contents from then on.
+func (w *StreamingWriter) fallBack(ctx context.Context) error {
+	streamed := w.next
+
+	var uploadErr error
+	if w.pipe != nil {
+		select {
+		case <-w.uploadDone:
+		default:
+			if !w.ended {
+				if w.cfg.Policy.Commit(streamed) {
+					w.end(io.EOF)
+				} else {
+					w.end(ErrStreamAbandoned)
+				}
+			}
+		}
+
+		if err := w.awaitUpload(ctx); err != nil {
+			return err
+		}
+
+		uploadErr = w.uploadErr
+	}
+
+	var prefix []byte
+	if streamed > 0 {
+		var err error
+		prefix, err = w.cfg.Policy.Prefix(ctx, streamed, uploadErr)
+		if err != nil {
+			return err
+		}
+
+		if int64(len(prefix)) != streamed {
+			return fmt.Errorf("Prefix returned %d bytes, want %d", len(prefix), streamed)
+		}
+	}
+
+	w.buffered = true
+	w.contents = append([]byte(nil), prefix...)
+	for offset, data := range w.parked {
+		w.bufferWrite(offset, data)
+	}
+
+	w.parked = nil
+	w.parkedBytes = 0
+	w.dirty = true
+	w.updateSize()
+	return nil
+}
+
+// Write to the buffered contents.
+func (w *StreamingWriter) bufferWrite(
+	offset int64,
+	data []byte) {
+	if end := offset + int64(len(data)); end > int64(len(w.contents)) {
+		w.contents = append(w.contents, make([]byte, end-int64(len(w.contents)))...)
+	}
+
+	copy(w.contents[offset:], data)
+	w.dirty = true
+	w.updateSize()
+}
+
+// A pipe holding up to size bytes written but not yet read.
+type streamPipe struct {
+	size int
+
+	mu sync.Mutex
+
+	// The bytes written and not yet read.
+	//
+	// GUARDED_BY(mu)
+	buf []byte
+
+	// What reads return once buf is empty, set when the writer closes the
+	// pipe: io.EOF or ErrStreamAbandoned.
+	//
+	// GUARDED_BY(mu)
+	writeErr error
+
+	// Set once the reader has gone, and whether it had seen io.EOF.
+	//
+	// GUARDED_BY(mu)
+	readDone bool
+	sawEOF   bool
+
+	// Closed and replaced whenever the fields above change.
+	//
+	// GUARDED_BY(mu)
+	changed chan struct{}
+}
+
+// LOCKS_REQUIRED(p.mu)
+func (p *streamPipe) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *streamPipe) Read(b []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		switch {
+		case len(p.buf) > 0:
+			n = copy(b, p.buf)
+			p.buf = p.buf[n:]
+			p.signal()
+			return n, nil
+
+		case p.writeErr != nil:
+			p.sawEOF = p.writeErr == io.EOF
+			return 0, p.writeErr
+		}
+
+		changed := p.changed
+		p.mu.Unlock()
+		<-changed
+		p.mu.Lock()
+	}
+}
+
+// Write all of data, returning errUploadEnded if the reader goes first or
+// EINTR if ctx is cancelled first.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *streamPipe) write(
+	ctx context.Context,
+	data []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(data) > 0 {
+		if p.readDone {
+			return n, errUploadEnded
+		}
+
+		if room := p.size - len(p.buf); room > 0 {
+			if room > len(data) {
+				room = len(data)
+			}
+
+			p.buf = append(p.buf, data[:room]...)
+			data = data[room:]
+			n += room
+			p.signal()
+			continue
+		}
+
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+			p.mu.Lock()
+
+		case <-ctx.Done():
+			p.mu.Lock()
+			return n, syscall.EINTR
+		}
+	}
+
+	return n, nil
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *streamPipe) closeWrite(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.writeErr = err
+	p.signal()
+}
+
+// Record that the reader has gone, returning whether it had seen io.EOF.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *streamPipe) closeRead() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readDone = true
+	p.buf = nil
+	p.signal()
+	return p.sawEOF
+}
@@ -0,0 +1,345 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A backend recording what is uploaded to it, whether streamed or flushed.
+type streamBackend struct {
+	// Closed to let streams start reading, if non-nil.
+	gate chan struct{}
+
+	mu sync.Mutex
+
+	// The file as of the last committed stream or flush.
+	object []byte
+
+	// What the latest stream has read, kept so as to recover from abandoning
+	// it.
+	received []byte
+
+	commits  int
+	abandons int
+	flushes  int
+}
+
+func (b *streamBackend) upload(r io.Reader) error {
+	if b.gate != nil {
+		<-b.gate
+	}
+
+	b.mu.Lock()
+	b.received = nil
+	b.mu.Unlock()
+
+	// Small reads, so that writes wait for them.
+	buf := make([]byte, 7)
+	for {
+		n, err := r.Read(buf)
+
+		b.mu.Lock()
+		b.received = append(b.received, buf[:n]...)
+		switch err {
+		case nil:
+
+		case io.EOF:
+			b.object = append([]byte(nil), b.received...)
+			b.commits++
+
+		case fuseutil.ErrStreamAbandoned:
+			b.abandons++
+		}
+		b.mu.Unlock()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (b *streamBackend) flush(
+	ctx context.Context,
+	contents []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.object = append([]byte(nil), contents...)
+	b.flushes++
+	return nil
+}
+
+func (b *streamBackend) uploaded() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.object
+}
+
+// Commits or abandons streams at random, recovering the streamed bytes from
+// what the backend received.
+type randomPolicy struct {
+	b   *streamBackend
+	rnd *rand.Rand
+}
+
+func (p *randomPolicy) Commit(streamed int64) bool {
+	return p.rnd.Intn(2) == 0
+}
+
+func (p *randomPolicy) Prefix(
+	ctx context.Context,
+	n int64,
+	uploadErr error) ([]byte, error) {
+	p.b.mu.Lock()
+	defer p.b.mu.Unlock()
+
+	if int64(len(p.b.received)) != n {
+		return nil, fmt.Errorf("Received %d bytes, want %d", len(p.b.received), n)
+	}
+
+	return append([]byte(nil), p.b.received...), nil
+}
+
+func newStreamingWriter(
+	b *streamBackend,
+	rnd *rand.Rand,
+	bufferSize int) *fuseutil.StreamingWriter {
+	return fuseutil.NewStreamingWriter(fuseutil.StreamingWriterConfig{
+		Upload:        b.upload,
+		Flush:         b.flush,
+		Policy:        &randomPolicy{b, rnd},
+		BufferSize:    bufferSize,
+		ReorderWindow: 256,
+	})
+}
+
+func streamBytes(
+	rnd *rand.Rand,
+	n int) []byte {
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+func TestStreamingWriter_Reordered(t *testing.T) {
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(1))
+	b := &streamBackend{}
+	w := newStreamingWriter(b, rnd, 64)
+	defer w.Close()
+
+	// Pairs of writes, the second of each arriving first, as concurrent
+	// writes may.
+	var want []byte
+	for i := 0; i < 50; i++ {
+		first := streamBytes(rnd, 1+rnd.Intn(100))
+		second := streamBytes(rnd, 1+rnd.Intn(100))
+		offset := int64(len(want))
+
+		if err := w.Write(ctx, offset+int64(len(first)), second); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		if err := w.Write(ctx, offset, first); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		want = append(append(want, first...), second...)
+	}
+
+	if err := w.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if !w.Streaming() || b.flushes != 0 || b.commits != 1 {
+		t.Errorf(
+			"Streaming: %v, flushes: %d, commits: %d",
+			w.Streaming(),
+			b.flushes,
+			b.commits)
+	}
+
+	if !bytes.Equal(b.uploaded(), want) {
+		t.Errorf("Uploaded %d bytes, want %d", len(b.uploaded()), len(want))
+	}
+}
+
+func TestStreamingWriter_Backpressure(t *testing.T) {
+	ctx := context.Background()
+	b := &streamBackend{gate: make(chan struct{})}
+	w := newStreamingWriter(b, rand.New(rand.NewSource(1)), 16)
+	defer w.Close()
+
+	data := streamBytes(rand.New(rand.NewSource(2)), 20)
+	if err := w.Write(ctx, 0, data[:10]); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// The next write doesn't fit until the upload reads.
+	done := make(chan error, 1)
+	go func() { done <- w.Write(ctx, 10, data[10:]) }()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Write returned %v while the buffer was full", err)
+
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Nor can a flush overtake it, and it can be interrupted.
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+
+	if err := w.Flush(shortCtx); err != syscall.EINTR {
+		t.Errorf("Flush: got %v, want EINTR", err)
+	}
+
+	close(b.gate)
+	if err := <-done; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if err := w.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if !bytes.Equal(b.uploaded(), data) {
+		t.Errorf("Uploaded %x, want %x", b.uploaded(), data)
+	}
+}
+
+func TestStreamingWriter_Interrupted(t *testing.T) {
+	b := &streamBackend{gate: make(chan struct{})}
+	defer close(b.gate)
+
+	w := newStreamingWriter(b, rand.New(rand.NewSource(1)), 16)
+	defer w.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := w.Write(ctx, 0, make([]byte, 100)); err != syscall.EINTR {
+		t.Errorf("Write: got %v, want EINTR", err)
+	}
+}
+
+// Random mixtures of sequential, reordered and other writes, truncations and
+// flushes, the others making the writer fall back, leave the backend with
+// what was written.
+func TestStreamingWriter_RandomFallback(t *testing.T) {
+	ctx := context.Background()
+
+	var streamed, commits, abandons int
+	for trial := 0; trial < 300; trial++ {
+		rnd := rand.New(rand.NewSource(int64(trial)))
+		b := &streamBackend{}
+		w := newStreamingWriter(b, rnd, 1+rnd.Intn(128))
+
+		var model []byte
+		write := func(offset int64, data []byte) {
+			if err := w.Write(ctx, offset, data); err != nil {
+				t.Fatalf("Trial %d: Write(%d, %d): %v", trial, offset, len(data), err)
+			}
+
+			if end := offset + int64(len(data)); end > int64(len(model)) {
+				model = append(model, make([]byte, end-int64(len(model)))...)
+			}
+
+			copy(model[offset:], data)
+		}
+
+		truncate := func(size int64) {
+			if err := w.Truncate(ctx, size); err != nil {
+				t.Fatalf("Trial %d: Truncate(%d): %v", trial, size, err)
+			}
+
+			if size < int64(len(model)) {
+				model = model[:size]
+			} else {
+				model = append(model, make([]byte, size-int64(len(model)))...)
+			}
+		}
+
+		flush := func() {
+			if err := w.Flush(ctx); err != nil {
+				t.Fatalf("Trial %d: Flush: %v", trial, err)
+			}
+
+			if !bytes.Equal(b.uploaded(), model) {
+				t.Fatalf("Trial %d: uploaded %d bytes, not the %d written", trial, len(b.uploaded()), len(model))
+			}
+		}
+
+		for i := 0; i < 40; i++ {
+			end := int64(len(model))
+			switch r := rnd.Intn(100); {
+			case r < 60:
+				write(end, streamBytes(rnd, 1+rnd.Intn(100)))
+
+			case r < 80:
+				first := streamBytes(rnd, 1+rnd.Intn(100))
+				second := streamBytes(rnd, 1+rnd.Intn(100))
+				write(end+int64(len(first)), second)
+				write(end, first)
+
+			case r < 85:
+				write(rnd.Int63n(end+50), streamBytes(rnd, 1+rnd.Intn(100)))
+
+			case r < 88:
+				truncate(rnd.Int63n(end + 50))
+
+			case r < 92:
+				truncate(end)
+
+			default:
+				flush()
+			}
+
+			if w.Size() != int64(len(model)) {
+				t.Fatalf("Trial %d: size %d, want %d", trial, w.Size(), len(model))
+			}
+		}
+
+		flush()
+		w.Close()
+
+		if w.Streaming() {
+			streamed++
+		}
+
+		commits += b.commits
+		abandons += b.abandons
+	}
+
+	// Each path was taken.
+	if streamed == 0 || commits == 0 || abandons == 0 {
+		t.Errorf("Streamed throughout %d times, %d commits, %d abandons", streamed, commits, abandons)
+	}
+}
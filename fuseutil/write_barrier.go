@@ -0,0 +1,256 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Tracks the writes in progress on each file handle of a connection, so that
+// syncs and flushes can wait for those that arrived before them and report
+// their failures. See NewFileSystemServer.
+type writeBarriers struct {
+	mu sync.Mutex
+
+	// The handles with writes in progress or failures not yet reported.
+	//
+	// GUARDED_BY(mu)
+	handles map[barrierKey]*handleWrites
+}
+
+// Identifies a handle. File systems that don't distinguish their handles give
+// them all the same ID, so the inode is needed as well to keep unrelated files
+// from waiting for each other.
+type barrierKey struct {
+	inode  fuseops.InodeID
+	handle fuseops.HandleID
+}
+
+type handleWrites struct {
+	// The number of writes that have arrived for the handle.
+	//
+	// GUARDED_BY(writeBarriers.mu)
+	arrived uint64
+
+	// The writes whose calls haven't yet finished, in arrival order.
+	//
+	// GUARDED_BY(writeBarriers.mu)
+	pending []*pendingWrite
+
+	// The writes that have failed since a sync or flush that arrived after them
+	// last reported a failure, in the order they failed.
+	//
+	// GUARDED_BY(writeBarriers.mu)
+	failed []*pendingWrite
+}
+
+type pendingWrite struct {
+	// The value of handleWrites.arrived when the write arrived.
+	seq uint64
+
+	// Closed when the write finishes, after setting err.
+	done chan struct{}
+	err  error
+}
+
+// The part an op read from the kernel plays in its handle's barrier, as
+// decided when it arrived. The zero value plays none.
+type barrierTicket struct {
+	key    barrierKey
+	writes *handleWrites
+
+	// For writes, the write itself.
+	write *pendingWrite
+
+	// For syncs and flushes, the writes to wait for, and the number of writes
+	// that had arrived before them.
+	waitFor []*pendingWrite
+	before  uint64
+}
+
+// Decide the part op plays in its handle's barrier. This must be called in
+// the order that ops are read from the kernel, since that is what "earlier"
+// means.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *writeBarriers) arrive(op interface{}) (t barrierTicket) {
+	var barrier bool
+	switch typed := op.(type) {
+	case *fuseops.WriteFileOp:
+		t.key = barrierKey{typed.Inode, typed.Handle}
+
+	case *fuseops.SyncFileOp:
+		t.key = barrierKey{typed.Inode, typed.Handle}
+		barrier = true
+
+	case *fuseops.FlushFileOp:
+		t.key = barrierKey{typed.Inode, typed.Handle}
+		barrier = true
+
+	default:
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hw := b.handles[t.key]
+	if barrier {
+		if hw != nil {
+			t.writes = hw
+			t.waitFor = append([]*pendingWrite(nil), hw.pending...)
+			t.before = hw.arrived
+		}
+
+		return
+	}
+
+	if hw == nil {
+		if b.handles == nil {
+			b.handles = make(map[barrierKey]*handleWrites)
+		}
+
+		hw = &handleWrites{}
+		b.handles[t.key] = hw
+	}
+
+	t.writes = hw
+	t.write = &pendingWrite{
+		seq:  hw.arrived,
+		done: make(chan struct{}),
+	}
+
+	hw.arrived++
+	hw.pending = append(hw.pending, t.write)
+	return
+}
+
+// Record that the write with the supplied ticket has finished with the given
+// result, whether or not it reached the file system. A no-op for other ops.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *writeBarriers) finish(t barrierTicket, err error) {
+	w := t.write
+	if w == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	hw := t.writes
+	for i, p := range hw.pending {
+		if p == w {
+			hw.pending = append(hw.pending[:i], hw.pending[i+1:]...)
+			break
+		}
+	}
+
+	if err != nil {
+		w.err = err
+		hw.failed = append(hw.failed, w)
+	}
+
+	close(w.done)
+	b.tidy(t.key, hw)
+}
+
+// Forget hw if it no longer holds anything of interest.
+//
+// LOCKS_REQUIRED(b.mu)
+func (b *writeBarriers) tidy(
+	key barrierKey,
+	hw *handleWrites) {
+	if len(hw.pending) == 0 && len(hw.failed) == 0 && b.handles[key] == hw {
+		delete(b.handles, key)
+	}
+}
+
+// Wait for the writes that a sync or flush must follow to finish. Return
+// EINTR if ctx is cancelled first. A no-op for other ops.
+func (b *writeBarriers) wait(
+	ctx context.Context,
+	t barrierTicket) error {
+	for _, w := range t.waitFor {
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return syscall.EINTR
+		}
+	}
+
+	return nil
+}
+
+// Given the result of the file system's call for a sync or flush, which must
+// have waited for its writes, return the result to reply with: the error of
+// the first write that arrived before it and failed since an earlier sync or
+// flush reported a failure, if there is one and the call itself succeeded.
+//
+// Each failure is reported at most once, so that a retried sync succeeds once
+// the file system has recovered. A failed sync or flush consumes the failures
+// it would have reported, since it has told the caller something went wrong.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *writeBarriers) result(
+	t barrierTicket,
+	err error) error {
+	hw := t.writes
+	if hw == nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var first error
+	remaining := hw.failed[:0]
+	for _, w := range hw.failed {
+		if w.seq >= t.before {
+			remaining = append(remaining, w)
+			continue
+		}
+
+		if first == nil {
+			first = w.err
+		}
+	}
+
+	hw.failed = remaining
+	b.tidy(t.key, hw)
+
+	if err == nil {
+		err = first
+	}
+
+	return err
+}
+
+// Forget the supplied handle, which has been released. The kernel waits for
+// the handle's writes before releasing it, so there is nothing to wait for.
+//
+// LOCKS_EXCLUDED(b.mu)
+func (b *writeBarriers) released(
+	inode fuseops.InodeID,
+	h fuseops.HandleID) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.handles, barrierKey{inode, h})
+}
@@ -0,0 +1,263 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The offset at which writeLogFS fails writes.
+const failingOffset = 13
+
+// Records the order in which calls reach it, failing writes at
+// failingOffset.
+type writeLogFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// Receives a value for each write, once it's been logged.
+	written chan struct{}
+
+	mu  sync.Mutex
+	log []string // GUARDED_BY(mu)
+}
+
+func (fs *writeLogFS) record(call string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.log = append(fs.log, call)
+}
+
+func (fs *writeLogFS) calls() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return append([]string(nil), fs.log...)
+}
+
+func (fs *writeLogFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	fs.record("statfs")
+	return nil
+}
+
+func (fs *writeLogFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	// Have the server choose distinct handle IDs.
+	op.HandleData = &openFile{}
+	return nil
+}
+
+func (fs *writeLogFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.record("write")
+	fs.written <- struct{}{}
+
+	if op.Offset == failingOffset {
+		return fuse.EIO
+	}
+
+	return nil
+}
+
+func (fs *writeLogFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.record("sync")
+	return nil
+}
+
+func (fs *writeLogFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.record("flush")
+	return nil
+}
+
+func (fs *writeLogFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+// A sync or flush, as sent by one of the FakeKernel methods.
+type barrierCall struct {
+	name string
+	call func(
+		k *fusetesting.FakeKernel,
+		inode fuseops.InodeID,
+		h fuseops.HandleID) error
+}
+
+var barrierCalls = []barrierCall{
+	{"sync", (*fusetesting.FakeKernel).Fsync},
+	{"flush", (*fusetesting.FakeKernel).Flush},
+}
+
+// A sync or flush arriving while an earlier write on the same handle is still
+// in progress must wait for it, however the scheduler would otherwise order
+// them, and fail if it failed.
+func TestWriteBarrier_WaitsForEarlierWrites(t *testing.T) {
+	for _, b := range barrierCalls {
+		t.Run(b.name, func(t *testing.T) {
+			testWaitsForEarlierWrites(t, b)
+		})
+	}
+}
+
+func testWaitsForEarlierWrites(t *testing.T, b barrierCall) {
+	s := fusetesting.NewScheduler(0)
+	fs := &writeLogFS{written: make(chan struct{}, 1)}
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(s.Wrap(fs)),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	h, err := k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	// The write reaches the file system but is kept from returning until a
+	// statfs, sent only once the sync or flush has had its chance to overtake
+	// it, is admitted. Meanwhile the scheduler is free to admit anything else.
+	s.Hold(
+		fusetesting.OpsOfType(&fuseops.WriteFileOp{}), fusetesting.PointDone,
+		fusetesting.OpsOfType(&fuseops.StatFSOp{}), fusetesting.PointStart)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := k.Write(fileInode, h, failingOffset, []byte("taco"))
+		writeErr <- err
+	}()
+
+	<-fs.written
+
+	barrierErr := make(chan error, 1)
+	go func() {
+		barrierErr <- b.call(k, fileInode, h)
+	}()
+
+	select {
+	case err := <-barrierErr:
+		t.Errorf("The %s returned (%v) while a write was in progress", b.name, err)
+		barrierErr <- err
+
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := k.Call(fusekernel.OpStatfs, 1, nil); err != nil {
+		t.Fatalf("StatFS: %v", err)
+	}
+
+	if err := <-writeErr; err != fuse.EIO {
+		t.Errorf("Write: got %v, want EIO", err)
+	}
+
+	if err := <-barrierErr; err != fuse.EIO {
+		t.Errorf("The %s: got %v, want EIO", b.name, err)
+	}
+
+	want := []string{"write", "statfs", b.name}
+	if got := fs.calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Calls: got %q, want %q", got, want)
+	}
+}
+
+// A failed write is reported by the next sync or flush on its handle and no
+// other.
+func TestWriteBarrier_ReportsFailuresOnce(t *testing.T) {
+	fs := &writeLogFS{written: make(chan struct{}, 16)}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	h1, err := k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	h2, err := k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for _, b := range barrierCalls {
+		// Fail a write on the first handle, then succeed at another.
+		if _, err := k.Write(fileInode, h1, failingOffset, []byte("taco")); err != fuse.EIO {
+			t.Fatalf("Write: got %v, want EIO", err)
+		}
+
+		if _, err := k.Write(fileInode, h1, 0, []byte("burrito")); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+
+		// The other handle knows nothing of it.
+		if err := b.call(k, fileInode, h2); err != nil {
+			t.Errorf("The %s of the other handle: %v", b.name, err)
+		}
+
+		if err := b.call(k, fileInode, h1); err != fuse.EIO {
+			t.Errorf("The first %s: got %v, want EIO", b.name, err)
+		}
+
+		if err := b.call(k, fileInode, h1); err != nil {
+			t.Errorf("The second %s: %v", b.name, err)
+		}
+	}
+
+	// Releasing a handle forgets failures never reported.
+	if _, err := k.Write(fileInode, h1, failingOffset, []byte("taco")); err != fuse.EIO {
+		t.Fatalf("Write: got %v, want EIO", err)
+	}
+
+	if err := k.Release(fileInode, h1); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	h3, err := k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if err := k.Fsync(fileInode, h3); err != nil {
+		t.Errorf("Fsync of a new handle: %v", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The data writeParallelFS expects to be written at the given offset.
+func parallelWriteData(offset int64) []byte {
+	return bytes.Repeat([]byte{byte(offset / 4096)}, 4096)
+}
+
+// Holds each write until all those expected are in progress at once, then checks that each was
+// given the data meant for its offset.
+type writeParallelFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	started sync.WaitGroup
+	all     chan struct{}
+
+	mu   sync.Mutex
+	errs []string // GUARDED_BY(mu)
+}
+
+func (fs *writeParallelFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *writeParallelFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.started.Done()
+
+	var err string
+	select {
+	case <-fs.all:
+	case <-time.After(5 * time.Second):
+		err = fmt.Sprintf("write at %d: the others didn't arrive", op.Offset)
+	}
+
+	// By now the other writes have been read into their own buffers.
+	if !bytes.Equal(op.Data, parallelWriteData(op.Offset)) {
+		err = fmt.Sprintf("write at %d: wrong data", op.Offset)
+	}
+
+	if err != "" {
+		fs.mu.Lock()
+		fs.errs = append(fs.errs, err)
+		fs.mu.Unlock()
+		return fuse.EIO
+	}
+
+	return nil
+}
+
+// Writes on the same handle at different offsets reach the file system
+// concurrently, each with its own data.
+func TestWriteFile_Parallel(t *testing.T) {
+	const n = 8
+	fs := &writeParallelFS{all: make(chan struct{})}
+	fs.started.Add(n)
+	go func() {
+		fs.started.Wait()
+		close(fs.all)
+	}()
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	h, err := k.Open(fileInode)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		offset := int64((n - 1 - i) * 4096)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			data := parallelWriteData(offset)
+			written, err := k.Write(fileInode, h, offset, data)
+			if err != nil || written != len(data) {
+				t.Errorf("Write(%d): got (%d, %v)", offset, written, err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, e := range fs.errs {
+		t.Error(e)
+	}
+}
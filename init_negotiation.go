@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import "github.com/jacobsa/fuse/internal/fusekernel"
+
+// InitFeatures lists optional protocol features that the kernel and the file
+// system agree on when the connection is initialized. See InitNegotiator.
+type InitFeatures struct {
+	// The kernel caches writes and sends them later, in larger pieces, rather
+	// than sending each write(2) as it happens. See
+	// MountConfig.DisableWritebackCaching.
+	WritebackCache bool
+
+	// The kernel reads directories with ReadDirPlusOp. See
+	// MountConfig.EnableReadDirPlus.
+	ReadDirPlus bool
+
+	// The kernel sends record locks to the file system. See
+	// MountConfig.EnablePOSIXLocks.
+	POSIXLocks bool
+
+	// The kernel sends flock(2) locks to the file system. See
+	// MountConfig.EnableFlockLocks.
+	FlockLocks bool
+
+	// The kernel caches symlink targets. See MountConfig.EnableSymlinkCaching.
+	SymlinkCaching bool
+}
+
+// Decode the features present in flags.
+func initFeaturesFromFlags(flags fusekernel.InitFlags) InitFeatures {
+	return InitFeatures{
+		WritebackCache: flags&fusekernel.InitWritebackCache != 0,
+		ReadDirPlus:    flags&fusekernel.InitDoReaddirplus != 0,
+		POSIXLocks:     flags&fusekernel.InitPosixLocks != 0,
+		FlockLocks:     flags&fusekernel.InitFlockLocks != 0,
+		SymlinkCaching: flags&fusekernel.InitCacheSymlinks != 0,
+	}
+}
+
+// Encode the features as init flags.
+func (f InitFeatures) flags() fusekernel.InitFlags {
+	var flags fusekernel.InitFlags
+	if f.WritebackCache {
+		flags |= fusekernel.InitWritebackCache
+	}
+
+	if f.ReadDirPlus {
+		flags |= fusekernel.InitDoReaddirplus
+	}
+
+	if f.POSIXLocks {
+		flags |= fusekernel.InitPosixLocks
+	}
+
+	if f.FlockLocks {
+		flags |= fusekernel.InitFlockLocks
+	}
+
+	if f.SymlinkCaching {
+		flags |= fusekernel.InitCacheSymlinks
+	}
+
+	return flags
+}
+
+// InitNegotiation describes the kernel's init request to an InitNegotiator,
+// which may change the features to be enabled before it is answered.
+type InitNegotiation struct {
+	// The version of the protocol spoken by the kernel.
+	KernelMajor uint32
+	KernelMinor uint32
+
+	// The features the kernel supports.
+	Offered InitFeatures
+
+	// The features to enable: initially those among Offered that the
+	// MountConfig asks for. The negotiator may turn any of them off, or turn
+	// on others. Those the kernel doesn't support are left off regardless.
+	Wanted InitFeatures
+}
+
+// A Server may implement InitNegotiator to take part in initializing the
+// connection. The server returned by fuseutil.NewFileSystemServer does so by
+// passing the call on to its FileSystem, if it implements this too.
+//
+// The features finally agreed on are reported as MountInfo.Features.
+type InitNegotiator interface {
+	// Called once for each connection, with the kernel's init request, before
+	// it is answered and before ServeOps. Returning an error refuses the connection, failing the
+	// mount. Not called for a connection resumed from another process (see
+	// MountConfig.Resume), which keeps the features agreed on before.
+	NegotiateInit(n *InitNegotiation) error
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system that takes part in init with the given function, and records
+// the negotiation it saw and the features its ops were served with.
+type negotiatingFS struct {
+	fuseutil.NotImplementedFileSystem
+	negotiate func(n *fuse.InitNegotiation) error
+
+	mu       sync.Mutex
+	seen     fuse.InitNegotiation // GUARDED_BY(mu)
+	features fuse.InitFeatures    // GUARDED_BY(mu)
+}
+
+func (fs *negotiatingFS) NegotiateInit(n *fuse.InitNegotiation) error {
+	fs.mu.Lock()
+	fs.seen = *n
+	fs.mu.Unlock()
+
+	return fs.negotiate(n)
+}
+
+func (fs *negotiatingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	info, _ := fuse.MountInfoFromContext(ctx)
+
+	fs.mu.Lock()
+	fs.features = info.Features
+	fs.mu.Unlock()
+
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0755 | os.ModeDir,
+	}
+
+	return nil
+}
+
+func TestInitNegotiation(t *testing.T) {
+	fs := &negotiatingFS{
+		negotiate: func(n *fuse.InitNegotiation) error {
+			// Turn off writeback caching, which the config leaves on, and turn on
+			// flock locks, which it leaves off.
+			n.Wanted.WritebackCache = false
+			n.Wanted.FlockLocks = true
+			return nil
+		},
+	}
+
+	cfg := &fuse.MountConfig{
+		EnableReadDirPlus: true,
+	}
+
+	k, err := fusetesting.NewFakeKernel(fuseutil.NewFileSystemServer(fs), cfg)
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	if _, err := k.GetAttr(fuseops.RootInodeID); err != nil {
+		t.Fatalf("GetAttr: %v", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// The fake kernel offers all the features, and the config wants the
+	// defaults plus READDIRPLUS.
+	all := fuse.InitFeatures{
+		WritebackCache: true,
+		ReadDirPlus:    true,
+		POSIXLocks:     true,
+		FlockLocks:     true,
+		SymlinkCaching: true,
+	}
+
+	if fs.seen.Offered != all {
+		t.Errorf("Offered: got %+v, want %+v", fs.seen.Offered, all)
+	}
+
+	want := fuse.InitFeatures{WritebackCache: true, ReadDirPlus: true}
+	if fs.seen.Wanted != want {
+		t.Errorf("Wanted: got %+v, want %+v", fs.seen.Wanted, want)
+	}
+
+	if fs.seen.KernelMajor != 7 || fs.seen.KernelMinor == 0 {
+		t.Errorf("Kernel version: got %d.%d", fs.seen.KernelMajor, fs.seen.KernelMinor)
+	}
+
+	// Ops see what the file system chose.
+	want = fuse.InitFeatures{ReadDirPlus: true, FlockLocks: true}
+	if fs.features != want {
+		t.Errorf("Features: got %+v, want %+v", fs.features, want)
+	}
+}
+
+func TestInitNegotiation_Refused(t *testing.T) {
+	fs := &negotiatingFS{
+		negotiate: func(n *fuse.InitNegotiation) error {
+			return errors.New("taco")
+		},
+	}
+
+	_, err := fusetesting.NewFakeKernel(fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{})
+	if err == nil || !strings.Contains(err.Error(), "taco") {
+		t.Fatalf("NewFakeKernel: got %v, want an error mentioning taco", err)
+	}
+}
@@ -79,6 +79,12 @@ func (m *InMessage) Header() *fusekernel.InHeader {
 	return (*fusekernel.InHeader)(unsafe.Pointer(&m.storage[0]))
 }
 
+// Return the whole message read in the most recent call to Init, including
+// the header, regardless of what has been consumed.
+func (m *InMessage) Bytes() []byte {
+	return m.storage[:m.Header().Len]
+}
+
 // Return the number of bytes left to consume.
 func (m *InMessage) Len() uintptr {
 	return uintptr(len(m.remaining))
@@ -0,0 +1,127 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package convert translates inode attributes and cache entries, as the file
+// system describes them in fuseops, to the structures the kernel expects. It
+// is shared by the connection, which encodes replies, and by fuseutil, whose
+// helpers encode directory entries carrying attributes.
+package convert
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Time splits t into whole seconds and nanoseconds since the Unix epoch.
+func Time(t time.Time) (secs uint64, nsec uint32) {
+	totalNano := t.UnixNano()
+	secs = uint64(totalNano / 1e9)
+	nsec = uint32(totalNano % 1e9)
+	return secs, nsec
+}
+
+// Attributes fills in out from the attributes of the supplied inode.
+func Attributes(
+	inodeID fuseops.InodeID,
+	in *fuseops.InodeAttributes,
+	out *fusekernel.Attr) {
+	out.Ino = uint64(inodeID)
+	out.Size = in.Size
+	out.Atime, out.AtimeNsec = Time(in.Atime)
+	out.Mtime, out.MtimeNsec = Time(in.Mtime)
+	out.Ctime, out.CtimeNsec = Time(in.Ctime)
+	out.SetCrtime(Time(in.Crtime))
+	out.Nlink = in.Nlink
+	out.Uid = in.Uid
+	out.Gid = in.Gid
+	out.Rdev = in.Rdev
+	out.Blksize = in.BlockSize
+
+	// Unless told otherwise, round up to the nearest 512 boundary.
+	out.Blocks = in.Blocks
+	if out.Blocks == 0 {
+		out.Blocks = (in.Size + 512 - 1) / 512
+	}
+
+	// Set the mode.
+	out.Mode = uint32(in.Mode) & 0777
+	switch {
+	default:
+		out.Mode |= syscall.S_IFREG
+	case in.Mode&os.ModeDir != 0:
+		out.Mode |= syscall.S_IFDIR
+	case in.Mode&os.ModeDevice != 0:
+		if in.Mode&os.ModeCharDevice != 0 {
+			out.Mode |= syscall.S_IFCHR
+		} else {
+			out.Mode |= syscall.S_IFBLK
+		}
+	case in.Mode&os.ModeNamedPipe != 0:
+		out.Mode |= syscall.S_IFIFO
+	case in.Mode&os.ModeSymlink != 0:
+		out.Mode |= syscall.S_IFLNK
+	case in.Mode&os.ModeSocket != 0:
+		out.Mode |= syscall.S_IFSOCK
+	}
+	if in.Mode&os.ModeSetuid != 0 {
+		out.Mode |= syscall.S_ISUID
+	}
+}
+
+// Expiration converts a cache expiration, given either as an absolute time or
+// (if that is zero) as a duration, to a time relative to now for consumption
+// by the fuse kernel module.
+func Expiration(
+	now time.Time,
+	t time.Time,
+	d time.Duration) (secs uint64, nsecs uint32) {
+	if !t.IsZero() {
+		d = t.Sub(now)
+	}
+
+	// Fuse represents durations as unsigned 64-bit counts of seconds and 32-bit
+	// counts of nanoseconds (cf. http://goo.gl/EJupJV). So negative durations
+	// are right out. There is no need to cap the positive magnitude, because
+	// 2^64 seconds is well longer than the 2^63 ns range of time.Duration.
+	if d > 0 {
+		secs = uint64(d / time.Second)
+		nsecs = uint32((d % time.Second) / time.Nanosecond)
+	}
+
+	return secs, nsecs
+}
+
+// ChildInodeEntry fills in out from the supplied entry, measuring its
+// expirations from now.
+func ChildInodeEntry(
+	now time.Time,
+	in *fuseops.ChildInodeEntry,
+	out *fusekernel.EntryOut) {
+	out.Nodeid = uint64(in.Child)
+	out.Generation = uint64(in.Generation)
+	out.EntryValid, out.EntryValidNsec = Expiration(
+		now,
+		in.EntryExpiration,
+		in.EntryValidFor)
+	out.AttrValid, out.AttrValidNsec = Expiration(
+		now,
+		in.AttributesExpiration,
+		in.AttributesValidFor)
+
+	Attributes(in.Child, &in.Attributes, &out.Attr)
+}
@@ -46,7 +46,7 @@ const (
 	ProtoVersionMinMajor = 7
 	ProtoVersionMinMinor = 8
 	ProtoVersionMaxMajor = 7
-	ProtoVersionMaxMinor = 12
+	ProtoVersionMaxMinor = 28
 )
 
 const (
@@ -227,6 +227,7 @@ const (
 	OpenDirectIO    OpenResponseFlags = 1 << 0 // bypass page cache for this open file
 	OpenKeepCache   OpenResponseFlags = 1 << 1 // don't invalidate the data cache on open
 	OpenNonSeekable OpenResponseFlags = 1 << 2 // mark the file as non-seekable (not supported on OS X)
+	OpenCacheDir    OpenResponseFlags = 1 << 3 // allow caching of directory entries (Linux 4.20+)
 
 	OpenPurgeAttr OpenResponseFlags = 1 << 30 // OS X
 	OpenPurgeUBC  OpenResponseFlags = 1 << 31 // OS X
@@ -240,6 +241,7 @@ var openResponseFlagNames = []flagName{
 	{uint32(OpenDirectIO), "OpenDirectIO"},
 	{uint32(OpenKeepCache), "OpenKeepCache"},
 	{uint32(OpenNonSeekable), "OpenNonSeekable"},
+	{uint32(OpenCacheDir), "OpenCacheDir"},
 	{uint32(OpenPurgeAttr), "OpenPurgeAttr"},
 	{uint32(OpenPurgeUBC), "OpenPurgeUBC"},
 }
@@ -333,7 +335,8 @@ func flagString(f uint32, names []flagName) string {
 type ReleaseFlags uint32
 
 const (
-	ReleaseFlush ReleaseFlags = 1 << 0
+	ReleaseFlush       ReleaseFlags = 1 << 0
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1
 )
 
 func (fl ReleaseFlags) String() string {
@@ -342,49 +345,90 @@ func (fl ReleaseFlags) String() string {
 
 var releaseFlagNames = []flagName{
 	{uint32(ReleaseFlush), "ReleaseFlush"},
+	{uint32(ReleaseFlockUnlock), "ReleaseFlockUnlock"},
+}
+
+// The RenameFlags are used in the Rename2 exchange.
+type RenameFlags uint32
+
+const (
+	RenameNoreplace RenameFlags = 1 << 0
+	RenameExchange  RenameFlags = 1 << 1
+	RenameWhiteout  RenameFlags = 1 << 2
+)
+
+func (fl RenameFlags) String() string {
+	return flagString(uint32(fl), renameFlagNames)
+}
+
+var renameFlagNames = []flagName{
+	{uint32(RenameNoreplace), "RenameNoreplace"},
+	{uint32(RenameExchange), "RenameExchange"},
+	{uint32(RenameWhiteout), "RenameWhiteout"},
+}
+
+// The LkFlags are used in the Getlk, Setlk and Setlkw exchanges.
+type LkFlags uint32
+
+const (
+	// The lock was taken with flock(2) rather than fcntl(2).
+	LkFlock LkFlags = 1 << 0
+)
+
+func (fl LkFlags) String() string {
+	return flagString(uint32(fl), lkFlagNames)
+}
+
+var lkFlagNames = []flagName{
+	{uint32(LkFlock), "LkFlock"},
 }
 
 // Opcodes
 const (
-	OpLookup      = 1
-	OpForget      = 2 // no reply
-	OpGetattr     = 3
-	OpSetattr     = 4
-	OpReadlink    = 5
-	OpSymlink     = 6
-	OpMknod       = 8
-	OpMkdir       = 9
-	OpUnlink      = 10
-	OpRmdir       = 11
-	OpRename      = 12
-	OpLink        = 13
-	OpOpen        = 14
-	OpRead        = 15
-	OpWrite       = 16
-	OpStatfs      = 17
-	OpRelease     = 18
-	OpFsync       = 20
-	OpSetxattr    = 21
-	OpGetxattr    = 22
-	OpListxattr   = 23
-	OpRemovexattr = 24
-	OpFlush       = 25
-	OpInit        = 26
-	OpOpendir     = 27
-	OpReaddir     = 28
-	OpReleasedir  = 29
-	OpFsyncdir    = 30
-	OpGetlk       = 31
-	OpSetlk       = 32
-	OpSetlkw      = 33
-	OpAccess      = 34
-	OpCreate      = 35
-	OpInterrupt   = 36
-	OpBmap        = 37
-	OpDestroy     = 38
-	OpIoctl       = 39 // Linux?
-	OpPoll        = 40 // Linux?
-	OpFallocate   = 43
+	OpLookup        = 1
+	OpForget        = 2 // no reply
+	OpGetattr       = 3
+	OpSetattr       = 4
+	OpReadlink      = 5
+	OpSymlink       = 6
+	OpMknod         = 8
+	OpMkdir         = 9
+	OpUnlink        = 10
+	OpRmdir         = 11
+	OpRename        = 12
+	OpLink          = 13
+	OpOpen          = 14
+	OpRead          = 15
+	OpWrite         = 16
+	OpStatfs        = 17
+	OpRelease       = 18
+	OpFsync         = 20
+	OpSetxattr      = 21
+	OpGetxattr      = 22
+	OpListxattr     = 23
+	OpRemovexattr   = 24
+	OpFlush         = 25
+	OpInit          = 26
+	OpOpendir       = 27
+	OpReaddir       = 28
+	OpReleasedir    = 29
+	OpFsyncdir      = 30
+	OpGetlk         = 31
+	OpSetlk         = 32
+	OpSetlkw        = 33
+	OpAccess        = 34
+	OpCreate        = 35
+	OpInterrupt     = 36
+	OpBmap          = 37
+	OpDestroy       = 38
+	OpIoctl         = 39 // Linux?
+	OpPoll          = 40 // Linux?
+	OpBatchForget   = 42 // no reply
+	OpFallocate     = 43
+	OpReaddirplus   = 44
+	OpRename2       = 45
+	OpLseek         = 46
+	OpCopyFileRange = 47
 
 	// OS X
 	OpSetvolname = 61
@@ -415,6 +459,16 @@ type ForgetIn struct {
 	Nlookup uint64
 }
 
+type BatchForgetIn struct {
+	Count uint32
+	Dummy uint32
+}
+
+type ForgetOne struct {
+	Nodeid  uint64
+	Nlookup uint64
+}
+
 type GetattrIn struct {
 	GetattrFlags uint32
 	dummy        uint32
@@ -482,6 +536,13 @@ type RenameIn struct {
 	// "oldname\x00newname\x00" follows
 }
 
+type Rename2In struct {
+	Newdir  uint64
+	Flags   uint32
+	Padding uint32
+	// "oldname\x00newname\x00" follows
+}
+
 // OS X
 type ExchangeIn struct {
 	Olddir  uint64
@@ -543,7 +604,7 @@ type ReleaseIn struct {
 	Fh           uint64
 	Flags        uint32
 	ReleaseFlags uint32
-	LockOwner    uint32
+	LockOwner    uint64
 }
 
 type FlushIn struct {
@@ -642,6 +703,13 @@ type FsyncIn struct {
 	Padding    uint32
 }
 
+// Flags for FsyncIn.FsyncFlags.
+const (
+	// Only the data, and the metadata needed to read it back, are to be
+	// synced, as for fdatasync(2).
+	FsyncFdatasync = 1 << 0
+)
+
 type setxattrInCommon struct {
 	Size  uint32
 	Flags uint32
@@ -678,11 +746,32 @@ type FallocateIn struct {
 	Padding uint32
 }
 
+type LseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+type LseekOut struct {
+	Offset uint64
+}
+
+type CopyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeidOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
 type LkIn struct {
 	Fh      uint64
 	Owner   uint64
 	Lk      fileLock
-	LkFlags uint32
+	LkFlags LkFlags
 	padding uint32
 }
 
@@ -699,6 +788,89 @@ type LkOut struct {
 	Lk fileLock
 }
 
+// The IoctlFlags are used in the Ioctl exchange.
+type IoctlFlags uint32
+
+const (
+	// The caller is a 32-bit process on a 64-bit kernel.
+	IoctlCompat IoctlFlags = 1 << 0
+
+	// The file system may ask for more data than the command's size says; only
+	// for CUSE.
+	IoctlUnrestricted IoctlFlags = 1 << 1
+
+	// In replies, unrestricted mode only: retry with the iovecs that follow.
+	IoctlRetry IoctlFlags = 1 << 2
+
+	// The caller is a 32-bit process.
+	Ioctl32Bit IoctlFlags = 1 << 3
+
+	// The ioctl is on a directory (protocol 7.18 and later).
+	IoctlDir IoctlFlags = 1 << 4
+
+	// The caller is an x32 process.
+	IoctlCompatX32 IoctlFlags = 1 << 5
+)
+
+func (fl IoctlFlags) String() string {
+	return flagString(uint32(fl), ioctlFlagNames)
+}
+
+var ioctlFlagNames = []flagName{
+	{uint32(IoctlCompat), "IoctlCompat"},
+	{uint32(IoctlUnrestricted), "IoctlUnrestricted"},
+	{uint32(IoctlRetry), "IoctlRetry"},
+	{uint32(Ioctl32Bit), "Ioctl32Bit"},
+	{uint32(IoctlDir), "IoctlDir"},
+	{uint32(IoctlCompatX32), "IoctlCompatX32"},
+}
+
+type IoctlIn struct {
+	Fh      uint64
+	Flags   IoctlFlags
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32
+}
+
+type IoctlOut struct {
+	Result  int32
+	Flags   IoctlFlags
+	InIovs  uint32
+	OutIovs uint32
+}
+
+// The PollFlags are used in the Poll exchange.
+type PollFlags uint32
+
+const (
+	// The kernel wants a wakeup notification if the file isn't ready.
+	PollScheduleNotify PollFlags = 1 << 0
+)
+
+func (fl PollFlags) String() string {
+	return flagString(uint32(fl), pollFlagNames)
+}
+
+var pollFlagNames = []flagName{
+	{uint32(PollScheduleNotify), "PollScheduleNotify"},
+}
+
+type PollIn struct {
+	Fh    uint64
+	Kh    uint64
+	Flags PollFlags
+
+	// Protocol 7.21 and later; zero before.
+	Events uint32
+}
+
+type PollOut struct {
+	Revents uint32
+	padding uint32
+}
+
 type AccessIn struct {
 	Mask    uint32
 	Padding uint32
@@ -765,12 +937,26 @@ type Dirent struct {
 
 const DirentSize = 8 + 8 + 4 + 4
 
+// An entry in a reply to OpReaddirplus: an entry as for OpLookup, which is
+// all zeroes if the file system supplied no attributes, followed by the
+// dirent and its name.
+type DirentPlus struct {
+	Entry  EntryOut
+	Dirent Dirent
+}
+
+const DirentPlusSize = unsafe.Sizeof(EntryOut{}) + DirentSize
+
 const (
 	NotifyCodePoll       int32 = 1
 	NotifyCodeInvalInode int32 = 2
 	NotifyCodeInvalEntry int32 = 3
 )
 
+type NotifyPollWakeupOut struct {
+	Kh uint64
+}
+
 type NotifyInvalInodeOut struct {
 	Ino uint64
 	Off int64
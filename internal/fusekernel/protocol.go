@@ -58,6 +58,16 @@ func (a Protocol) HasOpenNonSeekable() bool {
 	return a.is710()
 }
 
+func (a Protocol) is711() bool {
+	return a.GE(Protocol{7, 11})
+}
+
+// HasPoll returns whether PollRequest and the poll wakeup notification are
+// supported.
+func (a Protocol) HasPoll() bool {
+	return a.is711()
+}
+
 func (a Protocol) is712() bool {
 	return a.GE(Protocol{7, 12})
 }
@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system whose getattrs wait to be interrupted, then return result,
+// or ctx.Err() if it is nil. They succeed instead if release is closed, or if
+// no interrupt comes for a while.
+type interruptedFS struct {
+	fuseutil.NotImplementedFileSystem
+	result  error
+	release chan struct{}
+
+	// Receives an element when a getattr starts waiting, if non-nil.
+	started chan struct{}
+}
+
+func (fs *interruptedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if fs.started != nil {
+		fs.started <- struct{}{}
+	}
+
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0755 | os.ModeDir,
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-fs.release:
+		return nil
+	case <-time.After(10 * time.Second):
+		return nil
+	}
+
+	if fs.result == nil {
+		return ctx.Err()
+	}
+
+	return fs.result
+}
+
+var getattrIn [unsafe.Sizeof(fusekernel.GetattrIn{})]byte
+
+func TestInterrupt(t *testing.T) {
+	testCases := []struct {
+		name   string
+		result error
+		want   error
+	}{
+		{"ctx.Err", nil, syscall.EINTR},
+		{"OtherError", errors.New("taco"), syscall.EINTR},
+		{"Errno", syscall.ENOENT, syscall.ENOENT},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fs := &interruptedFS{
+				result:  tc.result,
+				release: make(chan struct{}),
+				started: make(chan struct{}, 1),
+			}
+
+			k, err := fusetesting.NewFakeKernel(fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{})
+			if err != nil {
+				t.Fatalf("NewFakeKernel: %v", err)
+			}
+
+			defer k.Close()
+
+			// Interrupt the getattr once it reaches the file system.
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-fs.started
+				cancel()
+			}()
+
+			_, err = k.CallContext(ctx, fusekernel.OpGetattr, uint64(fuseops.RootInodeID), getattrIn[:])
+			if err != tc.want {
+				t.Errorf("Got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestInterrupt_BeforeRequest(t *testing.T) {
+	fs := &interruptedFS{release: make(chan struct{})}
+	k, err := fusetesting.NewFakeKernel(fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{})
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	// The interrupt is remembered until the getattr arrives, whose context is
+	// then cancelled straight away.
+	_, err = k.CallInterrupted(fusekernel.OpGetattr, uint64(fuseops.RootInodeID), getattrIn[:])
+	if err != syscall.EINTR {
+		t.Errorf("Got %v, want EINTR", err)
+	}
+
+	// It isn't applied to anything else.
+	close(fs.release)
+	if _, err := k.GetAttr(fuseops.RootInodeID); err != nil {
+		t.Errorf("GetAttr: %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fuse_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const (
+	// _IOWR('t', 1, [8]byte): reverses its eight bytes.
+	ioctlReverse = 3<<30 | 8<<16 | 't'<<8 | 1
+
+	// _IO('t', 2), which the file system doesn't know.
+	ioctlUnknown = 't'<<8 | 2
+
+	fsIocGetflags = 0x80086601 // FS_IOC_GETFLAGS
+	fsNoatimeFl   = 0x80       // FS_NOATIME_FL
+)
+
+// A file system containing a single file, "foo", that answers ioctlReverse
+// and FS_IOC_GETFLAGS.
+type ioctlFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+const ioctlFileInode = fuseops.RootInodeID + 1
+
+func (fs *ioctlFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = ioctlFileInode
+	op.Entry.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0444}
+	return nil
+}
+
+func (fs *ioctlFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0777 | os.ModeDir}
+	if op.Inode == ioctlFileInode {
+		op.Attributes.Mode = 0444
+	}
+
+	return nil
+}
+
+func (fs *ioctlFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *ioctlFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	switch op.Cmd {
+	case ioctlReverse:
+		for i, b := range op.Input {
+			op.Dst[len(op.Input)-1-i] = b
+		}
+
+		op.BytesRead = len(op.Input)
+		op.Result = 17
+		return nil
+
+	case fsIocGetflags:
+		binary.LittleEndian.PutUint32(op.Dst, fsNoatimeFl)
+		op.BytesRead = 4
+		return nil
+	}
+
+	return fs.NotImplementedFileSystem.Ioctl(ctx, op)
+}
+
+func ioctl(fd int, cmd uintptr, arg unsafe.Pointer) (int, error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), cmd, uintptr(arg))
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(r), nil
+}
+
+func TestIoctl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ioctl_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(&ioctlFS{}), &fuse.MountConfig{FSName: "ioctlfs"})
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	name := path.Join(dir, "foo")
+	fd, err := syscall.Open(name, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	// The command's input reaches the file system, and its output and result
+	// come back.
+	buf := []byte("abcdefgh")
+	r, err := ioctl(fd, ioctlReverse, unsafe.Pointer(&buf[0]))
+	if err != nil {
+		t.Fatalf("ioctl: %v", err)
+	}
+
+	if r != 17 || string(buf) != "hgfedcba" {
+		t.Errorf("ioctl returned %d and %q", r, buf)
+	}
+
+	// Unknown commands fail as they would on any other file.
+	if _, err := ioctl(fd, ioctlUnknown, nil); err != syscall.ENOTTY {
+		t.Errorf("Unknown ioctl returned %v, want ENOTTY", err)
+	}
+
+	// lsattr gets at the flags.
+	var flags int32
+	if _, err := ioctl(fd, fsIocGetflags, unsafe.Pointer(&flags)); err != nil {
+		t.Fatalf("FS_IOC_GETFLAGS: %v", err)
+	}
+
+	if flags != fsNoatimeFl {
+		t.Errorf("FS_IOC_GETFLAGS returned %#x", flags)
+	}
+
+	lsattr, err := exec.LookPath("lsattr")
+	if err != nil {
+		return
+	}
+
+	out, err := exec.Command(lsattr, name).CombinedOutput()
+	if err != nil {
+		t.Fatalf("lsattr: %v\n%s", err, out)
+	}
+
+	if attrs := strings.Fields(string(out))[0]; !strings.Contains(attrs, "A") {
+		t.Errorf("lsattr reported %q, want no-atime", attrs)
+	}
+}
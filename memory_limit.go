@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// The memory held by each op between ReadOp and Reply: the message it was
+// read from, which has room for the largest write, and the message for its
+// reply, which has room for the largest read.
+const memoryPerOp = int64(unsafe.Sizeof(buffer.InMessage{}) +
+	unsafe.Sizeof(buffer.OutMessage{}))
+
+// Return whether ReadOp may hand out op while the connection is over its
+// memory limit. Forgets must keep flowing, since the kernel sends them to
+// reclaim memory of its own; they are small, and file systems handle them
+// quickly.
+func passesMemoryLimit(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+		return true
+	}
+
+	return false
+}
+
+// An op read from the kernel while in-flight ops held too much memory, which
+// ReadOp hands out once they release some.
+type parkedOp struct {
+	inMsg  *buffer.InMessage
+	outMsg *buffer.OutMessage
+	op     interface{}
+}
+
+// The result of a read from the kernel made in the background.
+type readResult struct {
+	inMsg *buffer.InMessage
+	err   error
+}
+
+// Return whether ReadOp may hand out ops that are subject to the limit set by
+// MountConfig.MaxInFlightBytes, because the memory held by in-flight ops is
+// under it, there is no limit, or the limit is moot: ops in degraded mode are
+// failed straight away, and once detached the ops already read must be
+// finished before the connection is handed over.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) memoryAvailable() bool {
+	limit := c.cfg.MaxInFlightBytes
+	if limit <= 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.inFlightBytes < limit || c.degradedErr != 0 || c.detached
+}
+
+// Tell ReadOp that memoryAvailable may have changed, if it's waiting for that.
+func (c *Connection) wakeParked() {
+	select {
+	case c.memoryWake <- struct{}{}:
+	default:
+	}
+}
+
+// Read the next message from the kernel. While ops are parked, also wait for
+// memory to become available, returning a nil message if it does first. The
+// read then carries on in the background, and a later call picks up its
+// result.
+//
+// Called only by ReadOp.
+func (c *Connection) readOrWake() (*buffer.InMessage, error) {
+	if len(c.parked) == 0 && c.pendingRead == nil {
+		return c.readMessage()
+	}
+
+	if c.pendingRead == nil {
+		result := make(chan readResult, 1)
+		go func() {
+			m, err := c.readMessage()
+			result <- readResult{m, err}
+		}()
+
+		c.pendingRead = result
+	}
+
+	var wake <-chan struct{}
+	if len(c.parked) > 0 {
+		wake = c.memoryWake
+	}
+
+	select {
+	case r := <-c.pendingRead:
+		c.pendingRead = nil
+		return r.inMsg, r.err
+
+	case <-wake:
+		return nil, nil
+	}
+}
+
+// Return the messages of any parked ops to the freelists, once the kernel
+// has hung up and nothing more can be replied to.
+//
+// Called only by ReadOp.
+func (c *Connection) dropParked() {
+	for _, p := range c.parked {
+		c.putInMessage(p.inMsg)
+		c.putOutMessage(p.outMsg)
+	}
+
+	c.parked = nil
+}
+
+// Account for the memory held by an op that is about to be handed out.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) holdMemory() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inFlightBytes += memoryPerOp
+}
+
+// Account for an op that has been replied to.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) releaseMemory() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.inFlightBytes -= memoryPerOp
+	c.memoryReleased.Broadcast()
+	c.wakeParked()
+}
+
+// InFlightBytes returns the memory currently held by ops that have been read
+// from the kernel but not yet replied to. See MountConfig.MaxInFlightBytes.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) InFlightBytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.inFlightBytes
+}
+
+// InFlightBytes returns the memory currently held by ops that the file system
+// has not yet replied to. See MountConfig.MaxInFlightBytes.
+func (mfs *MountedFileSystem) InFlightBytes() int64 {
+	return mfs.conn.InFlightBytes()
+}
@@ -0,0 +1,344 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Serves a file named bar plus any number named f0, f1, and so on. Writes
+// block until released or interrupted. (The kernel serializes direct writes
+// to each inode, so a flood needs many files.)
+type floodFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// Closed to let writes finish.
+	release chan struct{}
+
+	mu sync.Mutex
+
+	// The number of writes in progress, and the most there have been at once.
+	//
+	// GUARDED_BY(mu)
+	writes    int
+	peakWrite int
+
+	// The number of writes that returned because they were interrupted.
+	//
+	// GUARDED_BY(mu)
+	interrupted int
+
+	// The number of forget ops received.
+	//
+	// GUARDED_BY(mu)
+	forgets int
+}
+
+func (fs *floodFS) attributes(ino fuseops.InodeID) fuseops.InodeAttributes {
+	attrs := fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0666,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+	}
+
+	if ino == fuseops.RootInodeID {
+		attrs.Mode = 0755 | os.ModeDir
+	}
+
+	return attrs
+}
+
+func (fs *floodFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	var n int
+	switch {
+	case op.Name == "bar":
+		op.Entry.Child = fuseops.RootInodeID + 1
+
+	case strings.HasPrefix(op.Name, "f"):
+		if _, err := fmt.Sscanf(op.Name, "f%d", &n); err != nil {
+			return fuse.ENOENT
+		}
+
+		op.Entry.Child = fuseops.RootInodeID + 2 + fuseops.InodeID(n)
+
+	default:
+		return fuse.ENOENT
+	}
+
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	op.Entry.AttributesExpiration = time.Now().Add(time.Hour)
+	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	return nil
+}
+
+func (fs *floodFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	op.AttributesExpiration = time.Now().Add(time.Hour)
+	return nil
+}
+
+func (fs *floodFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *floodFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forgets++
+	return nil
+}
+
+func (fs *floodFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	// Make each write(2) reach us as it happens.
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fs *floodFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	fs.writes++
+	if fs.writes > fs.peakWrite {
+		fs.peakWrite = fs.writes
+	}
+	fs.mu.Unlock()
+
+	var err error
+	select {
+	case <-fs.release:
+	case <-ctx.Done():
+		err = syscall.EINTR
+	}
+
+	fs.mu.Lock()
+	fs.writes--
+	if err != nil {
+		fs.interrupted++
+	}
+	fs.mu.Unlock()
+
+	return err
+}
+
+func (fs *floodFS) state() (writes, peakWrite, interrupted, forgets int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.writes, fs.peakWrite, fs.interrupted, fs.forgets
+}
+
+func TestMaxInFlightBytes(t *testing.T) {
+	const (
+		maxOps  = 4
+		writers = 32
+	)
+
+	dir, err := ioutil.TempDir("", "memory_limit_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	fs := &floodFS{release: make(chan struct{})}
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:           "memory_limit_test",
+		MaxInFlightBytes: maxOps * fuse.MemoryPerOp,
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	released := false
+	defer func() {
+		if !released {
+			close(fs.release)
+		}
+
+		wg.Wait()
+
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		mfs.Join(context.Background())
+	}()
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path.Join(dir, "bar"), &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	// Start one write in a subprocess that we can interrupt, and then enough
+	// writes of our own to reach the limit.
+	dd := exec.Command(
+		"dd",
+		"if=/dev/zero",
+		"of="+path.Join(dir, "f0"),
+		"bs=131072",
+		"count=1",
+		"conv=notrunc")
+
+	if err := dd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	ddDone := make(chan error, 1)
+	go func() { ddDone <- dd.Wait() }()
+
+	waitFor(t, "dd's write", func() bool {
+		writes, _, _, _ := fs.state()
+		return writes == 1
+	})
+
+	writeErrs := make(chan error, writers)
+	write := func(i int) {
+		defer wg.Done()
+
+		p := path.Join(dir, fmt.Sprintf("f%d", i))
+		fd, err := syscall.Open(p, syscall.O_WRONLY, 0)
+		if err != nil {
+			writeErrs <- err
+			return
+		}
+
+		defer syscall.Close(fd)
+
+		// dd's exit signals this process, which can interrupt a write blocked
+		// in the kernel. Retry as the os package would.
+		buf := make([]byte, 1<<17)
+		for {
+			_, err = syscall.Pwrite(fd, buf, 0)
+			if err != syscall.EINTR {
+				break
+			}
+		}
+
+		if err != nil {
+			writeErrs <- err
+		}
+	}
+
+	for i := 1; i < maxOps; i++ {
+		wg.Add(1)
+		go write(i)
+	}
+
+	waitFor(t, "writes to reach the limit", func() bool {
+		writes, _, _, _ := fs.state()
+		return writes == maxOps
+	})
+
+	// One more write is held back rather than passed to the file system.
+	wg.Add(1)
+	go write(maxOps)
+
+	time.Sleep(100 * time.Millisecond)
+	if writes, _, _, _ := fs.state(); writes != maxOps {
+		t.Fatalf("%d writes in progress, want %d", writes, maxOps)
+	}
+
+	// While it waits, forgets and interrupts still get through.
+	if err := ioutil.WriteFile("/proc/sys/vm/drop_caches", []byte("2"), 0); err != nil {
+		t.Logf("Not checking forgets: %v", err)
+	} else {
+		waitFor(t, "a forget", func() bool {
+			_, _, _, forgets := fs.state()
+			return forgets > 0
+		})
+	}
+
+	if err := dd.Process.Signal(os.Interrupt); err != nil {
+		t.Fatalf("Signal: %v", err)
+	}
+
+	<-ddDone
+	waitFor(t, "dd's write to be interrupted", func() bool {
+		_, _, interrupted, _ := fs.state()
+		return interrupted >= 1
+	})
+
+	// That made room for the write that was held back.
+	waitFor(t, "the held write", func() bool {
+		writes, _, _, _ := fs.state()
+		return writes == maxOps
+	})
+
+	// Flood the file system with writes. No more than the limit should reach
+	// it, however long we wait.
+	for i := maxOps + 1; i < writers; i++ {
+		wg.Add(1)
+		go write(i)
+	}
+
+	waitFor(t, "writes to reach the limit again", func() bool {
+		writes, _, _, _ := fs.state()
+		return writes == maxOps
+	})
+
+	time.Sleep(100 * time.Millisecond)
+
+	if _, peak, _, _ := fs.state(); peak > maxOps {
+		t.Errorf("%d writes in progress at once, want at most %d", peak, maxOps)
+	}
+
+	if n := mfs.InFlightBytes(); n > maxOps*fuse.MemoryPerOp {
+		t.Errorf("InFlightBytes: %d, want at most %d", n, maxOps*fuse.MemoryPerOp)
+	}
+
+	// Let everything finish. The memory should all be released.
+	close(fs.release)
+	released = true
+	wg.Wait()
+
+	close(writeErrs)
+	for err := range writeErrs {
+		t.Errorf("Write: %v", err)
+	}
+
+	waitFor(t, "memory to be released", func() bool {
+		return mfs.InFlightBytes() == 0
+	})
+}
@@ -16,6 +16,7 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -27,8 +28,11 @@ import (
 // connection.
 type Server interface {
 	// Read and serve ops from the supplied connection until EOF. Do not return
-	// until all operations have been responded to. Must not be called more than
-	// once.
+	// until all operations have been responded to. Unless the implementation
+	// documents that it may be served on several connections, must not be
+	// called more than once. Each op must be passed to
+	// Connection.WaitForThaw and Connection.WaitForCapacity before it is
+	// carried out.
 	ServeOps(*Connection)
 }
 
@@ -39,6 +43,15 @@ func Mount(
 	dir string,
 	server Server,
 	config *MountConfig) (*MountedFileSystem, error) {
+	if config.Resume != nil {
+		return nil, errors.New("MountConfig.Resume is for use with Serve")
+	}
+
+	caps, err := describeServer(server)
+	if err != nil {
+		return nil, fmt.Errorf("Capabilities: %v", err)
+	}
+
 	// Sanity check: make sure the mount point exists and is a directory. This
 	// saves us from some confusing errors later on OS X.
 	fi, err := os.Stat(dir)
@@ -53,12 +66,6 @@ func Mount(
 		return nil, fmt.Errorf("Mount point %s is not a directory", dir)
 	}
 
-	// Initialize the struct.
-	mfs := &MountedFileSystem{
-		dir:                 dir,
-		joinStatusAvailable: make(chan struct{}),
-	}
-
 	// Begin the mounting process, which will continue in the background.
 	ready := make(chan error, 1)
 	dev, err := mount(dir, config, ready)
@@ -66,6 +73,52 @@ func Mount(
 		return nil, fmt.Errorf("mount: %v", err)
 	}
 
+	mfs, err := serve(dir, dev, server, caps, config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wait for the mount process to complete.
+	if err := <-ready; err != nil {
+		return nil, fmt.Errorf("mount (background): %v", err)
+	}
+
+	return mfs, nil
+}
+
+// Serve is like Mount, but serves ops read from dev, which must already be
+// connected to the kernel (or to something playing its part, such as
+// fusetesting.FakeKernel). It blocks until the kernel's init request has been
+// handled, unless config.Resume is set, in which case dev must be a connection
+// handed over by another process and no init request is expected. The Dir
+// method of the result returns the empty string.
+//
+// Join on the result returns once the other end hangs up. Serve does not
+// close dev until then.
+func Serve(
+	dev *os.File,
+	server Server,
+	config *MountConfig) (*MountedFileSystem, error) {
+	caps, err := describeServer(server)
+	if err != nil {
+		return nil, fmt.Errorf("Capabilities: %v", err)
+	}
+
+	return serve("", dev, server, caps, config)
+}
+
+func serve(
+	dir string,
+	dev *os.File,
+	server Server,
+	caps *declaredCapabilities,
+	config *MountConfig) (*MountedFileSystem, error) {
+	// Initialize the struct.
+	mfs := &MountedFileSystem{
+		dir:                 dir,
+		joinStatusAvailable: make(chan struct{}),
+	}
+
 	// Choose a parent context for ops.
 	cfgCopy := *config
 	if cfgCopy.OpContext == nil {
@@ -73,15 +126,21 @@ func Mount(
 	}
 
 	// Create a Connection object wrapping the device.
+	negotiator, _ := server.(InitNegotiator)
 	connection, err := newConnection(
 		cfgCopy,
+		dir,
 		config.DebugLogger,
 		config.ErrorLogger,
-		dev)
+		dev,
+		negotiator)
 	if err != nil {
 		return nil, fmt.Errorf("newConnection: %v", err)
 	}
 
+	connection.capabilities = caps
+	mfs.conn = connection
+
 	// Serve the connection in the background. When done, set the join status.
 	go func() {
 		server.ServeOps(connection)
@@ -89,11 +148,6 @@ func Mount(
 		close(mfs.joinStatusAvailable)
 	}()
 
-	// Wait for the mount process to complete.
-	if err := <-ready; err != nil {
-		return nil, fmt.Errorf("mount (background): %v", err)
-	}
-
 	return mfs, nil
 }
 
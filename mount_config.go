@@ -19,10 +19,16 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
 )
 
-// Optional configuration accepted by Mount.
+// Optional configuration accepted by Mount. Fields documented as specific to
+// one platform are ignored on the others.
 type MountConfig struct {
 	// The context from which every op read from the connetion by the sever
 	// should inherit. If nil, context.Background() will be used.
@@ -38,15 +44,152 @@ type MountConfig struct {
 	// chtimes, etc. will fail.
 	ReadOnly bool
 
+	// Let users other than the one who mounted the file system access it. On
+	// Linux, unprivileged users can do this only if /etc/fuse.conf contains
+	// user_allow_other, and Mount fails with an error saying so if it doesn't.
+	AllowOther bool
+
+	// When file systems should update access times as files are read. This is
+	// passed to the kernel as the relatime, strictatime or noatime mount
+	// option, and to the file system as MountInfo.Atime; see AtimePolicy for
+	// what it does and doesn't affect. The default is AtimeRelative.
+	Atime AtimePolicy
+
+	// If non-zero, the longest name, in bytes, that a directory entry may have.
+	// Ops that name longer entries (lookups, creations, renames and removals)
+	// are failed with ENAMETOOLONG without being passed to the file system, and
+	// the limit is reported by statfs(2) unless the file system's StatFS
+	// reports its own (see StatFSOp.MaxNameLength).
+	//
+	// Without this, names of up to 1024 bytes, the kernel's own limit, reach
+	// the file system, which must then fail those it can't store itself
+	// rather than e.g. truncating them.
+	MaxNameLength uint32
+
 	// A logger to use for logging errors. All errors are logged, with the
 	// exception of a few blacklisted errors that are expected. If nil, no error
 	// logging is performed.
+	//
+	// Messages about an op begin with "Op 0x...", identifying it by the kernel's
+	// ID for the request (see RequestIDFromContext).
 	ErrorLogger *log.Logger
 
 	// A logger to use for logging debug information. If nil, no debug logging is
-	// performed.
+	// performed. As for ErrorLogger, ops are identified by the kernel's ID for
+	// the request.
+	//
+	// Each op gets a line when it is read, such as
+	//
+	//     Op 0x00000006        connection.go:787] <- LookUpInode (parent 1, name "foo")
+	//
+	// and another when it is replied to, giving what the kernel is told and
+	// the time since the op was handed out:
+	//
+	//     Op 0x00000006       connection.go:1100] -> OK (inode 2) in 12.238µs
+	//     Op 0x00000012       connection.go:1102] -> Error: "no such file or directory" (errno 2) in 13.299µs
+	//
+	// Nothing is redacted, names included.
 	DebugLogger *log.Logger
 
+	// If non-nil, enable strict mode, checking each response the file system
+	// gives before it is sent to the kernel. See StrictConfig for the checks
+	// and what happens when one fails. The checks cost a little, so this is
+	// intended mainly for tests.
+	Strict *StrictConfig
+
+	// If non-nil, record every message read from or written to the kernel, for
+	// offline analysis. See CaptureConfig.
+	Capture *CaptureConfig
+
+	// The clock used to turn the absolute expiration times in responses (e.g.
+	// ChildInodeEntry.EntryExpiration) into the relative ones the kernel
+	// wants, and by strict mode to judge whether they have passed. File systems
+	// that run against a simulated clock should pass it here, so that their
+	// expiration times agree with the connection's idea of now. If nil,
+	// timeutil.RealClock() is used.
+	Clock timeutil.Clock
+
+	// If positive, a cap on the memory held by ops that have been read from the
+	// kernel but not yet replied to, e.g. the data of writes. Each op holds a
+	// fixed amount, enough for the largest write and the largest read reply.
+	// When the cap is reached, the connection stops passing new ops to the file
+	// system until some are replied to, so that the kernel applies
+	// backpressure to the processes making the requests, whose requests go
+	// unanswered meanwhile.
+	//
+	// Reading from the kernel carries on while paused, so that forgets and
+	// interrupts still get through: an op in flight may be interrupted, and
+	// wait for that, without holding everything up. The other requests read
+	// are held, in order, until they can be passed on. Their messages are not
+	// counted against the cap; the kernel's own limits on outstanding
+	// requests bound them.
+	//
+	// The current usage is reported by MountedFileSystem.InFlightBytes.
+	MaxInFlightBytes int64
+
+	// If set, the number of ops passed to the file system at once is limited,
+	// and the limit adjusted as the file system's latency changes. See
+	// ConcurrencyLimitConfig.
+	ConcurrencyLimit *ConcurrencyLimitConfig
+
+	// If positive, the minimum time between the notifications written for
+	// MountedFileSystem.QueueInvalidateInode and QueueInvalidateEntry, so that
+	// bulk out-of-band changes don't flood the kernel. Duplicate notifications
+	// queued in the meantime are coalesced. The synchronous notification
+	// methods are unaffected.
+	MinNotificationInterval time.Duration
+
+	// How long MountedFileSystem.Freeze may leave the file system frozen before
+	// it is thawed automatically, in case the caller never calls Thaw. If
+	// zero, five minutes.
+	MaxFreezeDuration time.Duration
+
+	// If positive, how long a mutating op arriving while the file system is
+	// frozen waits to be thawed before failing with EBUSY. If zero, it waits
+	// until the file system is thawed, automatically if need be.
+	FrozenOpTimeout time.Duration
+
+	// Cancel the contexts of the ops still in flight when the kernel hangs up,
+	// e.g. because the file system was unmounted or the connection aborted, so
+	// that their handlers can give up early. Otherwise they run to
+	// completion. Either way their replies are discarded, and Join waits for
+	// them. See teardown.go.
+	CancelOnUnmount bool
+
+	// If set, the device passed to Serve is a connection that another process
+	// initialized and then handed over with MountedFileSystem.Detach, with
+	// which it agreed the given state. The kernel doesn't send its init
+	// request again, so none is waited for. Not for use with Mount.
+	Resume *ConnectionState
+
+	// If positive, the number of attribute values sent to the kernel to
+	// remember for each inode, with when and by which op they were sent, for
+	// debugging stale attributes. See MountedFileSystem.AttributeHistory.
+	// Attributes carried by ReadDirOp replies aren't recorded.
+	//
+	// The histories of at most AttributeHistoryInodes inodes are kept, those
+	// least recently sent attributes being forgotten first. If zero, 1024.
+	AttributeHistory       int
+	AttributeHistoryInodes int
+
+	// Ask the file system's permission, with an AccessOp carrying the caller's
+	// credentials, before every open for writing and every change of
+	// attributes, on top of the kernel's own permission checks.
+	//
+	// The kernel checks permissions against the modes and owners the file
+	// system reports (see InodeAttributes.Mode), and like any local file
+	// system lets root through regardless. That is wrong for e.g. a network
+	// file system on which local root has no special powers. Linux has no
+	// mount option to stop root bypassing the checks short of giving them up
+	// altogether, so this instead gives the file system a chance to refuse
+	// the ops that matter most. Servers made by fuseutil.NewFileSystemServer
+	// call the file system's Access method (see Connection.AccessCheck), and
+	// fail the op with whatever error it returns, ENOSYS included.
+	//
+	// The file system can't see opens the kernel doesn't send, so this should
+	// not be combined with EnableNoOpenSupport.
+	CheckWriteAccess bool
+
 	// Linux only. OS X always behaves as if writeback caching is disabled.
 	//
 	// By default on Linux we allow the kernel to perform writeback caching
@@ -151,12 +294,68 @@ type MountConfig struct {
 	// OpenDir calls at all (Linux >= 5.1):
 	EnableNoOpendirSupport bool
 
+	// Linux only.
+	//
+	// Ask the kernel to read directories with READDIRPLUS (Linux >= 3.9), whose
+	// entries may carry each child's attributes, as for LookUpInodeOp, so that
+	// listing a directory populates the kernel's caches and e.g. ls -l needn't
+	// look each child up. ReadDirOp.Plus is set for such reads, which must be
+	// answered in a different format; see the notes there. Has no effect if the
+	// kernel doesn't offer it.
+	EnableReadDirPlus bool
+
+	// Linux only.
+	//
+	// Pass fcntl(2) record locks to the file system as fuseops.GetLockOp and
+	// fuseops.SetLockOp, so that it can enforce them across machines, rather
+	// than having the kernel keep them for this mount alone. The file system
+	// must then implement both, and drop each owner's locks in FlushFileOp;
+	// see fuseutil.FileLocks. Requests that wait for a lock bypass
+	// ConcurrencyLimit, lest they hold every slot while the unlock they wait
+	// for queues behind them, but do count towards MaxInFlightBytes. Has no
+	// effect if the kernel doesn't offer it. flock(2) locks are still kept by
+	// the kernel, unless EnableFlockLocks is set.
+	EnablePOSIXLocks bool
+
+	// Linux only.
+	//
+	// Like EnablePOSIXLocks, but for flock(2) locks, which arrive as
+	// fuseops.SetLockOp with Flock set. The file system must drop them in
+	// ReleaseFileHandleOp rather than FlushFileOp; fuseutil.FileLocks keeps
+	// both kinds. Has no effect if the kernel doesn't offer it.
+	EnableFlockLocks bool
+
+	// Linux only.
+	//
+	// The renameat2(2) flags that the file system implements, such as
+	// fuseops.RenameNoReplace. Renames with any others are failed with EINVAL
+	// without being passed to it, rather than having it ignore them and e.g.
+	// replace a name it was asked to keep. Kernels older than Linux 4.0
+	// (protocol 7.23), which don't pass the flags on, fail such renames
+	// themselves.
+	RenameFlags fuseops.RenameFlags
+
 	// OS X only.
 	//
 	// The name of the mounted volume, as displayed in the Finder. If empty, a
-	// default name involving the string 'osxfuse' is used.
+	// default name involving the string 'osxfuse' (or 'macFUSE') is used.
 	VolumeName string
 
+	// OS X only.
+	//
+	// Mark the volume as local rather than networked, so that the Finder lists
+	// it in its sidebar among the Mac's own disks rather than under network
+	// locations (cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options#local).
+	Local bool
+
+	// OS X only.
+	//
+	// Normally on OS X we mount with the noappledouble option, which stops the
+	// Finder and friends from littering the file system with "Apple Double"
+	// files (._foo and .DS_Store). These add noise to debug output and can have
+	// significant cost on network-based file systems. This field allows them.
+	EnableAppleDouble bool
+
 	// Additional key=value options to pass unadulterated to the underlying mount
 	// command. See `man 8 mount`, the fuse documentation, etc. for
 	// system-specific information.
@@ -210,6 +409,21 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 		opts["ro"] = ""
 	}
 
+	// Visible to other users?
+	if c.AllowOther {
+		opts["allow_other"] = ""
+	}
+
+	// Access time policy. relatime is the kernel's default, so needs no
+	// option.
+	switch c.Atime {
+	case AtimeStrict:
+		opts["strictatime"] = ""
+
+	case AtimeNone:
+		opts["noatime"] = ""
+	}
+
 	// Handle OS X options.
 	if isDarwin {
 		if !c.EnableVnodeCaching {
@@ -220,15 +434,17 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 			// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options#volname
 			opts["volname"] = c.VolumeName
 		}
-	}
 
-	// OS X: disable the use of "Apple Double" (._foo and .DS_Store) files, which
-	// just add noise to debug output and can have significant cost on
-	// network-based file systems.
-	//
-	// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options
-	if isDarwin {
-		opts["noappledouble"] = ""
+		if c.Local {
+			opts["local"] = ""
+		}
+
+		// Disable the use of "Apple Double" files unless asked not to.
+		//
+		// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options
+		if !c.EnableAppleDouble {
+			opts["noappledouble"] = ""
+		}
 	}
 
 	// Last but not least: other user-supplied options.
@@ -259,6 +475,9 @@ func mapToOptionsString(opts map[string]string) string {
 		components = append(components, component)
 	}
 
+	// Keep the string the same from one call to the next.
+	sort.Strings(components)
+
 	return strings.Join(components, ",")
 }
 
@@ -0,0 +1,204 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestMountConfig_OptionsString(t *testing.T) {
+	testCases := []struct {
+		cfg  fuse.MountConfig
+		want string
+	}{
+		// Linux always gets a name, lest systemd unmount the file system.
+		{
+			cfg:  fuse.MountConfig{},
+			want: "default_permissions,fsname=some_fuse_file_system",
+		},
+
+		{
+			cfg: fuse.MountConfig{
+				FSName:     "configfs",
+				Subtype:    "test",
+				ReadOnly:   true,
+				AllowOther: true,
+			},
+			want: "allow_other,default_permissions,fsname=configfs,ro,subtype=test",
+		},
+
+		// OS X options are ignored.
+		{
+			cfg: fuse.MountConfig{
+				FSName:     "configfs",
+				VolumeName: "Config",
+				Local:      true,
+			},
+			want: "default_permissions,fsname=configfs",
+		},
+
+		// Options override the fields, and are escaped.
+		{
+			cfg: fuse.MountConfig{
+				FSName:  "configfs",
+				Options: map[string]string{"fsname": "other", "a,b": ""},
+			},
+			want: `a\,b,default_permissions,fsname=other`,
+		},
+	}
+
+	for i, tc := range testCases {
+		if got := fuse.OptionsString(&tc.cfg); got != tc.want {
+			t.Errorf("Test case %d: got %q, want %q", i, got, tc.want)
+		}
+	}
+}
+
+func TestCheckAllowOther(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allow_other_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	allowed := path.Join(dir, "allowed")
+	if err := ioutil.WriteFile(allowed, []byte("mount_max = 1000\n  user_allow_other  # for peruserfs\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	commented := path.Join(dir, "commented")
+	if err := ioutil.WriteFile(commented, []byte("#user_allow_other\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	missing := path.Join(dir, "missing")
+	allowOther := map[string]string{"allow_other": ""}
+
+	testCases := []struct {
+		opts     map[string]string
+		euid     int
+		confPath string
+		wantErr  bool
+	}{
+		{allowOther, 1000, allowed, false},
+		{allowOther, 1000, commented, true},
+		{allowOther, 1000, missing, true},
+
+		// fusermount(1) doesn't consult the file for root.
+		{allowOther, 0, missing, false},
+
+		// Nor for mounts that don't ask for allow_other.
+		{map[string]string{"ro": ""}, 1000, missing, false},
+	}
+
+	for i, tc := range testCases {
+		err := fuse.CheckAllowOther(tc.opts, tc.euid, tc.confPath)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("Test case %d: got error %v, want error: %v", i, err, tc.wantErr)
+		}
+
+		if err != nil && !strings.Contains(err.Error(), "user_allow_other") {
+			t.Errorf("Test case %d: error doesn't mention user_allow_other: %v", i, err)
+		}
+	}
+}
+
+// Return the fields of the /proc/mounts entry for dir, or nil if there is
+// none.
+func procMountsEntry(t *testing.T, dir string) []string {
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	for _, line := range strings.Split(string(mounts), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[1] == dir {
+			return fields
+		}
+	}
+
+	return nil
+}
+
+func TestMountConfig_ProcMounts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount_config_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	cfg := &fuse.MountConfig{
+		FSName:     "configfs",
+		Subtype:    "test",
+		ReadOnly:   true,
+		AllowOther: true,
+	}
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(&minimalFS{}), cfg)
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := mfs.Unmount(); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	fields := procMountsEntry(t, dir)
+	if fields == nil {
+		t.Fatalf("No entry for %s in /proc/mounts", dir)
+	}
+
+	if got, want := fields[0], "configfs"; got != want {
+		t.Errorf("Source: got %q, want %q", got, want)
+	}
+
+	if got, want := fields[2], "fuse.test"; got != want {
+		t.Errorf("Type: got %q, want %q", got, want)
+	}
+
+	opts := make(map[string]bool)
+	for _, o := range strings.Split(fields[3], ",") {
+		opts[o] = true
+	}
+
+	for _, want := range []string{"ro", "allow_other", "default_permissions"} {
+		if !opts[want] {
+			t.Errorf("No %q in options %q", want, fields[3])
+		}
+	}
+
+	// The kernel refuses changes without asking the file system.
+	if err := syscall.Chmod(dir, 0700); err != syscall.EROFS {
+		t.Errorf("Chmod: got %v, want EROFS", err)
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// MountGroup mounts a single server at several mount points and manages the
+// mounts together, e.g. to expose per-user views of the same data. The server
+// must support being served on several connections at once, as those created
+// by fuseutil.NewFileSystemServer do; it then calls the file system's Destroy
+// method only once the last of the group's connections has ended.
+//
+// Invalidations sent through the group go to every mount in it, each of whose
+// kernels may have cached the affected entries independently. Mounts that
+// may see each other's writes should set DisableWritebackCaching: with
+// writeback caching the kernel keeps its own idea of each file's size, which
+// invalidation does not reset.
+//
+// The group may also hold child mounts of other servers, mounted on
+// directories within its mounts; see AddChildMount.
+//
+// Once UnmountAll has been called, or every mount in the group has ended, no
+// more mounts may be added, since the file system may already have been
+// destroyed.
+type MountGroup struct {
+	server Server
+
+	mu sync.Mutex
+
+	// Every mount added to the group, whether or not it has since ended.
+	//
+	// GUARDED_BY(mu)
+	mounts []*MountedFileSystem
+
+	// Every mount added by AddChildMount, in the order added.
+	//
+	// GUARDED_BY(mu)
+	children []*childMount
+
+	// Set by UnmountAll, or when AddMount finds that every mount has ended.
+	//
+	// GUARDED_BY(mu)
+	closed bool
+}
+
+// NewMountGroup creates an empty group of mounts of the supplied server.
+func NewMountGroup(server Server) *MountGroup {
+	return &MountGroup{
+		server: server,
+	}
+}
+
+// Return whether the connection for the supplied mount has ended.
+func mountEnded(mfs *MountedFileSystem) bool {
+	select {
+	case <-mfs.joinStatusAvailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// AddMount mounts the group's server at dir, as with Mount. A failure leaves
+// the rest of the group untouched. The group isn't locked while mounting, so
+// its other methods may be called meanwhile; if UnmountAll is among them, the
+// new mount is unmounted again and AddMount fails.
+//
+// LOCKS_EXCLUDED(g.mu)
+func (g *MountGroup) AddMount(
+	dir string,
+	config *MountConfig) (*MountedFileSystem, error) {
+	g.mu.Lock()
+	if !g.closed && len(g.mounts) > 0 {
+		g.closed = true
+		for _, mfs := range g.mounts {
+			if !mountEnded(mfs) {
+				g.closed = false
+				break
+			}
+		}
+	}
+
+	closed := g.closed
+	g.mu.Unlock()
+
+	if closed {
+		return nil, errors.New("AddMount: the group has been shut down")
+	}
+
+	mfs, err := Mount(dir, g.server, config)
+	if err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// UnmountAll may have been called in the meantime, in which case it didn't
+	// see the new mount.
+	if g.closed {
+		Unmount(dir)
+		return nil, errors.New("AddMount: the group has been shut down")
+	}
+
+	g.mounts = append(g.mounts, mfs)
+	return mfs, nil
+}
+
+// Mounts returns the mounts of the group's server that haven't yet ended, not
+// including child mounts.
+//
+// LOCKS_EXCLUDED(g.mu)
+func (g *MountGroup) Mounts() (mounts []*MountedFileSystem) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, mfs := range g.mounts {
+		if !mountEnded(mfs) {
+			mounts = append(mounts, mfs)
+		}
+	}
+
+	return mounts
+}
+
+// Combine errors for several mounts into one, or nil if there are none.
+func groupError(
+	desc string,
+	errs []string) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%s: %s", desc, strings.Join(errs, "; "))
+}
+
+// Add the result of invalidating through mfs to errs. Errors from mounts that
+// turn out to have ended, or whose kernel has hung up, are ignored: there is
+// nothing left there to invalidate.
+func addInvalidateError(
+	errs []string,
+	mfs *MountedFileSystem,
+	err error) []string {
+	switch {
+	case err == nil:
+	case err == syscall.ENOTCONN || err == syscall.ENODEV:
+	case mountEnded(mfs):
+	default:
+		errs = append(errs, fmt.Sprintf("%s: %v", mfs.Dir(), err))
+	}
+
+	return errs
+}
+
+// Call f for each mount that hasn't ended, combining the errors.
+func (g *MountGroup) forEach(
+	desc string,
+	f func(mfs *MountedFileSystem) error) error {
+	var errs []string
+	for _, mfs := range g.Mounts() {
+		errs = addInvalidateError(errs, mfs, f(mfs))
+	}
+
+	return groupError(desc, errs)
+}
+
+// InvalidateInode calls Connection.InvalidateInode for every mount in the
+// group.
+func (g *MountGroup) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	size int64) error {
+	return g.forEach("InvalidateInode", func(mfs *MountedFileSystem) error {
+		return mfs.conn.InvalidateInode(inode, off, size)
+	})
+}
+
+// InvalidateEntry calls Connection.InvalidateEntry for every mount in the
+// group.
+func (g *MountGroup) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	return g.forEach("InvalidateEntry", func(mfs *MountedFileSystem) error {
+		return mfs.conn.InvalidateEntry(parent, name)
+	})
+}
+
+// NotifyPollWakeup calls Connection.NotifyPollWakeup for every mount in the
+// group. Poll handles are only unique within a mount, so this may also wake
+// an unrelated file in another mount, which merely polls again.
+func (g *MountGroup) NotifyPollWakeup(handle fuseops.PollHandle) error {
+	return g.forEach("NotifyPollWakeup", func(mfs *MountedFileSystem) error {
+		return mfs.conn.NotifyPollWakeup(handle)
+	})
+}
+
+// InvalidateDirContents calls MountedFileSystem.InvalidateDirContents for
+// every mount in the group.
+func (g *MountGroup) InvalidateDirContents(dir fuseops.InodeID) error {
+	return g.forEach("InvalidateDirContents", func(mfs *MountedFileSystem) error {
+		return mfs.InvalidateDirContents(dir)
+	})
+}
+
+// InvalidateRename calls MountedFileSystem.InvalidateRename for every mount
+// in the group, concurrently. The returned channel receives the combined
+// result once all have finished, and is then closed.
+func (g *MountGroup) InvalidateRename(
+	oldParent fuseops.InodeID,
+	oldName string,
+	newParent fuseops.InodeID,
+	newName string,
+	child fuseops.InodeID) <-chan error {
+	mounts := g.Mounts()
+	results := make([]<-chan error, len(mounts))
+	for i, mfs := range mounts {
+		results[i] = mfs.InvalidateRename(oldParent, oldName, newParent, newName, child)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer close(result)
+
+		var errs []string
+		for i, mfs := range mounts {
+			errs = addInvalidateError(errs, mfs, <-results[i])
+		}
+
+		result <- groupError("InvalidateRename", errs)
+	}()
+
+	return result
+}
+
+// UnmountAll unmounts every mount in the group that hasn't already ended,
+// child mounts before the mounts they rest on, carrying on past failures, and
+// prevents more from being added. It doesn't wait for the connections to end;
+// see JoinAll.
+//
+// LOCKS_EXCLUDED(g.mu)
+func (g *MountGroup) UnmountAll() error {
+	g.mu.Lock()
+	g.closed = true
+
+	var ms []*MountedFileSystem
+	for _, mfs := range g.mounts {
+		if !mountEnded(mfs) {
+			ms = append(ms, g.descendants(mfs)...)
+			ms = append(ms, mfs)
+		}
+	}
+
+	g.mu.Unlock()
+
+	var errs []string
+	for _, mfs := range ms {
+		if err := Unmount(mfs.Dir()); err != nil && !mountEnded(mfs) {
+			errs = append(errs, fmt.Sprintf("%s: %v", mfs.Dir(), err))
+		}
+	}
+
+	return groupError("UnmountAll", errs)
+}
+
+// JoinAll waits for every mount added to the group, including child mounts,
+// to end, as with MountedFileSystem.Join, returning the combined errors.
+//
+// LOCKS_EXCLUDED(g.mu)
+func (g *MountGroup) JoinAll(ctx context.Context) error {
+	g.mu.Lock()
+	mounts := append([]*MountedFileSystem(nil), g.mounts...)
+	for _, c := range g.children {
+		mounts = append(mounts, c.mfs)
+	}
+
+	g.mu.Unlock()
+
+	var errs []string
+	for _, mfs := range mounts {
+		if err := mfs.Join(ctx); err != nil {
+			if err == ctx.Err() {
+				return err
+			}
+
+			errs = append(errs, fmt.Sprintf("%s: %v", mfs.Dir(), err))
+		}
+	}
+
+	return groupError("JoinAll", errs)
+}
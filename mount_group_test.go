@@ -0,0 +1,272 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Wraps a file system, counting calls to Destroy and DestroyMount.
+type destroyCountingFS struct {
+	fuseutil.FileSystem
+	destroys      int32 // Accessed atomically
+	mountDestroys int32 // Accessed atomically
+}
+
+func (fs *destroyCountingFS) Destroy() {
+	atomic.AddInt32(&fs.destroys, 1)
+	fs.FileSystem.Destroy()
+}
+
+func (fs *destroyCountingFS) DestroyMount(mount fuse.MountInfo) {
+	atomic.AddInt32(&fs.mountDestroys, 1)
+	if d, ok := fs.FileSystem.(fuseutil.MountDestroyer); ok {
+		d.DestroyMount(mount)
+	}
+}
+
+// Write the supplied contents to the given file, using raw system calls so as
+// not to involve the runtime's poller.
+func writeFile(
+	t *testing.T,
+	p string,
+	flags int,
+	contents string) {
+	fd, err := syscall.Open(p, syscall.O_WRONLY|flags, 0644)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", p, err)
+	}
+
+	if _, err := syscall.Write(fd, []byte(contents)); err != nil {
+		t.Fatalf("Write(%q): %v", p, err)
+	}
+
+	if err := syscall.Close(fd); err != nil {
+		t.Fatalf("Close(%q): %v", p, err)
+	}
+}
+
+func stat(t *testing.T, p string) (st syscall.Stat_t) {
+	if err := syscall.Stat(p, &st); err != nil {
+		t.Fatalf("Stat(%q): %v", p, err)
+	}
+
+	return st
+}
+
+func TestMountGroup(t *testing.T) {
+	ctx := context.Background()
+	fs := &destroyCountingFS{
+		FileSystem: memfs.NewFileSystem(uint32(os.Getuid()), uint32(os.Getgid())),
+	}
+
+	g := fuse.NewMountGroup(fuseutil.NewFileSystemServer(fs))
+
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "mount_group_test")
+		if err != nil {
+			t.Fatalf("TempDir: %v", err)
+		}
+
+		defer os.Remove(dir)
+		dirs = append(dirs, dir)
+	}
+
+	var mounts []*fuse.MountedFileSystem
+	for _, dir := range dirs {
+		mfs, err := g.AddMount(dir, &fuse.MountConfig{
+			FSName:                  "mount_group_test",
+			DisableWritebackCaching: true,
+		})
+
+		if err != nil {
+			g.UnmountAll()
+			g.JoinAll(ctx)
+			t.Skipf("AddMount: %v", err)
+		}
+
+		mounts = append(mounts, mfs)
+	}
+
+	defer func() {
+		g.UnmountAll()
+		g.JoinAll(ctx)
+	}()
+
+	// A failure to mount shouldn't affect the rest of the group.
+	if _, err := g.AddMount(path.Join(dirs[0], "nope"), &fuse.MountConfig{
+		FSName: "mount_group_test",
+	}); err == nil {
+		t.Fatal("AddMount succeeded for a missing directory")
+	}
+
+	if n := len(g.Mounts()); n != 2 {
+		t.Fatalf("%d mounts", n)
+	}
+
+	// Both mounts show the same file system.
+	pathA := path.Join(dirs[0], "foo")
+	pathB := path.Join(dirs[1], "foo")
+
+	writeFile(t, pathA, syscall.O_CREAT, "taco")
+	st := stat(t, pathB)
+	if st.Size != 4 {
+		t.Fatalf("Size via B: %d", st.Size)
+	}
+
+	// memfs allows attributes to be cached for a long time, so a change made
+	// through one mount isn't seen through the other until invalidated.
+	writeFile(t, pathA, syscall.O_APPEND, "burrito")
+	if st := stat(t, pathB); st.Size != 4 {
+		t.Fatalf("Size via B before invalidation: %d", st.Size)
+	}
+
+	if err := g.InvalidateInode(fuseops.InodeID(st.Ino), -1, 0); err != nil {
+		t.Fatalf("InvalidateInode: %v", err)
+	}
+
+	if st := stat(t, pathB); st.Size != 11 {
+		t.Errorf("Size via B after invalidation: %d", st.Size)
+	}
+
+	// Unmount one mount behind the group's back. The file system isn't
+	// destroyed, and invalidations still go to the other mount.
+	if err := fuse.Unmount(dirs[1]); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mounts[1].Join(ctx); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&fs.destroys); n != 0 {
+		t.Errorf("Destroyed %d times with a mount left", n)
+	}
+
+	if n := len(g.Mounts()); n != 1 {
+		t.Errorf("%d mounts after unmounting one", n)
+	}
+
+	if err := g.InvalidateInode(fuseops.InodeID(st.Ino), -1, 0); err != nil {
+		t.Errorf("InvalidateInode: %v", err)
+	}
+
+	// Shut down the rest.
+	if err := g.UnmountAll(); err != nil {
+		t.Fatalf("UnmountAll: %v", err)
+	}
+
+	if err := g.JoinAll(ctx); err != nil {
+		t.Fatalf("JoinAll: %v", err)
+	}
+
+	if n := atomic.LoadInt32(&fs.mountDestroys); n != 2 {
+		t.Errorf("DestroyMount called %d times", n)
+	}
+
+	if n := atomic.LoadInt32(&fs.destroys); n != 1 {
+		t.Errorf("Destroy called %d times", n)
+	}
+
+	// No more mounts may be added.
+	if _, err := g.AddMount(dirs[0], &fuse.MountConfig{FSName: "mount_group_test"}); err == nil {
+		t.Error("AddMount succeeded after UnmountAll")
+	}
+}
+
+func TestMountGroup_UnmountAllWhileMounting(t *testing.T) {
+	ctx := context.Background()
+
+	// Hold up init for the second mount until told otherwise.
+	var inits int32
+	entered := make(chan struct{}, 1)
+	release := make(chan struct{})
+	fs := &negotiatingFS{
+		negotiate: func(n *fuse.InitNegotiation) error {
+			if atomic.AddInt32(&inits, 1) == 2 {
+				entered <- struct{}{}
+				<-release
+			}
+
+			return nil
+		},
+	}
+
+	g := fuse.NewMountGroup(fuseutil.NewFileSystemServer(fs))
+
+	var dirs []string
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "mount_group_test")
+		if err != nil {
+			t.Fatalf("TempDir: %v", err)
+		}
+
+		defer os.Remove(dir)
+		dirs = append(dirs, dir)
+	}
+
+	config := &fuse.MountConfig{FSName: "mount_group_test"}
+	if _, err := g.AddMount(dirs[0], config); err != nil {
+		t.Skipf("AddMount: %v", err)
+	}
+
+	defer func() {
+		g.UnmountAll()
+		g.JoinAll(ctx)
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := g.AddMount(dirs[1], config)
+		result <- err
+	}()
+
+	<-entered
+
+	// The group isn't locked while the second mount is in progress.
+	if n := len(g.Mounts()); n != 1 {
+		t.Errorf("%d mounts while mounting", n)
+	}
+
+	if err := g.UnmountAll(); err != nil {
+		t.Errorf("UnmountAll: %v", err)
+	}
+
+	close(release)
+	if err := <-result; err == nil {
+		t.Error("AddMount succeeded after UnmountAll")
+	}
+
+	// The second mount was unmounted again.
+	if st, parent := stat(t, dirs[1]), stat(t, path.Dir(dirs[1])); st.Dev != parent.Dev {
+		t.Errorf("%s is still mounted", dirs[1])
+	}
+
+	if err := g.JoinAll(ctx); err != nil {
+		t.Errorf("JoinAll: %v", err)
+	}
+}
@@ -0,0 +1,483 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The environment variable through which MountHelperMain tells the copy of
+// itself that it starts in the background which inherited file descriptor to
+// report on once the file system is mounted.
+const mountHelperReadyEnv = "FUSE_MOUNT_HELPER_READY_FD"
+
+// What the background copy of a mount helper writes to the ready pipe once
+// the file system is mounted. Anything else is an error message.
+const mountHelperReady = "ready"
+
+// Exit statuses for mount helpers, as documented in mount(8).
+const (
+	mountExitUsage   = 1
+	mountExitSystem  = 2
+	mountExitFailure = 32
+)
+
+// Options that mean something to mount(8) or in /etc/fstab, which mount(8)
+// passes on to helpers but which the kernel doesn't understand. Options
+// beginning with "x-" are also dropped.
+var mountUtilOptions = map[string]bool{
+	"defaults": true,
+	"auto":     true,
+	"noauto":   true,
+	"user":     true,
+	"nouser":   true,
+	"users":    true,
+	"owner":    true,
+	"group":    true,
+	"_netdev":  true,
+	"nofail":   true,
+	"comment":  true,
+}
+
+// Options that override one another, so that of those given, only the last
+// is kept.
+var conflictingMountOptions = [][]string{
+	{"ro", "rw"},
+	{"relatime", "strictatime", "noatime"},
+}
+
+// The arguments with which mount(8) invokes a helper:
+//
+//	mount.<type> device dir [-sfnv] [-N namespace] [-o options] [-t type]
+//
+// util-linux passes -t only when the type doesn't follow from the helper's
+// name.
+type mountHelperArgs struct {
+	device  string
+	dir     string
+	fsType  string
+	options map[string]string
+
+	fake    bool // -f: do everything but mount
+	verbose bool // -v
+}
+
+// Parse the command line with which mount(8) invoked a helper. Options may
+// be given more than once, in which case the later ones win.
+func parseMountHelperArgs(argv []string) (*mountHelperArgs, error) {
+	a := &mountHelperArgs{
+		fsType:  strings.TrimPrefix(filepath.Base(argv[0]), "mount."),
+		options: make(map[string]string),
+	}
+
+	args := argv[1:]
+
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+
+		// Flags taking a value accept it either attached or as the next
+		// argument.
+		flags := arg[1:]
+		for j := 0; j < len(flags); j++ {
+			switch c := flags[j]; c {
+			case 's', 'n':
+				// Sloppy option parsing and not writing /etc/mtab, which make no
+				// difference to us.
+
+			case 'f':
+				a.fake = true
+
+			case 'v':
+				a.verbose = true
+
+			case 'o', 't', 'N':
+				value := flags[j+1:]
+				if value == "" {
+					if i+1 == len(args) {
+						return nil, fmt.Errorf("Option -%c requires a value", c)
+					}
+
+					i++
+					value = args[i]
+				}
+
+				switch c {
+				case 'o':
+					if err := parseMountOptions(value, a.options); err != nil {
+						return nil, err
+					}
+
+				case 't':
+					a.fsType = value
+
+				case 'N':
+					return nil, errors.New("Mounting in another namespace is not supported")
+				}
+
+				j = len(flags)
+
+			default:
+				return nil, fmt.Errorf("Unknown flag -%c", c)
+			}
+		}
+	}
+
+	if len(positional) != 2 {
+		return nil, fmt.Errorf(
+			"Expected a device and a mount point, got %d arguments",
+			len(positional))
+	}
+
+	a.device = positional[0]
+
+	// The background copy of the helper mustn't depend on the working
+	// directory of the one mount(8) started.
+	dir, err := filepath.Abs(positional[1])
+	if err != nil {
+		return nil, fmt.Errorf("Abs: %v", err)
+	}
+
+	a.dir = dir
+
+	return a, nil
+}
+
+// Parse a comma-separated mount option string, such as the fourth field of an
+// /etc/fstab entry, into opts. Commas may be escaped with a backslash, as in
+// the strings Mount gives fusermount(1), or appear within a double-quoted
+// value. Options meaningful only to mount(8) are dropped, as are those
+// overridden by a later one, e.g. rw followed by ro.
+func parseMountOptions(
+	s string,
+	opts map[string]string) error {
+	var components []string
+	var cur strings.Builder
+	var quoted bool
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			cur.WriteByte(s[i])
+
+		case c == '"':
+			quoted = !quoted
+
+		case c == ',' && !quoted:
+			components = append(components, cur.String())
+			cur.Reset()
+
+		default:
+			cur.WriteByte(c)
+		}
+	}
+
+	if quoted {
+		return fmt.Errorf("Unterminated quote in options %q", s)
+	}
+
+	components = append(components, cur.String())
+
+	for _, component := range components {
+		if component == "" {
+			continue
+		}
+
+		key, value := component, ""
+		if i := strings.IndexByte(component, '='); i >= 0 {
+			key, value = component[:i], component[i+1:]
+		}
+
+		if mountUtilOptions[key] || strings.HasPrefix(key, "x-") {
+			continue
+		}
+
+		for _, group := range conflictingMountOptions {
+			for _, k := range group {
+				if k == key {
+					for _, other := range group {
+						delete(opts, other)
+					}
+				}
+			}
+		}
+
+		opts[key] = value
+	}
+
+	return nil
+}
+
+// Build the configuration with which a mount helper mounts, from the options
+// left over once the file system has taken those it understands. The options
+// corresponding to MountConfig fields are translated; the rest are passed to
+// the kernel as they are.
+func (a *mountHelperArgs) mountConfig(opts map[string]string) *MountConfig {
+	cfg := &MountConfig{
+		FSName:  a.device,
+		Options: make(map[string]string),
+	}
+
+	// The type is e.g. fuse.myfs.
+	if i := strings.IndexByte(a.fsType, '.'); i >= 0 {
+		cfg.Subtype = a.fsType[i+1:]
+	}
+
+	for k, v := range opts {
+		switch k {
+		case "ro":
+			cfg.ReadOnly = true
+
+		case "rw":
+			cfg.ReadOnly = false
+
+		case "relatime":
+			cfg.Atime = AtimeRelative
+
+		case "strictatime":
+			cfg.Atime = AtimeStrict
+
+		case "noatime":
+			cfg.Atime = AtimeNone
+
+		case "fsname":
+			cfg.FSName = v
+
+		case "subtype":
+			cfg.Subtype = v
+
+		case "allow_other":
+			cfg.AllowOther = true
+
+		default:
+			cfg.Options[k] = v
+		}
+	}
+
+	return cfg
+}
+
+// MountHelperMain runs the program as a mount helper, so that the file system
+// can be mounted by mount(8), as in
+//
+//	mount -t fuse.myfs device /mnt/point -o ro,myoption=17
+//
+// or by a corresponding /etc/fstab entry, for which mount(8) invokes
+// /sbin/mount.fuse.myfs. Install the program under that name to make it
+// available. It never returns.
+//
+// newServer is called with the device, which means whatever the file system
+// makes of it (e.g. the directory a loopback file system mirrors), and the
+// mount options. It should delete from the map the options it understands
+// itself. Of the rest, those corresponding to MountConfig fields (ro, rw,
+// noatime, strictatime, relatime, fsname, subtype and allow_other) are
+// translated, and the others are passed to the kernel, which fails the mount
+// if it doesn't know them. Options that are meaningful only to mount(8), such
+// as noauto, user, _netdev and x-*, are dropped before newServer sees them.
+// The file system's name defaults to the device, and its subtype to the one
+// in the program's name.
+//
+// So that mount(8) returns once the file system is mounted, the program
+// starts a copy of itself in a new session, which calls newServer, mounts and
+// serves the file system until it is unmounted, and tells the original once
+// the mount is ready or has failed. The original then exits, reporting any
+// error on stderr with the exit status mount(8) expects. Since the copy has
+// no terminal, newServer should arrange for anything it logs to go
+// elsewhere, e.g. to syslog.
+//
+// With -f, mount(8)'s "fake" flag, everything is done except the mount
+// itself.
+func MountHelperMain(
+	newServer func(device string, opts map[string]string) (Server, error)) {
+	os.Exit(mountHelperMain(os.Args, os.Stderr, newServer))
+}
+
+// Do the work of MountHelperMain with the given command line, returning the
+// status with which to exit.
+func mountHelperMain(
+	argv []string,
+	stderr io.Writer,
+	newServer func(device string, opts map[string]string) (Server, error)) int {
+	name := filepath.Base(argv[0])
+	a, err := parseMountHelperArgs(argv)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		fmt.Fprintf(
+			stderr,
+			"Usage: %s device dir [-sfnv] [-o options] [-t type]\n",
+			name)
+
+		return mountExitUsage
+	}
+
+	// Are we the copy started in the background?
+	if fd := os.Getenv(mountHelperReadyEnv); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return mountExitSystem
+		}
+
+		return serveMountHelper(a, os.NewFile(uintptr(n), "(ready pipe)"), newServer)
+	}
+
+	if a.verbose {
+		fmt.Fprintf(
+			stderr,
+			"%s: mounting %s on %s with options %q\n",
+			name,
+			a.device,
+			a.dir,
+			a.options)
+	}
+
+	if err := startMountHelper(argv); err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", name, err)
+		return mountExitFailure
+	}
+
+	return 0
+}
+
+// Start a copy of the program with the given command line in a new session,
+// and wait for it to report that the file system is mounted, returning the
+// error it reports otherwise.
+func startMountHelper(argv []string) error {
+	// Find ourselves. argv[0] is what mount(8) ran, but needn't be a path.
+	path, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Executable: %v", err)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Pipe: %v", err)
+	}
+
+	defer r.Close()
+
+	// The pipe is the first of ExtraFiles, and so descriptor 3 in the child.
+	cmd := exec.Command(path, argv[1:]...)
+	cmd.Env = append(os.Environ(), mountHelperReadyEnv+"=3")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return fmt.Errorf("Start: %v", err)
+	}
+
+	if err := awaitMountHelper(r); err != nil {
+		// Don't leave a zombie if it failed before mounting.
+		cmd.Wait()
+		return err
+	}
+
+	// Let it carry on serving without us.
+	cmd.Process.Release()
+
+	return nil
+}
+
+// Wait for the background copy of a mount helper to report on the supplied
+// pipe, returning nil if it reports that the file system is mounted.
+func awaitMountHelper(r io.Reader) error {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Reading the ready pipe: %v", err)
+	}
+
+	switch s := string(msg); s {
+	case mountHelperReady:
+		return nil
+
+	case "":
+		return errors.New("The file system exited without mounting")
+
+	default:
+		return errors.New(s)
+	}
+}
+
+// Report err on the ready pipe, or that the file system is mounted if it is
+// nil, then close the pipe.
+func signalMountHelper(
+	ready io.WriteCloser,
+	err error) {
+	msg := mountHelperReady
+	if err != nil {
+		msg = err.Error()
+	}
+
+	io.WriteString(ready, msg)
+	ready.Close()
+}
+
+// As the background copy of a mount helper, mount and serve the file system,
+// reporting on ready once mounted or having failed to. Return the status with
+// which to exit once the file system is unmounted.
+func serveMountHelper(
+	a *mountHelperArgs,
+	ready *os.File,
+	newServer func(device string, opts map[string]string) (Server, error)) int {
+	// The file system mustn't write to the pipe, or keep it open.
+	os.Unsetenv(mountHelperReadyEnv)
+	syscall.CloseOnExec(int(ready.Fd()))
+
+	server, err := newServer(a.device, a.options)
+	if err != nil {
+		signalMountHelper(ready, err)
+		return mountExitFailure
+	}
+
+	cfg := a.mountConfig(a.options)
+	if a.fake {
+		signalMountHelper(ready, nil)
+		return 0
+	}
+
+	mfs, err := Mount(a.dir, server, cfg)
+	if err != nil {
+		signalMountHelper(ready, fmt.Errorf("Mount: %v", err))
+		return mountExitFailure
+	}
+
+	signalMountHelper(ready, nil)
+
+	if err := mfs.Join(context.Background()); err != nil {
+		return mountExitSystem
+	}
+
+	return 0
+}
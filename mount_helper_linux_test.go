@@ -0,0 +1,68 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+)
+
+func TestMountHelper_Mount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mount_helper_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	argv := []string{"mount.fuse.test", "backing", dir}
+
+	var stderr bytes.Buffer
+	if status := fuse.RunMountHelper(argv, &stderr, newHelperServer); status != 0 {
+		t.Skipf("Mount helper exited with %d: %s", status, stderr.String())
+	}
+
+	// The helper returns only once the file system is mounted, served by the
+	// copy it left running in the background.
+	mounts, err := ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	want := "backing " + dir + " fuse.test "
+	if !strings.Contains(string(mounts), want) {
+		t.Errorf("No %q in /proc/mounts:\n%s", want, mounts)
+	}
+
+	if err := fuse.Unmount(dir); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	// Unmounting takes effect straight away, and the background copy exits
+	// once the kernel hangs up.
+	mounts, err = ioutil.ReadFile("/proc/mounts")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if strings.Contains(string(mounts), want) {
+		t.Errorf("Still mounted:\n%s", mounts)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// When the test binary is started as the background copy of a mount helper,
+// be that helper.
+func TestMain(m *testing.M) {
+	if os.Getenv(fuse.MountHelperReadyEnv) != "" {
+		fuse.MountHelperMain(newHelperServer)
+	}
+
+	os.Exit(m.Run())
+}
+
+// The file system mounted by the helper tests. It takes the option "fail",
+// with which it fails, and "crash", with which it exits without reporting.
+func newHelperServer(
+	device string,
+	opts map[string]string) (fuse.Server, error) {
+	if _, ok := opts["crash"]; ok {
+		os.Exit(17)
+	}
+
+	if msg, ok := opts["fail"]; ok {
+		return nil, errors.New(msg)
+	}
+
+	return fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}), nil
+}
+
+func TestParseMountHelperArgs(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %v", err)
+	}
+
+	testCases := []struct {
+		args    []string
+		device  string
+		dir     string
+		opts    map[string]string
+		cfg     fuse.MountConfig
+		wantErr string
+	}{
+		// An invocation from an fstab entry, with an explicit type, which
+		// takes precedence over the program's name.
+		{
+			args: []string{
+				"backing",
+				"/mnt/point",
+				"-o", "rw,noauto,_netdev,x-systemd.automount,allow_other,ro,noatime,opt=17",
+				"-t", "fuse.other",
+			},
+			device: "backing",
+			dir:    "/mnt/point",
+			opts: map[string]string{
+				"ro":          "",
+				"allow_other": "",
+				"noatime":     "",
+				"opt":         "17",
+			},
+			cfg: fuse.MountConfig{
+				FSName:     "backing",
+				Subtype:    "other",
+				ReadOnly:   true,
+				AllowOther: true,
+				Atime:      fuse.AtimeNone,
+				Options:    map[string]string{"opt": "17"},
+			},
+		},
+
+		// Bundled flags, attached values, and a relative mount point. The
+		// subtype comes from the program's name.
+		{
+			args:   []string{"-snv", "-oopt", "backing", "rel"},
+			device: "backing",
+			dir:    filepath.Join(wd, "rel"),
+			opts:   map[string]string{"opt": ""},
+			cfg: fuse.MountConfig{
+				FSName:  "backing",
+				Subtype: "myfs",
+				Options: map[string]string{"opt": ""},
+			},
+		},
+
+		// Escaped and quoted commas, and options given more than once.
+		{
+			args: []string{
+				"backing",
+				"/mnt",
+				"-o", `a=1,b=x\,y,defaults`,
+				"-o", `a=2,c="p,q",,fsname=name,subtype=sub`,
+			},
+			device: "backing",
+			dir:    "/mnt",
+			opts: map[string]string{
+				"a":       "2",
+				"b":       "x,y",
+				"c":       "p,q",
+				"fsname":  "name",
+				"subtype": "sub",
+			},
+			cfg: fuse.MountConfig{
+				FSName:  "name",
+				Subtype: "sub",
+				Options: map[string]string{"a": "2", "b": "x,y", "c": "p,q"},
+			},
+		},
+
+		// Mistakes.
+		{
+			args:    []string{"backing"},
+			wantErr: "got 1 arguments",
+		},
+		{
+			args:    []string{"backing", "/mnt", "extra"},
+			wantErr: "got 3 arguments",
+		},
+		{
+			args:    []string{"backing", "/mnt", "-o"},
+			wantErr: "-o requires a value",
+		},
+		{
+			args:    []string{"backing", "/mnt", "-q"},
+			wantErr: "Unknown flag -q",
+		},
+		{
+			args:    []string{"backing", "/mnt", "-o", `a="b`},
+			wantErr: "Unterminated quote",
+		},
+		{
+			args:    []string{"backing", "/mnt", "-N", "/proc/1/ns/mnt"},
+			wantErr: "namespace",
+		},
+	}
+
+	for i, tc := range testCases {
+		argv := append([]string{"/sbin/mount.fuse.myfs"}, tc.args...)
+		device, dir, opts, cfg, err := fuse.ParseMountHelperArgs(argv)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("Case %d: got error %v, want %q", i, err, tc.wantErr)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Case %d: %v", i, err)
+			continue
+		}
+
+		if device != tc.device || dir != tc.dir {
+			t.Errorf("Case %d: got (%q, %q), want (%q, %q)", i, device, dir, tc.device, tc.dir)
+		}
+
+		if !reflect.DeepEqual(opts, tc.opts) {
+			t.Errorf("Case %d: options %q, want %q", i, opts, tc.opts)
+		}
+
+		if !reflect.DeepEqual(*cfg, tc.cfg) {
+			t.Errorf("Case %d: config %+v, want %+v", i, *cfg, tc.cfg)
+		}
+	}
+}
+
+func TestMountHelper_Handshake(t *testing.T) {
+	testCases := []struct {
+		opts       string
+		wantStatus int
+		wantStderr string
+	}{
+		{"opt=17", 0, ""},
+		{"fail=backing store unavailable", 32, "mount.fuse.test: backing store unavailable\n"},
+		{"crash", 32, "mount.fuse.test: The file system exited without mounting\n"},
+	}
+
+	for _, tc := range testCases {
+		// With -f, the background copy does everything but mount.
+		argv := []string{"mount.fuse.test", "backing", "/mnt", "-f", "-o", tc.opts}
+
+		var stderr bytes.Buffer
+		status := fuse.RunMountHelper(argv, &stderr, newHelperServer)
+		if status != tc.wantStatus || stderr.String() != tc.wantStderr {
+			t.Errorf(
+				"%q: got (%d, %q), want (%d, %q)",
+				tc.opts,
+				status,
+				stderr.String(),
+				tc.wantStatus,
+				tc.wantStderr)
+		}
+	}
+
+	// Mistakes in the command line are reported without starting anything.
+	var stderr bytes.Buffer
+	status := fuse.RunMountHelper([]string{"mount.fuse.test", "backing"}, &stderr, newHelperServer)
+	if status != 1 || !strings.HasPrefix(stderr.String(), "mount.fuse.test: Expected a device") {
+		t.Errorf("Bad command line: got (%d, %q)", status, stderr.String())
+	}
+}
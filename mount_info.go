@@ -0,0 +1,65 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// MountInfo identifies the kernel connection on which an op arrived. This
+// matters to file systems served on several connections at once, since inode
+// lookup counts and handle IDs are specific to a connection.
+type MountInfo struct {
+	// An ID distinguishing the connection from all others created by this
+	// process. IDs are never zero and never reused.
+	ID uint64
+
+	// The directory on which the file system is mounted, or the empty string
+	// for connections created with Serve.
+	Dir string
+
+	// The access time policy the file system was mounted with. File systems
+	// that keep access times should follow it when serving reads.
+	Atime AtimePolicy
+
+	// The optional features agreed on with the kernel. See InitNegotiator.
+	Features InitFeatures
+}
+
+// The ID of the most recently created connection.
+var lastMountID uint64
+
+func newMountInfo(
+	dir string,
+	atime AtimePolicy) MountInfo {
+	return MountInfo{
+		ID:    atomic.AddUint64(&lastMountID, 1),
+		Dir:   dir,
+		Atime: atime,
+	}
+}
+
+// MountInfoFromContext returns information about the connection on which the
+// op associated with ctx arrived. ctx must be, or be derived from, a context
+// returned by Connection.ReadOp; otherwise ok is false.
+func MountInfoFromContext(ctx context.Context) (info MountInfo, ok bool) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return MountInfo{}, false
+	}
+
+	return state.conn.mountInfo, true
+}
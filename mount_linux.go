@@ -3,7 +3,11 @@ package fuse
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"strings"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -36,11 +40,103 @@ var mountflagopts = map[string]func(uintptr) uintptr{
 	"atime":   disableFunc(unix.MS_NOATIME),
 	"noatime": enableFunc(unix.MS_NOATIME),
 	"dirsync": enableFunc(unix.MS_DIRSYNC),
+
+	"strictatime": enableFunc(unix.MS_STRICTATIME),
 }
 
 var errFallback = errors.New("sentinel: fallback to fusermount(1)")
 
+// The fusermount(1) configuration file, which must contain user_allow_other
+// for unprivileged users to mount with allow_other.
+var fuseConfPath = "/etc/fuse.conf"
+
+// Return an error if fusermount(1) would refuse to mount with the supplied
+// options on behalf of the user with the given effective ID, because they ask
+// for allow_other and the configuration file doesn't allow it. fusermount's
+// own complaint is lost to the caller if it is started with stderr closed.
+func checkAllowOther(opts map[string]string, euid int, confPath string) error {
+	if _, ok := opts["allow_other"]; !ok || euid == 0 {
+		return nil
+	}
+
+	contents, err := ioutil.ReadFile(confPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Reading %s: %v", confPath, err)
+	}
+
+	// As per libfuse/fusermount.c's read_conf: one option per line, and #
+	// starts a comment.
+	for _, line := range strings.Split(string(contents), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		if strings.TrimSpace(line) == "user_allow_other" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf(
+		"Mounting with allow_other requires user_allow_other in %s when not running as root",
+		confPath)
+}
+
+// Where to look for fusermount(1) if it isn't on the PATH, which may be
+// minimal when we are started by mount(8) at boot.
+var fusermountPaths = []string{
+	"/bin/fusermount",
+	"/usr/bin/fusermount",
+}
+
+// Return the path to fusermount(1).
+func findFusermount() (string, error) {
+	if path, err := exec.LookPath("fusermount"); err == nil {
+		return path, nil
+	}
+
+	for _, path := range fusermountPaths {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+
+	return "", errors.New("Can't find fusermount(1)")
+}
+
+// Return an error if dir has any entries, as fusermount(1) does before hiding
+// them behind a mount.
+func checkEmptyMountPoint(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err != io.EOF {
+		if err != nil {
+			return err
+		}
+
+		return fmt.Errorf(
+			"Mount point %s is not empty; if you are sure this is safe, use "+
+				"the 'nonempty' mount option",
+			dir)
+	}
+
+	return nil
+}
+
 func directmount(dir string, cfg *MountConfig) (*os.File, error) {
+	// Like fusermount, refuse a non-empty mount point unless told otherwise.
+	// The kernel doesn't know the option, so it isn't passed on.
+	opts := cfg.toMap()
+	if _, ok := opts["nonempty"]; ok {
+		delete(opts, "nonempty")
+	} else if err := checkEmptyMountPoint(dir); err != nil {
+		return nil, err
+	}
+
 	// We use syscall.Open + os.NewFile instead of os.OpenFile so that the file
 	// is opened in blocking mode. When opened in non-blocking mode, the Go
 	// runtime tries to use poll(2), which does not work with /dev/fuse.
@@ -54,7 +150,6 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 		dev.Fd(), os.Getuid(), os.Getgid())
 	// As per libfuse/fusermount.c:749: https://bit.ly/2SgtWYM#L749
 	mountflag := uintptr(unix.MS_NODEV | unix.MS_NOSUID)
-	opts := cfg.toMap()
 	for k := range opts {
 		fn, ok := mountflagopts[k]
 		if !ok {
@@ -63,7 +158,10 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 		mountflag = fn(mountflag)
 		delete(opts, k)
 	}
-	delete(opts, "fsname") // handled via fstype mount(2) parameter
+	// Handled via the source mount(2) parameter. toMap supplies a default, and
+	// the kernel rejects an empty source.
+	source := opts["fsname"]
+	delete(opts, "fsname")
 	fstype := "fuse"
 	if subtype, ok := opts["subtype"]; ok {
 		fstype += "." + subtype
@@ -71,11 +169,11 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	delete(opts, "subtype")
 	data += "," + mapToOptionsString(opts)
 	if err := unix.Mount(
-		cfg.FSName, // source
-		dir,        // target
-		fstype,     // fstype
-		mountflag,  // mountflag
-		data,       // data
+		source,    // source
+		dir,       // target
+		fstype,    // fstype
+		mountflag, // mountflag
+		data,      // data
 	); err != nil {
 		if err == syscall.EPERM {
 			return nil, errFallback
@@ -98,6 +196,10 @@ func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 	// have the CAP_SYS_ADMIN capability.
 	dev, err := directmount(dir, cfg)
 	if err == errFallback {
+		if err := checkAllowOther(cfg.toMap(), os.Geteuid(), fuseConfPath); err != nil {
+			return nil, err
+		}
+
 		fusermountPath, err := findFusermount()
 		if err != nil {
 			return nil, err
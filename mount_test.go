@@ -7,6 +7,7 @@ import (
 	"path"
 	"runtime"
 	"strings"
+	"syscall"
 	"testing"
 
 	"github.com/jacobsa/fuse"
@@ -110,6 +111,52 @@ func TestNonEmptyMountPoint(t *testing.T) {
 	}
 }
 
+func TestNonEmptyMountPoint_Allowed(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "mount_test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = ioutil.WriteFile(path.Join(dir, "foo"), []byte{}, 0600)
+	if err != nil {
+		t.Fatalf("ioutil.WriteFile: %v", err)
+	}
+
+	// The nonempty option lets the mount hide the directory's contents.
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&errorFS{errs: map[string]error{"foo": fuse.ENOENT}}),
+		&fuse.MountConfig{
+			FSName:  "nonemptyfs",
+			Options: map[string]string{"nonempty": ""},
+		})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(mfs.Dir()); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(path.Join(dir, "foo"), &st); err != syscall.ENOENT {
+		t.Errorf("Stat(foo): got %v, want ENOENT", err)
+	}
+}
+
 func TestNonexistentMountPoint(t *testing.T) {
 	ctx := context.Background()
 
@@ -14,13 +14,29 @@
 
 package fuse
 
-import "context"
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ErrAborted is returned by Join if the kernel connection was aborted, e.g.
+// through /sys/fs/fuse/connections on Linux, rather than the file system being
+// unmounted. The mount point is left in place, failing every access with
+// ENOTCONN, until it is unmounted.
+var ErrAborted = errors.New("Connection aborted")
 
 // MountedFileSystem represents the status of a mount operation, with a method
 // that waits for unmounting.
 type MountedFileSystem struct {
 	dir string
 
+	// The connection to the kernel, used for sending notifications.
+	conn *Connection
+
 	// The result to return from Join. Not valid until the channel is closed.
 	joinStatus          error
 	joinStatusAvailable chan struct{}
@@ -32,13 +48,28 @@ func (mfs *MountedFileSystem) Dir() string {
 	return mfs.dir
 }
 
+// Unmount unmounts the file system, as Unmount(mfs.Dir()) does. Join returns
+// once the kernel has finished with it. It fails for a file system served
+// with Serve, which has no mount point.
+func (mfs *MountedFileSystem) Unmount() error {
+	if mfs.dir == "" {
+		return errors.New("Not mounted on a directory")
+	}
+
+	return Unmount(mfs.dir)
+}
+
 // Join blocks until a mounted file system has been unmounted. It does not
 // return successfully until all ops read from the connection have been
 // responded to (i.e. the file system server has finished processing all
-// in-flight ops).
+// in-flight ops). Ops still in flight when the kernel hangs up are waited for
+// rather than abandoned, though they may be cancelled; see
+// MountConfig.CancelOnUnmount.
 //
 // The return value will be non-nil if anything unexpected happened while
-// serving. May be called multiple times.
+// serving: ErrAborted if the connection was aborted rather than the file
+// system unmounted, or the error with which reading from the kernel failed.
+// May be called multiple times.
 func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	select {
 	case <-mfs.joinStatusAvailable:
@@ -47,3 +78,143 @@ func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 		return ctx.Err()
 	}
 }
+
+// EnterDegradedMode makes the file system "soft-mounted" until
+// ExitDegradedMode is called, for use when the application has declared its
+// backend dead: rather than waiting on the file system, new ops fail
+// immediately with errno, typically EIO or EHOSTDOWN. The file system stays
+// mounted, so that it recovers in place once the backend returns.
+//
+// If failInFlight is set, ops that the file system is already working on are
+// failed too. Their contexts are cancelled, and the file system's eventual
+// replies are discarded.
+//
+// Some ops are still passed to the file system as usual: ForgetInodeOp and
+// BatchForgetOp, so that lookup counts stay accurate, and ReleaseFileHandleOp
+// and ReleaseDirHandleOp, so that handles opened before degrading are
+// released cleanly. errno must be non-zero.
+func (mfs *MountedFileSystem) EnterDegradedMode(
+	errno syscall.Errno,
+	failInFlight bool) {
+	mfs.conn.enterDegradedMode(errno, failInFlight)
+}
+
+// ExitDegradedMode undoes EnterDegradedMode, passing new ops to the file
+// system again. It is a no-op if the file system isn't in degraded mode.
+func (mfs *MountedFileSystem) ExitDegradedMode() {
+	mfs.conn.exitDegradedMode()
+}
+
+// InvalidateRename tells the kernel about a rename that happened behind its
+// back (e.g. performed by another client of a network file system's backend),
+// so that the file is immediately visible under its new name and gone from
+// its old one. child is the inode ID of the renamed file, or zero if unknown.
+//
+// The notifications are sent asynchronously, since the caller may be inside
+// an op handler for which the kernel holds the very directory locks the
+// notifications need. Transient write errors are retried. The returned
+// channel receives the final result and is then closed.
+//
+// The notifications are sent in this order:
+//
+//  1. The old entry, so that no further lookups resolve the old name to the
+//     child.
+//
+//  2. The new entry, dropping any cached negative lookup for the new name.
+//
+//  3. The child's attributes, whose ctime (and perhaps link count) changed.
+//
+//  4. The parents' attributes and readdir caches, old parent first.
+//
+// Dropping the names before the inodes means a concurrent lookup can't
+// re-cache the old name with attributes fetched after step 3. Each entry
+// notification locks only a single directory in the kernel, so this order
+// can't deadlock against a concurrent kernel-initiated rename, which locks
+// both parents at once.
+func (mfs *MountedFileSystem) InvalidateRename(
+	oldParent fuseops.InodeID,
+	oldName string,
+	newParent fuseops.InodeID,
+	newName string,
+	child fuseops.InodeID) <-chan error {
+	steps := []func() error{
+		func() error { return mfs.conn.InvalidateEntry(oldParent, oldName) },
+		func() error { return mfs.conn.InvalidateEntry(newParent, newName) },
+	}
+
+	if child != 0 {
+		steps = append(steps, func() error {
+			return mfs.conn.InvalidateInode(child, -1, 0)
+		})
+	}
+
+	steps = append(steps, func() error {
+		return mfs.conn.InvalidateInode(oldParent, 0, 0)
+	})
+
+	if newParent != oldParent {
+		steps = append(steps, func() error {
+			return mfs.conn.InvalidateInode(newParent, 0, 0)
+		})
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer close(result)
+
+		for _, step := range steps {
+			if err := retryNotification(step); err != nil {
+				result <- err
+				return
+			}
+		}
+
+		result <- nil
+	}()
+
+	return result
+}
+
+// InvalidateDirContents tells the kernel that the entries of the given
+// directory changed behind its back, dropping any entries it cached for the
+// directory under OpenDirOp.CacheDir so that the next readdir(2) goes to the
+// file system. It also drops the directory's cached attributes. Transient
+// write errors are retried.
+//
+// This doesn't affect the kernel's cached lookups of the directory's
+// children, which remain valid until their ChildInodeEntry.EntryExpiration.
+// A child removed or renamed out-of-band thus stays visible to stat(2) and
+// open(2), though no longer listed, until then; use InvalidateRename or
+// Connection.InvalidateEntry for such children. New children need nothing
+// more, unless a negative lookup for the name was cached.
+//
+// The same caveat about op handlers as for Connection.InvalidateInode
+// applies.
+func (mfs *MountedFileSystem) InvalidateDirContents(dir fuseops.InodeID) error {
+	// The readdir cache lives in the directory's page cache, so it's dropped
+	// only by a notification with a non-negative offset. Zero size means the
+	// whole thing.
+	return retryNotification(func() error {
+		return mfs.conn.InvalidateInode(dir, 0, 0)
+	})
+}
+
+// Call f until it succeeds, returns an error that isn't transient, or we run
+// out of attempts.
+func retryNotification(f func() error) error {
+	const maxAttempts = 5
+	backoff := time.Millisecond
+
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		err = f()
+		if err != syscall.EAGAIN && err != syscall.EINTR {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	return err
+}
@@ -0,0 +1,89 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The name length reported by statfs(2) for file systems that don't say
+// otherwise, as for most local file systems.
+const defaultMaxNameLength = 255
+
+// Return the names that op would create or refer to within a directory.
+func opNames(op interface{}) []string {
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return []string{o.Name}
+
+	case *fuseops.MkDirOp:
+		return []string{o.Name}
+
+	case *fuseops.MkNodeOp:
+		return []string{o.Name}
+
+	case *fuseops.CreateFileOp:
+		return []string{o.Name}
+
+	case *fuseops.CreateSymlinkOp:
+		return []string{o.Name}
+
+	case *fuseops.CreateLinkOp:
+		return []string{o.Name}
+
+	case *fuseops.RenameOp:
+		return []string{o.OldName, o.NewName}
+
+	case *fuseops.RmDirOp:
+		return []string{o.Name}
+
+	case *fuseops.UnlinkOp:
+		return []string{o.Name}
+	}
+
+	return nil
+}
+
+// Return whether op names a directory entry longer than the limit set by
+// MountConfig.MaxNameLength, in which case it should be failed with
+// ENAMETOOLONG without involving the user.
+func (c *Connection) nameTooLong(op interface{}) bool {
+	limit := int(c.cfg.MaxNameLength)
+	if limit == 0 {
+		return false
+	}
+
+	for _, name := range opNames(op) {
+		if len(name) > limit {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return the name length to report for a StatFSOp.
+func (c *Connection) maxNameLength(op *fuseops.StatFSOp) uint32 {
+	switch {
+	case op.MaxNameLength != 0:
+		return op.MaxNameLength
+
+	case c.cfg.MaxNameLength != 0:
+		return c.cfg.MaxNameLength
+
+	default:
+		return defaultMaxNameLength
+	}
+}
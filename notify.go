@@ -0,0 +1,155 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// InvalidateInode tells the kernel to drop its cached attributes for the
+// given inode, along with the cached data in the range [off, off+size) of its
+// page cache. A size of zero means "to the end of the file"; a negative off
+// means invalidate only the attributes.
+//
+// For a directory, invalidating the page cache discards any cached readdir
+// results.
+//
+// It is not an error to invalidate an inode the kernel doesn't know about.
+//
+// This must not be called from within an op handler whose reply the kernel
+// is waiting on for the same inode, since the kernel may hold locks that the
+// notification also needs.
+func (c *Connection) InvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	size int64) error {
+	if !c.protocol.HasInvalidate() {
+		return fmt.Errorf("Protocol %v doesn't support invalidation", c.protocol)
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalInodeOut)(m.Grow(
+		int(unsafe.Sizeof(fusekernel.NotifyInvalInodeOut{}))))
+	out.Ino = uint64(inode)
+	out.Off = off
+	out.Len = size
+
+	if err := c.writeNotification(m, fusekernel.NotifyCodeInvalInode); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cacheStats.InodeInvalidations++
+	c.mu.Unlock()
+
+	return nil
+}
+
+// InvalidateEntry tells the kernel to drop its cached directory entry (and
+// any cached negative lookup) for the given name within the given parent
+// directory, and to drop the parent's cached attributes.
+//
+// It is not an error to invalidate an entry the kernel doesn't know about. It
+// is an error to invalidate one on which a child mount rests, which would
+// detach the mount; see MountGroup.AddChildMount.
+//
+// The same caveat about op handlers as for InvalidateInode applies.
+func (c *Connection) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	if !c.protocol.HasInvalidate() {
+		return fmt.Errorf("Protocol %v doesn't support invalidation", c.protocol)
+	}
+
+	if c.isAnchor(anchorEntry{parent, name}) {
+		return fmt.Errorf("%q in inode %d has a child mount resting on it", name, parent)
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyInvalEntryOut)(m.Grow(
+		int(unsafe.Sizeof(fusekernel.NotifyInvalEntryOut{}))))
+	out.Parent = uint64(parent)
+	out.Namelen = uint32(len(name))
+
+	// The kernel requires the name to be NUL-terminated.
+	m.AppendString(name)
+	m.Append([]byte{0})
+
+	if err := c.writeNotification(m, fusekernel.NotifyCodeInvalEntry); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.cacheStats.EntryInvalidations++
+	c.mu.Unlock()
+
+	return nil
+}
+
+// NotifyPollWakeup tells the kernel that the file it named with the given
+// handle in a fuseops.PollOp may have become ready, so that it polls the file
+// again on behalf of whoever is waiting. It is not an error to wake a handle
+// that nobody is waiting on, or that has been released.
+func (c *Connection) NotifyPollWakeup(handle fuseops.PollHandle) error {
+	if !c.protocol.HasPoll() {
+		return fmt.Errorf("Protocol %v doesn't support poll", c.protocol)
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	out := (*fusekernel.NotifyPollWakeupOut)(m.Grow(
+		int(unsafe.Sizeof(fusekernel.NotifyPollWakeupOut{}))))
+	out.Kh = uint64(handle)
+
+	return c.writeNotification(m, fusekernel.NotifyCodePoll)
+}
+
+// Fill in the header for an unsolicited notification and write it to the
+// kernel.
+func (c *Connection) writeNotification(
+	m *buffer.OutMessage,
+	code int32) error {
+	// Notifications carry a zero "unique" ID, with the notification code in
+	// the error field.
+	h := m.OutHeader()
+	h.Unique = 0
+	h.Error = code
+	h.Len = uint32(m.Len())
+
+	if c.debugLogger != nil {
+		c.debugLog(0, 2, "-> Notify %d", code)
+	}
+
+	err := c.writeMessage(m.Bytes())
+
+	// The kernel responds with ENOENT when it has nothing cached for the inode
+	// or entry in question, which is exactly the state we were asking for.
+	if err == syscall.ENOENT {
+		err = nil
+	}
+
+	return err
+}
@@ -0,0 +1,382 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A notification waiting to be sent by a notificationQueue.
+type queuedNotification struct {
+	key notificationKey
+
+	// For inode invalidations, the range to invalidate, as for
+	// Connection.InvalidateInode.
+	off  int64
+	size int64
+
+	// For barriers, closed once everything queued before them has been sent,
+	// after setting err.
+	done chan struct{}
+	err  error
+}
+
+type notificationKind int
+
+const (
+	notifyInode notificationKind = iota
+	notifyEntry
+	notifyBarrier
+)
+
+// Identifies the cache entry a notification invalidates, so that duplicates
+// can be coalesced.
+type notificationKey struct {
+	kind notificationKind
+
+	// The inode, or for entries the parent directory.
+	inode fuseops.InodeID
+	name  string
+}
+
+// The error with which FlushNotifications fails if the connection closes
+// first.
+var errNotificationsClosed = errors.New("Connection closed")
+
+// A queue of notifications written to the kernel by a dedicated goroutine, so
+// that callers don't block on the kernel. See
+// MountedFileSystem.QueueInvalidateInode.
+type notificationQueue struct {
+	conn     *Connection
+	interval time.Duration
+
+	mu sync.Mutex
+
+	// The notifications waiting to be sent, in order.
+	//
+	// GUARDED_BY(mu)
+	pending []*queuedNotification
+
+	// The inode and entry notifications in pending, by what they invalidate.
+	//
+	// GUARDED_BY(mu)
+	byKey map[notificationKey]*queuedNotification
+
+	// Whether the writing goroutine has been started, and whether close has
+	// been called.
+	//
+	// GUARDED_BY(mu)
+	started bool
+	closed  bool
+
+	// Receives a value when pending becomes non-empty.
+	wake chan struct{}
+
+	// Closed by close, and by the writing goroutine when it exits.
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+func newNotificationQueue(
+	c *Connection,
+	interval time.Duration) *notificationQueue {
+	return &notificationQueue{
+		conn:     c,
+		interval: interval,
+		byKey:    make(map[notificationKey]*queuedNotification),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Queue n, coalescing it with a pending notification for the same cache
+// entry if there is one. That is safe because the pending one will be sent
+// after n was queued, so it too drops anything cached before then. The
+// notification is dropped if the queue has been closed.
+//
+// LOCKS_EXCLUDED(q.mu)
+func (q *notificationQueue) enqueue(n *queuedNotification) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		if n.done != nil {
+			n.err = errNotificationsClosed
+			close(n.done)
+		}
+
+		return
+	}
+
+	if n.key.kind != notifyBarrier {
+		if p, ok := q.byKey[n.key]; ok {
+			if n.key.kind == notifyInode {
+				p.off, p.size = mergeInodeRanges(p.off, p.size, n.off, n.size)
+			}
+
+			return
+		}
+
+		q.byKey[n.key] = n
+	}
+
+	q.pending = append(q.pending, n)
+
+	if !q.started {
+		q.started = true
+		go q.writeLoop()
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Return the smallest range covering the two supplied, in the terms of
+// Connection.InvalidateInode. Both invalidate the attributes, so a negative
+// offset, meaning only that, doesn't widen the range.
+func mergeInodeRanges(
+	off1 int64,
+	size1 int64,
+	off2 int64,
+	size2 int64) (off int64, size int64) {
+	switch {
+	case off1 < 0:
+		return off2, size2
+
+	case off2 < 0:
+		return off1, size1
+	}
+
+	off = off1
+	if off2 < off {
+		off = off2
+	}
+
+	// Zero size means "to the end of the file".
+	if size1 == 0 || size2 == 0 {
+		return off, 0
+	}
+
+	end := off1 + size1
+	if end2 := off2 + size2; end2 > end {
+		end = end2
+	}
+
+	return off, end - off
+}
+
+// Remove and return the first pending notification, waiting for one if
+// necessary. Return nil if the queue is closed first.
+//
+// LOCKS_EXCLUDED(q.mu)
+func (q *notificationQueue) next() *queuedNotification {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return nil
+		}
+
+		if len(q.pending) > 0 {
+			n := q.pending[0]
+			q.pending[0] = nil
+			q.pending = q.pending[1:]
+
+			if n.key.kind != notifyBarrier {
+				delete(q.byKey, n.key)
+			}
+
+			q.mu.Unlock()
+			return n
+		}
+
+		q.mu.Unlock()
+
+		select {
+		case <-q.wake:
+		case <-q.stop:
+			return nil
+		}
+	}
+}
+
+// Send pending notifications until the queue is closed, reporting failures
+// on the connection's Errors channel.
+func (q *notificationQueue) writeLoop() {
+	defer close(q.stopped)
+
+	var last time.Time
+	for {
+		n := q.next()
+		if n == nil {
+			return
+		}
+
+		if n.key.kind == notifyBarrier {
+			close(n.done)
+			continue
+		}
+
+		// Respect the minimum interval between notifications.
+		if q.interval > 0 && !last.IsZero() {
+			if d := q.interval - time.Since(last); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-q.stop:
+					return
+				}
+			}
+		}
+
+		err := retryNotification(func() error { return q.send(n) })
+		last = time.Now()
+
+		if err != nil {
+			q.conn.reportError(q.opError(n, err))
+		}
+	}
+}
+
+// Write the supplied inode or entry notification to the kernel.
+func (q *notificationQueue) send(n *queuedNotification) error {
+	if n.key.kind == notifyEntry {
+		return q.conn.InvalidateEntry(n.key.inode, n.key.name)
+	}
+
+	return q.conn.InvalidateInode(n.key.inode, n.off, n.size)
+}
+
+// Describe the failure to send n.
+func (q *notificationQueue) opError(
+	n *queuedNotification,
+	err error) OpError {
+	e := OpError{
+		Inode: n.key.inode,
+		Op:    "InvalidateInode",
+		Err:   err,
+	}
+
+	if n.key.kind == notifyEntry {
+		e.Op = fmt.Sprintf("InvalidateEntry(%q)", n.key.name)
+	}
+
+	return e
+}
+
+// Wait until everything queued before the call has been sent, or ctx is
+// done.
+func (q *notificationQueue) flush(ctx context.Context) error {
+	b := &queuedNotification{
+		key:  notificationKey{kind: notifyBarrier},
+		done: make(chan struct{}),
+	}
+
+	q.enqueue(b)
+
+	select {
+	case <-b.done:
+		return b.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop the writing goroutine, waiting for it to finish any write in progress,
+// and drop whatever is still pending. Flushes waiting on it fail.
+//
+// LOCKS_EXCLUDED(q.mu)
+func (q *notificationQueue) close() {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+
+	q.closed = true
+	started := q.started
+	close(q.stop)
+	q.mu.Unlock()
+
+	if started {
+		<-q.stopped
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, n := range q.pending {
+		if n.done != nil {
+			n.err = errNotificationsClosed
+			close(n.done)
+		}
+	}
+
+	q.pending = nil
+	q.byKey = nil
+}
+
+// QueueInvalidateInode is like Connection.InvalidateInode, but returns
+// without waiting for the kernel. The notification is instead written by a
+// goroutine dedicated to the purpose, so that this may be called freely from
+// within op handlers, and failures are delivered on Errors.
+//
+// Notifications are written in the order they were queued, at most one per
+// MountConfig.MinNotificationInterval if that is set. A notification for an
+// inode that is still waiting to be written when another is queued for the
+// same inode absorbs the later one, widening its range to cover both. Use
+// FlushNotifications to wait for queued notifications to be written.
+func (mfs *MountedFileSystem) QueueInvalidateInode(
+	inode fuseops.InodeID,
+	off int64,
+	size int64) {
+	mfs.conn.notifications.enqueue(&queuedNotification{
+		key:  notificationKey{kind: notifyInode, inode: inode},
+		off:  off,
+		size: size,
+	})
+}
+
+// QueueInvalidateEntry is like Connection.InvalidateEntry, but returns
+// without waiting for the kernel, as for QueueInvalidateInode. Duplicate
+// invalidations of the same entry waiting to be written are sent once.
+func (mfs *MountedFileSystem) QueueInvalidateEntry(
+	parent fuseops.InodeID,
+	name string) {
+	mfs.conn.notifications.enqueue(&queuedNotification{
+		key: notificationKey{kind: notifyEntry, inode: parent, name: name},
+	})
+}
+
+// FlushNotifications waits until every notification queued by
+// QueueInvalidateInode or QueueInvalidateEntry before the call has been
+// written to the kernel, successfully or not, for callers that must know the
+// kernel has dropped its caches before proceeding. It returns an error if ctx
+// is done or the connection closes first.
+//
+// Like the synchronous notifications, this must not be called from within an
+// op handler whose reply the kernel is waiting on for an inode being
+// invalidated.
+func (mfs *MountedFileSystem) FlushNotifications(ctx context.Context) error {
+	return mfs.conn.notifications.flush(ctx)
+}
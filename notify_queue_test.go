@@ -0,0 +1,305 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Describe the notification in msg, or return "" if it's a reply.
+func describeNotification(msg []byte) string {
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&msg[0]))
+	if h.Unique != 0 {
+		return ""
+	}
+
+	body := unsafe.Pointer(&msg[buffer.OutMessageHeaderSize])
+	switch h.Error {
+	case fusekernel.NotifyCodeInvalInode:
+		out := (*fusekernel.NotifyInvalInodeOut)(body)
+		return fmt.Sprintf("inode %d [%d, +%d)", out.Ino, out.Off, out.Len)
+
+	case fusekernel.NotifyCodeInvalEntry:
+		out := (*fusekernel.NotifyInvalEntryOut)(body)
+		name := msg[buffer.OutMessageHeaderSize+int(unsafe.Sizeof(*out)):]
+		return fmt.Sprintf("entry %d %q", out.Parent, name[:out.Namelen])
+	}
+
+	return fmt.Sprintf("notification %d", h.Error)
+}
+
+func TestNotificationQueue_Coalescing(t *testing.T) {
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+	mfs := k.MountedFileSystem()
+
+	// Record the notifications written, holding up the first until released,
+	// and fail those for inode 99.
+	var mu sync.Mutex
+	var written []string
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+
+	fuse.SetWriteHook(mfs, func(msg []byte) error {
+		desc := describeNotification(msg)
+		if desc == "" {
+			return nil
+		}
+
+		mu.Lock()
+		first := len(written) == 0
+		written = append(written, desc)
+		mu.Unlock()
+
+		if first {
+			close(blocked)
+			<-release
+		}
+
+		if desc == "inode 99 [-1, +0)" {
+			return syscall.EIO
+		}
+
+		return nil
+	})
+
+	// Queue a notification and wait for it to be picked up, so that the
+	// following ones pile up behind it.
+	mfs.QueueInvalidateInode(2, -1, 0)
+	<-blocked
+
+	mfs.QueueInvalidateInode(3, 0, 10)
+	mfs.QueueInvalidateEntry(1, "foo")
+	mfs.QueueInvalidateInode(2, 0, 0)
+	mfs.QueueInvalidateInode(3, 20, 10)
+	mfs.QueueInvalidateInode(4, -1, 0)
+	mfs.QueueInvalidateEntry(1, "foo")
+	mfs.QueueInvalidateEntry(1, "bar")
+	mfs.QueueInvalidateInode(4, 100, 0)
+	mfs.QueueInvalidateInode(99, -1, 0)
+
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := mfs.FlushNotifications(ctx); err != nil {
+		t.Fatalf("FlushNotifications: %v", err)
+	}
+
+	// The first notification for inode 2 had already been picked up, so the
+	// second isn't merged into it. The rest are coalesced in the position of
+	// the first of their kind.
+	want := []string{
+		"inode 2 [-1, +0)",
+		"inode 3 [0, +30)",
+		`entry 1 "foo"`,
+		"inode 2 [0, +0)",
+		"inode 4 [100, +0)",
+		`entry 1 "bar"`,
+		"inode 99 [-1, +0)",
+	}
+
+	mu.Lock()
+	got := written
+	mu.Unlock()
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Notifications:\n got %q\nwant %q", got, want)
+	}
+
+	// The failure is delivered as an asynchronous error.
+	select {
+	case e := <-mfs.Errors():
+		if e.Inode != 99 || e.Op != "InvalidateInode" || e.Err != syscall.EIO {
+			t.Errorf("Unexpected error: %#v", e)
+		}
+
+	default:
+		t.Error("No error delivered")
+	}
+}
+
+func TestNotificationQueue_Interval(t *testing.T) {
+	const interval = 50 * time.Millisecond
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		&fuse.MountConfig{MinNotificationInterval: interval})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+	mfs := k.MountedFileSystem()
+
+	var mu sync.Mutex
+	var times []time.Time
+
+	fuse.SetWriteHook(mfs, func(msg []byte) error {
+		if describeNotification(msg) != "" {
+			mu.Lock()
+			times = append(times, time.Now())
+			mu.Unlock()
+		}
+
+		return nil
+	})
+
+	const n = 4
+	for i := 0; i < n; i++ {
+		mfs.QueueInvalidateInode(fuseops.InodeID(i+2), -1, 0)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := mfs.FlushNotifications(ctx); err != nil {
+		t.Fatalf("FlushNotifications: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(times) != n {
+		t.Fatalf("Got %d notifications, want %d", len(times), n)
+	}
+
+	for i := 1; i < n; i++ {
+		if d := times[i].Sub(times[i-1]); d < interval {
+			t.Errorf("Notification %d sent %v after the previous one", i, d)
+		}
+	}
+}
+
+// A file system whose lookups in the root invalidate another entry in the
+// root, as a file system that discovered a change to the directory while
+// handling a lookup might.
+type invalidatingLookupFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu  sync.Mutex
+	mfs *fuse.MountedFileSystem // GUARDED_BY(mu)
+}
+
+func (fs *invalidatingLookupFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0755 | os.ModeDir,
+	}
+
+	return nil
+}
+
+func (fs *invalidatingLookupFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.mu.Lock()
+	mfs := fs.mfs
+	fs.mu.Unlock()
+
+	// The kernel holds the root's lock while waiting for this lookup, and the
+	// entry invalidation needs the same lock, so sending it synchronously
+	// would deadlock.
+	mfs.QueueInvalidateEntry(fuseops.RootInodeID, "other")
+	return fuse.ENOENT
+}
+
+func TestNotificationQueue_FromHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notify_queue_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	fs := &invalidatingLookupFS{}
+
+	// Don't let the file system see a lookup before it knows its mount.
+	fs.mu.Lock()
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName: "notify_queue_test",
+	})
+
+	fs.mfs = mfs
+	fs.mu.Unlock()
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		fuse.Unmount(dir)
+		mfs.Join(context.Background())
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		var st syscall.Stat_t
+		done <- syscall.Lstat(path.Join(dir, "foo"), &st)
+	}()
+
+	select {
+	case err := <-done:
+		if err != syscall.ENOENT {
+			t.Errorf("Lstat: got %v, want ENOENT", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("Lookup deadlocked")
+	}
+
+	// Once the lookup has finished, the notification can be written.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := mfs.FlushNotifications(ctx); err != nil {
+		t.Fatalf("FlushNotifications: %v", err)
+	}
+
+	select {
+	case e := <-mfs.Errors():
+		t.Errorf("Unexpected error: %v", e)
+
+	default:
+	}
+}
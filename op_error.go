@@ -0,0 +1,174 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The number of errors buffered for MountedFileSystem.Errors before the
+// oldest are dropped.
+const opErrorBufferSize = 64
+
+// OpError describes a failure that happened asynchronously, with no op in
+// progress through which the kernel could have been told about it. For
+// example, a file system that acknowledges writes once it has buffered them,
+// uploading them to a backend later, has nowhere to report a failed upload:
+// a later FlushFileOp or SyncFileOp may fail, but only if the application
+// calls close(2) or fsync(2) and checks the result.
+//
+// Such failures are delivered on MountedFileSystem.Errors. They come from the
+// library itself, for replies the kernel refused, and from file systems via
+// ReportError. The file system in the example above might handle a failed
+// upload like this:
+//
+//	fuse.ReportError(ctx, fuse.OpError{
+//		Inode:           inode,
+//		Path:            "logs/today",
+//		Op:              "upload",
+//		Err:             err,
+//		InvalidatePages: true,
+//	})
+//
+// and then discard the data that was never written, so that later reads see
+// what the backend actually holds, and fail the next flush or fsync of the
+// file too.
+type OpError struct {
+	// The inode affected, or zero if unknown or not applicable.
+	Inode fuseops.InodeID
+
+	// The path of the inode relative to the root of the file system, if known.
+	Path string
+
+	// What was being done, e.g. the type of an op or "upload".
+	Op string
+
+	// What went wrong.
+	Err error
+
+	// When reporting, ask the kernel to drop its cached pages and attributes
+	// for Inode, so that reads don't return data that the file system never
+	// durably wrote. As for Connection.InvalidateInode, ReportError must then
+	// not be called from an op handler whose reply the kernel is waiting on for
+	// the same inode.
+	InvalidatePages bool
+}
+
+func (e OpError) Error() string {
+	if e.Path != "" {
+		return fmt.Sprintf("%s %s: %v", e.Op, e.Path, e.Err)
+	}
+
+	if e.Inode != 0 {
+		return fmt.Sprintf("%s inode %d: %v", e.Op, e.Inode, e.Err)
+	}
+
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+// ReportError delivers e on MountedFileSystem.Errors for the connection on
+// which the op associated with ctx arrived. That op need not still be in
+// progress, so file systems may keep the context of, e.g., the write whose
+// data they are uploading. It returns false if ctx isn't, and isn't derived
+// from, a context returned by Connection.ReadOp.
+func ReportError(
+	ctx context.Context,
+	e OpError) bool {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return false
+	}
+
+	state.conn.reportError(e)
+	return true
+}
+
+// Deliver e on c.errors, dropping the oldest error if the buffer is full, and
+// carry out any invalidation it asks for.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) reportError(e OpError) {
+	if e.InvalidatePages && e.Inode != 0 {
+		if err := c.InvalidateInode(e.Inode, 0, 0); err != nil && c.errorLogger != nil {
+			c.errorLogger.Printf("Invalidating inode %d after %v: %v", e.Inode, e, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.errorsClosed {
+		return
+	}
+
+	for {
+		select {
+		case c.errors <- e:
+			return
+		default:
+		}
+
+		select {
+		case <-c.errors:
+			c.droppedErrors++
+		default:
+		}
+	}
+}
+
+// Close c.errors, after which further errors are discarded.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) closeErrors() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.errorsClosed = true
+	close(c.errors)
+}
+
+// Errors returns a channel on which asynchronous failures are delivered; see
+// OpError. The channel is buffered. When it is full, the oldest error is
+// dropped to make room, and counted in DroppedErrors. It is closed once the
+// connection has been closed.
+func (c *Connection) Errors() <-chan OpError {
+	return c.errors
+}
+
+// DroppedErrors returns the number of errors dropped from Errors because
+// nobody received them in time.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) DroppedErrors() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.droppedErrors
+}
+
+// Errors returns a channel on which asynchronous failures are delivered. See
+// OpError and Connection.Errors.
+func (mfs *MountedFileSystem) Errors() <-chan OpError {
+	return mfs.conn.Errors()
+}
+
+// DroppedErrors returns the number of errors dropped from Errors because
+// nobody received them in time.
+func (mfs *MountedFileSystem) DroppedErrors() uint64 {
+	return mfs.conn.DroppedErrors()
+}
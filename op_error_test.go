@@ -0,0 +1,271 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const uploadFileInode = fuseops.RootInodeID + 1
+
+// Serves a single file, foo, acknowledging writes straight away and
+// "uploading" them later, when told to fail the upload.
+type uploadFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// The contents reads see, and the part of them that has been durably
+	// written.
+	//
+	// GUARDED_BY(mu)
+	contents []byte
+	durable  []byte
+
+	// The context of the most recent write.
+	//
+	// GUARDED_BY(mu)
+	writeCtx context.Context
+}
+
+// LOCKS_REQUIRED(fs.mu)
+func (fs *uploadFS) attributes(ino fuseops.InodeID) fuseops.InodeAttributes {
+	if ino == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0755 | os.ModeDir,
+			Uid:   uint32(os.Getuid()),
+			Gid:   uint32(os.Getgid()),
+		}
+	}
+
+	return fuseops.InodeAttributes{
+		Size:  uint64(len(fs.contents)),
+		Nlink: 1,
+		Mode:  0644,
+		Uid:   uint32(os.Getuid()),
+		Gid:   uint32(os.Getgid()),
+	}
+}
+
+func (fs *uploadFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "foo" {
+		return fuse.ENOENT
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Entry.Child = uploadFileInode
+	op.Entry.Attributes = fs.attributes(uploadFileInode)
+	op.Entry.AttributesExpiration = time.Now().Add(time.Hour)
+	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	return nil
+}
+
+func (fs *uploadFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.Attributes = fs.attributes(op.Inode)
+	op.AttributesExpiration = time.Now().Add(time.Hour)
+	return nil
+}
+
+func (fs *uploadFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	// Let the kernel serve reads from its cache for as long as it may.
+	op.KeepPageCache = true
+	return nil
+}
+
+func (fs *uploadFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Offset < int64(len(fs.contents)) {
+		op.BytesRead = copy(op.Dst, fs.contents[op.Offset:])
+	}
+
+	return nil
+}
+
+func (fs *uploadFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	end := int(op.Offset) + len(op.Data)
+	if end > len(fs.contents) {
+		fs.contents = append(fs.contents, make([]byte, end-len(fs.contents))...)
+	}
+
+	copy(fs.contents[op.Offset:], op.Data)
+	fs.writeCtx = ctx
+	return nil
+}
+
+func (fs *uploadFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+// Fail the upload of everything written since the last durable state,
+// reverting to that state and reporting the failure.
+func (fs *uploadFS) failUpload(invalidate bool) {
+	fs.mu.Lock()
+	fs.contents = append([]byte(nil), fs.durable...)
+	ctx := fs.writeCtx
+	fs.mu.Unlock()
+
+	fuse.ReportError(ctx, fuse.OpError{
+		Inode:           uploadFileInode,
+		Path:            "foo",
+		Op:              "upload",
+		Err:             syscall.EIO,
+		InvalidatePages: invalidate,
+	})
+}
+
+// Read the whole of the file at p using system calls.
+func readAll(t *testing.T, p string) string {
+	fd, err := syscall.Open(p, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 4096)
+	n, err := syscall.Read(fd, buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	return string(buf[:n])
+}
+
+func TestOpErrors(t *testing.T) {
+	for _, invalidate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("InvalidatePages=%v", invalidate), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "op_error_test")
+			if err != nil {
+				t.Fatalf("TempDir: %v", err)
+			}
+
+			defer os.Remove(dir)
+
+			fs := &uploadFS{}
+			mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+				FSName:                  "op_error_test",
+				DisableWritebackCaching: true,
+			})
+
+			if err != nil {
+				t.Skipf("Mount: %v", err)
+			}
+
+			unmounted := false
+			defer func() {
+				if !unmounted {
+					fuse.Unmount(dir)
+					mfs.Join(context.Background())
+				}
+			}()
+
+			// Write some data, which the file system acknowledges, and read it
+			// back so that the kernel caches it.
+			p := path.Join(dir, "foo")
+			writeFile(t, p, 0, "taco")
+			if got := readAll(t, p); got != "taco" {
+				t.Fatalf("Read before failure: %q", got)
+			}
+
+			// Later the upload fails, and the application hears about it.
+			fs.failUpload(invalidate)
+
+			select {
+			case e := <-mfs.Errors():
+				if e.Inode != uploadFileInode || e.Path != "foo" || e.Op != "upload" || e.Err != syscall.EIO {
+					t.Errorf("Unexpected error: %#v", e)
+				}
+
+			case <-time.After(10 * time.Second):
+				t.Fatal("Timed out waiting for error")
+			}
+
+			// Unless the pages were invalidated, the kernel carries on serving
+			// data that was never durably written.
+			want := "taco"
+			if invalidate {
+				want = ""
+			}
+
+			if got := readAll(t, p); got != want {
+				t.Errorf("Read after failure: got %q, want %q", got, want)
+			}
+
+			// If nobody is listening, the oldest errors are dropped.
+			fs.mu.Lock()
+			ctx := fs.writeCtx
+			fs.mu.Unlock()
+
+			const extra = 10
+			for i := 0; i < fuse.OpErrorBufferSize+extra; i++ {
+				fuse.ReportError(ctx, fuse.OpError{Op: fmt.Sprint(i)})
+			}
+
+			if n := mfs.DroppedErrors(); n != extra {
+				t.Errorf("DroppedErrors: %d, want %d", n, extra)
+			}
+
+			if e := <-mfs.Errors(); e.Op != fmt.Sprint(extra) {
+				t.Errorf("Oldest remaining error: %v", e)
+			}
+
+			// The channel is closed once the connection is.
+			if err := fuse.Unmount(dir); err != nil {
+				t.Fatalf("Unmount: %v", err)
+			}
+
+			mfs.Join(context.Background())
+			unmounted = true
+
+			for range mfs.Errors() {
+			}
+		})
+	}
+}
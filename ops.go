@@ -31,6 +31,11 @@ type interruptOp struct {
 	FuseID uint64
 }
 
+// Sent by the kernel when it is done with the connection, e.g. when a fuseblk
+// file system is unmounted. Answered once the file system has wound down.
+type destroyOp struct {
+}
+
 // Required in order to mount on Linux and OS X.
 type initOp struct {
 	// In
@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// Prewarm hides first-access latency for a file system whose shape is known
+// in advance (an image or a snapshot, say) by populating the kernel's dentry
+// and attribute caches for the given paths, relative to the mount point,
+// along with each of their ancestors.
+//
+// The kernel offers no way to inject entries into its caches directly, so
+// this works by looking up each path through the mount point with lstat(2),
+// up to concurrency at a time (at least one). The file system sees the
+// lookups as ordinary LookUpInodeOps, and the warming lasts only as long as
+// the entry and attribute expirations it returns. Each lookup
+// also counts towards the inode's lookup count in the usual way.
+//
+// If the file system is mounted with MountConfig.EnableReadDirPlus, each
+// directory among the paths is also opened and read to the end, so that the
+// kernel issues READDIRPLUS and caches the entries and attributes the file
+// system returns for its children, which needn't be listed in paths.
+// Otherwise only the given paths and their ancestors are warmed: the kernel
+// keeps nothing from a plain READDIR that would spare a later lookup.
+//
+// Prewarm must not be called from within an op handler for the same file
+// system. It returns early if ctx is cancelled. Otherwise it looks up every
+// path, returning the first error encountered, if any.
+func (mfs *MountedFileSystem) Prewarm(
+	ctx context.Context,
+	paths []string,
+	concurrency int) error {
+	if mfs.dir == "" {
+		return errors.New("Prewarm: file system has no mount point")
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	plus := mfs.conn.cfg.EnableReadDirPlus
+	todo := make(chan string)
+	var wg sync.WaitGroup
+
+	var mu sync.Mutex
+	var firstErr error // GUARDED_BY(mu)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range todo {
+				var st syscall.Stat_t
+				err := syscall.Lstat(path.Join(mfs.dir, p), &st)
+				if err != nil {
+					err = fmt.Errorf("Lstat(%q): %v", p, err)
+				} else if plus && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+					err = readToEnd(path.Join(mfs.dir, p))
+				}
+
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	var err error
+loop:
+	for _, p := range paths {
+		select {
+		case todo <- p:
+		case <-ctx.Done():
+			err = ctx.Err()
+			break loop
+		}
+	}
+
+	close(todo)
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	return firstErr
+}
+
+// Read the directory at p to the end, discarding the entries.
+func readToEnd(p string) error {
+	fd, err := syscall.Open(p, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return fmt.Errorf("Open(%q): %v", p, err)
+	}
+
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err != nil {
+			return fmt.Errorf("ReadDirent(%q): %v", p, err)
+		}
+
+		if n == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// treeFS
+////////////////////////////////////////////////////////////////////////
+
+// The shape of the tree served by treeFS: the root contains treeDirs
+// directories named dN, each containing treeFiles files named fN.
+const (
+	treeDirs  = 10
+	treeFiles = 20
+)
+
+// Inode IDs for the tree.
+func treeDirInode(i int) fuseops.InodeID {
+	return fuseops.RootInodeID + 1 + fuseops.InodeID(i)
+}
+
+func treeFileInode(i, j int) fuseops.InodeID {
+	return 1000 + fuseops.InodeID(i*treeFiles+j)
+}
+
+// A read-only file system with a fixed tree, which allows everything to be
+// cached for a long time and counts the ops it receives.
+type treeFS struct {
+	fuseutil.NotImplementedFileSystem
+	ops uint64 // Accessed atomically
+}
+
+func (fs *treeFS) count() {
+	atomic.AddUint64(&fs.ops, 1)
+}
+
+func (fs *treeFS) attributes(inode fuseops.InodeID) (
+	attrs fuseops.InodeAttributes,
+	ok bool) {
+	switch {
+	case inode == fuseops.RootInodeID ||
+		inode >= treeDirInode(0) && inode < treeDirInode(treeDirs):
+		return fuseops.InodeAttributes{Nlink: 1, Mode: os.ModeDir | 0555}, true
+
+	case inode >= treeFileInode(0, 0) && inode < treeFileInode(treeDirs, 0):
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0444}, true
+	}
+
+	return attrs, false
+}
+
+func (fs *treeFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.count()
+
+	var i, j int
+	switch {
+	case op.Parent == fuseops.RootInodeID:
+		if _, err := fmt.Sscanf(op.Name, "d%d", &i); err != nil || i >= treeDirs {
+			return fuse.ENOENT
+		}
+
+		op.Entry.Child = treeDirInode(i)
+
+	default:
+		i = int(op.Parent - treeDirInode(0))
+		if i < 0 || i >= treeDirs {
+			return fuse.ENOENT
+		}
+
+		if _, err := fmt.Sscanf(op.Name, "f%d", &j); err != nil || j >= treeFiles {
+			return fuse.ENOENT
+		}
+
+		op.Entry.Child = treeFileInode(i, j)
+	}
+
+	op.Entry.Attributes, _ = fs.attributes(op.Entry.Child)
+	op.Entry.AttributesExpiration = time.Now().Add(time.Hour)
+	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+
+	return nil
+}
+
+func (fs *treeFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.count()
+
+	attrs, ok := fs.attributes(op.Inode)
+	if !ok {
+		return fuse.ENOENT
+	}
+
+	op.Attributes = attrs
+	op.AttributesExpiration = time.Now().Add(time.Hour)
+
+	return nil
+}
+
+func (fs *treeFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.count()
+	return nil
+}
+
+func (fs *treeFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.count()
+
+	var entries []fuseutil.Dirent
+	if op.Inode == fuseops.RootInodeID {
+		for i := 0; i < treeDirs; i++ {
+			entries = append(entries, fuseutil.Dirent{
+				Inode: treeDirInode(i),
+				Name:  fmt.Sprintf("d%d", i),
+				Type:  fuseutil.DT_Directory,
+			})
+		}
+	} else {
+		i := int(op.Inode - treeDirInode(0))
+		for j := 0; j < treeFiles; j++ {
+			entries = append(entries, fuseutil.Dirent{
+				Inode: treeFileInode(i, j),
+				Name:  fmt.Sprintf("f%d", j),
+				Type:  fuseutil.DT_File,
+			})
+		}
+	}
+
+	for k := int(op.Offset); k < len(entries); k++ {
+		entries[k].Offset = fuseops.DirOffset(k + 1)
+
+		var n int
+		if op.Plus {
+			e := &fuseops.ChildInodeEntry{Child: entries[k].Inode}
+			e.Attributes, _ = fs.attributes(e.Child)
+			e.AttributesExpiration = time.Now().Add(time.Hour)
+			e.EntryExpiration = e.AttributesExpiration
+			n = fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], entries[k], e)
+		} else {
+			n = fuseutil.WriteDirent(op.Dst[op.BytesRead:], entries[k])
+		}
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *treeFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	fs.count()
+	return nil
+}
+
+// Every path in the tree.
+func treePaths() (paths []string) {
+	for i := 0; i < treeDirs; i++ {
+		dir := fmt.Sprintf("d%d", i)
+		paths = append(paths, dir)
+		for j := 0; j < treeFiles; j++ {
+			paths = append(paths, path.Join(dir, fmt.Sprintf("f%d", j)))
+		}
+	}
+
+	return paths
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Mount the supplied file system on a new temporary directory, skipping the
+// test if that isn't possible here. The returned function unmounts it.
+func mountTree(
+	tb testing.TB,
+	fs *treeFS) (mfs *fuse.MountedFileSystem, unmount func()) {
+	return mountTreeWithConfig(tb, fs, &fuse.MountConfig{})
+}
+
+// Like mountTree, with the supplied config.
+func mountTreeWithConfig(
+	tb testing.TB,
+	fs *treeFS,
+	cfg *fuse.MountConfig) (mfs *fuse.MountedFileSystem, unmount func()) {
+	dir, err := ioutil.TempDir("", "prewarm_test")
+	if err != nil {
+		tb.Fatalf("TempDir: %v", err)
+	}
+
+	cfg.FSName = "prewarm_test"
+	mfs, err = fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), cfg)
+
+	if err != nil {
+		os.Remove(dir)
+		tb.Skipf("Mount: %v", err)
+	}
+
+	unmount = func() {
+		if err := fuse.Unmount(dir); err != nil {
+			tb.Errorf("Unmount: %v", err)
+			return
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			tb.Errorf("Join: %v", err)
+		}
+
+		os.Remove(dir)
+	}
+
+	return mfs, unmount
+}
+
+// Do the equivalent of `ls -lR` on the given directory, using raw system calls
+// so as not to involve the runtime's poller.
+func listRecursively(tb testing.TB, dir string) {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		tb.Fatalf("Open(%q): %v", dir, err)
+	}
+
+	var names []string
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err != nil {
+			syscall.Close(fd)
+			tb.Fatalf("ReadDirent(%q): %v", dir, err)
+		}
+
+		if n == 0 {
+			break
+		}
+
+		_, _, names = syscall.ParseDirent(buf[:n], -1, names)
+	}
+
+	syscall.Close(fd)
+
+	for _, name := range names {
+		p := path.Join(dir, name)
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(p, &st); err != nil {
+			tb.Fatalf("Lstat(%q): %v", p, err)
+		}
+
+		if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			listRecursively(tb, p)
+		}
+	}
+}
+
+// Mount fs, optionally prewarm it, and return the number of ops the file
+// system receives while listing it recursively. For a benchmark, only the
+// listing is timed.
+func opsForListing(
+	tb testing.TB,
+	fs *treeFS,
+	prewarm bool) uint64 {
+	mfs, unmount := mountTree(tb, fs)
+	defer unmount()
+
+	if prewarm {
+		if err := mfs.Prewarm(context.Background(), treePaths(), 4); err != nil {
+			tb.Fatalf("Prewarm: %v", err)
+		}
+	}
+
+	before := atomic.LoadUint64(&fs.ops)
+	if b, ok := tb.(*testing.B); ok {
+		b.StartTimer()
+		listRecursively(tb, mfs.Dir())
+		b.StopTimer()
+	} else {
+		listRecursively(tb, mfs.Dir())
+	}
+
+	return atomic.LoadUint64(&fs.ops) - before
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func TestPrewarm(t *testing.T) {
+	cold := opsForListing(t, &treeFS{}, false)
+	warm := opsForListing(t, &treeFS{}, true)
+
+	// The cold listing looks up every entry, while the warm one only needs to
+	// read the directories.
+	if warm*2 >= cold {
+		t.Errorf("Listing after Prewarm took %d ops, vs. %d cold", warm, cold)
+	}
+
+	// Prewarming a path that doesn't exist should say so.
+	mfs, unmount := mountTree(t, &treeFS{})
+	defer unmount()
+
+	if err := mfs.Prewarm(context.Background(), []string{"d0", "nope"}, 2); err == nil {
+		t.Error("Prewarm succeeded for a missing path")
+	}
+}
+
+func TestPrewarm_ReadDirPlus(t *testing.T) {
+	fs := &treeFS{}
+	mfs, unmount := mountTreeWithConfig(t, fs, &fuse.MountConfig{
+		EnableReadDirPlus: true,
+	})
+
+	defer unmount()
+
+	// Name only the directories.
+	var dirs []string
+	for i := 0; i < treeDirs; i++ {
+		dirs = append(dirs, fmt.Sprintf("d%d", i))
+	}
+
+	if err := mfs.Prewarm(context.Background(), dirs, 4); err != nil {
+		t.Fatalf("Prewarm: %v", err)
+	}
+
+	// Their children were cached from the listings. (Don't stat the directories
+	// themselves; reading them invalidates their cached atime.)
+	before := atomic.LoadUint64(&fs.ops)
+	for _, p := range treePaths() {
+		if path.Dir(p) == "." {
+			continue
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path.Join(mfs.Dir(), p), &st); err != nil {
+			t.Fatalf("Lstat(%q): %v", p, err)
+		}
+	}
+
+	if ops := atomic.LoadUint64(&fs.ops) - before; ops != 0 {
+		t.Errorf("Stat of every file took %d ops, want 0", ops)
+	}
+}
+
+func benchmarkListing(b *testing.B, prewarm bool) {
+	var ops uint64
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		ops += opsForListing(b, &treeFS{}, prewarm)
+	}
+
+	b.ReportMetric(float64(ops)/float64(b.N), "fsops/listing")
+}
+
+func BenchmarkListing_Cold(b *testing.B) {
+	benchmarkListing(b, false)
+}
+
+func BenchmarkListing_Prewarmed(b *testing.B) {
+	benchmarkListing(b, true)
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"math"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Return the error with which op should be failed without involving the user
+// because the range of the file it refers to can't be represented as an
+// off_t, or zero if it can. Offsets and sizes the kernel passes as unsigned
+// but which are negative as an off_t are rejected with EINVAL, and
+// allocations ending past the largest offset with EFBIG.
+//
+// Reads, writes and copies that merely run past the largest offset are trimmed
+// to end there, so that file systems needn't worry about Offset+len(Dst),
+// Offset+len(Data) or either offset plus Length overflowing. A write that is trimmed is reported to the
+// kernel as a short one, as pwrite(2) does at the limit of the file size; a
+// write at the largest offset itself fails with EFBIG.
+func rangeError(op interface{}) syscall.Errno {
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		if o.Offset < 0 {
+			return syscall.EINVAL
+		}
+
+		if max := math.MaxInt64 - o.Offset; int64(len(o.Dst)) > max {
+			o.Dst = o.Dst[:max]
+		}
+
+	case *fuseops.WriteFileOp:
+		if o.Offset < 0 {
+			return syscall.EINVAL
+		}
+
+		max := math.MaxInt64 - o.Offset
+		if len(o.Data) > 0 && max == 0 {
+			return syscall.EFBIG
+		}
+
+		if int64(len(o.Data)) > max {
+			o.Data = o.Data[:max]
+		}
+
+	case *fuseops.FallocateOp:
+		if o.Offset > math.MaxInt64 || o.Length > math.MaxInt64 {
+			return syscall.EINVAL
+		}
+
+		if o.Length > math.MaxInt64-o.Offset {
+			return syscall.EFBIG
+		}
+
+	case *fuseops.LseekOp:
+		if o.Whence != fuseops.SeekData && o.Whence != fuseops.SeekHole {
+			return syscall.EINVAL
+		}
+
+		if o.Offset < 0 {
+			return syscall.ENXIO
+		}
+
+	case *fuseops.CopyFileRangeOp:
+		if o.SrcOffset < 0 || o.DstOffset < 0 {
+			return syscall.EINVAL
+		}
+
+		for _, off := range []int64{o.SrcOffset, o.DstOffset} {
+			if max := uint64(math.MaxInt64 - off); o.Length > max {
+				o.Length = max
+			}
+		}
+
+	case *fuseops.SetInodeAttributesOp:
+		if o.Size != nil && *o.Size > math.MaxInt64 {
+			return syscall.EINVAL
+		}
+	}
+
+	return 0
+}
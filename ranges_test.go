@@ -0,0 +1,302 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system that records the ranges of the reads, writes and allocations
+// it is given, noting those that it shouldn't have been.
+type rangeFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu   sync.Mutex
+	ops  []string // GUARDED_BY(mu)
+	errs []string // GUARDED_BY(mu)
+}
+
+// Record an op with the given name and range, complaining if the range is
+// invalid.
+func (fs *rangeFS) record(
+	name string,
+	offset int64,
+	size int) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ops = append(fs.ops, fmt.Sprintf("%s %d +%d", name, offset, size))
+	if offset < 0 || int64(size) > math.MaxInt64-offset {
+		fs.errs = append(fs.errs, fs.ops[len(fs.ops)-1])
+	}
+
+	if size > fusetesting.MaxReadSize && name == "read" {
+		fs.errs = append(fs.errs, fs.ops[len(fs.ops)-1])
+	}
+}
+
+// Return and forget the ops recorded so far, and any invalid ones among them.
+func (fs *rangeFS) take() (ops []string, errs []string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	ops, errs = fs.ops, fs.errs
+	fs.ops, fs.errs = nil, nil
+	return ops, errs
+}
+
+func (fs *rangeFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *rangeFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.record("read", op.Offset, len(op.Dst))
+	op.BytesRead = len(op.Dst)
+	return nil
+}
+
+func (fs *rangeFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.record("write", op.Offset, len(op.Data))
+	return nil
+}
+
+func (fs *rangeFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fs.record("fallocate", int64(op.Offset), int(op.Length))
+	return nil
+}
+
+// Set up a fake kernel serving a rangeFS, with a file open on inode 2.
+func newRangeKernel(tb testing.TB) (
+	k *fusetesting.FakeKernel,
+	fs *rangeFS,
+	h fuseops.HandleID) {
+	fs = &rangeFS{}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		tb.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	h, err = k.Open(2)
+	if err != nil {
+		k.Close()
+		tb.Fatalf("Open: %v", err)
+	}
+
+	return k, fs, h
+}
+
+// Send a read with the given raw offset and size, bypassing the checks made
+// by FakeKernel.Read, and return the number of bytes in the reply. Servers
+// speaking older protocol versions ignore the fields they don't know.
+func rawRead(
+	k *fusetesting.FakeKernel,
+	h fuseops.HandleID,
+	offset uint64,
+	size uint32) (int, error) {
+	in := fusekernel.ReadIn{
+		Fh:     uint64(h),
+		Offset: offset,
+		Size:   size,
+	}
+
+	inBytes := (*[unsafe.Sizeof(fusekernel.ReadIn{})]byte)(unsafe.Pointer(&in))
+	out, err := k.Call(fusekernel.OpRead, 2, inBytes[:])
+
+	return len(out), err
+}
+
+func rawFallocate(
+	k *fusetesting.FakeKernel,
+	h fuseops.HandleID,
+	offset uint64,
+	length uint64) error {
+	in := fusekernel.FallocateIn{
+		Fh:     uint64(h),
+		Offset: offset,
+		Length: length,
+	}
+
+	inBytes := (*[unsafe.Sizeof(fusekernel.FallocateIn{})]byte)(unsafe.Pointer(&in))
+	_, err := k.Call(fusekernel.OpFallocate, 2, inBytes[:])
+	return err
+}
+
+func TestRanges_NearLargestOffset(t *testing.T) {
+	k, fs, h := newRangeKernel(t)
+	defer k.Close()
+
+	// 2^63-4096, leaving room for 4095 bytes.
+	const offset = 1<<63 - 4096
+
+	// A read straddling the largest offset is trimmed to end there.
+	n, err := rawRead(k, h, offset, 8192)
+	if err != nil || n != 4095 {
+		t.Errorf("Read: got (%d, %v), want 4095 bytes", n, err)
+	}
+
+	// As is a write, which the kernel is told was short.
+	written, err := k.Write(2, h, offset, make([]byte, 8192))
+	if err != nil || written != 4095 {
+		t.Errorf("Write: got (%d, %v), want 4095 bytes", written, err)
+	}
+
+	// Nothing at all may be written at the largest offset.
+	if _, err := k.Write(2, h, math.MaxInt64, []byte("x")); err != syscall.EFBIG {
+		t.Errorf("Write at the largest offset: got %v, want EFBIG", err)
+	}
+
+	ops, errs := fs.take()
+	want := []string{
+		fmt.Sprintf("read %d +4095", int64(offset)),
+		fmt.Sprintf("write %d +4095", int64(offset)),
+	}
+
+	if fmt.Sprint(ops) != fmt.Sprint(want) || errs != nil {
+		t.Errorf("Ops: got %q (invalid: %q), want %q", ops, errs, want)
+	}
+}
+
+func TestRanges_Negative(t *testing.T) {
+	k, fs, h := newRangeKernel(t)
+	defer k.Close()
+
+	if _, err := rawRead(k, h, 1<<63, 4096); err != syscall.EINVAL {
+		t.Errorf("Read: got %v, want EINVAL", err)
+	}
+
+	if _, err := k.Write(2, h, -4096, make([]byte, 4096)); err != syscall.EINVAL {
+		t.Errorf("Write: got %v, want EINVAL", err)
+	}
+
+	if err := rawFallocate(k, h, 1<<63, 1); err != syscall.EINVAL {
+		t.Errorf("Fallocate: got %v, want EINVAL", err)
+	}
+
+	if err := rawFallocate(k, h, math.MaxInt64-10, 20); err != syscall.EFBIG {
+		t.Errorf("Fallocate past the largest offset: got %v, want EFBIG", err)
+	}
+
+	if ops, _ := fs.take(); ops != nil {
+		t.Errorf("The file system was given %q", ops)
+	}
+}
+
+func TestRanges_OversizedRead(t *testing.T) {
+	k, fs, h := newRangeKernel(t)
+	defer k.Close()
+
+	// The connection survives a read it has no room for, answering it short.
+	n, err := rawRead(k, h, 0, 4*fusetesting.MaxReadSize)
+	if err != nil || n != fusetesting.MaxReadSize {
+		t.Errorf("Read: got (%d, %v), want %d bytes", n, err, fusetesting.MaxReadSize)
+	}
+
+	if n, err := rawRead(k, h, 0, 1); err != nil || n != 1 {
+		t.Errorf("Second read: got (%d, %v)", n, err)
+	}
+
+	if _, errs := fs.take(); errs != nil {
+		t.Errorf("Invalid ops: %q", errs)
+	}
+}
+
+func FuzzRanges(f *testing.F) {
+	for _, offset := range []uint64{
+		0,
+		4096,
+		1<<63 - 8192,
+		1<<63 - 4096,
+		1<<63 - 1,
+		1 << 63,
+		1<<64 - 4096,
+		1<<64 - 1,
+	} {
+		for _, size := range []uint32{0, 1, 4096, 8192, fusetesting.MaxReadSize + 1, math.MaxUint32} {
+			f.Add(offset, size)
+		}
+	}
+
+	k, fs, h := newRangeKernel(f)
+	defer k.Close()
+
+	f.Fuzz(func(t *testing.T, offset uint64, size uint32) {
+		negative := offset > math.MaxInt64
+		room := uint64(math.MaxInt64) - offset
+
+		// Reads.
+		n, err := rawRead(k, h, offset, size)
+		switch {
+		case negative:
+			if err != syscall.EINVAL {
+				t.Errorf("Read(%d, %d): got %v, want EINVAL", offset, size, err)
+			}
+
+		case err != nil:
+			t.Errorf("Read(%d, %d): %v", offset, size, err)
+
+		case uint64(n) > room || n > fusetesting.MaxReadSize || n > int(size):
+			t.Errorf("Read(%d, %d): got %d bytes", offset, size, n)
+		}
+
+		// Writes.
+		data := make([]byte, int(size)%(buffer.MaxWriteSize+1))
+		written, err := k.Write(2, h, int64(offset), data)
+		switch {
+		case negative:
+			if err != syscall.EINVAL {
+				t.Errorf("Write(%d, %d): got %v, want EINVAL", offset, len(data), err)
+			}
+
+		case room == 0 && len(data) > 0:
+			if err != syscall.EFBIG {
+				t.Errorf("Write(%d, %d): got %v, want EFBIG", offset, len(data), err)
+			}
+
+		case err != nil:
+			t.Errorf("Write(%d, %d): %v", offset, len(data), err)
+
+		case uint64(written) > room || written > len(data):
+			t.Errorf("Write(%d, %d): got %d bytes", offset, len(data), written)
+		}
+
+		if _, errs := fs.take(); errs != nil {
+			t.Errorf("Invalid ops: %q", errs)
+		}
+	})
+}
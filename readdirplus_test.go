@@ -0,0 +1,441 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The number of files in the root of a halfCachedFS.
+const halfCachedFiles = 20
+
+// A file system whose root holds halfCachedFiles files, of which it supplies
+// attributes in listings only for the even-numbered ones, as a file system
+// with only some attributes cached might. It records the lookups it sees.
+type halfCachedFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	lookups []string // GUARDED_BY(mu)
+	plus    bool     // GUARDED_BY(mu)
+}
+
+func (fs *halfCachedFS) entry(i int) fuseops.ChildInodeEntry {
+	return fuseops.ChildInodeEntry{
+		Child: fuseops.InodeID(fuseops.RootInodeID + 1 + i),
+		Attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0644,
+			Size:  uint64(i),
+		},
+		AttributesValidFor: time.Hour,
+		EntryValidFor:      time.Hour,
+	}
+}
+
+func (fs *halfCachedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if op.Inode != fuseops.RootInodeID {
+		op.Attributes = fs.entry(int(op.Inode - fuseops.RootInodeID - 1)).Attributes
+		return nil
+	}
+
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0755 | os.ModeDir,
+	}
+
+	return nil
+}
+
+func (fs *halfCachedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	var i int
+	if _, err := fmt.Sscanf(op.Name, "f%d", &i); err != nil || i >= halfCachedFiles {
+		return fuse.ENOENT
+	}
+
+	fs.mu.Lock()
+	fs.lookups = append(fs.lookups, op.Name)
+	fs.mu.Unlock()
+
+	op.Entry = fs.entry(i)
+	return nil
+}
+
+func (fs *halfCachedFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *halfCachedFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	fs.plus = fs.plus || op.Plus
+	fs.mu.Unlock()
+
+	rest, ok := fuseutil.EmitDotEntries(op, fuseops.RootInodeID, fuseops.RootInodeID)
+	if !ok {
+		return nil
+	}
+
+	for i := int(rest); i < halfCachedFiles; i++ {
+		e := fs.entry(i)
+		d := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1 + fuseutil.DotEntryCount),
+			Inode:  e.Child,
+			Name:   fmt.Sprintf("f%d", i),
+			Type:   fuseutil.DT_File,
+		}
+
+		var n int
+		switch {
+		case !op.Plus:
+			n = fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+		case i%2 == 0:
+			n = fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], d, &e)
+		default:
+			n = fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], d, nil)
+		}
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+// Return the sorted names of the children of the directory at p, read with
+// getdents(2).
+func listNames(t testing.TB, p string) (names []string) {
+	fd, err := syscall.Open(p, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", p, err)
+	}
+
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err != nil {
+			t.Fatalf("ReadDirent: %v", err)
+		}
+
+		if n == 0 {
+			sort.Strings(names)
+			return names
+		}
+
+		_, _, names = syscall.ParseDirent(buf[:n], -1, names)
+	}
+}
+
+func TestReadDirPlus_HalfCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "readdirplus_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	fs := &halfCachedFS{}
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:            "readdirplus_test",
+		EnableReadDirPlus: true,
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		fuse.Unmount(dir)
+		mfs.Join(context.Background())
+	}()
+
+	// Every entry is listed, whether or not it carried attributes.
+	var want []string
+	for i := 0; i < halfCachedFiles; i++ {
+		want = append(want, fmt.Sprintf("f%d", i))
+	}
+
+	sort.Strings(want)
+	if got := listNames(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("Listing:\n got %q\nwant %q", got, want)
+	}
+
+	fs.mu.Lock()
+	plus := fs.plus
+	fs.mu.Unlock()
+
+	if !plus {
+		t.Skip("Kernel doesn't support READDIRPLUS")
+	}
+
+	// "." and ".." are still there, and the types agree with the attributes.
+	if err := fusetesting.CheckDotEntries(dir, true); err != nil {
+		t.Errorf("CheckDotEntries: %v", err)
+	}
+
+	if err := fusetesting.CheckDirentTypes(dir, false); err != nil {
+		t.Errorf("CheckDirentTypes: %v", err)
+	}
+
+	// Each child has the attributes the file system supplies for it, whichever
+	// way they reached the kernel.
+	for i := 0; i < halfCachedFiles; i++ {
+		var st syscall.Stat_t
+		p := path.Join(dir, fmt.Sprintf("f%d", i))
+		if err := syscall.Lstat(p, &st); err != nil {
+			t.Fatalf("Lstat(%q): %v", p, err)
+		}
+
+		if st.Size != int64(i) {
+			t.Errorf("%q has size %d, want %d", p, st.Size, i)
+		}
+	}
+
+	// Only the children listed without attributes were looked up, once each.
+	want = nil
+	for i := 1; i < halfCachedFiles; i += 2 {
+		want = append(want, fmt.Sprintf("f%d", i))
+	}
+
+	sort.Strings(want)
+
+	fs.mu.Lock()
+	got := append([]string(nil), fs.lookups...)
+	fs.mu.Unlock()
+
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Lookups:\n got %q\nwant %q", got, want)
+	}
+}
+
+// A file system whose root holds the given number of files, all of whose
+// attributes it supplies in listings. It counts the lookups it sees.
+type wideFS struct {
+	fuseutil.NotImplementedFileSystem
+	files int
+
+	lookups uint64 // Accessed atomically
+	plus    uint32 // Accessed atomically; non-zero once READDIRPLUS is seen
+}
+
+func (fs *wideFS) entry(i int) fuseops.ChildInodeEntry {
+	return fuseops.ChildInodeEntry{
+		Child: fuseops.InodeID(fuseops.RootInodeID + 1 + i),
+		Attributes: fuseops.InodeAttributes{
+			Nlink: 1,
+			Mode:  0644,
+		},
+		AttributesValidFor: time.Hour,
+		EntryValidFor:      time.Hour,
+	}
+}
+
+func (fs *wideFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if op.Inode != fuseops.RootInodeID {
+		op.Attributes = fs.entry(int(op.Inode - fuseops.RootInodeID - 1)).Attributes
+		return nil
+	}
+
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0755 | os.ModeDir,
+	}
+
+	return nil
+}
+
+func (fs *wideFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	var i int
+	if _, err := fmt.Sscanf(op.Name, "f%d", &i); err != nil || i >= fs.files {
+		return fuse.ENOENT
+	}
+
+	atomic.AddUint64(&fs.lookups, 1)
+	op.Entry = fs.entry(i)
+	return nil
+}
+
+func (fs *wideFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *wideFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Plus {
+		atomic.StoreUint32(&fs.plus, 1)
+	}
+
+	rest, ok := fuseutil.EmitDotEntries(op, fuseops.RootInodeID, fuseops.RootInodeID)
+	if !ok {
+		return nil
+	}
+
+	for i := int(rest); i < fs.files; i++ {
+		e := fs.entry(i)
+		d := fuseutil.Dirent{
+			Offset: fuseops.DirOffset(i + 1 + fuseutil.DotEntryCount),
+			Inode:  e.Child,
+			Name:   fmt.Sprintf("f%d", i),
+			Type:   fuseutil.DT_File,
+		}
+
+		var n int
+		if op.Plus {
+			n = fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], d, &e)
+		} else {
+			n = fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+		}
+
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+// Mount a fresh wideFS with the given number of files, list it and stat each
+// child as ls -l does, and return the number of lookups the listing took. The
+// second result is false if plus was requested but the kernel didn't send
+// READDIRPLUS.
+func lookupsForListing(
+	tb testing.TB,
+	files int,
+	plus bool) (lookups uint64, ok bool) {
+	dir, err := ioutil.TempDir("", "readdirplus_test")
+	if err != nil {
+		tb.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	fs := &wideFS{files: files}
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:            "readdirplus_test",
+		EnableReadDirPlus: plus,
+	})
+
+	if err != nil {
+		tb.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		fuse.Unmount(dir)
+		mfs.Join(context.Background())
+	}()
+
+	b, _ := tb.(*testing.B)
+	if b != nil {
+		b.StartTimer()
+	}
+
+	names := listNames(tb, dir)
+	for _, name := range names {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path.Join(dir, name), &st); err != nil {
+			tb.Fatalf("Lstat(%q): %v", name, err)
+		}
+	}
+
+	if b != nil {
+		b.StopTimer()
+	}
+
+	if len(names) != files {
+		tb.Fatalf("Listed %d children, want %d", len(names), files)
+	}
+
+	return atomic.LoadUint64(&fs.lookups), !plus || atomic.LoadUint32(&fs.plus) != 0
+}
+
+func TestReadDirPlus_SavesLookups(t *testing.T) {
+	const files = 1000
+
+	// Without READDIRPLUS, each child is looked up once.
+	if lookups, _ := lookupsForListing(t, files, false); lookups != files {
+		t.Errorf("READDIR listing took %d lookups, want %d", lookups, files)
+	}
+
+	// With it, the listing supplies them all.
+	lookups, ok := lookupsForListing(t, files, true)
+	if !ok {
+		t.Skip("Kernel doesn't support READDIRPLUS")
+	}
+
+	if lookups != 0 {
+		t.Errorf("READDIRPLUS listing took %d lookups, want 0", lookups)
+	}
+}
+
+func benchmarkWideListing(b *testing.B, plus bool) {
+	var lookups uint64
+	b.StopTimer()
+	for i := 0; i < b.N; i++ {
+		n, ok := lookupsForListing(b, 10000, plus)
+		if !ok {
+			b.Skip("Kernel doesn't support READDIRPLUS")
+		}
+
+		lookups += n
+	}
+
+	b.ReportMetric(float64(lookups)/float64(b.N), "lookups/listing")
+}
+
+func BenchmarkWideListing_ReadDir(b *testing.B) {
+	benchmarkWideListing(b, false)
+}
+
+func BenchmarkWideListing_ReadDirPlus(b *testing.B) {
+	benchmarkWideListing(b, true)
+}
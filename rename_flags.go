@@ -0,0 +1,27 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Return whether op is a rename with renameat2(2) flags beyond those set by
+// MountConfig.RenameFlags, in which case it should be failed with EINVAL
+// without involving the user.
+func (c *Connection) renameFlagsUnsupported(op interface{}) bool {
+	o, ok := op.(*fuseops.RenameOp)
+	return ok && o.Flags&^c.cfg.RenameFlags != 0
+}
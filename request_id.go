@@ -0,0 +1,37 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import "context"
+
+// RequestIDFromContext returns the kernel's ID for the request that became the
+// op associated with ctx, i.e. fuse_in_header::unique. This is the ID that
+// appears in the connection's debug and error logs, and in the kernel's own
+// FUSE tracing, so file systems can include it in their logs or in requests
+// to a backend to tie them together.
+//
+// The kernel doesn't reuse IDs within the life of a connection, so a file
+// system that deduplicates or retries work may key on the ID, combined with
+// MountInfo.ID if it is served on several connections. ctx must be, or be
+// derived from, a context returned by Connection.ReadOp; otherwise ok is
+// false.
+func RequestIDFromContext(ctx context.Context) (id uint64, ok bool) {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return 0, false
+	}
+
+	return state.inMsg.Header().Unique, true
+}
@@ -0,0 +1,164 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A connection may be handed from one process to another without unmounting,
+// so that a file system can be restarted, e.g. to upgrade it, without the
+// applications using it noticing anything but a pause:
+//
+//  1. The old process calls MountedFileSystem.Detach. ReadOp reads nothing
+//     more; the ops already read are served and replied to as usual, and
+//     Join returns once they have been. The device is left open.
+//
+//  2. The old process hands the device to the new one, e.g. as one of
+//     exec.Cmd.ExtraFiles or over a unix socket with syscall.UnixRights,
+//     together with the ConnectionState returned by Connection.State. In the
+//     meantime the kernel queues its requests.
+//
+//  3. The new process calls Serve with the device and MountConfig.Resume set
+//     to the state, and serves the queued requests.
+//
+// Inode and handle IDs issued by the old process are still cached by the
+// kernel, so the new process must understand them. Those chosen by the file
+// system are its own business; see fuseutil.ResumableServer for the tables
+// kept by fuseutil's servers.
+
+// ConnectionState records what a connection agreed with the kernel when it
+// was initialized. A process taking over the connection must know it, since
+// the kernel doesn't send its init request again. See MountConfig.Resume.
+type ConnectionState struct {
+	// The version of the protocol in use.
+	ProtocolMajor uint32
+	ProtocolMinor uint32
+
+	// Whether the kernel agreed to no-open and no-opendir support.
+	NoOpen    bool
+	NoOpendir bool
+
+	// The optional features agreed on. See MountInfo.Features.
+	Features InitFeatures
+}
+
+// State returns what the connection agreed with the kernel at init.
+func (c *Connection) State() ConnectionState {
+	return ConnectionState{
+		ProtocolMajor: c.protocol.Major,
+		ProtocolMinor: c.protocol.Minor,
+		NoOpen:        c.noOpen,
+		NoOpendir:     c.noOpendir,
+		Features:      c.mountInfo.Features,
+	}
+}
+
+// Set up the connection to carry on where another process left off, in place
+// of Init.
+func (c *Connection) resume(st ConnectionState) error {
+	p := fusekernel.Protocol{st.ProtocolMajor, st.ProtocolMinor}
+	min := fusekernel.Protocol{
+		fusekernel.ProtoVersionMinMajor,
+		fusekernel.ProtoVersionMinMinor,
+	}
+
+	max := fusekernel.Protocol{
+		fusekernel.ProtoVersionMaxMajor,
+		fusekernel.ProtoVersionMaxMinor,
+	}
+
+	if p.LT(min) || max.LT(p) {
+		return fmt.Errorf("Unsupported protocol version %v", p)
+	}
+
+	c.protocol = p
+	c.noOpen = st.NoOpen
+	c.noOpendir = st.NoOpendir
+	c.mountInfo.Features = st.Features
+
+	return nil
+}
+
+// Detached reports whether reading from the connection stopped because of
+// MountedFileSystem.Detach, with the kernel still connected, so that the
+// connection may be taken over by another process. Servers should check it
+// when ReadOp returns io.EOF, to tell a handover from the kernel hanging up.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) Detached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.detached && !c.hungUp
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) isDetached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.detached
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) detach() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.detached = true
+	c.wakeParked()
+}
+
+// Detach stops serving the file system without unmounting it, so that
+// another process can take over the connection, and returns the still open
+// device for handing to it. See the notes at the top of resume.go.
+//
+// Nothing more is read from the kernel once the read in progress returns.
+// To hurry that along, Detach asks the kernel for the file system's
+// statistics, which it always sends on to the file system; the request is
+// answered by whichever process reads it. Without a mount point (see Serve)
+// Detach waits for the kernel's next request to arrive. It then waits for the
+// ops already read to be replied to, and for the server to return from
+// ServeOps, as for Join.
+//
+// If the kernel hangs up first, the device is closed as usual and an error
+// returned. If ctx is cancelled first, the connection stays detached, and
+// Join can still be used to wait for it.
+func (mfs *MountedFileSystem) Detach(ctx context.Context) (*os.File, error) {
+	mfs.conn.detach()
+	if mfs.dir != "" {
+		go func() {
+			var st syscall.Statfs_t
+			syscall.Statfs(mfs.dir, &st)
+		}()
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		return nil, err
+	}
+
+	if !mfs.conn.Detached() {
+		return nil, errors.New("The kernel hung up before the connection was detached")
+	}
+
+	return mfs.conn.dev, nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cachingfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/cachingfs"
+)
+
+// Mount a caching file system with the given entry timeout, stat foo the
+// given number of times, and return the cache statistics.
+func statFoo(
+	t *testing.T,
+	lookupEntryTimeout time.Duration,
+	n int) fuse.CacheStats {
+	dir, err := ioutil.TempDir("", "cache_stats_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	fs, err := cachingfs.NewCachingFS(lookupEntryTimeout, 0)
+	if err != nil {
+		t.Fatalf("NewCachingFS: %v", err)
+	}
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{FSName: "cachingfs"})
+
+	if err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		mfs.Join(context.Background())
+	}()
+
+	before := mfs.CacheStats()
+	for i := 0; i < n; i++ {
+		if _, err := os.Stat(path.Join(dir, "foo")); err != nil {
+			t.Fatalf("Stat: %v", err)
+		}
+	}
+
+	after := mfs.CacheStats()
+
+	return fuse.CacheStats{
+		LookUps:  after.LookUps - before.LookUps,
+		GetAttrs: after.GetAttrs - before.GetAttrs,
+	}
+}
+
+func TestCacheStats_EntryTimeout(t *testing.T) {
+	const n = 10
+
+	// Without caching, every stat looks foo up afresh.
+	uncached := statFoo(t, 0, n)
+	if uncached.LookUps < n {
+		t.Errorf("With no entry timeout: %d lookups for %d stats", uncached.LookUps, n)
+	}
+
+	// With it, the kernel answers all but the first from its cache. The
+	// attributes aren't cacheable either way, so the getattr rate is the
+	// baseline.
+	cached := statFoo(t, time.Hour, n)
+	if cached.LookUps != 1 {
+		t.Errorf("With an hour's entry timeout: %d lookups for %d stats", cached.LookUps, n)
+	}
+
+	if cached.GetAttrs == 0 {
+		t.Errorf("With an hour's entry timeout: no getattrs for %d stats", n)
+	}
+}
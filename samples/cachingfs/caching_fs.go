@@ -42,12 +42,14 @@ const (
 //
 // The file system is configured with durations that specify how long to allow
 // inode entries and attributes to be cached, used when responding to fuse
-// requests. It also exposes methods for renumbering inodes and updating mtimes
-// that are useful in testing that these durations are honored.
+// requests. It also exposes methods for renumbering inodes, updating mtimes,
+// and renaming foo behind the kernel's back that are useful in testing that
+// these durations are honored.
 //
 // Each file responds to reads with random contents. SetKeepCache can be used
 // to control whether the response to OpenFileOp tells the kernel to keep the
-// file's data in the page cache or not.
+// file's data in the page cache or not, and SetCacheDir does the same for
+// directory entries and OpenDirOp.
 type CachingFS interface {
 	fuseutil.FileSystem
 
@@ -59,6 +61,10 @@ type CachingFS interface {
 	// Cause the inode IDs to change to values that have never before been used.
 	RenumberInodes()
 
+	// Change the name by which foo is found in the root directory, without
+	// telling the kernel.
+	RenameFoo(name string)
+
 	// Cause further queries for the attributes of inodes to use the supplied
 	// time as the inode's mtime.
 	SetMtime(mtime time.Time)
@@ -66,15 +72,19 @@ type CachingFS interface {
 	// Instruct the file system whether or not to reply to OpenFileOp with
 	// FOPEN_KEEP_CACHE set.
 	SetKeepCache(keep bool)
+
+	// Instruct the file system whether or not to reply to OpenDirOp with
+	// FOPEN_CACHE_DIR and FOPEN_KEEP_CACHE set.
+	SetCacheDir(cache bool)
 }
 
 // Create a file system that issues cacheable responses according to the
 // following rules:
 //
-//  *  LookUpInodeResponse.Entry.EntryExpiration is set according to
+//  *  LookUpInodeOp.Entry.EntryValidFor is set according to
 //     lookupEntryTimeout.
 //
-//  *  GetInodeAttributesResponse.AttributesExpiration is set according to
+//  *  GetInodeAttributesOp.AttributesValidFor is set according to
 //     getattrTimeout.
 //
 //  *  Nothing else is marked cacheable. (In particular, the attributes
@@ -91,6 +101,7 @@ func NewCachingFS(
 		lookupEntryTimeout: lookupEntryTimeout,
 		getattrTimeout:     getattrTimeout,
 		baseID:             roundUp(fuseops.RootInodeID + 1),
+		fooName:            "foo",
 		mtime:              time.Now(),
 	}
 
@@ -127,6 +138,9 @@ type cachingFS struct {
 	// GUARDED_BY(mu)
 	keepPageCache bool
 
+	// GUARDED_BY(mu)
+	cacheDir bool
+
 	// The current ID of the lowest numbered non-root inode.
 	//
 	// INVARIANT: baseID > fuseops.RootInodeID
@@ -137,6 +151,11 @@ type cachingFS struct {
 
 	// GUARDED_BY(mu)
 	mtime time.Time
+
+	// The name of foo within the root directory.
+	//
+	// GUARDED_BY(mu)
+	fooName string
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -203,6 +222,39 @@ func (fs *cachingFS) barAttrs() fuseops.InodeAttributes {
 	}
 }
 
+// LOCKS_REQUIRED(fs.mu)
+func (fs *cachingFS) dirents(dir fuseops.InodeID) []fuseutil.Dirent {
+	switch {
+	case dir == fuseops.RootInodeID:
+		return []fuseutil.Dirent{
+			fuseutil.Dirent{
+				Offset: 1,
+				Inode:  fs.fooID(),
+				Name:   fs.fooName,
+				Type:   fuseutil.DT_File,
+			},
+			fuseutil.Dirent{
+				Offset: 2,
+				Inode:  fs.dirID(),
+				Name:   "dir",
+				Type:   fuseutil.DT_Directory,
+			},
+		}
+
+	case dir%numInodes == dirOffset:
+		return []fuseutil.Dirent{
+			fuseutil.Dirent{
+				Offset: 1,
+				Inode:  fs.barID(),
+				Name:   "bar",
+				Type:   fuseutil.DT_File,
+			},
+		}
+	}
+
+	return nil
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Public interface
 ////////////////////////////////////////////////////////////////////////
@@ -239,6 +291,14 @@ func (fs *cachingFS) RenumberInodes() {
 	fs.baseID += numInodes
 }
 
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFS) RenameFoo(name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.fooName = name
+}
+
 // LOCKS_EXCLUDED(fs.mu)
 func (fs *cachingFS) SetMtime(mtime time.Time) {
 	fs.mu.Lock()
@@ -255,6 +315,14 @@ func (fs *cachingFS) SetKeepCache(keep bool) {
 	fs.keepPageCache = keep
 }
 
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFS) SetCacheDir(cache bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.cacheDir = cache
+}
+
 ////////////////////////////////////////////////////////////////////////
 // FileSystem methods
 ////////////////////////////////////////////////////////////////////////
@@ -277,7 +345,7 @@ func (fs *cachingFS) LookUpInode(
 	var attrs fuseops.InodeAttributes
 
 	switch op.Name {
-	case "foo":
+	case fs.fooName:
 		// Parent must be the root.
 		if op.Parent != fuseops.RootInodeID {
 			return fuse.ENOENT
@@ -311,7 +379,7 @@ func (fs *cachingFS) LookUpInode(
 	// Fill in the response.
 	op.Entry.Child = id
 	op.Entry.Attributes = attrs
-	op.Entry.EntryExpiration = time.Now().Add(fs.lookupEntryTimeout)
+	op.Entry.EntryValidFor = fs.lookupEntryTimeout
 
 	return nil
 }
@@ -342,14 +410,53 @@ func (fs *cachingFS) GetInodeAttributes(
 
 	// Fill in the response.
 	op.Attributes = attrs
-	op.AttributesExpiration = time.Now().Add(fs.getattrTimeout)
+	op.AttributesValidFor = fs.getattrTimeout
 
 	return nil
 }
 
+// LOCKS_EXCLUDED(fs.mu)
 func (fs *cachingFS) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	op.CacheDir = fs.cacheDir
+	op.KeepCache = fs.cacheDir
+
+	return nil
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *cachingFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	entries := fs.dirents(op.Inode)
+	if entries == nil {
+		return fuse.EIO
+	}
+
+	// Grab the range of interest.
+	if op.Offset > fuseops.DirOffset(len(entries)) {
+		return fuse.EIO
+	}
+
+	entries = entries[op.Offset:]
+
+	// Resume at the specified offset into the array.
+	for _, e := range entries {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
 	return nil
 }
 
@@ -367,7 +474,26 @@ func (fs *cachingFS) OpenFile(
 func (fs *cachingFS) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) error {
+	// Don't return more than the file's size, which would be inconsistent with
+	// its attributes. IDs from before renumbering keep their offsets.
+	var size int64
+	switch op.Inode % numInodes {
+	case fooOffset:
+		size = FooSize
+	case barOffset:
+		size = BarSize
+	}
+
+	dst := op.Dst
+	if remaining := size - op.Offset; remaining < int64(len(dst)) {
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		dst = dst[:remaining]
+	}
+
 	var err error
-	op.BytesRead, err = io.ReadFull(rand.Reader, op.Dst)
+	op.BytesRead, err = io.ReadFull(rand.Reader, dst)
 	return err
 }
@@ -24,6 +24,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/fuse/samples"
 	"github.com/jacobsa/fuse/samples/cachingfs"
@@ -723,3 +725,111 @@ func (t *PageCacheTest) TwoFileHandles_KeepCache() {
 
 	ExpectTrue(bytes.Equal(c1, c3))
 }
+
+////////////////////////////////////////////////////////////////////////
+// Invalidation
+////////////////////////////////////////////////////////////////////////
+
+type InvalidationTest struct {
+	cachingFSTest
+}
+
+var _ SetUpInterface = &InvalidationTest{}
+
+func init() { RegisterTestSuite(&InvalidationTest{}) }
+
+func (t *InvalidationTest) SetUp(ti *TestInfo) {
+	const (
+		lookupEntryTimeout = 10000 * time.Hour
+		getattrTimeout     = 10000 * time.Hour
+	)
+
+	t.cachingFSTest.setUp(ti, lookupEntryTimeout, getattrTimeout)
+}
+
+func (t *InvalidationTest) RenameWithoutInvalidation() {
+	_, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	t.fs.RenameFoo("taco")
+
+	// The kernel should keep serving the cached entry for the old name.
+	_, err = os.Stat(path.Join(t.Dir, "foo"))
+	ExpectEq(nil, err)
+}
+
+func (t *InvalidationTest) InvalidateRename() {
+	// Cache the entry for the old name, and a negative entry for the new one.
+	_, err := os.Stat(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.Dir, "taco"))
+	AssertTrue(os.IsNotExist(err), "err: %v", err)
+
+	// Rename behind the kernel's back, then tell it about the rename.
+	t.fs.RenameFoo("taco")
+
+	err = <-t.MountedFileSystem().InvalidateRename(
+		fuseops.RootInodeID,
+		"foo",
+		fuseops.RootInodeID,
+		"taco",
+		t.fs.FooID())
+
+	AssertEq(nil, err)
+
+	// The file should be gone from the old name and visible under the new.
+	_, err = os.Stat(path.Join(t.Dir, "foo"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+
+	fi, err := os.Stat(path.Join(t.Dir, "taco"))
+	AssertEq(nil, err)
+	ExpectEq(t.fs.FooID(), getInodeID(fi))
+	ExpectEq(cachingfs.FooSize, fi.Size())
+}
+
+func (t *InvalidationTest) ListWithoutInvalidation() {
+	t.fs.SetCacheDir(true)
+
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("dir", entries[0].Name())
+	ExpectEq("foo", entries[1].Name())
+
+	t.fs.RenameFoo("taco")
+
+	// The kernel should keep serving the cached entries.
+	entries, err = fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("dir", entries[0].Name())
+	ExpectEq("foo", entries[1].Name())
+}
+
+func (t *InvalidationTest) InvalidateDirContents() {
+	t.fs.SetCacheDir(true)
+
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("foo", entries[1].Name())
+
+	// Rename behind the kernel's back, then tell it the directory changed.
+	t.fs.RenameFoo("taco")
+
+	err = t.MountedFileSystem().InvalidateDirContents(fuseops.RootInodeID)
+	AssertEq(nil, err)
+
+	// The new name should be listed.
+	entries, err = fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(2, len(entries))
+	ExpectEq("dir", entries[0].Name())
+	ExpectEq("taco", entries[1].Name())
+
+	// The entry for the old name wasn't invalidated, so it can still be looked
+	// up until it expires.
+	_, err = os.Stat(path.Join(t.Dir, "foo"))
+	ExpectEq(nil, err)
+}
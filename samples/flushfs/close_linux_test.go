@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flushfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/samples/flushfs"
+)
+
+func TestCloseReportsFlushError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flush_fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	// Fail flushes of anything written, as a file system pushing buffered
+	// writes to a backend that is out of space might.
+	var mu sync.Mutex
+	var flushes []string
+	reportFlush := func(contents string) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		flushes = append(flushes, contents)
+		if contents != "" {
+			return syscall.EDQUOT
+		}
+
+		return nil
+	}
+
+	server, err := flushfs.NewFileSystem(
+		reportFlush,
+		func(string) error { return nil },
+		func(fuseops.ReleaseFlags) error { return nil })
+
+	if err != nil {
+		t.Fatalf("NewFileSystem: %v", err)
+	}
+
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{FSName: "flushfs"})
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		mfs.Join(context.Background())
+	}()
+
+	f, err := os.OpenFile(path.Join(dir, "foo"), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	if _, err := f.Write([]byte("taco")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	// A child process's copy of the descriptor is flushed when it is closed,
+	// with nobody to tell of the error.
+	cmd := exec.Command("true")
+	cmd.ExtraFiles = []*os.File{f}
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	mu.Lock()
+	n := len(flushes)
+	mu.Unlock()
+
+	if n == 0 {
+		t.Errorf("No flush for the child's copy of the descriptor")
+	}
+
+	// close(2) fails with the file system's error.
+	err = f.Close()
+	if pe, ok := err.(*os.PathError); !ok || pe.Err != syscall.EDQUOT {
+		t.Errorf("Close: got %v, want EDQUOT", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(flushes) != n+1 || flushes[n] != "taco" {
+		t.Errorf("Flushes: got %q, want one more for the close", flushes)
+	}
+}
@@ -31,14 +31,19 @@ import (
 // The file may be opened for reading and/or writing. Its initial contents are
 // empty. Whenever a flush or fsync is received, the supplied function will be
 // called with the current contents of the file and its status returned.
+// Whenever a file handle is released, reportRelease will be called with the
+// release flags. A release with ReleaseFlush set is also reported as a flush
+// beforehand, since it stands in for one.
 //
 // The directory cannot be modified.
 func NewFileSystem(
 	reportFlush func(string) error,
-	reportFsync func(string) error) (fuse.Server, error) {
+	reportFsync func(string) error,
+	reportRelease func(fuseops.ReleaseFlags) error) (fuse.Server, error) {
 	fs := &flushFS{
-		reportFlush: reportFlush,
-		reportFsync: reportFsync,
+		reportFlush:   reportFlush,
+		reportFsync:   reportFsync,
+		reportRelease: reportRelease,
 	}
 
 	return fuseutil.NewFileSystemServer(fs), nil
@@ -52,8 +57,9 @@ const (
 type flushFS struct {
 	fuseutil.NotImplementedFileSystem
 
-	reportFlush func(string) error
-	reportFsync func(string) error
+	reportFlush   func(string) error
+	reportFsync   func(string) error
+	reportRelease func(fuseops.ReleaseFlags) error
 
 	mu          sync.Mutex
 	fooContents []byte // GUARDED_BY(mu)
@@ -243,6 +249,21 @@ func (fs *flushFS) FlushFile(
 	return fs.reportFlush(string(fs.fooContents))
 }
 
+func (fs *flushFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if op.Flags&fuseops.ReleaseFlush != 0 {
+		if err := fs.reportFlush(string(fs.fooContents)); err != nil {
+			return err
+		}
+	}
+
+	return fs.reportRelease(op.Flags)
+}
+
 func (fs *flushFS) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) error {
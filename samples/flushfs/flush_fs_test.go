@@ -21,6 +21,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"runtime"
 	"syscall"
@@ -46,9 +47,11 @@ func TestFlushFS(t *testing.T) { RunTests(t) }
 type flushFSTest struct {
 	samples.SubprocessTest
 
-	// Files to which mount_sample is writing reported flushes and fsyncs.
-	flushes *os.File
-	fsyncs  *os.File
+	// Files to which mount_sample is writing reported flushes, fsyncs and
+	// release flags.
+	flushes  *os.File
+	fsyncs   *os.File
+	releases *os.File
 
 	// File handles that are closed in TearDown if non-nil.
 	f1 *os.File
@@ -62,13 +65,16 @@ func (t *flushFSTest) setUp(
 	readOnly bool) {
 	var err error
 
-	// Set up files to receive flush and fsync reports.
+	// Set up files to receive flush, fsync and release reports.
 	t.flushes, err = fsutil.AnonymousFile("")
 	AssertEq(nil, err)
 
 	t.fsyncs, err = fsutil.AnonymousFile("")
 	AssertEq(nil, err)
 
+	t.releases, err = fsutil.AnonymousFile("")
+	AssertEq(nil, err)
+
 	// Set up test config.
 	t.MountType = "flushfs"
 	t.MountFlags = []string{
@@ -84,8 +90,9 @@ func (t *flushFSTest) setUp(
 	}
 
 	t.MountFiles = map[string]*os.File{
-		"flushfs.flushes_file": t.flushes,
-		"flushfs.fsyncs_file":  t.fsyncs,
+		"flushfs.flushes_file":  t.flushes,
+		"flushfs.fsyncs_file":   t.fsyncs,
+		"flushfs.releases_file": t.releases,
 	}
 
 	t.SubprocessTest.SetUp(ti)
@@ -95,10 +102,12 @@ func (t *flushFSTest) TearDown() {
 	// Unlink reporting files.
 	os.Remove(t.flushes.Name())
 	os.Remove(t.fsyncs.Name())
+	os.Remove(t.releases.Name())
 
 	// Close reporting files.
 	t.flushes.Close()
 	t.fsyncs.Close()
+	t.releases.Close()
 
 	// Close test files if non-nil.
 	if t.f1 != nil {
@@ -164,6 +173,29 @@ func (t *flushFSTest) getFsyncs() []string {
 	return p
 }
 
+// Return a copy of the current contents of t.releases.
+func (t *flushFSTest) getReleases() []string {
+	p, err := readReports(t.releases)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// The kernel sends releases asynchronously, so wait a while for at least n of
+// them to show up before returning whatever has been reported.
+func (t *flushFSTest) waitForReleases(n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		releases := t.getReleases()
+		if len(releases) >= n || time.Now().After(deadline) {
+			return releases
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // Like syscall.Dup2, but correctly annotates the syscall as blocking. See here
 // for more info: https://github.com/golang/go/issues/10202
 func dup2(oldfd int, newfd int) error {
@@ -790,6 +822,89 @@ func (t *NoErrorsTest) Directory() {
 	ExpectThat(t.getFsyncs(), ElementsAre())
 }
 
+func (t *NoErrorsTest) Release_Close() {
+	var err error
+
+	// Open the file and write some contents.
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	// Nothing has been released yet.
+	AssertThat(t.getReleases(), ElementsAre())
+
+	// Close the file. The flush comes first, so the release doesn't ask for
+	// another.
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	ExpectThat(t.waitForReleases(1), ElementsAre("0"))
+	ExpectThat(t.getFlushes(), ElementsAre("taco"))
+}
+
+func (t *NoErrorsTest) Release_MunmapLastReference() {
+	var err error
+
+	// Open the file, write some contents, and map it.
+	t.f1, err = os.OpenFile(path.Join(t.Dir, "foo"), os.O_RDWR, 0)
+	AssertEq(nil, err)
+
+	_, err = t.f1.Write([]byte("taco"))
+	AssertEq(nil, err)
+
+	data, err := syscall.Mmap(
+		int(t.f1.Fd()), 0, 4,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_SHARED)
+
+	AssertEq(nil, err)
+	defer syscall.Munmap(data)
+
+	// Close the file. The mapping still refers to the handle, so we should see
+	// a flush but no release.
+	err = t.f1.Close()
+	t.f1 = nil
+	AssertEq(nil, err)
+
+	AssertThat(t.getFlushes(), ElementsAre("taco"))
+	time.Sleep(100 * time.Millisecond)
+	AssertThat(t.getReleases(), ElementsAre())
+
+	// Unmapping drops the last reference, releasing the handle without another
+	// flush.
+	err = syscall.Munmap(data)
+	AssertEq(nil, err)
+
+	ExpectThat(t.waitForReleases(1), ElementsAre("0"))
+	ExpectThat(t.getFlushes(), ElementsAre("taco"))
+}
+
+func (t *NoErrorsTest) Release_ProcessExit() {
+	// Have a child process open the file and write to it, then exit without
+	// closing it, leaving the kernel to close the descriptor.
+	cmd := exec.Command(
+		"/bin/sh",
+		"-c",
+		`exec 3<>"$1" && printf taco >&3`,
+		"sh",
+		path.Join(t.Dir, "foo"))
+
+	output, err := cmd.CombinedOutput()
+	AssertEq(nil, err, "Output:\n%s", output)
+
+	// The implicit close should flush and release like an explicit one. The
+	// shell's redirection closes a duplicate of the descriptor, so there may be
+	// earlier flushes too.
+	ExpectThat(t.waitForReleases(1), ElementsAre("0"))
+
+	flushes := t.getFlushes()
+	AssertNe(0, len(flushes))
+	ExpectEq("taco", flushes[len(flushes)-1])
+}
+
 ////////////////////////////////////////////////////////////////////////
 // Flush error
 ////////////////////////////////////////////////////////////////////////
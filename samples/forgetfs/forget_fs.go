@@ -37,7 +37,9 @@ import (
 // panic if a reference count becomes negative or if an inode ID is re-used
 // after we expect it to be dead. Its Check method may be used to check that
 // there are no inodes with unexpected reference counts remaining, after
-// unmounting.
+// unmounting. The references the kernel still holds at unmount are dropped
+// only by fuseutil.ForgetAller, not by Destroy, so Check also verifies that
+// the server's account of them was exact.
 func NewFileSystem() *ForgetFS {
 	// Set up the actual file system.
 	impl := &fsImpl{
@@ -170,11 +172,6 @@ func (in *inode) DecrementLookupCount(n uint64) {
 	in.lookupCount -= n
 }
 
-// Decrement the lookup count to zero.
-func (in *inode) Destroy() {
-	in.DecrementLookupCount(in.lookupCount)
-}
-
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
@@ -378,8 +375,24 @@ func (fs *fsImpl) OpenDir(
 	return nil
 }
 
+func (fs *fsImpl) ForgetAll(
+	mount fuse.MountInfo,
+	remaining []fuseutil.RemainingInode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, r := range remaining {
+		fs.findInodeByID(r.Inode).DecrementLookupCount(r.N)
+	}
+}
+
 func (fs *fsImpl) Destroy() {
-	for _, in := range fs.inodes {
-		in.Destroy()
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// ForgetAll has already dropped the kernel's references, leaving the root's
+	// implicit one and those we hold on the canned inodes.
+	for _, id := range []fuseops.InodeID{cannedID_Root, cannedID_Foo, cannedID_Bar} {
+		fs.inodes[id].DecrementLookupCount(1)
 	}
 }
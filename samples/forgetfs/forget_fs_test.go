@@ -16,6 +16,7 @@ package forgetfs_test
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
@@ -165,3 +166,33 @@ func (t *ForgetFSTest) MkDir() {
 		AssertEq(nil, err)
 	}
 }
+
+func (t *ForgetFSTest) DropCaches() {
+	// Look up and create some inodes, leaving the kernel with references to
+	// them.
+	for _, name := range []string{"foo", "bar"} {
+		f, err := os.Open(path.Join(t.Dir, name))
+		AssertEq(nil, err)
+		AssertEq(nil, f.Close())
+	}
+
+	for _, name := range []string{"blah", "bar/blah"} {
+		f, err := os.Create(path.Join(t.Dir, name))
+		AssertEq(nil, err)
+		AssertEq(nil, f.Close())
+	}
+
+	// Have the kernel evict what it can from its caches, forgetting those
+	// inodes. This needs privileges, without which the references are all
+	// left to be dropped at unmount.
+	err := ioutil.WriteFile("/proc/sys/vm/drop_caches", []byte("2"), 0)
+	if err != nil {
+		return
+	}
+
+	// The canned inodes may still be looked up.
+	for _, name := range []string{"foo", "bar"} {
+		_, err := os.Stat(path.Join(t.Dir, name))
+		AssertEq(nil, err)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hellofs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples/hellofs"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestCapabilities(t *testing.T) {
+	server, err := hellofs.NewHelloFS(timeutil.RealClock())
+	if err != nil {
+		t.Fatalf("NewHelloFS: %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "hellofs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{FSName: "hellofs"})
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	d, err := fusetesting.CheckCapabilities(dir)
+	if err != nil {
+		t.Fatalf("CheckCapabilities: %v", err)
+	}
+
+	for _, d := range d {
+		t.Error(d)
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"syscall"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -32,13 +33,14 @@ import (
 //     dir/
 //         world
 //
-// Each file contains the string "Hello, world!".
+// Each file contains the string "Hello, world!". Its methods are called one
+// at a time.
 func NewHelloFS(clock timeutil.Clock) (fuse.Server, error) {
 	fs := &helloFS{
 		Clock: clock,
 	}
 
-	return fuseutil.NewFileSystemServer(fs), nil
+	return fuseutil.NewSerialFileSystemServer(fs), nil
 }
 
 type helloFS struct {
@@ -145,6 +147,23 @@ func (fs *helloFS) patchAttributes(
 	attr.Crtime = now
 }
 
+// Capabilities implements fuse.CapabilityReporter. The file system is read
+// only, and never changes.
+func (fs *helloFS) Capabilities() *fuse.Capabilities {
+	return &fuse.Capabilities{
+		Ops: []string{
+			"StatFS",
+			"LookUpInode",
+			"GetInodeAttributes",
+			"OpenDir",
+			"ReadDir",
+			"OpenFile",
+			"ReadFile",
+		},
+		Consistency: fuse.ConsistencyExclusive,
+	}
+}
+
 func (fs *helloFS) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) error {
@@ -239,7 +258,13 @@ func (fs *helloFS) ReadDir(
 func (fs *helloFS) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) error {
-	// Allow opening any file.
+	// Allow opening any file, but only for reading. Without the
+	// default_permissions mount option, the kernel leaves this to us despite
+	// the files' modes.
+	if op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return syscall.EACCES
+	}
+
 	return nil
 }
 
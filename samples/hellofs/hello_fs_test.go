@@ -224,3 +224,10 @@ func (t *HelloFSTest) Open_NonExistent() {
 	AssertNe(nil, err)
 	ExpectThat(err, Error(HasSubstr("no such file")))
 }
+
+func (t *HelloFSTest) Open_ForWriting() {
+	for _, flag := range []int{os.O_WRONLY, os.O_RDWR, os.O_WRONLY | os.O_TRUNC} {
+		_, err := os.OpenFile(path.Join(t.Dir, "hello"), flag, 0)
+		ExpectThat(err, Error(HasSubstr("permission denied")), "flag: %v", flag)
+	}
+}
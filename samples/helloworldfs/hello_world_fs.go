@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package helloworldfs is the smallest useful file system: a read-only root
+// directory containing one file. It is meant as starter code to copy.
+package helloworldfs
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const (
+	// The name of the single file in the root directory, and its contents.
+	FileName     = "hello"
+	FileContents = "Hello, world!"
+)
+
+const (
+	rootInode fuseops.InodeID = fuseops.RootInodeID + iota
+	fileInode
+)
+
+// Nothing ever changes, so every time is the time the program started.
+var startTime = time.Now()
+
+var rootAttrs = fuseops.InodeAttributes{
+	Nlink: 1,
+	Mode:  0555 | os.ModeDir,
+	Atime: startTime,
+	Mtime: startTime,
+	Ctime: startTime,
+}
+
+var fileAttrs = fuseops.InodeAttributes{
+	Nlink: 1,
+	Mode:  0444,
+	Size:  uint64(len(FileContents)),
+	Atime: startTime,
+	Mtime: startTime,
+	Ctime: startTime,
+}
+
+// Create a file system whose root directory contains a single file, named
+// FileName, containing FileContents.
+func NewHelloWorldFS() fuse.Server {
+	return fuseutil.NewFileSystemServer(&helloWorldFS{})
+}
+
+// Ops not implemented here fail with ENOSYS.
+type helloWorldFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *helloWorldFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != rootInode || op.Name != FileName {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = fileInode
+	op.Entry.Attributes = fileAttrs
+	return nil
+}
+
+func (fs *helloWorldFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	switch op.Inode {
+	case rootInode:
+		op.Attributes = rootAttrs
+
+	case fileInode:
+		op.Attributes = fileAttrs
+
+	default:
+		return fuse.ENOENT
+	}
+
+	return nil
+}
+
+func (fs *helloWorldFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *helloWorldFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	// Each entry's offset is where to resume listing after it.
+	entries := []fuseutil.Dirent{
+		{Offset: 1, Inode: fileInode, Name: FileName, Type: fuseutil.DT_File},
+	}
+
+	if op.Offset > fuseops.DirOffset(len(entries)) {
+		return fuse.EINVAL
+	}
+
+	for _, e := range entries[op.Offset:] {
+		n := fuseutil.WriteDirent(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func (fs *helloWorldFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	// The kernel checks the file's mode, but only as far as permissions go:
+	// root may still try to write.
+	if op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return syscall.EACCES
+	}
+
+	return nil
+}
+
+func (fs *helloWorldFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	var err error
+	op.BytesRead, err = strings.NewReader(FileContents).ReadAt(op.Dst, op.Offset)
+
+	// A short read tells the kernel it has reached the end of the file.
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
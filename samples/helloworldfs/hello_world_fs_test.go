@@ -0,0 +1,101 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package helloworldfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/helloworldfs"
+)
+
+func TestHelloWorldFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "helloworldfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	mfs, err := fuse.Mount(dir, helloworldfs.NewHelloWorldFS(), &fuse.MountConfig{
+		FSName:   "helloworldfs",
+		ReadOnly: true,
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	// The root lists just the file.
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != helloworldfs.FileName {
+		t.Fatalf("Got entries %v, want just %q", entries, helloworldfs.FileName)
+	}
+
+	fi := entries[0]
+	if fi.Mode() != 0444 || fi.Size() != int64(len(helloworldfs.FileContents)) {
+		t.Errorf("Got mode %v and size %d", fi.Mode(), fi.Size())
+	}
+
+	// Read it with syscalls, not the os package, which would have the runtime
+	// poll the file from within a call that holds a P.
+	p := path.Join(dir, helloworldfs.FileName)
+	fd, err := syscall.Open(p, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 100)
+	n, err := syscall.Read(fd, buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if got := string(buf[:n]); got != helloworldfs.FileContents {
+		t.Errorf("Read %q, want %q", got, helloworldfs.FileContents)
+	}
+
+	// And it can't be written, even by root.
+	if _, err := syscall.Open(p, syscall.O_WRONLY, 0); err == nil {
+		t.Errorf("Opened for writing")
+	}
+
+	// Nor does anything else exist.
+	var st syscall.Stat_t
+	if err := syscall.Stat(path.Join(dir, "missing"), &st); err != syscall.ENOENT {
+		t.Errorf("Stat(missing): got %v, want ENOENT", err)
+	}
+}
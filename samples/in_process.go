@@ -85,6 +85,11 @@ func (t *SampleTest) initialize(
 		config.OpContext = ctx
 	}
 
+	// Catch invalid responses, unless the test has its own ideas.
+	if config.Strict == nil {
+		config.Strict = &fuse.StrictConfig{Action: fuse.StrictPanic}
+	}
+
 	// Initialize the clock.
 	t.Clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
 
@@ -104,6 +109,12 @@ func (t *SampleTest) initialize(
 	return nil
 }
 
+// MountedFileSystem returns the file system mounted by SetUp, e.g. for
+// sending invalidations to the kernel.
+func (t *SampleTest) MountedFileSystem() *fuse.MountedFileSystem {
+	return t.mfs
+}
+
 // Unmount the file system and clean up. Panics on error.
 func (t *SampleTest) TearDown() {
 	err := t.destroy()
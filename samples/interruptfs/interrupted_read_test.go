@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package interruptfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/interruptfs"
+)
+
+// Records the error with which the wrapped file system's reads return.
+type readRecorder struct {
+	*interruptfs.InterruptFS
+	done chan error
+}
+
+func (fs *readRecorder) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	err := fs.InterruptFS.ReadFile(ctx, op)
+	select {
+	case fs.done <- err:
+	default:
+	}
+
+	return err
+}
+
+func TestInterruptedRead_CancelsContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "interruptfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	fs := &readRecorder{
+		InterruptFS: interruptfs.New(),
+		done:        make(chan error, 1),
+	}
+
+	fs.EnableReadBlocking()
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName: "interruptfs",
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	cmd := exec.Command("cat", path.Join(dir, "foo"))
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	cmdErr := make(chan error, 1)
+	go func() {
+		cmdErr <- cmd.Wait()
+	}()
+
+	// Once cat is stuck in the read, interrupt it. The kernel passes this on,
+	// cancelling the read's context.
+	fs.WaitForFirstRead()
+	cmd.Process.Signal(os.Interrupt)
+
+	select {
+	case err := <-fs.done:
+		if err != context.Canceled {
+			t.Errorf("ReadFile returned %v, want context.Canceled", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Timed out waiting for the read's context to be cancelled")
+	}
+
+	// The kernel was waiting for the reply, and cat dies of the signal.
+	if err := <-cmdErr; err == nil || !strings.Contains(err.Error(), "interrupt") {
+		t.Errorf("cat: got %v, want death by interrupt", err)
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loopbackfs contains a read-only file system that mirrors a
+// directory of an existing file system.
+package loopbackfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Config contains the parameters for NewLoopbackFS.
+type Config struct {
+	// How long the kernel may cache the attributes and entries of inodes.
+	TTL time.Duration
+
+	// If non-nil, the watcher is told about each inode handed to the kernel,
+	// so that it can invalidate the kernel's caches when the backing file
+	// changes. The caller must run it against the mounted file system.
+	Watcher *fuseutil.InodeWatcher
+}
+
+// Create a file system that mirrors the contents of the directory at root,
+// which may not be modified through it. The kernel is allowed to cache file
+// contents across opens, so changes made to the backing files directly are
+// seen only once the cache expires, unless cfg.Watcher is set.
+//
+// The file system must be mounted with MountConfig.DisableWritebackCaching
+// set, as otherwise the kernel considers itself the authority on the sizes of
+// files and ignores changes to them.
+func NewLoopbackFS(
+	root string,
+	cfg Config) (fuse.Server, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("Stat: %v", err)
+	}
+
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("Not a directory: %s", root)
+	}
+
+	fs := &loopbackFS{
+		root:    root,
+		ttl:     cfg.TTL,
+		watcher: cfg.Watcher,
+		inodes: map[fuseops.InodeID]*inode{
+			fuseops.RootInodeID: &inode{path: root},
+		},
+		byBacking: make(map[uint64]fuseops.InodeID),
+		nextID:    fuseops.RootInodeID + 1,
+	}
+
+	if fs.watcher != nil {
+		fs.watcher.Watch(fuseops.RootInodeID, 0, "", root)
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+type loopbackFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	root    string
+	ttl     time.Duration
+	watcher *fuseutil.InodeWatcher
+
+	mu sync.Mutex
+
+	// The inodes the kernel knows about.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*inode
+
+	// The non-root inodes, by the inode number of their backing file, so that
+	// hard links share an inode.
+	//
+	// GUARDED_BY(mu)
+	byBacking map[uint64]fuseops.InodeID
+
+	// GUARDED_BY(mu)
+	nextID fuseops.InodeID
+}
+
+type inode struct {
+	// The path of the backing file, as of the last lookup.
+	path string
+
+	// The inode number of the backing file. Zero for the root.
+	backing uint64
+
+	// The kernel's lookup count. The root is never forgotten.
+	lookups uint64
+}
+
+// Return the path of the backing file for the given inode.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *loopbackFS) pathOf(id fuseops.InodeID) (string, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[id]
+	if !ok {
+		return "", syscall.ESTALE
+	}
+
+	return in.path, nil
+}
+
+// Convert the result of lstat(2) on a backing file.
+func attributesOf(fi os.FileInfo) fuseops.InodeAttributes {
+	st := fi.Sys().(*syscall.Stat_t)
+	return fuseops.InodeAttributes{
+		Size:      uint64(fi.Size()),
+		Blocks:    uint64(st.Blocks),
+		BlockSize: uint32(st.Blksize),
+		Rdev:      uint32(st.Rdev),
+		Nlink:     uint32(st.Nlink),
+		Mode:      fi.Mode(),
+		Atime:     fi.ModTime(),
+		Mtime:     fi.ModTime(),
+		Ctime:     fi.ModTime(),
+		Uid:       st.Uid,
+		Gid:       st.Gid,
+	}
+}
+
+// Stat the file at p, translating failures into errnos for the kernel.
+func lstat(p string) (os.FileInfo, error) {
+	fi, err := os.Lstat(p)
+	if err != nil {
+		if pe, ok := err.(*os.PathError); ok {
+			return nil, pe.Err
+		}
+
+		return nil, err
+	}
+
+	return fi, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *loopbackFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *loopbackFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	p := path.Join(parent, op.Name)
+	fi, err := lstat(p)
+	if err != nil {
+		return err
+	}
+
+	backing := uint64(fi.Sys().(*syscall.Stat_t).Ino)
+
+	fs.mu.Lock()
+	id, ok := fs.byBacking[backing]
+	if !ok {
+		id = fs.nextID
+		fs.nextID++
+		fs.inodes[id] = &inode{backing: backing}
+		fs.byBacking[backing] = id
+	}
+
+	in := fs.inodes[id]
+	in.path = p
+	in.lookups++
+	fs.mu.Unlock()
+
+	if fs.watcher != nil {
+		fs.watcher.Watch(id, op.Parent, op.Name, p)
+	}
+
+	expiration := time.Now().Add(fs.ttl)
+	op.Entry = fuseops.ChildInodeEntry{
+		Child:                id,
+		Attributes:           attributesOf(fi),
+		AttributesExpiration: expiration,
+		EntryExpiration:      expiration,
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	fi, err := lstat(p)
+	if err != nil {
+		return err
+	}
+
+	if fs.watcher != nil {
+		fs.watcher.Touch(op.Inode)
+	}
+
+	op.Attributes = attributesOf(fi)
+	op.AttributesExpiration = time.Now().Add(fs.ttl)
+
+	return nil
+}
+
+func (fs *loopbackFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[op.Inode]
+	if !ok || op.Inode == fuseops.RootInodeID {
+		return nil
+	}
+
+	if op.N < in.lookups {
+		in.lookups -= op.N
+		return nil
+	}
+
+	delete(fs.inodes, op.Inode)
+	delete(fs.byBacking, in.backing)
+
+	if fs.watcher != nil {
+		fs.watcher.Unwatch(op.Inode)
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.HandleData = fuseutil.NewDirCursor(func(ctx context.Context) ([]fuseutil.Dirent, error) {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err.(*os.PathError).Err
+		}
+
+		defer f.Close()
+
+		infos, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+
+		var entries []fuseutil.Dirent
+		for _, fi := range infos {
+			entries = append(entries, fuseutil.Dirent{
+				Inode: fuseops.InodeID(fi.Sys().(*syscall.Stat_t).Ino),
+				Name:  fi.Name(),
+				Type:  fuseutil.DirentTypeOf(fi.Mode()),
+			})
+		}
+
+		return entries, nil
+	})
+
+	return nil
+}
+
+func (fs *loopbackFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	return op.HandleData.(*fuseutil.DirCursor).ReadDir(ctx, op)
+}
+
+func (fs *loopbackFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *loopbackFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err.(*os.PathError).Err
+	}
+
+	op.HandleData = f
+	op.KeepPageCache = true
+
+	return nil
+}
+
+func (fs *loopbackFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	var err error
+	op.BytesRead, err = op.HandleData.(*os.File).ReadAt(op.Dst, op.Offset)
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+func (fs *loopbackFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return op.HandleData.(*os.File).Close()
+}
+
+func (fs *loopbackFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	p, err := fs.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Target, err = os.Readlink(p)
+	if err != nil {
+		return err.(*os.PathError).Err
+	}
+
+	return nil
+}
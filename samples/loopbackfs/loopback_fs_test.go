@@ -0,0 +1,305 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loopbackfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
+)
+
+// Longer than any test runs, so that the kernel's caches never expire by
+// themselves.
+const ttl = time.Hour
+
+// Mount a loopback file system for the directory backing, watching it with a
+// watcher with the supplied config unless that is nil, and return the mount
+// point.
+func mount(
+	t *testing.T,
+	backing string,
+	watcherCfg *fuseutil.InodeWatcherConfig) string {
+	dir, err := ioutil.TempDir("", "loopback_fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	cfg := loopbackfs.Config{TTL: ttl}
+	if watcherCfg != nil {
+		cfg.Watcher, err = fuseutil.NewInodeWatcher(*watcherCfg)
+		if err != nil {
+			t.Fatalf("NewInodeWatcher: %v", err)
+		}
+	}
+
+	server, err := loopbackfs.NewLoopbackFS(backing, cfg)
+	if err != nil {
+		t.Fatalf("NewLoopbackFS: %v", err)
+	}
+
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		FSName:                  "loopbackfs",
+		ReadOnly:                true,
+		DisableWritebackCaching: true,
+	})
+
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("Mount: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	if cfg.Watcher != nil {
+		go func() { done <- cfg.Watcher.Run(ctx, mfs) }()
+	} else {
+		done <- nil
+	}
+
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Run: %v", err)
+		}
+
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		mfs.Join(context.Background())
+		os.Remove(dir)
+
+		if cfg.Watcher != nil {
+			cfg.Watcher.Close()
+		}
+	})
+
+	return dir
+}
+
+// Return the size of the file at p and its contents, read through a single
+// file descriptor.
+func sizeAndContents(
+	t *testing.T,
+	p string) (int64, string) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(p, &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	fd, err := syscall.Open(p, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 1024)
+	n, err := syscall.Read(fd, buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	return st.Size, string(buf[:n])
+}
+
+func TestModifyBackingFile(t *testing.T) {
+	testCases := []struct {
+		name string
+		cfg  *fuseutil.InodeWatcherConfig
+	}{
+		{"Watched", &fuseutil.InodeWatcherConfig{}},
+		{"Polled", &fuseutil.InodeWatcherConfig{
+			MaxWatches:   -1,
+			PollInterval: 10 * time.Millisecond,
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			backing, err := ioutil.TempDir("", "loopback_fs_test")
+			if err != nil {
+				t.Fatalf("TempDir: %v", err)
+			}
+
+			defer os.RemoveAll(backing)
+
+			if err := ioutil.WriteFile(path.Join(backing, "foo"), []byte("taco"), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+
+			dir := mount(t, backing, tc.cfg)
+			foo := path.Join(dir, "foo")
+
+			if size, contents := sizeAndContents(t, foo); size != 4 || contents != "taco" {
+				t.Fatalf("Before: got %d bytes %q", size, contents)
+			}
+
+			if err := ioutil.WriteFile(path.Join(backing, "foo"), []byte("burrito"), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+
+			// The new contents show up long before the cache would expire.
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				size, contents := sizeAndContents(t, foo)
+				if size == 7 && contents == "burrito" {
+					break
+				}
+
+				if time.Now().After(deadline) {
+					t.Fatalf("After: got %d bytes %q", size, contents)
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			// New and removed files show up too.
+			if err := os.Rename(path.Join(backing, "foo"), path.Join(backing, "bar")); err != nil {
+				t.Fatalf("Rename: %v", err)
+			}
+
+			for {
+				var st syscall.Stat_t
+				errFoo := syscall.Stat(foo, &st)
+				errBar := syscall.Stat(path.Join(dir, "bar"), &st)
+				if errFoo == syscall.ENOENT && errBar == nil {
+					break
+				}
+
+				if time.Now().After(deadline) {
+					t.Fatalf("After rename: %v, %v", errFoo, errBar)
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+// Without a watcher, the kernel goes on using what it cached.
+func TestModifyBackingFile_NotWatched(t *testing.T) {
+	backing, err := ioutil.TempDir("", "loopback_fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(backing)
+
+	if err := ioutil.WriteFile(path.Join(backing, "foo"), []byte("taco"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	dir := mount(t, backing, nil)
+	foo := path.Join(dir, "foo")
+
+	sizeAndContents(t, foo)
+	if err := ioutil.WriteFile(path.Join(backing, "foo"), []byte("burrito"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if size, contents := sizeAndContents(t, foo); size != 4 || contents != "taco" {
+		t.Errorf("Got %d bytes %q", size, contents)
+	}
+}
+
+func TestSparseFile(t *testing.T) {
+	backing, err := ioutil.TempDir("", "loopback_fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(backing)
+
+	// A 16 MiB file with a few bytes at the start and a hole after them.
+	const size = 16 << 20
+	p := path.Join(backing, "sparse")
+	if err := ioutil.WriteFile(p, []byte("taco"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := os.Truncate(p, size); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	var want syscall.Stat_t
+	if err := syscall.Stat(p, &want); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if want.Blocks >= size/512 {
+		t.Skipf("Backing file isn't sparse: %d blocks", want.Blocks)
+	}
+
+	dir := mount(t, backing, nil)
+
+	var got syscall.Stat_t
+	if err := syscall.Stat(path.Join(dir, "sparse"), &got); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if got.Size != size {
+		t.Errorf("Size: got %d, want %d", got.Size, size)
+	}
+
+	// du(1) counts the blocks, not the size.
+	if got.Blocks != want.Blocks {
+		t.Errorf("Blocks: got %d, want %d", got.Blocks, want.Blocks)
+	}
+
+	if got.Blksize != want.Blksize {
+		t.Errorf("Blksize: got %d, want %d", got.Blksize, want.Blksize)
+	}
+}
+
+func TestDeviceNode(t *testing.T) {
+	backing, err := ioutil.TempDir("", "loopback_fs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(backing)
+
+	// Major 1, minor 3, as for /dev/null.
+	const rdev = 1<<8 | 3
+	err = syscall.Mknod(path.Join(backing, "null"), syscall.S_IFCHR|0600, rdev)
+	if err != nil {
+		t.Skipf("Mknod: %v", err)
+	}
+
+	dir := mount(t, backing, nil)
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path.Join(dir, "null"), &st); err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+
+	if got, want := st.Mode, uint32(syscall.S_IFCHR|0600); got != want {
+		t.Errorf("Mode: got %#o, want %#o", got, want)
+	}
+
+	if st.Rdev != rdev {
+		t.Errorf("Rdev: got %#x, want %#x", st.Rdev, rdev)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Mount a memfs owned by root, with the supplied value for
+// MountConfig.CheckWriteAccess, and create a read-only file in it. Return the
+// file's path and a function that unmounts.
+func mountWithReadOnlyFile(
+	t *testing.T,
+	checkWriteAccess bool) (p string, unmount func()) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	mfs, err := fuse.Mount(dir, memfs.NewMemFS(0, 0), &fuse.MountConfig{
+		FSName:           "memfs",
+		CheckWriteAccess: checkWriteAccess,
+	})
+
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("Mount: %v", err)
+	}
+
+	unmount = func() {
+		fuse.Unmount(dir)
+		mfs.Join(context.Background())
+		os.Remove(dir)
+	}
+
+	p = path.Join(dir, "foo")
+	fd, err := syscall.Open(p, syscall.O_WRONLY|syscall.O_CREAT, 0444)
+	if err != nil {
+		unmount()
+		t.Fatalf("Open: %v", err)
+	}
+
+	syscall.Close(fd)
+	return p, unmount
+}
+
+func TestCheckWriteAccess(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Must be run as root")
+	}
+
+	// Without the option, the kernel lets root write to the file regardless of
+	// its mode.
+	p, unmount := mountWithReadOnlyFile(t, false)
+	fd, err := syscall.Open(p, syscall.O_WRONLY, 0)
+	if err != nil {
+		t.Errorf("Open for writing without CheckWriteAccess: %v", err)
+	} else {
+		syscall.Close(fd)
+	}
+
+	unmount()
+
+	// With it, memfs has its say, and gives root nothing the mode doesn't.
+	p, unmount = mountWithReadOnlyFile(t, true)
+	defer unmount()
+
+	if _, err := syscall.Open(p, syscall.O_WRONLY, 0); err != syscall.EACCES {
+		t.Errorf("Open for writing: got %v, want EACCES", err)
+	}
+
+	if _, err := syscall.Open(p, syscall.O_RDWR, 0); err != syscall.EACCES {
+		t.Errorf("Open for reading and writing: got %v, want EACCES", err)
+	}
+
+	if err := syscall.Truncate(p, 0); err != syscall.EACCES {
+		t.Errorf("Truncate: got %v, want EACCES", err)
+	}
+
+	// Reading is still fine.
+	fd, err = syscall.Open(p, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open for reading: %v", err)
+	}
+
+	syscall.Close(fd)
+
+	// As the owner, root may make the file writable, after which it can write.
+	if err := syscall.Chmod(p, 0644); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	fd, err = syscall.Open(p, syscall.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Open for writing after chmod: %v", err)
+	}
+
+	syscall.Close(fd)
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+func TestCapabilities(t *testing.T) {
+	dir, unmount := mountTemp(t, memfs.NewMemFS(currentUid(), currentGid()))
+	defer unmount()
+
+	d, err := fusetesting.CheckCapabilities(dir)
+	if err != nil {
+		t.Fatalf("CheckCapabilities: %v", err)
+	}
+
+	for _, d := range d {
+		t.Error(d)
+	}
+}
+
+// memfs, declaring capabilities it lacks and leaving out ones it has.
+type lyingFS struct {
+	fuseutil.FileSystem
+}
+
+func (fs *lyingFS) Capabilities() *fuse.Capabilities {
+	caps := fs.FileSystem.(fuse.CapabilityReporter).Capabilities()
+
+	var ops []string
+	for _, op := range caps.Ops {
+		if op != "CreateLink" {
+			ops = append(ops, op)
+		}
+	}
+
+	caps.Ops = ops
+	caps.MaxFileSize = 1 << 20
+	return caps
+}
+
+func (fs *lyingFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	return fuse.ENOSYS
+}
+
+// Refuse to replace existing files.
+func (fs *lyingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	lookUp := &fuseops.LookUpInodeOp{Parent: op.NewParent, Name: op.NewName}
+	if err := fs.FileSystem.LookUpInode(ctx, lookUp); err == nil {
+		return fuse.EEXIST
+	}
+
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+func TestCapabilities_Lies(t *testing.T) {
+	fs := &lyingFS{memfs.NewFileSystem(currentUid(), currentGid())}
+	dir, unmount := mountTemp(t, fuseutil.NewFileSystemServer(fs))
+	defer unmount()
+
+	d, err := fusetesting.CheckCapabilities(dir)
+	if err != nil {
+		t.Fatalf("CheckCapabilities: %v", err)
+	}
+
+	want := []string{
+		"CreateLink works, but isn't declared",
+		"CreateSymlink is declared, but fails with",
+		"AtomicRename is declared, but renaming over a file fails",
+		"Truncating beyond MaxFileSize",
+		"Writing beyond MaxFileSize",
+	}
+
+	for _, w := range want {
+		found := false
+		for _, d := range d {
+			found = found || strings.HasPrefix(d.Problem, w)
+		}
+
+		if !found {
+			t.Errorf("No discrepancy %q among %v", w, d)
+		}
+	}
+
+	if len(d) != len(want) {
+		t.Errorf("Got %d discrepancies, want %d: %v", len(d), len(want), d)
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package memfs_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+	"golang.org/x/sys/unix"
+)
+
+// memfs, counting the reads, writes and copies it serves. With noCopy set, it
+// leaves copies to NotImplementedFileSystem.
+type copyCounter struct {
+	fuseutil.FileSystem
+	noCopy bool
+
+	reads, writes, copies int64
+}
+
+func (fs *copyCounter) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	atomic.AddInt64(&fs.reads, 1)
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+func (fs *copyCounter) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	atomic.AddInt64(&fs.writes, 1)
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+func (fs *copyCounter) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	atomic.AddInt64(&fs.copies, 1)
+	if fs.noCopy {
+		var nfs fuseutil.NotImplementedFileSystem
+		return nfs.CopyFileRange(ctx, op)
+	}
+
+	return fs.FileSystem.CopyFileRange(ctx, op)
+}
+
+// Forget the counts so far, returning them.
+func (fs *copyCounter) take() (reads, writes, copies int64) {
+	return atomic.SwapInt64(&fs.reads, 0),
+		atomic.SwapInt64(&fs.writes, 0),
+		atomic.SwapInt64(&fs.copies, 0)
+}
+
+// Mount fs, and create two files in it, the first with the supplied contents.
+// Return descriptors for both, and a function that closes them and unmounts.
+func mountCopyFiles(
+	t *testing.T,
+	fs *copyCounter,
+	contents []byte) (src int, dst int, cleanup func()) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	// Without writeback caching, every write reaches memfs before the copy.
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:                  "memfs",
+		DisableWritebackCaching: true,
+	})
+
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("Mount: %v", err)
+	}
+
+	var fds []int
+	cleanup = func() {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+
+		os.Remove(dir)
+	}
+
+	// Not os.OpenFile, which would have the runtime poll the files.
+	for _, name := range []string{"src", "dst"} {
+		fd, err := syscall.Open(path.Join(dir, name), syscall.O_RDWR|syscall.O_CREAT, 0600)
+		if err != nil {
+			cleanup()
+			t.Fatalf("Open: %v", err)
+		}
+
+		fds = append(fds, fd)
+	}
+
+	for off := 0; off < len(contents); {
+		n, err := syscall.Pwrite(fds[0], contents[off:], int64(off))
+		if err != nil {
+			cleanup()
+			t.Fatalf("Pwrite: %v", err)
+		}
+
+		off += n
+	}
+
+	return fds[0], fds[1], cleanup
+}
+
+// Read the first n bytes of the file.
+func readFirst(t *testing.T, fd int, n int) []byte {
+	buf := make([]byte, n)
+	for off := 0; off < n; {
+		m, err := syscall.Pread(fd, buf[off:], int64(off))
+		if err != nil {
+			t.Fatalf("Pread: %v", err)
+		}
+
+		if m == 0 {
+			return buf[:off]
+		}
+
+		off += m
+	}
+
+	return buf
+}
+
+func TestCopyFileRange(t *testing.T) {
+	contents := make([]byte, 100<<20)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+
+	fs := &copyCounter{FileSystem: memfs.NewFileSystem(currentUid(), currentGid())}
+	src, dst, cleanup := mountCopyFiles(t, fs, contents)
+	defer cleanup()
+
+	fs.take()
+
+	// The whole file is copied in one op, without memfs seeing any of it
+	// read or written.
+	var srcOff, dstOff int64
+	n, err := unix.CopyFileRange(src, &srcOff, dst, &dstOff, len(contents), 0)
+	if err != nil {
+		t.Fatalf("CopyFileRange: %v", err)
+	}
+
+	if n != len(contents) {
+		t.Errorf("Copied %d bytes, want %d", n, len(contents))
+	}
+
+	if reads, writes, copies := fs.take(); reads != 0 || writes != 0 || copies != 1 {
+		t.Errorf("Got %d reads, %d writes and %d copies, want 0, 0 and 1", reads, writes, copies)
+	}
+
+	if !bytes.Equal(readFirst(t, dst, len(contents)+1), contents) {
+		t.Errorf("Copy differs from the original")
+	}
+
+	// Part of the file, copied past the end of the other, grows it, leaving a
+	// hole in between.
+	srcOff, dstOff = 10, int64(len(contents))+5
+	if _, err := unix.CopyFileRange(src, &srcOff, dst, &dstOff, 20, 0); err != nil {
+		t.Fatalf("CopyFileRange: %v", err)
+	}
+
+	want := append(append(append([]byte(nil), contents...), 0, 0, 0, 0, 0), contents[10:30]...)
+	if got := readFirst(t, dst, len(want)+1); !bytes.Equal(got, want) {
+		t.Errorf("Got %d bytes after copying past the end, want %d", len(got), len(want))
+	}
+
+	// Copying from the end of the file copies nothing.
+	srcOff, dstOff = int64(len(contents)), 0
+	n, err = unix.CopyFileRange(src, &srcOff, dst, &dstOff, 10, 0)
+	if err != nil || n != 0 {
+		t.Errorf("CopyFileRange at the end: got %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestCopyFileRange_NotImplemented(t *testing.T) {
+	contents := bytes.Repeat([]byte("taco"), 1<<18)
+
+	fs := &copyCounter{
+		FileSystem: memfs.NewFileSystem(currentUid(), currentGid()),
+		noCopy:     true,
+	}
+
+	src, dst, cleanup := mountCopyFiles(t, fs, contents)
+	defer cleanup()
+
+	fs.take()
+
+	// The kernel copies through writes instead, reading from the page cache
+	// where it can, and after the first refusal doesn't ask again.
+	for i := 0; i < 2; i++ {
+		var srcOff, dstOff int64
+		n, err := unix.CopyFileRange(src, &srcOff, dst, &dstOff, len(contents), 0)
+		if err != nil {
+			t.Fatalf("CopyFileRange: %v", err)
+		}
+
+		if n != len(contents) {
+			t.Errorf("Copied %d bytes, want %d", n, len(contents))
+		}
+	}
+
+	if _, writes, copies := fs.take(); copies != 1 || writes == 0 {
+		t.Errorf("Got %d writes and %d copies, want some and 1", writes, copies)
+	}
+
+	if !bytes.Equal(readFirst(t, dst, len(contents)+1), contents) {
+		t.Errorf("Copy differs from the original")
+	}
+}
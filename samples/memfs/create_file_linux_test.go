@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// memfs, recording the flags of each CreateFileOp.
+type createFlagsFS struct {
+	fuseutil.FileSystem
+
+	mu    sync.Mutex
+	flags []uint32
+}
+
+func (fs *createFlagsFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.mu.Lock()
+	fs.flags = append(fs.flags, op.Flags)
+	fs.mu.Unlock()
+
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+func (fs *createFlagsFS) lastFlags() uint32 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.flags) == 0 {
+		return 0
+	}
+
+	return fs.flags[len(fs.flags)-1]
+}
+
+func TestCreateFile(t *testing.T) {
+	fs := &createFlagsFS{FileSystem: memfs.NewFileSystem(currentUid(), currentGid())}
+	dir, unmount := mountTemp(t, fuseutil.NewFileSystemServer(fs))
+	defer unmount()
+
+	cmd := exec.Command("sh", "-c", "touch newfile && echo hi > newfile")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("sh: %v: %s", err, out)
+	}
+
+	if flags := fs.lastFlags(); flags&syscall.O_CREAT == 0 || flags&syscall.O_ACCMODE != syscall.O_WRONLY {
+		t.Errorf("touch created with flags %#o", flags)
+	}
+
+	fd, err := syscall.Open(path.Join(dir, "newfile"), syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	buf := make([]byte, 16)
+	n, err := syscall.Read(fd, buf)
+	syscall.Close(fd)
+
+	if err != nil || string(buf[:n]) != "hi\n" {
+		t.Errorf("Read: got %q, %v; want %q", buf[:n], err, "hi\n")
+	}
+
+	// O_EXCL reaches the file system, and an existing name isn't opened.
+	p := path.Join(dir, "exclusive")
+	for i, want := range []error{nil, syscall.EEXIST} {
+		fd, err := syscall.Open(p, syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL, 0600)
+		if err != want {
+			t.Fatalf("Open #%d: got %v, want %v", i, err, want)
+		}
+
+		if err == nil {
+			syscall.Close(fd)
+		}
+	}
+
+	if flags := fs.lastFlags(); flags&syscall.O_EXCL == 0 || flags&syscall.O_ACCMODE != syscall.O_RDWR {
+		t.Errorf("Created with flags %#o, want O_RDWR and O_EXCL", flags)
+	}
+
+	if len(fs.flags) != 2 {
+		t.Errorf("%d creates, want 2", len(fs.flags))
+	}
+}
+
+// The kernel checks for an existing name itself, but may not know of it.
+func TestCreateFile_Exists(t *testing.T) {
+	ctx := context.Background()
+	fs := memfs.NewFileSystem(currentUid(), currentGid())
+
+	for i, want := range []error{nil, fuse.EEXIST} {
+		op := &fuseops.CreateFileOp{
+			Metadata: fuseops.OpMetadata{Pid: uint32(os.Getpid())},
+			Parent:   fuseops.RootInodeID,
+			Name:     "f",
+			Mode:     0600,
+			Flags:    uint32(os.O_RDWR | os.O_CREATE | os.O_EXCL),
+		}
+
+		if err := fs.CreateFile(ctx, op); err != want {
+			t.Fatalf("CreateFile #%d: got %v, want %v", i, err, want)
+		}
+
+		if want != nil && (op.Entry.Child != 0 || op.HandleData != nil) {
+			t.Errorf("CreateFile #%d: made inode %d, with handle data %v", i, op.Entry.Child, op.HandleData)
+		}
+	}
+}
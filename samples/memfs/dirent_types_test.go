@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+func TestDirentTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	var errorLog bytes.Buffer
+	server := memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid()))
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		FSName:      "memfs",
+		ErrorLogger: log.New(&errorLog, "", 0),
+		Strict:      &fuse.StrictConfig{Action: fuse.StrictFail},
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	mounted := true
+	defer func() {
+		if mounted {
+			fuse.Unmount(dir)
+			mfs.Join(context.Background())
+		}
+	}()
+
+	// One child of each type memfs supports, plus a hard link to a symlink,
+	// which is listed as a symlink too.
+	p := func(name string) string { return path.Join(dir, name) }
+	fd, err := syscall.Open(p("file"), syscall.O_WRONLY|syscall.O_CREAT, 0644)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	syscall.Close(fd)
+
+	if err := syscall.Mkdir(p("dir"), 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	if err := syscall.Symlink("file", p("symlink")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	if err := syscall.Mkfifo(p("fifo"), 0644); err != nil {
+		t.Fatalf("Mkfifo: %v", err)
+	}
+
+	if err := syscall.Link(p("symlink"), p("link")); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+
+	if err := fusetesting.CheckDirentTypes(dir, false); err != nil {
+		t.Error(err)
+	}
+
+	// The server writes to the error log, so read it only once the server is
+	// done.
+	mounted = false
+	if err := fuse.Unmount(dir); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(context.Background()); err != nil {
+		t.Fatalf("Join: %v", err)
+	}
+
+	if strings.Contains(errorLog.String(), "invalid") {
+		t.Errorf("Strict mode complained: %q", errorLog.String())
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+func TestDotEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	server := memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid()))
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{FSName: "memfs"})
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		fuse.Unmount(dir)
+		mfs.Join(context.Background())
+	}()
+
+	// Set up a few levels of directories, with some files in the middle.
+	a := path.Join(dir, "a")
+	b := path.Join(a, "b")
+	for _, p := range []string{a, b} {
+		if err := syscall.Mkdir(p, 0755); err != nil {
+			t.Fatalf("Mkdir(%q): %v", p, err)
+		}
+	}
+
+	var children []string
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("f%d", i)
+		fd, err := syscall.Open(path.Join(a, name), syscall.O_WRONLY|syscall.O_CREAT, 0644)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+
+		syscall.Close(fd)
+		children = append(children, name)
+	}
+
+	children = append(children, "b")
+	sort.Strings(children)
+
+	for _, tc := range []struct {
+		dir  string
+		root bool
+	}{
+		{dir, true},
+		{a, false},
+		{b, false},
+	} {
+		if err := fusetesting.CheckDotEntries(tc.dir, tc.root); err != nil {
+			t.Errorf("CheckDotEntries(%q): %v", tc.dir, err)
+		}
+	}
+
+	// A moved directory's ".." follows it.
+	c := path.Join(dir, "c")
+	if err := syscall.Rename(b, c); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if err := fusetesting.CheckDotEntries(c, false); err != nil {
+		t.Errorf("CheckDotEntries after rename: %v", err)
+	}
+
+	children = children[1:]
+
+	// Read the listing of a with a buffer that has room for the dot entries
+	// alone, so that the kernel consumes only them from the file system's
+	// first reply, and then continues from the offset after them.
+	fd, err := syscall.Open(a, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	// Each of "." and ".." takes 24 bytes as a linux_dirent64.
+	var names []string
+	for _, size := range []int{48, 4096, 4096} {
+		buf := make([]byte, size)
+		n, err := syscall.ReadDirent(fd, buf)
+		if err != nil {
+			t.Fatalf("ReadDirent: %v", err)
+		}
+
+		_, _, names = syscall.ParseDirent(buf[:n], -1, names)
+
+		// ParseDirent skips the dot entries, so after the first read there
+		// should be nothing.
+		if size == 48 && len(names) != 0 {
+			t.Errorf("First read returned %v", names)
+		}
+	}
+
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, children) {
+		t.Errorf("Listing: got %v, want %v", names, children)
+	}
+}
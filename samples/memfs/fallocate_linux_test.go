@@ -0,0 +1,125 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/memfs"
+	"golang.org/x/sys/unix"
+)
+
+func TestFallocate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	// Without writeback caching the kernel takes file sizes from memfs, rather
+	// than from its own idea of them.
+	server := memfs.NewMemFS(currentUid(), currentGid())
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		FSName:                  "memfs",
+		DisableWritebackCaching: true,
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	fd, err := syscall.Open(path.Join(dir, "foo"), syscall.O_RDWR|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	size := func() int64 {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil {
+			t.Fatalf("Fstat: %v", err)
+		}
+
+		return st.Size
+	}
+
+	// Allocating grows the file, unless asked to keep its size.
+	if err := unix.Fallocate(fd, 0, 0, 4096); err != nil {
+		t.Fatalf("Fallocate: %v", err)
+	}
+
+	if got := size(); got != 4096 {
+		t.Errorf("Size after Fallocate: got %d, want 4096", got)
+	}
+
+	if err := unix.Fallocate(fd, unix.FALLOC_FL_KEEP_SIZE, 4096, 4096); err != nil {
+		t.Fatalf("Fallocate(KEEP_SIZE): %v", err)
+	}
+
+	if got := size(); got != 4096 {
+		t.Errorf("Size after Fallocate(KEEP_SIZE): got %d, want 4096", got)
+	}
+
+	// Punching a hole zeroes the range, leaving the size be.
+	if _, err := syscall.Pwrite(fd, []byte("taco burrito"), 0); err != nil {
+		t.Fatalf("Pwrite: %v", err)
+	}
+
+	if err := unix.Fallocate(fd, unix.FALLOC_FL_KEEP_SIZE|unix.FALLOC_FL_PUNCH_HOLE, 5, 7); err != nil {
+		t.Fatalf("Fallocate(PUNCH_HOLE): %v", err)
+	}
+
+	buf := make([]byte, 13)
+	n, err := syscall.Pread(fd, buf, 0)
+	if err != nil || string(buf[:n]) != "taco \x00\x00\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("Pread after Fallocate(PUNCH_HOLE): got %q, %v", buf[:n], err)
+	}
+
+	if got := size(); got != 4096 {
+		t.Errorf("Size after Fallocate(PUNCH_HOLE): got %d, want 4096", got)
+	}
+
+	// The kernel itself refuses a hole that would change the size, and
+	// fallocate(2) keeps working afterwards.
+	if err := unix.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE, 0, 1); err != syscall.EOPNOTSUPP {
+		t.Errorf("Fallocate(PUNCH_HOLE) without KEEP_SIZE: got %v, want EOPNOTSUPP", err)
+	}
+
+	if err := unix.Fallocate(fd, 0, 0, 8192); err != nil {
+		t.Errorf("Fallocate: %v", err)
+	}
+
+	if got := size(); got != 8192 {
+		t.Errorf("Size after second Fallocate: got %d, want 8192", got)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package memfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// memfs, recording the flock(2) locks set and the releases that drop them.
+type flockRecorder struct {
+	fuseutil.FileSystem
+
+	mu       sync.Mutex
+	locks    []fuseops.SetLockOp
+	releases []fuseops.ReleaseFileHandleOp
+}
+
+func (fs *flockRecorder) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	if op.Flock {
+		fs.mu.Lock()
+		fs.locks = append(fs.locks, *op)
+		fs.mu.Unlock()
+	}
+
+	return fs.FileSystem.SetLock(ctx, op)
+}
+
+func (fs *flockRecorder) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	if op.Flags&fuseops.ReleaseFlockUnlock != 0 {
+		fs.mu.Lock()
+		fs.releases = append(fs.releases, *op)
+		fs.mu.Unlock()
+	}
+
+	return fs.FileSystem.ReleaseFileHandle(ctx, op)
+}
+
+// Forget what has been recorded so far, returning it.
+func (fs *flockRecorder) take() ([]fuseops.SetLockOp, []fuseops.ReleaseFileHandleOp) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	locks, releases := fs.locks, fs.releases
+	fs.locks, fs.releases = nil, nil
+	return locks, releases
+}
+
+func TestFlock(t *testing.T) {
+	flockPath, err := exec.LookPath("flock")
+	if err != nil {
+		t.Skipf("No flock(1): %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	fs := &flockRecorder{FileSystem: memfs.NewFileSystem(currentUid(), currentGid())}
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:           "memfs",
+		EnableFlockLocks: true,
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	name := path.Join(dir, "foo")
+	fd, err := syscall.Open(name, syscall.O_RDONLY|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	syscall.Close(fd)
+
+	runFlock := func(args ...string) error {
+		return exec.Command(flockPath, append(args, name, "true")...).Run()
+	}
+
+	// flock(1) takes an exclusive lock on the whole file, which memfs sees,
+	// and drops it by closing the file.
+	if err := runFlock(); err != nil {
+		t.Fatalf("flock: %v", err)
+	}
+
+	locks, _ := fs.take()
+	if len(locks) != 1 {
+		t.Fatalf("Got %d flock locks, want 1: %+v", len(locks), locks)
+	}
+
+	want := fuseops.FileLock{Start: 0, End: math.MaxInt64, Type: syscall.F_WRLCK}
+	if got := locks[0].Lock; got.Start != want.Start || got.End != want.End || got.Type != want.Type {
+		t.Errorf("Got lock %+v, want %+v", got, want)
+	}
+
+	// While we hold an exclusive lock, flock(1) can't take one of either kind.
+	fd, err = syscall.Open(name, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer func() {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}()
+
+	// flock(1)'s handle is released asynchronously, so its lock may not be
+	// gone yet.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		err := syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+
+		if err != syscall.EWOULDBLOCK || time.Now().After(deadline) {
+			t.Fatalf("Flock: %v", err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, args := range [][]string{{"-n"}, {"-n", "-s"}} {
+		if err := runFlock(args...); err == nil {
+			t.Errorf("flock %v succeeded while we held the lock", args)
+		}
+	}
+
+	// fcntl(2) locks don't interact with flock(2) locks.
+	if err := syscall.FcntlFlock(uintptr(fd), syscall.F_SETLK, &syscall.Flock_t{Type: syscall.F_RDLCK}); err != nil {
+		t.Errorf("FcntlFlock: %v", err)
+	}
+
+	// Closing our descriptor releases our lock, which memfs hears about from
+	// the release of our handle, and flock(1) then gets it.
+	locks, _ = fs.take()
+	var owner uint64
+	for _, l := range locks {
+		if l.Lock.Type == syscall.F_WRLCK && l.Lock.Pid == uint32(os.Getpid()) {
+			owner = l.Owner
+		}
+	}
+
+	if owner == 0 {
+		t.Fatalf("Our lock wasn't recorded: %+v", locks)
+	}
+
+	syscall.Close(fd)
+	fd = -1
+
+	deadline = time.Now().Add(10 * time.Second)
+	for {
+		if err := runFlock("-n"); err == nil {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("flock still failing after we closed the file")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	released := false
+	_, releases := fs.take()
+	for _, r := range releases {
+		if r.LockOwner == owner {
+			released = true
+		}
+	}
+
+	if !released {
+		t.Errorf("No release for owner %#x: %+v", owner, releases)
+	}
+}
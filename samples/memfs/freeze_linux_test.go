@@ -0,0 +1,225 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// The size of the block each writer writes.
+const freezeBlockSize = 4096
+
+// The block written by the kth iteration of a writer: k, repeated.
+func freezeBlock(k int64) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%07d\n", k)), freezeBlockSize/8)
+}
+
+// Open the file at p for direct I/O, so that the page cache doesn't show
+// readers data the file system hasn't yet been given.
+func openDirect(
+	t *testing.T,
+	p string,
+	flags int) int {
+	fd, err := syscall.Open(p, flags|syscall.O_DIRECT, 0644)
+	if err != nil {
+		t.Fatalf("Open(%q): %v", p, err)
+	}
+
+	return fd
+}
+
+// Write blocks to the files at a and b until stop is set, first to a and
+// then to b, with one more in each iteration. completed is the number of
+// iterations finished so far.
+func freezeWriter(
+	t *testing.T,
+	a string,
+	b string,
+	stop *int32,
+	completed *int64) {
+	fa := openDirect(t, a, syscall.O_WRONLY|syscall.O_CREAT)
+	defer syscall.Close(fa)
+
+	fb := openDirect(t, b, syscall.O_WRONLY|syscall.O_CREAT)
+	defer syscall.Close(fb)
+
+	for k := int64(1); atomic.LoadInt32(stop) == 0; k++ {
+		for _, fd := range []int{fa, fb} {
+			if _, err := syscall.Pwrite(fd, freezeBlock(k), 0); err != nil {
+				t.Errorf("Pwrite: %v", err)
+				return
+			}
+		}
+
+		atomic.StoreInt64(completed, k)
+	}
+}
+
+// Read the iteration number from the block at the start of the file at p,
+// checking that the block isn't torn. Return zero for an empty file.
+func readBlock(t *testing.T, p string) int64 {
+	fd := openDirect(t, p, syscall.O_RDONLY)
+	defer syscall.Close(fd)
+
+	buf := make([]byte, freezeBlockSize)
+	n, err := syscall.Pread(fd, buf, 0)
+	if err != nil {
+		t.Fatalf("Pread(%q): %v", p, err)
+	}
+
+	if n == 0 {
+		return 0
+	}
+
+	var k int64
+	if _, err := fmt.Sscanf(string(buf[:8]), "%d", &k); err != nil || !bytes.Equal(buf[:n], freezeBlock(k)) {
+		t.Fatalf("Torn block in %q: %q", p, buf[:n])
+	}
+
+	return k
+}
+
+// Return the iteration number of every writer's files, in order.
+func snapshot(
+	t *testing.T,
+	dir string,
+	writers int) (s []int64) {
+	for i := 0; i < writers; i++ {
+		s = append(
+			s,
+			readBlock(t, path.Join(dir, fmt.Sprintf("a%d", i))),
+			readBlock(t, path.Join(dir, fmt.Sprintf("b%d", i))))
+	}
+
+	return s
+}
+
+// Wait until each writer has completed more than the given number of
+// iterations.
+func waitForWriters(
+	t *testing.T,
+	completed []int64,
+	than []int64) {
+	deadline := time.Now().Add(10 * time.Second)
+	for i := range completed {
+		for atomic.LoadInt64(&completed[i]) <= than[i] {
+			if time.Now().After(deadline) {
+				t.Fatalf("Writer %d stuck at %d", i, atomic.LoadInt64(&completed[i]))
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	server := memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid()))
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		FSName:                  "memfs",
+		DisableWritebackCaching: true,
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	// Create the files up front. The kernel holds a directory's lock while
+	// waiting for a creation in it, so a frozen creation would keep the
+	// snapshot below from looking anything up in the directory.
+	const writers = 8
+	for i := 0; i < writers; i++ {
+		for _, name := range []string{"a", "b"} {
+			syscall.Close(openDirect(t, path.Join(dir, fmt.Sprint(name, i)), syscall.O_WRONLY|syscall.O_CREAT))
+		}
+	}
+
+	var stop int32
+	completed := make([]int64, writers)
+
+	var wg sync.WaitGroup
+	defer func() {
+		mfs.Thaw()
+		atomic.StoreInt32(&stop, 1)
+		wg.Wait()
+
+		fuse.Unmount(dir)
+		mfs.Join(context.Background())
+	}()
+
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a := path.Join(dir, fmt.Sprintf("a%d", i))
+			b := path.Join(dir, fmt.Sprintf("b%d", i))
+			freezeWriter(t, a, b, &stop, &completed[i])
+		}(i)
+	}
+
+	// Let the storm get going, then freeze.
+	waitForWriters(t, completed, make([]int64, writers))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := mfs.Freeze(ctx); err != nil {
+		t.Fatalf("Freeze: %v", err)
+	}
+
+	// Nothing changes while frozen, though reads carry on.
+	s := snapshot(t, dir, writers)
+	time.Sleep(200 * time.Millisecond)
+
+	if s2 := snapshot(t, dir, writers); !reflect.DeepEqual(s, s2) {
+		t.Fatalf("Snapshot changed while frozen:\n%v\n%v", s, s2)
+	}
+
+	// The snapshot is consistent: each writer's second file is the same as its
+	// first, or one iteration behind.
+	frozen := make([]int64, writers)
+	for i := range frozen {
+		a, b := s[2*i], s[2*i+1]
+		if b != a && b != a-1 {
+			t.Errorf("Writer %d: a at %d, b at %d", i, a, b)
+		}
+
+		frozen[i] = a
+	}
+
+	// Once thawed, the writers carry on.
+	mfs.Thaw()
+	waitForWriters(t, completed, frozen)
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// An inode ID freed once the kernel forgets it is reused in a new generation.
+func TestGeneration_ReusedID(t *testing.T) {
+	fs := memfs.NewFileSystem(uint32(os.Getuid()), uint32(os.Getgid()))
+	ctx := context.Background()
+
+	create := func(name string) fuseops.ChildInodeEntry {
+		op := &fuseops.CreateFileOp{
+			Parent:   fuseops.RootInodeID,
+			Name:     name,
+			Mode:     0600,
+			Metadata: fuseops.OpMetadata{Pid: uint32(os.Getpid())},
+		}
+
+		if err := fs.CreateFile(ctx, op); err != nil {
+			t.Fatalf("CreateFile(%q): %v", name, err)
+		}
+
+		return op.Entry
+	}
+
+	first := create("taco")
+
+	// Still known to the kernel, so not yet reused.
+	err := fs.Unlink(ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "taco"})
+	if err != nil {
+		t.Fatalf("Unlink: %v", err)
+	}
+
+	if other := create("burrito"); other.Child == first.Child {
+		t.Fatalf("ID %d reused before being forgotten", first.Child)
+	}
+
+	if err := fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: first.Child, N: 1}); err != nil {
+		t.Fatalf("ForgetInode: %v", err)
+	}
+
+	second := create("enchilada")
+	if second.Child != first.Child {
+		t.Fatalf("Got ID %d, want freed ID %d", second.Child, first.Child)
+	}
+
+	if second.Generation == first.Generation {
+		t.Errorf("ID %d reused in the same generation %d", second.Child, second.Generation)
+	}
+
+	// A lookup sees the current generation.
+	op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "enchilada"}
+	if err := fs.LookUpInode(ctx, op); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	if op.Entry.Generation != second.Generation {
+		t.Errorf("Lookup generation %d, want %d", op.Entry.Generation, second.Generation)
+	}
+}
@@ -18,11 +18,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"syscall"
 	"time"
 
-	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/sys/unix"
 )
 
 // Common attributes for files and directories.
@@ -53,6 +54,17 @@ type inode struct {
 	// INVARIANT: Contains no duplicate names in used entries.
 	entries []fuseutil.Dirent
 
+	// For directories, the ID of the parent directory, listed as "..". The
+	// root is its own parent. A directory that has been removed keeps the
+	// parent it was removed from, as ext4's do, so that ".." still leads
+	// somewhere from a process's working directory.
+	parent fuseops.InodeID
+
+	// For directories, the number of removed directories that name this one as
+	// their parent and have yet to be deallocated. This one isn't deallocated
+	// until then.
+	deadChildren int
+
 	// For files, the current contents of the file.
 	//
 	// INVARIANT: If !isFile(), len(contents) == 0
@@ -266,7 +278,9 @@ func (in *inode) RemoveChild(name string) {
 	}
 }
 
-// Serve a ReadDir request.
+// Serve a ReadDir request for the children, starting at the given index
+// into in.entries. Their offsets are shifted to follow the "." and ".."
+// entries.
 //
 // REQUIRES: in.isDir()
 func (in *inode) ReadDir(p []byte, offset int) int {
@@ -283,7 +297,8 @@ func (in *inode) ReadDir(p []byte, offset int) int {
 			continue
 		}
 
-		tmp := fuseutil.WriteDirent(p[n:], in.entries[i])
+		e.Offset += fuseutil.DotEntryCount
+		tmp := fuseutil.WriteDirent(p[n:], e)
 		if tmp == 0 {
 			break
 		}
@@ -350,6 +365,8 @@ func (in *inode) WriteAt(p []byte, off int64) (int, error) {
 func (in *inode) SetAttributes(
 	size *uint64,
 	mode *os.FileMode,
+	uid *uint32,
+	gid *uint32,
 	mtime *time.Time) {
 	// Update the modification time.
 	in.attrs.Mtime = time.Now()
@@ -375,21 +392,100 @@ func (in *inode) SetAttributes(
 		in.attrs.Mode = *mode
 	}
 
+	// Change owner?
+	if uid != nil {
+		in.attrs.Uid = *uid
+	}
+
+	if gid != nil {
+		in.attrs.Gid = *gid
+	}
+
 	// Change mtime?
 	if mtime != nil {
 		in.attrs.Mtime = *mtime
 	}
 }
 
+// Allocate or deallocate a range of the file, as for fuseops.FallocateOp.
+// Since the contents are held in full, allocating only grows the file, unless
+// mode has FALLOC_FL_KEEP_SIZE, and punching a hole zeroes the part of the
+// range within it.
 func (in *inode) Fallocate(mode uint32, offset uint64, length uint64) error {
-	if mode != 0 {
-		return fuse.ENOSYS
-	}
-	newSize := int(offset + length)
-	if newSize > len(in.contents) {
-		padding := make([]byte, newSize-len(in.contents))
-		in.contents = append(in.contents, padding...)
-		in.attrs.Size = offset + length
+	end := offset + length
+
+	switch mode {
+	case 0:
+		if end > uint64(len(in.contents)) {
+			padding := make([]byte, int(end)-len(in.contents))
+			in.contents = append(in.contents, padding...)
+			in.attrs.Size = end
+			in.attrs.Mtime = time.Now()
+		}
+
+	case unix.FALLOC_FL_KEEP_SIZE:
+
+	case unix.FALLOC_FL_KEEP_SIZE | unix.FALLOC_FL_PUNCH_HOLE:
+		if end > uint64(len(in.contents)) {
+			end = uint64(len(in.contents))
+		}
+
+		if offset < end {
+			hole := in.contents[offset:end]
+			for i := range hole {
+				hole[i] = 0
+			}
+
+			in.attrs.Mtime = time.Now()
+		}
+
+	default:
+		return syscall.EOPNOTSUPP
 	}
+
 	return nil
 }
+
+// The granularity at which Lseek finds holes.
+const holeBlockSize = 4096
+
+// Find data or a hole in the file, as for fuseops.LseekOp. Since the contents
+// are held in full, the holes are taken to be the aligned blocks of
+// holeBlockSize bytes that hold only zeroes, plus the end of the file.
+//
+// REQUIRES: in.isFile()
+func (in *inode) Lseek(offset int64, whence fuseops.SeekWhence) (int64, error) {
+	size := int64(len(in.contents))
+	if offset >= size {
+		return 0, syscall.ENXIO
+	}
+
+	for start := offset - offset%holeBlockSize; start < size; start += holeBlockSize {
+		end := start + holeBlockSize
+		if end > size {
+			end = size
+		}
+
+		hole := true
+		for _, b := range in.contents[start:end] {
+			if b != 0 {
+				hole = false
+				break
+			}
+		}
+
+		if hole == (whence == fuseops.SeekHole) {
+			if start < offset {
+				return offset, nil
+			}
+
+			return start, nil
+		}
+	}
+
+	if whence == fuseops.SeekHole {
+		return size, nil
+	}
+
+	return 0, syscall.ENXIO
+}
@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// An entry read from a directory, and the offset from which to continue
+// after it.
+type listedEntry struct {
+	name   string
+	offset fuseops.DirOffset
+}
+
+// Read the listing of the directory open on the given handle from offset
+// until the file system returns nothing, size bytes at a time.
+func readListing(
+	t *testing.T,
+	k *fusetesting.FakeKernel,
+	h fuseops.HandleID,
+	offset fuseops.DirOffset,
+	size int) (entries []listedEntry) {
+	for {
+		buf, err := k.ReadDir(fuseops.RootInodeID, h, offset, size)
+		if err != nil {
+			t.Fatalf("ReadDir(%d): %v", offset, err)
+		}
+
+		if len(buf) == 0 {
+			return entries
+		}
+
+		for len(buf) > 0 {
+			d, n := fuseutil.ReadDirent(buf)
+			if n == 0 {
+				t.Fatalf("Corrupt listing at offset %d", offset)
+			}
+
+			entries = append(entries, listedEntry{d.Name, d.Offset})
+			offset = d.Offset
+			buf = buf[n:]
+		}
+	}
+}
+
+func TestLargeDirectory(t *testing.T) {
+	fs := memfs.NewFileSystem(uint32(os.Getuid()), uint32(os.Getgid()))
+	ctx := context.Background()
+
+	// Far more than fits in one request, with names of varied lengths so that
+	// entries straddle the ends of the buffers.
+	const n = 3000
+	want := []string{".", ".."}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("%d_%s", i, strings.Repeat("x", i%37))
+		op := &fuseops.CreateFileOp{
+			Parent:   fuseops.RootInodeID,
+			Name:     name,
+			Mode:     0600,
+			Metadata: fuseops.OpMetadata{Pid: uint32(os.Getpid())},
+		}
+
+		if err := fs.CreateFile(ctx, op); err != nil {
+			t.Fatalf("CreateFile: %v", err)
+		}
+
+		want = append(want, name)
+	}
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	h, err := k.OpenDir(fuseops.RootInodeID)
+	if err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	defer k.ReleaseDir(fuseops.RootInodeID, h)
+
+	// Continuing from the offset of each entry lists each name once.
+	entries := readListing(t, k, h, 0, 256)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.name)
+	}
+
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("Listed %d entries, want %d, in creation order", len(names), len(want))
+	}
+
+	// The same handle may be read again from any offset it returned, e.g. by
+	// a kernel whose buffer filled part way through a reply. From the last,
+	// there is nothing more.
+	for _, i := range []int{0, 1, 2, 1000, len(entries) - 1} {
+		rest := readListing(t, k, h, entries[i].offset, 4096)
+		if len(rest) != len(entries[i+1:]) || (len(rest) > 0 && !reflect.DeepEqual(rest, entries[i+1:])) {
+			t.Errorf(
+				"From offset %d: got %d entries, want %d",
+				entries[i].offset,
+				len(rest),
+				len(entries[i+1:]))
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package memfs_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Set for TestLocksHelper to the file it should lock.
+const locksHelperFileEnv = "MEMFS_LOCKS_HELPER_FILE"
+
+var lockTypes = map[string]int16{
+	"rd": syscall.F_RDLCK,
+	"wr": syscall.F_WRLCK,
+	"un": syscall.F_UNLCK,
+}
+
+var lockCmds = map[string]int{
+	"getlk":  syscall.F_GETLK,
+	"setlk":  syscall.F_SETLK,
+	"setlkw": syscall.F_SETLKW,
+}
+
+// Parse a command such as "setlk wr 0 100" into an fcntl(2) command and lock.
+func parseLockCommand(line string) (cmd int, lk syscall.Flock_t, err error) {
+	var name, typ string
+	if _, err = fmt.Sscan(line, &name, &typ, &lk.Start, &lk.Len); err != nil {
+		return
+	}
+
+	cmd, ok := lockCmds[name]
+	if !ok {
+		err = fmt.Errorf("unknown command %q", name)
+		return
+	}
+
+	lk.Type, ok = lockTypes[typ]
+	if !ok {
+		err = fmt.Errorf("unknown lock type %q", typ)
+	}
+
+	lk.Whence = io.SeekStart
+	return
+}
+
+// Format the result of a lock command the way TestLocksHelper reports it.
+func formatLockResult(cmd int, lk syscall.Flock_t, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+
+	if cmd != syscall.F_GETLK {
+		return "ok"
+	}
+
+	if lk.Type == syscall.F_UNLCK {
+		return "unlocked"
+	}
+
+	typ := "rd"
+	if lk.Type == syscall.F_WRLCK {
+		typ = "wr"
+	}
+
+	return fmt.Sprintf("%s %d %d %d", typ, lk.Start, lk.Len, lk.Pid)
+}
+
+func lock(fd int, line string) string {
+	cmd, lk, err := parseLockCommand(line)
+	if err != nil {
+		return err.Error()
+	}
+
+	err = syscall.FcntlFlock(uintptr(fd), cmd, &lk)
+	return formatLockResult(cmd, lk, err)
+}
+
+// Run by TestLocks in another process, since record locks belong to
+// processes. Carries out a lock command from each line of stdin, and writes
+// its result to stdout.
+func TestLocksHelper(t *testing.T) {
+	name := os.Getenv(locksHelperFileEnv)
+	if name == "" {
+		t.Skip("Run by TestLocks")
+	}
+
+	fd, err := syscall.Open(name, syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		fmt.Println(lock(fd, scanner.Text()))
+	}
+}
+
+// Another process taking locks on the same file, through TestLocksHelper.
+type lockHelper struct {
+	t       *testing.T
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	results chan string
+}
+
+func startLockHelper(t *testing.T, name string) *lockHelper {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLocksHelper$")
+	cmd.Env = append(os.Environ(), locksHelperFileEnv+"="+name)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("StdinPipe: %v", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe: %v", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	h := &lockHelper{
+		t:       t,
+		cmd:     cmd,
+		stdin:   stdin,
+		results: make(chan string, 1),
+	}
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			h.results <- scanner.Text()
+		}
+
+		close(h.results)
+	}()
+
+	return h
+}
+
+// Send a command to the helper without waiting for its result.
+func (h *lockHelper) send(line string) {
+	if _, err := fmt.Fprintln(h.stdin, line); err != nil {
+		h.t.Fatalf("Sending %q: %v", line, err)
+	}
+}
+
+func (h *lockHelper) result(line string) string {
+	select {
+	case r, ok := <-h.results:
+		if !ok {
+			h.t.Fatalf("%q: the helper exited", line)
+		}
+
+		return r
+
+	case <-time.After(10 * time.Second):
+		h.t.Fatalf("%q: timed out waiting for the helper", line)
+	}
+
+	return ""
+}
+
+func (h *lockHelper) lock(line string) string {
+	h.send(line)
+	return h.result(line)
+}
+
+// Close the helper's descriptor, releasing its locks, and wait for it to exit.
+func (h *lockHelper) stop() {
+	h.stdin.Close()
+	if err := h.cmd.Wait(); err != nil {
+		h.t.Errorf("Helper: %v", err)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	server := memfs.NewMemFS(currentUid(), currentGid())
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		FSName:           "memfs",
+		EnablePOSIXLocks: true,
+	})
+
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	name := path.Join(dir, "foo")
+	fd, err := syscall.Open(name, syscall.O_RDWR|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer func() {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}()
+
+	h := startLockHelper(t, name)
+	defer func() {
+		if h != nil {
+			h.stop()
+		}
+	}()
+
+	pid := os.Getpid()
+	expect := func(who string, got string, line string, want string) {
+		t.Helper()
+		if got != want {
+			t.Errorf("%s %q: got %q, want %q", who, line, got, want)
+		}
+	}
+
+	ours := func(line string, want string) {
+		t.Helper()
+		expect("We", lock(fd, line), line, want)
+	}
+
+	theirs := func(line string, want string) {
+		t.Helper()
+		expect("Helper", h.lock(line), line, want)
+	}
+
+	// A write lock keeps the helper out of its range, and only its range.
+	ours("setlk wr 0 100", "ok")
+	theirs("getlk wr 50 10", fmt.Sprintf("wr 0 100 %d", pid))
+	theirs("getlk rd 100 0", "unlocked")
+	theirs("setlk rd 90 20", syscall.EAGAIN.Error())
+	theirs("setlk rd 100 100", "ok")
+	ours("getlk wr 0 0", fmt.Sprintf("rd 100 100 %d", h.cmd.Process.Pid))
+
+	// Our own locks never conflict, so we may upgrade over the helper's read
+	// lock only where it isn't.
+	ours("setlk wr 0 200", syscall.EAGAIN.Error())
+
+	// Downgrading part of our lock splits it, sharing that part.
+	ours("setlk rd 0 50", "ok")
+	theirs("setlk rd 0 10", "ok")
+	theirs("getlk rd 40 20", fmt.Sprintf("wr 50 50 %d", pid))
+	theirs("setlk wr 60 1", syscall.EAGAIN.Error())
+
+	// A waiting lock is granted when our locks go away with our descriptor.
+	const wait = "setlkw wr 60 1"
+	h.send(wait)
+	select {
+	case r := <-h.results:
+		t.Fatalf("%q returned %q while we held the range", wait, r)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := syscall.Close(fd); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	fd = -1
+	expect("Helper", h.result(wait), wait, "ok")
+
+	// The helper now has its own locks, and nothing else.
+	fd, err = syscall.Open(name, syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	ours("getlk rd 0 0", fmt.Sprintf("wr 60 1 %d", h.cmd.Process.Pid))
+	ours("setlk wr 10 50", "ok")
+	ours("setlk wr 0 1", syscall.EAGAIN.Error())
+
+	// The helper's locks go when it closes the file.
+	h.stop()
+	h = nil
+	ours("setlk wr 0 0", "ok")
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package memfs_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+	"golang.org/x/sys/unix"
+)
+
+// memfs, leaving lseek(2) to NotImplementedFileSystem.
+type noLseekFS struct {
+	fuseutil.FileSystem
+}
+
+func (fs *noLseekFS) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) error {
+	var nfs fuseutil.NotImplementedFileSystem
+	return nfs.Lseek(ctx, op)
+}
+
+type seekCase struct {
+	whence int
+	offset int64
+	want   int64
+	err    error
+}
+
+// Mount fs and create a file in it holding 4 KiB of data, an 8 KiB hole and
+// another 4 KiB of data. Return its descriptor and a function that closes it
+// and unmounts.
+func openSparseFile(t *testing.T, fs fuseutil.FileSystem) (fd int, cleanup func()) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	// Without writeback caching the kernel takes file sizes from memfs, rather
+	// than from its own idea of them.
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{
+		FSName:                  "memfs",
+		DisableWritebackCaching: true,
+	})
+
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("Mount: %v", err)
+	}
+
+	unmount := func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+
+		os.Remove(dir)
+	}
+
+	// Not os.OpenFile, which would have the runtime poll the file.
+	fd, err = syscall.Open(path.Join(dir, "foo"), syscall.O_RDWR|syscall.O_CREAT, 0600)
+	if err != nil {
+		unmount()
+		t.Fatalf("Open: %v", err)
+	}
+
+	cleanup = func() {
+		syscall.Close(fd)
+		unmount()
+	}
+
+	for _, off := range []int64{0, 12 << 10} {
+		if _, err := syscall.Pwrite(fd, bytes.Repeat([]byte("x"), 4<<10), off); err != nil {
+			cleanup()
+			t.Fatalf("Pwrite: %v", err)
+		}
+	}
+
+	return fd, cleanup
+}
+
+func checkSeeks(t *testing.T, fd int, cases []seekCase) {
+	names := map[int]string{unix.SEEK_DATA: "SEEK_DATA", unix.SEEK_HOLE: "SEEK_HOLE"}
+	for _, c := range cases {
+		got, err := syscall.Seek(fd, c.offset, c.whence)
+		if err != c.err || (err == nil && got != c.want) {
+			t.Errorf(
+				"%s from %d: got %d, %v; want %d, %v",
+				names[c.whence],
+				c.offset,
+				got,
+				err,
+				c.want,
+				c.err)
+		}
+	}
+}
+
+func TestLseek(t *testing.T) {
+	fd, cleanup := openSparseFile(t, memfs.NewFileSystem(currentUid(), currentGid()))
+	defer cleanup()
+
+	checkSeeks(t, fd, []seekCase{
+		{unix.SEEK_DATA, 0, 0, nil},
+		{unix.SEEK_DATA, 100, 100, nil},
+		{unix.SEEK_HOLE, 0, 4 << 10, nil},
+		{unix.SEEK_HOLE, 100, 4 << 10, nil},
+
+		// In the hole.
+		{unix.SEEK_DATA, 4 << 10, 12 << 10, nil},
+		{unix.SEEK_DATA, 5000, 12 << 10, nil},
+		{unix.SEEK_HOLE, 5000, 5000, nil},
+
+		// The end of the file is a hole, and there is nothing at or past it.
+		{unix.SEEK_HOLE, 12 << 10, 16 << 10, nil},
+		{unix.SEEK_DATA, 16<<10 - 1, 16<<10 - 1, nil},
+		{unix.SEEK_DATA, 16 << 10, 0, syscall.ENXIO},
+		{unix.SEEK_HOLE, 16 << 10, 0, syscall.ENXIO},
+		{unix.SEEK_DATA, 1 << 20, 0, syscall.ENXIO},
+	})
+
+	// Growing the file leaves a hole at its end, with no data after it.
+	if err := syscall.Ftruncate(fd, 24<<10); err != nil {
+		t.Fatalf("Ftruncate: %v", err)
+	}
+
+	checkSeeks(t, fd, []seekCase{
+		{unix.SEEK_HOLE, 12 << 10, 16 << 10, nil},
+		{unix.SEEK_HOLE, 20 << 10, 20 << 10, nil},
+		{unix.SEEK_DATA, 16 << 10, 0, syscall.ENXIO},
+		{unix.SEEK_HOLE, 24 << 10, 0, syscall.ENXIO},
+	})
+}
+
+func TestLseek_NotImplemented(t *testing.T) {
+	fd, cleanup := openSparseFile(t, &noLseekFS{memfs.NewFileSystem(currentUid(), currentGid())})
+	defer cleanup()
+
+	// The kernel treats the whole file as data.
+	checkSeeks(t, fd, []seekCase{
+		{unix.SEEK_DATA, 4 << 10, 4 << 10, nil},
+		{unix.SEEK_HOLE, 0, 16 << 10, nil},
+		{unix.SEEK_DATA, 16 << 10, 0, syscall.ENXIO},
+		{unix.SEEK_HOLE, 16 << 10, 0, syscall.ENXIO},
+	})
+}
@@ -29,6 +29,9 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// The renameat2(2) flags that memfs implements, for MountConfig.RenameFlags.
+const RenameFlags = fuseops.RenameNoReplace | fuseops.RenameExchange
+
 type memFS struct {
 	fuseutil.NotImplementedFileSystem
 
@@ -36,6 +39,16 @@ type memFS struct {
 	uid uint32
 	gid uint32
 
+	// The kernel's lookup counts for our inodes, for each connection on which
+	// we're served. Updated with mu held, so that the decision to deallocate an
+	// inode is consistent with our other state.
+	lookups *fuseutil.LookupCounts
+
+	// The record and flock(2) locks held on our inodes, when mounted with
+	// fuse.MountConfig.EnablePOSIXLocks or EnableFlockLocks. They have their own lock, since
+	// SetLock may wait for another owner's.
+	locks *fuseutil.FileLocks
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
@@ -61,21 +74,43 @@ type memFS struct {
 	// INVARIANT: This is all and only indices i of 'inodes' such that i >
 	// fuseops.RootInodeID and inodes[i] == nil
 	freeInodes []fuseops.InodeID // GUARDED_BY(mu)
+
+	// The generation of each ID in inodes, changed each time the ID is reused
+	// so that an NFS file handle naming an earlier inode with the ID is told
+	// apart from the current one. See fuseops.GenerationNumber.
+	//
+	// INVARIANT: len(generations) == len(inodes)
+	generations []fuseops.GenerationNumber // GUARDED_BY(mu)
 }
 
 // Create a file system that stores data and metadata in memory.
 //
 // The supplied UID/GID pair will own the root inode. This file system does no
-// permissions checking, and should therefore be mounted with the
-// default_permissions option.
+// permissions checking of its own unless mounted with
+// fuse.MountConfig.CheckWriteAccess, relying on the kernel's, and should
+// therefore be mounted with the default_permissions option.
+//
+// The result may be mounted at several mount points at once, each showing the
+// same contents.
 func NewMemFS(
 	uid uint32,
 	gid uint32) fuse.Server {
+	return fuseutil.NewFileSystemServer(NewFileSystem(uid, gid))
+}
+
+// NewFileSystem is like NewMemFS, but returns the file system itself rather
+// than a server for it, e.g. for use with fuseutil.NewIOFS.
+func NewFileSystem(
+	uid uint32,
+	gid uint32) fuseutil.FileSystem {
 	// Set up the basic struct.
 	fs := &memFS{
-		inodes: make([]*inode, fuseops.RootInodeID+1),
-		uid:    uid,
-		gid:    gid,
+		inodes:      make([]*inode, fuseops.RootInodeID+1),
+		generations: make([]fuseops.GenerationNumber, fuseops.RootInodeID+1),
+		uid:         uid,
+		gid:         gid,
+		lookups:     fuseutil.NewLookupCounts(),
+		locks:       fuseutil.NewFileLocks(),
 	}
 
 	// Set up the root inode.
@@ -85,12 +120,14 @@ func NewMemFS(
 		Gid:  gid,
 	}
 
-	fs.inodes[fuseops.RootInodeID] = newInode(rootAttrs)
+	root := newInode(rootAttrs)
+	root.parent = fuseops.RootInodeID
+	fs.inodes[fuseops.RootInodeID] = root
 
 	// Set up invariant checking.
 	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
 
-	return fuseutil.NewFileSystemServer(fs)
+	return fs
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -110,6 +147,14 @@ func (fs *memFS) checkInvariants() {
 		panic("Expected root to be a directory.")
 	}
 
+	// INVARIANT: len(generations) == len(inodes)
+	if len(fs.generations) != len(fs.inodes) {
+		panic(fmt.Sprintf(
+			"Generations length mismatch: %v vs. %v",
+			len(fs.generations),
+			len(fs.inodes)))
+	}
+
 	// Build our own list of free IDs.
 	freeIDsEncountered := make(map[fuseops.InodeID]struct{})
 	for i := fuseops.RootInodeID + 1; i < len(fs.inodes); i++ {
@@ -139,6 +184,25 @@ func (fs *memFS) checkInvariants() {
 	for _, in := range fs.inodes {
 		in.CheckInvariants()
 	}
+
+	// INVARIANT: For each directory, deadChildren counts the removed
+	// directories naming it as their parent.
+	deadChildren := make(map[fuseops.InodeID]int)
+	for i, in := range fs.inodes {
+		if i != fuseops.RootInodeID && in != nil && in.isDir() && in.attrs.Nlink == 0 {
+			deadChildren[in.parent]++
+		}
+	}
+
+	for i, in := range fs.inodes {
+		if in != nil && in.deadChildren != deadChildren[fuseops.InodeID(i)] {
+			panic(fmt.Sprintf(
+				"Inode %d: deadChildren %d, want %d",
+				i,
+				in.deadChildren,
+				deadChildren[fuseops.InodeID(i)]))
+		}
+	}
 }
 
 // Find the given inode. Panic if it doesn't exist.
@@ -161,15 +225,18 @@ func (fs *memFS) allocateInode(
 	// Create the inode.
 	inode = newInode(attrs)
 
-	// Re-use a free ID if possible. Otherwise mint a new one.
+	// Re-use a free ID if possible, in a new generation. Otherwise mint a new
+	// one.
 	numFree := len(fs.freeInodes)
 	if numFree != 0 {
 		id = fs.freeInodes[numFree-1]
 		fs.freeInodes = fs.freeInodes[:numFree-1]
 		fs.inodes[id] = inode
+		fs.generations[id]++
 	} else {
 		id = fuseops.InodeID(len(fs.inodes))
 		fs.inodes = append(fs.inodes, inode)
+		fs.generations = append(fs.generations, 0)
 	}
 
 	return id, inode
@@ -181,10 +248,105 @@ func (fs *memFS) deallocateInode(id fuseops.InodeID) {
 	fs.inodes[id] = nil
 }
 
+// Deallocate the given inode if it is no longer linked into the tree, no
+// connection's kernel knows about it, and no removed directory names it as
+// its parent. Deallocating a removed directory may in turn allow its parent
+// to be deallocated.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) maybeDeallocateInode(id fuseops.InodeID) {
+	for id != fuseops.RootInodeID {
+		inode := fs.inodes[id]
+		if inode == nil ||
+			inode.attrs.Nlink != 0 ||
+			inode.deadChildren != 0 ||
+			fs.lookups.Total(id) != 0 {
+			return
+		}
+
+		fs.deallocateInode(id)
+		if !inode.isDir() {
+			return
+		}
+
+		id = inode.parent
+		fs.getInodeOrDie(id).deadChildren--
+	}
+}
+
+// Note that the directory with the given ID has been removed from its parent,
+// and deallocate it if possible.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) removeDir(id fuseops.InodeID) {
+	dir := fs.getInodeOrDie(id)
+	dir.attrs.Nlink--
+	fs.getInodeOrDie(dir.parent).deadChildren++
+	fs.maybeDeallocateInode(id)
+}
+
+// Find the directory to which an entry is to be added. Return ENOENT if it
+// has been removed, as ext4 does, e.g. for a process whose working directory
+// was removed through another mount, which the kernel for this one doesn't
+// know of.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *memFS) getParentForCreate(id fuseops.InodeID) (*inode, error) {
+	parent := fs.getInodeOrDie(id)
+	if id != fuseops.RootInodeID && parent.attrs.Nlink == 0 {
+		return nil, fuse.ENOENT
+	}
+
+	return parent, nil
+}
+
 ////////////////////////////////////////////////////////////////////////
 // FileSystem methods
 ////////////////////////////////////////////////////////////////////////
 
+// Capabilities implements fuse.CapabilityReporter. Since no expiration times
+// are given to the kernel, changes made through other mounts of the file
+// system are seen at once.
+func (fs *memFS) Capabilities() *fuse.Capabilities {
+	return &fuse.Capabilities{
+		Ops: []string{
+			"StatFS",
+			"LookUpInode",
+			"GetInodeAttributes",
+			"SetInodeAttributes",
+			"ForgetInode",
+			"MkDir",
+			"MkNode",
+			"CreateFile",
+			"CreateLink",
+			"CreateSymlink",
+			"Rename",
+			"RmDir",
+			"Unlink",
+			"OpenDir",
+			"ReadDir",
+			"OpenFile",
+			"ReadFile",
+			"WriteFile",
+			"FlushFile",
+			"ReleaseFileHandle",
+			"ReadSymlink",
+			"RemoveXattr",
+			"GetXattr",
+			"ListXattr",
+			"SetXattr",
+			"Fallocate",
+			"Lseek",
+			"CopyFileRange",
+			"GetLock",
+			"SetLock",
+			"Access",
+		},
+		AtomicRename: true,
+		Consistency:  fuse.ConsistencyExpiring,
+	}
+}
+
 func (fs *memFS) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) error {
@@ -200,23 +362,32 @@ func (fs *memFS) LookUpInode(
 	// Grab the parent directory.
 	inode := fs.getInodeOrDie(op.Parent)
 
-	// Does the directory have an entry with the given name?
+	// Does the directory have an entry with the given name? The kernel
+	// resolves ".." itself, except for directories it knows only by inode
+	// (e.g. when exported over NFS), for which we answer even if the directory
+	// has been removed.
 	childID, _, ok := inode.LookUpChild(op.Name)
+	if op.Name == ".." {
+		childID, ok = inode.parent, true
+	}
+
 	if !ok {
 		return fuse.ENOENT
 	}
 
 	// Grab the child.
 	child := fs.getInodeOrDie(childID)
+	fs.lookups.Increment(ctx, childID)
 
 	// Fill in the response.
 	op.Entry.Child = childID
+	op.Entry.Generation = fs.generations[childID]
 	op.Entry.Attributes = child.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	op.Entry.AttributesValidFor = 365 * 24 * time.Hour
+	op.Entry.EntryValidFor = op.Entry.AttributesValidFor
 
 	return nil
 }
@@ -235,7 +406,7 @@ func (fs *memFS) GetInodeAttributes(
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
-	op.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	op.AttributesValidFor = 365 * 24 * time.Hour
 
 	return nil
 }
@@ -257,14 +428,14 @@ func (fs *memFS) SetInodeAttributes(
 	inode := fs.getInodeOrDie(op.Inode)
 
 	// Handle the request.
-	inode.SetAttributes(op.Size, op.Mode, op.Mtime)
+	inode.SetAttributes(op.Size, op.Mode, op.Uid, op.Gid, op.Mtime)
 
 	// Fill in the response.
 	op.Attributes = inode.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
-	op.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	op.AttributesValidFor = 365 * 24 * time.Hour
 
 	return err
 }
@@ -276,7 +447,10 @@ func (fs *memFS) MkDir(
 	defer fs.mu.Unlock()
 
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(op.Parent)
+	parent, err := fs.getParentForCreate(op.Parent)
+	if err != nil {
+		return err
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -295,18 +469,21 @@ func (fs *memFS) MkDir(
 
 	// Allocate a child.
 	childID, child := fs.allocateInode(childAttrs)
+	child.parent = op.Parent
+	fs.lookups.Increment(ctx, childID)
 
 	// Add an entry in the parent.
 	parent.AddChild(childID, op.Name, fuseutil.DT_Directory)
 
 	// Fill in the response.
 	op.Entry.Child = childID
+	op.Entry.Generation = fs.generations[childID]
 	op.Entry.Attributes = child.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	op.Entry.AttributesValidFor = 365 * 24 * time.Hour
+	op.Entry.EntryValidFor = op.Entry.AttributesValidFor
 
 	return nil
 }
@@ -318,17 +495,21 @@ func (fs *memFS) MkNode(
 	defer fs.mu.Unlock()
 
 	var err error
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(ctx, op.Parent, op.Name, op.Mode)
 	return err
 }
 
 // LOCKS_REQUIRED(fs.mu)
 func (fs *memFS) createFile(
+	ctx context.Context,
 	parentID fuseops.InodeID,
 	name string,
 	mode os.FileMode) (fuseops.ChildInodeEntry, error) {
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(parentID)
+	parent, err := fs.getParentForCreate(parentID)
+	if err != nil {
+		return fuseops.ChildInodeEntry{}, err
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -352,19 +533,21 @@ func (fs *memFS) createFile(
 
 	// Allocate a child.
 	childID, child := fs.allocateInode(childAttrs)
+	fs.lookups.Increment(ctx, childID)
 
 	// Add an entry in the parent.
-	parent.AddChild(childID, name, fuseutil.DT_File)
+	parent.AddChild(childID, name, fuseutil.DirentTypeOf(mode))
 
 	// Fill in the response entry.
 	var entry fuseops.ChildInodeEntry
 	entry.Child = childID
+	entry.Generation = fs.generations[childID]
 	entry.Attributes = child.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
-	entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	entry.EntryExpiration = entry.AttributesExpiration
+	entry.AttributesValidFor = 365 * 24 * time.Hour
+	entry.EntryValidFor = entry.AttributesValidFor
 
 	return entry, nil
 }
@@ -379,8 +562,12 @@ func (fs *memFS) CreateFile(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	var err error
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(ctx, op.Parent, op.Name, op.Mode)
+	if err == nil {
+		// As for OpenFile.
+		op.HandleData = fs.inodes[op.Entry.Child]
+	}
+
 	return err
 }
 
@@ -391,7 +578,10 @@ func (fs *memFS) CreateSymlink(
 	defer fs.mu.Unlock()
 
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(op.Parent)
+	parent, err := fs.getParentForCreate(op.Parent)
+	if err != nil {
+		return err
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -415,6 +605,7 @@ func (fs *memFS) CreateSymlink(
 
 	// Allocate a child.
 	childID, child := fs.allocateInode(childAttrs)
+	fs.lookups.Increment(ctx, childID)
 
 	// Set up its target.
 	child.target = op.Target
@@ -424,12 +615,13 @@ func (fs *memFS) CreateSymlink(
 
 	// Fill in the response entry.
 	op.Entry.Child = childID
+	op.Entry.Generation = fs.generations[childID]
 	op.Entry.Attributes = child.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	op.Entry.AttributesValidFor = 365 * 24 * time.Hour
+	op.Entry.EntryValidFor = op.Entry.AttributesValidFor
 
 	return nil
 }
@@ -441,7 +633,10 @@ func (fs *memFS) CreateLink(
 	defer fs.mu.Unlock()
 
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(op.Parent)
+	parent, err := fs.getParentForCreate(op.Parent)
+	if err != nil {
+		return err
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -459,16 +654,18 @@ func (fs *memFS) CreateLink(
 	target.attrs.Ctime = now
 
 	// Add an entry in the parent.
-	parent.AddChild(op.Target, op.Name, fuseutil.DT_File)
+	parent.AddChild(op.Target, op.Name, fuseutil.DirentTypeOf(target.attrs.Mode))
+	fs.lookups.Increment(ctx, op.Target)
 
 	// Return the response.
 	op.Entry.Child = op.Target
+	op.Entry.Generation = fs.generations[op.Target]
 	op.Entry.Attributes = target.attrs
 
 	// We don't spontaneously mutate, so the kernel can cache as long as it wants
 	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.AttributesExpiration
+	op.Entry.AttributesValidFor = 365 * 24 * time.Hour
+	op.Entry.EntryValidFor = op.Entry.AttributesValidFor
 
 	return nil
 }
@@ -489,8 +686,46 @@ func (fs *memFS) Rename(
 
 	// If the new name exists already in the new parent, make sure it's not a
 	// non-empty directory, then delete it.
-	newParent := fs.getInodeOrDie(op.NewParent)
-	existingID, _, ok := newParent.LookUpChild(op.NewName)
+	newParent, err := fs.getParentForCreate(op.NewParent)
+	if err != nil {
+		return err
+	}
+
+	existingID, existingType, ok := newParent.LookUpChild(op.NewName)
+	if ok && existingID == childID {
+		// Both names are links to the same inode, so there's nothing to do.
+		return nil
+	}
+
+	switch {
+	case op.Flags&^RenameFlags != 0:
+		return fuse.EINVAL
+
+	case op.Flags&fuseops.RenameNoReplace != 0 && ok:
+		return fuse.EEXIST
+
+	case op.Flags&fuseops.RenameExchange != 0:
+		if !ok {
+			return fuse.ENOENT
+		}
+
+		// Swap the names, and the parents of any directories among them.
+		oldParent.RemoveChild(op.OldName)
+		newParent.RemoveChild(op.NewName)
+		oldParent.AddChild(existingID, op.OldName, existingType)
+		newParent.AddChild(childID, op.NewName, childType)
+
+		if existingType == fuseutil.DT_Directory {
+			fs.getInodeOrDie(existingID).parent = op.OldParent
+		}
+
+		if childType == fuseutil.DT_Directory {
+			fs.getInodeOrDie(childID).parent = op.NewParent
+		}
+
+		return nil
+	}
+
 	if ok {
 		existing := fs.getInodeOrDie(existingID)
 
@@ -500,6 +735,14 @@ func (fs *memFS) Rename(
 		}
 
 		newParent.RemoveChild(op.NewName)
+
+		// The existing inode has been unlinked, as for Unlink and RmDir.
+		if existing.isDir() {
+			fs.removeDir(existingID)
+		} else {
+			existing.attrs.Nlink--
+			fs.maybeDeallocateInode(existingID)
+		}
 	}
 
 	// Link the new name.
@@ -511,6 +754,11 @@ func (fs *memFS) Rename(
 	// Finally, remove the old name from the old parent.
 	oldParent.RemoveChild(op.OldName)
 
+	// A directory's ".." now refers to its new parent.
+	if childType == fuseutil.DT_Directory {
+		fs.getInodeOrDie(childID).parent = op.NewParent
+	}
+
 	return nil
 }
 
@@ -541,7 +789,7 @@ func (fs *memFS) RmDir(
 	parent.RemoveChild(op.Name)
 
 	// Mark the child as unlinked.
-	child.attrs.Nlink--
+	fs.removeDir(childID)
 
 	return nil
 }
@@ -569,10 +817,34 @@ func (fs *memFS) Unlink(
 
 	// Mark the child as unlinked.
 	child.attrs.Nlink--
+	fs.maybeDeallocateInode(childID)
 
 	return nil
 }
 
+func (fs *memFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.lookups.Forget(ctx, op.Inode, op.N) == 0 {
+		fs.maybeDeallocateInode(op.Inode)
+	}
+
+	return nil
+}
+
+// The kernel for the mount has implicitly forgotten all of our inodes.
+func (fs *memFS) DestroyMount(mount fuse.MountInfo) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, id := range fs.lookups.ForgetMount(mount) {
+		fs.maybeDeallocateInode(id)
+	}
+}
+
 func (fs *memFS) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) error {
@@ -600,8 +872,11 @@ func (fs *memFS) ReadDir(
 	// Grab the directory.
 	inode := fs.getInodeOrDie(op.Inode)
 
-	// Serve the request.
-	op.BytesRead = inode.ReadDir(op.Dst, int(op.Offset))
+	// Serve the request, starting with "." and "..".
+	rest, ok := fuseutil.EmitDotEntries(op, inode.parent, op.Inode)
+	if ok {
+		op.BytesRead += inode.ReadDir(op.Dst[op.BytesRead:], int(rest))
+	}
 
 	return nil
 }
@@ -626,6 +901,9 @@ func (fs *memFS) OpenFile(
 		panic("Found non-file.")
 	}
 
+	// Have the server give each open its own handle ID, so that closing one
+	// file descriptor doesn't wait for writes through another.
+	op.HandleData = inode
 	return nil
 }
 
@@ -672,9 +950,21 @@ func (fs *memFS) FlushFile(
 		// FlushFileOp should have a valid pid in metadata.
 		return fuse.EINVAL
 	}
+
+	fs.locks.ReleaseOwner(op.Inode, op.LockOwner)
 	return
 }
 
+func (fs *memFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	if op.Flags&fuseops.ReleaseFlockUnlock != 0 {
+		fs.locks.ReleaseOwner(op.Inode, op.LockOwner)
+	}
+
+	return nil
+}
+
 func (fs *memFS) ReadSymlink(
 	ctx context.Context,
 	op *fuseops.ReadSymlinkOp) error {
@@ -721,8 +1011,10 @@ func (fs *memFS) ListXattr(ctx context.Context,
 	for key := range inode.xattrs {
 		keyLen := len(key) + 1
 
+		// The buffer isn't zeroed, so terminate each name explicitly.
 		if len(dst) >= keyLen {
 			copy(dst, key)
+			dst[len(key)] = 0
 			dst = dst[keyLen:]
 		} else if len(op.Dst) != 0 {
 			return syscall.ERANGE
@@ -777,6 +1069,91 @@ func (fs *memFS) Fallocate(ctx context.Context,
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 	inode := fs.getInodeOrDie(op.Inode)
-	inode.Fallocate(op.Mode, op.Length, op.Length)
+	return inode.Fallocate(op.Mode, op.Offset, op.Length)
+}
+
+func (fs *memFS) Lseek(
+	ctx context.Context,
+	op *fuseops.LseekOp) (err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	inode := fs.getInodeOrDie(op.Inode)
+	op.Result, err = inode.Lseek(op.Offset, op.Whence)
+	return
+}
+
+func (fs *memFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	src := fs.getInodeOrDie(op.SrcInode)
+	dst := fs.getInodeOrDie(op.DstInode)
+
+	// Copy what the source has, stopping at its end as read(2) would. The
+	// kernel has made sure that the ranges don't overlap if src is dst.
+	if op.SrcOffset >= int64(len(src.contents)) {
+		return nil
+	}
+
+	data := src.contents[op.SrcOffset:]
+	if uint64(len(data)) > op.Length {
+		data = data[:op.Length]
+	}
+
+	n, err := dst.WriteAt(data, op.DstOffset)
+	op.BytesCopied = uint64(n)
+
+	return err
+}
+
+func (fs *memFS) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	fs.locks.GetLock(op)
+	return nil
+}
+
+func (fs *memFS) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	return fs.locks.SetLock(ctx, op)
+}
+
+// Access is called only when the file system is mounted with
+// fuse.MountConfig.CheckWriteAccess. It checks the caller against the inode's
+// mode the way the kernel would, except that root gets no special treatment,
+// as for a backend on which local root has no special powers.
+func (fs *memFS) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	attrs := fs.getInodeOrDie(op.Inode).attrs
+
+	// Owners may change their inodes' modes and times without having write
+	// permission, but truncating them needs it.
+	if set, ok := op.For.(*fuseops.SetInodeAttributesOp); ok {
+		if set.Size == nil && op.Metadata.Uid == attrs.Uid {
+			return nil
+		}
+	}
+
+	// Pick out the permission bits that apply to the caller.
+	perm := uint32(attrs.Mode.Perm())
+	switch {
+	case op.Metadata.Uid == attrs.Uid:
+		perm >>= 6
+	case op.Metadata.Gid == attrs.Gid:
+		perm >>= 3
+	}
+
+	if op.Mask&^perm&07 != 0 {
+		return syscall.EACCES
+	}
+
 	return nil
 }
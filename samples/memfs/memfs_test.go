@@ -1008,6 +1008,60 @@ func (t *MemFSTest) Chmod() {
 	ExpectEq(0754, fi.Mode())
 }
 
+func (t *MemFSTest) Chown() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file.
+	err = ioutil.WriteFile(fileName, []byte(""), 0600)
+	AssertEq(nil, err)
+
+	// Change its group only, to one we belong to.
+	err = os.Chown(fileName, -1, os.Getgid())
+	AssertEq(nil, err)
+
+	// Stat it.
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+	ExpectEq(currentUid(), fi.Sys().(*syscall.Stat_t).Uid)
+	ExpectEq(currentGid(), fi.Sys().(*syscall.Stat_t).Gid)
+
+	// Only root may give a file away.
+	if os.Getuid() != 0 {
+		return
+	}
+
+	err = os.Chown(fileName, 1234, 5678)
+	AssertEq(nil, err)
+
+	fi, err = os.Stat(fileName)
+	AssertEq(nil, err)
+	ExpectEq(1234, fi.Sys().(*syscall.Stat_t).Uid)
+	ExpectEq(5678, fi.Sys().(*syscall.Stat_t).Gid)
+}
+
+func (t *MemFSTest) Truncate_ByPathThenStat() {
+	var err error
+	fileName := path.Join(t.Dir, "foo")
+
+	// Create a file, and have the kernel cache its attributes.
+	err = ioutil.WriteFile(fileName, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(fileName)
+	AssertEq(nil, err)
+	AssertEq(4, fi.Size())
+
+	// Truncate it, as truncate -s 0 does. The kernel takes the new size from
+	// the reply, so that it doesn't stat the old one from its cache.
+	err = os.Truncate(fileName, 0)
+	AssertEq(nil, err)
+
+	fi, err = os.Stat(fileName)
+	AssertEq(nil, err)
+	ExpectEq(0, fi.Size())
+}
+
 func (t *MemFSTest) Chtimes() {
 	var err error
 	fileName := path.Join(t.Dir, "foo")
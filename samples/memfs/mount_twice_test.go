@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Mount the supplied server on a new temporary directory. The returned
+// function unmounts it.
+func mountTemp(
+	t *testing.T,
+	server fuse.Server) (dir string, unmount func()) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		FSName:  "memfs",
+		Options: map[string]string{"default_permissions": ""},
+	})
+
+	if err != nil {
+		os.Remove(dir)
+		t.Fatalf("Mount: %v", err)
+	}
+
+	unmount = func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+			return
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+
+		os.Remove(dir)
+	}
+
+	return dir, unmount
+}
+
+func TestMountedTwice(t *testing.T) {
+	// The os package registers the files it opens with the runtime's poller,
+	// which causes the kernel to send the file system a poll request from
+	// within a runtime call that holds a P. Make sure there's another P to
+	// serve it.
+	if runtime.GOMAXPROCS(0) < 2 {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	}
+
+	server := memfs.NewMemFS(currentUid(), currentGid())
+
+	dirA, unmountA := mountTemp(t, server)
+	mountedA := true
+	defer func() {
+		if mountedA {
+			unmountA()
+		}
+	}()
+
+	dirB, unmountB := mountTemp(t, server)
+	defer unmountB()
+
+	// Keep a file open through B while it's unlinked through A.
+	const contents = "taco"
+	if err := ioutil.WriteFile(path.Join(dirA, "foo"), []byte(contents), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	f, err := os.Open(path.Join(dirB, "foo"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	if err := os.Remove(path.Join(dirA, "foo")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	// Churn through files on both mounts concurrently, creating each through
+	// one and reading and removing it through the other.
+	const (
+		workersPerMount = 4
+		filesPerWorker  = 50
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workersPerMount)
+
+	work := func(src, dst, name string) {
+		defer wg.Done()
+
+		for i := 0; i < filesPerWorker; i++ {
+			leaf := fmt.Sprintf("%s_%d", name, i)
+			want := []byte(leaf)
+
+			err := ioutil.WriteFile(path.Join(src, leaf), want, 0600)
+			if err != nil {
+				errs <- fmt.Errorf("WriteFile: %v", err)
+				return
+			}
+
+			got, err := ioutil.ReadFile(path.Join(dst, leaf))
+			if err != nil {
+				errs <- fmt.Errorf("ReadFile: %v", err)
+				return
+			}
+
+			if string(got) != string(want) {
+				errs <- fmt.Errorf("Read %q from %s; want %q", got, leaf, want)
+				return
+			}
+
+			if err := os.Remove(path.Join(dst, leaf)); err != nil {
+				errs <- fmt.Errorf("Remove: %v", err)
+				return
+			}
+		}
+	}
+
+	for i := 0; i < workersPerMount; i++ {
+		wg.Add(2)
+		go work(dirA, dirB, fmt.Sprintf("a%d", i))
+		go work(dirB, dirA, fmt.Sprintf("b%d", i))
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// Both mounts should agree that the directory is now empty.
+	for _, dir := range []string{dirA, dirB} {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("ReadDir: %v", err)
+		}
+
+		if len(entries) != 0 {
+			t.Errorf("Unexpected entries in %s: %v", dir, entries)
+		}
+	}
+
+	// Unmounting A implicitly forgets all of its lookups, but B's kernel still
+	// refers to the unlinked file, which should remain readable through it.
+	mountedA = false
+	unmountA()
+
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+
+	if string(got) != contents {
+		t.Errorf("Read %q; want %q", got, contents)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Mount memfs with the supplied limit on name lengths, returning the mount
+// point and a function that unmounts it.
+func mountWithMaxNameLength(
+	t *testing.T,
+	maxNameLength uint32) (dir string, unmount func()) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	server := memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid()))
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		FSName:        "memfs",
+		MaxNameLength: maxNameLength,
+	})
+
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("Mount: %v", err)
+	}
+
+	unmount = func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+			return
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+
+		os.Remove(dir)
+	}
+
+	return dir, unmount
+}
+
+// Return what getconf(1) says NAME_MAX is for the given directory.
+func nameMax(t *testing.T, dir string) string {
+	out, err := exec.Command("getconf", "NAME_MAX", dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("getconf: %v (%s)", err, out)
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+func TestMaxNameLength_Default(t *testing.T) {
+	dir, unmount := mountWithMaxNameLength(t, 0)
+	defer unmount()
+
+	if got, want := nameMax(t, dir), "255"; got != want {
+		t.Errorf("NAME_MAX: got %s, want %s", got, want)
+	}
+}
+
+func TestMaxNameLength(t *testing.T) {
+	const maxNameLength = 16
+
+	dir, unmount := mountWithMaxNameLength(t, maxNameLength)
+	defer unmount()
+
+	if got, want := nameMax(t, dir), "16"; got != want {
+		t.Errorf("NAME_MAX: got %s, want %s", got, want)
+	}
+
+	atLimit := path.Join(dir, strings.Repeat("a", maxNameLength))
+	overLimit := path.Join(dir, strings.Repeat("b", maxNameLength+1))
+
+	// A name right at the limit is fine.
+	fd, err := syscall.Open(atLimit, syscall.O_CREAT|syscall.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if err := syscall.Close(fd); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Anything that would create or refer to a longer one fails cleanly.
+	attempts := []struct {
+		desc string
+		f    func() error
+	}{
+		{"create", func() error {
+			fd, err := syscall.Open(overLimit, syscall.O_CREAT|syscall.O_WRONLY, 0644)
+			if err == nil {
+				syscall.Close(fd)
+			}
+
+			return err
+		}},
+		{"stat", func() error {
+			var st syscall.Stat_t
+			return syscall.Stat(overLimit, &st)
+		}},
+		{"mkdir", func() error { return syscall.Mkdir(overLimit, 0755) }},
+		{"symlink", func() error { return syscall.Symlink("foo", overLimit) }},
+		{"link", func() error { return syscall.Link(atLimit, overLimit) }},
+		{"rename", func() error { return syscall.Rename(atLimit, overLimit) }},
+		{"unlink", func() error { return syscall.Unlink(overLimit) }},
+	}
+
+	for _, a := range attempts {
+		if err := a.f(); err != syscall.ENAMETOOLONG {
+			t.Errorf("%s: got %v, want ENAMETOOLONG", a.desc, err)
+		}
+	}
+
+	// Nothing changed.
+	names, err := readDirNames(dir)
+	if err != nil {
+		t.Fatalf("readDirNames: %v", err)
+	}
+
+	if len(names) != 1 || names[0] != path.Base(atLimit) {
+		t.Errorf("Unexpected entries: %v", names)
+	}
+}
+
+// Read the names in a directory using system calls, skipping . and ..
+func readDirNames(dir string) ([]string, error) {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer syscall.Close(fd)
+
+	var names []string
+	buf := make([]byte, 4096)
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err != nil {
+			return nil, err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		_, _, names = syscall.ParseDirent(buf[:n], -1, names)
+	}
+
+	return names, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Read the file open for direct I/O on fd from offset until EOF, size bytes
+// at a time, into a page-aligned buffer as O_DIRECT requires.
+func readDirect(
+	t *testing.T,
+	fd int,
+	offset int64,
+	size int) []byte {
+	buf, err := syscall.Mmap(
+		-1,
+		0,
+		size,
+		syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_ANON|syscall.MAP_PRIVATE)
+
+	if err != nil {
+		t.Fatalf("Mmap: %v", err)
+	}
+
+	defer syscall.Munmap(buf)
+
+	var contents []byte
+	for {
+		n, err := syscall.Pread(fd, buf, offset)
+		if err != nil {
+			t.Fatalf("Pread(%d): %v", offset, err)
+		}
+
+		if n == 0 {
+			return contents
+		}
+
+		contents = append(contents, buf[:n]...)
+		offset += int64(n)
+	}
+}
+
+func TestReadPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	server := memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid()))
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{FSName: "memfs"})
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		mfs.Join(context.Background())
+	}()
+
+	// Several megabytes of noise, not a multiple of the page size so that the
+	// last read is short.
+	want := make([]byte, 5<<20+1234)
+	rand.New(rand.NewSource(17)).Read(want)
+
+	// Not ioutil.WriteFile and ioutil.ReadFile, which would have the runtime
+	// poll the file.
+	p := path.Join(dir, "foo")
+	wfd, err := syscall.Open(p, syscall.O_WRONLY|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	for off := 0; off < len(want); {
+		n, err := syscall.Pwrite(wfd, want[off:], int64(off))
+		if err != nil {
+			t.Fatalf("Pwrite: %v", err)
+		}
+
+		off += n
+	}
+
+	syscall.Close(wfd)
+
+	// Through the page cache.
+	rfd, err := syscall.Open(p, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	got := readFirst(t, rfd, len(want)+1)
+	syscall.Close(rfd)
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("Buffered read: got %d bytes, not those written", len(got))
+	}
+
+	// Around it, in reads both larger and smaller than the kernel's limit on
+	// the size of a single request.
+	fd := openDirect(t, p, syscall.O_RDONLY)
+	defer syscall.Close(fd)
+
+	for _, size := range []int{4096, 64 << 10, 1 << 20} {
+		if got := readDirect(t, fd, 0, size); !bytes.Equal(got, want) {
+			t.Errorf("Direct read by %d: got %d bytes, not those written", size, len(got))
+		}
+	}
+
+	// A read running past the end comes back short, with exactly the bytes
+	// that are there.
+	offset := int64(len(want)) - 100
+	if got := readDirect(t, fd, offset, 1<<20); !bytes.Equal(got, want[offset:]) {
+		t.Errorf("Read at the end: got %d bytes, want 100", len(got))
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+func TestRemovedDirectory(t *testing.T) {
+	dir, unmount := mountTemp(t, memfs.NewMemFS(currentUid(), currentGid()))
+	defer unmount()
+
+	d := path.Join(dir, "d")
+	if err := syscall.Mkdir(d, 0755); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	err := fusetesting.CheckRemovedDirectory(d, func() error {
+		return syscall.Rmdir(d)
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Removing the directory through another mount leaves the kernel for the
+// first none the wiser, so it's up to the file system.
+func TestRemovedDirectory_OtherMount(t *testing.T) {
+	// As for TestMountedTwice.
+	if runtime.GOMAXPROCS(0) < 2 {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	}
+
+	server := memfs.NewMemFS(currentUid(), currentGid())
+
+	dirA, unmountA := mountTemp(t, server)
+	defer unmountA()
+
+	dirB, unmountB := mountTemp(t, server)
+	defer unmountB()
+
+	for _, p := range []string{"a", "a/d"} {
+		if err := syscall.Mkdir(path.Join(dirA, p), 0755); err != nil {
+			t.Fatalf("Mkdir(%q): %v", p, err)
+		}
+	}
+
+	err := fusetesting.CheckRemovedDirectory(path.Join(dirB, "a/d"), func() error {
+		return syscall.Rmdir(path.Join(dirA, "a/d"))
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// A removed directory's ".." refers to its former parent for as long as the
+// kernel knows of the directory, even once the parent has been removed and
+// forgotten too.
+func TestRemovedDirectory_DeadParent(t *testing.T) {
+	ctx := context.Background()
+	fs := memfs.NewFileSystem(currentUid(), currentGid())
+
+	mkDir := func(parent fuseops.InodeID, name string) fuseops.InodeID {
+		op := &fuseops.MkDirOp{Parent: parent, Name: name, Mode: 0755 | os.ModeDir}
+		if err := fs.MkDir(ctx, op); err != nil {
+			t.Fatalf("MkDir(%q): %v", name, err)
+		}
+
+		return op.Entry.Child
+	}
+
+	rmDir := func(parent fuseops.InodeID, name string) {
+		if err := fs.RmDir(ctx, &fuseops.RmDirOp{Parent: parent, Name: name}); err != nil {
+			t.Fatalf("RmDir(%q): %v", name, err)
+		}
+	}
+
+	forget := func(inode fuseops.InodeID) {
+		if err := fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: inode, N: 1}); err != nil {
+			t.Fatalf("ForgetInode: %v", err)
+		}
+	}
+
+	a := mkDir(fuseops.RootInodeID, "a")
+	d := mkDir(a, "d")
+	rmDir(a, "d")
+	rmDir(fuseops.RootInodeID, "a")
+	forget(a)
+
+	lookUp := &fuseops.LookUpInodeOp{Parent: d, Name: ".."}
+	if err := fs.LookUpInode(ctx, lookUp); err != nil {
+		t.Fatalf("LookUpInode(..): %v", err)
+	}
+
+	if lookUp.Entry.Child != a {
+		t.Errorf("\"..\" is inode %v, want %v", lookUp.Entry.Child, a)
+	}
+
+	if n := lookUp.Entry.Attributes.Nlink; n != 0 {
+		t.Errorf("\"..\" has %d links, want 0", n)
+	}
+
+	// The listing is just "." and "..".
+	readDir := &fuseops.ReadDirOp{Inode: d, Dst: make([]byte, 4096)}
+	if err := fs.ReadDir(ctx, readDir); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	want := &fuseops.ReadDirOp{Dst: make([]byte, 4096)}
+	fuseutil.EmitDotEntries(want, a, d)
+
+	if got := readDir.Dst[:readDir.BytesRead]; !bytes.Equal(got, want.Dst[:want.BytesRead]) {
+		t.Errorf("ReadDir: got %v, want %v", got, want.Dst[:want.BytesRead])
+	}
+
+	// Nothing can be created in it.
+	create := &fuseops.CreateFileOp{
+		Parent:   d,
+		Name:     "foo",
+		Mode:     0644,
+		Metadata: fuseops.OpMetadata{Pid: 1},
+	}
+
+	if err := fs.CreateFile(ctx, create); err != fuse.ENOENT {
+		t.Errorf("CreateFile: got %v, want ENOENT", err)
+	}
+
+	if err := fs.MkDir(ctx, &fuseops.MkDirOp{Parent: d, Name: "bar", Mode: 0755 | os.ModeDir}); err != fuse.ENOENT {
+		t.Errorf("MkDir: got %v, want ENOENT", err)
+	}
+
+	// Once the kernel has forgotten both, their IDs are free for reuse.
+	forget(a)
+	forget(d)
+
+	reused := map[fuseops.InodeID]bool{
+		mkDir(fuseops.RootInodeID, "x"): true,
+		mkDir(fuseops.RootInodeID, "y"): true,
+	}
+
+	if !reused[a] || !reused[d] {
+		t.Errorf("IDs %v and %v not reused: got %v", a, d, reused)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/samples/memfs"
+	"golang.org/x/sys/unix"
+)
+
+// Mount memfs, declaring the supplied rename flags, returning the mount point
+// and a function that unmounts it.
+func mountWithRenameFlags(
+	t *testing.T,
+	flags fuseops.RenameFlags) (dir string, unmount func()) {
+	dir, err := ioutil.TempDir("", "memfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	server := memfs.NewMemFS(currentUid(), currentGid())
+	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{
+		FSName:      "memfs",
+		RenameFlags: flags,
+	})
+
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("Mount: %v", err)
+	}
+
+	unmount = func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+			return
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+
+		os.Remove(dir)
+	}
+
+	return dir, unmount
+}
+
+// Create a file with the supplied contents.
+func writeRenameFile(t *testing.T, p string, contents string) {
+	fd, err := syscall.Open(p, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+	if _, err := syscall.Write(fd, []byte(contents)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// Return the contents of the file at p, or the error opening it.
+func readRenameFile(p string) (string, error) {
+	fd, err := syscall.Open(p, syscall.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+
+	defer syscall.Close(fd)
+	buf := make([]byte, 64)
+	n, err := syscall.Read(fd, buf)
+	return string(buf[:n]), err
+}
+
+func TestRenameFlags(t *testing.T) {
+	dir, unmount := mountWithRenameFlags(t, memfs.RenameFlags)
+	defer unmount()
+
+	a, b, c, d := path.Join(dir, "a"), path.Join(dir, "b"), path.Join(dir, "c"), path.Join(dir, "d")
+	writeRenameFile(t, a, "taco")
+	writeRenameFile(t, b, "burrito")
+
+	if err := os.Mkdir(d, 0700); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	writeRenameFile(t, path.Join(d, "e"), "enchilada")
+
+	// RENAME_NOREPLACE keeps an existing name, and otherwise renames.
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_NOREPLACE); err != syscall.EEXIST {
+		t.Errorf("NOREPLACE over existing name: got %v, want EEXIST", err)
+	}
+
+	if got, err := readRenameFile(b); got != "burrito" {
+		t.Errorf("b: got %q, %v", got, err)
+	}
+
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, c, unix.RENAME_NOREPLACE); err != nil {
+		t.Errorf("NOREPLACE to new name: %v", err)
+	}
+
+	if _, err := readRenameFile(a); err != syscall.ENOENT {
+		t.Errorf("a after rename: got %v, want ENOENT", err)
+	}
+
+	if got, err := readRenameFile(c); got != "taco" {
+		t.Errorf("c: got %q, %v", got, err)
+	}
+
+	// RENAME_EXCHANGE swaps two files, and a file with a non-empty directory.
+	if err := unix.Renameat2(unix.AT_FDCWD, b, unix.AT_FDCWD, c, unix.RENAME_EXCHANGE); err != nil {
+		t.Errorf("EXCHANGE of files: %v", err)
+	}
+
+	if got, err := readRenameFile(b); got != "taco" {
+		t.Errorf("b after exchange: got %q, %v", got, err)
+	}
+
+	if got, err := readRenameFile(c); got != "burrito" {
+		t.Errorf("c after exchange: got %q, %v", got, err)
+	}
+
+	if err := unix.Renameat2(unix.AT_FDCWD, b, unix.AT_FDCWD, d, unix.RENAME_EXCHANGE); err != nil {
+		t.Errorf("EXCHANGE of file and directory: %v", err)
+	}
+
+	if got, err := readRenameFile(d); got != "taco" {
+		t.Errorf("d after exchange: got %q, %v", got, err)
+	}
+
+	if got, err := readRenameFile(path.Join(b, "e")); got != "enchilada" {
+		t.Errorf("b/e after exchange: got %q, %v", got, err)
+	}
+
+	// Both names must exist.
+	if err := unix.Renameat2(unix.AT_FDCWD, c, unix.AT_FDCWD, a, unix.RENAME_EXCHANGE); err != syscall.ENOENT {
+		t.Errorf("EXCHANGE with missing name: got %v, want ENOENT", err)
+	}
+
+	// memfs doesn't declare RENAME_WHITEOUT.
+	if err := unix.Renameat2(unix.AT_FDCWD, c, unix.AT_FDCWD, a, unix.RENAME_WHITEOUT); err != syscall.EINVAL {
+		t.Errorf("WHITEOUT: got %v, want EINVAL", err)
+	}
+
+	if got, err := readRenameFile(c); got != "burrito" {
+		t.Errorf("c after WHITEOUT: got %q, %v", got, err)
+	}
+}
+
+func TestRenameFlags_Undeclared(t *testing.T) {
+	dir, unmount := mountWithRenameFlags(t, 0)
+	defer unmount()
+
+	a, b, c := path.Join(dir, "a"), path.Join(dir, "b"), path.Join(dir, "c")
+	writeRenameFile(t, a, "taco")
+	writeRenameFile(t, c, "churro")
+
+	// memfs would honour both flags, but they aren't passed to it. (The kernel
+	// itself checks whether the new name exists, which NOREPLACE forbids and
+	// EXCHANGE requires.)
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_NOREPLACE); err != syscall.EINVAL {
+		t.Errorf("NOREPLACE: got %v, want EINVAL", err)
+	}
+
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, c, unix.RENAME_EXCHANGE); err != syscall.EINVAL {
+		t.Errorf("EXCHANGE: got %v, want EINVAL", err)
+	}
+
+	if _, err := readRenameFile(b); err != syscall.ENOENT {
+		t.Errorf("b: got %v, want ENOENT", err)
+	}
+
+	if got, err := readRenameFile(c); got != "churro" {
+		t.Errorf("c: got %q, %v", got, err)
+	}
+
+	// Renames without flags are unaffected.
+	if err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, 0); err != nil {
+		t.Errorf("Renameat2: %v", err)
+	}
+
+	if got, err := readRenameFile(b); got != "taco" {
+		t.Errorf("b after rename: got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Check that stat(2) sees the type, permissions, link count, ownership, size
+// and times the file system reports for each kind of inode.
+func TestStat_InodeKinds(t *testing.T) {
+	dir, unmount := mountWithMaxNameLength(t, 0)
+	defer unmount()
+
+	// Times are reported to the second at worst.
+	before := time.Now().Add(-time.Second)
+
+	if err := syscall.Mkdir(path.Join(dir, "dir"), 0750); err != nil {
+		t.Fatalf("Mkdir: %v", err)
+	}
+
+	fd, err := syscall.Open(path.Join(dir, "file"), syscall.O_CREAT|syscall.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	_, err = syscall.Pwrite(fd, []byte("taco"), 0)
+	syscall.Close(fd)
+	if err != nil {
+		t.Fatalf("Pwrite: %v", err)
+	}
+
+	if err := syscall.Symlink("file", path.Join(dir, "symlink")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	after := time.Now().Add(time.Second)
+
+	// memfs doesn't give symlinks a size.
+	testCases := []struct {
+		name string
+		mode uint32
+		size int64
+	}{
+		{"dir", syscall.S_IFDIR | 0750, 0},
+		{"file", syscall.S_IFREG | 0640, int64(len("taco"))},
+		{"symlink", syscall.S_IFLNK | 0444, 0},
+	}
+
+	for _, tc := range testCases {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path.Join(dir, tc.name), &st); err != nil {
+			t.Errorf("Lstat(%s): %v", tc.name, err)
+			continue
+		}
+
+		if st.Mode != tc.mode {
+			t.Errorf("%s: mode %#o, want %#o", tc.name, st.Mode, tc.mode)
+		}
+
+		if st.Nlink != 1 {
+			t.Errorf("%s: nlink %d, want 1", tc.name, st.Nlink)
+		}
+
+		if int(st.Uid) != os.Getuid() || int(st.Gid) != os.Getgid() {
+			t.Errorf(
+				"%s: owner %d:%d, want %d:%d",
+				tc.name, st.Uid, st.Gid, os.Getuid(), os.Getgid())
+		}
+
+		if st.Size != tc.size {
+			t.Errorf("%s: size %d, want %d", tc.name, st.Size, tc.size)
+		}
+
+		mtime := time.Unix(st.Mtim.Unix())
+		if mtime.Before(before) || mtime.After(after) {
+			t.Errorf("%s: mtime %v, want between %v and %v", tc.name, mtime, before, after)
+		}
+	}
+}
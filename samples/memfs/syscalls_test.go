@@ -0,0 +1,153 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// Build, modify and walk a small tree the way an ordinary program would,
+// through the os package.
+func TestSyscalls_Tree(t *testing.T) {
+	// The runtime polls the files the os package opens from within a call that
+	// holds a P. See TestMountedTwice.
+	if runtime.GOMAXPROCS(0) < 2 {
+		defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(2))
+	}
+
+	dir, unmount := mountWithMaxNameLength(t, 0)
+	defer unmount()
+
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	if err := os.MkdirAll(p("a/b/c"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	f, err := os.Create(p("a/b/file"))
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	if _, err := f.WriteString("burrito"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+
+	// memfs insists on a handle for truncating to a non-zero size.
+	if err := f.Truncate(4); err != nil {
+		t.Fatalf("Truncate: %v", err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Renames within and between directories, and a symlink.
+
+	if err := os.Rename(p("a/b/file"), p("a/file")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if err := os.Rename(p("a/b/c"), p("a/d")); err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	if err := os.Symlink("file", p("a/link")); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+
+	if err := ioutil.WriteFile(p("a/d/doomed"), []byte("x"), 0600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := os.Remove(p("a/d/doomed")); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+
+	// Permissions and timestamps.
+	if err := os.Chmod(p("a/file"), 0640); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+
+	mtime := time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local)
+	if err := os.Chtimes(p("a/file"), mtime, mtime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	// Walk the result.
+	type entry struct {
+		Path string
+		Mode os.FileMode
+		Size int64
+	}
+
+	var got []entry
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, _ := filepath.Rel(dir, path)
+		e := entry{Path: rel, Mode: fi.Mode()}
+		if fi.Mode().IsRegular() {
+			e.Size = fi.Size()
+		}
+
+		got = append(got, e)
+		return nil
+	})
+
+	if err != nil {
+		t.Fatalf("Walk: %v", err)
+	}
+
+	want := []entry{
+		{".", os.ModeDir | 0700, 0},
+		{"a", os.ModeDir | 0755, 0},
+		{"a/b", os.ModeDir | 0755, 0},
+		{"a/d", os.ModeDir | 0755, 0},
+		{"a/file", 0640, 4},
+		{"a/link", os.ModeSymlink | 0444, 0},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Walk found %+v, want %+v", got, want)
+	}
+
+	// The contents and times survived.
+	contents, err := ioutil.ReadFile(p("a/link"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(contents) != "burr" {
+		t.Errorf("Contents %q, want %q", contents, "burr")
+	}
+
+	fi, err := os.Stat(p("a/file"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if !fi.ModTime().Equal(mtime) {
+		t.Errorf("Mtime %v, want %v", fi.ModTime(), mtime)
+	}
+}
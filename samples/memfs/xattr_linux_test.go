@@ -0,0 +1,165 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memfs_test
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Check that an extended attribute with the given name and value survives
+// the trip through the kernel: it can be read back, with a buffer too small
+// for it failing as it should, it is listed, and it can be removed.
+func checkXattr(
+	t *testing.T,
+	p string,
+	name string,
+	value []byte) {
+	if err := syscall.Setxattr(p, name, value, 0); err != nil {
+		t.Fatalf("Setxattr: %v", err)
+	}
+
+	// Creating it again fails, while replacing it works, even if empty.
+	if err := syscall.Setxattr(p, name, value, 1 /* XATTR_CREATE */); err != syscall.EEXIST {
+		t.Errorf("Setxattr(XATTR_CREATE): got %v, want EEXIST", err)
+	}
+
+	if err := syscall.Setxattr(p, name, value, 2 /* XATTR_REPLACE */); err != nil {
+		t.Errorf("Setxattr(XATTR_REPLACE): %v", err)
+	}
+
+	// Ask for the size, then read it into buffers of that size and larger.
+	n, err := syscall.Getxattr(p, name, nil)
+	if err != nil || n != len(value) {
+		t.Fatalf("Getxattr(nil): got (%d, %v), want %d", n, err, len(value))
+	}
+
+	for _, size := range []int{len(value), len(value) + 1} {
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(p, name, buf)
+		if err != nil || !bytes.Equal(buf[:n], value) {
+			t.Errorf("Getxattr(%d bytes): got %d bytes, %v", size, n, err)
+		}
+	}
+
+	// A zero-length buffer would ask for the size instead.
+	if len(value) > 1 {
+		if _, err := syscall.Getxattr(p, name, make([]byte, len(value)-1)); err != syscall.ERANGE {
+			t.Errorf("Getxattr(too small): got %v, want ERANGE", err)
+		}
+	}
+
+	list := make([]byte, 1024)
+	n, err = syscall.Listxattr(p, list)
+	if err != nil {
+		t.Fatalf("Listxattr: %v", err)
+	}
+
+	if got := string(list[:n]); got != name+"\x00" {
+		t.Errorf("Listxattr: got %q", got)
+	}
+
+	if err := syscall.Removexattr(p, name); err != nil {
+		t.Fatalf("Removexattr: %v", err)
+	}
+
+	if _, err := syscall.Getxattr(p, name, nil); err != syscall.ENODATA {
+		t.Errorf("Getxattr after removal: got %v, want ENODATA", err)
+	}
+}
+
+func TestXattrSizes(t *testing.T) {
+	dir, unmount := mountTemp(t, memfs.NewMemFS(currentUid(), currentGid()))
+	defer unmount()
+
+	p := path.Join(dir, "foo")
+	fd, err := syscall.Open(p, syscall.O_CREAT|syscall.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	syscall.Close(fd)
+
+	for _, nameLen := range []int{1, 255} {
+		for _, size := range []int{0, 1, 4095, 65536} {
+			t.Run(fmt.Sprintf("Name=%d,Value=%d", nameLen, size), func(t *testing.T) {
+				checkXattr(t, p, strings.Repeat("n", nameLen), bytes.Repeat([]byte("v"), size))
+			})
+		}
+	}
+
+	// Beyond the limits.
+	if err := syscall.Setxattr(p, "n", make([]byte, 65537), 0); err != syscall.E2BIG {
+		t.Errorf("Setxattr(65537 bytes): got %v, want E2BIG", err)
+	}
+
+	if err := syscall.Setxattr(p, strings.Repeat("n", 256), nil, 0); err != syscall.ERANGE {
+		t.Errorf("Setxattr(256-byte name): got %v, want ERANGE", err)
+	}
+}
+
+func TestXattrFlags(t *testing.T) {
+	dir, unmount := mountTemp(t, memfs.NewMemFS(currentUid(), currentGid()))
+	defer unmount()
+
+	p := path.Join(dir, "foo")
+	fd, err := syscall.Open(p, syscall.O_CREAT|syscall.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	syscall.Close(fd)
+
+	// The kernel leaves both flags to the file system, so each result below
+	// comes from memfs.
+	testCases := []struct {
+		name  string
+		value string
+		flags int
+		err   error
+		want  string
+	}{
+		{"replace absent", "taco", 2 /* XATTR_REPLACE */, syscall.ENODATA, ""},
+		{"create absent", "taco", 1 /* XATTR_CREATE */, nil, "taco"},
+		{"create present", "burrito", 1 /* XATTR_CREATE */, syscall.EEXIST, "taco"},
+		{"replace present", "burrito", 2 /* XATTR_REPLACE */, nil, "burrito"},
+	}
+
+	for _, tc := range testCases {
+		if err := syscall.Setxattr(p, "user.test", []byte(tc.value), tc.flags); err != tc.err {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.err)
+		}
+
+		buf := make([]byte, 16)
+		n, err := syscall.Getxattr(p, "user.test", buf)
+		if tc.want == "" {
+			if err != syscall.ENODATA {
+				t.Errorf("%s: Getxattr got %v, want ENODATA", tc.name, err)
+			}
+
+			continue
+		}
+
+		if err != nil || string(buf[:n]) != tc.want {
+			t.Errorf("%s: Getxattr got %q, %v; want %q", tc.name, buf[:n], err, tc.want)
+		}
+	}
+}
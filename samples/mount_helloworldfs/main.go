@@ -0,0 +1,70 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A program serving helloworldfs. Run it as
+//
+//	go run ./samples/mount_helloworldfs /mnt/point
+//
+// then read /mnt/point/hello. Interrupting the program unmounts the file
+// system, once it is no longer busy.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/helloworldfs"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s mount_point\n", os.Args[0])
+	}
+
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	mfs, err := fuse.Mount(flag.Arg(0), helloworldfs.NewHelloWorldFS(), &fuse.MountConfig{
+		FSName:   "helloworldfs",
+		ReadOnly: true,
+	})
+
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Unmount when told to stop, retrying with each signal while busy.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range signals {
+			if err := mfs.Unmount(); err != nil {
+				log.Printf("Unmount: %v", err)
+			}
+		}
+	}()
+
+	if err := mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
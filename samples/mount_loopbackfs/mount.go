@@ -0,0 +1,63 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A mount helper for loopbackfs, letting mount(8) mount it. Install it as
+// mount.fuse.loopbackfs:
+//
+//	go build -o /sbin/mount.fuse.loopbackfs ./samples/mount_loopbackfs
+//
+// Then mirror a directory with
+//
+//	mount -t fuse.loopbackfs /srv/backing /mnt/point -o ttl=10s
+//
+// or with an /etc/fstab entry like
+//
+//	/srv/backing  /mnt/point  fuse.loopbackfs  ttl=10s,allow_other  0  0
+//
+// The device is the directory to mirror. The option ttl sets how long the
+// kernel may cache attributes and entries, a minute by default; other options
+// are passed to the kernel.
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
+)
+
+func newServer(
+	device string,
+	opts map[string]string) (fuse.Server, error) {
+	cfg := loopbackfs.Config{
+		TTL: time.Minute,
+	}
+
+	if s, ok := opts["ttl"]; ok {
+		ttl, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("Option ttl: %v", err)
+		}
+
+		cfg.TTL = ttl
+		delete(opts, "ttl")
+	}
+
+	return loopbackfs.NewLoopbackFS(device, cfg)
+}
+
+func main() {
+	fuse.MountHelperMain(newServer)
+}
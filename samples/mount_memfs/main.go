@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A minimal program serving memfs, an in-memory file system that supports
+// most operations. Run it as
+//
+//	go run ./samples/mount_memfs /mnt/point
+//
+// then use /mnt/point like any other directory. Its contents are lost when
+// the program exits. Interrupting the program unmounts the file system, once
+// it is no longer busy.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+var fDebug = flag.Bool("debug", false, "Enable debug logging.")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [--debug] mount_point\n", os.Args[0])
+	}
+
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// The root is owned by whoever runs the program.
+	server := memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid()))
+
+	cfg := &fuse.MountConfig{
+		FSName: "memfs",
+	}
+
+	if *fDebug {
+		cfg.DebugLogger = log.New(os.Stderr, "fuse: ", 0)
+	}
+
+	mfs, err := fuse.Mount(flag.Arg(0), server, cfg)
+	if err != nil {
+		log.Fatalf("Mount: %v", err)
+	}
+
+	// Unmount when told to stop. Unmounting fails while the file system is in
+	// use, so keep trying with each signal.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range signals {
+			if err := mfs.Unmount(); err != nil {
+				log.Printf("Unmount: %v", err)
+			}
+		}
+	}()
+
+	// Join returns once the kernel is done with the file system.
+	if err := mfs.Join(context.Background()); err != nil {
+		log.Fatalf("Join: %v", err)
+	}
+}
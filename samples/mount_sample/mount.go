@@ -25,9 +25,13 @@ import (
 	"os"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/fuse/samples/flushfs"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
 )
 
 var fType = flag.String("type", "", "The name of the samples/ sub-dir.")
@@ -36,21 +40,27 @@ var fReadyFile = flag.Uint64("ready_file", 0, "FD to signal when ready.")
 
 var fFlushesFile = flag.Uint64("flushfs.flushes_file", 0, "")
 var fFsyncsFile = flag.Uint64("flushfs.fsyncs_file", 0, "")
+var fReleasesFile = flag.Uint64("flushfs.releases_file", 0, "")
 var fFlushError = flag.Int("flushfs.flush_error", 0, "")
 var fFsyncError = flag.Int("flushfs.fsync_error", 0, "")
 
+var fLoopbackRoot = flag.String("loopbackfs.root", "", "Directory to mirror.")
+var fLoopbackTTL = flag.Duration("loopbackfs.ttl", time.Minute, "How long the kernel may cache attributes and entries.")
+var fLoopbackWatch = flag.Bool("loopbackfs.watch", false, "Invalidate the kernel's caches when backing files change.")
+
 var fReadOnly = flag.Bool("read_only", false, "Mount in read-only mode.")
 var fDebug = flag.Bool("debug", false, "Enable debug logging.")
 
 func makeFlushFS() (fuse.Server, error) {
 	// Check the flags.
-	if *fFlushesFile == 0 || *fFsyncsFile == 0 {
+	if *fFlushesFile == 0 || *fFsyncsFile == 0 || *fReleasesFile == 0 {
 		return nil, fmt.Errorf("You must set the flushfs flags.")
 	}
 
 	// Set up the files.
 	flushes := os.NewFile(uintptr(*fFlushesFile), "(flushes file)")
 	fsyncs := os.NewFile(uintptr(*fFsyncsFile), "(fsyncs file)")
+	releases := os.NewFile(uintptr(*fReleasesFile), "(releases file)")
 
 	// Set up errors.
 	var flushErr error
@@ -81,17 +91,68 @@ func makeFlushFS() (fuse.Server, error) {
 	reportFlush := report(flushes, flushErr)
 	reportFsync := report(fsyncs, fsyncErr)
 
+	// Report releases by writing the flags in the same format.
+	reportRelease := func(flags fuseops.ReleaseFlags) error {
+		return report(releases, nil)(flags.String())
+	}
+
 	// Create the file system.
-	return flushfs.NewFileSystem(reportFlush, reportFsync)
+	return flushfs.NewFileSystem(reportFlush, reportFsync, reportRelease)
+}
+
+// Create a loopback file system, returning a function to be called once it
+// is mounted if it needs to know about the mount.
+func makeLoopbackFS() (fuse.Server, func(*fuse.MountedFileSystem), error) {
+	if *fLoopbackRoot == "" {
+		return nil, nil, fmt.Errorf("You must set --loopbackfs.root.")
+	}
+
+	cfg := loopbackfs.Config{
+		TTL: *fLoopbackTTL,
+	}
+
+	if *fLoopbackWatch {
+		w, err := fuseutil.NewInodeWatcher(fuseutil.InodeWatcherConfig{})
+		if err != nil {
+			return nil, nil, fmt.Errorf("NewInodeWatcher: %v", err)
+		}
+
+		cfg.Watcher = w
+	}
+
+	server, err := loopbackfs.NewLoopbackFS(*fLoopbackRoot, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cfg.Watcher == nil {
+		return server, nil, nil
+	}
+
+	mounted := func(mfs *fuse.MountedFileSystem) {
+		go func() {
+			if err := cfg.Watcher.Run(context.Background(), mfs); err != nil {
+				log.Printf("InodeWatcher.Run: %v", err)
+			}
+		}()
+	}
+
+	return server, mounted, nil
 }
 
-func makeFS() (fuse.Server, error) {
+// Create the file system, and a function to be called once it is mounted, if
+// any.
+func makeFS() (fuse.Server, func(*fuse.MountedFileSystem), error) {
 	switch *fType {
 	default:
-		return nil, fmt.Errorf("Unknown FS type: %v", *fType)
+		return nil, nil, fmt.Errorf("Unknown FS type: %v", *fType)
 
 	case "flushfs":
-		return makeFlushFS()
+		server, err := makeFlushFS()
+		return server, nil, err
+
+	case "loopbackfs":
+		return makeLoopbackFS()
 	}
 }
 
@@ -117,7 +178,7 @@ func main() {
 	}
 
 	// Create an appropriate file system.
-	server, err := makeFS()
+	server, mounted, err := makeFS()
 	if err != nil {
 		log.Fatalf("makeFS: %v", err)
 	}
@@ -131,6 +192,11 @@ func main() {
 		ReadOnly: *fReadOnly,
 	}
 
+	// See the notes on loopbackfs.NewLoopbackFS.
+	if *fType == "loopbackfs" {
+		cfg.DisableWritebackCaching = true
+	}
+
 	if *fDebug {
 		cfg.DebugLogger = log.New(os.Stderr, "fuse: ", 0)
 	}
@@ -140,6 +206,10 @@ func main() {
 		log.Fatalf("Mount: %v", err)
 	}
 
+	if mounted != nil {
+		mounted(mfs)
+	}
+
 	// Signal that it is ready.
 	_, err = readyFile.Write([]byte("x"))
 	if err != nil {
@@ -0,0 +1,136 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nullfs
+
+import (
+	"context"
+	"os"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+const (
+	// The name of the single file in the root directory.
+	ZerosName = "zeros"
+
+	// The size of that file.
+	ZerosSize = 1 << 30
+)
+
+const (
+	rootInode fuseops.InodeID = fuseops.RootInodeID + iota
+	zerosInode
+)
+
+var rootAttrs = fuseops.InodeAttributes{
+	Nlink: 1,
+	Mode:  0555 | os.ModeDir,
+}
+
+var zerosAttrs = fuseops.InodeAttributes{
+	Nlink: 1,
+	Mode:  0444,
+	Size:  ZerosSize,
+}
+
+// Create a file system that does as little work as possible, for measuring
+// the overhead of the fuse package itself. Its root directory contains a
+// single read-only file named "zeros", ZerosSize bytes long and full of zeros.
+//
+// Every response is a compiled-in constant, and nothing is marked cacheable,
+// so that each stat(2) and read(2) is served by the file system. Reads are
+// served in direct I/O mode, zeroing the kernel's reply buffer in place
+// rather than copying from anywhere.
+func NewNullFS() fuse.Server {
+	return fuseutil.NewFileSystemServer(&nullFS{})
+}
+
+type nullFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *nullFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *nullFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != rootInode || op.Name != ZerosName {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = zerosInode
+	op.Entry.Attributes = zerosAttrs
+
+	return nil
+}
+
+func (fs *nullFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	switch op.Inode {
+	case rootInode:
+		op.Attributes = rootAttrs
+
+	case zerosInode:
+		op.Attributes = zerosAttrs
+
+	default:
+		return fuse.ENOENT
+	}
+
+	return nil
+}
+
+func (fs *nullFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fs *nullFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if op.Offset >= ZerosSize {
+		return nil
+	}
+
+	n := len(op.Dst)
+	if remaining := ZerosSize - op.Offset; int64(n) > remaining {
+		n = int(remaining)
+	}
+
+	// Dst points into the pooled reply buffer, which may contain garbage from
+	// an earlier reply.
+	dst := op.Dst[:n]
+	for i := range dst {
+		dst[i] = 0
+	}
+
+	op.BytesRead = n
+	return nil
+}
+
+func (fs *nullFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
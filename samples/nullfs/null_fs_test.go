@@ -0,0 +1,263 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nullfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples/nullfs"
+)
+
+// The benchmarks below measure the same four operations in two ways: against
+// fusetesting.FakeKernel, which isolates the cost of this package's dispatch
+// path, and against a real mount, which adds the kernel's overhead. Run them
+// with `make bench-baseline` to regenerate testdata/baseline.txt.
+
+////////////////////////////////////////////////////////////////////////
+// Fake kernel
+////////////////////////////////////////////////////////////////////////
+
+func newFakeKernel(b *testing.B) *fusetesting.FakeKernel {
+	k, err := fusetesting.NewFakeKernel(nullfs.NewNullFS(), &fuse.MountConfig{})
+	if err != nil {
+		b.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	return k
+}
+
+func closeFakeKernel(b *testing.B, k *fusetesting.FakeKernel) {
+	if err := k.Close(); err != nil {
+		b.Fatalf("Close: %v", err)
+	}
+}
+
+func BenchmarkFakeKernel_LookUp(b *testing.B) {
+	k := newFakeKernel(b)
+	defer closeFakeKernel(b, k)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := k.LookUp(fuseops.RootInodeID, nullfs.ZerosName); err != nil {
+			b.Fatalf("LookUp: %v", err)
+		}
+	}
+}
+
+func BenchmarkFakeKernel_GetAttr(b *testing.B) {
+	k := newFakeKernel(b)
+	defer closeFakeKernel(b, k)
+
+	inode, err := k.LookUp(fuseops.RootInodeID, nullfs.ZerosName)
+	if err != nil {
+		b.Fatalf("LookUp: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := k.GetAttr(inode); err != nil {
+			b.Fatalf("GetAttr: %v", err)
+		}
+	}
+}
+
+func benchmarkFakeKernelRead(b *testing.B, size int) {
+	k := newFakeKernel(b)
+	defer closeFakeKernel(b, k)
+
+	inode, err := k.LookUp(fuseops.RootInodeID, nullfs.ZerosName)
+	if err != nil {
+		b.Fatalf("LookUp: %v", err)
+	}
+
+	handle, err := k.Open(inode)
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Split large reads into requests no bigger than the kernel would send.
+	for i := 0; i < b.N; i++ {
+		for off := 0; off < size; off += fusetesting.MaxReadSize {
+			n := size - off
+			if n > fusetesting.MaxReadSize {
+				n = fusetesting.MaxReadSize
+			}
+
+			data, err := k.Read(inode, handle, int64(off), n)
+			if err != nil {
+				b.Fatalf("Read: %v", err)
+			}
+
+			if len(data) != n {
+				b.Fatalf("Read %d bytes; expected %d", len(data), n)
+			}
+		}
+	}
+
+	b.StopTimer()
+
+	if err := k.Release(inode, handle); err != nil {
+		b.Fatalf("Release: %v", err)
+	}
+}
+
+func BenchmarkFakeKernel_Read4KiB(b *testing.B) {
+	benchmarkFakeKernelRead(b, 1<<12)
+}
+
+func BenchmarkFakeKernel_Read1MiB(b *testing.B) {
+	benchmarkFakeKernelRead(b, 1<<20)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Real mount
+////////////////////////////////////////////////////////////////////////
+
+// Mount the file system, skipping the benchmark if that isn't possible here
+// (e.g. because fuse isn't installed). The returned function unmounts it.
+func mount(b *testing.B) (dir string, unmount func()) {
+	dir, err := ioutil.TempDir("", "nullfs_test")
+	if err != nil {
+		b.Fatalf("TempDir: %v", err)
+	}
+
+	mfs, err := fuse.Mount(dir, nullfs.NewNullFS(), &fuse.MountConfig{
+		FSName:   "nullfs",
+		ReadOnly: true,
+	})
+
+	if err != nil {
+		os.Remove(dir)
+		b.Skipf("Mount: %v", err)
+	}
+
+	unmount = func() {
+		if err := fuse.Unmount(dir); err != nil {
+			b.Fatalf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			b.Fatalf("Join: %v", err)
+		}
+
+		os.Remove(dir)
+	}
+
+	return dir, unmount
+}
+
+func BenchmarkMount_LookUp(b *testing.B) {
+	dir, unmount := mount(b)
+	defer unmount()
+
+	p := path.Join(dir, nullfs.ZerosName)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Nothing is marked cacheable, so each stat(2) results in a lookup.
+	for i := 0; i < b.N; i++ {
+		if _, err := os.Stat(p); err != nil {
+			b.Fatalf("Stat: %v", err)
+		}
+	}
+}
+
+// Open the file without involving os.File. The Go runtime registers files
+// opened with os.Open with its poller, causing the kernel to send a poll
+// request to the file system from within a runtime call that holds a P. With
+// GOMAXPROCS=1 that leaves the server unable to reply.
+func openZeros(b *testing.B, dir string) int {
+	fd, err := syscall.Open(
+		path.Join(dir, nullfs.ZerosName),
+		syscall.O_RDONLY,
+		0)
+
+	if err != nil {
+		b.Fatalf("Open: %v", err)
+	}
+
+	return fd
+}
+
+func BenchmarkMount_GetAttr(b *testing.B) {
+	dir, unmount := mount(b)
+	defer unmount()
+
+	fd := openZeros(b, dir)
+	defer syscall.Close(fd)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Attributes aren't cacheable, so each fstat(2) results in a getattr.
+	var st syscall.Stat_t
+	for i := 0; i < b.N; i++ {
+		if err := syscall.Fstat(fd, &st); err != nil {
+			b.Fatalf("Fstat: %v", err)
+		}
+	}
+}
+
+func benchmarkMountRead(b *testing.B, size int) {
+	dir, unmount := mount(b)
+	defer unmount()
+
+	fd := openZeros(b, dir)
+	defer syscall.Close(fd)
+
+	buf := make([]byte, size)
+
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// The file is opened in direct I/O mode, so the page cache doesn't absorb
+	// repeated reads.
+	for i := 0; i < b.N; i++ {
+		n, err := syscall.Pread(fd, buf, 0)
+		if err != nil {
+			b.Fatalf("Pread: %v", err)
+		}
+
+		if n != size {
+			b.Fatalf("Read %d bytes; expected %d", n, size)
+		}
+	}
+}
+
+func BenchmarkMount_Read4KiB(b *testing.B) {
+	benchmarkMountRead(b, 1<<12)
+}
+
+func BenchmarkMount_Read1MiB(b *testing.B) {
+	benchmarkMountRead(b, 1<<20)
+}
@@ -0,0 +1,219 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package pollfs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/sys/unix"
+)
+
+var rootAttrs = fuseops.InodeAttributes{
+	Nlink: 1,
+	Mode:  os.ModeDir | 0555,
+}
+
+const eventsID = fuseops.RootInodeID + 1
+
+var eventsAttrs = fuseops.InodeAttributes{
+	Nlink: 1,
+	Mode:  0444,
+}
+
+// A file system containing exactly one file, named "events", that behaves
+// like the read end of a pipe fed by Send. Reads return whatever has been sent
+// since the last read, or nothing if there is nothing new, and poll(2) and
+// select(2) report the file readable only when there is something to read,
+// waking readers that wait in them when there is.
+//
+// A PollFS may be mounted only once at a time, since it wakes pollers through
+// the connection it was last served on.
+//
+// Must be created with New.
+type PollFS struct {
+	impl   *pollFS
+	server fuse.Server
+}
+
+func New() *PollFS {
+	impl := &pollFS{
+		waiters: make(map[fuseops.PollHandle]struct{}),
+	}
+
+	return &PollFS{
+		impl:   impl,
+		server: fuseutil.NewFileSystemServer(impl),
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Public interface
+////////////////////////////////////////////////////////////////////////
+
+func (fs *PollFS) ServeOps(c *fuse.Connection) {
+	fs.impl.mu.Lock()
+	fs.impl.conn = c
+	fs.impl.mu.Unlock()
+
+	fs.server.ServeOps(c)
+}
+
+// Make data available for reading from "events", waking anybody waiting for
+// the file to become readable.
+func (fs *PollFS) Send(data []byte) error {
+	fs.impl.mu.Lock()
+	fs.impl.pending = append(fs.impl.pending, data...)
+	conn := fs.impl.conn
+	waiters := fs.impl.waiters
+	fs.impl.waiters = make(map[fuseops.PollHandle]struct{})
+	fs.impl.mu.Unlock()
+
+	for h := range waiters {
+		if err := conn.NotifyPollWakeup(h); err != nil {
+			return fmt.Errorf("NotifyPollWakeup: %v", err)
+		}
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Actual implementation
+////////////////////////////////////////////////////////////////////////
+
+type pollFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu sync.Mutex
+
+	// The connection we're served on, for waking pollers.
+	conn *fuse.Connection // GUARDED_BY(mu)
+
+	// Data sent but not yet read.
+	pending []byte // GUARDED_BY(mu)
+
+	// The kernel's handles for files polled while there was nothing to read,
+	// to be woken when there is.
+	waiters map[fuseops.PollHandle]struct{} // GUARDED_BY(mu)
+}
+
+func (fs *pollFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *pollFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "events" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = eventsID
+	op.Entry.Attributes = eventsAttrs
+
+	return nil
+}
+
+func (fs *pollFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	switch op.Inode {
+	case fuseops.RootInodeID:
+		op.Attributes = rootAttrs
+
+	case eventsID:
+		op.Attributes = eventsAttrs
+
+	default:
+		return fmt.Errorf("Unexpected inode ID: %v", op.Inode)
+	}
+
+	return nil
+}
+
+func (fs *pollFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *pollFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Offset > 0 {
+		return nil
+	}
+
+	op.BytesRead = fuseutil.WriteDirent(op.Dst, fuseutil.Dirent{
+		Offset: 1,
+		Inode:  eventsID,
+		Name:   "events",
+		Type:   fuseutil.DT_File,
+	})
+
+	return nil
+}
+
+func (fs *pollFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if op.Flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		return syscall.EACCES
+	}
+
+	// The file has no size and no stable contents, so have every read come
+	// to us.
+	op.UseDirectIO = true
+	return nil
+}
+
+func (fs *pollFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Offsets mean nothing for a stream.
+	op.BytesRead = copy(op.Dst, fs.pending)
+	fs.pending = fs.pending[op.BytesRead:]
+
+	return nil
+}
+
+func (fs *pollFS) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.pending) > 0 {
+		op.Revents = unix.POLLIN | unix.POLLRDNORM
+		return nil
+	}
+
+	if op.Notify {
+		fs.waiters[op.PollHandle] = struct{}{}
+	}
+
+	return nil
+}
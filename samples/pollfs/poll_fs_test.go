@@ -0,0 +1,144 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package pollfs_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/samples/pollfs"
+)
+
+// Wait up to timeout for fd to become readable, as select(2) sees it.
+func readable(fd int, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		var r syscall.FdSet
+		r.Bits[fd/64] |= 1 << (uint(fd) % 64)
+
+		tv := syscall.NsecToTimeval(int64(time.Until(deadline)))
+		if tv.Sec < 0 || tv.Usec < 0 {
+			tv = syscall.Timeval{}
+		}
+
+		n, err := syscall.Select(fd+1, &r, nil, nil, &tv)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		return n == 1, err
+	}
+}
+
+func TestSelect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pollfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.Remove(dir)
+
+	fs := pollfs.New()
+	mfs, err := fuse.Mount(dir, fs, &fuse.MountConfig{FSName: "pollfs"})
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	// Not os.Open, which would have the runtime poll the file.
+	fd, err := syscall.Open(path.Join(dir, "events"), syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	// Nothing has been sent yet.
+	if ok, err := readable(fd, 50*time.Millisecond); ok || err != nil {
+		t.Fatalf("Readable before anything was sent: %v, %v", ok, err)
+	}
+
+	// A waiting select returns once something is sent.
+	type result struct {
+		ok  bool
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		ok, err := readable(fd, 10*time.Second)
+		done <- result{ok, err}
+	}()
+
+	select {
+	case r := <-done:
+		t.Fatalf("select returned %v, %v before anything was sent", r.ok, r.err)
+
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	sent := time.Now()
+	if err := fs.Send([]byte("taco")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	// select polls once more when it times out, so it must have been woken
+	// well before then.
+	if r := <-done; !r.ok || r.err != nil {
+		t.Fatalf("select returned %v, %v after a send", r.ok, r.err)
+	}
+
+	if d := time.Since(sent); d > 5*time.Second {
+		t.Errorf("select took %v to notice the send", d)
+	}
+
+	buf := make([]byte, 16)
+	n, err := syscall.Read(fd, buf)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if got := string(buf[:n]); got != "taco" {
+		t.Errorf("Read %q, want %q", got, "taco")
+	}
+
+	// Reading drained the file.
+	if ok, err := readable(fd, 50*time.Millisecond); ok || err != nil {
+		t.Errorf("Readable after reading everything: %v, %v", ok, err)
+	}
+
+	// With nobody waiting, the next select sees what was sent straight away.
+	if err := fs.Send([]byte("burrito")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	if ok, err := readable(fd, 0); !ok || err != nil {
+		t.Errorf("Not readable after a send: %v, %v", ok, err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with an empty root directory that leaves StatFS to
+// NotImplementedFileSystem.
+type defaultStatFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *defaultStatFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0777 | os.ModeDir}
+	return nil
+}
+
+func TestStatFS_NotImplemented(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statfs_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(&defaultStatFS{}), &fuse.MountConfig{FSName: "defaultstatfs"})
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		t.Fatalf("Statfs: %v", err)
+	}
+
+	if stat.Frsize != 4096 ||
+		stat.Blocks != 1<<40 ||
+		stat.Bavail != stat.Blocks ||
+		stat.Files != 1<<32 ||
+		stat.Ffree != stat.Files ||
+		stat.Namelen != 255 {
+		t.Errorf("Got %+v", stat)
+	}
+
+	// df(1) lists the file system, rather than failing or hiding it.
+	out, err := exec.Command("df", "-B4096", "--output=size,avail,itotal", dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("df: %v: %s", err, out)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || strings.Join(strings.Fields(lines[1]), " ") != "1099511627776 1099511627776 4294967296" {
+		t.Errorf("df printed %q", out)
+	}
+}
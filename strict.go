@@ -0,0 +1,450 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/convert"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// StrictConfig configures strict mode, in which a connection checks the
+// responses the file system gives to ops before sending them to the kernel.
+// The checks catch responses that the kernel accepts but that almost
+// certainly don't mean what the file system intended. Servers may make checks
+// of their own on the ops they are given; see StrictStaleHandle. See
+// MountConfig.Strict.
+type StrictConfig struct {
+	// What to do about a response that fails a check.
+	Action StrictAction
+
+	// Checks to skip. By default all are performed.
+	Disable StrictCheck
+}
+
+// StrictAction says what a connection in strict mode does about a response
+// that fails a check.
+type StrictAction int
+
+const (
+	// Log the problem to the ErrorLogger and send the response anyway.
+	StrictLog StrictAction = iota
+
+	// Log the problem and fail the op with EIO instead.
+	StrictFail
+
+	// Panic. This is intended for tests.
+	StrictPanic
+)
+
+// StrictCheck identifies one or more of the checks made in strict mode.
+type StrictCheck uint32
+
+const (
+	// A successful LookUpInodeOp, MkDirOp, MkNodeOp, CreateFileOp,
+	// CreateSymlinkOp or CreateLinkOp has a zero Entry.Child. The kernel treats
+	// this as a negative entry for the name, which is occasionally
+	// intentional for LookUpInodeOp; file systems that do it on purpose should
+	// disable this check.
+	StrictZeroChild StrictCheck = 1 << iota
+
+	// An AttributesExpiration or EntryExpiration is set but already passed, or
+	// an AttributesValidFor or EntryValidFor in use is negative, usually a sign
+	// that a file system meaning to cache for a long time computed the time
+	// wrongly. Leave the fields zero to disable caching.
+	StrictExpirationPassed
+
+	// OpenFileOp or CreateFileOp returned handle ID zero while the kernel's
+	// no-open support is enabled (see MountConfig.EnableNoOpenSupport), or
+	// OpenDirOp did while no-opendir support is. Handle zero is what the
+	// kernel uses for inodes opened without calling the file system.
+	StrictZeroHandle
+
+	// A ReadFileOp returned data beyond the size last reported for the inode
+	// in its attributes. Unless the file was opened with UseDirectIO, the
+	// kernel drops such data, which is a sign that the file system's attributes
+	// and contents disagree.
+	StrictReadPastSize
+
+	// An op named a handle whose HandleData (see OpenFileOp.HandleData) has
+	// already been released, e.g. a second release of the same handle. This
+	// is checked by servers made by fuseutil.NewFileSystemServer. While it is
+	// enabled they embed a generation in the handle IDs they choose, so that a
+	// stale ID can be told apart from the ID of a later handle reusing its
+	// slot; otherwise the stale ID silently refers to the later handle.
+	StrictStaleHandle
+
+	// A LookUpInodeOp or CreateLinkOp returned a child whose mode disagrees
+	// with the type a ReadDirOp last reported for the same inode. Programs like
+	// find(1) trust the types in directory listings without looking the
+	// children up. A file system that can't cheaply tell what type a child is
+	// while listing should report it as unknown (fuseutil.DT_Unknown), which
+	// is never flagged.
+	StrictDirentType
+)
+
+// How far in the past an expiration time must be to fail
+// StrictExpirationPassed, so that time.Now() meaning "expire immediately"
+// doesn't.
+const strictExpirationSlack = time.Second
+
+// Strict mode state for a connection.
+type strictState struct {
+	// The size last reported for each inode in a reply to the kernel.
+	sizes map[fuseops.InodeID]uint64
+
+	// The number of handles open with UseDirectIO, by ID.
+	directIO map[fuseops.HandleID]int
+
+	// The type, other than unknown, last reported for each inode in a reply to
+	// a ReadDirOp, as a DT_* value.
+	direntTypes map[fuseops.InodeID]uint32
+}
+
+func newStrictState() *strictState {
+	return &strictState{
+		sizes:       make(map[fuseops.InodeID]uint64),
+		directIO:    make(map[fuseops.HandleID]int),
+		direntTypes: make(map[fuseops.InodeID]uint32),
+	}
+}
+
+// Return the DT_* value matching the supplied mode.
+func direntTypeOf(mode os.FileMode) uint32 {
+	var attr fusekernel.Attr
+	convert.Attributes(0, &fuseops.InodeAttributes{Mode: mode}, &attr)
+	return (attr.Mode & syscall.S_IFMT) >> 12
+}
+
+// Return the name of the supplied DT_* value.
+func direntTypeName(t uint32) string {
+	switch t {
+	case syscall.DT_REG:
+		return "DT_REG"
+	case syscall.DT_DIR:
+		return "DT_DIR"
+	case syscall.DT_LNK:
+		return "DT_LNK"
+	case syscall.DT_FIFO:
+		return "DT_FIFO"
+	case syscall.DT_SOCK:
+		return "DT_SOCK"
+	case syscall.DT_CHR:
+		return "DT_CHR"
+	case syscall.DT_BLK:
+		return "DT_BLK"
+	}
+
+	return fmt.Sprintf("type %d", t)
+}
+
+// Record the types of the children in the supplied ReadDirOp reply, in the
+// format written by fuseutil.WriteDirent, or by fuseutil.WriteDirentPlus if
+// plus is set, in which case the sizes of children with attributes are
+// recorded too.
+//
+// LOCKS_REQUIRED(c.mu)
+func (s *strictState) recordDirentTypes(buf []byte, plus bool) {
+	const alignment = 8
+	const entrySize = int(unsafe.Sizeof(fusekernel.EntryOut{}))
+	for {
+		if plus {
+			if len(buf) < entrySize {
+				break
+			}
+
+			e := (*fusekernel.EntryOut)(unsafe.Pointer(&buf[0]))
+			if e.Nodeid != 0 {
+				s.sizes[fuseops.InodeID(e.Nodeid)] = e.Attr.Size
+			}
+
+			buf = buf[entrySize:]
+		}
+
+		if len(buf) < fusekernel.DirentSize {
+			break
+		}
+
+		d := (*fusekernel.Dirent)(unsafe.Pointer(&buf[0]))
+		if d.Type != syscall.DT_UNKNOWN {
+			s.direntTypes[fuseops.InodeID(d.Ino)] = d.Type
+		}
+
+		n := fusekernel.DirentSize + int(d.Namelen)
+		n = (n + alignment - 1) / alignment * alignment
+		if n > len(buf) {
+			break
+		}
+
+		buf = buf[n:]
+	}
+}
+
+// Check the successful response the file system gave to op, returning an error
+// describing the first problem found, and record whatever later checks need
+// to know about it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) checkResponse(op interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := c.strict
+	disabled := c.cfg.Strict.Disable
+	enabled := func(check StrictCheck) bool { return disabled&check == 0 }
+	now := c.clock.Now()
+
+	checkExpiration := func(name string, t time.Time, d time.Duration) error {
+		if !enabled(StrictExpirationPassed) {
+			return nil
+		}
+
+		if !t.IsZero() && t.Before(now.Add(-strictExpirationSlack)) {
+			return fmt.Errorf("%sExpiration %v has already passed", name, t)
+		}
+
+		if t.IsZero() && d < 0 {
+			return fmt.Errorf("%sValidFor %v is negative", name, d)
+		}
+
+		return nil
+	}
+
+	checkEntry := func(e *fuseops.ChildInodeEntry) error {
+		if enabled(StrictZeroChild) && e.Child == 0 {
+			return errors.New("zero child inode ID")
+		}
+
+		s.sizes[e.Child] = e.Attributes.Size
+		err := checkExpiration(
+			"Attributes",
+			e.AttributesExpiration,
+			e.AttributesValidFor)
+
+		if err != nil {
+			return err
+		}
+
+		return checkExpiration("Entry", e.EntryExpiration, e.EntryValidFor)
+	}
+
+	// Compare the mode of a child being looked up or linked with the type last
+	// listed for it.
+	checkType := func(e *fuseops.ChildInodeEntry) error {
+		listed, ok := s.direntTypes[e.Child]
+		if !enabled(StrictDirentType) || e.Child == 0 || !ok {
+			return nil
+		}
+
+		if t := direntTypeOf(e.Attributes.Mode); t != listed {
+			delete(s.direntTypes, e.Child)
+			return fmt.Errorf(
+				"ReadDir reported inode %d as %s, but its mode is %v",
+				e.Child,
+				direntTypeName(listed),
+				e.Attributes.Mode)
+		}
+
+		return nil
+	}
+
+	// A new child may reuse the ID of a forgotten inode of another type.
+	forgetType := func(e *fuseops.ChildInodeEntry) {
+		delete(s.direntTypes, e.Child)
+	}
+
+	checkHandle := func(h fuseops.HandleID, noOpen bool) error {
+		if enabled(StrictZeroHandle) && noOpen && h == 0 {
+			return errors.New("zero handle ID with no-open support enabled")
+		}
+
+		return nil
+	}
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		if err := checkEntry(&o.Entry); err != nil {
+			return err
+		}
+
+		return checkType(&o.Entry)
+
+	case *fuseops.MkDirOp:
+		forgetType(&o.Entry)
+		return checkEntry(&o.Entry)
+
+	case *fuseops.MkNodeOp:
+		forgetType(&o.Entry)
+		return checkEntry(&o.Entry)
+
+	case *fuseops.CreateSymlinkOp:
+		forgetType(&o.Entry)
+		return checkEntry(&o.Entry)
+
+	case *fuseops.CreateLinkOp:
+		if err := checkEntry(&o.Entry); err != nil {
+			return err
+		}
+
+		return checkType(&o.Entry)
+
+	case *fuseops.CreateFileOp:
+		forgetType(&o.Entry)
+		if err := checkEntry(&o.Entry); err != nil {
+			return err
+		}
+
+		return checkHandle(o.Handle, c.noOpen)
+
+	case *fuseops.GetInodeAttributesOp:
+		s.sizes[o.Inode] = o.Attributes.Size
+		return checkExpiration(
+			"Attributes",
+			o.AttributesExpiration,
+			o.AttributesValidFor)
+
+	case *fuseops.SetInodeAttributesOp:
+		s.sizes[o.Inode] = o.Attributes.Size
+		return checkExpiration(
+			"Attributes",
+			o.AttributesExpiration,
+			o.AttributesValidFor)
+
+	case *fuseops.ForgetInodeOp:
+		// The inode may live on, but we can no longer be sure what the kernel
+		// thinks its size is.
+		delete(s.sizes, o.Inode)
+		delete(s.direntTypes, o.Inode)
+
+	case *fuseops.BatchForgetOp:
+		for _, f := range o.Forgets {
+			delete(s.sizes, f.Inode)
+			delete(s.direntTypes, f.Inode)
+		}
+
+	case *fuseops.ReadDirOp:
+		if enabled(StrictDirentType) {
+			s.recordDirentTypes(o.Dst[:o.BytesRead], o.Plus)
+		}
+
+	case *fuseops.OpenFileOp:
+		if o.UseDirectIO {
+			s.directIO[o.Handle]++
+		}
+
+		return checkHandle(o.Handle, c.noOpen)
+
+	case *fuseops.OpenDirOp:
+		return checkHandle(o.Handle, c.noOpendir)
+
+	case *fuseops.ReleaseFileHandleOp:
+		if n := s.directIO[o.Handle]; n > 1 {
+			s.directIO[o.Handle] = n - 1
+		} else {
+			delete(s.directIO, o.Handle)
+		}
+
+	case *fuseops.WriteFileOp:
+		end := uint64(o.Offset) + uint64(len(o.Data))
+		if size, ok := s.sizes[o.Inode]; ok && end > size {
+			s.sizes[o.Inode] = end
+		}
+
+	case *fuseops.FallocateOp:
+		const keepSize = 0x1 // FALLOC_FL_KEEP_SIZE
+		end := o.Offset + o.Length
+		if size, ok := s.sizes[o.Inode]; ok && o.Mode&keepSize == 0 && end > size {
+			s.sizes[o.Inode] = end
+		}
+
+	case *fuseops.ReadFileOp:
+		if !enabled(StrictReadPastSize) || s.directIO[o.Handle] > 0 {
+			return nil
+		}
+
+		size, ok := s.sizes[o.Inode]
+		end := uint64(o.Offset) + uint64(o.BytesRead)
+		if ok && o.BytesRead > 0 && end > size {
+			return fmt.Errorf(
+				"read of %d bytes at offset %d extends past size %d",
+				o.BytesRead,
+				o.Offset,
+				size)
+		}
+	}
+
+	return nil
+}
+
+// Deal with a response that failed a strict mode check, returning the error
+// with which to reply instead, if any.
+func (c *Connection) strictViolation(
+	fuseID uint64,
+	op interface{},
+	err error) error {
+	return c.strictAction(
+		fmt.Sprintf("Op 0x%08x: invalid %T response: %v", fuseID, op, err))
+}
+
+// Act on the supplied description of a failed check as configured, returning
+// the error with which to fail the op, if any.
+func (c *Connection) strictAction(msg string) error {
+	switch c.cfg.Strict.Action {
+	case StrictPanic:
+		panic(msg)
+
+	case StrictFail:
+		if c.errorLogger != nil {
+			c.errorLogger.Print(msg)
+		}
+
+		return EIO
+
+	default:
+		if c.errorLogger != nil {
+			c.errorLogger.Print(msg)
+		}
+
+		return nil
+	}
+}
+
+// StrictCheckEnabled returns whether the connection is in strict mode with
+// the given check enabled, for the checks servers make themselves (see
+// StrictStaleHandle).
+func (c *Connection) StrictCheckEnabled(check StrictCheck) bool {
+	return c.cfg.Strict != nil && c.cfg.Strict.Disable&check == 0
+}
+
+// ReportStrictViolation deals with a check made by the server failing for the
+// op associated with ctx, a context returned by ReadOp, as configured by
+// StrictConfig.Action: it logs err, then returns EIO if the server should fail
+// the op with it, returns nil if the server should carry on, or panics.
+func (c *Connection) ReportStrictViolation(
+	ctx context.Context,
+	op interface{},
+	err error) error {
+	fuseID, _ := RequestIDFromContext(ctx)
+	return c.strictAction(
+		fmt.Sprintf("Op 0x%08x: invalid %T request: %v", fuseID, op, err))
+}
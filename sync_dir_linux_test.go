@@ -0,0 +1,184 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with an empty root directory, whose syncs wait for the test
+// to answer them. With no syncs channel, it leaves them to
+// NotImplementedFileSystem.
+type syncDirFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// Receive each sync, and then its result.
+	syncs   chan *fuseops.SyncDirOp
+	results chan error
+}
+
+const syncDirHandle = 17
+
+func (fs *syncDirFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0777 | os.ModeDir}
+	return nil
+}
+
+func (fs *syncDirFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	op.Handle = syncDirHandle
+	return nil
+}
+
+func (fs *syncDirFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+func (fs *syncDirFS) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	if fs.syncs == nil {
+		return fs.NotImplementedFileSystem.SyncDir(ctx, op)
+	}
+
+	fs.syncs <- op
+	return <-fs.results
+}
+
+// Mount fs and open its root directory, returning the descriptor and a
+// function that closes it and unmounts.
+func openSyncDir(t *testing.T, fs *syncDirFS) (fd int, cleanup func()) {
+	dir, err := ioutil.TempDir("", "sync_dir_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{FSName: "syncdirfs"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Skipf("Mount: %v", err)
+	}
+
+	unmount := func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+
+		os.RemoveAll(dir)
+	}
+
+	// Not os.Open, which would have the runtime poll the directory.
+	fd, err = syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		unmount()
+		t.Fatalf("Open: %v", err)
+	}
+
+	return fd, func() {
+		syscall.Close(fd)
+		unmount()
+	}
+}
+
+func TestSyncDir(t *testing.T) {
+	fs := &syncDirFS{
+		syncs:   make(chan *fuseops.SyncDirOp),
+		results: make(chan error),
+	}
+
+	fd, cleanup := openSyncDir(t, fs)
+	defer cleanup()
+
+	testCases := []struct {
+		name     string
+		sync     func() error
+		dataOnly bool
+		result   error
+	}{
+		{"fsync", func() error { return syscall.Fsync(fd) }, false, nil},
+		{"fdatasync", func() error { return syscall.Fdatasync(fd) }, true, nil},
+		{"failing fsync", func() error { return syscall.Fsync(fd) }, false, syscall.EIO},
+	}
+
+	for _, tc := range testCases {
+		done := make(chan error, 1)
+		go func() { done <- tc.sync() }()
+
+		// The file system sees the sync, on the handle it minted, while the
+		// syscall waits for it.
+		var op *fuseops.SyncDirOp
+		select {
+		case op = <-fs.syncs:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: timed out waiting for SyncDir", tc.name)
+		}
+
+		if op.Inode != fuseops.RootInodeID ||
+			op.Handle != syncDirHandle ||
+			op.DataOnly != tc.dataOnly {
+			t.Errorf(
+				"%s: got inode %d, handle %d and DataOnly %v",
+				tc.name,
+				op.Inode,
+				op.Handle,
+				op.DataOnly)
+		}
+
+		select {
+		case err := <-done:
+			t.Fatalf("%s returned %v before SyncDir did", tc.name, err)
+
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		fs.results <- tc.result
+		if err := <-done; err != tc.result {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.result)
+		}
+	}
+}
+
+func TestSyncDir_NotImplemented(t *testing.T) {
+	// Linux turns ENOSYS into success too, but remembers it and stops sending
+	// the op, so check the file system's answer itself.
+	var fs fuseutil.NotImplementedFileSystem
+	if err := fs.SyncDir(context.Background(), &fuseops.SyncDirOp{}); err != nil {
+		t.Errorf("NotImplementedFileSystem.SyncDir: %v", err)
+	}
+
+	fd, cleanup := openSyncDir(t, &syncDirFS{})
+	defer cleanup()
+
+	if err := syscall.Fsync(fd); err != nil {
+		t.Errorf("Fsync: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with a single file, "f", whose syncs wait for the test to
+// answer them.
+type syncFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// Receive each sync, and then its result.
+	syncs   chan *fuseops.SyncFileOp
+	results chan error
+}
+
+const syncFileID = fuseops.RootInodeID + 1
+
+func (fs *syncFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	if id == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0777 | os.ModeDir}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0666}
+}
+
+func (fs *syncFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "f" {
+		return syscall.ENOENT
+	}
+
+	op.Entry.Child = syncFileID
+	op.Entry.Attributes = fs.attributes(syncFileID)
+	return nil
+}
+
+func (fs *syncFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+// Called by fsync(2) with the writeback cache, to write back times.
+func (fs *syncFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *syncFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *syncFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func (fs *syncFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.syncs <- op
+	return <-fs.results
+}
+
+func (fs *syncFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *syncFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func TestSyncFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync_file_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	fs := &syncFS{
+		syncs:   make(chan *fuseops.SyncFileOp),
+		results: make(chan error),
+	}
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{FSName: "syncfs"})
+	if err != nil {
+		t.Skipf("Mount: %v", err)
+	}
+
+	defer func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	}()
+
+	// Not os.OpenFile, which would have the runtime poll the file.
+	fd, err := syscall.Open(path.Join(dir, "f"), syscall.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer syscall.Close(fd)
+
+	if _, err := syscall.Write(fd, []byte("taco")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		sync     func() error
+		dataOnly bool
+		result   error
+	}{
+		{"fsync", func() error { return syscall.Fsync(fd) }, false, nil},
+		{"fdatasync", func() error { return syscall.Fdatasync(fd) }, true, nil},
+		{"failing fsync", func() error { return syscall.Fsync(fd) }, false, syscall.EIO},
+	}
+
+	for _, tc := range testCases {
+		done := make(chan error, 1)
+		go func() { done <- tc.sync() }()
+
+		// The file system sees the sync while the syscall waits for it.
+		var op *fuseops.SyncFileOp
+		select {
+		case op = <-fs.syncs:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: timed out waiting for SyncFile", tc.name)
+		}
+
+		if op.Inode != syncFileID || op.DataOnly != tc.dataOnly {
+			t.Errorf("%s: got inode %d and DataOnly %v", tc.name, op.Inode, op.DataOnly)
+		}
+
+		select {
+		case err := <-done:
+			t.Fatalf("%s returned %v before SyncFile did", tc.name, err)
+
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		fs.results <- tc.result
+		if err := <-done; err != tc.result {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.result)
+		}
+	}
+}
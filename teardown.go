@@ -0,0 +1,128 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import "syscall"
+
+// A connection winds down in this order:
+//
+//  1. The kernel hangs up. Either reading from the device fails with ENODEV
+//     (the usual case for fuse mounts once unmounted or aborted), a reply
+//     fails with ENOTCONN or ENODEV, or the kernel sends DESTROY (for fuseblk
+//     mounts, and as the last request before an unmount completes).
+//
+//  2. ReadOp hands out nothing more, returning io.EOF. If
+//     MountConfig.CancelOnUnmount is set, the contexts of the ops still in
+//     flight are cancelled.
+//
+//  3. The server waits for the ops in flight to be replied to, which it must
+//     not return from ServeOps before doing. Their replies are discarded
+//     rather than written, since the kernel is no longer waiting for them.
+//     fuseutil's servers then call FileSystem.Destroy.
+//
+//  4. Once ServeOps returns, the connection waits (again) for any replies
+//     still outstanding, so that none is written to a closed device, answers
+//     DESTROY if the kernel sent it, and closes the device. Join then
+//     returns: nil after an unmount, and ErrAborted if the connection was
+//     aborted.
+
+// Record err as the reason serving ended, unless there already is one.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) noteServeError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.serveErr == nil {
+		c.serveErr = err
+	}
+}
+
+// Having found that the kernel hung up, record ErrAborted if that is because
+// the connection was aborted rather than the file system unmounted. An aborted
+// mount is left in place, and fails every access with ENOTCONN; there is
+// nothing else to tell the two apart by. Accessing it doesn't reach us, since
+// the kernel no longer sends anything on the connection.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) checkAborted() {
+	if c.mountInfo.Dir == "" {
+		return
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(c.mountInfo.Dir, &st); err == syscall.ENOTCONN {
+		c.noteServeError(ErrAborted)
+	}
+}
+
+// Note that the kernel is done with the connection, so that nothing more is
+// read from it or written to it, and if configured, cancel the ops in flight.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) hangUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.hungUp {
+		return
+	}
+
+	c.hungUp = true
+	if c.cfg.CancelOnUnmount {
+		for _, f := range c.inFlight {
+			f.cancel()
+		}
+	}
+}
+
+// Hang up in response to the kernel's DESTROY request with the given ID,
+// which is answered by finishTeardown.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) handleDestroy(fuseID uint64) {
+	c.mu.Lock()
+	c.destroyID = fuseID
+	c.mu.Unlock()
+
+	c.hangUp()
+}
+
+// Wait for all ops that have been handed out to be replied to, then answer
+// DESTROY if the kernel sent it. The kernel may block an unmount until then,
+// so that the file system has finished with its data once umount(8) returns.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) finishTeardown() {
+	c.mu.Lock()
+	for c.inFlightBytes > 0 {
+		c.memoryReleased.Wait()
+	}
+
+	fuseID := c.destroyID
+	c.mu.Unlock()
+
+	if fuseID == 0 {
+		return
+	}
+
+	m := c.getOutMessage()
+	defer c.putOutMessage(m)
+
+	c.kernelResponse(m, fuseID, &destroyOp{}, nil)
+	if err := c.writeMessage(m.Bytes()); err != nil && c.errorLogger != nil {
+		c.errorLogger.Printf("Op 0x%08x: writing reply for DESTROY: %v", fuseID, err)
+	}
+}
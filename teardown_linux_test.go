@@ -0,0 +1,380 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system with a single file, "f", that takes its time over writes. If
+// block is set, writes wait until their contexts are cancelled or release is
+// closed.
+type teardownFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	block   bool
+	release chan struct{}
+
+	mu        sync.Mutex
+	writes    int  // GUARDED_BY(mu)
+	active    int  // GUARDED_BY(mu)
+	cancelled int  // GUARDED_BY(mu)
+	destroyed bool // GUARDED_BY(mu)
+
+	// Complaints about the order in which things happened.
+	errs []string // GUARDED_BY(mu)
+}
+
+const teardownFileID = fuseops.RootInodeID + 1
+
+func (fs *teardownFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	if id == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0777 | os.ModeDir}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0666}
+}
+
+func (fs *teardownFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Parent != fuseops.RootInodeID || op.Name != "f" {
+		return syscall.ENOENT
+	}
+
+	op.Entry.Child = teardownFileID
+	op.Entry.Attributes = fs.attributes(teardownFileID)
+	return nil
+}
+
+func (fs *teardownFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *teardownFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *teardownFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	fs.writes++
+	fs.active++
+	if fs.destroyed {
+		fs.errs = append(fs.errs, "Write after Destroy")
+	}
+	fs.mu.Unlock()
+
+	defer func() {
+		fs.mu.Lock()
+		fs.active--
+		fs.mu.Unlock()
+	}()
+
+	wait := time.After(time.Millisecond)
+	if fs.block {
+		wait = nil
+	}
+
+	select {
+	case <-wait:
+		return nil
+
+	case <-fs.release:
+		return nil
+
+	case <-ctx.Done():
+		fs.mu.Lock()
+		fs.cancelled++
+		fs.mu.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+func (fs *teardownFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	return nil
+}
+
+func (fs *teardownFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+func (fs *teardownFS) Destroy() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.active != 0 {
+		fs.errs = append(fs.errs, fmt.Sprintf("Destroy with %d writes in flight", fs.active))
+	}
+
+	if fs.destroyed {
+		fs.errs = append(fs.errs, "Destroy called twice")
+	}
+
+	fs.destroyed = true
+}
+
+// Wait for the number of writes the file system has seen to exceed n,
+// returning the number.
+func (fs *teardownFS) awaitWrites(
+	t *testing.T,
+	n int) int {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		fs.mu.Lock()
+		writes := fs.writes
+		fs.mu.Unlock()
+
+		if writes > n {
+			return writes
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("Timed out waiting for more than %d writes", n)
+	return 0
+}
+
+// Mount a teardownFS with the given configuration, start dd writing to its
+// file, and wait for the writes to arrive.
+func startTeardown(
+	t *testing.T,
+	fs *teardownFS,
+	cfg *fuse.MountConfig) (mfs *fuse.MountedFileSystem, dd *exec.Cmd) {
+	dir, err := ioutil.TempDir("", "teardown_test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+
+	cfg.FSName = "teardown"
+	mfs, err = fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), cfg)
+	if err != nil {
+		os.Remove(dir)
+		t.Fatalf("Mount: %v", err)
+	}
+
+	dd = exec.Command(
+		"dd",
+		"if=/dev/zero",
+		"of="+path.Join(dir, "f"),
+		"bs=4096",
+		"count=1000000",
+		"conv=notrunc")
+
+	if err := dd.Start(); err != nil {
+		fuse.Unmount(dir)
+		os.Remove(dir)
+		t.Fatalf("Starting dd: %v", err)
+	}
+
+	fs.awaitWrites(t, 0)
+	return mfs, dd
+}
+
+// Join the file system, which must come to an end with the given error (nil
+// for a clean unmount), and check that everything happened in order and
+// nothing was left running.
+func finishTeardown(
+	t *testing.T,
+	fs *teardownFS,
+	mfs *fuse.MountedFileSystem,
+	goroutines int,
+	wantErr error) {
+	defer os.Remove(mfs.Dir())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := mfs.Join(ctx); err != wantErr {
+		t.Fatalf("Join: got %v, want %v", err, wantErr)
+	}
+
+	fs.mu.Lock()
+	if !fs.destroyed {
+		t.Errorf("Join returned before Destroy")
+	}
+
+	for _, err := range fs.errs {
+		t.Error(err)
+	}
+	fs.mu.Unlock()
+
+	// Give the goroutines serving the connection a moment to exit.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := runtime.NumGoroutine(); n > goroutines {
+		buf := make([]byte, 1<<20)
+		t.Errorf(
+			"%d goroutines left over, %d before mounting:\n%s",
+			n,
+			goroutines,
+			buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestTeardown_UnmountDuringWrites(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	fs := &teardownFS{}
+	mfs, dd := startTeardown(t, fs, &fuse.MountConfig{})
+
+	// The file is open, so the file system can't be unmounted, and carries
+	// on serving.
+	if err := fuse.Unmount(mfs.Dir()); err == nil {
+		t.Errorf("Unmounted with a file open")
+	}
+
+	fs.awaitWrites(t, fs.awaitWrites(t, 0))
+
+	dd.Process.Kill()
+	dd.Wait()
+
+	if err := mfs.Unmount(); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	finishTeardown(t, fs, mfs, goroutines, nil)
+}
+
+func TestTeardown_LazyUnmountDuringWrites(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+
+	fs := &teardownFS{}
+	mfs, dd := startTeardown(t, fs, &fuse.MountConfig{})
+
+	if out, err := exec.Command("fusermount", "-u", "-z", mfs.Dir()).CombinedOutput(); err != nil {
+		dd.Process.Kill()
+		dd.Wait()
+		fuse.Unmount(mfs.Dir())
+		t.Fatalf("fusermount -u -z: %v: %s", err, out)
+	}
+
+	// The file system is detached, but serves dd until it closes the file.
+	fs.awaitWrites(t, fs.awaitWrites(t, 0))
+
+	select {
+	case <-joined(mfs):
+		t.Errorf("Joined while dd still had the file open")
+	default:
+	}
+
+	dd.Process.Kill()
+	dd.Wait()
+
+	finishTeardown(t, fs, mfs, goroutines, nil)
+}
+
+// Return a channel closed once mfs has been joined.
+func joined(mfs *fuse.MountedFileSystem) <-chan struct{} {
+	c := make(chan struct{})
+	go func() {
+		mfs.Join(context.Background())
+		close(c)
+	}()
+
+	return c
+}
+
+// Abort the connection serving the file system mounted on dir, skipping the
+// test if that isn't possible.
+func abortConnection(
+	t *testing.T,
+	dir string) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	// Connections are named after the minor device number of the mount.
+	minor := (st.Dev & 0xff) | ((st.Dev >> 12) & 0xfff00)
+	abort := fmt.Sprintf("/sys/fs/fuse/connections/%d/abort", minor)
+	if err := ioutil.WriteFile(abort, []byte("1"), 0); err != nil {
+		t.Skipf("Can't abort the connection: %v", err)
+	}
+}
+
+func TestTeardown_AbortDuringWrites(t *testing.T) {
+	for _, cancelOnUnmount := range []bool{true, false} {
+		t.Run(fmt.Sprintf("CancelOnUnmount=%v", cancelOnUnmount), func(t *testing.T) {
+			goroutines := runtime.NumGoroutine()
+
+			fs := &teardownFS{block: true, release: make(chan struct{})}
+			mfs, dd := startTeardown(t, fs, &fuse.MountConfig{CancelOnUnmount: cancelOnUnmount})
+
+			abortConnection(t, mfs.Dir())
+
+			// dd fails once the kernel gives up on its write.
+			if err := dd.Wait(); err == nil {
+				t.Errorf("dd succeeded")
+			}
+
+			// Without cancellation, the write carries on until it is done.
+			if !cancelOnUnmount {
+				select {
+				case <-joined(mfs):
+					t.Errorf("Joined with a write in flight")
+
+				case <-time.After(50 * time.Millisecond):
+				}
+
+				close(fs.release)
+			}
+
+			// Join tells this apart from an unmount.
+			finishTeardown(t, fs, mfs, goroutines, fuse.ErrAborted)
+			fuse.Unmount(mfs.Dir())
+
+			fs.mu.Lock()
+			defer fs.mu.Unlock()
+
+			if cancelOnUnmount && fs.cancelled == 0 {
+				t.Errorf("No write was cancelled")
+			}
+
+			if !cancelOnUnmount && fs.cancelled != 0 {
+				t.Errorf("%d writes were cancelled", fs.cancelled)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// The limits Linux places on extended attributes (XATTR_NAME_MAX and
+// XATTR_SIZE_MAX), which are also enforced here so that file systems see the
+// same behavior on every platform.
+const (
+	maxXattrNameLength = 255
+	maxXattrValueSize  = 1 << 16
+)
+
+// The extended attribute through which macOS exposes a file's resource fork,
+// which is exempt from the limit on value sizes there.
+const resourceForkXattr = "com.apple.ResourceFork"
+
+// Return the error with which op should be failed without involving the user
+// because it exceeds the limits on extended attributes, or zero if it
+// doesn't: ERANGE for names that are too long, and E2BIG for values that are
+// too large. Zero-length names and values are fine.
+func xattrError(op interface{}) syscall.Errno {
+	var name string
+	switch o := op.(type) {
+	case *fuseops.GetXattrOp:
+		name = o.Name
+
+	case *fuseops.RemoveXattrOp:
+		name = o.Name
+
+	case *fuseops.SetXattrOp:
+		name = o.Name
+		if len(o.Value) > maxXattrValueSize && name != resourceForkXattr {
+			return syscall.E2BIG
+		}
+
+	default:
+		return 0
+	}
+
+	if len(name) > maxXattrNameLength {
+		return syscall.ERANGE
+	}
+
+	return 0
+}
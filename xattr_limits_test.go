@@ -0,0 +1,138 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/samples/memfs"
+)
+
+// Set an extended attribute of the root the way the kernel would.
+func setXattr(
+	k *fusetesting.FakeKernel,
+	name string,
+	value []byte) error {
+	var in fusekernel.SetxattrIn
+	in.Size = uint32(len(value))
+
+	body := append([]byte(nil), (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:]...)
+	body = append(body, name...)
+	body = append(body, 0)
+	body = append(body, value...)
+
+	_, err := k.Call(fusekernel.OpSetxattr, uint64(fuseops.RootInodeID), body)
+	return err
+}
+
+// Fetch the size of an extended attribute of the root the way the kernel
+// would, and then its value.
+func getXattr(
+	k *fusetesting.FakeKernel,
+	name string) ([]byte, error) {
+	var in fusekernel.GetxattrIn
+	call := func() ([]byte, error) {
+		body := append([]byte(nil), (*[unsafe.Sizeof(in)]byte)(unsafe.Pointer(&in))[:]...)
+		body = append(body, name...)
+		body = append(body, 0)
+
+		return k.Call(fusekernel.OpGetxattr, uint64(fuseops.RootInodeID), body)
+	}
+
+	out, err := call()
+	if err != nil {
+		return nil, err
+	}
+
+	in.Size = (*fusekernel.GetxattrOut)(unsafe.Pointer(&out[0])).Size
+	if in.Size == 0 {
+		return []byte{}, nil
+	}
+
+	return call()
+}
+
+func TestXattrLimits(t *testing.T) {
+	k, err := fusetesting.NewFakeKernel(
+		memfs.NewMemFS(uint32(os.Getuid()), uint32(os.Getgid())),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	longName := strings.Repeat("n", 255)
+	large := bytes.Repeat([]byte("v"), 1<<16)
+	tooLarge := bytes.Repeat([]byte("v"), 1<<16+1)
+
+	testCases := []struct {
+		name    string
+		value   []byte
+		wantErr error
+	}{
+		// The shortest name, and an empty value.
+		{"a", []byte{}, nil},
+		{"b", []byte("x"), nil},
+
+		// Right at the limits.
+		{longName, large, nil},
+
+		// Beyond them.
+		{longName + "n", []byte("x"), syscall.ERANGE},
+		{"c", tooLarge, syscall.E2BIG},
+
+		// Except for the resource fork.
+		{"com.apple.ResourceFork", tooLarge, nil},
+	}
+
+	for _, tc := range testCases {
+		if err := setXattr(k, tc.name, tc.value); err != tc.wantErr {
+			t.Errorf("setXattr(%d-byte name, %d bytes): got %v, want %v", len(tc.name), len(tc.value), err, tc.wantErr)
+			continue
+		}
+
+		wantErr := tc.wantErr
+		if wantErr == syscall.E2BIG {
+			// The file system never saw it.
+			wantErr = fuse.ENOATTR
+		}
+
+		value, err := getXattr(k, tc.name)
+		if err != wantErr {
+			t.Errorf("getXattr(%d-byte name): got %v, want %v", len(tc.name), err, wantErr)
+			continue
+		}
+
+		if err == nil && (value == nil || !bytes.Equal(value, tc.value)) {
+			t.Errorf("getXattr(%d-byte name): got %d bytes, want %d", len(tc.name), len(value), len(tc.value))
+		}
+	}
+
+	// An empty value is distinct from no value.
+	if _, err := getXattr(k, "d"); err != fuse.ENOATTR {
+		t.Errorf("getXattr(missing): got %v, want ENOATTR", err)
+	}
+}